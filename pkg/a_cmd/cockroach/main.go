@@ -1,6 +1,10 @@
 package main
 
-import cli "github.com/dborchard/tiny_crdb/pkg/b_cli"
+import (
+	cli "github.com/dborchard/tiny_crdb/pkg/b_cli"
+	// Register the resumer of the changefeed jobs.
+	_ "github.com/dborchard/tiny_crdb/pkg/f_sql/changefeedccl"
+)
 
 func main() {
 	cli.Main()
@@ -0,0 +1,39 @@
+package cli
+
+import "github.com/dborchard/tiny_crdb/pkg/c_server"
+
+// serverCfg is the configuration of the server started by the start
+// commands. Its fields are populated by the command-line flags.
+var serverCfg = server.MakeConfig()
+
+// storeUsage is the usage of the --store flag.
+const storeUsage = `The file path to a storage device. This flag must be specified separately
+for each storage device, for example:
+  --store=/mnt/ssd01 --store=/mnt/ssd02 --store=/mnt/hda1
+For each store, the "attrs" and "size" fields can be used to specify device
+attributes and a maximum store size. When one or both of these
+fields are set, the "path" field label must be used for the path to the
+storage device, for example:
+  --store=path=/mnt/ssd01,attrs=ssd,size=20GiB
+An in-memory store is specified with the "type=mem" field and a size:
+  --store=type=mem,size=1GiB
+If no --store is specified, a single in-memory store is used.`
+
+// listenAddrUsage is the usage of the --listen-addr flag.
+const listenAddrUsage = `The address/hostname and port to listen on for the RPCs of the other nodes,
+for example --listen-addr=myhost:26257. The other nodes dial the node at this
+address.`
+
+// maxOffsetUsage is the usage of the --max-offset flag.
+const maxOffsetUsage = `Maximum allowed clock offset for the cluster. If observed clock offsets exceed
+this limit, the requests carrying them are rejected, to minimize the likelihood
+of reading inconsistent data.
+Note that this value must be the same on all nodes in the cluster. In order to
+change it, every node in the cluster must be stopped and restarted with the new
+value.`
+
+func init() {
+	startSingleNodeCmd.Flags().Var(&serverCfg.Stores, "store", storeUsage)
+	startSingleNodeCmd.Flags().StringVar(&serverCfg.Addr, "listen-addr", serverCfg.Addr, listenAddrUsage)
+	startSingleNodeCmd.Flags().DurationVar(&serverCfg.MaxOffset, "max-offset", serverCfg.MaxOffset, maxOffsetUsage)
+}
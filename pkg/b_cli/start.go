@@ -76,9 +76,6 @@ func runStartInternal(
 		return err
 	}
 
-	var serverCfg = func() server.Config {
-		return server.Config{}
-	}()
 	// Beyond this point, the configuration is set and the server is
 	// ready to start.
 
@@ -186,6 +183,9 @@ func reportServerInfo(
 	serverCfg *server.Config,
 ) error {
 	fmt.Println("CockroachDB node started")
+	for i, spec := range serverCfg.Stores.Specs {
+		fmt.Printf("store[%d]:\t%s\n", i, spec)
+	}
 	return nil
 }
 
@@ -10,9 +10,16 @@ import (
 	"github.com/dborchard/tiny_crdb/pkg/f_sql/sessiondata"
 	kv "github.com/dborchard/tiny_crdb/pkg/g_kv"
 	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvclient/kvcoord"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/liveness"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	rpc "github.com/dborchard/tiny_crdb/pkg/g_rpc"
+	"github.com/dborchard/tiny_crdb/pkg/g_rpc/nodedialer"
 	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
 	"github.com/dborchard/tiny_crdb/pkg/z_util/netutil"
 	"github.com/dborchard/tiny_crdb/pkg/z_util/stop"
+	"google.golang.org/grpc"
 	"net"
 	"time"
 )
@@ -23,28 +30,63 @@ type topLevelServer struct {
 	cfg            Config
 	clock          *hlc.Clock
 	db             *kv.DB
+	nodeLiveness   *liveness.NodeLiveness
+	node           *Node
 	http           *httpServer
 	sqlServer      *SQLServer
 	startTime      time.Time
 	engines        Engines
 	authentication authserver.Server
 
+	rpcContext  *rpc.Context
+	grpcServer  *grpc.Server
+	stopTrigger *stopTrigger
+
 	pgL         net.Listener
 	loopbackPgL *netutil.LoopbackListener
 	pgServer    *pgwire.Server
 }
 
+// stopTrigger is used by the server to request its own shutdown.
+type stopTrigger struct {
+	c chan serverctl.ShutdownRequest
+}
+
+func newStopTrigger() *stopTrigger {
+	return &stopTrigger{c: make(chan serverctl.ShutdownRequest, 1)}
+}
+
+// signalStop requests the shutdown of the server. Only the first request is
+// delivered.
+func (st *stopTrigger) signalStop(req serverctl.ShutdownRequest) {
+	select {
+	case st.c <- req:
+	default:
+	}
+}
+
 func (s *topLevelServer) PreStart(ctx context.Context) error {
-	//// Start the RPC server. This opens the RPC/SQL listen socket,
-	//// and dispatches the server worker for the RPC.
-	//// The SQL listener is returned, to start the SQL server later
-	//// below when the server has initialized.
-	//pgL, loopbackPgL, rpcLoopbackDialFn, startRPCServer, err := startListenRPCAndSQL()
-	//if err != nil {
-	//	return err
-	//}
-	//s.pgL = pgL
-	//s.loopbackPgL = loopbackPgL
+	// Start the RPC server, through which the other nodes reach the node's
+	// stores.
+	if err := s.startServeRPC(ctx); err != nil {
+		return err
+	}
+
+	// Start the node's stores, bootstrapping the cluster's initial ranges
+	// on a fresh node, so that KV requests can be served.
+	if err := s.node.start(ctx, s.engines); err != nil {
+		return err
+	}
+	// Heartbeat the node's liveness record, on which the epoch-based leases
+	// of its stores depend.
+	if err := s.nodeLiveness.Start(ctx, s.node.nodeID); err != nil {
+		return err
+	}
+
+	if err := s.sqlServer.preStart(ctx); err != nil {
+		return err
+	}
+
 	s.pgServer.Start(ctx, s.stopper)
 
 	// Connect the HTTP endpoints. This also wraps the privileged HTTP
@@ -57,6 +99,25 @@ func (s *topLevelServer) PreStart(ctx context.Context) error {
 	return nil
 }
 
+// startServeRPC opens the RPC listen socket and serves the RPCs on it until
+// the server is stopped.
+func (s *topLevelServer) startServeRPC(ctx context.Context) error {
+	ln, err := net.Listen("tcp", s.cfg.Addr)
+	if err != nil {
+		return err
+	}
+	if err := s.stopper.RunAsyncTask(ctx, "serve-rpc", func(context.Context) {
+		_ = s.grpcServer.Serve(ln)
+	}); err != nil {
+		_ = ln.Close()
+		return err
+	}
+	return s.stopper.RunAsyncTask(ctx, "stop-rpc", func(context.Context) {
+		<-s.stopper.ShouldQuiesce()
+		s.grpcServer.Stop()
+	})
+}
+
 func (s *topLevelServer) AcceptInternalClients(ctx context.Context) error {
 	return s.stopper.RunAsyncTaskEx(ctx,
 		func(ctx context.Context) {
@@ -96,9 +157,10 @@ func (s *topLevelServer) AcceptClients(ctx context.Context) error {
 	panic("implement me")
 }
 
+// ShutdownRequested returns a channel on which the server requests its own
+// shutdown, such as when the node's clock is out of sync with the cluster.
 func (s *topLevelServer) ShutdownRequested() <-chan serverctl.ShutdownRequest {
-	//TODO implement me
-	panic("implement me")
+	return s.stopTrigger.c
 }
 
 // NewServer creates a Server from a server.Config.
@@ -108,9 +170,15 @@ func (s *topLevelServer) ShutdownRequested() <-chan serverctl.ShutdownRequest {
 func NewServer(cfg Config, stopper *stop.Stopper) (serverctl.ServerStartupInterface, error) {
 	ctx := context.Background()
 
-	clock, err := newClockFromConfig()
+	clock, err := newClockFromConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
 
 	engines, err := cfg.CreateEngines(ctx)
+	if err != nil {
+		return nil, err
+	}
 
 	// The Executor will be further initialized later, as we create more
 	// of the server's components. There's a circular dependency - many things
@@ -119,13 +187,60 @@ func NewServer(cfg Config, stopper *stop.Stopper) (serverctl.ServerStartupInterf
 	// Executor uses this one instance.
 	internalExecutor := &sql.InternalExecutor{}
 
+	// The node shuts itself down if its clock is found to be out of sync
+	// with the clocks of the cluster, since it could otherwise serve
+	// inconsistent reads.
+	stopTrigger := newStopTrigger()
+	rpcContext := rpc.NewContext(rpc.ContextOptions{
+		Clock:         clock,
+		Stopper:       stopper,
+		AdvertiseAddr: cfg.Addr,
+		OnClockOffsetViolation: func(ctx context.Context, err error) {
+			stopTrigger.signalStop(serverctl.MakeShutdownRequest(err))
+		},
+	})
+
+	storeCfg := kvserver.StoreConfig{
+		Clock:   clock,
+		Stopper: stopper,
+	}
+	node := NewNode(storeCfg, stopper, clock)
+	grpcServer := rpc.NewServer(rpcContext)
+	kvpb.RegisterInternalServer(grpcServer, node)
+	rpcContext.SetLocalInternalServer(node)
+	// The server runs a single node, so all the replicas of its ranges are
+	// local, and served without gRPC.
+	nodeDialer := nodedialer.New(rpcContext, func(roachpb.NodeID) (string, error) {
+		return cfg.Addr, nil
+	})
+
 	_dbCtx := kv.DefaultDBContext(stopper)
-	_distSender := kvcoord.NewDistSender()
-	_tcsFactory := kvcoord.NewTxnCoordSenderFactory(_distSender)
+	_distSender := kvcoord.NewDistSender(kvcoord.DistSenderConfig{
+		Clock:              clock,
+		Stopper:            stopper,
+		FirstRangeProvider: node,
+		TransportFactory:   kvcoord.GRPCTransportFactory(nodeDialer),
+	})
+	_tcsFactory := kvcoord.NewTxnCoordSenderFactory(kvcoord.TxnCoordSenderFactoryConfig{
+		Clock:   clock,
+		Stopper: stopper,
+	}, _distSender)
 	db := kv.NewDBWithContext(_tcsFactory, clock, _dbCtx)
+	// The stores use the DB to push conflicting transactions and to resolve
+	// their locks.
+	node.storeCfg.DB = db
+	nodeLiveness := liveness.NewNodeLiveness(liveness.NodeLivenessOptions{
+		DB:      db,
+		Clock:   clock,
+		Stopper: stopper,
+	})
+	node.storeCfg.NodeLiveness = nodeLiveness
 	insqlDB := sql.NewShimInternalDB(db)
 	sqlServer, err := newSQLServer(ctx, sqlServerArgs{
 		db:                       db,
+		clock:                    clock,
+		stopper:                  stopper,
+		distSender:               _distSender,
 		internalDB:               insqlDB,
 		circularInternalExecutor: internalExecutor,
 	})
@@ -141,16 +256,25 @@ func NewServer(cfg Config, stopper *stop.Stopper) (serverctl.ServerStartupInterf
 		clock:          clock,
 		stopper:        stopper,
 		db:             db,
+		nodeLiveness:   nodeLiveness,
+		node:           node,
 		sqlServer:      sqlServer,
 		http:           sHTTP,
 		startTime:      time.Now(),
 		engines:        engines,
 		authentication: sAuth,
+		rpcContext:     rpcContext,
+		grpcServer:     grpcServer,
+		stopTrigger:    stopTrigger,
 	}
 	return lateBoundServer, nil
 }
 
-func newClockFromConfig() (*hlc.Clock, error) {
-	var clock *hlc.Clock
-	return clock, nil
+// newClockFromConfig creates the HLC clock of the server, which enforces the
+// maximum clock offset of the configuration.
+func newClockFromConfig(cfg Config) (*hlc.Clock, error) {
+	if cfg.MaxOffset <= 0 {
+		return nil, fmt.Errorf("invalid --max-offset %s: must be positive", cfg.MaxOffset)
+	}
+	return hlc.NewClock(hlc.UnixNano, cfg.MaxOffset), nil
 }
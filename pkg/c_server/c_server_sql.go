@@ -3,10 +3,16 @@ package server
 import (
 	"context"
 	"github.com/dborchard/tiny_crdb/pkg/e_upgrade/upgrademanager"
+	jobs "github.com/dborchard/tiny_crdb/pkg/f_jobs"
 	sql "github.com/dborchard/tiny_crdb/pkg/f_sql"
 	pgwire "github.com/dborchard/tiny_crdb/pkg/f_sql/a_pgwire"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/contention"
 	isql "github.com/dborchard/tiny_crdb/pkg/f_sql/d_isql"
 	kv "github.com/dborchard/tiny_crdb/pkg/g_kv"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvclient/kvcoord"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvclient/rangefeed"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/stop"
 )
 
 // SQLServer encapsulates the part of a CRDB server that is dedicated to SQL
@@ -19,12 +25,20 @@ type SQLServer struct {
 	execCfg          *sql.ExecutorConfig
 	internalDB       *sql.InternalDB
 	internalExecutor *sql.InternalExecutor
+	jobRegistry      *jobs.Registry
 }
 
 func (S *SQLServer) ExecutorConfig() *sql.ExecutorConfig {
 	return S.execCfg
 }
 
+// preStart starts the background processes of the SQL server, once the KV
+// layer serves requests.
+func (s *SQLServer) preStart(ctx context.Context) error {
+	// Run the jobs of the node, and adopt those of the stopped nodes.
+	return s.jobRegistry.Start(ctx)
+}
+
 func (S *SQLServer) InternalExecutor() isql.Executor {
 	return S.internalExecutor
 }
@@ -32,6 +46,9 @@ func (S *SQLServer) InternalExecutor() isql.Executor {
 type sqlServerArgs struct {
 	internalDB               *sql.InternalDB
 	db                       *kv.DB
+	clock                    *hlc.Clock
+	stopper                  *stop.Stopper
+	distSender               *kvcoord.DistSender
 	circularInternalExecutor *sql.InternalExecutor
 }
 
@@ -39,7 +56,20 @@ type sqlServerArgs struct {
 // listening to the server's serverctl.ShutdownRequested() channel (which is the same as
 // cfg.stopTrigger.C()) and stopping cfg.stopper when signaled.
 func newSQLServer(ctx context.Context, cfg sqlServerArgs) (*SQLServer, error) {
-	execCfg := &sql.ExecutorConfig{}
+	execCfg := &sql.ExecutorConfig{
+		DB:                 cfg.db,
+		Clock:              cfg.clock,
+		Stopper:            cfg.stopper,
+		RangeFeedFactory:   rangefeed.NewFactory(cfg.stopper, cfg.db, cfg.distSender),
+		ContentionRegistry: contention.NewRegistry(contention.Config{}),
+	}
+	jobRegistry := jobs.MakeRegistry(jobs.RegistryConfig{
+		DB:      cfg.db,
+		Clock:   cfg.clock,
+		Stopper: cfg.stopper,
+		ExecCtx: execCfg,
+	})
+	execCfg.JobRegistry = jobRegistry
 
 	// Initialize the pgwire server which handles connections
 	// established via the pgPreServer.
@@ -61,7 +91,8 @@ func newSQLServer(ctx context.Context, cfg sqlServerArgs) (*SQLServer, error) {
 	execCfg.InternalDB = internalDB
 
 	return &SQLServer{
-		execCfg:    execCfg,
-		internalDB: cfg.internalDB,
+		execCfg:     execCfg,
+		internalDB:  cfg.internalDB,
+		jobRegistry: jobRegistry,
 	}, nil
 }
@@ -2,21 +2,291 @@ package server
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
 	"github.com/dborchard/tiny_crdb/pkg/h_storage"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// defaultInMemSize is the size of an in-memory store when none is
+// specified, such as for the default store.
+const defaultInMemSize = 512 << 20 // 512 MiB
+
+// DefaultStoreSpec is the store used when no --store flag is specified.
+var DefaultStoreSpec = StoreSpec{InMemory: true, Size: defaultInMemSize}
+
+// StoreSpec contains the details that can be specified in the cli pertaining
+// to the --store flag.
+type StoreSpec struct {
+	// Path is the directory of the store. It is empty for in-memory stores.
+	Path string
+	// Size is the maximum size of the store, in bytes. It is required for
+	// in-memory stores; for stores on the filesystem, zero means that the
+	// store may use the entire filesystem.
+	Size       int64
+	InMemory   bool
+	Attributes roachpb.Attributes
+}
+
+// String returns a fully parsable version of the store spec.
+func (ss StoreSpec) String() string {
+	var buffer strings.Builder
+	if len(ss.Path) != 0 {
+		fmt.Fprintf(&buffer, "path=%s,", ss.Path)
+	}
+	if ss.InMemory {
+		fmt.Fprint(&buffer, "type=mem,")
+	}
+	if ss.Size > 0 {
+		fmt.Fprintf(&buffer, "size=%d,", ss.Size)
+	}
+	if len(ss.Attributes.Attrs) > 0 {
+		fmt.Fprintf(&buffer, "attrs=%s,", strings.Join(ss.Attributes.Attrs, ":"))
+	}
+	// Trim the extra comma from the end if it exists.
+	return strings.TrimSuffix(buffer.String(), ",")
+}
+
+// NewStoreSpec parses the string passed into a --store flag and returns a
+// StoreSpec if it is correctly parsed.
+// There are four possible fields that can be passed in, comma separated:
+//   - path=xxx The directory in which the store's data is kept.
+//   - type=mem This specifies that the store is an in memory storage instead
+//     of an on disk one. mem is currently the only other type available.
+//   - size=xxx[B|KB|KiB|MB|MiB|GB|GiB|TB|TiB] The maximum size of the store.
+//     It is required for in memory stores.
+//   - attrs=xxx:yyy:zzz A colon separated list of optional attributes.
+//
+// A spec which is not made of fields, such as "/mnt/ssd1", is the path of the
+// store.
+func NewStoreSpec(value string) (StoreSpec, error) {
+	const pathField = "path"
+	if len(value) == 0 {
+		return StoreSpec{}, errors.New("no value specified")
+	}
+	var ss StoreSpec
+	used := make(map[string]struct{})
+	for _, split := range strings.Split(value, ",") {
+		if len(split) == 0 {
+			continue
+		}
+		subSplits := strings.SplitN(split, "=", 2)
+		var field string
+		var value string
+		if len(subSplits) == 1 {
+			field = pathField
+			value = subSplits[0]
+		} else {
+			field = strings.ToLower(subSplits[0])
+			value = subSplits[1]
+		}
+		if _, ok := used[field]; ok {
+			return StoreSpec{}, fmt.Errorf("%s field was used twice in store definition", field)
+		}
+		used[field] = struct{}{}
+
+		if len(field) == 0 {
+			continue
+		}
+		if len(value) == 0 {
+			return StoreSpec{}, fmt.Errorf("no value specified for %s", field)
+		}
+
+		switch field {
+		case pathField:
+			ss.Path = value
+		case "size":
+			size, err := parseStoreSize(value)
+			if err != nil {
+				return StoreSpec{}, fmt.Errorf("could not parse store size (%s): %w", value, err)
+			}
+			ss.Size = size
+		case "attrs":
+			// Check to make sure there are no duplicate attributes.
+			attrMap := make(map[string]struct{})
+			for _, attribute := range strings.Split(value, ":") {
+				if _, ok := attrMap[attribute]; ok {
+					return StoreSpec{}, fmt.Errorf("duplicate attribute given for store: %s", attribute)
+				}
+				attrMap[attribute] = struct{}{}
+			}
+			for attribute := range attrMap {
+				ss.Attributes.Attrs = append(ss.Attributes.Attrs, attribute)
+			}
+			sort.Strings(ss.Attributes.Attrs)
+		case "type":
+			if value == "mem" {
+				ss.InMemory = true
+			} else {
+				return StoreSpec{}, fmt.Errorf("%s is not a valid store type", value)
+			}
+		default:
+			return StoreSpec{}, fmt.Errorf("%s is not a valid store field", field)
+		}
+	}
+	if ss.InMemory {
+		// Only in memory stores don't need a path and require a size.
+		if ss.Path != "" {
+			return StoreSpec{}, errors.New("path specified for in memory store")
+		}
+		if ss.Size == 0 {
+			return StoreSpec{}, errors.New("size must be specified for an in memory store")
+		}
+	} else if ss.Path == "" {
+		return StoreSpec{}, errors.New("no path specified")
+	}
+	return ss, nil
+}
+
+// storeSizeUnits are the units accepted in store sizes, with their size in
+// bytes.
+var storeSizeUnits = map[string]int64{
+	"":    1,
+	"b":   1,
+	"kb":  1e3,
+	"kib": 1 << 10,
+	"mb":  1e6,
+	"mib": 1 << 20,
+	"gb":  1e9,
+	"gib": 1 << 30,
+	"tb":  1e12,
+	"tib": 1 << 40,
+}
+
+// parseStoreSize parses a human-readable store size, such as "20GiB", into a
+// number of bytes.
+func parseStoreSize(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	i := strings.IndexFunc(value, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if i == -1 {
+		i = len(value)
+	}
+	unit, ok := storeSizeUnits[strings.ToLower(strings.TrimSpace(value[i:]))]
+	if !ok {
+		return 0, fmt.Errorf("unknown unit %q", value[i:])
+	}
+	n, err := strconv.ParseFloat(value[:i], 64)
+	if err != nil {
+		return 0, err
+	}
+	size := int64(n * float64(unit))
+	if size <= 0 {
+		return 0, errors.New("size must be positive")
+	}
+	return size, nil
+}
+
+// StoreSpecList contains a slice of StoreSpecs that implements pflag's value
+// interface.
+type StoreSpecList struct {
+	Specs   []StoreSpec
+	updated bool // updated is used to determine if specs only contain the default value.
+}
+
+// String returns a string representation of all the StoreSpecs. This is part
+// of pflag's value interface.
+func (ssl StoreSpecList) String() string {
+	var buffer strings.Builder
+	for _, ss := range ssl.Specs {
+		fmt.Fprintf(&buffer, "--store=%s ", ss)
+	}
+	// Trim the extra space from the end if it exists.
+	return strings.TrimSuffix(buffer.String(), " ")
+}
+
+// Type returns the underlying type in string form. This is part of pflag's
+// value interface.
+func (ssl *StoreSpecList) Type() string {
+	return "StoreSpec"
+}
+
+// Set adds a new value to the StoreSpecValue. It is the important part of
+// pflag's value interface. The specs given on the command line replace the
+// default store.
+func (ssl *StoreSpecList) Set(value string) error {
+	spec, err := NewStoreSpec(value)
+	if err != nil {
+		return err
+	}
+	if !ssl.updated {
+		ssl.Specs = []StoreSpec{spec}
+		ssl.updated = true
+	} else {
+		ssl.Specs = append(ssl.Specs, spec)
+	}
+	return nil
+}
+
+// DefaultMaxClockOffset is the default maximum acceptable clock offset value.
+// On Azure, clock offsets between 250ms and 500ms are common. On AWS and GCE,
+// clock offsets generally stay below 250ms.
+const DefaultMaxClockOffset = 500 * time.Millisecond
+
+// DefaultAddr is the default address at which the node serves RPCs.
+const DefaultAddr = "localhost:26257"
+
 // Config holds the parameters needed to set up a combined KV and SQL server.
 type Config struct {
+	// Stores is specified to enable durable key-value storage.
+	Stores StoreSpecList
+
+	// Addr is the address at which the node serves the RPCs of the other
+	// nodes.
+	Addr string
+
+	// MaxOffset is the maximum clock offset for the cluster. The node rejects
+	// the requests carrying clock readings which are further ahead of its
+	// own clock.
+	MaxOffset time.Duration
+}
+
+// MakeConfig returns a Config with default values, i.e. with the default
+// store, address and maximum clock offset.
+func MakeConfig() Config {
+	return Config{
+		Stores:    StoreSpecList{Specs: []StoreSpec{DefaultStoreSpec}},
+		Addr:      DefaultAddr,
+		MaxOffset: DefaultMaxClockOffset,
+	}
 }
 
 // Engines is a container of engines, allowing convenient closing.
 type Engines []storage.Engine
 
+// Close closes all the Engines.
+func (e *Engines) Close() {
+	for _, eng := range *e {
+		eng.Close()
+	}
+	*e = nil
+}
+
 // CreateEngines creates Engines based on the specs in cfg.Stores.
 func (cfg *Config) CreateEngines(ctx context.Context) (Engines, error) {
-	var location storage.Location
+	if len(cfg.Stores.Specs) == 0 {
+		return nil, errors.New("no stores specified")
+	}
 	var engines Engines
-	eng, _ := storage.Open(ctx, location)
-	engines = append(engines, eng)
+	for i, spec := range cfg.Stores.Specs {
+		location := storage.InMemory()
+		if !spec.InMemory {
+			location = storage.Filesystem(spec.Path)
+		}
+		eng, err := storage.Open(ctx, location,
+			storage.MaxSize(spec.Size),
+			storage.Attributes(spec.Attributes),
+		)
+		if err != nil {
+			engines.Close()
+			return nil, fmt.Errorf("store %d (%s): %w", i, spec, err)
+		}
+		engines = append(engines, eng)
+	}
 	return engines, nil
 }
@@ -0,0 +1,67 @@
+package server
+
+import (
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestNewStoreSpec(t *testing.T) {
+	testCases := []struct {
+		value    string
+		expected StoreSpec
+		err      string
+	}{
+		{"/mnt/hda1", StoreSpec{Path: "/mnt/hda1"}, ""},
+		{"path=/mnt/hda1", StoreSpec{Path: "/mnt/hda1"}, ""},
+		{"attrs=ssd,path=/mnt/ssd1", StoreSpec{
+			Path: "/mnt/ssd1", Attributes: roachpb.Attributes{Attrs: []string{"ssd"}},
+		}, ""},
+		{"path=/mnt/ssd1,attrs=ssd:hdd,size=20GiB", StoreSpec{
+			Path:       "/mnt/ssd1",
+			Size:       20 << 30,
+			Attributes: roachpb.Attributes{Attrs: []string{"hdd", "ssd"}},
+		}, ""},
+		{"type=mem,size=1.5GB", StoreSpec{InMemory: true, Size: 1.5e9}, ""},
+		{"type=mem,size=1024", StoreSpec{InMemory: true, Size: 1024}, ""},
+
+		{"", StoreSpec{}, "no value specified"},
+		{"size=20GiB", StoreSpec{}, "no path specified"},
+		{"type=mem", StoreSpec{}, "size must be specified for an in memory store"},
+		{"type=mem,path=/mnt/hda1,size=1GiB", StoreSpec{}, "path specified for in memory store"},
+		{"type=ssd,path=/mnt/hda1", StoreSpec{}, "ssd is not a valid store type"},
+		{"path=/mnt/hda1,path=/mnt/hda2", StoreSpec{}, "path field was used twice"},
+		{"path=/mnt/hda1,attrs=ssd:ssd", StoreSpec{}, "duplicate attribute given for store: ssd"},
+		{"path=/mnt/hda1,size=20XB", StoreSpec{}, "could not parse store size"},
+		{"path=/mnt/hda1,color=blue", StoreSpec{}, "color is not a valid store field"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.value, func(t *testing.T) {
+			spec, err := NewStoreSpec(tc.value)
+			if tc.err != "" {
+				require.ErrorContains(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, spec)
+			// The spec round-trips through its string representation.
+			reparsed, err := NewStoreSpec(spec.String())
+			require.NoError(t, err)
+			require.Equal(t, spec, reparsed)
+		})
+	}
+}
+
+// TestStoreSpecListSet verifies that the --store flags replace the default
+// store.
+func TestStoreSpecListSet(t *testing.T) {
+	cfg := MakeConfig()
+	require.Equal(t, []StoreSpec{DefaultStoreSpec}, cfg.Stores.Specs)
+	require.NoError(t, cfg.Stores.Set("/mnt/hda1"))
+	require.NoError(t, cfg.Stores.Set("type=mem,size=1GiB"))
+	require.Equal(t, []StoreSpec{
+		{Path: "/mnt/hda1"},
+		{InMemory: true, Size: 1 << 30},
+	}, cfg.Stores.Specs)
+	require.Equal(t, "--store=path=/mnt/hda1 --store=type=mem,size=1073741824", cfg.Stores.String())
+}
@@ -0,0 +1,234 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	keys "github.com/dborchard/tiny_crdb/pkg/g_keys"
+	kv "github.com/dborchard/tiny_crdb/pkg/g_kv"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/kvstorage"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/dborchard/tiny_crdb/pkg/h_storage"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/stop"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/uuid"
+)
+
+// A Node manages a map of stores (by store ID) for which it serves
+// traffic. A node is the top-level data structure. There is one node
+// instance per process. A node accepts incoming RPCs and services
+// them by directing the commands contained within RPCs to local
+// stores, which in turn direct the commands to specific ranges. Each
+// node has access to the global, monolithic Key-Value abstraction via
+// its client.DB reference. Nodes use this to allocate node and store
+// IDs for bootstrapping the node itself or initializing new stores as
+// they're added on subsequent instantiations.
+type Node struct {
+	stopper   *stop.Stopper
+	clock     *hlc.Clock
+	clusterID uuid.UUID
+	nodeID    roachpb.NodeID
+	storeCfg  kvserver.StoreConfig // Config to use and pass to stores
+	stores    *kvserver.Stores     // Access to node-local stores
+}
+
+var _ kv.Sender = &Node{}
+
+// NewNode returns a new instance of Node.
+func NewNode(cfg kvserver.StoreConfig, stopper *stop.Stopper, clock *hlc.Clock) *Node {
+	return &Node{
+		stopper:  stopper,
+		clock:    clock,
+		storeCfg: cfg,
+		stores:   kvserver.NewStores(),
+	}
+}
+
+// start starts the node. The engines which hold a store ident are
+// started as the node's existing stores; they must all belong to the same
+// cluster and node. If there are none, the node bootstraps a new cluster on
+// its first engine: the engine is given the first node and store IDs and the
+// initial ranges. Any remaining empty engines are then initialized with
+// store IDs allocated from the cluster's store ID generator.
+func (n *Node) start(ctx context.Context, engines []storage.Engine) error {
+	var initialized []storage.Engine
+	var idents []roachpb.StoreIdent
+	var empty []storage.Engine
+	for _, eng := range engines {
+		ident, err := kvstorage.ReadStoreIdent(ctx, eng)
+		if errors.Is(err, kvstorage.ErrStoreNotBootstrapped) {
+			empty = append(empty, eng)
+			continue
+		} else if err != nil {
+			return err
+		}
+		if len(idents) > 0 {
+			if ident.ClusterID != idents[0].ClusterID {
+				return fmt.Errorf("store s%d belongs to cluster %s, but s%d belongs to cluster %s",
+					ident.StoreID, ident.ClusterID, idents[0].StoreID, idents[0].ClusterID)
+			}
+			if ident.NodeID != idents[0].NodeID {
+				return fmt.Errorf("store s%d belongs to n%d, but s%d belongs to n%d",
+					ident.StoreID, ident.NodeID, idents[0].StoreID, idents[0].NodeID)
+			}
+		}
+		initialized = append(initialized, eng)
+		idents = append(idents, ident)
+	}
+
+	if len(initialized) == 0 {
+		if len(empty) == 0 {
+			return nil
+		}
+		ident, err := bootstrapCluster(ctx, empty[0], n.clock)
+		if err != nil {
+			return err
+		}
+		initialized = append(initialized, empty[0])
+		idents = append(idents, ident)
+		empty = empty[1:]
+	}
+	n.clusterID = idents[0].ClusterID
+	n.nodeID = idents[0].NodeID
+
+	for i, eng := range initialized {
+		if err := n.startStore(ctx, eng, idents[i].StoreID); err != nil {
+			return err
+		}
+	}
+	if len(empty) == 0 {
+		return nil
+	}
+
+	// The stores of the node now serve the cluster's ranges, so the store
+	// IDs of the remaining engines can be allocated through KV.
+	firstID, err := allocateIDs(ctx, n.storeCfg.DB, keys.StoreIDGenerator, int64(len(empty)))
+	if err != nil {
+		return err
+	}
+	for i, eng := range empty {
+		ident := roachpb.StoreIdent{
+			ClusterID: n.clusterID,
+			NodeID:    n.nodeID,
+			StoreID:   roachpb.StoreID(firstID + int64(i)),
+		}
+		if err := kvstorage.InitEngine(ctx, eng, ident); err != nil {
+			return err
+		}
+		if err := n.startStore(ctx, eng, ident.StoreID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startStore creates the store of the node backed by the engine, and starts
+// it.
+func (n *Node) startStore(ctx context.Context, eng storage.Engine, storeID roachpb.StoreID) error {
+	s := kvserver.NewStore(ctx, n.storeCfg, eng, n.nodeID, storeID)
+	if err := s.Start(ctx); err != nil {
+		return err
+	}
+	n.stores.AddStore(s)
+	return nil
+}
+
+// bootstrapCluster bootstraps a new cluster on the engine, which becomes the
+// first store of the first node, and writes the cluster's initial ranges to
+// it. It returns the ident of the new store.
+func bootstrapCluster(
+	ctx context.Context, eng storage.Engine, clock *hlc.Clock,
+) (roachpb.StoreIdent, error) {
+	ident := roachpb.StoreIdent{
+		ClusterID: uuid.MakeV4(),
+		NodeID:    1,
+		StoreID:   1,
+	}
+	if err := kvstorage.InitEngine(ctx, eng, ident); err != nil {
+		return roachpb.StoreIdent{}, err
+	}
+	if err := kvserver.WriteInitialClusterData(ctx, eng, []roachpb.ReplicaDescriptor{{
+		NodeID:  ident.NodeID,
+		StoreID: ident.StoreID,
+	}}, clock.Now().WallTime); err != nil {
+		return roachpb.StoreIdent{}, err
+	}
+	return ident, nil
+}
+
+// allocateIDs increments the ID generator at the key by count, and returns
+// the first of the count IDs allocated.
+func allocateIDs(ctx context.Context, db *kv.DB, key roachpb.Key, count int64) (int64, error) {
+	var last int64
+	if err := db.Txn(ctx, func(ctx context.Context, txn *kv.Txn) error {
+		res, err := txn.GetForUpdate(ctx, key)
+		if err != nil {
+			return err
+		}
+		last = 0
+		if res.Value != nil {
+			if last, err = res.Value.GetInt(); err != nil {
+				return err
+			}
+		}
+		last += count
+		return txn.Put(ctx, key, last)
+	}); err != nil {
+		return 0, fmt.Errorf("unable to allocate %d IDs from %s: %w", count, key, err)
+	}
+	return last - count + 1, nil
+}
+
+// ClusterID returns the ID of the cluster the node belongs to. It is known
+// once the node has started.
+func (n *Node) ClusterID() uuid.UUID {
+	return n.clusterID
+}
+
+// GetFirstRangeDescriptor implements the kvcoord.FirstRangeProvider
+// interface. The first range is held by one of the node's stores.
+func (n *Node) GetFirstRangeDescriptor() (*roachpb.RangeDescriptor, error) {
+	var desc *roachpb.RangeDescriptor
+	_ = n.stores.VisitStores(func(s *kvserver.Store) error {
+		if desc == nil {
+			if repl := s.LookupReplica(roachpb.RKeyMin); repl != nil {
+				desc = repl.Desc()
+			}
+		}
+		return nil
+	})
+	if desc == nil {
+		return nil, errors.New("first range not found on the local stores")
+	}
+	return desc, nil
+}
+
+// Send implements the kv.Sender interface. The batch is dispatched to the
+// local store holding the replica it is addressed to.
+func (n *Node) Send(ctx context.Context, ba *kvpb.BatchRequest) (*kvpb.BatchResponse, *kvpb.Error) {
+	return n.stores.Send(ctx, ba)
+}
+
+// Batch implements the kvpb.InternalServer interface. The errors
+// encountered while serving the batch are returned in the response.
+func (n *Node) Batch(ctx context.Context, ba *kvpb.BatchRequest) (*kvpb.BatchResponse, error) {
+	br, pErr := n.stores.Send(ctx, ba)
+	if br == nil {
+		br = &kvpb.BatchResponse{}
+	}
+	br.Error = pErr
+	return br, nil
+}
+
+// RangeFeed implements the kvpb.InternalServer interface. The error which
+// ends the rangefeed is sent on the stream as its last event.
+func (n *Node) RangeFeed(args *kvpb.RangeFeedRequest, stream kvpb.Internal_RangeFeedServer) error {
+	if pErr := n.stores.RangeFeed(args, stream); pErr != nil {
+		var event kvpb.RangeFeedEvent
+		event.Error = &kvpb.RangeFeedError{Error: *pErr}
+		return stream.Send(&event)
+	}
+	return nil
+}
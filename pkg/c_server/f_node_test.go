@@ -0,0 +1,152 @@
+package server
+
+import (
+	"context"
+	keys "github.com/dborchard/tiny_crdb/pkg/g_keys"
+	kv "github.com/dborchard/tiny_crdb/pkg/g_kv"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvclient/kvcoord"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/kvstorage"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	storage "github.com/dborchard/tiny_crdb/pkg/h_storage"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/stop"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+// startTestNode starts a node on the engines, wired to a DB which sends its
+// requests to the node's stores.
+func startTestNode(t *testing.T, engines ...storage.Engine) (*Node, *kv.DB, error) {
+	ctx := context.Background()
+	stopper := stop.NewStopper()
+	t.Cleanup(func() { stopper.Stop(ctx) })
+	clock := hlc.NewClock(hlc.UnixNano, time.Nanosecond)
+
+	node := NewNode(kvserver.StoreConfig{Clock: clock, Stopper: stopper}, stopper, clock)
+	ds := kvcoord.NewDistSender(kvcoord.DistSenderConfig{
+		Clock:              clock,
+		Stopper:            stopper,
+		FirstRangeProvider: node,
+		TransportFactory:   kvcoord.SenderTransportFactory(node),
+	})
+	factory := kvcoord.NewTxnCoordSenderFactory(kvcoord.TxnCoordSenderFactoryConfig{
+		Clock:   clock,
+		Stopper: stopper,
+	}, ds)
+	db := kv.NewDB(ctx, factory, clock, stopper)
+	node.storeCfg.DB = db
+	return node, db, node.start(ctx, engines)
+}
+
+func newTestEngine(t *testing.T) storage.Engine {
+	eng, err := storage.Open(context.Background(), storage.Location{})
+	require.NoError(t, err)
+	t.Cleanup(eng.Close)
+	return eng
+}
+
+// TestNodeBootstrapAndRestart verifies that a fresh node bootstraps a cluster
+// on its first store and allocates store IDs for the others, and that the
+// idents are read back on restart.
+func TestNodeBootstrapAndRestart(t *testing.T) {
+	ctx := context.Background()
+	engines := []storage.Engine{newTestEngine(t), newTestEngine(t)}
+
+	node, db, err := startTestNode(t, engines...)
+	require.NoError(t, err)
+	require.Equal(t, roachpb.NodeID(1), node.nodeID)
+	require.Equal(t, 2, node.stores.GetStoreCount())
+	var idents []roachpb.StoreIdent
+	for _, eng := range engines {
+		ident, err := kvstorage.ReadStoreIdent(ctx, eng)
+		require.NoError(t, err)
+		require.Equal(t, node.ClusterID(), ident.ClusterID)
+		require.Equal(t, node.nodeID, ident.NodeID)
+		idents = append(idents, ident)
+	}
+	require.Equal(t, roachpb.StoreID(1), idents[0].StoreID)
+	require.Equal(t, roachpb.StoreID(2), idents[1].StoreID)
+	require.NoError(t, db.Txn(ctx, func(ctx context.Context, txn *kv.Txn) error {
+		res, err := txn.Get(ctx, keys.StoreIDGenerator)
+		require.NoError(t, err)
+		last, err := res.Value.GetInt()
+		require.NoError(t, err)
+		require.Equal(t, int64(2), last)
+		return nil
+	}))
+	// The initial ranges are split around the system keyspace.
+	store, err := node.stores.GetStore(1)
+	require.NoError(t, err)
+	require.Equal(t, 3, store.ReplicaCount())
+
+	// A restarted node picks up the idents of its stores, and does not
+	// bootstrap again.
+	restarted, _, err := startTestNode(t, engines...)
+	require.NoError(t, err)
+	require.Equal(t, node.ClusterID(), restarted.ClusterID())
+	require.Equal(t, 2, restarted.stores.GetStoreCount())
+	require.True(t, restarted.stores.HasStore(2))
+	for i, eng := range engines {
+		ident, err := kvstorage.ReadStoreIdent(ctx, eng)
+		require.NoError(t, err)
+		require.Equal(t, idents[i], ident)
+	}
+}
+
+// TestNodeRefusesForeignStore verifies that a node refuses to start with a
+// store which belongs to another cluster.
+func TestNodeRefusesForeignStore(t *testing.T) {
+	eng1, eng2 := newTestEngine(t), newTestEngine(t)
+	_, _, err := startTestNode(t, eng1)
+	require.NoError(t, err)
+	_, _, err = startTestNode(t, eng2)
+	require.NoError(t, err)
+
+	_, _, err = startTestNode(t, eng1, eng2)
+	require.ErrorContains(t, err, "belongs to cluster")
+
+	// An engine which is not empty cannot be initialized as a new store.
+	require.Error(t, kvstorage.InitEngine(context.Background(), eng1, roachpb.StoreIdent{}))
+}
+
+// TestNodeStoreDescriptors verifies that a node started with several store
+// specs opens a store for each of them, and that the stores report their
+// attributes and capacity.
+func TestNodeStoreDescriptors(t *testing.T) {
+	ctx := context.Background()
+	cfg := MakeConfig()
+	require.NoError(t, cfg.Stores.Set("type=mem,size=1GiB,attrs=mem"))
+	require.NoError(t, cfg.Stores.Set("path="+t.TempDir()+",attrs=ssd,size=10MiB"))
+	engines, err := cfg.CreateEngines(ctx)
+	require.NoError(t, err)
+	t.Cleanup(engines.Close)
+
+	node, _, err := startTestNode(t, engines...)
+	require.NoError(t, err)
+	require.Equal(t, 2, node.stores.GetStoreCount())
+
+	s1, err := node.stores.GetStore(1)
+	require.NoError(t, err)
+	desc, err := s1.Descriptor(ctx)
+	require.NoError(t, err)
+	require.Equal(t, roachpb.StoreID(1), desc.StoreID)
+	require.Equal(t, node.nodeID, desc.Node.NodeID)
+	require.Equal(t, []string{"mem"}, desc.Attrs.Attrs)
+	require.Equal(t, int64(1<<30), desc.Capacity.Capacity)
+	require.Equal(t, desc.Capacity.Capacity-desc.Capacity.Used, desc.Capacity.Available)
+	require.Less(t, int64(0), desc.Capacity.Used)
+	// The first store holds the initial ranges.
+	require.Equal(t, int32(3), desc.Capacity.RangeCount)
+	require.Less(t, int64(0), desc.Capacity.LogicalBytes)
+
+	s2, err := node.stores.GetStore(2)
+	require.NoError(t, err)
+	desc, err = s2.Descriptor(ctx)
+	require.NoError(t, err)
+	require.Equal(t, roachpb.StoreID(2), desc.StoreID)
+	require.Equal(t, []string{"ssd"}, desc.Attrs.Attrs)
+	require.LessOrEqual(t, desc.Capacity.Capacity, int64(10<<20))
+	require.Equal(t, int32(0), desc.Capacity.RangeCount)
+}
@@ -0,0 +1,148 @@
+// Package jobs runs the long-running background operations of the cluster,
+// such as changefeeds, as jobs. The record of a job is persisted in KV, so
+// that the job survives the node running it: a job is claimed by the
+// registry of the node which runs it, and adopted by another registry once
+// that claim expires, which resumes it from its persisted progress.
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/dborchard/tiny_crdb/pkg/f_jobs/jobspb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/uuid"
+	"sync"
+)
+
+// Status represents the status of a job.
+type Status string
+
+const (
+	// StatusRunning is for jobs that are currently in progress, or waiting to
+	// be adopted after the node running them stopped.
+	StatusRunning Status = "running"
+	// StatusCancelRequested is for jobs that were requested to be canceled,
+	// but haven't stopped yet.
+	StatusCancelRequested Status = "cancel-requested"
+	// StatusSucceeded is for jobs that have successfully completed.
+	StatusSucceeded Status = "succeeded"
+	// StatusFailed is for jobs that failed.
+	StatusFailed Status = "failed"
+	// StatusCanceled is for jobs that were canceled.
+	StatusCanceled Status = "canceled"
+)
+
+// Terminal returns whether this status represents a "terminal" state: a
+// state after which the job should never be updated again.
+func (s Status) Terminal() bool {
+	return s == StatusSucceeded || s == StatusFailed || s == StatusCanceled
+}
+
+// errClaimLost is returned by the updates of a job whose claim was taken
+// over by another registry, after it expired.
+var errClaimLost = errors.New("job claim lost")
+
+// Record bundles together the user-managed fields of a job to be created.
+type Record struct {
+	Description string
+	Username    string
+	Details     jobspb.Details
+	// Progress is the initial progress of the job.
+	Progress jobspb.Progress
+}
+
+// jobRecord is the record of a job which is persisted in KV.
+type jobRecord struct {
+	ID       jobspb.JobID
+	Status   Status
+	Payload  jobspb.Payload
+	Progress jobspb.Progress
+	// ClaimInstanceID identifies the registry which claimed the job to run
+	// it, if any. The claim holds until ClaimExpiration, unless the registry
+	// extends it.
+	ClaimInstanceID uuid.UUID
+	ClaimExpiration hlc.Timestamp
+}
+
+// Job manages the record of a job, as seen by the registry running it or
+// loading it.
+type Job struct {
+	registry *Registry
+	id       jobspb.JobID
+
+	mu struct {
+		sync.Mutex
+		status   Status
+		payload  jobspb.Payload
+		progress jobspb.Progress
+	}
+}
+
+func (r *Registry) newJob(rec *jobRecord) *Job {
+	j := &Job{registry: r, id: rec.ID}
+	j.setRecord(rec)
+	return j
+}
+
+func (j *Job) setRecord(rec *jobRecord) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.mu.status = rec.Status
+	j.mu.payload = rec.Payload
+	j.mu.progress = rec.Progress
+}
+
+// ID returns the ID of the job.
+func (j *Job) ID() jobspb.JobID {
+	return j.id
+}
+
+// Status returns the status of the job, as of when it was last loaded or
+// updated.
+func (j *Job) Status() Status {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.mu.status
+}
+
+// Payload returns the payload of the job.
+func (j *Job) Payload() jobspb.Payload {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.mu.payload
+}
+
+// Details returns the details from the payload of the job.
+func (j *Job) Details() jobspb.Details {
+	return j.Payload().Details
+}
+
+// Progress returns the progress of the job, as of when it was last loaded
+// or updated.
+func (j *Job) Progress() jobspb.Progress {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.mu.progress
+}
+
+// HighWaterProgressed forwards the high-water mark of the job to the
+// timestamp, and persists it. It returns an error if the registry no longer
+// holds the claim of the job, in which case the job must stop running.
+func (j *Job) HighWaterProgressed(ctx context.Context, highWater hlc.Timestamp) error {
+	return j.registry.updateClaimedJob(ctx, j, func(rec *jobRecord) error {
+		if rec.Status != StatusRunning {
+			return fmt.Errorf("job %d: cannot update progress on %s job", j.id, rec.Status)
+		}
+		rec.Progress.HighWater.Forward(highWater)
+		return nil
+	})
+}
+
+// SetRunningStatus sets the running status of the job, and persists it.
+func (j *Job) SetRunningStatus(ctx context.Context, status string) error {
+	return j.registry.updateClaimedJob(ctx, j, func(rec *jobRecord) error {
+		rec.Progress.RunningStatus = status
+		return nil
+	})
+}
@@ -0,0 +1,91 @@
+package jobspb
+
+import (
+	"fmt"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/c_catalog/descpb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+)
+
+// JobID is the ID of a job.
+type JobID int64
+
+// InvalidJobID is the zero value for JobID corresponding to no job.
+const InvalidJobID JobID = 0
+
+// Type is the type of a job, which determines the Resumer that runs it.
+type Type int32
+
+const (
+	// TypeUnspecified is the type of the jobs without details.
+	TypeUnspecified Type = iota
+	// TypeChangefeed is the type of the jobs of the changefeeds.
+	TypeChangefeed
+)
+
+// String implements the fmt.Stringer interface.
+func (t Type) String() string {
+	switch t {
+	case TypeUnspecified:
+		return "UNSPECIFIED"
+	case TypeChangefeed:
+		return "CHANGEFEED"
+	default:
+		return fmt.Sprintf("Type(%d)", int32(t))
+	}
+}
+
+// Details is a union of the details of the job types. Exactly one of its
+// fields is set.
+type Details struct {
+	Changefeed *ChangefeedDetails
+}
+
+// Type returns the type of the job whose details are held by the union.
+func (d Details) Type() Type {
+	switch {
+	case d.Changefeed != nil:
+		return TypeChangefeed
+	default:
+		return TypeUnspecified
+	}
+}
+
+// Payload holds the fields of a job which are set when it is created.
+type Payload struct {
+	Description string
+	Username    string
+	Details     Details
+	// Error is the error which failed the job, if any.
+	Error string
+}
+
+// Progress holds the fields of a job which are updated while it runs.
+type Progress struct {
+	// HighWater is the timestamp up to which the job has processed its input,
+	// for the jobs that follow the changes to their input, like changefeeds.
+	// A job resumed after a failure picks up from its high-water mark.
+	HighWater hlc.Timestamp
+	// RunningStatus describes what the job is currently doing.
+	RunningStatus string
+}
+
+// ChangefeedTargetTable describes a table watched by a changefeed.
+type ChangefeedTargetTable struct {
+	// StatementTimeName is the name of the table when the changefeed was
+	// created, which is the topic of its messages.
+	StatementTimeName string
+}
+
+// ChangefeedDetails holds the details of a changefeed job.
+type ChangefeedDetails struct {
+	// Tables are the tables watched by the changefeed, by descriptor ID.
+	Tables  map[descpb.ID]ChangefeedTargetTable
+	SinkURI string
+	// Opts are the options of the changefeed. The options without a value
+	// map to the empty string.
+	Opts map[string]string
+	// StatementTime is the time at which the changefeed was created. The
+	// initial scan of the changefeed, if any, reads the tables as of that
+	// time, and the changes made after it are emitted.
+	StatementTime hlc.Timestamp
+}
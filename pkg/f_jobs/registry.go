@@ -0,0 +1,409 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/dborchard/tiny_crdb/pkg/f_jobs/jobspb"
+	keys "github.com/dborchard/tiny_crdb/pkg/g_keys"
+	kv "github.com/dborchard/tiny_crdb/pkg/g_kv"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/stop"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/uuid"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultAdoptInterval is the default interval at which a registry
+	// extends the claims of its jobs and adopts the unclaimed jobs.
+	defaultAdoptInterval = 10 * time.Second
+	// defaultClaimTTL is the default duration of the claim of a job, after
+	// which the job is adopted by another registry unless it is extended.
+	defaultClaimTTL = 30 * time.Second
+)
+
+// Resumer is implemented by the jobs of each type, to run them.
+type Resumer interface {
+	// Resume is called when a job is started or adopted. It runs the job until
+	// it completes, in which case it returns nil, or fails. The job is resumed
+	// again from its persisted progress if the node running it stops, which
+	// cancels the context.
+	//
+	// execCtx is the execution context of the registry.
+	Resume(ctx context.Context, execCtx interface{}) error
+
+	// OnFailOrCancel is called when the job failed or was canceled, to clean
+	// up after it. jobErr is the error which failed the job, if any.
+	OnFailOrCancel(ctx context.Context, execCtx interface{}, jobErr error) error
+}
+
+// Constructor creates the Resumer of a job.
+type Constructor func(job *Job) Resumer
+
+var constructors = make(map[jobspb.Type]Constructor)
+
+// RegisterConstructor registers a Resumer constructor for a certain job type.
+func RegisterConstructor(typ jobspb.Type, fn Constructor) {
+	constructors[typ] = fn
+}
+
+// RegistryConfig configures a Registry.
+type RegistryConfig struct {
+	DB      *kv.DB
+	Clock   *hlc.Clock
+	Stopper *stop.Stopper
+	// ExecCtx is the execution context passed to the resumers of the jobs.
+	ExecCtx interface{}
+
+	// AdoptInterval is the interval at which the registry extends the claims
+	// of its jobs, and adopts the jobs whose claims expired.
+	AdoptInterval time.Duration
+	// ClaimTTL is the duration for which the claims of the jobs hold.
+	ClaimTTL time.Duration
+}
+
+// SetDefaults initializes unset fields in RegistryConfig to values suitable
+// for use on a production cluster.
+func (c *RegistryConfig) SetDefaults() {
+	if c.AdoptInterval == 0 {
+		c.AdoptInterval = defaultAdoptInterval
+	}
+	if c.ClaimTTL == 0 {
+		c.ClaimTTL = defaultClaimTTL
+	}
+}
+
+// Registry creates the jobs of a node, and runs them along with the jobs
+// that it adopts.
+type Registry struct {
+	cfg RegistryConfig
+	// instanceID identifies the claims of the registry.
+	instanceID uuid.UUID
+
+	mu struct {
+		sync.Mutex
+		// adopted are the jobs claimed and run by the registry.
+		adopted map[jobspb.JobID]*adoptedJob
+	}
+}
+
+// adoptedJob is a job run by the registry.
+type adoptedJob struct {
+	job    *Job
+	cancel context.CancelFunc
+	// cancelRequested is set when the job is canceled by a request, rather
+	// than because the registry stops.
+	cancelRequested bool
+}
+
+// MakeRegistry creates a new Registry.
+func MakeRegistry(cfg RegistryConfig) *Registry {
+	cfg.SetDefaults()
+	r := &Registry{cfg: cfg, instanceID: uuid.MakeV4()}
+	r.mu.adopted = make(map[jobspb.JobID]*adoptedJob)
+	return r
+}
+
+// Start starts the adoption loop of the registry, which extends the claims
+// of the jobs run by the registry, and adopts the jobs whose claims expired,
+// until the stopper quiesces.
+func (r *Registry) Start(ctx context.Context) error {
+	return r.cfg.Stopper.RunAsyncTask(ctx, "jobs: adopt", func(ctx context.Context) {
+		ctx, cancel := r.cfg.Stopper.WithCancelOnQuiesce(ctx)
+		defer cancel()
+		ticker := time.NewTicker(r.cfg.AdoptInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				// Errors are transient: the claims are extended and the jobs
+				// adopted on the next tick.
+				_ = r.claimAndResumeJobs(ctx)
+			case <-ctx.Done():
+				return
+			}
+		}
+	})
+}
+
+// CreateJob creates a job from the record, and starts running it in the
+// registry. The job is claimed by the registry when it is created.
+func (r *Registry) CreateJob(ctx context.Context, record Record) (*Job, error) {
+	if _, ok := constructors[record.Details.Type()]; !ok {
+		return nil, fmt.Errorf("no resumer is available for %s", record.Details.Type())
+	}
+	id, err := r.generateJobID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rec := &jobRecord{
+		ID:     id,
+		Status: StatusRunning,
+		Payload: jobspb.Payload{
+			Description: record.Description,
+			Username:    record.Username,
+			Details:     record.Details,
+		},
+		Progress:        record.Progress,
+		ClaimInstanceID: r.instanceID,
+		ClaimExpiration: r.claimExpiration(),
+	}
+	if err := r.cfg.DB.Txn(ctx, func(ctx context.Context, txn *kv.Txn) error {
+		return txn.Put(ctx, keys.JobKey(int64(id)), rec)
+	}); err != nil {
+		return nil, err
+	}
+	job := r.newJob(rec)
+	if err := r.resumeJob(ctx, job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// LoadJob loads the job with the ID.
+func (r *Registry) LoadJob(ctx context.Context, id jobspb.JobID) (*Job, error) {
+	var rec *jobRecord
+	if err := r.cfg.DB.Txn(ctx, func(ctx context.Context, txn *kv.Txn) (err error) {
+		rec, err = loadJobRecord(ctx, txn, id)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return r.newJob(rec), nil
+}
+
+// CancelRequested marks the job as requested to be canceled. The registry
+// running the job cancels it the next time it extends its claim.
+func (r *Registry) CancelRequested(ctx context.Context, id jobspb.JobID) error {
+	return r.cfg.DB.Txn(ctx, func(ctx context.Context, txn *kv.Txn) error {
+		rec, err := loadJobRecord(ctx, txn, id)
+		if err != nil {
+			return err
+		}
+		if rec.Status.Terminal() {
+			return fmt.Errorf("job %d: cannot cancel %s job", id, rec.Status)
+		}
+		rec.Status = StatusCancelRequested
+		return txn.Put(ctx, keys.JobKey(int64(id)), rec)
+	})
+}
+
+// generateJobID allocates a new job ID from the job ID generator.
+func (r *Registry) generateJobID(ctx context.Context) (jobspb.JobID, error) {
+	var id int64
+	if err := r.cfg.DB.Txn(ctx, func(ctx context.Context, txn *kv.Txn) error {
+		res, err := txn.GetForUpdate(ctx, keys.JobIDGenerator)
+		if err != nil {
+			return err
+		}
+		id = 0
+		if res.Value != nil {
+			if id, err = res.Value.GetInt(); err != nil {
+				return err
+			}
+		}
+		id++
+		return txn.Put(ctx, keys.JobIDGenerator, id)
+	}); err != nil {
+		return 0, fmt.Errorf("unable to allocate job ID: %w", err)
+	}
+	return jobspb.JobID(id), nil
+}
+
+func (r *Registry) claimExpiration() hlc.Timestamp {
+	return r.cfg.Clock.Now().Add(r.cfg.ClaimTTL.Nanoseconds(), 0)
+}
+
+// claimAndResumeJobs extends the claims of the jobs run by the registry,
+// cancels those of them which were requested to be canceled, and claims and
+// resumes the jobs whose claims expired.
+func (r *Registry) claimAndResumeJobs(ctx context.Context) error {
+	var recs []*jobRecord
+	if err := r.cfg.DB.Txn(ctx, func(ctx context.Context, txn *kv.Txn) error {
+		recs = recs[:0]
+		rows, err := txn.Scan(ctx, keys.JobsPrefix, keys.JobsPrefix.PrefixEnd(), 0)
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			rec := &jobRecord{}
+			if err := row.Value.GetProto(rec); err != nil {
+				return err
+			}
+			recs = append(recs, rec)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	now := r.cfg.Clock.Now()
+	for _, rec := range recs {
+		if rec.Status.Terminal() {
+			continue
+		}
+		r.mu.Lock()
+		aj, ok := r.mu.adopted[rec.ID]
+		r.mu.Unlock()
+		if ok {
+			if err := r.updateClaimedJob(ctx, aj.job, func(rec *jobRecord) error {
+				rec.ClaimExpiration = r.claimExpiration()
+				return nil
+			}); errors.Is(err, errClaimLost) {
+				// The claim expired before it was extended, and the job was
+				// adopted by another registry.
+				aj.cancel()
+				continue
+			}
+			if aj.job.Status() == StatusCancelRequested {
+				r.mu.Lock()
+				aj.cancelRequested = true
+				r.mu.Unlock()
+				aj.cancel()
+			}
+			continue
+		}
+		if rec.ClaimInstanceID != uuid.Nil && now.Less(rec.ClaimExpiration) {
+			continue
+		}
+		job, err := r.claimJob(ctx, rec.ID)
+		if err != nil {
+			continue
+		}
+		if err := r.resumeJob(ctx, job); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// claimJob claims the job with the ID for the registry, if its claim expired.
+func (r *Registry) claimJob(ctx context.Context, id jobspb.JobID) (*Job, error) {
+	var rec *jobRecord
+	if err := r.cfg.DB.Txn(ctx, func(ctx context.Context, txn *kv.Txn) (err error) {
+		if rec, err = loadJobRecord(ctx, txn, id); err != nil {
+			return err
+		}
+		if rec.Status.Terminal() {
+			return fmt.Errorf("job %d: cannot adopt %s job", id, rec.Status)
+		}
+		if rec.ClaimInstanceID != uuid.Nil && r.cfg.Clock.Now().Less(rec.ClaimExpiration) {
+			return fmt.Errorf("job %d: claimed by another registry", id)
+		}
+		rec.ClaimInstanceID = r.instanceID
+		rec.ClaimExpiration = r.claimExpiration()
+		return txn.Put(ctx, keys.JobKey(int64(id)), rec)
+	}); err != nil {
+		return nil, err
+	}
+	return r.newJob(rec), nil
+}
+
+// updateClaimedJob updates the record of the job, if the registry still
+// holds its claim, and refreshes the job from the updated record. It returns
+// errClaimLost otherwise.
+func (r *Registry) updateClaimedJob(
+	ctx context.Context, job *Job, fn func(rec *jobRecord) error,
+) error {
+	var rec *jobRecord
+	if err := r.cfg.DB.Txn(ctx, func(ctx context.Context, txn *kv.Txn) (err error) {
+		if rec, err = loadJobRecord(ctx, txn, job.id); err != nil {
+			return err
+		}
+		if rec.ClaimInstanceID != r.instanceID {
+			return errClaimLost
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+		return txn.Put(ctx, keys.JobKey(int64(job.id)), rec)
+	}); err != nil {
+		return err
+	}
+	job.setRecord(rec)
+	return nil
+}
+
+// resumeJob runs the claimed job in an async task, until it completes or
+// the stopper quiesces.
+func (r *Registry) resumeJob(ctx context.Context, job *Job) error {
+	resumer := constructors[job.Details().Type()](job)
+	ctx, cancel := r.cfg.Stopper.WithCancelOnQuiesce(context.WithoutCancel(ctx))
+	aj := &adoptedJob{job: job, cancel: cancel}
+	r.mu.Lock()
+	r.mu.adopted[job.id] = aj
+	r.mu.Unlock()
+
+	taskName := fmt.Sprintf("job-%d", job.id)
+	if err := r.cfg.Stopper.RunAsyncTask(ctx, taskName, func(ctx context.Context) {
+		defer func() {
+			cancel()
+			r.mu.Lock()
+			delete(r.mu.adopted, job.id)
+			r.mu.Unlock()
+		}()
+		r.runJob(ctx, aj, resumer)
+	}); err != nil {
+		cancel()
+		r.mu.Lock()
+		delete(r.mu.adopted, job.id)
+		r.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// runJob runs the resumer of the job, and records the outcome of the job.
+func (r *Registry) runJob(ctx context.Context, aj *adoptedJob, resumer Resumer) {
+	job := aj.job
+	var jobErr error
+	if job.Status() != StatusCancelRequested {
+		jobErr = resumer.Resume(ctx, r.cfg.ExecCtx)
+	}
+	r.mu.Lock()
+	cancelRequested := aj.cancelRequested || job.Status() == StatusCancelRequested
+	r.mu.Unlock()
+	if ctx.Err() != nil && !cancelRequested {
+		// The registry stopped, or lost the claim of the job. The job is
+		// resumed once another registry adopts it.
+		return
+	}
+	// The job outlives the context of its run, which is canceled when it is
+	// canceled.
+	ctx = context.WithoutCancel(ctx)
+	status := StatusSucceeded
+	switch {
+	case cancelRequested:
+		status = StatusCanceled
+		_ = resumer.OnFailOrCancel(ctx, r.cfg.ExecCtx, nil)
+	case jobErr != nil:
+		status = StatusFailed
+		_ = resumer.OnFailOrCancel(ctx, r.cfg.ExecCtx, jobErr)
+	}
+	_ = r.updateClaimedJob(ctx, job, func(rec *jobRecord) error {
+		rec.Status = status
+		if jobErr != nil && status == StatusFailed {
+			rec.Payload.Error = jobErr.Error()
+		}
+		rec.ClaimInstanceID = uuid.Nil
+		rec.ClaimExpiration = hlc.Timestamp{}
+		return nil
+	})
+}
+
+// loadJobRecord reads the record of the job with the ID in the transaction.
+func loadJobRecord(ctx context.Context, txn *kv.Txn, id jobspb.JobID) (*jobRecord, error) {
+	res, err := txn.Get(ctx, keys.JobKey(int64(id)))
+	if err != nil {
+		return nil, err
+	}
+	if res.Value == nil {
+		return nil, fmt.Errorf("job with ID %d does not exist", id)
+	}
+	rec := &jobRecord{}
+	if err := res.Value.GetProto(rec); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
@@ -0,0 +1,53 @@
+// Package appstatspb defines the fingerprints of the statements and
+// transactions that applications run, by which their statistics are
+// aggregated.
+package appstatspb
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+)
+
+// StmtFingerprintID is the ID of the fingerprint of a statement. Statements
+// that only differ by their constants share a fingerprint.
+type StmtFingerprintID uint64
+
+// TransactionFingerprintID is the ID of the fingerprint of a transaction,
+// which is the sequence of the fingerprints of its statements.
+type TransactionFingerprintID uint64
+
+// InvalidTransactionFingerprintID is the fingerprint ID of a transaction
+// whose fingerprint is unknown.
+const InvalidTransactionFingerprintID TransactionFingerprintID = 0
+
+// ConstructStatementFingerprintID constructs the fingerprint ID of a
+// statement from its anonymized form, whether it ran in an implicit
+// transaction, and the database that it ran in.
+func ConstructStatementFingerprintID(
+	anonymizedStmt string, implicitTxn bool, database string,
+) StmtFingerprintID {
+	h := fnv.New64()
+	_, _ = h.Write([]byte(anonymizedStmt))
+	if implicitTxn {
+		_, _ = h.Write([]byte("I"))
+	} else {
+		_, _ = h.Write([]byte("E"))
+	}
+	_, _ = h.Write([]byte(database))
+	return StmtFingerprintID(h.Sum64())
+}
+
+// ConstructTransactionFingerprintID constructs the fingerprint ID of a
+// transaction from the fingerprint IDs of its statements, in the order in
+// which they ran.
+func ConstructTransactionFingerprintID(
+	stmtFingerprintIDs []StmtFingerprintID,
+) TransactionFingerprintID {
+	h := fnv.New64()
+	var buf [8]byte
+	for _, id := range stmtFingerprintIDs {
+		binary.BigEndian.PutUint64(buf[:], uint64(id))
+		_, _ = h.Write(buf[:])
+	}
+	return TransactionFingerprintID(h.Sum64())
+}
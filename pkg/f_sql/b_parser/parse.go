@@ -1,8 +1,11 @@
 package parser
 
 import (
+	"fmt"
 	"github.com/dborchard/tiny_crdb/pkg/f_sql/b_parser/statements"
 	"github.com/dborchard/tiny_crdb/pkg/f_sql/e_sem/tree"
+	"strconv"
+	"strings"
 )
 
 // ParseOne parses a sql statement string, ensuring that it contains only a
@@ -12,28 +15,685 @@ import (
 // bits of SQL from other nodes. In general,earwe expect that all
 // user-generated SQL has been run through the ParseWithInt() function.
 func ParseOne(sql string) (statements.Statement[tree.Statement], error) {
-	return statements.Statement[tree.Statement]{
-		AST: &tree.Select{
-			With: &tree.With{
-				Recursive: false,
-			},
-			Select: &tree.SelectClause{
-				From:        tree.From{},
-				DistinctOn:  tree.DistinctOn{},
-				Exprs:       tree.SelectExprs{},
-				GroupBy:     tree.GroupBy{},
-				Having:      nil,
-				Where:       nil,
-				Distinct:    false,
-				TableSelect: false,
-			},
-			OrderBy: tree.OrderBy{},
-			Limit: &tree.Limit{
-				Offset:   nil,
-				Count:    nil,
-				LimitAll: false,
-			},
+	if toks := strings.Fields(sql); len(toks) >= 2 &&
+		strings.EqualFold(toks[0], "CREATE") && strings.EqualFold(toks[1], "CHANGEFEED") {
+		stmt, err := parseCreateChangefeed(sql)
+		if err != nil {
+			return statements.Statement[tree.Statement]{}, err
+		}
+		return statements.Statement[tree.Statement]{AST: stmt, SQL: sql}, nil
+	}
+	if toks := strings.Fields(sql); len(toks) >= 1 {
+		switch strings.ToUpper(strings.TrimSuffix(toks[0], ";")) {
+		case "BEGIN", "START", "COMMIT", "END", "ROLLBACK", "ABORT":
+			stmt, err := parseTransaction(sql)
+			if err != nil {
+				return statements.Statement[tree.Statement]{}, err
+			}
+			return statements.Statement[tree.Statement]{AST: stmt, SQL: sql}, nil
+		case "EXPLAIN":
+			stmt, err := parseExplain(sql)
+			if err != nil {
+				return statements.Statement[tree.Statement]{}, err
+			}
+			return statements.Statement[tree.Statement]{AST: stmt, SQL: sql}, nil
+		}
+	}
+	stmt, err := parseSelect(sql)
+	if err != nil {
+		return statements.Statement[tree.Statement]{}, err
+	}
+	return statements.Statement[tree.Statement]{AST: stmt, SQL: sql}, nil
+}
+
+// parseSelect parses a SELECT statement. The clauses at the end of the
+// statement may come in either order:
+//
+//	select_stmt:
+//	  select_clause opt_sort_clause opt_select_limit opt_for_locking_clause
+//	| select_clause opt_sort_clause for_locking_clause select_limit
+func parseSelect(sql string) (*tree.Select, error) {
+	toks, err := tokenize(strings.TrimSuffix(strings.TrimSpace(sql), ";"))
+	if err != nil {
+		return nil, err
+	}
+	return parseSelectTokens(toks)
+}
+
+// parseSelectTokens parses the tokens of a SELECT statement.
+func parseSelectTokens(toks []string) (*tree.Select, error) {
+	tail := selectTailStart(toks)
+	sc := &tree.SelectClause{}
+	if err := (&tokenCursor{toks: toks[:tail]}).parseSelectClause(sc); err != nil {
+		return nil, err
+	}
+	p := &tokenCursor{toks: toks, i: tail}
+	limit := &tree.Limit{}
+	hasLimit, err := p.parseSelectLimit(limit)
+	if err != nil {
+		return nil, err
+	}
+	locking, err := p.parseLockingClause()
+	if err != nil {
+		return nil, err
+	}
+	if !hasLimit && len(locking) > 0 {
+		if _, err := p.parseSelectLimit(limit); err != nil {
+			return nil, err
+		}
+	}
+	if !p.done() {
+		return nil, p.syntaxError()
+	}
+	sc.Locking = locking
+	return &tree.Select{
+		With: &tree.With{
+			Recursive: false,
 		},
-		SQL: sql,
+		Select:  sc,
+		OrderBy: tree.OrderBy{},
+		Limit:   limit,
 	}, nil
 }
+
+// parseSelectClause parses the select clause of a SELECT statement. Only the
+// target lists made of column names are supported, and the WHERE clause is
+// recorded but not parsed:
+//
+//	simple_select:
+//	  SELECT target_list opt_from_clause opt_where_clause
+//
+//	target_list:
+//	  '*' | name [, ...]
+//
+//	opt_from_clause:
+//	  /* EMPTY */ | FROM table_name [, ...]
+//
+//	table_name:
+//	  name | name '.' name
+//
+//	opt_where_clause:
+//	  /* EMPTY */ | WHERE a_expr
+func (p *tokenCursor) parseSelectClause(sc *tree.SelectClause) error {
+	if !p.isKeyword(0, "SELECT") {
+		return p.syntaxError()
+	}
+	p.i++
+	if p.peek(0) == "*" {
+		sc.Exprs = tree.SelectExprs{{Expr: &tree.UnresolvedName{Star: true}}}
+		p.i++
+	} else {
+		for {
+			name := p.peek(0)
+			if name == "" || p.isKeyword(0, "FROM") || p.isKeyword(0, "WHERE") {
+				return p.syntaxError()
+			}
+			if !isName(name) {
+				return p.unimplemented()
+			}
+			p.i++
+			sc.Exprs = append(sc.Exprs, tree.SelectExpr{
+				Expr: &tree.UnresolvedName{NumParts: 1, Parts: tree.NameParts{unquote(name)}},
+			})
+			if p.peek(0) != "," {
+				break
+			}
+			p.i++
+		}
+	}
+	if p.isKeyword(0, "FROM") {
+		p.i++
+		for {
+			tn, err := p.parseTableName()
+			if err != nil {
+				return err
+			}
+			sc.From.Tables = append(sc.From.Tables, &tn)
+			if p.peek(0) != "," {
+				break
+			}
+			p.i++
+		}
+	}
+	if p.isKeyword(0, "WHERE") {
+		if p.peek(1) == "" {
+			p.i++
+			return p.syntaxError()
+		}
+		sc.Where = &tree.Where{Type: tree.AstWhere}
+		p.i = len(p.toks)
+	}
+	if !p.done() {
+		return p.unimplemented()
+	}
+	return nil
+}
+
+// parseTableName parses the name of a table, which may be qualified by the
+// name of its schema.
+func (p *tokenCursor) parseTableName() (tree.TableName, error) {
+	name := p.peek(0)
+	if name == "" || !isIdentifier(name) {
+		return tree.TableName{}, p.syntaxError()
+	}
+	if name[0] == '"' || !strings.Contains(name, ".") {
+		p.i++
+		return tree.MakeUnqualifiedTableName(tree.Name(unquote(name))), nil
+	}
+	parts := strings.Split(name, ".")
+	for _, part := range parts {
+		if part == "" || !isName(part) {
+			return tree.TableName{}, p.syntaxError()
+		}
+	}
+	if len(parts) > 2 {
+		return tree.TableName{}, p.unimplemented()
+	}
+	p.i++
+	prefix := tree.ObjectNamePrefix{SchemaName: tree.Name(parts[0]), ExplicitSchema: true}
+	return tree.MakeTableNameFromPrefix(prefix, tree.Name(parts[1])), nil
+}
+
+// selectTailStart returns the position of the first token of the LIMIT,
+// OFFSET or locking clause of a SELECT statement, or the number of tokens if
+// there is none. The clauses of subqueries are skipped.
+func selectTailStart(toks []string) int {
+	depth := 0
+	for i, tok := range toks {
+		switch {
+		case tok == "(":
+			depth++
+		case tok == ")":
+			depth--
+		case depth > 0:
+		case strings.EqualFold(tok, "LIMIT"), strings.EqualFold(tok, "OFFSET"):
+			return i
+		case strings.EqualFold(tok, "FOR") && i+1 < len(toks):
+			switch strings.ToUpper(toks[i+1]) {
+			case "UPDATE", "SHARE", "NO", "KEY":
+				return i
+			}
+		}
+	}
+	return len(toks)
+}
+
+// tokenCursor is a position in the tokens of a statement.
+type tokenCursor struct {
+	toks []string
+	i    int
+}
+
+// peek returns the token n positions after the current one, or the empty
+// string past the end of the statement.
+func (p *tokenCursor) peek(n int) string {
+	if p.i+n < len(p.toks) {
+		return p.toks[p.i+n]
+	}
+	return ""
+}
+
+// isKeyword returns whether the token n positions after the current one is
+// the provided keyword.
+func (p *tokenCursor) isKeyword(n int, kw string) bool {
+	return strings.EqualFold(p.peek(n), kw)
+}
+
+func (p *tokenCursor) done() bool {
+	return p.i >= len(p.toks)
+}
+
+func (p *tokenCursor) syntaxError() error {
+	if p.done() {
+		return fmt.Errorf("syntax error at end of input")
+	}
+	return fmt.Errorf("syntax error at or near %q", p.toks[p.i])
+}
+
+// unimplemented returns the error for the valid syntax which isn't
+// supported, at the current token.
+func (p *tokenCursor) unimplemented() error {
+	return fmt.Errorf("at or near %q: unimplemented: this syntax", p.toks[p.i])
+}
+
+// parseSelectLimit parses the LIMIT and OFFSET clauses of a SELECT statement
+// into limit, if any, and returns whether there was one:
+//
+//	select_limit:
+//	  limit_clause offset_clause | offset_clause limit_clause
+//	| limit_clause | offset_clause
+//
+//	limit_clause:
+//	  LIMIT ALL | LIMIT iconst
+//
+//	offset_clause:
+//	  OFFSET iconst | OFFSET iconst row_or_rows
+func (p *tokenCursor) parseSelectLimit(limit *tree.Limit) (bool, error) {
+	found := false
+	for {
+		switch {
+		case p.isKeyword(0, "LIMIT"):
+			if limit.Count != nil || limit.LimitAll {
+				return false, fmt.Errorf("multiple LIMIT clauses not allowed")
+			}
+			p.i++
+			if p.isKeyword(0, "ALL") {
+				limit.LimitAll = true
+				p.i++
+				break
+			}
+			count, err := p.parseIntConst()
+			if err != nil {
+				return false, err
+			}
+			limit.Count = count
+		case p.isKeyword(0, "OFFSET"):
+			if limit.Offset != nil {
+				return false, fmt.Errorf("multiple OFFSET clauses not allowed")
+			}
+			p.i++
+			offset, err := p.parseIntConst()
+			if err != nil {
+				return false, err
+			}
+			limit.Offset = offset
+			if p.isKeyword(0, "ROW") || p.isKeyword(0, "ROWS") {
+				p.i++
+			}
+		default:
+			return found, nil
+		}
+		found = true
+	}
+}
+
+// parseIntConst parses a non-negative integer constant.
+func (p *tokenCursor) parseIntConst() (*tree.DInt, error) {
+	n, err := strconv.ParseInt(p.peek(0), 10, 64)
+	if err != nil || n < 0 {
+		return nil, p.syntaxError()
+	}
+	p.i++
+	return tree.NewDInt(tree.DInt(n)), nil
+}
+
+// parseLockingClause parses the locking clause of a SELECT statement, if
+// any:
+//
+//	for_locking_clause:
+//	  for_locking_items
+//
+//	for_locking_item:
+//	  for_locking_strength opt_locked_rels opt_nowait_or_skip
+//
+//	for_locking_strength:
+//	  FOR UPDATE | FOR NO KEY UPDATE | FOR SHARE | FOR KEY SHARE
+//
+//	opt_locked_rels:
+//	  /* EMPTY */ | OF table_name_list
+//
+//	opt_nowait_or_skip:
+//	  /* EMPTY */ | SKIP LOCKED | NOWAIT
+func (p *tokenCursor) parseLockingClause() (tree.LockingClause, error) {
+	var clause tree.LockingClause
+	for p.isKeyword(0, "FOR") {
+		item := &tree.LockingItem{}
+		switch {
+		case p.isKeyword(1, "UPDATE"):
+			item.Strength = tree.ForUpdate
+			p.i += 2
+		case p.isKeyword(1, "SHARE"):
+			item.Strength = tree.ForShare
+			p.i += 2
+		case p.isKeyword(1, "NO") && p.isKeyword(2, "KEY") && p.isKeyword(3, "UPDATE"):
+			item.Strength = tree.ForNoKeyUpdate
+			p.i += 4
+		case p.isKeyword(1, "KEY") && p.isKeyword(2, "SHARE"):
+			item.Strength = tree.ForKeyShare
+			p.i += 3
+		default:
+			return nil, p.syntaxError()
+		}
+		if p.isKeyword(0, "OF") {
+			p.i++
+			for {
+				name := p.peek(0)
+				if name == "" || !isIdentifier(name) {
+					return nil, p.syntaxError()
+				}
+				p.i++
+				item.Targets = append(item.Targets, tree.MakeUnqualifiedTableName(tree.Name(unquote(name))))
+				if p.peek(0) != "," {
+					break
+				}
+				p.i++
+			}
+		}
+		switch {
+		case p.isKeyword(0, "NOWAIT"):
+			item.WaitPolicy = tree.LockWaitError
+			p.i++
+		case p.isKeyword(0, "SKIP") && p.isKeyword(1, "LOCKED"):
+			item.WaitPolicy = tree.LockWaitSkipLocked
+			p.i += 2
+		}
+		clause = append(clause, item)
+	}
+	return clause, nil
+}
+
+// parseTransaction parses a transaction control statement:
+//
+//	transaction_stmt:
+//	  BEGIN opt_transaction opt_transaction_mode
+//	| START TRANSACTION opt_transaction_mode
+//	| COMMIT opt_transaction | END opt_transaction
+//	| ROLLBACK opt_transaction | ABORT opt_transaction
+//
+//	opt_transaction:
+//	  /* EMPTY */ | TRANSACTION
+//
+//	opt_transaction_mode:
+//	  /* EMPTY */ | ISOLATION LEVEL iso_level
+//
+//	iso_level:
+//	  READ UNCOMMITTED | READ COMMITTED | SNAPSHOT | REPEATABLE READ | SERIALIZABLE
+func parseTransaction(sql string) (tree.Statement, error) {
+	toks, err := tokenize(strings.TrimSuffix(strings.TrimSpace(sql), ";"))
+	if err != nil {
+		return nil, err
+	}
+	p := &tokenCursor{toks: toks}
+	var stmt tree.Statement
+	switch {
+	case p.isKeyword(0, "BEGIN"), p.isKeyword(0, "START"):
+		begin := &tree.BeginTransaction{FormatWithStart: p.isKeyword(0, "START")}
+		p.i++
+		if begin.FormatWithStart && !p.isKeyword(0, "TRANSACTION") {
+			return nil, p.syntaxError()
+		}
+		if p.isKeyword(0, "TRANSACTION") {
+			p.i++
+		}
+		if p.isKeyword(0, "ISOLATION") && p.isKeyword(1, "LEVEL") {
+			p.i += 2
+			level, err := p.parseIsolationLevel()
+			if err != nil {
+				return nil, err
+			}
+			begin.Modes.Isolation = level
+		}
+		stmt = begin
+	case p.isKeyword(0, "COMMIT"), p.isKeyword(0, "END"):
+		stmt = &tree.CommitTransaction{}
+		if p.i++; p.isKeyword(0, "TRANSACTION") {
+			p.i++
+		}
+	default:
+		stmt = &tree.RollbackTransaction{}
+		if p.i++; p.isKeyword(0, "TRANSACTION") {
+			p.i++
+		}
+	}
+	if !p.done() {
+		return nil, p.syntaxError()
+	}
+	return stmt, nil
+}
+
+// parseIsolationLevel parses the isolation level of a transaction mode.
+func (p *tokenCursor) parseIsolationLevel() (tree.IsolationLevel, error) {
+	switch {
+	case p.isKeyword(0, "READ") && p.isKeyword(1, "UNCOMMITTED"):
+		p.i += 2
+		return tree.ReadUncommittedIsolation, nil
+	case p.isKeyword(0, "READ") && p.isKeyword(1, "COMMITTED"):
+		p.i += 2
+		return tree.ReadCommittedIsolation, nil
+	case p.isKeyword(0, "REPEATABLE") && p.isKeyword(1, "READ"):
+		p.i += 2
+		return tree.RepeatableReadIsolation, nil
+	case p.isKeyword(0, "SNAPSHOT"):
+		p.i++
+		return tree.SnapshotIsolation, nil
+	case p.isKeyword(0, "SERIALIZABLE"):
+		p.i++
+		return tree.SerializableIsolation, nil
+	default:
+		return tree.UnspecifiedIsolation, p.syntaxError()
+	}
+}
+
+// parseExplain parses an EXPLAIN statement. Only the EXPLAIN ANALYZE of a
+// SELECT statement is supported:
+//
+//	explain_stmt:
+//	  EXPLAIN ANALYZE select_stmt
+func parseExplain(sql string) (tree.Statement, error) {
+	toks, err := tokenize(strings.TrimSuffix(strings.TrimSpace(sql), ";"))
+	if err != nil {
+		return nil, err
+	}
+	p := &tokenCursor{toks: toks, i: 1}
+	if p.done() {
+		return nil, p.syntaxError()
+	}
+	if !p.isKeyword(0, "ANALYZE") {
+		return nil, p.unimplemented()
+	}
+	p.i++
+	if !p.isKeyword(0, "SELECT") {
+		if p.done() {
+			return nil, p.syntaxError()
+		}
+		return nil, p.unimplemented()
+	}
+	stmt, err := parseSelectTokens(toks[p.i:])
+	if err != nil {
+		return nil, err
+	}
+	return &tree.ExplainAnalyze{Statement: stmt}, nil
+}
+
+// parseCreateChangefeed parses a CREATE CHANGEFEED statement:
+//
+//	create_changefeed_stmt:
+//	  CREATE CHANGEFEED FOR changefeed_targets opt_changefeed_sink opt_with_options
+//
+//	changefeed_targets:
+//	  opt_table table_name [, ...]
+//
+//	opt_changefeed_sink:
+//	  /* EMPTY */ | INTO string_or_placeholder
+//
+//	opt_with_options:
+//	  /* EMPTY */ | WITH kv_option [, ...]
+//
+//	kv_option:
+//	  name | name '=' string_or_name
+func parseCreateChangefeed(sql string) (*tree.CreateChangefeed, error) {
+	toks, err := tokenize(strings.TrimSuffix(strings.TrimSpace(sql), ";"))
+	if err != nil {
+		return nil, err
+	}
+	i := 0
+	peek := func() string {
+		if i < len(toks) {
+			return toks[i]
+		}
+		return ""
+	}
+	isKeyword := func(kw string) bool {
+		return strings.EqualFold(peek(), kw)
+	}
+	syntaxError := func() error {
+		if i >= len(toks) {
+			return fmt.Errorf("syntax error at end of input")
+		}
+		return fmt.Errorf("syntax error at or near %q", toks[i])
+	}
+	// expectName consumes an identifier or a string literal, and returns it
+	// unquoted.
+	expectName := func() (string, error) {
+		tok := peek()
+		if tok == "" || tok == "," || tok == "=" {
+			return "", syntaxError()
+		}
+		i++
+		return unquote(tok), nil
+	}
+
+	for _, kw := range []string{"CREATE", "CHANGEFEED", "FOR"} {
+		if !isKeyword(kw) {
+			return nil, syntaxError()
+		}
+		i++
+	}
+	if isKeyword("TABLE") {
+		i++
+	}
+	stmt := &tree.CreateChangefeed{}
+	for {
+		name, err := expectName()
+		if err != nil {
+			return nil, err
+		}
+		stmt.Targets = append(stmt.Targets, tree.MakeUnqualifiedTableName(tree.Name(name)))
+		if peek() != "," {
+			break
+		}
+		i++
+	}
+	if isKeyword("INTO") {
+		i++
+		if !strings.HasPrefix(peek(), "'") {
+			return nil, syntaxError()
+		}
+		stmt.SinkURI = unquote(toks[i])
+		i++
+	}
+	if isKeyword("WITH") {
+		i++
+		for {
+			key, err := expectName()
+			if err != nil {
+				return nil, err
+			}
+			opt := tree.KVOption{Key: tree.Name(strings.ToLower(key))}
+			if peek() == "=" {
+				i++
+				if opt.Value, err = expectName(); err != nil {
+					return nil, err
+				}
+			}
+			stmt.Options = append(stmt.Options, opt)
+			if peek() != "," {
+				break
+			}
+			i++
+		}
+	}
+	if i < len(toks) {
+		return nil, syntaxError()
+	}
+	return stmt, nil
+}
+
+// tokenize splits the SQL into words, string literals, quoted identifiers,
+// parentheses, commas and equal signs. String literals and quoted
+// identifiers keep their quotes.
+func tokenize(sql string) ([]string, error) {
+	var toks []string
+	for i := 0; i < len(sql); {
+		switch c := sql[i]; {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == ',' || c == '=' || c == '(' || c == ')':
+			toks = append(toks, string(c))
+			i++
+		case c == '\'' || c == '"':
+			j := i + 1
+			for ; j < len(sql); j++ {
+				if sql[j] != c {
+					continue
+				}
+				if j+1 < len(sql) && sql[j+1] == c {
+					j++
+					continue
+				}
+				break
+			}
+			if j >= len(sql) {
+				if c == '"' {
+					return nil, fmt.Errorf("unterminated quoted identifier at or near %q", sql[i:])
+				}
+				return nil, fmt.Errorf("unterminated string literal at or near %q", sql[i:])
+			}
+			toks = append(toks, sql[i:j+1])
+			i = j + 1
+		default:
+			j := i
+			for j < len(sql) && !strings.ContainsRune(" \t\n\r,=()'\"", rune(sql[j])) {
+				j++
+			}
+			toks = append(toks, sql[i:j])
+			i = j
+		}
+	}
+	return toks, nil
+}
+
+// HideConstants returns the statement with its literals replaced by
+// underscores, and its tokens separated by single spaces, so that the
+// statements which only differ by their constants or their layout have the
+// same form. The fingerprints of the statements are constructed from it.
+func HideConstants(sql string) string {
+	sql = strings.TrimSuffix(strings.TrimSpace(sql), ";")
+	toks, err := tokenize(sql)
+	if err != nil {
+		return sql
+	}
+	for i, tok := range toks {
+		if tok[0] == '\'' || ('0' <= tok[0] && tok[0] <= '9') {
+			toks[i] = "_"
+		}
+	}
+	return strings.Join(toks, " ")
+}
+
+// unquote returns the value of a string literal or the name of a quoted
+// identifier, or the token itself if it isn't one.
+func unquote(tok string) string {
+	if len(tok) >= 2 && (tok[0] == '\'' || tok[0] == '"') {
+		q := tok[:1]
+		return strings.ReplaceAll(tok[1:len(tok)-1], q+q, q)
+	}
+	return tok
+}
+
+// isName returns whether the token is an unqualified name or a quoted
+// identifier.
+func isName(tok string) bool {
+	if tok[0] == '"' {
+		return true
+	}
+	for i, c := range tok {
+		switch {
+		case c == '_', 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z':
+		case i > 0 && '0' <= c && c <= '9':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// isIdentifier returns whether the token is a name or a quoted identifier,
+// rather than a string literal or punctuation.
+func isIdentifier(tok string) bool {
+	switch tok[0] {
+	case '\'', ',', '=', '(', ')':
+		return false
+	}
+	return true
+}
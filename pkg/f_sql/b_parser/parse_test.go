@@ -0,0 +1,187 @@
+package parser
+
+import (
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/e_sem/tree"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func parseSelectClause(t *testing.T, sql string) (*tree.Select, *tree.SelectClause) {
+	stmt, err := ParseOne(sql)
+	require.NoError(t, err)
+	sel := stmt.AST.(*tree.Select)
+	return sel, sel.Select.(*tree.SelectClause)
+}
+
+// TestParseLockingClause verifies that the locking clause of a SELECT is
+// parsed wherever it may appear, and is not confused with the contents of
+// literals, quoted identifiers and subqueries.
+func TestParseLockingClause(t *testing.T) {
+	for _, tc := range []struct {
+		sql     string
+		locking string
+	}{
+		{sql: "SELECT * FROM t", locking: ""},
+		{sql: "SELECT * FROM t FOR UPDATE", locking: "FOR UPDATE"},
+		{sql: "select * from t for no key update nowait;", locking: "FOR NO KEY UPDATE NOWAIT"},
+		{sql: "SELECT * FROM t FOR SHARE SKIP LOCKED", locking: "FOR SHARE SKIP LOCKED"},
+		{sql: "SELECT * FROM t, u FOR KEY SHARE OF t FOR UPDATE OF u, \"v w\"", locking: "FOR KEY SHARE OF t FOR UPDATE OF u, v w"},
+		{sql: "SELECT * FROM t WHERE s = 'x for update y'", locking: ""},
+		{sql: "SELECT * FROM t WHERE s = 'it''s for update' FOR SHARE", locking: "FOR SHARE"},
+		{sql: "SELECT \"for update\" FROM t", locking: ""},
+		{sql: "SELECT * FROM t WHERE a IN (SELECT a FROM u FOR UPDATE)", locking: ""},
+		{sql: "SELECT * FROM t WHERE a IN (SELECT a FROM u LIMIT 1) FOR SHARE", locking: "FOR SHARE"},
+	} {
+		t.Run(tc.sql, func(t *testing.T) {
+			_, sc := parseSelectClause(t, tc.sql)
+			require.Equal(t, tc.locking, sc.Locking.String())
+		})
+	}
+}
+
+// TestParseLockingClauseWithLimit verifies that the locking clause of a
+// SELECT may precede or follow its LIMIT and OFFSET clauses.
+func TestParseLockingClauseWithLimit(t *testing.T) {
+	count, offset := tree.NewDInt(1), tree.NewDInt(2)
+	for _, tc := range []struct {
+		sql   string
+		limit tree.Limit
+	}{
+		{sql: "SELECT * FROM t FOR UPDATE LIMIT 1", limit: tree.Limit{Count: count}},
+		{sql: "SELECT * FROM t LIMIT 1 FOR UPDATE", limit: tree.Limit{Count: count}},
+		{sql: "SELECT * FROM t FOR UPDATE OFFSET 2 ROWS", limit: tree.Limit{Offset: offset}},
+		{sql: "SELECT * FROM t FOR UPDATE LIMIT 1 OFFSET 2", limit: tree.Limit{Count: count, Offset: offset}},
+		{sql: "SELECT * FROM t OFFSET 2 LIMIT 1 FOR UPDATE", limit: tree.Limit{Count: count, Offset: offset}},
+		{sql: "SELECT * FROM t LIMIT ALL FOR UPDATE", limit: tree.Limit{LimitAll: true}},
+	} {
+		t.Run(tc.sql, func(t *testing.T) {
+			sel, sc := parseSelectClause(t, tc.sql)
+			require.Equal(t, "FOR UPDATE", sc.Locking.String())
+			require.Equal(t, tc.limit, *sel.Limit)
+		})
+	}
+}
+
+// TestParseLockingClauseErrors verifies that the clauses at the end of a
+// SELECT are rejected when they are malformed or repeated.
+func TestParseLockingClauseErrors(t *testing.T) {
+	for _, tc := range []struct {
+		sql string
+		err string
+	}{
+		{sql: "SELECT * FROM t FOR UPDATE y", err: `syntax error at or near "y"`},
+		{sql: "SELECT * FROM t FOR UPDATE OF", err: "syntax error at end of input"},
+		{sql: "SELECT * FROM t FOR UPDATE OF 't'", err: `syntax error at or near "'t'"`},
+		{sql: "SELECT * FROM t LIMIT x", err: `syntax error at or near "x"`},
+		{sql: "SELECT * FROM t LIMIT 1 FOR UPDATE LIMIT 2", err: `syntax error at or near "LIMIT"`},
+		{sql: "SELECT * FROM t FOR UPDATE LIMIT 1 FOR SHARE", err: `syntax error at or near "FOR"`},
+		{sql: "SELECT * FROM t LIMIT 1 LIMIT 2", err: "multiple LIMIT clauses not allowed"},
+		{sql: "SELECT * FROM t WHERE s = 'x", err: "unterminated string literal"},
+	} {
+		t.Run(tc.sql, func(t *testing.T) {
+			_, err := ParseOne(tc.sql)
+			require.ErrorContains(t, err, tc.err)
+		})
+	}
+}
+
+// TestParseTransaction verifies that the transaction control statements are
+// parsed, along with the isolation level of the transactions they begin.
+func TestParseTransaction(t *testing.T) {
+	for _, tc := range []struct {
+		sql  string
+		stmt tree.Statement
+	}{
+		{sql: "BEGIN", stmt: &tree.BeginTransaction{}},
+		{sql: "begin transaction;", stmt: &tree.BeginTransaction{}},
+		{sql: "START TRANSACTION", stmt: &tree.BeginTransaction{FormatWithStart: true}},
+		{sql: "BEGIN ISOLATION LEVEL READ COMMITTED", stmt: &tree.BeginTransaction{
+			Modes: tree.TransactionModes{Isolation: tree.ReadCommittedIsolation}}},
+		{sql: "BEGIN TRANSACTION ISOLATION LEVEL REPEATABLE READ", stmt: &tree.BeginTransaction{
+			Modes: tree.TransactionModes{Isolation: tree.RepeatableReadIsolation}}},
+		{sql: "START TRANSACTION ISOLATION LEVEL SERIALIZABLE", stmt: &tree.BeginTransaction{
+			FormatWithStart: true, Modes: tree.TransactionModes{Isolation: tree.SerializableIsolation}}},
+		{sql: "COMMIT", stmt: &tree.CommitTransaction{}},
+		{sql: "END TRANSACTION", stmt: &tree.CommitTransaction{}},
+		{sql: "ROLLBACK", stmt: &tree.RollbackTransaction{}},
+		{sql: "abort transaction", stmt: &tree.RollbackTransaction{}},
+	} {
+		t.Run(tc.sql, func(t *testing.T) {
+			stmt, err := ParseOne(tc.sql)
+			require.NoError(t, err)
+			require.Equal(t, tc.stmt, stmt.AST)
+		})
+	}
+
+	for sql, err := range map[string]string{
+		"START":                           "syntax error at end of input",
+		"BEGIN ISOLATION LEVEL READ":      "syntax error at or near \"READ\"",
+		"BEGIN ISOLATION LEVEL CHAOS":     "syntax error at or near \"CHAOS\"",
+		"COMMIT TRANSACTION NOW":          "syntax error at or near \"NOW\"",
+		"ROLLBACK TO SAVEPOINT cockroach": "syntax error at or near \"TO\"",
+	} {
+		_, actual := ParseOne(sql)
+		require.ErrorContains(t, actual, err, sql)
+	}
+}
+
+// TestParseTableName verifies that the tables of the FROM clause may be
+// qualified by the name of their schema.
+func TestParseTableName(t *testing.T) {
+	_, sc := parseSelectClause(t, `SELECT * FROM crdb_internal.transaction_contention_events, t, "a.b"`)
+	require.Len(t, sc.From.Tables, 3)
+	tn := sc.From.Tables[0].(*tree.TableName)
+	require.True(t, tn.ExplicitSchema)
+	require.Equal(t, "crdb_internal", tn.Schema())
+	require.Equal(t, "transaction_contention_events", tn.Table())
+	for i, name := range []string{"t", "a.b"} {
+		tn := sc.From.Tables[i+1].(*tree.TableName)
+		require.False(t, tn.ExplicitSchema)
+		require.Equal(t, name, tn.Table())
+	}
+
+	for sql, err := range map[string]string{
+		"SELECT * FROM s.":      `syntax error at or near "s."`,
+		"SELECT * FROM s..t":    `syntax error at or near "s..t"`,
+		"SELECT * FROM db.s.t":  `at or near "db.s.t": unimplemented`,
+		"SELECT * FROM s.t.'u'": `syntax error at or near "s.t."`,
+	} {
+		_, actual := ParseOne(sql)
+		require.ErrorContains(t, actual, err, sql)
+	}
+}
+
+// TestParseExplainAnalyze verifies that EXPLAIN ANALYZE wraps the statement
+// that it runs.
+func TestParseExplainAnalyze(t *testing.T) {
+	stmt, err := ParseOne("explain analyze SELECT a FROM t FOR UPDATE LIMIT 1;")
+	require.NoError(t, err)
+	explain := stmt.AST.(*tree.ExplainAnalyze)
+	expected, err := ParseOne("SELECT a FROM t FOR UPDATE LIMIT 1")
+	require.NoError(t, err)
+	require.Equal(t, expected.AST, explain.Statement)
+
+	for sql, err := range map[string]string{
+		"EXPLAIN":                 "syntax error at end of input",
+		"EXPLAIN ANALYZE":         "syntax error at end of input",
+		"EXPLAIN SELECT * FROM t": `at or near "SELECT": unimplemented`,
+		"EXPLAIN ANALYZE BEGIN":   `at or near "BEGIN": unimplemented`,
+	} {
+		_, actual := ParseOne(sql)
+		require.ErrorContains(t, actual, err, sql)
+	}
+}
+
+// TestHideConstants verifies that the statements which only differ by their
+// constants or their layout have the same form once their constants are
+// hidden.
+func TestHideConstants(t *testing.T) {
+	const expected = "SELECT a FROM t WHERE b = _ LIMIT _"
+	for _, sql := range []string{
+		"SELECT a FROM t WHERE b = 'x' LIMIT 1",
+		"SELECT a  FROM t\nWHERE b='it''s' LIMIT 10;",
+	} {
+		require.Equal(t, expected, HideConstants(sql), sql)
+	}
+	require.Equal(t, `SELECT "1" FROM t`, HideConstants(`SELECT "1" FROM t`))
+}
@@ -23,3 +23,8 @@ type ResultColumn struct {
 // ResultColumns is the type used throughout the sql module to
 // describe the column types of a table.
 type ResultColumns []ResultColumn
+
+// ExplainPlanColumns are the result columns of EXPLAIN ANALYZE.
+var ExplainPlanColumns = ResultColumns{
+	{Name: "info", Typ: types.String},
+}
@@ -1,6 +1,10 @@
 package descpb
 
-import "github.com/dborchard/tiny_crdb/pkg/f_sql/e_sem/catid"
+import (
+	"fmt"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/e_sem/catid"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/types"
+)
 
 // ID, ColumnID, FamilyID, and IndexID are all uint32, but are each given a
 // type alias to prevent accidental use of one of the types where
@@ -8,3 +12,61 @@ import "github.com/dborchard/tiny_crdb/pkg/f_sql/e_sem/catid"
 
 // ID is a custom type for {Database,Table}Descriptor IDs.
 type ID = catid.DescID
+
+// ColumnID is a custom type for ColumnDescriptor IDs.
+type ColumnID = catid.ColumnID
+
+// IndexID is a custom type for IndexDescriptor IDs.
+type IndexID = catid.IndexID
+
+// MinUserDescID is the smallest ID of the descriptors of the user tables.
+const MinUserDescID ID = 100
+
+// ColumnDescriptor describes a column of a table.
+type ColumnDescriptor struct {
+	Name     string
+	ID       ColumnID
+	Type     *types.T
+	Nullable bool
+}
+
+// IndexDescriptor describes an index of a table. The key of an index entry is
+// made of the values of the key columns of the index, in order.
+type IndexDescriptor struct {
+	Name         string
+	ID           IndexID
+	KeyColumnIDs []ColumnID
+}
+
+// TableDescriptor describes a table. The rows of the table are stored in its
+// primary index: the key of a row holds the values of the primary key
+// columns, and its value those of the other columns.
+type TableDescriptor struct {
+	Name         string
+	ID           ID
+	Columns      []ColumnDescriptor
+	PrimaryIndex IndexDescriptor
+	// Version is incremented on every change of the descriptor.
+	Version uint64
+}
+
+// FindColumnByID returns the column with the ID, or an error if the table
+// has no such column.
+func (desc *TableDescriptor) FindColumnByID(id ColumnID) (*ColumnDescriptor, error) {
+	for i := range desc.Columns {
+		if desc.Columns[i].ID == id {
+			return &desc.Columns[i], nil
+		}
+	}
+	return nil, fmt.Errorf("column-id \"%d\" does not exist", id)
+}
+
+// ColumnIdxMap returns a map from the IDs of the columns of the table to
+// their ordinals in Columns.
+func (desc *TableDescriptor) ColumnIdxMap() map[ColumnID]int {
+	m := make(map[ColumnID]int, len(desc.Columns))
+	for i := range desc.Columns {
+		m[desc.Columns[i].ID] = i
+	}
+	return m
+}
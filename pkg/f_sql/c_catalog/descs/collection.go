@@ -1,5 +1,13 @@
 package descs
 
+import (
+	"context"
+	"fmt"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/c_catalog/descpb"
+	keys "github.com/dborchard/tiny_crdb/pkg/g_keys"
+	kv "github.com/dborchard/tiny_crdb/pkg/g_kv"
+)
+
 // Collection is a collection of descriptors held by a single session that
 // serves SQL requests, or a background job using descriptors. The
 // collection is cleared using ReleaseAll() which is called at the
@@ -10,3 +18,77 @@ package descs
 // binding a collection to a *kv.Txn.
 type Collection struct {
 }
+
+// WriteDesc writes the descriptor of the table, and the mapping of its name
+// to its ID, in the transaction. The version of the descriptor is
+// incremented.
+func (tc *Collection) WriteDesc(
+	ctx context.Context, txn *kv.Txn, desc *descpb.TableDescriptor,
+) error {
+	desc.Version++
+	b := txn.NewBatch()
+	b.Put(keys.DescMetadataKey(uint32(desc.ID)), desc)
+	b.Put(keys.NamespaceKey(desc.Name), int64(desc.ID))
+	return txn.Run(ctx, b)
+}
+
+// GetImmutableTableByID returns the descriptor of the table with the ID, as
+// of the transaction.
+func (tc *Collection) GetImmutableTableByID(
+	ctx context.Context, txn *kv.Txn, id descpb.ID,
+) (*descpb.TableDescriptor, error) {
+	res, err := txn.Get(ctx, keys.DescMetadataKey(uint32(id)))
+	if err != nil {
+		return nil, err
+	}
+	if res.Value == nil {
+		return nil, fmt.Errorf("descriptor not found: %d", id)
+	}
+	desc := &descpb.TableDescriptor{}
+	if err := res.Value.GetProto(desc); err != nil {
+		return nil, err
+	}
+	return desc, nil
+}
+
+// GetImmutableTableByName returns the descriptor of the table with the name,
+// as of the transaction.
+func (tc *Collection) GetImmutableTableByName(
+	ctx context.Context, txn *kv.Txn, name string,
+) (*descpb.TableDescriptor, error) {
+	res, err := txn.Get(ctx, keys.NamespaceKey(name))
+	if err != nil {
+		return nil, err
+	}
+	if res.Value == nil {
+		return nil, fmt.Errorf("relation %q does not exist", name)
+	}
+	id, err := res.Value.GetInt()
+	if err != nil {
+		return nil, err
+	}
+	return tc.GetImmutableTableByID(ctx, txn, descpb.ID(id))
+}
+
+// GenerateUniqueDescID allocates a new descriptor ID from the descriptor ID
+// generator. The IDs of the user tables start at descpb.MinUserDescID.
+func GenerateUniqueDescID(ctx context.Context, db *kv.DB) (descpb.ID, error) {
+	var id int64
+	if err := db.Txn(ctx, func(ctx context.Context, txn *kv.Txn) error {
+		res, err := txn.GetForUpdate(ctx, keys.DescIDGenerator)
+		if err != nil {
+			return err
+		}
+		id = int64(descpb.MinUserDescID) - 1
+		if res.Value != nil {
+			if id, err = res.Value.GetInt(); err != nil {
+				return err
+			}
+		}
+		id++
+		return txn.Put(ctx, keys.DescIDGenerator, id)
+	}); err != nil {
+		return 0, fmt.Errorf("unable to allocate descriptor ID: %w", err)
+	}
+	return descpb.ID(id), nil
+}
@@ -48,8 +48,14 @@ func (buf *StmtBuf) Init() {
 	buf.mu.data = ring.NewBuffer[Command]()
 }
 
+// Close marks the buffer as closed. Once Close is called, no further
+// commands can be pushed, and CurCmd returns io.EOF, waking up a CurCmd call
+// blocked waiting for a command.
 func (buf *StmtBuf) Close() {
-
+	buf.mu.Lock()
+	buf.mu.closed = true
+	buf.mu.cond.Signal()
+	buf.mu.Unlock()
 }
 
 // Push adds a Command to the end of the buffer. If a CurCmd() call was blocked
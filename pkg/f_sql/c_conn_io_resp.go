@@ -2,6 +2,7 @@ package sql
 
 import (
 	"context"
+	"errors"
 	"github.com/dborchard/tiny_crdb/pkg/f_sql/c_catalog/colinfo"
 	"github.com/dborchard/tiny_crdb/pkg/f_sql/e_sem/tree"
 	"github.com/dborchard/tiny_crdb/pkg/y_col/coldata"
@@ -84,9 +85,11 @@ func (r *streamingCommandResult) RowsAffected() int {
 	panic("implement me")
 }
 
+// Discard is part of the CommandResult interface.
 func (r *streamingCommandResult) Discard() {
-	//TODO implement me
-	panic("implement me")
+	if r.discardCallback != nil {
+		r.discardCallback()
+	}
 }
 
 func (r *streamingCommandResult) SetError(err error) {
@@ -97,3 +100,76 @@ func (r *streamingCommandResult) SetError(err error) {
 func (r *streamingCommandResult) Err() error {
 	return r.err
 }
+
+// bufferedCommandResult is a RestrictedCommandResult which buffers the
+// results of an attempt at running a statement, so that they can be thrown
+// away if the statement is retried, or forwarded to the client's result once
+// the attempt succeeds.
+type bufferedCommandResult struct {
+	cols         colinfo.ResultColumns
+	rows         []tree.Datums
+	rowsAffected int
+	err          error
+}
+
+var _ RestrictedCommandResult = &bufferedCommandResult{}
+
+// SetColumns is part of the RestrictedCommandResult interface.
+func (r *bufferedCommandResult) SetColumns(_ context.Context, cols colinfo.ResultColumns) {
+	if cols == nil {
+		cols = colinfo.ResultColumns{}
+	}
+	r.cols = cols
+}
+
+// AddRow is part of the RestrictedCommandResult interface.
+func (r *bufferedCommandResult) AddRow(_ context.Context, row tree.Datums) error {
+	r.rows = append(r.rows, append(tree.Datums(nil), row...))
+	return nil
+}
+
+// AddBatch is part of the RestrictedCommandResult interface.
+func (r *bufferedCommandResult) AddBatch(context.Context, coldata.Batch) error {
+	return errors.New("bufferedCommandResult does not support AddBatch")
+}
+
+// SupportsAddBatch is part of the RestrictedCommandResult interface.
+func (r *bufferedCommandResult) SupportsAddBatch() bool {
+	return false
+}
+
+// SetRowsAffected is part of the RestrictedCommandResult interface.
+func (r *bufferedCommandResult) SetRowsAffected(_ context.Context, n int) {
+	r.rowsAffected = n
+}
+
+// RowsAffected is part of the RestrictedCommandResult interface.
+func (r *bufferedCommandResult) RowsAffected() int {
+	return r.rowsAffected
+}
+
+// SetError is part of the RestrictedCommandResult interface.
+func (r *bufferedCommandResult) SetError(err error) {
+	r.err = err
+}
+
+// Err is part of the RestrictedCommandResult interface.
+func (r *bufferedCommandResult) Err() error {
+	return r.err
+}
+
+// flush forwards the buffered results to res.
+func (r *bufferedCommandResult) flush(ctx context.Context, res RestrictedCommandResult) error {
+	if r.cols != nil {
+		res.SetColumns(ctx, r.cols)
+	}
+	for _, row := range r.rows {
+		if err := res.AddRow(ctx, row); err != nil {
+			return err
+		}
+	}
+	if r.rowsAffected != 0 {
+		res.SetRowsAffected(ctx, r.rowsAffected)
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+package changefeedccl
+
+import (
+	"context"
+	"fmt"
+	jobs "github.com/dborchard/tiny_crdb/pkg/f_jobs"
+	"github.com/dborchard/tiny_crdb/pkg/f_jobs/jobspb"
+	sql "github.com/dborchard/tiny_crdb/pkg/f_sql"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/c_catalog/descpb"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/c_catalog/descs"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/rowenc"
+	keys "github.com/dborchard/tiny_crdb/pkg/g_keys"
+	kv "github.com/dborchard/tiny_crdb/pkg/g_kv"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvclient/rangefeed"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"time"
+)
+
+func init() {
+	jobs.RegisterConstructor(jobspb.TypeChangefeed, func(job *jobs.Job) jobs.Resumer {
+		return &changefeedResumer{job: job}
+	})
+}
+
+// changefeedResumer runs the job of a changefeed.
+type changefeedResumer struct {
+	job *jobs.Job
+}
+
+var _ jobs.Resumer = &changefeedResumer{}
+
+// Resume implements the jobs.Resumer interface. It runs the changefeed until
+// it fails, or the job is canceled.
+func (r *changefeedResumer) Resume(ctx context.Context, execCtx interface{}) error {
+	execCfg := execCtx.(*sql.ExecutorConfig)
+	cf, err := newChangefeed(ctx, execCfg, r.job)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = cf.sink.Close() }()
+	return cf.run(ctx)
+}
+
+// OnFailOrCancel implements the jobs.Resumer interface. A changefeed has
+// nothing to clean up: the messages emitted into its sink are kept.
+func (r *changefeedResumer) OnFailOrCancel(context.Context, interface{}, error) error {
+	return nil
+}
+
+// changefeed is a running changefeed. Its callbacks are all called by the
+// goroutine of its rangefeed.
+type changefeed struct {
+	job     *jobs.Job
+	details *jobspb.ChangefeedDetails
+	factory *rangefeed.Factory
+
+	// tables are the descriptors of the tables of the changefeed. The
+	// changes to the schemas of the tables after the changefeed started are
+	// not followed.
+	tables  map[descpb.ID]*descpb.TableDescriptor
+	encoder Encoder
+	sink    Sink
+	diff    bool
+
+	emitResolved     bool
+	resolvedInterval time.Duration
+	lastResolved     time.Time
+
+	// errCh receives the first error of the changefeed, after which its
+	// callbacks do nothing.
+	errCh  chan error
+	failed bool
+}
+
+func newChangefeed(
+	ctx context.Context, execCfg *sql.ExecutorConfig, job *jobs.Job,
+) (*changefeed, error) {
+	details := job.Details().Changefeed
+	if details == nil {
+		return nil, fmt.Errorf("job %d: not a changefeed", job.ID())
+	}
+	encoder, sink, err := getSink(details.SinkURI, details.Opts)
+	if err != nil {
+		return nil, err
+	}
+	cf := &changefeed{
+		job:     job,
+		details: details,
+		factory: execCfg.RangeFeedFactory,
+		tables:  make(map[descpb.ID]*descpb.TableDescriptor, len(details.Tables)),
+		encoder: encoder,
+		sink:    sink,
+		errCh:   make(chan error, 1),
+	}
+	_, cf.diff = details.Opts[OptDiff]
+	cf.resolvedInterval, cf.emitResolved = resolvedInterval(details.Opts)
+	if err := execCfg.DB.Txn(ctx, func(ctx context.Context, txn *kv.Txn) error {
+		var col descs.Collection
+		for id := range details.Tables {
+			desc, err := col.GetImmutableTableByID(ctx, txn, id)
+			if err != nil {
+				return err
+			}
+			cf.tables[id] = desc
+		}
+		return nil
+	}); err != nil {
+		_ = sink.Close()
+		return nil, err
+	}
+	return cf, nil
+}
+
+// run runs the rangefeed of the changefeed until the changefeed fails or the
+// context is canceled. The changefeed resumes from the high-water mark of
+// its job, if any. Otherwise, it starts from its statement time, which the
+// initial scan reads the tables as of.
+func (cf *changefeed) run(ctx context.Context) error {
+	spans := make([]roachpb.Span, 0, len(cf.tables))
+	for _, desc := range cf.tables {
+		spans = append(spans, rowenc.PrimaryIndexSpan(desc))
+	}
+	start := cf.details.StatementTime
+	options := []rangefeed.Option{
+		rangefeed.WithDiff(cf.diff),
+		rangefeed.WithOnFrontierAdvance(cf.checkpoint),
+	}
+	if highWater := cf.job.Progress().HighWater; !highWater.IsEmpty() {
+		start = highWater
+	} else if cf.details.Opts[OptInitialScan] != OptInitialScanNo {
+		options = append(options, rangefeed.WithInitialScan(func(ctx context.Context) {
+			cf.checkpoint(ctx, start)
+		}))
+	}
+
+	rf, err := cf.factory.RangeFeed(
+		ctx, fmt.Sprintf("changefeed-%d", cf.job.ID()), spans, start, cf.emitValue, options...)
+	if err != nil {
+		return err
+	}
+	defer rf.Close()
+	select {
+	case err := <-cf.errCh:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// fail records the error of the changefeed, which stops it.
+func (cf *changefeed) fail(err error) {
+	cf.failed = true
+	select {
+	case cf.errCh <- err:
+	default:
+	}
+}
+
+// emitValue decodes the changed row of a value of the rangefeed, and emits
+// it into the sink.
+func (cf *changefeed) emitValue(ctx context.Context, v *kvpb.RangeFeedValue) {
+	if cf.failed {
+		return
+	}
+	if err := cf.emitValueOrErr(ctx, v); err != nil {
+		cf.fail(err)
+	}
+}
+
+func (cf *changefeed) emitValueOrErr(ctx context.Context, v *kvpb.RangeFeedValue) error {
+	_, tableID, err := keys.DecodeTablePrefix(v.Key)
+	if err != nil {
+		return err
+	}
+	desc, ok := cf.tables[descpb.ID(tableID)]
+	if !ok {
+		return fmt.Errorf("changefeed: unexpected key %s", v.Key)
+	}
+	row := encodeRow{tableDesc: desc, updated: v.Value.Timestamp}
+	if row.datums, row.deleted, err = rowenc.DecodePrimaryIndex(desc, v.Key, v.Value); err != nil {
+		return err
+	}
+	if cf.diff {
+		if row.prevDatums, row.prevDeleted, err = rowenc.DecodePrimaryIndex(desc, v.Key, v.PrevValue); err != nil {
+			return err
+		}
+	}
+	key, err := cf.encoder.EncodeKey(row)
+	if err != nil {
+		return err
+	}
+	value, err := cf.encoder.EncodeValue(row)
+	if err != nil {
+		return err
+	}
+	topic := cf.details.Tables[desc.ID].StatementTimeName
+	return cf.sink.EmitRow(ctx, topic, key, value, row.updated)
+}
+
+// checkpoint is called when all the changes to the tables up to the
+// timestamp have been emitted. It flushes the sink, emits a resolved
+// timestamp message if needed, and records the timestamp as the high-water
+// mark of the job.
+func (cf *changefeed) checkpoint(ctx context.Context, resolved hlc.Timestamp) {
+	if cf.failed {
+		return
+	}
+	if err := cf.sink.Flush(ctx); err != nil {
+		cf.fail(err)
+		return
+	}
+	if cf.emitResolved && time.Since(cf.lastResolved) >= cf.resolvedInterval {
+		if err := cf.sink.EmitResolvedTimestamp(ctx, cf.encoder, resolved); err != nil {
+			cf.fail(err)
+			return
+		}
+		cf.lastResolved = time.Now()
+	}
+	if err := cf.job.HighWaterProgressed(ctx, resolved); err != nil {
+		cf.fail(err)
+	}
+}
@@ -0,0 +1,80 @@
+// Package changefeedccl implements changefeeds: CREATE CHANGEFEED streams the
+// changes to the rows of tables into a sink, as messages.
+//
+// A changefeed runs as a job, which follows the primary indexes of its
+// tables with a rangefeed, decodes the changed KVs into rows, and emits them
+// into the sink. Whenever the frontier of the rangefeed advances, the sink is
+// flushed and the frontier is checkpointed as the high-water mark of the
+// job, from which the changefeed resumes when the node running it stops. The
+// messages emitted after the last checkpoint are emitted again: the delivery
+// is at-least-once.
+package changefeedccl
+
+import (
+	"context"
+	"fmt"
+	"github.com/dborchard/tiny_crdb/pkg/e_security/username"
+	jobs "github.com/dborchard/tiny_crdb/pkg/f_jobs"
+	"github.com/dborchard/tiny_crdb/pkg/f_jobs/jobspb"
+	sql "github.com/dborchard/tiny_crdb/pkg/f_sql"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/c_catalog/descpb"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/c_catalog/descs"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/e_sem/tree"
+	kv "github.com/dborchard/tiny_crdb/pkg/g_kv"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+)
+
+// CreateChangefeedJob plans a CREATE CHANGEFEED statement: it validates the
+// options and the sink of the changefeed, resolves its tables, and creates
+// the job which runs it. It returns the ID of the job.
+func CreateChangefeedJob(
+	ctx context.Context, execCfg *sql.ExecutorConfig, stmt *tree.CreateChangefeed,
+) (jobspb.JobID, error) {
+	if stmt.SinkURI == "" {
+		return jobspb.InvalidJobID, fmt.Errorf("changefeeds without a sink are not supported")
+	}
+	opts, err := validateOptions(stmt.Options)
+	if err != nil {
+		return jobspb.InvalidJobID, err
+	}
+	_, sink, err := getSink(stmt.SinkURI, opts)
+	if err != nil {
+		return jobspb.InvalidJobID, err
+	}
+	_ = sink.Close()
+
+	// The changefeed follows the tables from the time of the statement, as of
+	// which it resolves their names.
+	var statementTime hlc.Timestamp
+	tables := make(map[descpb.ID]jobspb.ChangefeedTargetTable, len(stmt.Targets))
+	if err := execCfg.DB.Txn(ctx, func(ctx context.Context, txn *kv.Txn) error {
+		statementTime = txn.Sender().ReadTimestamp()
+		var col descs.Collection
+		for i := range stmt.Targets {
+			name := stmt.Targets[i].Table()
+			desc, err := col.GetImmutableTableByName(ctx, txn, name)
+			if err != nil {
+				return err
+			}
+			tables[desc.ID] = jobspb.ChangefeedTargetTable{StatementTimeName: name}
+		}
+		return nil
+	}); err != nil {
+		return jobspb.InvalidJobID, err
+	}
+
+	job, err := execCfg.JobRegistry.CreateJob(ctx, jobs.Record{
+		Description: stmt.String(),
+		Username:    username.RootUser,
+		Details: jobspb.Details{Changefeed: &jobspb.ChangefeedDetails{
+			Tables:        tables,
+			SinkURI:       stmt.SinkURI,
+			Opts:          opts,
+			StatementTime: statementTime,
+		}},
+	})
+	if err != nil {
+		return jobspb.InvalidJobID, err
+	}
+	return job.ID(), nil
+}
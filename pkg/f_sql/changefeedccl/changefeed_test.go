@@ -0,0 +1,301 @@
+package changefeedccl_test
+
+import (
+	"context"
+	"encoding/json"
+	jobs "github.com/dborchard/tiny_crdb/pkg/f_jobs"
+	"github.com/dborchard/tiny_crdb/pkg/f_jobs/jobspb"
+	sql "github.com/dborchard/tiny_crdb/pkg/f_sql"
+	parser "github.com/dborchard/tiny_crdb/pkg/f_sql/b_parser"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/c_catalog/descpb"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/changefeedccl"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/e_sem/tree"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/rowenc"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/sqltestutils"
+	kv "github.com/dborchard/tiny_crdb/pkg/g_kv"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvclient/rangefeed"
+	"github.com/dborchard/tiny_crdb/pkg/z_testutils/testcluster"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startJobRegistry sets up the executor config of the node, and starts its
+// job registry, like the SQL server of a node does. The claims of the jobs
+// expire quickly, for the jobs of stopped nodes to be adopted.
+func startJobRegistry(t *testing.T, ts *testcluster.TestServer) *sql.ExecutorConfig {
+	execCfg := &sql.ExecutorConfig{
+		DB:               ts.DB(),
+		Clock:            ts.Clock(),
+		Stopper:          ts.Stopper(),
+		RangeFeedFactory: rangefeed.NewFactory(ts.Stopper(), ts.DB(), ts.DistSender()),
+	}
+	execCfg.JobRegistry = jobs.MakeRegistry(jobs.RegistryConfig{
+		DB:            ts.DB(),
+		Clock:         ts.Clock(),
+		Stopper:       ts.Stopper(),
+		ExecCtx:       execCfg,
+		AdoptInterval: 100 * time.Millisecond,
+		ClaimTTL:      time.Second,
+	})
+	require.NoError(t, execCfg.JobRegistry.Start(context.Background()))
+	return execCfg
+}
+
+// upsert writes the row of the table created by sqltestutils.CreateTable. An
+// empty b is a NULL.
+func upsert(t *testing.T, db *kv.DB, desc *descpb.TableDescriptor, a int64, b string) {
+	row := tree.Datums{tree.NewDInt(tree.DInt(a)), nil}
+	if b != "" {
+		row[1] = tree.NewDString(b)
+	}
+	key, value, err := rowenc.EncodePrimaryIndex(desc, row)
+	require.NoError(t, err)
+	require.NoError(t, db.Txn(context.Background(), func(ctx context.Context, txn *kv.Txn) error {
+		return txn.Put(ctx, key, &value)
+	}))
+}
+
+// deleteRow deletes the row of the table created by
+// sqltestutils.CreateTable.
+func deleteRow(t *testing.T, db *kv.DB, desc *descpb.TableDescriptor, a int64) {
+	key, _, err := rowenc.EncodePrimaryIndex(desc, tree.Datums{tree.NewDInt(tree.DInt(a)), nil})
+	require.NoError(t, err)
+	require.NoError(t, db.Txn(context.Background(), func(ctx context.Context, txn *kv.Txn) error {
+		_, err := txn.Del(ctx, key)
+		return err
+	}))
+}
+
+// createChangefeed parses the CREATE CHANGEFEED statement, and creates its
+// job.
+func createChangefeed(
+	t *testing.T, execCfg *sql.ExecutorConfig, stmtStr string,
+) (jobspb.JobID, error) {
+	stmt, err := parser.ParseOne(stmtStr)
+	require.NoError(t, err)
+	return changefeedccl.CreateChangefeedJob(
+		context.Background(), execCfg, stmt.AST.(*tree.CreateChangefeed))
+}
+
+// webhookMessage is a message received by a webhook.
+type webhookMessage struct {
+	After    map[string]interface{} `json:"after"`
+	Before   map[string]interface{} `json:"before"`
+	Key      []interface{}          `json:"key"`
+	Topic    string                 `json:"topic"`
+	Updated  string                 `json:"updated"`
+	Resolved string                 `json:"resolved"`
+}
+
+// webhook records the messages posted by a webhook sink, in order.
+type webhook struct {
+	mu       sync.Mutex
+	messages []webhookMessage
+}
+
+func (w *webhook) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Payload []webhookMessage `json:"payload"`
+		Length  int              `json:"length"`
+		webhookMessage
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if body.Resolved != "" {
+		w.messages = append(w.messages, body.webhookMessage)
+		return
+	}
+	if body.Length != len(body.Payload) {
+		http.Error(rw, "length mismatch", http.StatusBadRequest)
+		return
+	}
+	w.messages = append(w.messages, body.Payload...)
+}
+
+// waitFor waits for a message to match the predicate, and returns the index
+// of the first match.
+func (w *webhook) waitFor(t *testing.T, pred func(m webhookMessage) bool) int {
+	idx := -1
+	require.Eventually(t, func() bool {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		for i, m := range w.messages {
+			if pred(m) {
+				idx = i
+				return true
+			}
+		}
+		return false
+	}, 10*time.Second, 10*time.Millisecond)
+	return idx
+}
+
+// waitForResolvedAfter waits for a resolved timestamp message after the
+// message with the index.
+func (w *webhook) waitForResolvedAfter(t *testing.T, idx int) {
+	require.Eventually(t, func() bool {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		for _, m := range w.messages[idx+1:] {
+			if m.Resolved != "" {
+				return true
+			}
+		}
+		return false
+	}, 10*time.Second, 10*time.Millisecond)
+}
+
+func isRow(a float64, after, before string) func(m webhookMessage) bool {
+	value := func(row map[string]interface{}) string {
+		if row == nil {
+			return "<deleted>"
+		}
+		b, _ := row["b"].(string)
+		return b
+	}
+	return func(m webhookMessage) bool {
+		return m.Topic == "t" && len(m.Key) == 1 && m.Key[0] == a &&
+			value(m.After) == after && value(m.Before) == before
+	}
+}
+
+// TestChangefeedWebhook verifies that a changefeed into a webhook emits the
+// initial scan of its table, then its changes with their previous values and
+// timestamps, and resolved timestamps.
+func TestChangefeedWebhook(t *testing.T) {
+	ctx := context.Background()
+	hook := &webhook{}
+	srv := httptest.NewTLSServer(hook)
+	t.Cleanup(srv.Close)
+	tc := testcluster.StartTestCluster(t, 1)
+	ts := tc.Server(0)
+	db := ts.DB()
+	execCfg := startJobRegistry(t, ts)
+
+	desc := sqltestutils.CreateTable(t, db, "t")
+	upsert(t, db, desc, 1, "a")
+	sinkURI := "webhook-" + srv.URL + "/feed?insecure_tls_skip_verify=true"
+	jobID, err := createChangefeed(t, execCfg,
+		"CREATE CHANGEFEED FOR TABLE t INTO '"+sinkURI+"' WITH updated, diff, resolved")
+	require.NoError(t, err)
+
+	hook.waitFor(t, isRow(1, "a", "<deleted>"))
+	upsert(t, db, desc, 1, "b")
+	hook.waitFor(t, isRow(1, "b", "a"))
+	upsert(t, db, desc, 2, "c")
+	deleteRow(t, db, desc, 1)
+	hook.waitFor(t, isRow(2, "c", "<deleted>"))
+	idx := hook.waitFor(t, isRow(1, "<deleted>", "b"))
+	hook.waitForResolvedAfter(t, idx)
+
+	hook.mu.Lock()
+	updated := hook.messages[idx].Updated
+	hook.mu.Unlock()
+	require.NotEmpty(t, updated)
+
+	// The resolved timestamp is checkpointed as the high-water mark of the
+	// job.
+	require.Eventually(t, func() bool {
+		job, err := execCfg.JobRegistry.LoadJob(ctx, jobID)
+		require.NoError(t, err)
+		return job.Status() == jobs.StatusRunning && !job.Progress().HighWater.IsEmpty()
+	}, 10*time.Second, 10*time.Millisecond)
+
+	// Canceling the job stops the changefeed.
+	require.NoError(t, execCfg.JobRegistry.CancelRequested(ctx, jobID))
+	require.Eventually(t, func() bool {
+		job, err := execCfg.JobRegistry.LoadJob(ctx, jobID)
+		require.NoError(t, err)
+		return job.Status() == jobs.StatusCanceled
+	}, 10*time.Second, 10*time.Millisecond)
+}
+
+// TestChangefeedFileSink verifies that a changefeed into files emits the rows
+// of its table as CSV, and that invalid changefeeds are rejected.
+func TestChangefeedFileSink(t *testing.T) {
+	tc := testcluster.StartTestCluster(t, 1)
+	ts := tc.Server(0)
+	db := ts.DB()
+	execCfg := startJobRegistry(t, ts)
+
+	desc := sqltestutils.CreateTable(t, db, "t")
+	upsert(t, db, desc, 1, "a")
+	upsert(t, db, desc, 2, "")
+	dir := t.TempDir()
+	sinkURI := "file://" + dir
+	for stmt, expErr := range map[string]string{
+		"CREATE CHANGEFEED FOR TABLE t INTO '" + sinkURI + "' WITH format = csv, resolved": "not supported with option resolved",
+		"CREATE CHANGEFEED FOR TABLE t INTO '" + sinkURI + "' WITH foo":                    `unknown option "foo"`,
+		"CREATE CHANGEFEED FOR TABLE u INTO '" + sinkURI + "'":                             `relation "u" does not exist`,
+		"CREATE CHANGEFEED FOR TABLE t INTO 'kafka://localhost'":                           "unsupported sink: kafka",
+		"CREATE CHANGEFEED FOR TABLE t":                                                    "without a sink are not supported",
+	} {
+		_, err := createChangefeed(t, execCfg, stmt)
+		require.ErrorContains(t, err, expErr, stmt)
+	}
+
+	_, err := createChangefeed(t, execCfg,
+		"CREATE CHANGEFEED FOR TABLE t INTO '"+sinkURI+"' WITH format = csv, initial_scan = 'yes'")
+	require.NoError(t, err)
+	upsert(t, db, desc, 3, "c")
+
+	require.Eventually(t, func() bool {
+		files, err := filepath.Glob(filepath.Join(dir, "*-t-*.csv"))
+		require.NoError(t, err)
+		lines := map[string]bool{}
+		for _, f := range files {
+			b, err := os.ReadFile(f)
+			require.NoError(t, err)
+			for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+				lines[line] = true
+			}
+		}
+		return lines["1,a"] && lines["2,"] && lines["3,c"]
+	}, 10*time.Second, 10*time.Millisecond)
+}
+
+// TestChangefeedResumesAfterNodeStops verifies that the job of a changefeed is
+// adopted by another node when the node running it stops, and resumes from
+// its high-water mark.
+func TestChangefeedResumesAfterNodeStops(t *testing.T) {
+	ctx := context.Background()
+	hook := &webhook{}
+	srv := httptest.NewServer(hook)
+	t.Cleanup(srv.Close)
+	tc := testcluster.StartTestCluster(t, 3)
+	execCfgs := make([]*sql.ExecutorConfig, tc.NumServers())
+	for i := range execCfgs {
+		execCfgs[i] = startJobRegistry(t, tc.Server(i))
+	}
+	db := tc.Server(1).DB()
+
+	desc := sqltestutils.CreateTable(t, db, "t")
+	upsert(t, db, desc, 1, "a")
+	jobID, err := createChangefeed(t, execCfgs[0],
+		"CREATE CHANGEFEED FOR TABLE t INTO 'webhook-"+srv.URL+"'")
+	require.NoError(t, err)
+	hook.waitFor(t, isRow(1, "a", "<deleted>"))
+	require.Eventually(t, func() bool {
+		job, err := execCfgs[1].JobRegistry.LoadJob(ctx, jobID)
+		require.NoError(t, err)
+		return !job.Progress().HighWater.IsEmpty()
+	}, 10*time.Second, 10*time.Millisecond)
+
+	tc.StopServer(0)
+	upsert(t, db, desc, 2, "b")
+	hook.waitFor(t, isRow(2, "b", "<deleted>"))
+	job, err := execCfgs[1].JobRegistry.LoadJob(ctx, jobID)
+	require.NoError(t, err)
+	require.Equal(t, jobs.StatusRunning, job.Status())
+}
@@ -0,0 +1,195 @@
+package changefeedccl
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/c_catalog/descpb"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/e_sem/tree"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"strconv"
+)
+
+// encodeRow holds the changed row of a table, to be encoded into a message.
+type encodeRow struct {
+	tableDesc *descpb.TableDescriptor
+	// datums are the values of the row, ordered like the columns of the
+	// table. Only the primary key columns are set for a deleted row.
+	datums  tree.Datums
+	deleted bool
+	// updated is the commit timestamp of the change.
+	updated hlc.Timestamp
+	// prevDatums are the values of the row before the change, if the
+	// changefeed has the diff option. prevDeleted is set if the row didn't
+	// exist.
+	prevDatums  tree.Datums
+	prevDeleted bool
+}
+
+// Encoder turns a row into a serialized changefeed key, value, and resolved
+// timestamp messages.
+type Encoder interface {
+	// EncodeKey encodes the primary key of the row. The returned bytes are
+	// only valid until the next call to Encode*.
+	EncodeKey(row encodeRow) ([]byte, error)
+	// EncodeValue encodes the values of the row, and the options of the
+	// changefeed that add to them. The returned bytes are only valid until
+	// the next call to Encode*.
+	EncodeValue(row encodeRow) ([]byte, error)
+	// EncodeResolvedTimestamp encodes a resolved timestamp message for the
+	// topic, or for all topics if it is empty.
+	EncodeResolvedTimestamp(topic string, resolved hlc.Timestamp) ([]byte, error)
+}
+
+// getEncoder returns the encoder of the format of the changefeed options.
+// keyInValue and topicInValue add the key and the topic of the messages to
+// their JSON values, for the sinks which don't carry them separately.
+func getEncoder(opts map[string]string, keyInValue, topicInValue bool) (Encoder, error) {
+	switch opts[OptFormat] {
+	case "", OptFormatJSON:
+		_, diff := opts[OptDiff]
+		_, updated := opts[OptUpdatedTimestamps]
+		return &jsonEncoder{
+			updatedField: updated,
+			beforeField:  diff,
+			keyInValue:   keyInValue,
+			topicInValue: topicInValue,
+		}, nil
+	case OptFormatCSV:
+		return &csvEncoder{}, nil
+	default:
+		return nil, fmt.Errorf("unknown %s: %q", OptFormat, opts[OptFormat])
+	}
+}
+
+// jsonEncoder encodes the changefeed messages as JSON. The key of a row is
+// the array of its primary key values, and its value an object with the
+// values of the row under "after", which is null for a deleted row.
+type jsonEncoder struct {
+	updatedField, beforeField, keyInValue, topicInValue bool
+}
+
+var _ Encoder = &jsonEncoder{}
+
+// EncodeKey implements the Encoder interface.
+func (e *jsonEncoder) EncodeKey(row encodeRow) ([]byte, error) {
+	return json.Marshal(jsonKey(row))
+}
+
+// EncodeValue implements the Encoder interface.
+func (e *jsonEncoder) EncodeValue(row encodeRow) ([]byte, error) {
+	value := map[string]interface{}{"after": nil}
+	if !row.deleted {
+		value["after"] = jsonRow(row.tableDesc, row.datums)
+	}
+	if e.beforeField {
+		value["before"] = nil
+		if !row.prevDeleted {
+			value["before"] = jsonRow(row.tableDesc, row.prevDatums)
+		}
+	}
+	if e.updatedField {
+		value["updated"] = timestampString(row.updated)
+	}
+	if e.keyInValue {
+		value["key"] = jsonKey(row)
+	}
+	if e.topicInValue {
+		value["topic"] = row.tableDesc.Name
+	}
+	return json.Marshal(value)
+}
+
+// EncodeResolvedTimestamp implements the Encoder interface.
+func (e *jsonEncoder) EncodeResolvedTimestamp(_ string, resolved hlc.Timestamp) ([]byte, error) {
+	return json.Marshal(map[string]string{"resolved": timestampString(resolved)})
+}
+
+// jsonKey returns the primary key values of the row, in the order of the
+// primary index.
+func jsonKey(row encodeRow) []interface{} {
+	colIdx := row.tableDesc.ColumnIdxMap()
+	key := make([]interface{}, 0, len(row.tableDesc.PrimaryIndex.KeyColumnIDs))
+	for _, id := range row.tableDesc.PrimaryIndex.KeyColumnIDs {
+		key = append(key, jsonDatum(row.datums[colIdx[id]]))
+	}
+	return key
+}
+
+// jsonRow returns the values of the row by column name.
+func jsonRow(desc *descpb.TableDescriptor, datums tree.Datums) map[string]interface{} {
+	m := make(map[string]interface{}, len(desc.Columns))
+	for i := range desc.Columns {
+		m[desc.Columns[i].Name] = jsonDatum(datums[i])
+	}
+	return m
+}
+
+// jsonDatum returns the JSON representation of the datum. Bytes are
+// hex-encoded, like in the SQL output.
+func jsonDatum(d tree.Datum) interface{} {
+	switch t := d.(type) {
+	case nil:
+		return nil
+	case *tree.DInt:
+		return int64(*t)
+	case *tree.DString:
+		return string(*t)
+	case *tree.DBytes:
+		return `\x` + hex.EncodeToString([]byte(*t))
+	default:
+		return fmt.Sprintf("%v", d)
+	}
+}
+
+// csvEncoder encodes the values of the rows as CSV lines. It has no keys, and
+// no resolved timestamp messages. The line of a deleted row only holds its
+// primary key values.
+type csvEncoder struct {
+	buf bytes.Buffer
+}
+
+var _ Encoder = &csvEncoder{}
+
+// EncodeKey implements the Encoder interface.
+func (e *csvEncoder) EncodeKey(encodeRow) ([]byte, error) {
+	return nil, nil
+}
+
+// EncodeValue implements the Encoder interface.
+func (e *csvEncoder) EncodeValue(row encodeRow) ([]byte, error) {
+	record := make([]string, len(row.datums))
+	for i, d := range row.datums {
+		switch t := d.(type) {
+		case nil:
+		case *tree.DInt:
+			record[i] = strconv.FormatInt(int64(*t), 10)
+		case *tree.DString:
+			record[i] = string(*t)
+		case *tree.DBytes:
+			record[i] = `\x` + hex.EncodeToString([]byte(*t))
+		default:
+			record[i] = fmt.Sprintf("%v", d)
+		}
+	}
+	e.buf.Reset()
+	w := csv.NewWriter(&e.buf)
+	if err := w.Write(record); err != nil {
+		return nil, err
+	}
+	w.Flush()
+	return e.buf.Bytes(), w.Error()
+}
+
+// EncodeResolvedTimestamp implements the Encoder interface.
+func (e *csvEncoder) EncodeResolvedTimestamp(string, hlc.Timestamp) ([]byte, error) {
+	return nil, fmt.Errorf("%s=%s does not support resolved timestamps", OptFormat, OptFormatCSV)
+}
+
+// timestampString formats the timestamp like an AS OF SYSTEM TIME value: its
+// wall time in nanoseconds, followed by its logical component.
+func timestampString(ts hlc.Timestamp) string {
+	return fmt.Sprintf("%d.%010d", ts.WallTime, ts.Logical)
+}
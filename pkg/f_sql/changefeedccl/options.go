@@ -0,0 +1,95 @@
+package changefeedccl
+
+import (
+	"fmt"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/e_sem/tree"
+	"time"
+)
+
+// The options of a changefeed, set in its WITH clause.
+const (
+	// OptFormat is the format of the messages: OptFormatJSON, the default, or
+	// OptFormatCSV.
+	OptFormat = "format"
+	// OptResolvedTimestamps makes the changefeed emit resolved timestamp
+	// messages, which promise that no row changed at or below the timestamp
+	// is emitted afterwards, except for duplicates. Its optional value is the
+	// minimum duration between two resolved timestamp messages.
+	OptResolvedTimestamps = "resolved"
+	// OptUpdatedTimestamps adds the commit timestamp of the change to each
+	// message.
+	OptUpdatedTimestamps = "updated"
+	// OptDiff adds the value of the row before the change to each message.
+	OptDiff = "diff"
+	// OptInitialScan is whether the changefeed first emits the rows of the
+	// tables as of its creation: OptInitialScanYes, the default, or
+	// OptInitialScanNo.
+	OptInitialScan = "initial_scan"
+
+	OptFormatJSON = "json"
+	OptFormatCSV  = "csv"
+
+	OptInitialScanYes = "yes"
+	OptInitialScanNo  = "no"
+)
+
+// validateOptions validates the options of a CREATE CHANGEFEED statement,
+// and returns them as a map. The options without a value map to the empty
+// string, except for initial_scan which maps to OptInitialScanYes.
+func validateOptions(opts tree.KVOptions) (map[string]string, error) {
+	m := make(map[string]string, len(opts))
+	for _, opt := range opts {
+		key := string(opt.Key)
+		if _, ok := m[key]; ok {
+			return nil, fmt.Errorf("option %q specified multiple times", key)
+		}
+		switch key {
+		case OptFormat:
+			switch opt.Value {
+			case OptFormatJSON, OptFormatCSV:
+			default:
+				return nil, fmt.Errorf("unknown %s: %q", OptFormat, opt.Value)
+			}
+		case OptResolvedTimestamps:
+			if opt.Value != "" {
+				if d, err := time.ParseDuration(opt.Value); err != nil || d < 0 {
+					return nil, fmt.Errorf("invalid duration %q for option %s", opt.Value, key)
+				}
+			}
+		case OptUpdatedTimestamps, OptDiff:
+			if opt.Value != "" {
+				return nil, fmt.Errorf("option %s does not take a value", key)
+			}
+		case OptInitialScan:
+			switch opt.Value {
+			case "":
+				opt.Value = OptInitialScanYes
+			case OptInitialScanYes, OptInitialScanNo:
+			default:
+				return nil, fmt.Errorf("unknown %s: %q", OptInitialScan, opt.Value)
+			}
+		default:
+			return nil, fmt.Errorf("unknown option %q", key)
+		}
+		m[key] = opt.Value
+	}
+	if m[OptFormat] == OptFormatCSV {
+		for _, key := range []string{OptResolvedTimestamps, OptUpdatedTimestamps, OptDiff} {
+			if _, ok := m[key]; ok {
+				return nil, fmt.Errorf("%s=%s is not supported with option %s", OptFormat, OptFormatCSV, key)
+			}
+		}
+	}
+	return m, nil
+}
+
+// resolvedInterval returns whether the changefeed emits resolved timestamp
+// messages, and the minimum duration between two of them.
+func resolvedInterval(opts map[string]string) (time.Duration, bool) {
+	v, ok := opts[OptResolvedTimestamps]
+	if !ok || v == "" {
+		return 0, ok
+	}
+	d, _ := time.ParseDuration(v)
+	return d, true
+}
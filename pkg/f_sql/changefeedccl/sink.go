@@ -0,0 +1,73 @@
+package changefeedccl
+
+import (
+	"context"
+	"fmt"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"net/url"
+	"strings"
+)
+
+// The schemes of the sink URIs.
+const (
+	sinkSchemeFile         = "file"
+	sinkSchemeWebhookHTTP  = "webhook-http"
+	sinkSchemeWebhookHTTPS = "webhook-https"
+)
+
+// Sink is an abstraction for anything that a changefeed may emit into.
+//
+// The messages emitted into a sink are only guaranteed to be delivered once
+// Flush returns, which happens before the progress of the changefeed is
+// checkpointed. A changefeed resumed from its checkpoint may emit the
+// messages after it again: the delivery is at-least-once.
+type Sink interface {
+	// EmitRow enqueues a row message for asynchronous delivery on the sink.
+	EmitRow(ctx context.Context, topic string, key, value []byte, updated hlc.Timestamp) error
+	// EmitResolvedTimestamp delivers a resolved timestamp message, for all
+	// the topics of the changefeed. All the rows emitted before it must have
+	// been flushed.
+	EmitResolvedTimestamp(ctx context.Context, encoder Encoder, resolved hlc.Timestamp) error
+	// Flush blocks until every message enqueued by EmitRow has been
+	// delivered.
+	Flush(ctx context.Context) error
+	// Close does not guarantee delivery of outstanding messages.
+	Close() error
+}
+
+// getSink returns the sink of the URI, and the encoder of the messages
+// emitted into it. It validates the URI and the compatibility of the sink
+// with the options of the changefeed.
+func getSink(sinkURI string, opts map[string]string) (Encoder, Sink, error) {
+	u, err := url.Parse(sinkURI)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid sink URI %q: %w", sinkURI, err)
+	}
+	switch u.Scheme {
+	case sinkSchemeFile:
+		// The files only hold the values of the messages.
+		encoder, err := getEncoder(opts, true /* keyInValue */, false /* topicInValue */)
+		if err != nil {
+			return nil, nil, err
+		}
+		sink, err := makeFileSink(u, opts)
+		return encoder, sink, err
+	case sinkSchemeWebhookHTTP, sinkSchemeWebhookHTTPS:
+		if f := opts[OptFormat]; f != "" && f != OptFormatJSON {
+			return nil, nil, fmt.Errorf("this sink is incompatible with %s=%s", OptFormat, f)
+		}
+		// The batches of messages posted to the webhook only hold their
+		// values.
+		encoder, err := getEncoder(opts, true /* keyInValue */, true /* topicInValue */)
+		if err != nil {
+			return nil, nil, err
+		}
+		u.Scheme = strings.TrimPrefix(u.Scheme, "webhook-")
+		sink, err := makeWebhookSink(u)
+		return encoder, sink, err
+	case "":
+		return nil, nil, fmt.Errorf("no scheme found for sink URI %q", sinkURI)
+	default:
+		return nil, nil, fmt.Errorf("unsupported sink: %s", u.Scheme)
+	}
+}
@@ -0,0 +1,144 @@
+package changefeedccl
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/uuid"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// fileSink emits into files in a directory. Each flush writes the messages
+// of each topic into a new file, named after the timestamp of its earliest
+// message so that the files of a topic sort in the order of their messages:
+//
+//	<timestamp>-<sink id>-<topic>-<sequence number>.<format>
+//
+// Each resolved timestamp message is written into its own file,
+// <timestamp>.RESOLVED. The sink id tells apart the files written by the
+// successive runs of the changefeed, which may hold the same messages.
+type fileSink struct {
+	dir    string
+	ext    string
+	sinkID string
+	seq    int64
+
+	// files are the messages enqueued since the last flush, by topic.
+	files map[string]*bufferedFile
+}
+
+// bufferedFile is the content of a file to be written on the next flush.
+type bufferedFile struct {
+	buf      bytes.Buffer
+	earliest hlc.Timestamp
+}
+
+var _ Sink = &fileSink{}
+
+func makeFileSink(u *url.URL, opts map[string]string) (*fileSink, error) {
+	if u.Host != "" {
+		return nil, fmt.Errorf("file sink URI %q must not have a host", u.String())
+	}
+	if u.Path == "" {
+		return nil, fmt.Errorf("file sink URI %q must have a path", u.String())
+	}
+	if err := os.MkdirAll(u.Path, 0755); err != nil {
+		return nil, err
+	}
+	ext := "ndjson"
+	if opts[OptFormat] == OptFormatCSV {
+		ext = OptFormatCSV
+	}
+	return &fileSink{
+		dir:    u.Path,
+		ext:    ext,
+		sinkID: uuid.MakeV4().Short(),
+		files:  make(map[string]*bufferedFile),
+	}, nil
+}
+
+// EmitRow implements the Sink interface. The key of the message is dropped:
+// the values of the messages carry their keys.
+func (s *fileSink) EmitRow(
+	_ context.Context, topic string, _, value []byte, updated hlc.Timestamp,
+) error {
+	f, ok := s.files[topic]
+	if !ok {
+		f = &bufferedFile{earliest: updated}
+		s.files[topic] = f
+	}
+	if updated.Less(f.earliest) {
+		f.earliest = updated
+	}
+	f.buf.Write(value)
+	if !bytes.HasSuffix(value, []byte{'\n'}) {
+		f.buf.WriteByte('\n')
+	}
+	return nil
+}
+
+// EmitResolvedTimestamp implements the Sink interface.
+func (s *fileSink) EmitResolvedTimestamp(
+	_ context.Context, encoder Encoder, resolved hlc.Timestamp,
+) error {
+	payload, err := encoder.EncodeResolvedTimestamp("", resolved)
+	if err != nil {
+		return err
+	}
+	return s.writeFile(fileTimestamp(resolved)+".RESOLVED", payload)
+}
+
+// Flush implements the Sink interface.
+func (s *fileSink) Flush(context.Context) error {
+	topics := make([]string, 0, len(s.files))
+	for topic := range s.files {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	for _, topic := range topics {
+		f := s.files[topic]
+		name := fmt.Sprintf("%s-%s-%s-%d.%s", fileTimestamp(f.earliest), s.sinkID, topic, s.seq, s.ext)
+		if err := s.writeFile(name, f.buf.Bytes()); err != nil {
+			return err
+		}
+		s.seq++
+		delete(s.files, topic)
+	}
+	return nil
+}
+
+// Close implements the Sink interface.
+func (s *fileSink) Close() error {
+	return nil
+}
+
+// writeFile writes the file atomically, so that the readers of the
+// directory never see it partially written.
+func (s *fileSink) writeFile(name string, data []byte) error {
+	tmp, err := os.CreateTemp(s.dir, ".tmp-"+name)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(s.dir, name))
+}
+
+// fileTimestamp formats the timestamp so that the formatted timestamps sort
+// like the timestamps: its wall time in UTC down to the nanosecond, followed
+// by its logical component.
+func fileTimestamp(ts hlc.Timestamp) string {
+	t := ts.GoTime().UTC()
+	return fmt.Sprintf("%s%09d%010d", t.Format("20060102150405"), t.Nanosecond(), ts.Logical)
+}
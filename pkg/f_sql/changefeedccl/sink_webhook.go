@@ -0,0 +1,156 @@
+package changefeedccl
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	// sinkParamSkipTLSVerify disables the verification of the certificate of
+	// the webhook, e.g. for a self-signed one.
+	sinkParamSkipTLSVerify = "insecure_tls_skip_verify"
+
+	// webhookMaxBatchSize is the number of messages after which the sink
+	// posts its batch, without waiting for a flush.
+	webhookMaxBatchSize = 100
+	// webhookMaxAttempts and webhookInitialBackoff configure the retries of
+	// the requests to the webhook.
+	webhookMaxAttempts    = 3
+	webhookInitialBackoff = 50 * time.Millisecond
+	webhookTimeout        = 30 * time.Second
+)
+
+// webhookSink emits into a webhook: it posts the batches of messages as
+// JSON objects, {"payload":[...],"length":n}, whose payload holds the values
+// of the messages, and the resolved timestamp messages by themselves.
+type webhookSink struct {
+	url    string
+	client *http.Client
+	batch  []json.RawMessage
+}
+
+// webhookBatch is the body of a request which posts a batch of messages.
+type webhookBatch struct {
+	Payload []json.RawMessage `json:"payload"`
+	Length  int               `json:"length"`
+}
+
+var _ Sink = &webhookSink{}
+
+func makeWebhookSink(u *url.URL) (*webhookSink, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("webhook sink URI %q must have a host", u.String())
+	}
+	q := u.Query()
+	var skipVerify bool
+	if v := q.Get(sinkParamSkipTLSVerify); v != "" {
+		var err error
+		if skipVerify, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("param %s must be a bool: %w", sinkParamSkipTLSVerify, err)
+		}
+	}
+	q.Del(sinkParamSkipTLSVerify)
+	u.RawQuery = q.Encode()
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if skipVerify {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	return &webhookSink{
+		url:    u.String(),
+		client: &http.Client{Transport: transport, Timeout: webhookTimeout},
+	}, nil
+}
+
+// EmitRow implements the Sink interface. The key of the message is dropped:
+// the values of the messages carry their keys and topics.
+func (s *webhookSink) EmitRow(
+	ctx context.Context, _ string, _, value []byte, _ hlc.Timestamp,
+) error {
+	s.batch = append(s.batch, append(json.RawMessage(nil), value...))
+	if len(s.batch) >= webhookMaxBatchSize {
+		return s.Flush(ctx)
+	}
+	return nil
+}
+
+// EmitResolvedTimestamp implements the Sink interface.
+func (s *webhookSink) EmitResolvedTimestamp(
+	ctx context.Context, encoder Encoder, resolved hlc.Timestamp,
+) error {
+	payload, err := encoder.EncodeResolvedTimestamp("", resolved)
+	if err != nil {
+		return err
+	}
+	return s.post(ctx, payload)
+}
+
+// Flush implements the Sink interface.
+func (s *webhookSink) Flush(ctx context.Context) error {
+	if len(s.batch) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(webhookBatch{Payload: s.batch, Length: len(s.batch)})
+	if err != nil {
+		return err
+	}
+	if err := s.post(ctx, body); err != nil {
+		return err
+	}
+	s.batch = s.batch[:0]
+	return nil
+}
+
+// Close implements the Sink interface.
+func (s *webhookSink) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+// post posts the body to the webhook, retrying with exponential backoff
+// until it is accepted with a 2xx status.
+func (s *webhookSink) post(ctx context.Context, body []byte) error {
+	backoff := webhookInitialBackoff
+	var err error
+	for attempt := 0; attempt < webhookMaxAttempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(backoff):
+				backoff *= 2
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		if err = s.postOnce(ctx, body); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (s *webhookSink) postOnce(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("webhook sink: %s: %s", res.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
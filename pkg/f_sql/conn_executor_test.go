@@ -0,0 +1,505 @@
+package sql
+
+import (
+	"context"
+	"fmt"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/appstatspb"
+	parser "github.com/dborchard/tiny_crdb/pkg/f_sql/b_parser"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/c_catalog/colinfo"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/c_catalog/descpb"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/contention"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/e_sem/tree"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/rowenc"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/sqltestutils"
+	kv "github.com/dborchard/tiny_crdb/pkg/g_kv"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvclient/kvcoord"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/concurrency"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/concurrency/isolation"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/dborchard/tiny_crdb/pkg/y_col/coldata"
+	"github.com/dborchard/tiny_crdb/pkg/z_testutils/testcluster"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/fsm"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/stop"
+	"github.com/stretchr/testify/require"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCommandResult is a CommandResult which records the result of a
+// statement.
+type testCommandResult struct {
+	cols colinfo.ResultColumns
+	rows []tree.Datums
+	err  error
+
+	discard func()
+}
+
+var _ CommandResult = &testCommandResult{}
+
+func (r *testCommandResult) SetError(err error) { r.err = err }
+func (r *testCommandResult) Err() error         { return r.err }
+
+func (r *testCommandResult) SetColumns(_ context.Context, cols colinfo.ResultColumns) {
+	r.cols = cols
+}
+
+func (r *testCommandResult) AddRow(_ context.Context, row tree.Datums) error {
+	r.rows = append(r.rows, append(tree.Datums(nil), row...))
+	return nil
+}
+
+func (r *testCommandResult) AddBatch(context.Context, coldata.Batch) error { return nil }
+func (r *testCommandResult) SupportsAddBatch() bool                        { return false }
+func (r *testCommandResult) SetRowsAffected(context.Context, int)          {}
+func (r *testCommandResult) RowsAffected() int                             { return len(r.rows) }
+func (r *testCommandResult) Discard()                                      { r.discard() }
+
+// testClientComm is a ClientComm which hands the results of each batch of
+// statements over to the test.
+type testClientComm struct {
+	results []*testCommandResult
+	flushed chan []*testCommandResult
+}
+
+func (c *testClientComm) CreateStatementResult(
+	tree.Statement, CmdPos, int, string, bool,
+) CommandResult {
+	res := &testCommandResult{}
+	res.discard = func() { c.results = c.results[:len(c.results)-1] }
+	c.results = append(c.results, res)
+	return res
+}
+
+func (c *testClientComm) Flush(CmdPos) error {
+	c.flushed <- c.results
+	c.results = nil
+	return nil
+}
+
+// testConn is a SQL connection served by a connExecutor.
+type testConn struct {
+	ex      *connExecutor
+	stmtBuf *StmtBuf
+	comm    *testClientComm
+	errCh   chan error
+}
+
+func startTestConn(t *testing.T, execCfg *ExecutorConfig) *testConn {
+	ctx := context.Background()
+	c := &testConn{
+		stmtBuf: NewStmtBuf(),
+		comm:    &testClientComm{flushed: make(chan []*testCommandResult, 1)},
+		errCh:   make(chan error, 1),
+	}
+	s := &Server{cfg: execCfg}
+	c.ex = s.newConnExecutor(ctx, c.stmtBuf, c.comm, nil /* postSetupFn */)
+	go func() { c.errCh <- c.ex.run(ctx, nil /* onCancel */) }()
+	t.Cleanup(func() {
+		c.stmtBuf.Close()
+		require.ErrorIs(t, <-c.errCh, io.EOF)
+	})
+	return c
+}
+
+// exec runs the statement in its own batch, and returns its result.
+func (c *testConn) exec(t *testing.T, sql string) *testCommandResult {
+	ctx := context.Background()
+	stmt, err := parser.ParseOne(sql)
+	require.NoError(t, err)
+	require.NoError(t, c.stmtBuf.Push(ctx, ExecStmt{Statement: stmt, LastInBatch: true}))
+	require.NoError(t, c.stmtBuf.Push(ctx, Sync{}))
+	select {
+	case results := <-c.comm.flushed:
+		require.Len(t, results, 1)
+		return results[0]
+	case err := <-c.errCh:
+		t.Fatalf("connExecutor stopped: %v", err)
+		return nil
+	}
+}
+
+// newFakeKVDB returns a DB whose batches are answered by a sender which
+// stands in for the KV layer, and which holds no data.
+func newFakeKVDB() *kv.DB {
+	ctx := context.Background()
+	sender := kv.SenderFunc(func(ctx context.Context, ba *kvpb.BatchRequest) (*kvpb.BatchResponse, *kvpb.Error) {
+		br := &kvpb.BatchResponse{}
+		br.Txn = ba.Txn
+		for _, ru := range ba.Requests {
+			br.Add(kvpb.CreateReply(ru.GetInner()))
+		}
+		return br, nil
+	})
+	clock := hlc.NewClock(hlc.UnixNano, time.Nanosecond)
+	factory := kvcoord.NewTxnCoordSenderFactory(kvcoord.TxnCoordSenderFactoryConfig{Clock: clock}, sender)
+	return kv.NewDB(ctx, factory, clock, stop.NewStopper())
+}
+
+// createTestTable creates the table (a INT PRIMARY KEY, b STRING) with the
+// rows (1, 'a'), (2, 'b') and (3, 'c').
+func createTestTable(t *testing.T, db *kv.DB, name string) *descpb.TableDescriptor {
+	return sqltestutils.CreateTable(t, db, name, testRow(1, "a"), testRow(2, "b"), testRow(3, "c"))
+}
+
+func testRow(a int64, b string) tree.Datums {
+	return tree.Datums{tree.NewDInt(tree.DInt(a)), tree.NewDString(b)}
+}
+
+// TestSelectLockingClause verifies that the rows scanned by a SELECT are
+// locked with the strength and the wait policy of its locking clause.
+func TestSelectLockingClause(t *testing.T) {
+	ctx := context.Background()
+	tc := testcluster.StartTestCluster(t, 1)
+	db := tc.Server(0).DB()
+	desc := createTestTable(t, db, "t")
+	c := startTestConn(t, &ExecutorConfig{DB: db, Clock: tc.Server(0).Clock()})
+
+	// Another transaction holds a Shared lock on the row (2, 'b').
+	key, _, err := rowenc.EncodePrimaryIndex(desc, testRow(2, "b"))
+	require.NoError(t, err)
+	holder := kv.NewTxn(ctx, db)
+	kvs, err := holder.ScanForShare(ctx, key, roachpb.Key(key).PrefixEnd(), 0 /* maxRows */)
+	require.NoError(t, err)
+	require.Len(t, kvs, 1)
+
+	all := []tree.Datums{testRow(1, "a"), testRow(2, "b"), testRow(3, "c")}
+	for _, tc := range []struct {
+		sql  string
+		rows []tree.Datums
+		err  string
+	}{
+		// Non-locking reads and Shared locks don't conflict with the Shared
+		// lock.
+		{sql: "SELECT * FROM t", rows: all},
+		{sql: "SELECT * FROM t FOR SHARE NOWAIT", rows: all},
+		{sql: "SELECT * FROM t FOR KEY SHARE NOWAIT", rows: all},
+		// Exclusive locks do.
+		{sql: "SELECT * FROM t FOR UPDATE NOWAIT", err: "conflicting intents"},
+		{sql: "SELECT * FROM t FOR NO KEY UPDATE NOWAIT", err: "conflicting intents"},
+		{sql: "SELECT * FROM t FOR UPDATE SKIP LOCKED", rows: []tree.Datums{testRow(1, "a"), testRow(3, "c")}},
+		{sql: "SELECT * FROM t FOR UPDATE OF t SKIP LOCKED LIMIT 1 OFFSET 1", rows: []tree.Datums{testRow(3, "c")}},
+		{sql: "SELECT * FROM t FOR SHARE OF u FOR UPDATE OF t NOWAIT", err: `relation "u" in FOR SHARE clause not found in FROM clause`},
+		// The locking clause may follow the LIMIT and OFFSET clauses. The
+		// whole span of the scan is checked for conflicting locks, whatever
+		// its limit.
+		{sql: "SELECT * FROM t LIMIT 1 OFFSET 1 FOR SHARE NOWAIT", rows: all[1:2]},
+		{sql: "SELECT * FROM t LIMIT 1 OFFSET 1 FOR UPDATE SKIP LOCKED", rows: all[2:]},
+		{sql: "SELECT * FROM t LIMIT 1 FOR UPDATE NOWAIT", err: "conflicting intents"},
+	} {
+		t.Run(tc.sql, func(t *testing.T) {
+			res := c.exec(t, tc.sql)
+			if tc.err != "" {
+				require.ErrorContains(t, res.err, tc.err)
+				return
+			}
+			require.NoError(t, res.err)
+			require.Equal(t, tc.rows, res.rows)
+		})
+	}
+	require.NoError(t, holder.Commit(ctx))
+
+	// The rows can be locked once the lock is released.
+	res := c.exec(t, "SELECT * FROM t FOR UPDATE NOWAIT")
+	require.NoError(t, res.err)
+	require.Equal(t, all, res.rows)
+}
+
+// TestSelectColumns verifies that a SELECT returns the columns of its select
+// list.
+func TestSelectColumns(t *testing.T) {
+	tc := testcluster.StartTestCluster(t, 1)
+	db := tc.Server(0).DB()
+	createTestTable(t, db, "t")
+	c := startTestConn(t, &ExecutorConfig{DB: db, Clock: tc.Server(0).Clock()})
+
+	res := c.exec(t, "SELECT b, a FROM t LIMIT 2")
+	require.NoError(t, res.err)
+	require.Equal(t, []string{"b", "a"}, []string{res.cols[0].Name, res.cols[1].Name})
+	require.Equal(t, []tree.Datums{
+		{tree.NewDString("a"), tree.NewDInt(1)},
+		{tree.NewDString("b"), tree.NewDInt(2)},
+	}, res.rows)
+
+	for sql, err := range map[string]string{
+		"SELECT c FROM t":           `column "c" does not exist`,
+		"SELECT * FROM u":           `relation "u" does not exist`,
+		"SELECT * FROM t WHERE a=1": "unimplemented: WHERE clause",
+	} {
+		require.ErrorContains(t, c.exec(t, sql).err, err, sql)
+	}
+}
+
+// TestTxnIsolationLevelToKV verifies that the isolation levels of SQL are
+// mapped to the KV isolation levels that implement them.
+func TestTxnIsolationLevelToKV(t *testing.T) {
+	ex := &connExecutor{}
+	for level, expected := range map[tree.IsolationLevel]isolation.Level{
+		tree.UnspecifiedIsolation:     isolation.Serializable,
+		tree.ReadUncommittedIsolation: isolation.ReadCommitted,
+		tree.ReadCommittedIsolation:   isolation.ReadCommitted,
+		tree.RepeatableReadIsolation:  isolation.Snapshot,
+		tree.SnapshotIsolation:        isolation.Snapshot,
+		tree.SerializableIsolation:    isolation.Serializable,
+	} {
+		require.Equal(t, expected, ex.txnIsolationLevelToKV(level), level.String())
+	}
+}
+
+// TestTxnStateTransitions verifies that BEGIN opens an explicit transaction
+// at the isolation level it requests, which COMMIT and ROLLBACK end, and that
+// a transaction in which a statement failed rejects the statements other than
+// COMMIT and ROLLBACK until it is ended.
+func TestTxnStateTransitions(t *testing.T) {
+	c := startTestConn(t, &ExecutorConfig{DB: newFakeKVDB()})
+
+	require.NoError(t, c.exec(t, "BEGIN ISOLATION LEVEL READ COMMITTED").err)
+	require.Equal(t, stateOpen{ImplicitTxn: fsm.False}, c.ex.machine.CurState())
+	txn := c.ex.state.txn
+	require.NotNil(t, txn)
+	require.Equal(t, isolation.ReadCommitted, txn.IsoLevel())
+	require.NoError(t, c.exec(t, "COMMIT").err)
+	require.Equal(t, stateNoTxn{}, c.ex.machine.CurState())
+	require.Nil(t, c.ex.state.txn)
+
+	require.NoError(t, c.exec(t, "BEGIN").err)
+	require.Equal(t, isolation.Serializable, c.ex.state.txn.IsoLevel())
+	require.ErrorContains(t, c.exec(t, "BEGIN").err, "there is already a transaction in progress")
+	require.Equal(t, stateAborted{}, c.ex.machine.CurState())
+	require.ErrorContains(t, c.exec(t, "SELECT * FROM t").err,
+		"current transaction is aborted, commands ignored until end of transaction block")
+	// COMMIT rolls an aborted transaction back.
+	require.NoError(t, c.exec(t, "COMMIT").err)
+	require.Equal(t, stateNoTxn{}, c.ex.machine.CurState())
+
+	require.NoError(t, c.exec(t, "BEGIN TRANSACTION ISOLATION LEVEL REPEATABLE READ").err)
+	require.Equal(t, isolation.Snapshot, c.ex.state.txn.IsoLevel())
+	require.NoError(t, c.exec(t, "ROLLBACK").err)
+	require.Equal(t, stateNoTxn{}, c.ex.machine.CurState())
+
+	// A statement which fails in an implicit transaction rolls it back.
+	require.ErrorContains(t, c.exec(t, "SELECT * FROM t").err, `relation "t" does not exist`)
+	require.Equal(t, stateNoTxn{}, c.ex.machine.CurState())
+	require.Nil(t, c.ex.state.txn)
+}
+
+// TestExplicitTxn verifies that the statements between BEGIN and COMMIT run
+// in a single transaction, and that a transaction in which a statement failed
+// rejects further statements until it is ended.
+func TestExplicitTxn(t *testing.T) {
+	tc := testcluster.StartTestCluster(t, 1)
+	db := tc.Server(0).DB()
+	createTestTable(t, db, "t")
+	c := startTestConn(t, &ExecutorConfig{DB: db, Clock: tc.Server(0).Clock()})
+	all := []tree.Datums{testRow(1, "a"), testRow(2, "b"), testRow(3, "c")}
+
+	require.NoError(t, c.exec(t, "BEGIN").err)
+	txn := c.ex.state.txn
+	require.NotNil(t, txn)
+	res := c.exec(t, "SELECT * FROM t FOR UPDATE")
+	require.NoError(t, res.err)
+	require.Equal(t, all, res.rows)
+	require.Same(t, txn, c.ex.state.txn)
+	require.NoError(t, c.exec(t, "COMMIT").err)
+	require.Nil(t, c.ex.state.txn)
+	require.True(t, txn.IsCommitted())
+
+	require.NoError(t, c.exec(t, "BEGIN").err)
+	require.ErrorContains(t, c.exec(t, "BEGIN").err, "there is already a transaction in progress")
+	require.Equal(t, stateAborted{}, c.ex.machine.CurState())
+	require.ErrorContains(t, c.exec(t, "SELECT * FROM t").err,
+		"current transaction is aborted, commands ignored until end of transaction block")
+	require.NoError(t, c.exec(t, "COMMIT").err)
+	require.Equal(t, stateNoTxn{}, c.ex.machine.CurState())
+
+	// The locks of a rolled back transaction are released.
+	require.NoError(t, c.exec(t, "BEGIN").err)
+	require.NoError(t, c.exec(t, "SELECT * FROM t FOR UPDATE").err)
+	require.NoError(t, c.exec(t, "ROLLBACK").err)
+	require.Equal(t, stateNoTxn{}, c.ex.machine.CurState())
+	res = c.exec(t, "SELECT * FROM t FOR UPDATE NOWAIT")
+	require.NoError(t, res.err)
+	require.Equal(t, all, res.rows)
+}
+
+// TestExplicitTxnIsolationLevel verifies that the KV transaction of an
+// explicit transaction runs at the isolation level requested by BEGIN, and
+// that only the READ COMMITTED transactions observe the writes committed
+// after their previous statement.
+func TestExplicitTxnIsolationLevel(t *testing.T) {
+	ctx := context.Background()
+	tc := testcluster.StartTestCluster(t, 1)
+	db := tc.Server(0).DB()
+	desc := createTestTable(t, db, "t")
+	c := startTestConn(t, &ExecutorConfig{DB: db, Clock: tc.Server(0).Clock()})
+
+	for i, tc := range []struct {
+		sql      string
+		level    isolation.Level
+		readsNew bool
+	}{
+		{sql: "BEGIN", level: isolation.Serializable},
+		{sql: "BEGIN ISOLATION LEVEL SERIALIZABLE", level: isolation.Serializable},
+		{sql: "BEGIN ISOLATION LEVEL REPEATABLE READ", level: isolation.Snapshot},
+		{sql: "BEGIN ISOLATION LEVEL READ COMMITTED", level: isolation.ReadCommitted, readsNew: true},
+	} {
+		t.Run(tc.sql, func(t *testing.T) {
+			require.NoError(t, c.exec(t, tc.sql).err)
+			require.Equal(t, tc.level, c.ex.state.txn.IsoLevel())
+			res := c.exec(t, "SELECT b FROM t LIMIT 1")
+			require.NoError(t, res.err)
+			old := res.rows
+
+			// Another transaction updates the row, and commits.
+			b := fmt.Sprintf("a%d", i)
+			key, value, err := rowenc.EncodePrimaryIndex(desc, testRow(1, b))
+			require.NoError(t, err)
+			require.NoError(t, db.Txn(ctx, func(ctx context.Context, txn *kv.Txn) error {
+				return txn.Put(ctx, key, &value)
+			}))
+
+			res = c.exec(t, "SELECT b FROM t LIMIT 1")
+			require.NoError(t, res.err)
+			if tc.readsNew {
+				require.Equal(t, []tree.Datums{{tree.NewDString(b)}}, res.rows)
+			} else {
+				require.Equal(t, old, res.rows)
+			}
+			require.NoError(t, c.exec(t, "COMMIT").err)
+		})
+	}
+}
+
+// TestReadCommittedStmtRetry verifies that a statement of a READ COMMITTED
+// transaction which hits a write-write conflict is retried on its own, on a
+// new read snapshot, while a SERIALIZABLE transaction must be retried as a
+// whole.
+func TestReadCommittedStmtRetry(t *testing.T) {
+	ctx := context.Background()
+	tc := testcluster.StartTestCluster(t, 1)
+	db := tc.Server(0).DB()
+	desc := createTestTable(t, db, "t")
+	c := startTestConn(t, &ExecutorConfig{DB: db, Clock: tc.Server(0).Clock()})
+
+	// writeAhead updates the row (2, 'b') at a timestamp ahead of the clock,
+	// which the statements that follow read below. A locking read of the row
+	// conflicts with the write.
+	writeAhead := func(b string) {
+		key, value, err := rowenc.EncodePrimaryIndex(desc, testRow(2, b))
+		require.NoError(t, err)
+		ba := &kv.Batch{}
+		ba.Header.Timestamp = db.Clock().Now().Add(time.Second.Nanoseconds(), 0)
+		ba.Put(key, &value)
+		require.NoError(t, db.Run(ctx, ba))
+	}
+
+	require.NoError(t, c.exec(t, "BEGIN ISOLATION LEVEL READ COMMITTED").err)
+	writeAhead("x")
+	res := c.exec(t, "SELECT * FROM t")
+	require.NoError(t, res.err)
+	require.Equal(t, []tree.Datums{testRow(1, "a"), testRow(2, "b"), testRow(3, "c")}, res.rows)
+	// The statement is retried above the write, and returns the rows once.
+	res = c.exec(t, "SELECT * FROM t FOR UPDATE")
+	require.NoError(t, res.err)
+	require.Equal(t, []tree.Datums{testRow(1, "a"), testRow(2, "x"), testRow(3, "c")}, res.rows)
+	require.NoError(t, c.exec(t, "COMMIT").err)
+
+	require.NoError(t, c.exec(t, "BEGIN ISOLATION LEVEL SERIALIZABLE").err)
+	writeAhead("y")
+	require.ErrorContains(t, c.exec(t, "SELECT * FROM t FOR UPDATE").err, "TransactionRetryWithProtoRefreshError")
+	require.Equal(t, stateAborted{}, c.ex.machine.CurState())
+	require.NoError(t, c.exec(t, "ROLLBACK").err)
+}
+
+// TestContentionEventsSQL verifies that a statement which waits on the locks
+// of another SQL transaction reports its contention through EXPLAIN ANALYZE,
+// and that crdb_internal.transaction_contention_events exposes the event
+// with the fingerprints of both transactions once they have finished.
+func TestContentionEventsSQL(t *testing.T) {
+	// The waiting statement must not push the blocking transaction, which
+	// commits instead.
+	defer func(prev time.Duration) {
+		concurrency.LockTableDeadlockDetectionPushDelay = prev
+	}(concurrency.LockTableDeadlockDetectionPushDelay)
+	concurrency.LockTableDeadlockDetectionPushDelay = time.Minute
+
+	ctx := context.Background()
+	tc := testcluster.StartTestCluster(t, 1)
+	db := tc.Server(0).DB()
+	createTestTable(t, db, "t")
+	execCfg := &ExecutorConfig{
+		DB:                 db,
+		Clock:              tc.Server(0).Clock(),
+		ContentionRegistry: contention.NewRegistry(contention.Config{}),
+	}
+	blocking, waiting := startTestConn(t, execCfg), startTestConn(t, execCfg)
+
+	const blockingSQL = "SELECT * FROM t FOR UPDATE"
+	require.NoError(t, blocking.exec(t, "BEGIN").err)
+	require.NoError(t, blocking.exec(t, blockingSQL).err)
+	blockingTxnID := blocking.ex.state.txn.ID()
+
+	// The statement of the waiting connection runs in an implicit
+	// transaction, and waits until the blocking transaction commits.
+	const waitingSQL = "EXPLAIN ANALYZE SELECT * FROM t FOR UPDATE LIMIT 1"
+	stmt, err := parser.ParseOne(waitingSQL)
+	require.NoError(t, err)
+	require.NoError(t, waiting.stmtBuf.Push(ctx, ExecStmt{Statement: stmt, LastInBatch: true}))
+	require.NoError(t, waiting.stmtBuf.Push(ctx, Sync{}))
+	const wait = 50 * time.Millisecond
+	time.Sleep(wait)
+	require.NoError(t, blocking.exec(t, "COMMIT").err)
+	results := <-waiting.comm.flushed
+	require.Len(t, results, 1)
+	res := results[0]
+	require.NoError(t, res.err)
+	require.Equal(t, colinfo.ExplainPlanColumns, res.cols)
+	var info []string
+	for _, row := range res.rows {
+		info = append(info, string(*row[0].(*tree.DString)))
+	}
+	require.Greater(t, len(info), 2, info)
+	require.True(t, strings.HasPrefix(info[1], "cumulative time spent due to contention: "), info[1])
+	require.Contains(t, info[2], blockingTxnID.String())
+
+	stmtFingerprintID := func(sql string, implicitTxn bool) appstatspb.StmtFingerprintID {
+		return appstatspb.ConstructStatementFingerprintID(parser.HideConstants(sql), implicitTxn, "")
+	}
+	waitingStmtFingerprintID := stmtFingerprintID(waitingSQL, true /* implicitTxn */)
+	blockingTxnFingerprintID := appstatspb.ConstructTransactionFingerprintID(
+		[]appstatspb.StmtFingerprintID{stmtFingerprintID(blockingSQL, false /* implicitTxn */)})
+	waitingTxnFingerprintID := appstatspb.ConstructTransactionFingerprintID(
+		[]appstatspb.StmtFingerprintID{waitingStmtFingerprintID})
+
+	res = waiting.exec(t, `SELECT blocking_txn_id, blocking_txn_fingerprint_id, waiting_txn_fingerprint_id,
+waiting_stmt_fingerprint_id, contention_duration FROM crdb_internal.transaction_contention_events`)
+	require.NoError(t, res.err)
+	// The blocking statement may itself have waited on the intents of the
+	// transaction which created the table, until they were resolved: only
+	// the events of the waiting statement are checked.
+	var rows []tree.Datums
+	for _, row := range res.rows {
+		if *row[3].(*tree.DBytes) == *encodeFingerprintID(uint64(waitingStmtFingerprintID)) {
+			rows = append(rows, row)
+		}
+	}
+	require.NotEmpty(t, rows, res.rows)
+	for _, row := range rows {
+		require.Equal(t, blockingTxnID.String(), string(*row[0].(*tree.DString)))
+		require.Equal(t, encodeFingerprintID(uint64(blockingTxnFingerprintID)), row[1])
+		require.Equal(t, encodeFingerprintID(uint64(waitingTxnFingerprintID)), row[2])
+	}
+	require.GreaterOrEqual(t, rows[0][4].(*tree.DInterval).Duration, wait)
+
+	for sql, err := range map[string]string{
+		"SELECT missing FROM crdb_internal.transaction_contention_events":      `column "missing" does not exist`,
+		"SELECT * FROM crdb_internal.missing":                                  "missing",
+		"SELECT * FROM crdb_internal.transaction_contention_events FOR UPDATE": "FOR UPDATE is not allowed with virtual tables",
+	} {
+		require.ErrorContains(t, waiting.exec(t, sql).err, err, sql)
+	}
+}
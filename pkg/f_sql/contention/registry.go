@@ -0,0 +1,170 @@
+// Package contention aggregates the contention events of the statements run
+// by the node: the waits of their requests on the locks of other
+// transactions. Each event records the blocking and the waiting
+// transactions, along with their fingerprints, so that the statements which
+// block each other can be found.
+package contention
+
+import (
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/appstatspb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/ring"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/uuid"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMaxEvents is the default number of events kept by a Registry.
+	DefaultMaxEvents = 1024
+	// DefaultMaxTxnFingerprints is the default number of transaction
+	// fingerprints remembered by a Registry.
+	DefaultMaxTxnFingerprints = 4096
+)
+
+// ExtendedContentionEvent is a contention event of a statement, extended
+// with the transactions on both sides of the contention.
+type ExtendedContentionEvent struct {
+	// BlockingEvent is the event reported by KV. Its TxnMeta is the blocking
+	// transaction.
+	BlockingEvent kvpb.ContentionEvent
+	// BlockingTxnFingerprintID is the fingerprint of the blocking
+	// transaction, once it is known.
+	BlockingTxnFingerprintID appstatspb.TransactionFingerprintID
+
+	// WaitingTxnID is the transaction of the statement that waited.
+	WaitingTxnID uuid.UUID
+	// WaitingTxnFingerprintID is the fingerprint of the waiting transaction,
+	// once it is known.
+	WaitingTxnFingerprintID appstatspb.TransactionFingerprintID
+	// WaitingStmtFingerprintID is the fingerprint of the statement that
+	// waited.
+	WaitingStmtFingerprintID appstatspb.StmtFingerprintID
+
+	// CollectionTs is the time at which the event was added to the registry.
+	CollectionTs time.Time
+}
+
+// Config configures a Registry.
+type Config struct {
+	// MaxEvents is the number of events kept by the registry, beyond which
+	// the oldest events are evicted. Defaults to DefaultMaxEvents.
+	MaxEvents int
+	// MaxTxnFingerprints is the number of transaction fingerprints
+	// remembered by the registry, beyond which the fingerprints of the
+	// oldest transactions are forgotten. Defaults to
+	// DefaultMaxTxnFingerprints.
+	MaxTxnFingerprints int
+}
+
+// SetDefaults sets the defaults of the fields left unset.
+func (c *Config) SetDefaults() {
+	if c.MaxEvents <= 0 {
+		c.MaxEvents = DefaultMaxEvents
+	}
+	if c.MaxTxnFingerprints <= 0 {
+		c.MaxTxnFingerprints = DefaultMaxTxnFingerprints
+	}
+}
+
+// Registry is a bounded in-memory store of the contention events of the
+// node.
+//
+// The fingerprint of a transaction is only known once the transaction
+// finishes, which is usually after its events, as the waiting transaction,
+// or the events of others, as the blocking transaction, were added. The
+// registry remembers the fingerprints of the recent transactions, by ID, and
+// resolves the fingerprints of the events with them when they are read.
+type Registry struct {
+	cfg Config
+
+	mu struct {
+		sync.Mutex
+		// events is a circular buffer of the events, of which next is the
+		// position of the oldest one once the buffer is full.
+		events []ExtendedContentionEvent
+		next   int
+		// txnFingerprints maps the IDs of the recent transactions to their
+		// fingerprints, and txnIDs holds the IDs in the order in which they
+		// were added, to evict the oldest ones.
+		txnFingerprints map[uuid.UUID]appstatspb.TransactionFingerprintID
+		txnIDs          ring.Buffer[uuid.UUID]
+	}
+}
+
+// NewRegistry creates a Registry.
+func NewRegistry(cfg Config) *Registry {
+	cfg.SetDefaults()
+	r := &Registry{cfg: cfg}
+	r.mu.txnFingerprints = make(map[uuid.UUID]appstatspb.TransactionFingerprintID)
+	r.mu.txnIDs = ring.NewBuffer[uuid.UUID]()
+	return r
+}
+
+// AddContentionEvent adds an event to the registry, evicting the oldest
+// event if the registry is full. The event's CollectionTs is set if unset.
+func (r *Registry) AddContentionEvent(ev ExtendedContentionEvent) {
+	if ev.CollectionTs.IsZero() {
+		ev.CollectionTs = time.Now()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.mu.events) < r.cfg.MaxEvents {
+		r.mu.events = append(r.mu.events, ev)
+		return
+	}
+	r.mu.events[r.mu.next] = ev
+	r.mu.next = (r.mu.next + 1) % len(r.mu.events)
+}
+
+// RecordTxnFingerprint records the fingerprint of a finished transaction,
+// with which the fingerprints of its events are resolved.
+func (r *Registry) RecordTxnFingerprint(
+	txnID uuid.UUID, fingerprintID appstatspb.TransactionFingerprintID,
+) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.mu.txnFingerprints[txnID]; !ok {
+		if r.mu.txnIDs.Len() >= r.cfg.MaxTxnFingerprints {
+			oldest, _ := r.mu.txnIDs.GetFirst()
+			r.mu.txnIDs.RemoveFirst()
+			delete(r.mu.txnFingerprints, oldest)
+		}
+		r.mu.txnIDs.AddLast(txnID)
+	}
+	r.mu.txnFingerprints[txnID] = fingerprintID
+}
+
+// ForEachEvent calls fn with each of the events of the registry, from the
+// oldest to the newest, after resolving their fingerprints. The fingerprints
+// of the transactions which are not known are left invalid.
+func (r *Registry) ForEachEvent(fn func(*ExtendedContentionEvent) error) error {
+	for _, ev := range r.resolvedEvents() {
+		ev := ev
+		if err := fn(&ev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolvedEvents resolves the fingerprints of the events, and returns a copy
+// of the events in the order in which they were added. The resolved
+// fingerprints are stored in the events, so that they outlive the
+// fingerprints remembered by the registry.
+func (r *Registry) resolvedEvents() []ExtendedContentionEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	events := make([]ExtendedContentionEvent, 0, len(r.mu.events))
+	for i := range r.mu.events {
+		ev := &r.mu.events[(r.mu.next+i)%len(r.mu.events)]
+		if ev.BlockingTxnFingerprintID == appstatspb.InvalidTransactionFingerprintID {
+			ev.BlockingTxnFingerprintID = r.mu.txnFingerprints[ev.BlockingEvent.TxnMeta.ID]
+		}
+		if ev.WaitingTxnFingerprintID == appstatspb.InvalidTransactionFingerprintID {
+			ev.WaitingTxnFingerprintID = r.mu.txnFingerprints[ev.WaitingTxnID]
+		}
+		events = append(events, *ev)
+	}
+	return events
+}
@@ -0,0 +1,85 @@
+package contention
+
+import (
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/appstatspb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/dborchard/tiny_crdb/pkg/h_storage/enginepb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/uuid"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func makeEvent(blocking, waiting uuid.UUID, key string) ExtendedContentionEvent {
+	return ExtendedContentionEvent{
+		BlockingEvent: kvpb.ContentionEvent{
+			Key:      roachpb.Key(key),
+			TxnMeta:  enginepb.TxnMeta{ID: blocking},
+			Duration: time.Second,
+		},
+		WaitingTxnID: waiting,
+	}
+}
+
+func readEvents(t *testing.T, r *Registry) []ExtendedContentionEvent {
+	var events []ExtendedContentionEvent
+	require.NoError(t, r.ForEachEvent(func(ev *ExtendedContentionEvent) error {
+		events = append(events, *ev)
+		return nil
+	}))
+	return events
+}
+
+// TestRegistryEvictsOldestEvents verifies that the registry keeps the most
+// recent events, in the order in which they were added.
+func TestRegistryEvictsOldestEvents(t *testing.T) {
+	r := NewRegistry(Config{MaxEvents: 3})
+	blocking, waiting := uuid.MakeV4(), uuid.MakeV4()
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		r.AddContentionEvent(makeEvent(blocking, waiting, key))
+	}
+	events := readEvents(t, r)
+	require.Len(t, events, 3)
+	for i, key := range []string{"c", "d", "e"} {
+		require.Equal(t, roachpb.Key(key), events[i].BlockingEvent.Key)
+		require.False(t, events[i].CollectionTs.IsZero())
+	}
+}
+
+// TestRegistryResolvesTxnFingerprints verifies that the fingerprints of the
+// transactions of the events are resolved once the transactions finish, and
+// are kept by the events after the registry forgets them.
+func TestRegistryResolvesTxnFingerprints(t *testing.T) {
+	r := NewRegistry(Config{MaxTxnFingerprints: 2})
+	blocking, waiting := uuid.MakeV4(), uuid.MakeV4()
+	r.AddContentionEvent(makeEvent(blocking, waiting, "a"))
+
+	events := readEvents(t, r)
+	require.Len(t, events, 1)
+	require.Equal(t, appstatspb.InvalidTransactionFingerprintID, events[0].BlockingTxnFingerprintID)
+	require.Equal(t, appstatspb.InvalidTransactionFingerprintID, events[0].WaitingTxnFingerprintID)
+
+	// The waiting transaction finishes first, as the blocking one is still
+	// running.
+	r.RecordTxnFingerprint(waiting, 2)
+	events = readEvents(t, r)
+	require.Equal(t, appstatspb.InvalidTransactionFingerprintID, events[0].BlockingTxnFingerprintID)
+	require.Equal(t, appstatspb.TransactionFingerprintID(2), events[0].WaitingTxnFingerprintID)
+
+	r.RecordTxnFingerprint(blocking, 1)
+	events = readEvents(t, r)
+	require.Equal(t, appstatspb.TransactionFingerprintID(1), events[0].BlockingTxnFingerprintID)
+
+	// Other transactions evict the fingerprints from the registry, which
+	// the event has kept.
+	r.RecordTxnFingerprint(uuid.MakeV4(), 3)
+	r.RecordTxnFingerprint(uuid.MakeV4(), 4)
+	r.mu.Lock()
+	require.Len(t, r.mu.txnFingerprints, 2)
+	require.NotContains(t, r.mu.txnFingerprints, blocking)
+	r.mu.Unlock()
+	events = readEvents(t, r)
+	require.Equal(t, appstatspb.TransactionFingerprintID(1), events[0].BlockingTxnFingerprintID)
+	require.Equal(t, appstatspb.TransactionFingerprintID(2), events[0].WaitingTxnFingerprintID)
+}
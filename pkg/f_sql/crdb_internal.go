@@ -0,0 +1,152 @@
+package sql
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/c_catalog/colinfo"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/contention"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/e_sem/catconstants"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/e_sem/tree"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/types"
+	"time"
+)
+
+// virtualSchemaTable is a table of a virtual schema. Its rows are not
+// stored: they are generated from the state of the node each time the table
+// is read.
+type virtualSchemaTable struct {
+	id      uint32
+	comment string
+	columns colinfo.ResultColumns
+	// populate generates the rows of the table, calling addRow with the
+	// datums of each row, in the order of the columns.
+	populate func(ctx context.Context, execCfg *ExecutorConfig, addRow func(...tree.Datum) error) error
+}
+
+// virtualSchemas maps the names of the virtual schemas to their tables, by
+// name.
+var virtualSchemas = map[string]map[string]virtualSchemaTable{
+	catconstants.CRDBInternalSchemaName: {
+		"transaction_contention_events": crdbInternalTransactionContentionEventsTable,
+	},
+}
+
+// ReadVirtualTable reads the rows of the table of a virtual schema, along
+// with its columns.
+func ReadVirtualTable(
+	ctx context.Context, execCfg *ExecutorConfig, schema, table string,
+) (colinfo.ResultColumns, []tree.Datums, error) {
+	vt, ok := virtualSchemas[schema][table]
+	if !ok {
+		return nil, nil, fmt.Errorf("relation %s.%s does not exist", schema, table)
+	}
+	var rows []tree.Datums
+	if err := vt.populate(ctx, execCfg, func(datums ...tree.Datum) error {
+		if len(datums) != len(vt.columns) {
+			return fmt.Errorf("%s.%s: %d datums for %d columns", schema, table, len(datums), len(vt.columns))
+		}
+		rows = append(rows, datums)
+		return nil
+	}); err != nil {
+		return nil, nil, err
+	}
+	return vt.columns, rows, nil
+}
+
+// newVirtualTableNode returns a node which returns the rows of the table of
+// a virtual schema, made of the columns of the select list.
+func (p *planner) newVirtualTableNode(
+	ctx context.Context, tn *tree.TableName, exprs tree.SelectExprs,
+) (*valuesNode, error) {
+	cols, rows, err := ReadVirtualTable(ctx, p.ExecCfg(), tn.Schema(), tn.Table())
+	if err != nil {
+		return nil, err
+	}
+	var ords []int
+	for _, expr := range exprs {
+		name, ok := expr.Expr.(*tree.UnresolvedName)
+		if !ok {
+			return nil, fmt.Errorf("unimplemented: %T in select list", expr.Expr)
+		}
+		if name.Star {
+			for i := range cols {
+				ords = append(ords, i)
+			}
+			continue
+		}
+		idx := -1
+		for i := range cols {
+			if cols[i].Name == name.Parts[0] {
+				idx = i
+				break
+			}
+		}
+		if idx < 0 {
+			return nil, fmt.Errorf("column %q does not exist", name.Parts[0])
+		}
+		ords = append(ords, idx)
+	}
+
+	n := &valuesNode{
+		columns: make(colinfo.ResultColumns, len(ords)),
+		rows:    make([]tree.Datums, len(rows)),
+	}
+	for i, ord := range ords {
+		n.columns[i] = cols[ord]
+	}
+	for i, row := range rows {
+		n.rows[i] = make(tree.Datums, len(ords))
+		for j, ord := range ords {
+			n.rows[i][j] = row[ord]
+		}
+	}
+	return n, nil
+}
+
+// crdbInternalTransactionContentionEventsTable exposes the contention events
+// of the contention registry of the node.
+var crdbInternalTransactionContentionEventsTable = virtualSchemaTable{
+	id: catconstants.CrdbInternalTransactionContentionEvents,
+	comment: `the waits of the statements of the node on the locks of other
+transactions, with the fingerprints of both transactions (in-memory, bounded)`,
+	columns: colinfo.ResultColumns{
+		{Name: "collection_ts", Typ: types.TimestampTZ},
+		{Name: "blocking_txn_id", Typ: types.String},
+		{Name: "blocking_txn_fingerprint_id", Typ: types.Bytes},
+		{Name: "waiting_txn_id", Typ: types.String},
+		{Name: "waiting_txn_fingerprint_id", Typ: types.Bytes},
+		{Name: "waiting_stmt_fingerprint_id", Typ: types.Bytes},
+		{Name: "contention_duration", Typ: types.Interval},
+		{Name: "contending_key", Typ: types.Bytes},
+	},
+	populate: func(ctx context.Context, execCfg *ExecutorConfig, addRow func(...tree.Datum) error) error {
+		if execCfg.ContentionRegistry == nil {
+			return nil
+		}
+		return execCfg.ContentionRegistry.ForEachEvent(func(ev *contention.ExtendedContentionEvent) error {
+			collectionTs, err := tree.MakeDTimestampTZ(ev.CollectionTs, time.Microsecond)
+			if err != nil {
+				return err
+			}
+			return addRow(
+				collectionTs,
+				tree.NewDString(ev.BlockingEvent.TxnMeta.ID.String()),
+				encodeFingerprintID(uint64(ev.BlockingTxnFingerprintID)),
+				tree.NewDString(ev.WaitingTxnID.String()),
+				encodeFingerprintID(uint64(ev.WaitingTxnFingerprintID)),
+				encodeFingerprintID(uint64(ev.WaitingStmtFingerprintID)),
+				tree.NewDInterval(ev.BlockingEvent.Duration),
+				tree.NewDBytes(tree.DBytes(ev.BlockingEvent.Key)),
+			)
+		})
+	},
+}
+
+// encodeFingerprintID encodes a fingerprint ID as the bytes that the
+// crdb_internal tables expose it as.
+func encodeFingerprintID(id uint64) *tree.DBytes {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], id)
+	return tree.NewDBytes(tree.DBytes(buf[:]))
+}
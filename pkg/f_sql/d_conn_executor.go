@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/appstatspb"
 	"github.com/dborchard/tiny_crdb/pkg/f_sql/b_parser/statements"
 	"github.com/dborchard/tiny_crdb/pkg/f_sql/e_sem/eval"
 	"github.com/dborchard/tiny_crdb/pkg/f_sql/e_sem/tree"
@@ -44,7 +45,23 @@ type connExecutor struct {
 	activated      bool
 	queryCancelKey string
 	curStmtAST     tree.Statement
-	machine        fsm.Machine
+
+	// machine is the connExecutor's state machine, whose transitions are
+	// described by TxnStateTransitions, and state is its extended state.
+	machine fsm.Machine
+	state   txnState
+	// transitionCtx contains the fields passed to the transitions that start
+	// a transaction.
+	transitionCtx transitionCtx
+
+	// extraTxnState is the state of the current SQL transaction that the
+	// state machine doesn't need.
+	extraTxnState struct {
+		// stmtFingerprintIDs are the fingerprints of the statements that the
+		// transaction ran, from which the fingerprint of the transaction is
+		// constructed once it finishes.
+		stmtFingerprintIDs []appstatspb.StmtFingerprintID
+	}
 }
 
 func (ie *InternalExecutor) initConnEx(
@@ -121,7 +138,7 @@ func (ex *connExecutor) execCmd() (retErr error) {
 	switch tcmd := cmd.(type) {
 	case ExecStmt:
 		err := func() error {
-			stmtRes := ex.clientComm.CreateStatementResult(tcmd.AST, pos, 0, "", true)
+			stmtRes := ex.clientComm.CreateStatementResult(tcmd.AST, pos, 0, "", ex.implicitTxn())
 			res = stmtRes
 			ev, payload, err = ex.execStmt(ctx, tcmd.Statement, nil, nil, stmtRes, true)
 			return err
@@ -129,6 +146,12 @@ func (ex *connExecutor) execCmd() (retErr error) {
 		if err != nil {
 			return err
 		}
+	case Sync:
+		// The Sync marks the end of a batch of commands: the results produced
+		// so far are delivered to the client.
+		if err := ex.clientComm.Flush(pos); err != nil {
+			return err
+		}
 	default:
 		panic(errors.New("unknown command type"))
 	}
@@ -137,7 +160,7 @@ func (ex *connExecutor) execCmd() (retErr error) {
 	var advInfo advanceInfo
 	if ev != nil {
 		var err error
-		advInfo, err = ex.txnStateTransitionsApplyWrapper(ev, payload, res, pos)
+		advInfo, err = ex.txnStateTransitionsApplyWrapper(ctx, ev, payload, res, pos)
 		if err != nil {
 			return err
 		}
@@ -149,16 +172,56 @@ func (ex *connExecutor) execCmd() (retErr error) {
 	switch advInfo.code {
 	case advanceOne:
 		ex.stmtBuf.AdvanceOne()
+	case stayInPlace:
+		// The same statement is executed again, in the new state; the result
+		// created for this attempt is thrown away.
+		res.Discard()
 	default:
-		panic(errors.New("unexpected advance code: %s"))
+		panic(fmt.Errorf("unexpected advance code: %d", advInfo.code))
 	}
 	return nil
 }
 
+// txnStateTransitionsApplyWrapper is a wrapper on top of Machine built with the
+// TxnStateTransitions above. Its point is to detect when we go in and out of
+// transactions and update some state.
+//
+// The error carried by the payload, if any, is set on the result of the
+// statement that generated the event.
 func (ex *connExecutor) txnStateTransitionsApplyWrapper(
-	ev fsm.Event, payload fsm.EventPayload, res ResultBase, pos CmdPos,
+	ctx context.Context, ev fsm.Event, payload fsm.EventPayload, res ResultBase, pos CmdPos,
 ) (advanceInfo, error) {
-	return advanceInfo{code: advanceOne}, nil
+	if pe, ok := payload.(payloadWithError); ok {
+		res.SetError(pe.errorCause())
+	}
+	txn := ex.state.txn
+	if err := ex.machine.ApplyWithPayload(ctx, ev, payload); err != nil {
+		return advanceInfo{}, err
+	}
+	if txn != nil && ex.state.txn == nil {
+		ex.recordTransactionFinish(txn)
+	}
+	return ex.state.consumeAdvanceInfo(), nil
+}
+
+// recordTransactionFinish records the fingerprint of a transaction once it
+// has committed or rolled back, so that the contention events in which it
+// took part can be attributed to it.
+func (ex *connExecutor) recordTransactionFinish(txn *kv.Txn) {
+	stmtFingerprintIDs := ex.extraTxnState.stmtFingerprintIDs
+	ex.extraTxnState.stmtFingerprintIDs = nil
+	registry := ex.server.cfg.ContentionRegistry
+	if registry == nil || len(stmtFingerprintIDs) == 0 {
+		return
+	}
+	registry.RecordTxnFingerprint(txn.ID(), appstatspb.ConstructTransactionFingerprintID(stmtFingerprintIDs))
+}
+
+// implicitTxn returns whether the current transaction is implicit. Returns
+// false if there's no transaction.
+func (ex *connExecutor) implicitTxn() bool {
+	state, ok := ex.machine.CurState().(stateOpen)
+	return ok && state.ImplicitTxn.Get()
 }
 
 func (ex *connExecutor) execStmt(
@@ -175,9 +238,13 @@ func (ex *connExecutor) execStmt(
 
 	switch ex.machine.CurState().(type) {
 	case stateNoTxn:
-		ev, payload = ex.execStmtInNoTxnState(parserStmt)
+		ev, payload = ex.execStmtInNoTxnState(ctx, parserStmt)
+	case stateOpen:
+		ev, payload, err = ex.execStmtInOpenState(ctx, parserStmt, res)
+	case stateAborted:
+		ev, payload = ex.execStmtInAbortedState(parserStmt)
 	default:
-		panic(errors.New(fmt.Sprintf("unexpected state: %s", ex.machine.CurState())))
+		panic(errors.New(fmt.Sprintf("unexpected state: %T", ex.machine.CurState())))
 	}
 
 	return ev, payload, err
@@ -191,5 +258,6 @@ func (ex *connExecutor) initEvalCtx(ctx context.Context, evalCtx *extendedEvalCo
 		Context: eval.Context{
 			Planner: p,
 		},
+		ExecCfg: ex.server.cfg,
 	}
 }
@@ -2,9 +2,12 @@ package sql
 
 import (
 	"context"
+	"errors"
 	"github.com/dborchard/tiny_crdb/pkg/f_sql/physicalplan"
 	"github.com/dborchard/tiny_crdb/pkg/f_sql/physicalplan/replicaoracle"
+	keys "github.com/dborchard/tiny_crdb/pkg/g_keys"
 	kv "github.com/dborchard/tiny_crdb/pkg/g_kv"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvclient"
 	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
 )
 
@@ -42,6 +45,31 @@ const (
 //     and add processing stages (connected to the result routers of the children
 //     node).
 type DistSQLPlanner struct {
+	// gatewayNodeID is the ID of the node where the DistSQLPlanner is.
+	gatewayNodeID roachpb.NodeID
+
+	// spanResolver is used to find the replicas of the ranges of the spans
+	// that the plans read.
+	spanResolver physicalplan.SpanResolver
+
+	// nodeDescs is used to look up the localities of the nodes. It is
+	// optional.
+	nodeDescs kvclient.NodeDescStore
+}
+
+// NewDistSQLPlanner initializes a DistSQLPlanner.
+//
+// gatewayNodeID is the ID of the node where the DistSQLPlanner is.
+func NewDistSQLPlanner(
+	gatewayNodeID roachpb.NodeID,
+	spanResolver physicalplan.SpanResolver,
+	nodeDescs kvclient.NodeDescStore,
+) *DistSQLPlanner {
+	return &DistSQLPlanner{
+		gatewayNodeID: gatewayNodeID,
+		spanResolver:  spanResolver,
+		nodeDescs:     nodeDescs,
+	}
 }
 
 // NewPlanningCtx returns a new PlanningCtx. When distribute is false, a
@@ -65,10 +93,28 @@ func (dsp *DistSQLPlanner) NewPlanningCtx(
 // a single query.
 type PlanningCtx struct {
 	ExtendedEvalCtx *extendedEvalContext
+
+	// spanIter is used to find the replicas of the ranges of the spans read by
+	// the plan. It is nil if the DistSQLPlanner has no SpanResolver.
+	spanIter physicalplan.SpanResolverIterator
+
+	// localityFilter, if not empty, restricts the nodes on which the spans
+	// are planned to those whose locality matches it; the other spans are
+	// planned on the gateway node.
+	localityFilter roachpb.Locality
+
+	// planner is the planner of the query. It is used to run the planNodes of
+	// the plan.
+	planner *planner
+
+	// isLocal is set when the plan is run only in the root txn on the gateway
+	// node.
+	isLocal bool
 }
 
 // NewPlanningCtxWithOracle is a variant of NewPlanningCtx that allows passing a
-// replica choice oracle as well.
+// replica choice oracle as well. The spans of the plan are only planned on
+// the nodes whose locality matches the localityFilter, if it is not empty.
 func (dsp *DistSQLPlanner) NewPlanningCtxWithOracle(
 	ctx context.Context,
 	evalCtx *extendedEvalContext,
@@ -76,11 +122,127 @@ func (dsp *DistSQLPlanner) NewPlanningCtxWithOracle(
 	txn *kv.Txn,
 	distributionType DistributionType,
 	oracle replicaoracle.Oracle,
-	localityFiler roachpb.Locality,
+	localityFilter roachpb.Locality,
 ) *PlanningCtx {
-	return &PlanningCtx{
+	planCtx := &PlanningCtx{
 		ExtendedEvalCtx: evalCtx,
+		localityFilter:  localityFilter,
+		planner:         planner,
+		isLocal:         distributionType == DistributionTypeNone,
+	}
+	if distributionType != DistributionTypeNone && dsp.spanResolver != nil {
+		planCtx.spanIter = dsp.spanResolver.NewSpanResolverIterator(txn, oracle)
+	}
+	return planCtx
+}
+
+// SpanPartition associates a subset of a query's spans with the node on
+// which they are planned.
+type SpanPartition struct {
+	NodeID roachpb.NodeID
+	Spans  []roachpb.Span
+}
+
+// PartitionSpans finds out which nodes are owners for ranges touching the
+// given spans, and splits the spans according to owning nodes. The result is a
+// set of SpanPartitions (guaranteed one for each relevant node), which form a
+// partitioning of the spans (i.e. they are non-overlapping and their union is
+// exactly the original set of spans).
+//
+// The replica of each range is chosen by the oracle of the planning context.
+// If the plan is not distributed, all the spans are planned on the gateway
+// node.
+func (dsp *DistSQLPlanner) PartitionSpans(
+	ctx context.Context, planCtx *PlanningCtx, spans []roachpb.Span,
+) ([]SpanPartition, error) {
+	if len(spans) == 0 {
+		return nil, errors.New("no spans")
+	}
+	if planCtx.spanIter == nil {
+		return []SpanPartition{{NodeID: dsp.gatewayNodeID, Spans: spans}}, nil
+	}
+	var partitions []SpanPartition
+	// nodeMap maps a nodeID to an index inside the partitions array.
+	nodeMap := make(map[roachpb.NodeID]int)
+	addSpan := func(nodeID roachpb.NodeID, span roachpb.Span) {
+		idx, ok := nodeMap[nodeID]
+		if !ok {
+			idx = len(partitions)
+			partitions = append(partitions, SpanPartition{NodeID: nodeID})
+			nodeMap[nodeID] = idx
+		}
+		partition := &partitions[idx]
+		// Ranges of the same span planned on the same node are merged.
+		if n := len(partition.Spans); n > 0 && partition.Spans[n-1].EndKey.Equal(span.Key) {
+			partition.Spans[n-1].EndKey = span.EndKey
+			return
+		}
+		partition.Spans = append(partition.Spans, span)
+	}
+
+	it := planCtx.spanIter
+	for _, span := range spans {
+		if len(span.EndKey) == 0 {
+			// A single key belongs to a single range.
+			it.Seek(ctx, span)
+			if !it.Valid() {
+				return nil, it.Error()
+			}
+			repl, err := it.ReplicaInfo(ctx)
+			if err != nil {
+				return nil, err
+			}
+			addSpan(dsp.filterNode(planCtx, repl.NodeID), span)
+			continue
+		}
+		// lastKey maintains the EndKey of the last piece of the span.
+		lastKey, err := keys.Addr(span.Key)
+		if err != nil {
+			return nil, err
+		}
+		spanEndKey, err := keys.AddrUpperBound(span.EndKey)
+		if err != nil {
+			return nil, err
+		}
+		for it.Seek(ctx, span); ; it.Next(ctx) {
+			if !it.Valid() {
+				return nil, it.Error()
+			}
+			repl, err := it.ReplicaInfo(ctx)
+			if err != nil {
+				return nil, err
+			}
+			// The piece of the span within the range.
+			endKey := it.Desc().EndKey
+			if spanEndKey.Less(endKey) {
+				endKey = spanEndKey
+			}
+			addSpan(dsp.filterNode(planCtx, repl.NodeID),
+				roachpb.Span{Key: lastKey.AsRawKey(), EndKey: endKey.AsRawKey()})
+			if !it.NeedAnother() {
+				break
+			}
+			lastKey = endKey
+		}
+	}
+	return partitions, nil
+}
+
+// filterNode returns the node on which the spans chosen to be read from the
+// node are planned: the node itself, unless the locality filter of the
+// planning context excludes it, in which case the gateway node.
+func (dsp *DistSQLPlanner) filterNode(planCtx *PlanningCtx, nodeID roachpb.NodeID) roachpb.NodeID {
+	if planCtx.localityFilter.Empty() || nodeID == dsp.gatewayNodeID {
+		return nodeID
+	}
+	if dsp.nodeDescs != nil {
+		if desc, err := dsp.nodeDescs.GetNodeDescriptor(nodeID); err == nil {
+			if ok, _ := desc.Locality.Matches(planCtx.localityFilter); ok {
+				return nodeID
+			}
+		}
 	}
+	return dsp.gatewayNodeID
 }
 
 // PhysicalPlan is a partial physical plan which corresponds to a planNode
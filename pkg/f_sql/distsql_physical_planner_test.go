@@ -0,0 +1,110 @@
+package sql
+
+import (
+	"context"
+	"fmt"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/physicalplan"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/physicalplan/replicaoracle"
+	kv "github.com/dborchard/tiny_crdb/pkg/g_kv"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/dborchard/tiny_crdb/pkg/z_testutils/testcluster"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+// testNodeDescs is a kvclient.NodeDescStore of the node descriptors.
+type testNodeDescs map[roachpb.NodeID]*roachpb.NodeDescriptor
+
+func (s testNodeDescs) GetNodeDescriptor(nodeID roachpb.NodeID) (*roachpb.NodeDescriptor, error) {
+	if desc, ok := s[nodeID]; ok {
+		return desc, nil
+	}
+	return nil, fmt.Errorf("node n%d not found", nodeID)
+}
+
+func TestPartitionSpans(t *testing.T) {
+	ctx := context.Background()
+	tc := testcluster.StartTestCluster(t, 3)
+	db := tc.Server(0).DB()
+	require.NoError(t, db.AdminSplit(ctx, "c", hlc.Timestamp{}))
+	require.NoError(t, db.AdminSplit(ctx, "e", hlc.Timestamp{}))
+	rangeCache := tc.Server(0).DistSender().RangeDescriptorCache()
+	rangeCache.Clear()
+
+	region := func(r string) roachpb.Locality {
+		return roachpb.Locality{Tiers: []roachpb.Tier{{Key: "region", Value: r}}}
+	}
+	nodeDescs := testNodeDescs{
+		1: {NodeID: 1, Locality: region("us")},
+		2: {NodeID: 2, Locality: region("eu")},
+		3: {NodeID: 3, Locality: region("us")},
+	}
+	dsp := NewDistSQLPlanner(1, physicalplan.NewSpanResolver(
+		rangeCache, replicaoracle.Config{NodeID: 1}, replicaoracle.BinPackingChoice), nodeDescs)
+
+	// The oracle assigns the ranges of [b,c), [c,e) and [e,f) to n2, n3 and
+	// n2 in turn.
+	oracle := &sequenceOracle{nodeIDs: []roachpb.NodeID{2, 3, 2}}
+	spans := []roachpb.Span{
+		{Key: roachpb.Key("b"), EndKey: roachpb.Key("f")},
+		{Key: roachpb.Key("g")},
+	}
+	span := func(key, endKey string) roachpb.Span {
+		s := roachpb.Span{Key: roachpb.Key(key)}
+		if endKey != "" {
+			s.EndKey = roachpb.Key(endKey)
+		}
+		return s
+	}
+	planCtx := dsp.NewPlanningCtxWithOracle(
+		ctx, nil, nil, nil, DistributionTypeAlways, oracle, roachpb.Locality{})
+	partitions, err := dsp.PartitionSpans(ctx, planCtx, spans)
+	require.NoError(t, err)
+	require.Equal(t, []SpanPartition{
+		{NodeID: 2, Spans: []roachpb.Span{span("b", "c"), span("e", "f"), span("g", "")}},
+		{NodeID: 3, Spans: []roachpb.Span{span("c", "e")}},
+	}, partitions)
+
+	// The spans of the nodes excluded by the locality filter are planned on
+	// the gateway node.
+	oracle = &sequenceOracle{nodeIDs: []roachpb.NodeID{2, 3, 2}}
+	planCtx = dsp.NewPlanningCtxWithOracle(
+		ctx, nil, nil, nil, DistributionTypeAlways, oracle, region("us"))
+	partitions, err = dsp.PartitionSpans(ctx, planCtx, spans)
+	require.NoError(t, err)
+	require.Equal(t, []SpanPartition{
+		{NodeID: 1, Spans: []roachpb.Span{span("b", "c"), span("e", "f"), span("g", "")}},
+		{NodeID: 3, Spans: []roachpb.Span{span("c", "e")}},
+	}, partitions)
+
+	// Plans which aren't distributed read all the spans on the gateway.
+	planCtx = dsp.NewPlanningCtx(ctx, nil, nil, nil, DistributionTypeNone)
+	partitions, err = dsp.PartitionSpans(ctx, planCtx, spans)
+	require.NoError(t, err)
+	require.Equal(t, []SpanPartition{{NodeID: 1, Spans: spans}}, partitions)
+}
+
+// sequenceOracle is a replicaoracle.Oracle which chooses the replicas of the
+// nodes in sequence, cycling back to the first.
+type sequenceOracle struct {
+	nodeIDs []roachpb.NodeID
+	next    int
+}
+
+func (o *sequenceOracle) ChoosePreferredReplica(
+	_ context.Context,
+	_ *kv.Txn,
+	rng *roachpb.RangeDescriptor,
+	_ *roachpb.ReplicaDescriptor,
+	_ replicaoracle.QueryState,
+) (roachpb.ReplicaDescriptor, error) {
+	nodeID := o.nodeIDs[o.next%len(o.nodeIDs)]
+	o.next++
+	for _, repl := range rng.Replicas() {
+		if repl.NodeID == nodeID {
+			return repl, nil
+		}
+	}
+	return roachpb.ReplicaDescriptor{}, fmt.Errorf("n%d has no replica of r%d", nodeID, rng.RangeID)
+}
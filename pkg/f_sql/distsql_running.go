@@ -2,6 +2,7 @@ package sql
 
 import (
 	"context"
+	"errors"
 	"github.com/dborchard/tiny_crdb/pkg/f_sql/e_sem/tree"
 	"github.com/dborchard/tiny_crdb/pkg/f_sql/flowinfra"
 	kv "github.com/dborchard/tiny_crdb/pkg/g_kv"
@@ -27,24 +28,24 @@ type CallbackResultWriter struct {
 	err          error
 }
 
+// AddRow is part of the rowResultWriter interface.
 func (c *CallbackResultWriter) AddRow(ctx context.Context, row tree.Datums) error {
-	//TODO implement me
-	panic("implement me")
+	return c.fn(ctx, row)
 }
 
+// SetRowsAffected is part of the rowResultWriter interface.
 func (c *CallbackResultWriter) SetRowsAffected(ctx context.Context, n int) {
-	//TODO implement me
-	panic("implement me")
+	c.rowsAffected = n
 }
 
+// SetError is part of the rowResultWriter interface.
 func (c *CallbackResultWriter) SetError(err error) {
-	//TODO implement me
-	panic("implement me")
+	c.err = err
 }
 
+// Err is part of the rowResultWriter interface.
 func (c *CallbackResultWriter) Err() error {
-	//TODO implement me
-	panic("implement me")
+	return c.err
 }
 
 // NewCallbackResultWriter creates a new CallbackResultWriter.
@@ -152,5 +153,66 @@ func (dsp *DistSQLPlanner) PlanAndRun(
 	recv *DistSQLReceiver,
 	finishedSetupFn func(localFlow flowinfra.Flow),
 ) {
+	if err := dsp.planAndRun(ctx, evalCtx, planCtx, txn, plan, recv); err != nil {
+		recv.resultWriter.SetError(err)
+	}
+}
+
+// planAndRun runs the planNode tree of the plan. Plans are always run on the
+// gateway node; a plan that is not local is run in a leaf txn created from the
+// state of the root txn, as a remote flow would be, and the leaf's final state
+// is merged back into the root afterwards. Flows can't start in a txn that is
+// already known to be aborted, since GetLeafTxnInputState rejects it.
+func (dsp *DistSQLPlanner) planAndRun(
+	ctx context.Context,
+	evalCtx *extendedEvalContext,
+	planCtx *PlanningCtx,
+	txn *kv.Txn,
+	plan planMaybePhysical,
+	recv *DistSQLReceiver,
+) error {
+	p := planCtx.planner
+	if p == nil {
+		return errors.New("cannot run a plan without a planner")
+	}
+	flowTxn := txn
+	if txn != nil && !planCtx.isLocal {
+		tis, err := txn.GetLeafTxnInputState(ctx)
+		if err != nil {
+			return err
+		}
+		flowTxn = kv.NewLeafTxn(ctx, p.ExecCfg().DB, tis)
+	}
 
+	prevTxn := p.txn
+	p.txn = flowTxn
+	defer func() { p.txn = prevTxn }()
+	params := runParams{
+		ctx:             ctx,
+		extendedEvalCtx: evalCtx,
+		p:               p,
+	}
+	if err := plan.planNode.startExec(params); err != nil {
+		return err
+	}
+	for {
+		ok, err := plan.planNode.Next(params)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		if err := recv.resultWriter.AddRow(ctx, plan.planNode.Values()); err != nil {
+			return err
+		}
+	}
+	if flowTxn != txn {
+		tfs, err := flowTxn.GetLeafTxnFinalState(ctx)
+		if err != nil {
+			return err
+		}
+		return txn.UpdateRootWithLeafFinalState(ctx, tfs)
+	}
+	return nil
 }
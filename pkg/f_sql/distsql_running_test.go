@@ -7,10 +7,12 @@ import (
 	"github.com/dborchard/tiny_crdb/pkg/f_sql/e_sem/tree"
 	kv "github.com/dborchard/tiny_crdb/pkg/g_kv"
 	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvclient/kvcoord"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/concurrency/isolation"
 	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
-	"github.com/dborchard/tiny_crdb/pkg/z_testutils/serverutils"
+	"github.com/dborchard/tiny_crdb/pkg/z_testutils/testcluster"
 	"github.com/stretchr/testify/require"
 	"testing"
+	"time"
 )
 
 // Test that we don't attempt to create flows in an aborted transaction.
@@ -27,17 +29,19 @@ import (
 func TestDistSQLRunningInAbortedTxn(t *testing.T) {
 
 	ctx := context.Background()
-	s, sqlDB, db := serverutils.StartServer()
-	defer s.Stopper().Stop(ctx)
+	tc := testcluster.StartTestCluster(t, 1)
+	s := tc.Server(0)
+	db := s.DB()
 
-	if _, err := sqlDB.ExecContext(
-		ctx, "create database test; create table test.t(a int)"); err != nil {
-		t.Fatal(err)
-	}
+	createTestTable(t, db, "t")
 	key := roachpb.Key("a")
 
 	// Plan a statement.
-	execCfg := s.ExecutorConfig().(ExecutorConfig)
+	execCfg := ExecutorConfig{
+		DB:             db,
+		Clock:          s.Clock(),
+		DistSQLPlanner: NewDistSQLPlanner(s.NodeID(), nil /* spanResolver */, nil /* nodeDescs */),
+	}
 	sd := NewInternalSessionData(ctx, "test")
 	internalPlanner, cleanup := NewInternalPlanner(
 		"test",
@@ -48,15 +52,18 @@ func TestDistSQLRunningInAbortedTxn(t *testing.T) {
 	)
 	defer cleanup()
 	p := internalPlanner.(*planner)
-	query := "select * from test.t"
+	query := "select * from t"
 	stmt, err := parser.ParseOne(query)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	push := func(ctx context.Context, key roachpb.Key) error {
-		// Conflicting transaction that pushes another transaction.
-		conflictTxn := kv.NewTxn(ctx, db)
+		// Conflicting transaction that pushes another transaction. It has the
+		// highest priority, so that it doesn't wait for the pushee.
+		proto := roachpb.MakeTransaction(
+			"pusher", nil /* baseKey */, isolation.Serializable, roachpb.MaxUserPriority, s.Clock().Now())
+		conflictTxn := kv.NewTxnFromProto(ctx, db, s.Clock().NowAsClockTimestamp(), kv.RootTxn, &proto)
 		// Push through a Put, as opposed to a Get, so that the pushee gets aborted.
 		if err := conflictTxn.Put(ctx, key, "pusher was here"); err != nil {
 			return err
@@ -70,7 +77,12 @@ func TestDistSQLRunningInAbortedTxn(t *testing.T) {
 	// Make a db with a short heartbeat interval, so that the aborted txn finds
 	// out quickly.
 	ambient := context.Background()
-	tsf := kvcoord.NewTxnCoordSenderFactory(s.DistSenderI().(*kvcoord.DistSender))
+	tsf := kvcoord.NewTxnCoordSenderFactory(
+		kvcoord.TxnCoordSenderFactoryConfig{
+			Clock:             s.Clock(),
+			Stopper:           s.Stopper(),
+			HeartbeatInterval: 5 * time.Millisecond,
+		}, s.DistSender())
 	shortDB := kv.NewDB(ambient, tsf, s.Clock(), s.Stopper())
 
 	iter := 0
@@ -86,6 +98,10 @@ func TestDistSQLRunningInAbortedTxn(t *testing.T) {
 				t.Fatal(err)
 			}
 
+			// Wait for the heartbeat loop to find out that the txn is aborted.
+			require.Eventually(t, func() bool {
+				return txn.TestingCloneTxn().Status == roachpb.ABORTED
+			}, 10*time.Second, time.Millisecond)
 		}
 
 		// Create and run a DistSQL plan.
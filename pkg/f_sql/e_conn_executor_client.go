@@ -62,15 +62,24 @@ func (icc *internalClientComm) CreateStatementResult(stmt tree.Statement, pos Cm
 
 func (icc *internalClientComm) createRes(pos CmdPos) *streamingCommandResult {
 	res := &streamingCommandResult{
-		pos:             pos,
-		w:               icc.w,
-		discardCallback: func() {},
+		pos: pos,
+		w:   icc.w,
+	}
+	res.discardCallback = func() {
+		// The result was created last; it is removed from the results of
+		// the batch.
+		icc.results = icc.results[:len(icc.results)-1]
 	}
 	icc.results = append(icc.results, res)
 	return res
 }
 
+// Flush is part of the ClientComm interface. The results of the batch are
+// passed to the sync callback.
 func (icc *internalClientComm) Flush(pos CmdPos) error {
-	//TODO implement me
-	panic("implement me")
+	if icc.sync != nil {
+		icc.sync(icc.results)
+	}
+	icc.results = nil
+	return nil
 }
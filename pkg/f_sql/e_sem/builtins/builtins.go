@@ -2,11 +2,13 @@ package builtins
 
 import (
 	"context"
+	"errors"
 	"github.com/dborchard/tiny_crdb/pkg/f_sql/e_sem/builtins/builtinconstants"
 	"github.com/dborchard/tiny_crdb/pkg/f_sql/e_sem/eval"
 	"github.com/dborchard/tiny_crdb/pkg/f_sql/e_sem/tree"
 	"github.com/dborchard/tiny_crdb/pkg/f_sql/e_sem/volatility"
 	"github.com/dborchard/tiny_crdb/pkg/f_sql/types"
+	"time"
 )
 
 func init() {
@@ -45,6 +47,44 @@ var regularBuiltins = map[string]builtinDefinition{
 			volatility.Immutable,
 		),
 	),
+
+	"follower_read_timestamp": makeBuiltin(tree.FunctionProperties{Category: builtinconstants.CategorySystemInfo},
+		tree.Overload{
+			Types:      tree.ParamTypes{},
+			ReturnType: tree.FixedReturnType(types.TimestampTZ),
+			Fn: func(_ context.Context, evalCtx *eval.Context, _ tree.Datums) (tree.Datum, error) {
+				return tree.MakeDTimestampTZ(
+					evalCtx.GetStmtTimestamp().Add(builtinconstants.DefaultFollowerReadDuration), time.Microsecond)
+			},
+			Info: `Returns a timestamp which is very likely to be safe to perform
+against a follower replica.
+
+This function is intended to be used to perform historical reads against a
+time which is recent but sufficiently old for reads to be performed against
+the closest replica as opposed to the current leaseholder for a given range:
+the closed timestamps of the ranges trail the present by less than the
+returned staleness.`,
+			Volatility: volatility.Volatile,
+		},
+	),
+
+	"with_max_staleness": makeBuiltin(tree.FunctionProperties{Category: builtinconstants.CategorySystemInfo},
+		tree.Overload{
+			Types:      tree.ParamTypes{{Name: "max_staleness", Typ: types.Interval}},
+			ReturnType: tree.FixedReturnType(types.TimestampTZ),
+			Fn: func(_ context.Context, evalCtx *eval.Context, args tree.Datums) (tree.Datum, error) {
+				maxStaleness := args[0].(*tree.DInterval).Duration
+				if maxStaleness < 0 {
+					return nil, errors.New("interval duration for with_max_staleness must be greater or equal to 0")
+				}
+				return tree.MakeDTimestampTZ(evalCtx.GetStmtTimestamp().Add(-maxStaleness), time.Microsecond)
+			},
+			Info: `Returns the oldest timestamp within the staleness bound, for
+bounded staleness reads: the reads are served at the newest timestamp above
+it at which the closest replica can serve them without blocking.`,
+			Volatility: volatility.Volatile,
+		},
+	),
 }
 
 func makeBuiltin(props tree.FunctionProperties, overloads ...tree.Overload) builtinDefinition {
@@ -0,0 +1,35 @@
+package builtins
+
+import (
+	"context"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/e_sem/builtins/builtinconstants"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/e_sem/builtins/builtinsregistry"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/e_sem/eval"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/e_sem/tree"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestFollowerReadBuiltins(t *testing.T) {
+	ctx := context.Background()
+	stmtTS := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	evalCtx := &eval.Context{StmtTimestamp: stmtTS}
+	call := func(name string, args ...tree.Datum) (tree.Datum, error) {
+		_, overloads := builtinsregistry.GetBuiltinProperties(name)
+		require.Len(t, overloads, 1)
+		return overloads[0].Fn.(func(context.Context, *eval.Context, tree.Datums) (tree.Datum, error))(
+			ctx, evalCtx, args)
+	}
+
+	d, err := call("follower_read_timestamp")
+	require.NoError(t, err)
+	require.Equal(t, stmtTS.Add(builtinconstants.DefaultFollowerReadDuration), d.(*tree.DTimestampTZ).Time)
+
+	d, err = call("with_max_staleness", tree.NewDInterval(10*time.Second))
+	require.NoError(t, err)
+	require.Equal(t, stmtTS.Add(-10*time.Second), d.(*tree.DTimestampTZ).Time)
+
+	_, err = call("with_max_staleness", tree.NewDInterval(-time.Second))
+	require.Error(t, err)
+}
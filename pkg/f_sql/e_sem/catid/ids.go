@@ -5,3 +5,6 @@ type DescID uint32
 
 // ColumnID is a custom type for Column IDs.
 type ColumnID uint32
+
+// IndexID is a custom type for IndexDescriptor IDs.
+type IndexID uint32
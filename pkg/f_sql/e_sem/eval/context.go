@@ -1,6 +1,9 @@
 package eval
 
-import "github.com/dborchard/tiny_crdb/pkg/f_sql/sessiondata"
+import (
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/sessiondata"
+	"time"
+)
 
 // Context defines the context in which to evaluate an expression, allowing
 // the retrieval of state such as the node ID or statement start time.
@@ -20,6 +23,19 @@ import "github.com/dborchard/tiny_crdb/pkg/f_sql/sessiondata"
 type Context struct {
 	Planner          Planner
 	SessionDataStack *sessiondata.Stack
+
+	// StmtTimestamp is the time at which the statement being evaluated
+	// started.
+	StmtTimestamp time.Time
+}
+
+// GetStmtTimestamp retrieves the current statement timestamp as per
+// the evaluation context. The timestamp is guaranteed to be nonzero.
+func (ec *Context) GetStmtTimestamp() time.Time {
+	if ec.StmtTimestamp.IsZero() {
+		panic("zero statement timestamp in EvalContext")
+	}
+	return ec.StmtTimestamp
 }
 
 // SessionData returns the SessionData the current EvalCtx should use to eval.
@@ -0,0 +1,79 @@
+package tree
+
+import "strings"
+
+// CreateChangefeed represents a CREATE CHANGEFEED statement.
+type CreateChangefeed struct {
+	Targets TableNames
+	// SinkURI is the URI of the sink into which the changefeed emits its
+	// messages. It is empty for a changefeed whose messages are returned to
+	// the client.
+	SinkURI string
+	Options KVOptions
+}
+
+var _ Statement = &CreateChangefeed{}
+
+// String returns the statement as SQL.
+func (node *CreateChangefeed) String() string {
+	var buf strings.Builder
+	buf.WriteString("CREATE CHANGEFEED FOR TABLE ")
+	for i := range node.Targets {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		buf.WriteString(node.Targets[i].Table())
+	}
+	if node.SinkURI != "" {
+		buf.WriteString(" INTO ")
+		buf.WriteString(quoteString(node.SinkURI))
+	}
+	if len(node.Options) > 0 {
+		buf.WriteString(" WITH ")
+		buf.WriteString(node.Options.String())
+	}
+	return buf.String()
+}
+
+// StatementReturnType implements the Statement interface. A changefeed into
+// a sink returns the ID of its job, while a changefeed without a sink
+// streams its messages to the client.
+func (node *CreateChangefeed) StatementReturnType() StatementReturnType {
+	if node.SinkURI != "" {
+		return Rows
+	}
+	return Replication
+}
+
+// StatementType implements the Statement interface.
+func (*CreateChangefeed) StatementType() StatementType { return TypeDML }
+
+// StatementTag implements the Statement interface.
+func (*CreateChangefeed) StatementTag() string { return "CREATE CHANGEFEED" }
+
+// KVOption is a key-value option.
+type KVOption struct {
+	Key Name
+	// Value is empty for an option without a value.
+	Value string
+}
+
+// KVOptions is a list of KVOptions.
+type KVOptions []KVOption
+
+// String returns the options as SQL.
+func (o KVOptions) String() string {
+	items := make([]string, len(o))
+	for i, opt := range o {
+		items[i] = string(opt.Key)
+		if opt.Value != "" {
+			items[i] += " = " + quoteString(opt.Value)
+		}
+	}
+	return strings.Join(items, ", ")
+}
+
+// quoteString returns the string as an SQL string literal.
+func quoteString(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
@@ -2,9 +2,12 @@ package tree
 
 import (
 	"context"
+	"fmt"
 	"github.com/dborchard/tiny_crdb/pkg/f_sql/types"
 	"github.com/lib/pq/oid"
+	"math"
 	"time"
+	"unsafe"
 )
 
 // Datum represents a SQL value.
@@ -114,10 +117,22 @@ type DOid struct {
 	name string
 }
 
+// DTimestampTZ is the timestamp Datum that is rendered with session offset.
+type DTimestampTZ struct {
+	time.Time
+}
+
+// DInterval is the interval Datum.
+type DInterval struct {
+	Duration time.Duration
+}
+
 var _ Datum = new(DInt)
 var _ Datum = new(DString)
 var _ Datum = new(DBytes)
 var _ Datum = new(DOid)
+var _ Datum = new(DTimestampTZ)
+var _ Datum = new(DInterval)
 
 // NewDInt is a helper routine to create a *DInt initialized from its argument.
 func NewDInt(d DInt) *DInt {
@@ -137,6 +152,12 @@ func NewDString(d string) *DString {
 	return &r
 }
 
+// NewDBytes is a helper routine to create a *DBytes initialized from its
+// argument.
+func NewDBytes(d DBytes) *DBytes {
+	return &d
+}
+
 func (d *DInt) String() string {
 	//TODO implement me
 	panic("implement me")
@@ -456,3 +477,166 @@ func (d *DOid) Size() uintptr {
 	//TODO implement me
 	panic("implement me")
 }
+
+// MakeDTimestampTZ creates a DTimestampTZ with specified precision.
+func MakeDTimestampTZ(t time.Time, precision time.Duration) (*DTimestampTZ, error) {
+	return &DTimestampTZ{Time: t.Round(precision)}, nil
+}
+
+func (d *DTimestampTZ) String() string {
+	return d.Time.UTC().Format("2006-01-02 15:04:05.999999-07:00")
+}
+
+func (d *DTimestampTZ) Format(ctx *FmtCtx) {}
+
+func (d *DTimestampTZ) Walk(visitor Visitor) Expr {
+	return d
+}
+
+func (d *DTimestampTZ) TypeCheck(ctx context.Context, semaCtx *SemaContext, desired *types.T) (TypedExpr, error) {
+	return d, nil
+}
+
+func (d *DTimestampTZ) ResolvedType() *types.T {
+	return types.TimestampTZ
+}
+
+func (d *DTimestampTZ) Eval(ctx context.Context, evaluator ExprEvaluator) (Datum, error) {
+	return d, nil
+}
+
+func (d *DTimestampTZ) AmbiguousFormat() bool {
+	return true
+}
+
+func (d *DTimestampTZ) Compare(ctx CompareContext, other Datum) int {
+	res, err := d.CompareError(ctx, other)
+	if err != nil {
+		panic(err)
+	}
+	return res
+}
+
+func (d *DTimestampTZ) CompareError(ctx CompareContext, other Datum) (int, error) {
+	v, ok := other.(*DTimestampTZ)
+	if !ok {
+		return 0, makeUnsupportedComparisonMessage(d, other)
+	}
+	return d.Time.Compare(v.Time), nil
+}
+
+func (d *DTimestampTZ) Prev(ctx CompareContext) (Datum, bool) {
+	return &DTimestampTZ{Time: d.Add(-time.Microsecond)}, true
+}
+
+func (d *DTimestampTZ) IsMin(ctx CompareContext) bool {
+	return false
+}
+
+func (d *DTimestampTZ) Next(ctx CompareContext) (Datum, bool) {
+	return &DTimestampTZ{Time: d.Add(time.Microsecond)}, true
+}
+
+func (d *DTimestampTZ) IsMax(ctx CompareContext) bool {
+	return false
+}
+
+func (d *DTimestampTZ) Max(ctx CompareContext) (Datum, bool) {
+	return nil, false
+}
+
+func (d *DTimestampTZ) Min(ctx CompareContext) (Datum, bool) {
+	return nil, false
+}
+
+func (d *DTimestampTZ) Size() uintptr {
+	return unsafe.Sizeof(*d)
+}
+
+// NewDInterval creates a new DInterval.
+func NewDInterval(d time.Duration) *DInterval {
+	return &DInterval{Duration: d}
+}
+
+func (d *DInterval) String() string {
+	return d.Duration.String()
+}
+
+func (d *DInterval) Format(ctx *FmtCtx) {}
+
+func (d *DInterval) Walk(visitor Visitor) Expr {
+	return d
+}
+
+func (d *DInterval) TypeCheck(ctx context.Context, semaCtx *SemaContext, desired *types.T) (TypedExpr, error) {
+	return d, nil
+}
+
+func (d *DInterval) ResolvedType() *types.T {
+	return types.Interval
+}
+
+func (d *DInterval) Eval(ctx context.Context, evaluator ExprEvaluator) (Datum, error) {
+	return d, nil
+}
+
+func (d *DInterval) AmbiguousFormat() bool {
+	return true
+}
+
+func (d *DInterval) Compare(ctx CompareContext, other Datum) int {
+	res, err := d.CompareError(ctx, other)
+	if err != nil {
+		panic(err)
+	}
+	return res
+}
+
+func (d *DInterval) CompareError(ctx CompareContext, other Datum) (int, error) {
+	v, ok := other.(*DInterval)
+	if !ok {
+		return 0, makeUnsupportedComparisonMessage(d, other)
+	}
+	switch {
+	case d.Duration < v.Duration:
+		return -1, nil
+	case d.Duration > v.Duration:
+		return 1, nil
+	default:
+		return 0, nil
+	}
+}
+
+func (d *DInterval) Prev(ctx CompareContext) (Datum, bool) {
+	return nil, false
+}
+
+func (d *DInterval) IsMin(ctx CompareContext) bool {
+	return d.Duration == math.MinInt64
+}
+
+func (d *DInterval) Next(ctx CompareContext) (Datum, bool) {
+	return nil, false
+}
+
+func (d *DInterval) IsMax(ctx CompareContext) bool {
+	return d.Duration == math.MaxInt64
+}
+
+func (d *DInterval) Max(ctx CompareContext) (Datum, bool) {
+	return NewDInterval(math.MaxInt64), true
+}
+
+func (d *DInterval) Min(ctx CompareContext) (Datum, bool) {
+	return NewDInterval(math.MinInt64), true
+}
+
+func (d *DInterval) Size() uintptr {
+	return unsafe.Sizeof(*d)
+}
+
+// makeUnsupportedComparisonMessage returns the error of a comparison between
+// datums of different types.
+func makeUnsupportedComparisonMessage(d1, d2 Datum) error {
+	return fmt.Errorf("unsupported comparison: %T to %T", d1, d2)
+}
@@ -0,0 +1,23 @@
+package tree
+
+// ExplainAnalyze represents an EXPLAIN ANALYZE statement. The statement is
+// run, and the statistics of its execution are returned instead of its rows.
+type ExplainAnalyze struct {
+	Statement Statement
+}
+
+var _ Statement = &ExplainAnalyze{}
+
+// String returns the statement as SQL.
+func (node *ExplainAnalyze) String() string {
+	return "EXPLAIN ANALYZE " + node.Statement.String()
+}
+
+// StatementReturnType implements the Statement interface.
+func (*ExplainAnalyze) StatementReturnType() StatementReturnType { return Rows }
+
+// StatementType implements the Statement interface.
+func (*ExplainAnalyze) StatementType() StatementType { return TypeDML }
+
+// StatementTag implements the Statement interface.
+func (*ExplainAnalyze) StatementTag() string { return "EXPLAIN ANALYZE" }
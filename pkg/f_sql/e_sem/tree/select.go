@@ -1,6 +1,9 @@
 package tree
 
-import "github.com/dborchard/tiny_crdb/pkg/y_col/coldata"
+import (
+	"github.com/dborchard/tiny_crdb/pkg/y_col/coldata"
+	"strings"
+)
 
 // Select represents a SelectStatement with an ORDER and/or LIMIT.
 type Select struct {
@@ -38,6 +41,9 @@ type SelectClause struct {
 	Where       *Where
 	Distinct    bool
 	TableSelect bool
+	// Locking is the row-level locking clause of the SELECT, e.g. FOR UPDATE
+	// SKIP LOCKED. It is empty if the SELECT does not lock the rows it reads.
+	Locking LockingClause
 }
 
 func (c *SelectClause) String() string {
@@ -69,6 +75,12 @@ type Where struct {
 	Expr Expr
 }
 
+// Where.Type
+const (
+	AstWhere  = "WHERE"
+	AstHaving = "HAVING"
+)
+
 // SelectExprs represents SELECT expressions.
 type SelectExprs []SelectExpr
 
@@ -200,3 +212,151 @@ func (s *Select) StatementTag() string {
 	//TODO implement me
 	panic("implement me")
 }
+
+// LockingClause represents a locking clause, like FOR UPDATE.
+type LockingClause []*LockingItem
+
+// String returns the locking clause as SQL.
+func (node LockingClause) String() string {
+	items := make([]string, len(node))
+	for i, n := range node {
+		items[i] = n.String()
+	}
+	return strings.Join(items, " ")
+}
+
+// ForTable returns the strongest locking strength and wait policy of the
+// locking items that apply to the provided table: those that target the
+// table, and those that do not name their targets.
+func (node LockingClause) ForTable(table Name) (LockingStrength, LockingWaitPolicy) {
+	var str LockingStrength
+	var wp LockingWaitPolicy
+	for _, item := range node {
+		if !item.appliesTo(table) {
+			continue
+		}
+		str = str.Max(item.Strength)
+		wp = wp.Max(item.WaitPolicy)
+	}
+	return str, wp
+}
+
+// LockingItem represents a single locking item in a locking clause.
+type LockingItem struct {
+	Strength   LockingStrength
+	Targets    TableNames
+	WaitPolicy LockingWaitPolicy
+}
+
+// String returns the locking item as SQL.
+func (f *LockingItem) String() string {
+	var buf strings.Builder
+	buf.WriteString(f.Strength.String())
+	if len(f.Targets) > 0 {
+		buf.WriteString(" OF ")
+		for i := range f.Targets {
+			if i > 0 {
+				buf.WriteString(", ")
+			}
+			buf.WriteString(f.Targets[i].Table())
+		}
+	}
+	if f.WaitPolicy != LockWaitBlock {
+		buf.WriteString(f.WaitPolicy.String())
+	}
+	return buf.String()
+}
+
+func (f *LockingItem) appliesTo(table Name) bool {
+	if len(f.Targets) == 0 {
+		return true
+	}
+	for i := range f.Targets {
+		if f.Targets[i].ObjectName == table {
+			return true
+		}
+	}
+	return false
+}
+
+// LockingStrength represents the possible row-level lock modes for a SELECT
+// statement.
+type LockingStrength byte
+
+// The ordering of the variants is important, because the highest numerical
+// value takes precedence when row-level locking is specified multiple ways.
+const (
+	// ForNone represents the default - no row-level locking.
+	ForNone LockingStrength = iota
+
+	// ForKeyShare represents FOR KEY SHARE behavior.
+	ForKeyShare
+
+	// ForShare represents FOR SHARE behavior.
+	ForShare
+
+	// ForNoKeyUpdate represents FOR NO KEY UPDATE behavior.
+	ForNoKeyUpdate
+
+	// ForUpdate represents FOR UPDATE behavior.
+	ForUpdate
+)
+
+var lockingStrengthName = [...]string{
+	ForNone:        "",
+	ForKeyShare:    "FOR KEY SHARE",
+	ForShare:       "FOR SHARE",
+	ForNoKeyUpdate: "FOR NO KEY UPDATE",
+	ForUpdate:      "FOR UPDATE",
+}
+
+func (s LockingStrength) String() string {
+	return lockingStrengthName[s]
+}
+
+// Max returns the maximum of the two locking strengths.
+func (s LockingStrength) Max(s2 LockingStrength) LockingStrength {
+	if s > s2 {
+		return s
+	}
+	return s2
+}
+
+// LockingWaitPolicy represents the possible policies for dealing with rows
+// being locked by FOR UPDATE/SHARE clauses (i.e., it represents the NOWAIT
+// and SKIP LOCKED options).
+type LockingWaitPolicy byte
+
+// The ordering of the variants is important, because the highest numerical
+// value takes precedence when row-level locking is specified multiple ways.
+const (
+	// LockWaitBlock represents the default - wait for the lock to become
+	// available.
+	LockWaitBlock LockingWaitPolicy = iota
+
+	// LockWaitSkipLocked represents SKIP LOCKED - skip rows that can't be
+	// locked.
+	LockWaitSkipLocked
+
+	// LockWaitError represents NOWAIT - raise an error if a row cannot be
+	// locked.
+	LockWaitError
+)
+
+var lockingWaitPolicyName = [...]string{
+	LockWaitBlock:      "",
+	LockWaitSkipLocked: " SKIP LOCKED",
+	LockWaitError:      " NOWAIT",
+}
+
+func (p LockingWaitPolicy) String() string {
+	return lockingWaitPolicyName[p]
+}
+
+// Max returns the maximum of the two locking wait policies.
+func (p LockingWaitPolicy) Max(p2 LockingWaitPolicy) LockingWaitPolicy {
+	if p > p2 {
+		return p
+	}
+	return p2
+}
@@ -44,6 +44,21 @@ const (
 	Unknown
 )
 
+//go:generate stringer -type=StatementType
+const (
+	// TypeDDL (Data Definition Language) deals with database schemas and descriptions.
+	TypeDDL StatementType = iota
+	// TypeDML (Data Manipulation Language) deals with data manipulation and it is used to
+	// store, modify, retrieve, delete and update data in a database.
+	TypeDML
+	// TypeDCL (Data Control Language) deals with commands such as GRANT and mostly
+	// concerned with rights, permissions and other controls of the database system.
+	TypeDCL
+	// TypeTCL (Transaction Control Language) deals with a transaction within a
+	// database.
+	TypeTCL
+)
+
 // Statement represents a statement.
 type Statement interface {
 	fmt.Stringer
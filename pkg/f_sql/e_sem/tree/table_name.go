@@ -65,3 +65,38 @@ type ObjectNamePrefix struct {
 // aggressive about quoting names in certain positions. New grammar rules should
 // prefer to parse unrestricted_name nonterminals into UnrestrictedNames.
 type UnrestrictedName string
+
+// MakeUnqualifiedTableName creates a new base table name.
+func MakeUnqualifiedTableName(tn Name) TableName {
+	return TableName{objName{ObjectName: tn}}
+}
+
+// MakeTableNameFromPrefix creates a table name from an unqualified name
+// and a resolved prefix.
+func MakeTableNameFromPrefix(prefix ObjectNamePrefix, object Name) TableName {
+	return TableName{objName{ObjectName: object, ObjectNamePrefix: prefix}}
+}
+
+// Schema retrieves the unqualified schema name.
+func (t *TableName) Schema() string {
+	return string(t.SchemaName)
+}
+
+// Table retrieves the unqualified table name.
+func (t *TableName) Table() string {
+	return string(t.ObjectName)
+}
+
+func (*TableName) tableExpr() {}
+
+// Format implements the NodeFormatter interface.
+func (t *TableName) Format(ctx *FmtCtx) {}
+
+// WalkTableExpr implements the TableExpr interface.
+func (t *TableName) WalkTableExpr(_ Visitor) TableExpr { return t }
+
+var _ TableExpr = &TableName{}
+
+// TableNames represents a comma separated list (see the Format method)
+// of table names.
+type TableNames []TableName
@@ -1,5 +1,7 @@
 package tree
 
+import "fmt"
+
 // TransactionModes holds the transaction modes for a transaction.
 type TransactionModes struct {
 	Isolation     IsolationLevel
@@ -22,6 +24,23 @@ const (
 	SerializableIsolation
 )
 
+var isolationLevelNames = [...]string{
+	UnspecifiedIsolation:     "UNSPECIFIED",
+	ReadUncommittedIsolation: "READ UNCOMMITTED",
+	ReadCommittedIsolation:   "READ COMMITTED",
+	RepeatableReadIsolation:  "REPEATABLE READ",
+	SnapshotIsolation:        "SNAPSHOT",
+	SerializableIsolation:    "SERIALIZABLE",
+}
+
+// String implements the Stringer interface.
+func (i IsolationLevel) String() string {
+	if i < 0 || i > IsolationLevel(len(isolationLevelNames)-1) {
+		return fmt.Sprintf("IsolationLevel(%d)", i)
+	}
+	return isolationLevelNames[i]
+}
+
 // ReadWriteMode holds the read write mode for a transaction.
 type ReadWriteMode int
 
@@ -42,3 +61,69 @@ const (
 	Normal
 	High
 )
+
+// BeginTransaction represents a BEGIN statement
+type BeginTransaction struct {
+	// FormatWithStart says whether this statement must be formatted with
+	// "START" rather than "BEGIN". This is needed if this statement is in a
+	// BEGIN ATOMIC block of a procedure or function.
+	FormatWithStart bool
+	Modes           TransactionModes
+}
+
+var _ Statement = &BeginTransaction{}
+
+// String implements the Statement interface.
+func (node *BeginTransaction) String() string {
+	kw := "BEGIN"
+	if node.FormatWithStart {
+		kw = "START"
+	}
+	if node.Modes.Isolation == UnspecifiedIsolation {
+		return kw + " TRANSACTION"
+	}
+	return fmt.Sprintf("%s TRANSACTION ISOLATION LEVEL %s", kw, node.Modes.Isolation)
+}
+
+// StatementReturnType implements the Statement interface.
+func (*BeginTransaction) StatementReturnType() StatementReturnType { return Ack }
+
+// StatementType implements the Statement interface.
+func (*BeginTransaction) StatementType() StatementType { return TypeTCL }
+
+// StatementTag returns a short string identifying the type of statement.
+func (*BeginTransaction) StatementTag() string { return "BEGIN" }
+
+// CommitTransaction represents a COMMIT statement.
+type CommitTransaction struct{}
+
+var _ Statement = &CommitTransaction{}
+
+// String implements the Statement interface.
+func (*CommitTransaction) String() string { return "COMMIT TRANSACTION" }
+
+// StatementReturnType implements the Statement interface.
+func (*CommitTransaction) StatementReturnType() StatementReturnType { return Ack }
+
+// StatementType implements the Statement interface.
+func (*CommitTransaction) StatementType() StatementType { return TypeTCL }
+
+// StatementTag returns a short string identifying the type of statement.
+func (*CommitTransaction) StatementTag() string { return "COMMIT" }
+
+// RollbackTransaction represents a ROLLBACK statement.
+type RollbackTransaction struct{}
+
+var _ Statement = &RollbackTransaction{}
+
+// String implements the Statement interface.
+func (*RollbackTransaction) String() string { return "ROLLBACK TRANSACTION" }
+
+// StatementReturnType implements the Statement interface.
+func (*RollbackTransaction) StatementReturnType() StatementReturnType { return Ack }
+
+// StatementType implements the Statement interface.
+func (*RollbackTransaction) StatementType() StatementType { return TypeTCL }
+
+// StatementTag returns a short string identifying the type of statement.
+func (*RollbackTransaction) StatementTag() string { return "ROLLBACK" }
@@ -2,6 +2,7 @@ package sql
 
 import (
 	"context"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/fsm"
 	"github.com/dborchard/tiny_crdb/pkg/z_util/stop"
 )
 
@@ -21,7 +22,11 @@ func (s *Server) newConnExecutor(
 		stmtBuf:      stmtBuf,
 		clientComm:   clientComm,
 		executorType: executorTypeExec,
+		transitionCtx: transitionCtx{
+			db: s.cfg.DB,
+		},
 	}
+	ex.machine = fsm.MakeMachine(TxnStateTransitions, stateNoTxn{}, &ex.state)
 
 	if postSetupFn != nil {
 		postSetupFn(ex)
@@ -1,7 +1,9 @@
 package sql
 
 import (
+	"context"
 	"github.com/dborchard/tiny_crdb/pkg/f_sql/e_sem/tree"
+	kv "github.com/dborchard/tiny_crdb/pkg/g_kv"
 	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/concurrency/isolation"
 	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
 	"github.com/dborchard/tiny_crdb/pkg/z_util/fsm"
@@ -9,11 +11,28 @@ import (
 	"time"
 )
 
+/// States.
+
 type stateNoTxn struct{}
 
 var _ fsm.State = &stateNoTxn{}
 
-func (stateNoTxn) State() {}
+type stateOpen struct {
+	ImplicitTxn fsm.Bool
+}
+
+var _ fsm.State = &stateOpen{}
+
+// stateAborted is the state of an explicit transaction in which a statement
+// failed. Statements other than COMMIT and ROLLBACK are rejected until the
+// transaction is ended.
+type stateAborted struct{}
+
+var _ fsm.State = &stateAborted{}
+
+func (stateNoTxn) State()   {}
+func (stateOpen) State()    {}
+func (stateAborted) State() {}
 
 // advanceCode is part of advanceInfo; it instructs the module managing the
 // statements buffer on what action to take.
@@ -21,7 +40,11 @@ type advanceCode int
 
 const (
 	advanceUnknown advanceCode = iota
+	// stayInPlace means that the cursor should remain where it is. The
+	// connExecutor will execute this statement again.
 	stayInPlace
+	// advanceOne means that the cursor should be advanced to the next
+	// statement.
 	advanceOne
 	skipBatch
 	rewind
@@ -34,22 +57,250 @@ const (
 type advanceInfo struct {
 	code advanceCode
 }
+
+/// Events.
+
 type eventTxnStart struct {
 	ImplicitTxn fsm.Bool
 }
+type eventTxnStartPayload struct {
+	tranCtx transitionCtx
+
+	pri roachpb.UserPriority
+	// txnSQLTimestamp is the timestamp that statements executed in the
+	// transaction that is started by this event will report for now(),
+	// current_timestamp(), transaction_timestamp().
+	txnSQLTimestamp     time.Time
+	readOnly            tree.ReadWriteMode
+	historicalTimestamp *hlc.Timestamp
+	isoLevel            isolation.Level
+}
+
+// makeEventTxnStartPayload creates an eventTxnStartPayload.
+func makeEventTxnStartPayload(
+	pri roachpb.UserPriority,
+	readOnly tree.ReadWriteMode,
+	txnSQLTimestamp time.Time,
+	historicalTimestamp *hlc.Timestamp,
+	tranCtx transitionCtx,
+	isoLevel isolation.Level,
+) eventTxnStartPayload {
+	return eventTxnStartPayload{
+		pri:                 pri,
+		readOnly:            readOnly,
+		txnSQLTimestamp:     txnSQLTimestamp,
+		historicalTimestamp: historicalTimestamp,
+		tranCtx:             tranCtx,
+		isoLevel:            isoLevel,
+	}
+}
+
+// eventTxnFinishCommitted is generated when a transaction is committed.
+type eventTxnFinishCommitted struct{}
+
+// eventTxnFinishAborted is generated when a transaction is rolled back by a
+// ROLLBACK statement, or by a COMMIT statement in the Aborted state.
+type eventTxnFinishAborted struct{}
+
+// eventNonRetriableErr is generated by a statement that failed with an error
+// which does not allow the transaction to be retried automatically.
+type eventNonRetriableErr struct {
+	IsCommit fsm.Bool
+}
+
+// eventNonRetriableErrPayload represents the payload for eventNonRetriableErr.
+type eventNonRetriableErrPayload struct {
+	// err is the error that caused the event.
+	err error
+}
 
-func (e eventTxnStart) Event() {
-	//TODO implement me
-	panic("implement me")
+// errorCause implements the payloadWithError interface.
+func (p eventNonRetriableErrPayload) errorCause() error {
+	return p.err
 }
 
+// payloadWithError is a common interface for the payloads that wrap an error.
+type payloadWithError interface {
+	errorCause() error
+}
+
+func (eventTxnStart) Event()           {}
+func (eventTxnFinishCommitted) Event() {}
+func (eventTxnFinishAborted) Event()   {}
+func (eventNonRetriableErr) Event()    {}
+
 var eventStartImplicitTxn fsm.Event = eventTxnStart{ImplicitTxn: fsm.True}
 var eventStartExplicitTxn fsm.Event = eventTxnStart{ImplicitTxn: fsm.False}
 
-type eventTxnStartPayload struct {
-	pri                 roachpb.UserPriority
-	txnSQLTimestamp     time.Time
-	readOnly            tree.ReadWriteMode
-	historicalTimestamp *hlc.Timestamp
-	isoLevel            isolation.Level
+// TxnStateTransitions describe the transitions used by a connExecutor's
+// fsm.Machine. Args.Extended is a txnState, which is mutated by the Actions.
+var TxnStateTransitions = fsm.Compile(fsm.Pattern{
+	// NoTxn
+	stateNoTxn{}: {
+		eventTxnStart{ImplicitTxn: fsm.True}: {
+			Next: stateOpen{ImplicitTxn: fsm.True},
+			Action: func(args fsm.Args) error {
+				ts := args.Extended.(*txnState)
+				if err := ts.resetForNewSQLTxn(args.Ctx, args.Payload.(eventTxnStartPayload)); err != nil {
+					return err
+				}
+				// The statement is run again, now that the transaction is
+				// open.
+				ts.setAdvanceInfo(stayInPlace)
+				return nil
+			},
+		},
+		eventTxnStart{ImplicitTxn: fsm.False}: {
+			Next: stateOpen{ImplicitTxn: fsm.False},
+			Action: func(args fsm.Args) error {
+				ts := args.Extended.(*txnState)
+				if err := ts.resetForNewSQLTxn(args.Ctx, args.Payload.(eventTxnStartPayload)); err != nil {
+					return err
+				}
+				// The BEGIN statement is consumed.
+				ts.setAdvanceInfo(advanceOne)
+				return nil
+			},
+		},
+		// The statement failed before a transaction was started. The error is
+		// reported to the client, and the statement is consumed.
+		eventNonRetriableErr{IsCommit: fsm.False}: {
+			Next: stateNoTxn{},
+			Action: func(args fsm.Args) error {
+				args.Extended.(*txnState).setAdvanceInfo(advanceOne)
+				return nil
+			},
+		},
+	},
+
+	/// Open
+	stateOpen{ImplicitTxn: fsm.True}: {
+		eventTxnFinishCommitted{}: {
+			Next: stateNoTxn{},
+			Action: func(args fsm.Args) error {
+				args.Extended.(*txnState).finishSQLTxn()
+				return nil
+			},
+		},
+		eventNonRetriableErr{IsCommit: fsm.False}: {
+			Next: stateNoTxn{},
+			Action: func(args fsm.Args) error {
+				return args.Extended.(*txnState).finishTxnRollback(args.Ctx)
+			},
+		},
+		eventNonRetriableErr{IsCommit: fsm.True}: {
+			Next: stateNoTxn{},
+			Action: func(args fsm.Args) error {
+				args.Extended.(*txnState).finishSQLTxn()
+				return nil
+			},
+		},
+	},
+	stateOpen{ImplicitTxn: fsm.False}: {
+		eventTxnFinishCommitted{}: {
+			Next: stateNoTxn{},
+			Action: func(args fsm.Args) error {
+				args.Extended.(*txnState).finishSQLTxn()
+				return nil
+			},
+		},
+		eventTxnFinishAborted{}: {
+			Next: stateNoTxn{},
+			Action: func(args fsm.Args) error {
+				return args.Extended.(*txnState).finishTxnRollback(args.Ctx)
+			},
+		},
+		// A statement failed: the transaction stays open, but rejects the
+		// statements other than COMMIT and ROLLBACK until it is ended.
+		eventNonRetriableErr{IsCommit: fsm.False}: {
+			Next: stateAborted{},
+			Action: func(args fsm.Args) error {
+				args.Extended.(*txnState).setAdvanceInfo(advanceOne)
+				return nil
+			},
+		},
+		eventNonRetriableErr{IsCommit: fsm.True}: {
+			Next: stateNoTxn{},
+			Action: func(args fsm.Args) error {
+				args.Extended.(*txnState).finishSQLTxn()
+				return nil
+			},
+		},
+	},
+
+	/// Aborted
+	stateAborted{}: {
+		eventTxnFinishAborted{}: {
+			Next: stateNoTxn{},
+			Action: func(args fsm.Args) error {
+				return args.Extended.(*txnState).finishTxnRollback(args.Ctx)
+			},
+		},
+		eventNonRetriableErr{IsCommit: fsm.False}: {
+			Next: stateAborted{},
+			Action: func(args fsm.Args) error {
+				args.Extended.(*txnState).setAdvanceInfo(advanceOne)
+				return nil
+			},
+		},
+	},
+})
+
+// transitionCtx is a bag of fields needed by some state machine events.
+type transitionCtx struct {
+	db *kv.DB
+}
+
+// txnState contains state associated with an ongoing SQL txn; it constitutes
+// the ExtendedState of a connExecutor's state machine (defined above).
+type txnState struct {
+	// txn is the KV transaction of the SQL transaction, or nil when there is
+	// no transaction open.
+	txn *kv.Txn
+
+	// adv is the advanceInfo set by the latest transition, and consumed by
+	// the connExecutor.
+	adv advanceInfo
+}
+
+// resetForNewSQLTxn (re)initializes the txnState for a new transaction, whose
+// KV transaction runs at the isolation level of the payload. The transaction
+// executes step-wise: each statement reads at the snapshot established when
+// the transaction is stepped before it.
+func (ts *txnState) resetForNewSQLTxn(ctx context.Context, payload eventTxnStartPayload) error {
+	txn := kv.NewTxn(ctx, payload.tranCtx.db)
+	if err := txn.SetIsoLevel(payload.isoLevel); err != nil {
+		return err
+	}
+	txn.ConfigureStepping(ctx, kv.SteppingEnabled)
+	ts.txn = txn
+	return nil
+}
+
+// finishTxnRollback rolls back the transaction, and resets the txnState.
+func (ts *txnState) finishTxnRollback(ctx context.Context) error {
+	err := ts.txn.Rollback(ctx)
+	ts.finishSQLTxn()
+	return err
+}
+
+// finishSQLTxn finalizes a transaction's results. The statement that ended
+// the transaction is consumed.
+func (ts *txnState) finishSQLTxn() {
+	ts.txn = nil
+	ts.setAdvanceInfo(advanceOne)
+}
+
+// setAdvanceInfo stores the advanceInfo to be consumed by the connExecutor
+// once the current transition is done.
+func (ts *txnState) setAdvanceInfo(code advanceCode) {
+	ts.adv = advanceInfo{code: code}
+}
+
+// consumeAdvanceInfo returns the advanceInfo set by the last transition and
+// resets the state so that another transition can overwrite it.
+func (ts *txnState) consumeAdvanceInfo() advanceInfo {
+	adv := ts.adv
+	ts.adv = advanceInfo{}
+	return adv
 }
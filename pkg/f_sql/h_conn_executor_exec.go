@@ -1,8 +1,15 @@
 package sql
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/appstatspb"
 	"github.com/dborchard/tiny_crdb/pkg/f_sql/b_parser/statements"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/c_catalog/colinfo"
 	"github.com/dborchard/tiny_crdb/pkg/f_sql/e_sem/tree"
+	kv "github.com/dborchard/tiny_crdb/pkg/g_kv"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
 	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/concurrency/isolation"
 	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
 	"github.com/dborchard/tiny_crdb/pkg/z_util/fsm"
@@ -10,29 +17,271 @@ import (
 	"time"
 )
 
-func (ex *connExecutor) execStmtInNoTxnState(parserStmt statements.Statement[tree.Statement]) (_ fsm.Event, payload fsm.EventPayload) {
+// maxRetriesForReadCommitted is the maximum number of times a statement of a
+// READ COMMITTED transaction is retried after a retryable error that only
+// requires the statement, not the whole transaction, to be retried.
+const maxRetriesForReadCommitted = 10
 
+// execStmtInNoTxnState "executes" a statement when no transaction is in
+// scope. A BEGIN statement starts an explicit transaction at the isolation
+// level it requests; any other statement starts an implicit transaction, in
+// which it is then executed.
+func (ex *connExecutor) execStmtInNoTxnState(
+	ctx context.Context, parserStmt statements.Statement[tree.Statement],
+) (_ fsm.Event, payload fsm.EventPayload) {
 	ast := parserStmt.AST
-	switch ast.(type) {
+	switch s := ast.(type) {
+	case *tree.BeginTransaction:
+		mode, sqlTs, historicalTs, err := ex.beginTransactionTimestampsAndReadMode()
+		if err != nil {
+			return ex.makeErrEvent(err)
+		}
+		return eventStartExplicitTxn, makeEventTxnStartPayload(roachpb.NormalUserPriority, mode, sqlTs, historicalTs, ex.transitionCtx, ex.txnIsolationLevelToKV(s.Modes.Isolation))
 	default:
 		mode, sqlTs, historicalTs, err := ex.beginTransactionTimestampsAndReadMode()
 		if err != nil {
-			return nil, nil
+			return ex.makeErrEvent(err)
 		}
-		return eventStartImplicitTxn, makeEventTxnStartPayload(roachpb.NormalUserPriority, mode, sqlTs, historicalTs, isolation.Serializable)
+		return eventStartImplicitTxn, makeEventTxnStartPayload(roachpb.NormalUserPriority, mode, sqlTs, historicalTs, ex.transitionCtx, isolation.Serializable)
 	}
 }
 
-func (ex *connExecutor) beginTransactionTimestampsAndReadMode() (rwMode tree.ReadWriteMode, txnSQLTimestamp time.Time, historicalTimestamp *hlc.Timestamp, err error) {
-	return tree.ReadOnly, time.Time{}, nil, nil
+// execStmtInOpenState executes one statement in the context of the session's
+// current transaction. If the transaction is implicit, it is committed once
+// the statement has run. The contention events that the statement ran into
+// are added to the contention registry, under the fingerprint of the
+// statement.
+//
+// If an error is returned, the connection is supposed to be consumed.
+func (ex *connExecutor) execStmtInOpenState(
+	ctx context.Context,
+	parserStmt statements.Statement[tree.Statement],
+	res RestrictedCommandResult,
+) (fsm.Event, fsm.EventPayload, error) {
+	switch parserStmt.AST.(type) {
+	case *tree.BeginTransaction:
+		ev, payload := ex.makeErrEvent(errors.New("there is already a transaction in progress"))
+		return ev, payload, nil
+	case *tree.CommitTransaction:
+		ev, payload := ex.commitSQLTransaction(ctx)
+		return ev, payload, nil
+	case *tree.RollbackTransaction:
+		return eventTxnFinishAborted{}, nil, nil
+	}
+
+	p := &ex.planner
+	ex.resetPlanner(ctx, p, ex.state.txn)
+	p.stmt = makeStatement(parserStmt)
+	fingerprintID := appstatspb.ConstructStatementFingerprintID(
+		p.stmt.StmtNoConstants, ex.implicitTxn(), "" /* database */)
+	ex.extraTxnState.stmtFingerprintIDs = append(ex.extraTxnState.stmtFingerprintIDs, fingerprintID)
+	p.instrumentation.Setup(ex.state.txn.ID(), fingerprintID)
+	// Each statement observes the writes of the previous ones and, under the
+	// isolation levels that establish a read snapshot per statement, the
+	// writes committed before it starts.
+	err := ex.state.txn.Step(ctx, true /* allowReadTimestampStep */)
+	if err == nil {
+		if ex.state.txn.IsoLevel() == isolation.ReadCommitted {
+			err = ex.dispatchReadCommittedStmtToExecutionEngine(ctx, p, res)
+		} else {
+			err = ex.dispatchToExecutionEngine(ctx, p, res)
+		}
+	}
+	p.instrumentation.Finish(ex.server.cfg.ContentionRegistry)
+	if err != nil {
+		ev, payload := ex.makeErrEvent(err)
+		return ev, payload, nil
+	}
+	if ex.implicitTxn() {
+		ev, payload := ex.handleAutoCommit(ctx)
+		return ev, payload, nil
+	}
+	return nil, nil, nil
+}
+
+// execStmtInAbortedState executes a statement in a transaction in which a
+// previous statement failed. Only COMMIT and ROLLBACK are allowed, and both
+// roll the transaction back.
+func (ex *connExecutor) execStmtInAbortedState(
+	parserStmt statements.Statement[tree.Statement],
+) (fsm.Event, fsm.EventPayload) {
+	switch parserStmt.AST.(type) {
+	case *tree.CommitTransaction, *tree.RollbackTransaction:
+		return eventTxnFinishAborted{}, nil
+	default:
+		return ex.makeErrEvent(errors.New(
+			"current transaction is aborted, commands ignored until end of transaction block"))
+	}
+}
+
+// commitSQLTransaction commits the KV transaction of the current SQL
+// transaction, on COMMIT or at the end of an implicit transaction.
+func (ex *connExecutor) commitSQLTransaction(ctx context.Context) (fsm.Event, fsm.EventPayload) {
+	if err := ex.state.txn.Commit(ctx); err != nil {
+		return eventNonRetriableErr{IsCommit: fsm.True}, eventNonRetriableErrPayload{err: err}
+	}
+	return eventTxnFinishCommitted{}, nil
+}
+
+// handleAutoCommit commits the KV transaction of an implicit transaction
+// once its statement has run.
+func (ex *connExecutor) handleAutoCommit(ctx context.Context) (fsm.Event, fsm.EventPayload) {
+	return ex.commitSQLTransaction(ctx)
+}
+
+// makeErrEvent creates an event for the error of a statement that isn't a
+// COMMIT.
+func (ex *connExecutor) makeErrEvent(err error) (fsm.Event, fsm.EventPayload) {
+	return eventNonRetriableErr{IsCommit: fsm.False}, eventNonRetriableErrPayload{err: err}
+}
+
+// resetPlanner prepares the planner to plan and run a statement in the
+// transaction.
+func (ex *connExecutor) resetPlanner(ctx context.Context, p *planner, txn *kv.Txn) {
+	p.txn = txn
+	p.stmt = Statement{}
+	p.curPlan = planTop{}
+	p.autoCommit = false
+}
+
+// dispatchToExecutionEngine executes the statement, and sends its rows to
+// res.
+func (ex *connExecutor) dispatchToExecutionEngine(
+	ctx context.Context, planner *planner, res RestrictedCommandResult,
+) error {
+	if err := ex.makeExecPlan(ctx, planner); err != nil {
+		return err
+	}
+	defer planner.curPlan.close(ctx)
+
+	if _, ok := planner.stmt.AST.(*tree.ExplainAnalyze); ok {
+		return ex.execExplainAnalyze(ctx, planner, res)
+	}
+	if planner.stmt.AST.StatementReturnType() == tree.Rows {
+		res.SetColumns(ctx, planColumns(planner.curPlan.main.planNode))
+	}
+	return ex.execWithLocalEngine(ctx, planner, res)
 }
 
-func makeEventTxnStartPayload(pri roachpb.UserPriority, readOnly tree.ReadWriteMode, txnSQLTimestamp time.Time, historicalTimestamp *hlc.Timestamp, isoLevel isolation.Level) eventTxnStartPayload {
-	return eventTxnStartPayload{
-		pri:                 pri,
-		readOnly:            readOnly,
-		txnSQLTimestamp:     txnSQLTimestamp,
-		historicalTimestamp: historicalTimestamp,
-		isoLevel:            isoLevel,
+// makeExecPlan creates an execution plan and populates planner.curPlan.
+func (ex *connExecutor) makeExecPlan(ctx context.Context, planner *planner) error {
+	planner.curPlan.stmt = &planner.stmt
+	return planner.makeOptimizerPlan(ctx)
+}
+
+// execExplainAnalyze runs the plan of the statement of an EXPLAIN ANALYZE,
+// and sends the statistics of its execution to res instead of its rows.
+func (ex *connExecutor) execExplainAnalyze(
+	ctx context.Context, planner *planner, res RestrictedCommandResult,
+) error {
+	res.SetColumns(ctx, colinfo.ExplainPlanColumns)
+	if err := ex.execWithLocalEngine(ctx, planner, nil /* res */); err != nil {
+		return err
+	}
+	// The scans record their contention once they are closed.
+	planner.curPlan.close(ctx)
+	for _, line := range planner.instrumentation.explainAnalyzeInfo() {
+		if err := res.AddRow(ctx, tree.Datums{tree.NewDString(line)}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// execWithLocalEngine runs the plan on the gateway node, pulling its rows
+// from the root planNode, and sends them to res. The rows are discarded if
+// res is nil.
+func (ex *connExecutor) execWithLocalEngine(
+	ctx context.Context, planner *planner, res RestrictedCommandResult,
+) error {
+	params := runParams{
+		ctx:             ctx,
+		extendedEvalCtx: &planner.extendedEvalCtx,
+		p:               planner,
+	}
+	plan := planner.curPlan.main.planNode
+	if err := plan.startExec(params); err != nil {
+		return err
+	}
+	for {
+		ok, err := plan.Next(params)
+		if err != nil || !ok {
+			return err
+		}
+		if res == nil {
+			continue
+		}
+		if err := res.AddRow(ctx, plan.Values()); err != nil {
+			return err
+		}
+	}
+}
+
+// txnIsolationLevelToKV maps the isolation level requested by a SQL statement
+// to the isolation level of the KV transaction. Levels that are not
+// implemented are upgraded to the next stronger level that is: READ
+// UNCOMMITTED runs as READ COMMITTED, and REPEATABLE READ runs as SNAPSHOT.
+func (ex *connExecutor) txnIsolationLevelToKV(level tree.IsolationLevel) isolation.Level {
+	switch level {
+	case tree.ReadUncommittedIsolation, tree.ReadCommittedIsolation:
+		return isolation.ReadCommitted
+	case tree.RepeatableReadIsolation, tree.SnapshotIsolation:
+		return isolation.Snapshot
+	case tree.SerializableIsolation, tree.UnspecifiedIsolation:
+		return isolation.Serializable
+	default:
+		panic(fmt.Sprintf("unknown isolation level: %s", level))
+	}
+}
+
+// dispatchReadCommittedStmtToExecutionEngine runs a statement of a READ
+// COMMITTED transaction and retries it, rather than the whole transaction,
+// after retryable errors that allow it. Each attempt runs on top of a
+// savepoint; on a retryable error, the writes of the attempt are rolled back
+// and the transaction is stepped to establish a new read snapshot that
+// observes the conflicting write before the statement is run again. The
+// results of an attempt are buffered, and only sent to res once it succeeds.
+func (ex *connExecutor) dispatchReadCommittedStmtToExecutionEngine(
+	ctx context.Context, p *planner, res RestrictedCommandResult,
+) error {
+	txn := p.txn
+	if txn.IsoLevel() != isolation.ReadCommitted {
+		return errors.New("statement-level retries are only supported for READ COMMITTED transactions")
 	}
+	sp, err := txn.CreateSavepoint(ctx)
+	if err != nil {
+		return err
+	}
+	for attemptNum := 0; ; attemptNum++ {
+		attemptRes := &bufferedCommandResult{}
+		err := ex.dispatchToExecutionEngine(ctx, p, attemptRes)
+		if err == nil {
+			// The statement succeeded; the savepoint is no longer needed.
+			if err := txn.ReleaseSavepoint(ctx, sp); err != nil {
+				return err
+			}
+			return attemptRes.flush(ctx, res)
+		}
+		// If the error does not allow for a partial retry, then stop. The
+		// error is returned to the client, which needs to retry the
+		// transaction.
+		var retryErr *kvpb.TransactionRetryWithProtoRefreshError
+		if !errors.As(err, &retryErr) || retryErr.TxnMustRestartFromBeginning() {
+			return err
+		}
+		if attemptNum == maxRetriesForReadCommitted {
+			return fmt.Errorf("read committed retry limit (%d) exceeded: %w",
+				maxRetriesForReadCommitted, err)
+		}
+		if err := txn.RollbackToSavepoint(ctx, sp); err != nil {
+			return err
+		}
+		if err := txn.Step(ctx, true /* allowReadTimestampStep */); err != nil {
+			return err
+		}
+	}
+}
+
+func (ex *connExecutor) beginTransactionTimestampsAndReadMode() (rwMode tree.ReadWriteMode, txnSQLTimestamp time.Time, historicalTimestamp *hlc.Timestamp, err error) {
+	return tree.ReadOnly, time.Time{}, nil, nil
 }
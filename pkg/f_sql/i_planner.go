@@ -2,6 +2,7 @@ package sql
 
 import (
 	"context"
+	"fmt"
 	"github.com/dborchard/tiny_crdb/pkg/e_security/username"
 	"github.com/dborchard/tiny_crdb/pkg/f_sql/c_catalog/descs"
 	"github.com/dborchard/tiny_crdb/pkg/f_sql/e_sem/eval"
@@ -45,6 +46,10 @@ type planner struct {
 	// is undefined at the beginning of the planning of each new statement, and cannot
 	// be reused for an old prepared statement after a new statement has been prepared.
 	curPlan planTop
+
+	// instrumentation collects the execution statistics of the current
+	// statement.
+	instrumentation instrumentationHelper
 }
 
 // internalPlannerParams encapsulates configurable planner fields. The defaults
@@ -87,7 +92,14 @@ func newInternalPlanner(
 	sd *sessiondata.SessionData,
 	opts ...InternalPlannerParamsOption,
 ) (*planner, func()) {
-	return nil, nil
+	p := &planner{txn: txn}
+	p.extendedEvalCtx = extendedEvalContext{
+		Context: eval.Context{
+			Planner: p,
+		},
+		ExecCfg: execCfg,
+	}
+	return p, func() {}
 }
 
 // extendedEvalContext extends eval.Context with fields that are needed for
@@ -181,23 +193,28 @@ func (p *planner) Txn() *kv.Txn {
 	return p.txn
 }
 
-// makeOptimizerPlan generates a plan using the cost-based optimizer.
-// On success, it populates p.curPlan.
+// makeOptimizerPlan generates a plan for the statement, and populates
+// p.curPlan. There is no cost-based optimizer yet: the plan is built from the
+// AST of the statement.
 func (p *planner) makeOptimizerPlan(ctx context.Context) error {
+	plan, err := p.newPlan(ctx, p.stmt.AST)
+	if err != nil {
+		return err
+	}
+	p.curPlan.main.planNode = plan
 	return nil
-	//opc := &p.optPlanningCtx
-
-	// If we got here, we did not create a plan above.
-	//return opc.runExecBuilder(
-	//	ctx,
-	//	&p.curPlan,
-	//	&p.stmt,
-	//	newExecFactory(ctx, p),
-	//	execMemo,
-	//	p.SemaCtx(),
-	//	p.EvalContext(),
-	//	p.autoCommit,
-	//)
+}
+
+// newPlan constructs a planNode from a statement.
+func (p *planner) newPlan(ctx context.Context, stmt tree.Statement) (planNode, error) {
+	switch n := stmt.(type) {
+	case *tree.Select:
+		return p.Select(ctx, n)
+	case *tree.ExplainAnalyze:
+		return p.newPlan(ctx, n.Statement)
+	default:
+		return nil, fmt.Errorf("unimplemented: statement %T", stmt)
+	}
 }
 
 func (p *planner) ExtendedEvalContext() *extendedEvalContext {
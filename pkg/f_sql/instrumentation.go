@@ -0,0 +1,93 @@
+package sql
+
+import (
+	"fmt"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/appstatspb"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/contention"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/row"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/uuid"
+	"time"
+)
+
+// contentionReader is implemented by the components of a plan which read
+// from KV, and report the waits of their requests on the locks of other
+// transactions.
+type contentionReader interface {
+	GetContentionTime() time.Duration
+	GetContentionEvents() []kvpb.ContentionEvent
+}
+
+var _ contentionReader = &row.KVFetcher{}
+
+// instrumentationHelper collects the execution statistics of a statement,
+// which EXPLAIN ANALYZE reports. Once the statement finishes, the contention
+// events that it ran into are added to the contention registry.
+type instrumentationHelper struct {
+	// txnID is the transaction of the statement.
+	txnID uuid.UUID
+	// fingerprintID is the fingerprint of the statement.
+	fingerprintID appstatspb.StmtFingerprintID
+
+	startTime time.Time
+
+	contentionTime   time.Duration
+	contentionEvents []kvpb.ContentionEvent
+}
+
+// Setup prepares the helper for the execution of a statement.
+func (ih *instrumentationHelper) Setup(
+	txnID uuid.UUID, fingerprintID appstatspb.StmtFingerprintID,
+) {
+	*ih = instrumentationHelper{
+		txnID:         txnID,
+		fingerprintID: fingerprintID,
+		startTime:     time.Now(),
+	}
+}
+
+// RecordKVReads records the contention of a component of the plan once it
+// has finished reading.
+func (ih *instrumentationHelper) RecordKVReads(r contentionReader) {
+	ih.contentionTime += r.GetContentionTime()
+	ih.contentionEvents = append(ih.contentionEvents, r.GetContentionEvents()...)
+}
+
+// Finish is called when the statement finishes. It adds the contention events
+// of the statement to the registry, if any.
+func (ih *instrumentationHelper) Finish(registry *contention.Registry) {
+	if registry == nil {
+		return
+	}
+	now := time.Now()
+	for _, ev := range ih.contentionEvents {
+		registry.AddContentionEvent(contention.ExtendedContentionEvent{
+			BlockingEvent:            ev,
+			WaitingTxnID:             ih.txnID,
+			WaitingStmtFingerprintID: ih.fingerprintID,
+			CollectionTs:             now,
+		})
+	}
+}
+
+// explainAnalyzeInfo returns the lines of statistics at the top of the
+// output of EXPLAIN ANALYZE, once the plan of the statement has run. The
+// waits on the locks of other transactions are listed after their cumulative
+// time.
+func (ih *instrumentationHelper) explainAnalyzeInfo() []string {
+	info := []string{
+		fmt.Sprintf("execution time: %s", formatDuration(time.Since(ih.startTime))),
+		fmt.Sprintf("cumulative time spent due to contention: %s", formatDuration(ih.contentionTime)),
+	}
+	for _, ev := range ih.contentionEvents {
+		info = append(info, fmt.Sprintf("  contention on key %s with txn %s: %s",
+			ev.Key, ev.TxnMeta.ID, formatDuration(ev.Duration)))
+	}
+	return info
+}
+
+// formatDuration formats a duration of the output of EXPLAIN ANALYZE, down
+// to the microsecond.
+func formatDuration(d time.Duration) string {
+	return d.Round(time.Microsecond).String()
+}
@@ -0,0 +1,93 @@
+package sql
+
+import (
+	"context"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/appstatspb"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/contention"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/e_sem/catconstants"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/e_sem/tree"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/row"
+	kv "github.com/dborchard/tiny_crdb/pkg/g_kv"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/concurrency"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/dborchard/tiny_crdb/pkg/z_testutils/testcluster"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestContentionEvents verifies that a statement which waits on the lock of
+// another transaction records a contention event, which EXPLAIN ANALYZE
+// reports and crdb_internal.transaction_contention_events exposes, along
+// with the fingerprints of both transactions.
+func TestContentionEvents(t *testing.T) {
+	// The waiting statement must not push the blocking transaction, which
+	// commits instead.
+	defer func(prev time.Duration) {
+		concurrency.LockTableDeadlockDetectionPushDelay = prev
+	}(concurrency.LockTableDeadlockDetectionPushDelay)
+	concurrency.LockTableDeadlockDetectionPushDelay = time.Minute
+
+	ctx := context.Background()
+	tc := testcluster.StartTestCluster(t, 1)
+	db := tc.Server(0).DB()
+	execCfg := &ExecutorConfig{
+		DB:                 db,
+		ContentionRegistry: contention.NewRegistry(contention.Config{}),
+	}
+
+	key := roachpb.Key("a")
+	blocking := kv.NewTxn(ctx, db)
+	require.NoError(t, blocking.Put(ctx, key, "v"))
+
+	// A statement of another transaction scans the key, and waits on the
+	// intent of the blocking transaction.
+	waiting := kv.NewTxn(ctx, db)
+	const stmtFingerprintID = appstatspb.StmtFingerprintID(7)
+	var ih instrumentationHelper
+	ih.Setup(waiting.TestingCloneTxn().ID, stmtFingerprintID)
+	f := row.NewKVFetcher(waiting, tree.ForNone, tree.LockWaitBlock, 0 /* batchKeyLimit */)
+	f.SetupNextFetch([]roachpb.Span{{Key: key, EndKey: key.PrefixEnd()}})
+	errCh := make(chan error, 1)
+	go func() {
+		_, _, err := f.NextBatch(ctx)
+		errCh <- err
+	}()
+	const wait = 50 * time.Millisecond
+	time.Sleep(wait)
+	require.NoError(t, blocking.Commit(ctx))
+	require.NoError(t, <-errCh)
+	ih.RecordKVReads(f)
+	ih.Finish(execCfg.ContentionRegistry)
+	require.NoError(t, waiting.Commit(ctx))
+	require.GreaterOrEqual(t, f.GetContentionTime(), wait)
+
+	info := ih.explainAnalyzeInfo()
+	require.Len(t, info, 3)
+	require.True(t, strings.HasPrefix(info[1], "cumulative time spent due to contention: "), info[1])
+	require.Contains(t, info[2], blocking.TestingCloneTxn().ID.String())
+
+	// Both transactions have finished: their fingerprints are known.
+	const blockingTxnFingerprintID, waitingTxnFingerprintID = 1, 2
+	execCfg.ContentionRegistry.RecordTxnFingerprint(blocking.TestingCloneTxn().ID, blockingTxnFingerprintID)
+	execCfg.ContentionRegistry.RecordTxnFingerprint(waiting.TestingCloneTxn().ID, waitingTxnFingerprintID)
+
+	cols, rows, err := ReadVirtualTable(ctx, execCfg, catconstants.CRDBInternalSchemaName, "transaction_contention_events")
+	require.NoError(t, err)
+	require.Len(t, rows, 1)
+	got := make(map[string]tree.Datum, len(cols))
+	for i, col := range cols {
+		got[col.Name] = rows[0][i]
+	}
+	require.Equal(t, blocking.TestingCloneTxn().ID.String(), string(*got["blocking_txn_id"].(*tree.DString)))
+	require.Equal(t, encodeFingerprintID(blockingTxnFingerprintID), got["blocking_txn_fingerprint_id"])
+	require.Equal(t, waiting.TestingCloneTxn().ID.String(), string(*got["waiting_txn_id"].(*tree.DString)))
+	require.Equal(t, encodeFingerprintID(waitingTxnFingerprintID), got["waiting_txn_fingerprint_id"])
+	require.Equal(t, encodeFingerprintID(uint64(stmtFingerprintID)), got["waiting_stmt_fingerprint_id"])
+	require.GreaterOrEqual(t, got["contention_duration"].(*tree.DInterval).Duration, wait)
+	require.Equal(t, tree.DBytes(key), *got["contending_key"].(*tree.DBytes))
+
+	_, _, err = ReadVirtualTable(ctx, execCfg, catconstants.CRDBInternalSchemaName, "missing")
+	require.Error(t, err)
+}
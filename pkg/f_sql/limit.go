@@ -0,0 +1,56 @@
+package sql
+
+import (
+	"context"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/e_sem/tree"
+)
+
+// limitNode represents a node that limits the number of rows
+// returned or only return them past a given number (offset).
+type limitNode struct {
+	plan planNode
+	// count is the maximum number of rows returned, or -1 if there is no
+	// limit.
+	count  int64
+	offset int64
+
+	// returned is the number of rows returned so far.
+	returned int64
+}
+
+func (n *limitNode) startExec(params runParams) error {
+	if err := n.plan.startExec(params); err != nil {
+		return err
+	}
+	for ; n.offset > 0; n.offset-- {
+		ok, err := n.plan.Next(params)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			// There are fewer rows than the offset.
+			n.count = 0
+			return nil
+		}
+	}
+	return nil
+}
+
+func (n *limitNode) Next(params runParams) (bool, error) {
+	if n.count >= 0 && n.returned >= n.count {
+		return false, nil
+	}
+	ok, err := n.plan.Next(params)
+	if ok {
+		n.returned++
+	}
+	return ok, err
+}
+
+func (n *limitNode) Values() tree.Datums {
+	return n.plan.Values()
+}
+
+func (n *limitNode) Close(ctx context.Context) {
+	n.plan.Close(ctx)
+}
@@ -1,4 +1,317 @@
+// Package replicaoracle provides functionality for physicalplan to choose a
+// replica for a range.
 package replicaoracle
 
+import (
+	"context"
+	"errors"
+	"fmt"
+	kv "github.com/dborchard/tiny_crdb/pkg/g_kv"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvclient"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// Policy determines how an Oracle should select a replica.
+type Policy byte
+
+var (
+	// RandomChoice chooses lease replicas randomly.
+	RandomChoice = RegisterPolicy(newRandomOracle)
+	// BinPackingChoice gives preference to the leaseholder if known, and
+	// otherwise bin-packs the ranges of a query on as few nodes as possible,
+	// choosing the closest replicas to break the ties.
+	BinPackingChoice = RegisterPolicy(newBinPackingOracle)
+	// LeaseholderChoice chooses the leaseholder if known, and otherwise the
+	// closest replica.
+	LeaseholderChoice = RegisterPolicy(newLeaseholderOracle)
+	// ClosestChoice chooses the replica closest to the gateway node: the
+	// replica on the node itself, or else that of the node with the lowest
+	// latency, or else that of the node whose locality shares the most tiers
+	// with the gateway's. It suits the reads which any replica serves, such
+	// as follower reads.
+	ClosestChoice = RegisterPolicy(newClosestOracle)
+)
+
+// LatencyFunc returns the latency from the gateway node to the node, if it
+// is known.
+type LatencyFunc func(roachpb.NodeID) (time.Duration, bool)
+
+// Config is used to construct an Oracle.
+type Config struct {
+	// NodeDescs is used to look up the localities of the nodes. It is
+	// optional.
+	NodeDescs kvclient.NodeDescStore
+	// NodeID is the ID of the gateway node.
+	NodeID roachpb.NodeID
+	// Locality is the locality of the gateway node.
+	Locality roachpb.Locality
+	// LatencyFunc returns the latencies to the other nodes. It is optional.
+	LatencyFunc LatencyFunc
+}
+
+// Oracle is used to choose the replica of a range to which the requests of a
+// query are planned. An Oracle can only be used for a single query.
 type Oracle interface {
+	// ChoosePreferredReplica returns a choice for one range. Implementors
+	// are free to use the queryState param, which has info about the number
+	// of ranges already handled by each node for the current SQL query. The
+	// state is not updated with the result of this method; the caller is in
+	// charge of that.
+	//
+	// The leaseholder is the replica which holds the lease of the range, if
+	// known, and is nil otherwise.
+	ChoosePreferredReplica(
+		ctx context.Context,
+		txn *kv.Txn,
+		rng *roachpb.RangeDescriptor,
+		leaseholder *roachpb.ReplicaDescriptor,
+		queryState QueryState,
+	) (roachpb.ReplicaDescriptor, error)
+}
+
+// OracleFactory creates an Oracle from a Config.
+type OracleFactory func(Config) Oracle
+
+// oracleFactories are the registered factories, indexed by their Policy.
+var oracleFactories []OracleFactory
+
+// RegisterPolicy registers an OracleFactory and returns the Policy which
+// selects it.
+func RegisterPolicy(f OracleFactory) Policy {
+	if len(oracleFactories) == 255 {
+		panic("Can only register 255 Policy instances")
+	}
+	oracleFactories = append(oracleFactories, f)
+	return Policy(len(oracleFactories) - 1)
+}
+
+// NewOracle creates an oracle with the given policy.
+func NewOracle(policy Policy, cfg Config) Oracle {
+	if int(policy) >= len(oracleFactories) {
+		panic(fmt.Sprintf("unknown Policy %v", policy))
+	}
+	return oracleFactories[policy](cfg)
+}
+
+// QueryState encapsulates the history of assignments of ranges to nodes
+// done by an oracle on behalf of one particular query.
+type QueryState struct {
+	RangesPerNode  map[roachpb.NodeID]int
+	AssignedRanges map[roachpb.RangeID]roachpb.ReplicaDescriptor
+}
+
+// MakeQueryState creates an initialized QueryState.
+func MakeQueryState() QueryState {
+	return QueryState{
+		RangesPerNode:  make(map[roachpb.NodeID]int),
+		AssignedRanges: make(map[roachpb.RangeID]roachpb.ReplicaDescriptor),
+	}
+}
+
+// errNoReplicas is returned for a range without replicas.
+var errNoReplicas = errors.New("range has no replicas")
+
+// randomOracle is an Oracle that chooses the lease holder randomly among the
+// replicas of a range.
+type randomOracle struct{}
+
+func newRandomOracle(Config) Oracle {
+	return &randomOracle{}
+}
+
+// ChoosePreferredReplica implements the Oracle interface.
+func (o *randomOracle) ChoosePreferredReplica(
+	_ context.Context,
+	_ *kv.Txn,
+	rng *roachpb.RangeDescriptor,
+	_ *roachpb.ReplicaDescriptor,
+	_ QueryState,
+) (roachpb.ReplicaDescriptor, error) {
+	replicas := rng.Replicas()
+	if len(replicas) == 0 {
+		return roachpb.ReplicaDescriptor{}, errNoReplicas
+	}
+	return replicas[rand.Intn(len(replicas))], nil
+}
+
+// closestOracle chooses the replica closest to the gateway node.
+type closestOracle struct {
+	closeness closeness
+}
+
+func newClosestOracle(cfg Config) Oracle {
+	return &closestOracle{closeness: makeCloseness(cfg)}
+}
+
+// ChoosePreferredReplica implements the Oracle interface.
+func (o *closestOracle) ChoosePreferredReplica(
+	_ context.Context,
+	_ *kv.Txn,
+	rng *roachpb.RangeDescriptor,
+	_ *roachpb.ReplicaDescriptor,
+	_ QueryState,
+) (roachpb.ReplicaDescriptor, error) {
+	replicas, err := o.closeness.sortedReplicas(rng)
+	if err != nil {
+		return roachpb.ReplicaDescriptor{}, err
+	}
+	return replicas[0], nil
+}
+
+// maxPreferredRangesPerLeaseHolder applies to the binPackingOracle. When
+// choosing lease holders, we try to choose the same node for all the ranges
+// applicable, until we hit this limit. The rationale is that maybe a bunch of
+// those ranges don't have an active lease, so our choice is going to be
+// self-fulfilling. If so, we want to collocate the lease holders. But above
+// some limit, we prefer to take the parallelism and distribute to multiple
+// nodes. The actual number used is based on nothing.
+const maxPreferredRangesPerLeaseHolder = 10
+
+// binPackingOracle coalesces choices together, so it gives preference to
+// replicas on nodes that are already assumed to be lease holders for some
+// other ranges that are going to be part of a single query. Secondarily, it
+// gives preference to replicas that are "close" to the current node. Finally,
+// it tries not to overload any node.
+type binPackingOracle struct {
+	maxPreferredRangesPerLeaseHolder int
+	closeness                        closeness
+}
+
+func newBinPackingOracle(cfg Config) Oracle {
+	return &binPackingOracle{
+		maxPreferredRangesPerLeaseHolder: maxPreferredRangesPerLeaseHolder,
+		closeness:                        makeCloseness(cfg),
+	}
+}
+
+// ChoosePreferredReplica implements the Oracle interface.
+func (o *binPackingOracle) ChoosePreferredReplica(
+	_ context.Context,
+	_ *kv.Txn,
+	rng *roachpb.RangeDescriptor,
+	leaseholder *roachpb.ReplicaDescriptor,
+	queryState QueryState,
+) (roachpb.ReplicaDescriptor, error) {
+	if leaseholder != nil {
+		return *leaseholder, nil
+	}
+	replicas, err := o.closeness.sortedReplicas(rng)
+	if err != nil {
+		return roachpb.ReplicaDescriptor{}, err
+	}
+
+	// Look for a replica that has been assigned some ranges, but it's not yet
+	// full.
+	minLoad := math.MaxInt32
+	var leastLoadedIdx int
+	for i, repl := range replicas {
+		assignedRanges := queryState.RangesPerNode[repl.NodeID]
+		if assignedRanges != 0 && assignedRanges < o.maxPreferredRangesPerLeaseHolder {
+			return repl, nil
+		}
+		if assignedRanges < minLoad {
+			leastLoadedIdx = i
+			minLoad = assignedRanges
+		}
+	}
+	// Either no replica was assigned any previous ranges, or all replicas are
+	// full. Use the least-loaded one (if all the load is 0, then the closest
+	// replica is returned).
+	return replicas[leastLoadedIdx], nil
+}
+
+// leaseholderOracle chooses the leaseholder of a range if it is known, and
+// otherwise its closest replica.
+type leaseholderOracle struct {
+	closeness closeness
+}
+
+func newLeaseholderOracle(cfg Config) Oracle {
+	return &leaseholderOracle{closeness: makeCloseness(cfg)}
+}
+
+// ChoosePreferredReplica implements the Oracle interface.
+func (o *leaseholderOracle) ChoosePreferredReplica(
+	_ context.Context,
+	_ *kv.Txn,
+	rng *roachpb.RangeDescriptor,
+	leaseholder *roachpb.ReplicaDescriptor,
+	_ QueryState,
+) (roachpb.ReplicaDescriptor, error) {
+	if leaseholder != nil {
+		return *leaseholder, nil
+	}
+	replicas, err := o.closeness.sortedReplicas(rng)
+	if err != nil {
+		return roachpb.ReplicaDescriptor{}, err
+	}
+	return replicas[0], nil
+}
+
+// closeness orders the replicas of a range by their closeness to the gateway
+// node.
+type closeness struct {
+	nodeDescs   kvclient.NodeDescStore
+	nodeID      roachpb.NodeID
+	locality    roachpb.Locality
+	latencyFunc LatencyFunc
+}
+
+func makeCloseness(cfg Config) closeness {
+	return closeness{
+		nodeDescs:   cfg.NodeDescs,
+		nodeID:      cfg.NodeID,
+		locality:    cfg.Locality,
+		latencyFunc: cfg.LatencyFunc,
+	}
+}
+
+// sortedReplicas returns the replicas of the range, closest first. The
+// replica on the gateway node comes first, followed by those of the nodes
+// with known latencies, the lowest first, and then by those of the nodes
+// whose locality shares the most tiers with the gateway's. Ties keep the
+// order of the range's descriptor.
+func (c closeness) sortedReplicas(rng *roachpb.RangeDescriptor) ([]roachpb.ReplicaDescriptor, error) {
+	if len(rng.Replicas()) == 0 {
+		return nil, errNoReplicas
+	}
+	replicas := append([]roachpb.ReplicaDescriptor(nil), rng.Replicas()...)
+	sort.SliceStable(replicas, func(i, j int) bool {
+		a, b := replicas[i].NodeID, replicas[j].NodeID
+		if a == b {
+			return false
+		}
+		if c.nodeID != 0 && (a == c.nodeID || b == c.nodeID) {
+			return a == c.nodeID
+		}
+		if c.latencyFunc != nil {
+			latencyA, okA := c.latencyFunc(a)
+			latencyB, okB := c.latencyFunc(b)
+			if okA && okB {
+				return latencyA < latencyB
+			}
+			if okA != okB {
+				return okA
+			}
+		}
+		return c.sharedLocality(a) > c.sharedLocality(b)
+	})
+	return replicas, nil
+}
+
+// sharedLocality returns the number of locality tiers that the node shares
+// with the gateway node, or 0 if its locality is unknown.
+func (c closeness) sharedLocality(nodeID roachpb.NodeID) int {
+	if c.nodeDescs == nil {
+		return 0
+	}
+	desc, err := c.nodeDescs.GetNodeDescriptor(nodeID)
+	if err != nil {
+		return 0
+	}
+	return c.locality.SharedPrefix(desc.Locality)
 }
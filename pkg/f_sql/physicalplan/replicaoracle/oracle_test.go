@@ -0,0 +1,128 @@
+package replicaoracle
+
+import (
+	"context"
+	"fmt"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+// testNodeDescs is a kvclient.NodeDescStore of the node descriptors.
+type testNodeDescs map[roachpb.NodeID]*roachpb.NodeDescriptor
+
+func (s testNodeDescs) GetNodeDescriptor(nodeID roachpb.NodeID) (*roachpb.NodeDescriptor, error) {
+	if desc, ok := s[nodeID]; ok {
+		return desc, nil
+	}
+	return nil, fmt.Errorf("node n%d not found", nodeID)
+}
+
+// makeDesc returns the descriptor of a range with replicas on the nodes.
+func makeDesc(rangeID roachpb.RangeID, nodeIDs ...roachpb.NodeID) *roachpb.RangeDescriptor {
+	desc := &roachpb.RangeDescriptor{RangeID: rangeID}
+	for i, nodeID := range nodeIDs {
+		desc.InternalReplicas = append(desc.InternalReplicas, roachpb.ReplicaDescriptor{
+			NodeID: nodeID, StoreID: roachpb.StoreID(nodeID), ReplicaID: roachpb.ReplicaID(i + 1),
+		})
+	}
+	return desc
+}
+
+func TestClosest(t *testing.T) {
+	ctx := context.Background()
+	desc := makeDesc(1, 1, 2, 3)
+	leaseholder := &desc.InternalReplicas[0]
+	choose := func(cfg Config) roachpb.NodeID {
+		o := NewOracle(ClosestChoice, cfg)
+		repl, err := o.ChoosePreferredReplica(ctx, nil, desc, leaseholder, MakeQueryState())
+		require.NoError(t, err)
+		return repl.NodeID
+	}
+
+	// The replica of the gateway node is the closest.
+	require.Equal(t, roachpb.NodeID(2), choose(Config{NodeID: 2}))
+
+	// Otherwise, the node with the lowest known latency is chosen.
+	latencies := map[roachpb.NodeID]time.Duration{1: 20 * time.Millisecond, 3: 5 * time.Millisecond}
+	latencyFunc := func(nodeID roachpb.NodeID) (time.Duration, bool) {
+		l, ok := latencies[nodeID]
+		return l, ok
+	}
+	require.Equal(t, roachpb.NodeID(3), choose(Config{NodeID: 4, LatencyFunc: latencyFunc}))
+
+	// Without latencies, the replica of the node sharing the most locality
+	// tiers with the gateway is chosen.
+	locality := func(region, zone string) roachpb.Locality {
+		return roachpb.Locality{Tiers: []roachpb.Tier{{Key: "region", Value: region}, {Key: "zone", Value: zone}}}
+	}
+	nodeDescs := testNodeDescs{
+		1: {NodeID: 1, Locality: locality("us", "a")},
+		2: {NodeID: 2, Locality: locality("eu", "a")},
+		3: {NodeID: 3, Locality: locality("eu", "b")},
+	}
+	require.Equal(t, roachpb.NodeID(3), choose(Config{
+		NodeDescs: nodeDescs, NodeID: 4, Locality: locality("eu", "b"),
+	}))
+	require.Equal(t, roachpb.NodeID(2), choose(Config{
+		NodeDescs: nodeDescs, NodeID: 4, Locality: locality("eu", "c"),
+	}))
+
+	// Otherwise, the first replica is chosen.
+	require.Equal(t, roachpb.NodeID(1), choose(Config{NodeID: 4}))
+
+	_, err := NewOracle(ClosestChoice, Config{}).ChoosePreferredReplica(
+		ctx, nil, &roachpb.RangeDescriptor{}, nil, MakeQueryState())
+	require.Error(t, err)
+}
+
+func TestLeaseholderAndBinPacking(t *testing.T) {
+	ctx := context.Background()
+	cfg := Config{NodeID: 3}
+	desc := makeDesc(1, 1, 2, 3)
+	leaseholder := &desc.InternalReplicas[1]
+
+	for _, policy := range []Policy{LeaseholderChoice, BinPackingChoice} {
+		o := NewOracle(policy, cfg)
+		repl, err := o.ChoosePreferredReplica(ctx, nil, desc, leaseholder, MakeQueryState())
+		require.NoError(t, err)
+		require.Equal(t, *leaseholder, repl)
+
+		// Without a known leaseholder, the closest replica is chosen.
+		repl, err = o.ChoosePreferredReplica(ctx, nil, desc, nil, MakeQueryState())
+		require.NoError(t, err)
+		require.Equal(t, roachpb.NodeID(3), repl.NodeID)
+	}
+
+	// The bin-packing oracle prefers the nodes already assigned some ranges,
+	// until they are full.
+	o := NewOracle(BinPackingChoice, cfg)
+	qs := MakeQueryState()
+	qs.RangesPerNode[2] = 1
+	repl, err := o.ChoosePreferredReplica(ctx, nil, desc, nil, qs)
+	require.NoError(t, err)
+	require.Equal(t, roachpb.NodeID(2), repl.NodeID)
+
+	qs.RangesPerNode[2] = maxPreferredRangesPerLeaseHolder
+	qs.RangesPerNode[3] = maxPreferredRangesPerLeaseHolder
+	repl, err = o.ChoosePreferredReplica(ctx, nil, desc, nil, qs)
+	require.NoError(t, err)
+	require.Equal(t, roachpb.NodeID(1), repl.NodeID)
+}
+
+func TestRandom(t *testing.T) {
+	ctx := context.Background()
+	desc := makeDesc(1, 1, 2, 3)
+	o := NewOracle(RandomChoice, Config{})
+	seen := make(map[roachpb.NodeID]bool)
+	for i := 0; i < 100; i++ {
+		repl, err := o.ChoosePreferredReplica(ctx, nil, desc, nil, MakeQueryState())
+		require.NoError(t, err)
+		seen[repl.NodeID] = true
+	}
+	require.Len(t, seen, 3)
+
+	_, err := o.ChoosePreferredReplica(ctx, nil, &roachpb.RangeDescriptor{}, nil, MakeQueryState())
+	require.Error(t, err)
+}
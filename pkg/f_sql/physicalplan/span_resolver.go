@@ -1,8 +1,222 @@
 package physicalplan
 
-import "github.com/dborchard/tiny_crdb/pkg/f_sql/physicalplan/replicaoracle"
+import (
+	"context"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/physicalplan/replicaoracle"
+	keys "github.com/dborchard/tiny_crdb/pkg/g_keys"
+	kv "github.com/dborchard/tiny_crdb/pkg/g_kv"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvclient/rangecache"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+)
+
+// SpanResolver resolves key spans to their respective ranges and lease holders.
+// Used for planning physical execution of distributed SQL queries.
+//
+// Sample usage for resolving a bunch of spans:
+//
+//	func resolveSpans(
+//	  ctx context.Context,
+//	  it SpanResolverIterator,
+//	  spans ...roachpb.Span,
+//	) ([][]roachpb.ReplicaDescriptor, error) {
+//	  lr := make([][]roachpb.ReplicaDescriptor, 0, len(spans))
+//	  for _, span := range spans {
+//	    it.Seek(ctx, span)
+//	    var replicas []roachpb.ReplicaDescriptor
+//	    for ; ; it.Next(ctx) {
+//	      if !it.Valid() {
+//	        return nil, it.Error()
+//	      }
+//	      repl, err := it.ReplicaInfo(ctx)
+//	      if err != nil {
+//	        return nil, err
+//	      }
+//	      replicas = append(replicas, repl)
+//	      if !it.NeedAnother() {
+//	        break
+//	      }
+//	    }
+//	    lr = append(lr, replicas)
+//	  }
+//	  return lr, nil
+//	}
+type SpanResolver interface {
+	// NewSpanResolverIterator creates a new SpanResolverIterator for a
+	// query of the txn, which is passed to the oracle. The optionalOracle, if not nil, is used to choose the replicas instead
+	// of an oracle of the resolver's default policy.
+	NewSpanResolverIterator(txn *kv.Txn, optionalOracle replicaoracle.Oracle) SpanResolverIterator
+}
+
+// SpanResolverIterator is used to iterate over the ranges composing a key
+// span, in ascending key order.
+type SpanResolverIterator interface {
+	// Seek positions the iterator on the start of a span (span.Key). The
+	// iterator is valid if it could find the range containing the key, and
+	// otherwise Error() reports why.
+	//
+	// A span with an empty EndKey is a single key.
+	Seek(ctx context.Context, span roachpb.Span)
+
+	// NeedAnother returns true if the current range is not the last for the
+	// span that was last Seek()ed.
+	NeedAnother() bool
+
+	// Next advances the iterator to the next range. The next range contains
+	// the last range's end key (but it does not necessarily start there,
+	// because of asynchronous range splits and caching effects).
+	// Possible errors encountered should be checked for with Valid().
+	Next(ctx context.Context)
+
+	// Valid returns false if an error was encountered by the last Seek() or
+	// Next().
+	Valid() bool
+
+	// Error returns any error encountered by the last Seek() or Next().
+	Error() error
+
+	// Desc returns the current RangeDescriptor.
+	Desc() roachpb.RangeDescriptor
+
+	// ReplicaInfo returns the replica chosen by the oracle for the current
+	// range, and records the choice in the state of the query, which the
+	// oracle considers for the next ranges.
+	ReplicaInfo(ctx context.Context) (roachpb.ReplicaDescriptor, error)
+}
 
 // DefaultReplicaChooser is a nil replicaoracle.Oracle which can be passed in
 // place of a replica oracle to some APIs to indicate they can use their default
 // replica oracle.
 var DefaultReplicaChooser replicaoracle.Oracle
+
+// spanResolver implements SpanResolver.
+type spanResolver struct {
+	rangeCache    *rangecache.RangeCache
+	oracleCfg     replicaoracle.Config
+	defaultPolicy replicaoracle.Policy
+}
+
+var _ SpanResolver = &spanResolver{}
+
+// NewSpanResolver creates a new SpanResolver, which looks up the ranges in
+// the range cache, and chooses their replicas with an oracle of the default
+// policy unless the iterators are passed another oracle.
+func NewSpanResolver(
+	rangeCache *rangecache.RangeCache,
+	oracleCfg replicaoracle.Config,
+	defaultPolicy replicaoracle.Policy,
+) SpanResolver {
+	return &spanResolver{
+		rangeCache:    rangeCache,
+		oracleCfg:     oracleCfg,
+		defaultPolicy: defaultPolicy,
+	}
+}
+
+// spanResolverIterator implements the SpanResolverIterator interface.
+type spanResolverIterator struct {
+	// txn is the transaction using the iterator.
+	txn *kv.Txn
+	// rangeCache is used to look up the ranges.
+	rangeCache *rangecache.RangeCache
+	// oracle is used to choose the replicas of the ranges.
+	oracle replicaoracle.Oracle
+	// queryState accumulates the choices of the oracle for the query.
+	queryState replicaoracle.QueryState
+
+	// curSpan is the span last Seek()ed, in addressable keys.
+	curSpan roachpb.RSpan
+	// desc is the current range.
+	desc *roachpb.RangeDescriptor
+	// err is the error encountered by the last Seek() or Next(), if any.
+	err error
+}
+
+var _ SpanResolverIterator = &spanResolverIterator{}
+
+// NewSpanResolverIterator creates a new SpanResolverIterator.
+func (sr *spanResolver) NewSpanResolverIterator(
+	txn *kv.Txn, optionalOracle replicaoracle.Oracle,
+) SpanResolverIterator {
+	oracle := optionalOracle
+	if oracle == nil {
+		oracle = replicaoracle.NewOracle(sr.defaultPolicy, sr.oracleCfg)
+	}
+	return &spanResolverIterator{
+		txn:        txn,
+		rangeCache: sr.rangeCache,
+		oracle:     oracle,
+		queryState: replicaoracle.MakeQueryState(),
+	}
+}
+
+// Valid is part of the SpanResolverIterator interface.
+func (it *spanResolverIterator) Valid() bool {
+	return it.err == nil && it.desc != nil
+}
+
+// Error is part of the SpanResolverIterator interface.
+func (it *spanResolverIterator) Error() error {
+	return it.err
+}
+
+// Seek is part of the SpanResolverIterator interface.
+func (it *spanResolverIterator) Seek(ctx context.Context, span roachpb.Span) {
+	it.desc, it.err = nil, nil
+	key, err := keys.Addr(span.Key)
+	if err != nil {
+		it.err = err
+		return
+	}
+	endKey := key.Next()
+	if len(span.EndKey) != 0 {
+		if endKey, err = keys.AddrUpperBound(span.EndKey); err != nil {
+			it.err = err
+			return
+		}
+	}
+	it.curSpan = roachpb.RSpan{Key: key, EndKey: endKey}
+	it.desc, it.err = it.rangeCache.Lookup(ctx, key)
+}
+
+// NeedAnother is part of the SpanResolverIterator interface.
+func (it *spanResolverIterator) NeedAnother() bool {
+	return it.desc.EndKey.Less(it.curSpan.EndKey)
+}
+
+// Next is part of the SpanResolverIterator interface.
+func (it *spanResolverIterator) Next(ctx context.Context) {
+	if !it.Valid() {
+		panic(it.Error())
+	}
+	it.desc, it.err = it.rangeCache.Lookup(ctx, it.desc.EndKey)
+}
+
+// Desc is part of the SpanResolverIterator interface.
+func (it *spanResolverIterator) Desc() roachpb.RangeDescriptor {
+	return *it.desc
+}
+
+// ReplicaInfo is part of the SpanResolverIterator interface.
+func (it *spanResolverIterator) ReplicaInfo(ctx context.Context) (roachpb.ReplicaDescriptor, error) {
+	if !it.Valid() {
+		panic(it.Error())
+	}
+
+	// If we've assigned the range before, return that assignment.
+	rangeID := it.desc.RangeID
+	if repl, ok := it.queryState.AssignedRanges[rangeID]; ok {
+		return repl, nil
+	}
+
+	var leaseholder *roachpb.ReplicaDescriptor
+	if lh, ok := it.rangeCache.Leaseholder(it.desc.StartKey); ok {
+		leaseholder = &lh
+	}
+	repl, err := it.oracle.ChoosePreferredReplica(ctx, it.txn, it.desc, leaseholder, it.queryState)
+	if err != nil {
+		return roachpb.ReplicaDescriptor{}, err
+	}
+	it.queryState.RangesPerNode[repl.NodeID]++
+	it.queryState.AssignedRanges[rangeID] = repl
+	return repl, nil
+}
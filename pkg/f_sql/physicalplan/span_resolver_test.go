@@ -0,0 +1,65 @@
+package physicalplan_test
+
+import (
+	"context"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/physicalplan"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/physicalplan/replicaoracle"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/dborchard/tiny_crdb/pkg/z_testutils/testcluster"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+// TestSpanResolver verifies that the iterators of a SpanResolver visit the
+// ranges of the spans, and assign each range to the replica chosen by their
+// oracle.
+func TestSpanResolver(t *testing.T) {
+	ctx := context.Background()
+	tc := testcluster.StartTestCluster(t, 3)
+	db := tc.Server(0).DB()
+	require.NoError(t, db.AdminSplit(ctx, "c", hlc.Timestamp{}))
+	require.NoError(t, db.AdminSplit(ctx, "e", hlc.Timestamp{}))
+
+	resolve := func(it physicalplan.SpanResolverIterator, span roachpb.Span) (descs []roachpb.RangeDescriptor, replicas []roachpb.ReplicaDescriptor) {
+		for it.Seek(ctx, span); ; it.Next(ctx) {
+			require.True(t, it.Valid(), "%v", it.Error())
+			repl, err := it.ReplicaInfo(ctx)
+			require.NoError(t, err)
+			descs = append(descs, it.Desc())
+			replicas = append(replicas, repl)
+			if !it.NeedAnother() {
+				return descs, replicas
+			}
+		}
+	}
+
+	// The resolver plans on the cached descriptors, which may predate the
+	// splits.
+	rangeCache := tc.Server(1).DistSender().RangeDescriptorCache()
+	rangeCache.Clear()
+	sr := physicalplan.NewSpanResolver(
+		rangeCache, replicaoracle.Config{NodeID: 2}, replicaoracle.ClosestChoice)
+	it := sr.NewSpanResolverIterator(nil, physicalplan.DefaultReplicaChooser)
+	descs, replicas := resolve(it, roachpb.Span{Key: roachpb.Key("a"), EndKey: roachpb.Key("d")})
+	require.Len(t, descs, 2)
+	require.Equal(t, roachpb.RKey("c"), descs[0].EndKey)
+	require.Equal(t, roachpb.RKey("c"), descs[1].StartKey)
+	require.Equal(t, roachpb.RKey("e"), descs[1].EndKey)
+	for _, repl := range replicas {
+		require.Equal(t, roachpb.NodeID(2), repl.NodeID)
+	}
+
+	descs, _ = resolve(it, roachpb.Span{Key: roachpb.Key("f")})
+	require.Len(t, descs, 1)
+	require.Equal(t, roachpb.RKey("e"), descs[0].StartKey)
+
+	// The iterators use the oracle they are passed.
+	it = sr.NewSpanResolverIterator(nil, replicaoracle.NewOracle(
+		replicaoracle.ClosestChoice, replicaoracle.Config{NodeID: 3}))
+	_, replicas = resolve(it, roachpb.Span{Key: roachpb.Key("a"), EndKey: roachpb.Key("z")})
+	require.Len(t, replicas, 3)
+	for _, repl := range replicas {
+		require.Equal(t, roachpb.NodeID(3), repl.NodeID)
+	}
+}
@@ -17,8 +17,11 @@ type planTop struct {
 	main planMaybePhysical
 }
 
+// close ensures that the plan's resources have been deallocated.
 func (t *planTop) close(ctx context.Context) {
-
+	if t.main.planNode != nil {
+		t.main.planNode.Close(ctx)
+	}
 }
 
 // planMaybePhysical is a utility struct representing a plan. It can currently
@@ -0,0 +1,18 @@
+package sql
+
+import "github.com/dborchard/tiny_crdb/pkg/f_sql/c_catalog/colinfo"
+
+// planColumns returns the signature of rows logically computed
+// by the given planNode.
+func planColumns(plan planNode) colinfo.ResultColumns {
+	switch n := plan.(type) {
+	case *scanNode:
+		return n.resultColumns
+	case *limitNode:
+		return planColumns(n.plan)
+	case *valuesNode:
+		return n.columns
+	default:
+		return nil
+	}
+}
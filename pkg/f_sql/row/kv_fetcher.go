@@ -0,0 +1,109 @@
+package row
+
+import (
+	"context"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/e_sem/tree"
+	kv "github.com/dborchard/tiny_crdb/pkg/g_kv"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/concurrency/lock"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"time"
+)
+
+// KVFetcher fetches the key-value pairs in a set of spans within a
+// transaction, one batch of ScanRequests at a time, resuming each scan where
+// the previous batch left off. The scans lock the keys that they return with
+// the row-level locking strength of the statement, and handle the locks held
+// by other transactions according to its wait policy: SKIP LOCKED scans skip
+// over the locked keys, and NOWAIT scans return an error instead of waiting.
+type KVFetcher struct {
+	txn *kv.Txn
+
+	// lockStrength represents the locking mode to use when fetching KVs.
+	lockStrength lock.Strength
+	// lockWaitPolicy represents the policy to be used for handling conflicting
+	// locks held by other active transactions.
+	lockWaitPolicy lock.WaitPolicy
+	// batchKeyLimit is the maximum number of keys fetched in a single batch.
+	// Zero means unbounded.
+	batchKeyLimit int64
+
+	// spans contains the spans that remain to be fetched.
+	spans []roachpb.Span
+
+	// contentionEvents are the events of the fetcher's requests waiting on
+	// the locks of other transactions, and contentionTime is their total
+	// duration.
+	contentionEvents []kvpb.ContentionEvent
+	contentionTime   time.Duration
+}
+
+// NewKVFetcher creates a new KVFetcher that fetches key-value pairs in the
+// provided transaction with the row-level locking of a locking clause.
+func NewKVFetcher(
+	txn *kv.Txn,
+	lockStrength tree.LockingStrength,
+	lockWaitPolicy tree.LockingWaitPolicy,
+	batchKeyLimit int64,
+) *KVFetcher {
+	return &KVFetcher{
+		txn:            txn,
+		lockStrength:   GetKeyLockingStrength(lockStrength),
+		lockWaitPolicy: GetWaitPolicy(lockWaitPolicy),
+		batchKeyLimit:  batchKeyLimit,
+	}
+}
+
+// SetupNextFetch prepares the fetcher to fetch the provided spans. The spans
+// must not be modified until they have been fetched.
+func (f *KVFetcher) SetupNextFetch(spans []roachpb.Span) {
+	f.spans = spans
+}
+
+// NextBatch returns the key-value pairs of the next batch. ok is false once
+// all of the spans have been fetched.
+func (f *KVFetcher) NextBatch(ctx context.Context) (ok bool, kvs []roachpb.KeyValue, err error) {
+	if len(f.spans) == 0 {
+		return false, nil, nil
+	}
+	b := f.txn.NewBatch()
+	b.Header.MaxSpanRequestKeys = f.batchKeyLimit
+	b.Header.WaitPolicy = f.lockWaitPolicy
+	for _, span := range f.spans {
+		b.AddRawRequest(&kvpb.ScanRequest{
+			RequestHeader:      kvpb.RequestHeaderFromSpan(span),
+			KeyLockingStrength: f.lockStrength,
+		})
+	}
+	if err := f.txn.Run(ctx, b); err != nil {
+		return false, nil, err
+	}
+
+	br := b.RawResponse()
+	for _, ev := range br.ContentionEvents {
+		f.contentionEvents = append(f.contentionEvents, ev)
+		f.contentionTime += ev.Duration
+	}
+	var resumeSpans []roachpb.Span
+	for _, ru := range br.Responses {
+		resp := ru.GetInner().(*kvpb.ScanResponse)
+		kvs = append(kvs, resp.Rows...)
+		if resp.ResumeSpan != nil {
+			resumeSpans = append(resumeSpans, *resp.ResumeSpan)
+		}
+	}
+	f.spans = resumeSpans
+	return true, kvs, nil
+}
+
+// GetContentionTime returns the amount of time that the fetcher's requests
+// spent waiting on the locks of other transactions.
+func (f *KVFetcher) GetContentionTime() time.Duration {
+	return f.contentionTime
+}
+
+// GetContentionEvents returns the events of the fetcher's requests waiting on
+// the locks of other transactions.
+func (f *KVFetcher) GetContentionEvents() []kvpb.ContentionEvent {
+	return f.contentionEvents
+}
@@ -0,0 +1,75 @@
+package row
+
+import (
+	"context"
+	parser "github.com/dborchard/tiny_crdb/pkg/f_sql/b_parser"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/e_sem/tree"
+	kv "github.com/dborchard/tiny_crdb/pkg/g_kv"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvclient/kvcoord"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/concurrency/lock"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/stop"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+// TestKVFetcherLockingClause verifies that the locking clause of a SELECT is
+// wired through to the ScanRequests issued by the KVFetcher.
+func TestKVFetcherLockingClause(t *testing.T) {
+	ctx := context.Background()
+	var sent []*kvpb.BatchRequest
+	sender := kv.SenderFunc(func(ctx context.Context, ba *kvpb.BatchRequest) (*kvpb.BatchResponse, *kvpb.Error) {
+		sent = append(sent, ba)
+		br := &kvpb.BatchResponse{}
+		br.Txn = ba.Txn
+		for _, ru := range ba.Requests {
+			resp := kvpb.CreateReply(ru.GetInner()).(*kvpb.ScanResponse)
+			resp.Rows = []roachpb.KeyValue{{Key: ru.GetInner().Header().Key}}
+			br.Add(resp)
+		}
+		return br, nil
+	})
+	clock := hlc.NewClock(hlc.UnixNano, time.Nanosecond)
+	factory := kvcoord.NewTxnCoordSenderFactory(kvcoord.TxnCoordSenderFactoryConfig{Clock: clock}, sender)
+	db := kv.NewDB(ctx, factory, clock, stop.NewStopper())
+
+	for _, tc := range []struct {
+		sql      string
+		table    tree.Name
+		strength lock.Strength
+		policy   lock.WaitPolicy
+	}{
+		{sql: "SELECT * FROM t", table: "t", strength: lock.None, policy: lock.Block},
+		{sql: "SELECT * FROM t FOR UPDATE", table: "t", strength: lock.Exclusive, policy: lock.Block},
+		{sql: "SELECT * FROM t FOR SHARE SKIP LOCKED", table: "t", strength: lock.Shared, policy: lock.SkipLocked},
+		{sql: "SELECT * FROM t FOR NO KEY UPDATE NOWAIT;", table: "t", strength: lock.Exclusive, policy: lock.Error},
+		{sql: "SELECT * FROM t, u FOR KEY SHARE OF t FOR UPDATE OF u", table: "t", strength: lock.Shared, policy: lock.Block},
+	} {
+		t.Run(tc.sql, func(t *testing.T) {
+			stmt, err := parser.ParseOne(tc.sql)
+			require.NoError(t, err)
+			locking := stmt.AST.(*tree.Select).Select.(*tree.SelectClause).Locking
+			str, wp := locking.ForTable(tc.table)
+
+			sent = nil
+			f := NewKVFetcher(kv.NewTxn(ctx, db), str, wp, 0 /* batchKeyLimit */)
+			f.SetupNextFetch([]roachpb.Span{{Key: roachpb.Key("a"), EndKey: roachpb.Key("b")}})
+			ok, kvs, err := f.NextBatch(ctx)
+			require.NoError(t, err)
+			require.True(t, ok)
+			require.Len(t, kvs, 1)
+			ok, _, err = f.NextBatch(ctx)
+			require.NoError(t, err)
+			require.False(t, ok)
+
+			require.Len(t, sent, 1)
+			require.Equal(t, tc.policy, sent[0].WaitPolicy)
+			scan := sent[0].Requests[0].GetInner().(*kvpb.ScanRequest)
+			require.Equal(t, tc.strength, scan.KeyLockingStrength)
+			require.Equal(t, tc.strength != lock.None, kvpb.IsLocking(scan))
+		})
+	}
+}
@@ -0,0 +1,51 @@
+// Package row contains the routines that fetch the rows of SQL tables from
+// the key-value layer.
+package row
+
+import (
+	"fmt"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/e_sem/tree"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/concurrency/lock"
+)
+
+// GetKeyLockingStrength returns the configured per-key locking strength to use
+// for key-value scans.
+func GetKeyLockingStrength(lockStrength tree.LockingStrength) lock.Strength {
+	switch lockStrength {
+	case tree.ForNone:
+		return lock.None
+
+	case tree.ForKeyShare, tree.ForShare:
+		// Shared locks are compatible with each other, so concurrent
+		// transactions locking the same rows for share do not block each
+		// other, but they block writers.
+		return lock.Shared
+
+	case tree.ForNoKeyUpdate, tree.ForUpdate:
+		// Both NO KEY UPDATE and UPDATE locks map to Exclusive locks: the
+		// key-value layer does not distinguish between updates to a row's
+		// key and to its other columns.
+		return lock.Exclusive
+
+	default:
+		panic(fmt.Sprintf("unknown locking strength %d", lockStrength))
+	}
+}
+
+// GetWaitPolicy returns the configured lock wait policy to use for key-value
+// scans.
+func GetWaitPolicy(lockWaitPolicy tree.LockingWaitPolicy) lock.WaitPolicy {
+	switch lockWaitPolicy {
+	case tree.LockWaitBlock:
+		return lock.Block
+
+	case tree.LockWaitSkipLocked:
+		return lock.SkipLocked
+
+	case tree.LockWaitError:
+		return lock.Error
+
+	default:
+		panic(fmt.Sprintf("unknown wait policy %d", lockWaitPolicy))
+	}
+}
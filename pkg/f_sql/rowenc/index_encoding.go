@@ -0,0 +1,177 @@
+// Package rowenc encodes the rows of SQL tables into the key-value pairs of
+// their primary index, and decodes them back.
+//
+// The key of a row is made of the table and index prefix, the encoded values
+// of its primary key columns and the suffix of its single column family. The
+// value of a row holds the values of its other columns which aren't NULL,
+// each preceded by its column ID.
+package rowenc
+
+import (
+	"fmt"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/c_catalog/descpb"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/e_sem/tree"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/types"
+	keys "github.com/dborchard/tiny_crdb/pkg/g_keys"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/encoding"
+)
+
+// MakeIndexKeyPrefix returns the key prefix used for the index's data.
+func MakeIndexKeyPrefix(desc *descpb.TableDescriptor, indexID descpb.IndexID) []byte {
+	return keys.MakeIndexPrefix(uint32(desc.ID), uint32(indexID))
+}
+
+// PrimaryIndexSpan returns the span of the keys of the table's primary index.
+func PrimaryIndexSpan(desc *descpb.TableDescriptor) roachpb.Span {
+	prefix := roachpb.Key(MakeIndexKeyPrefix(desc, desc.PrimaryIndex.ID))
+	return roachpb.Span{Key: prefix, EndKey: prefix.PrefixEnd()}
+}
+
+// makeFamilyKey appends the suffix of the single column family of the rows,
+// and the length of that suffix, to the key.
+func makeFamilyKey(key []byte) []byte {
+	size := len(key)
+	key = encoding.EncodeUvarintAscending(key, 0 /* familyID */)
+	return encoding.EncodeUvarintAscending(key, uint64(len(key)-size))
+}
+
+// EncodePrimaryIndex encodes the row of the table, whose datums are ordered
+// like the columns of the table, into the key and value of its primary index
+// entry. A nil datum is a NULL.
+func EncodePrimaryIndex(
+	desc *descpb.TableDescriptor, row tree.Datums,
+) (roachpb.Key, roachpb.Value, error) {
+	if len(row) != len(desc.Columns) {
+		return nil, roachpb.Value{}, fmt.Errorf(
+			"table %s has %d columns, got %d values", desc.Name, len(desc.Columns), len(row))
+	}
+	colIdx := desc.ColumnIdxMap()
+	key := MakeIndexKeyPrefix(desc, desc.PrimaryIndex.ID)
+	isKeyCol := make(map[descpb.ColumnID]bool, len(desc.PrimaryIndex.KeyColumnIDs))
+	for _, id := range desc.PrimaryIndex.KeyColumnIDs {
+		d := row[colIdx[id]]
+		if d == nil {
+			return nil, roachpb.Value{}, fmt.Errorf(
+				"null value in column %q violates not-null constraint", desc.Columns[colIdx[id]].Name)
+		}
+		var err error
+		if key, err = encodeTableKey(key, d); err != nil {
+			return nil, roachpb.Value{}, err
+		}
+		isKeyCol[id] = true
+	}
+	key = makeFamilyKey(key)
+
+	var val []byte
+	for i := range desc.Columns {
+		col := &desc.Columns[i]
+		if isKeyCol[col.ID] {
+			continue
+		}
+		if row[i] == nil {
+			if !col.Nullable {
+				return nil, roachpb.Value{}, fmt.Errorf(
+					"null value in column %q violates not-null constraint", col.Name)
+			}
+			continue
+		}
+		val = encoding.EncodeUvarintAscending(val, uint64(col.ID))
+		var err error
+		if val, err = encodeTableKey(val, row[i]); err != nil {
+			return nil, roachpb.Value{}, err
+		}
+	}
+	var v roachpb.Value
+	v.SetBytes(val)
+	return key, v, nil
+}
+
+// DecodePrimaryIndex decodes the primary index entry of a row of the table
+// into its datums, ordered like the columns of the table. The value of a
+// deleted row is empty: only the primary key columns of the row are decoded,
+// and deleted is true.
+func DecodePrimaryIndex(
+	desc *descpb.TableDescriptor, key roachpb.Key, value roachpb.Value,
+) (row tree.Datums, deleted bool, err error) {
+	rem, tableID, indexID, err := keys.DecodeIndexPrefix(key)
+	if err != nil {
+		return nil, false, err
+	}
+	if descpb.ID(tableID) != desc.ID || descpb.IndexID(indexID) != desc.PrimaryIndex.ID {
+		return nil, false, fmt.Errorf("%s: not a key of the primary index of table %s", key, desc.Name)
+	}
+	colIdx := desc.ColumnIdxMap()
+	row = make(tree.Datums, len(desc.Columns))
+	for _, id := range desc.PrimaryIndex.KeyColumnIDs {
+		i := colIdx[id]
+		if row[i], rem, err = decodeTableKey(desc.Columns[i].Type, rem); err != nil {
+			return nil, false, err
+		}
+	}
+
+	if !value.IsPresent() {
+		return row, true, nil
+	}
+	val, err := value.GetBytes()
+	if err != nil {
+		return nil, false, err
+	}
+	for len(val) > 0 {
+		var id uint64
+		if val, id, err = encoding.DecodeUvarintAscending(val); err != nil {
+			return nil, false, err
+		}
+		i, ok := colIdx[descpb.ColumnID(id)]
+		if !ok {
+			return nil, false, fmt.Errorf("column-id \"%d\" does not exist", id)
+		}
+		if row[i], val, err = decodeTableKey(desc.Columns[i].Type, val); err != nil {
+			return nil, false, err
+		}
+	}
+	return row, false, nil
+}
+
+// encodeTableKey encodes the datum with the ascending key encoding of its
+// type, and appends it to b.
+func encodeTableKey(b []byte, d tree.Datum) ([]byte, error) {
+	switch t := d.(type) {
+	case *tree.DInt:
+		return encoding.EncodeVarintAscending(b, int64(*t)), nil
+	case *tree.DString:
+		return encoding.EncodeStringAscending(b, string(*t)), nil
+	case *tree.DBytes:
+		return encoding.EncodeBytesAscending(b, []byte(*t)), nil
+	default:
+		return nil, fmt.Errorf("unable to encode table key: %T", d)
+	}
+}
+
+// decodeTableKey decodes a datum of the type, encoded by encodeTableKey, and
+// returns the remaining bytes.
+func decodeTableKey(typ *types.T, b []byte) (tree.Datum, []byte, error) {
+	switch typ.Family() {
+	case types.IntFamily:
+		rem, i, err := encoding.DecodeVarintAscending(b)
+		if err != nil {
+			return nil, nil, err
+		}
+		return tree.NewDInt(tree.DInt(i)), rem, nil
+	case types.StringFamily:
+		rem, s, err := encoding.DecodeBytesAscending(b)
+		if err != nil {
+			return nil, nil, err
+		}
+		return tree.NewDString(string(s)), rem, nil
+	case types.BytesFamily:
+		rem, s, err := encoding.DecodeBytesAscending(b)
+		if err != nil {
+			return nil, nil, err
+		}
+		d := tree.DBytes(s)
+		return &d, rem, nil
+	default:
+		return nil, nil, fmt.Errorf("unable to decode table key: %d", typ.Family())
+	}
+}
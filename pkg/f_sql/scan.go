@@ -0,0 +1,131 @@
+package sql
+
+import (
+	"context"
+	"fmt"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/c_catalog/colinfo"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/c_catalog/descpb"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/e_sem/tree"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/row"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/rowenc"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+)
+
+// A scanNode handles scanning over the key/value pairs of the primary index
+// of a table and decoding them into rows.
+type scanNode struct {
+	desc *descpb.TableDescriptor
+
+	// cols are the ordinals of the columns of the table returned by the scan,
+	// in order.
+	cols          []int
+	resultColumns colinfo.ResultColumns
+
+	// hardLimit, if non-zero, is the number of rows that the scan needs to
+	// return at most. The rows of a table are made of a single key, so the
+	// batches of the scan are limited to as many keys, and the scan doesn't
+	// lock the rows that follow.
+	hardLimit int64
+
+	// lockingStrength and lockingWaitPolicy are the row-level locking
+	// strength and wait policy of the scan, from the locking clause of the
+	// statement.
+	lockingStrength   tree.LockingStrength
+	lockingWaitPolicy tree.LockingWaitPolicy
+
+	fetcher *row.KVFetcher
+	// instrumentation collects the contention of the reads of the fetcher
+	// once the scan is closed.
+	instrumentation *instrumentationHelper
+	// kvs are the key/value pairs of the current batch which haven't been
+	// decoded yet.
+	kvs []roachpb.KeyValue
+	// row is the current row, made of the datums of cols.
+	row tree.Datums
+}
+
+// initCols sets up the columns returned by the scan, from the select list of
+// the statement.
+func (n *scanNode) initCols(exprs tree.SelectExprs) error {
+	for _, expr := range exprs {
+		name, ok := expr.Expr.(*tree.UnresolvedName)
+		if !ok {
+			return fmt.Errorf("unimplemented: %T in select list", expr.Expr)
+		}
+		if name.Star {
+			for i := range n.desc.Columns {
+				n.addCol(i)
+			}
+			continue
+		}
+		idx := -1
+		for i := range n.desc.Columns {
+			if n.desc.Columns[i].Name == name.Parts[0] {
+				idx = i
+				break
+			}
+		}
+		if idx < 0 {
+			return fmt.Errorf("column %q does not exist", name.Parts[0])
+		}
+		n.addCol(idx)
+	}
+	return nil
+}
+
+func (n *scanNode) addCol(idx int) {
+	col := &n.desc.Columns[idx]
+	n.cols = append(n.cols, idx)
+	n.resultColumns = append(n.resultColumns, colinfo.ResultColumn{
+		Name:           col.Name,
+		Typ:            col.Type,
+		TableID:        n.desc.ID,
+		PGAttributeNum: uint32(col.ID),
+	})
+}
+
+func (n *scanNode) startExec(params runParams) error {
+	n.fetcher = row.NewKVFetcher(params.p.txn, n.lockingStrength, n.lockingWaitPolicy, n.hardLimit)
+	n.fetcher.SetupNextFetch([]roachpb.Span{rowenc.PrimaryIndexSpan(n.desc)})
+	n.instrumentation = &params.p.instrumentation
+	n.row = make(tree.Datums, len(n.cols))
+	return nil
+}
+
+func (n *scanNode) Next(params runParams) (bool, error) {
+	for {
+		if len(n.kvs) == 0 {
+			ok, kvs, err := n.fetcher.NextBatch(params.ctx)
+			if err != nil || !ok {
+				return false, err
+			}
+			n.kvs = kvs
+			continue
+		}
+		kv := n.kvs[0]
+		n.kvs = n.kvs[1:]
+		datums, deleted, err := rowenc.DecodePrimaryIndex(n.desc, kv.Key, kv.Value)
+		if err != nil {
+			return false, err
+		}
+		if deleted {
+			continue
+		}
+		for i, idx := range n.cols {
+			n.row[i] = datums[idx]
+		}
+		return true, nil
+	}
+}
+
+func (n *scanNode) Values() tree.Datums {
+	return n.row
+}
+
+func (n *scanNode) Close(context.Context) {
+	if n.fetcher != nil {
+		n.instrumentation.RecordKVReads(n.fetcher)
+	}
+	n.fetcher = nil
+	n.kvs = nil
+}
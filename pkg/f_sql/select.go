@@ -0,0 +1,80 @@
+package sql
+
+import (
+	"context"
+	"fmt"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/c_catalog/descs"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/e_sem/tree"
+)
+
+// Select plans a SELECT statement. Only the scans of a single table are
+// supported: the select list may only name the columns of the table, and
+// there may be no WHERE clause. A table qualified by the name of its schema
+// is a table of a virtual schema, such as crdb_internal.
+//
+// The rows are locked with the strength and the wait policy of the locking
+// clause items that apply to the table.
+func (p *planner) Select(ctx context.Context, n *tree.Select) (planNode, error) {
+	sc, ok := n.Select.(*tree.SelectClause)
+	if !ok {
+		return nil, fmt.Errorf("unimplemented: %T", n.Select)
+	}
+	if sc.Where != nil {
+		return nil, fmt.Errorf("unimplemented: %s clause", sc.Where.Type)
+	}
+	if len(sc.From.Tables) != 1 {
+		return nil, fmt.Errorf("unimplemented: SELECT from %d tables", len(sc.From.Tables))
+	}
+	tn, ok := sc.From.Tables[0].(*tree.TableName)
+	if !ok {
+		return nil, fmt.Errorf("unimplemented: %T in FROM clause", sc.From.Tables[0])
+	}
+	for _, item := range sc.Locking {
+		for i := range item.Targets {
+			if target := &item.Targets[i]; target.ObjectName != tn.ObjectName {
+				return nil, fmt.Errorf("relation %q in %s clause not found in FROM clause",
+					target.Table(), item.Strength)
+			}
+		}
+	}
+
+	var plan planNode
+	var scan *scanNode
+	if tn.ExplicitSchema {
+		if len(sc.Locking) > 0 {
+			return nil, fmt.Errorf("%s is not allowed with virtual tables", sc.Locking[0].Strength)
+		}
+		values, err := p.newVirtualTableNode(ctx, tn, sc.Exprs)
+		if err != nil {
+			return nil, err
+		}
+		plan = values
+	} else {
+		desc, err := (&descs.Collection{}).GetImmutableTableByName(ctx, p.txn, tn.Table())
+		if err != nil {
+			return nil, err
+		}
+		scan = &scanNode{desc: desc}
+		if err := scan.initCols(sc.Exprs); err != nil {
+			return nil, err
+		}
+		scan.lockingStrength, scan.lockingWaitPolicy = sc.Locking.ForTable(tn.ObjectName)
+		plan = scan
+	}
+
+	if n.Limit == nil || (n.Limit.Count == nil && n.Limit.Offset == nil) {
+		return plan, nil
+	}
+	limit := &limitNode{plan: plan, count: -1}
+	if n.Limit.Count != nil {
+		limit.count = int64(*n.Limit.Count.(*tree.DInt))
+	}
+	if n.Limit.Offset != nil {
+		limit.offset = int64(*n.Limit.Offset.(*tree.DInt))
+	}
+	if scan != nil && limit.count >= 0 {
+		// The scan only needs to read, and lock, the rows up to the limit.
+		scan.hardLimit = limit.count + limit.offset
+	}
+	return limit, nil
+}
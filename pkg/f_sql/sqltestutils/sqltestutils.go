@@ -0,0 +1,52 @@
+// Package sqltestutils holds helpers for the tests of the SQL layer and of
+// the features built upon it.
+package sqltestutils
+
+import (
+	"context"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/c_catalog/descpb"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/c_catalog/descs"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/e_sem/tree"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/rowenc"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/types"
+	kv "github.com/dborchard/tiny_crdb/pkg/g_kv"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+// CreateTable creates the table (a INT PRIMARY KEY, b STRING), along with the
+// rows, in a single transaction.
+func CreateTable(
+	t testing.TB, db *kv.DB, name string, rows ...tree.Datums,
+) *descpb.TableDescriptor {
+	t.Helper()
+	ctx := context.Background()
+	id, err := descs.GenerateUniqueDescID(ctx, db)
+	require.NoError(t, err)
+	desc := &descpb.TableDescriptor{
+		Name: name,
+		ID:   id,
+		Columns: []descpb.ColumnDescriptor{
+			{Name: "a", ID: 1, Type: types.Int},
+			{Name: "b", ID: 2, Type: types.String, Nullable: true},
+		},
+		PrimaryIndex: descpb.IndexDescriptor{Name: "primary", ID: 1, KeyColumnIDs: []descpb.ColumnID{1}},
+	}
+	require.NoError(t, db.Txn(ctx, func(ctx context.Context, txn *kv.Txn) error {
+		var col descs.Collection
+		if err := col.WriteDesc(ctx, txn, desc); err != nil {
+			return err
+		}
+		for _, row := range rows {
+			key, value, err := rowenc.EncodePrimaryIndex(desc, row)
+			if err != nil {
+				return err
+			}
+			if err := txn.Put(ctx, key, &value); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	return desc
+}
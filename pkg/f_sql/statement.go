@@ -1,6 +1,7 @@
 package sql
 
 import (
+	parser "github.com/dborchard/tiny_crdb/pkg/f_sql/b_parser"
 	"github.com/dborchard/tiny_crdb/pkg/f_sql/b_parser/statements"
 	"github.com/dborchard/tiny_crdb/pkg/f_sql/e_sem/tree"
 )
@@ -8,11 +9,16 @@ import (
 // Statement contains a statement with optional expected result columns and metadata.
 type Statement struct {
 	statements.Statement[tree.Statement]
+
+	// StmtNoConstants is the SQL of the statement with its constants hidden,
+	// from which the fingerprint of the statement is constructed.
+	StmtNoConstants string
 }
 
 func makeStatement(parserStmt statements.Statement[tree.Statement],
 ) Statement {
 	return Statement{
-		Statement: parserStmt,
+		Statement:       parserStmt,
+		StmtNoConstants: parser.HideConstants(parserStmt.SQL),
 	}
 }
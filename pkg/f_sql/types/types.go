@@ -186,6 +186,8 @@ const (
 	BoolFamily
 	AnyFamily
 	BytesFamily
+	TimestampTZFamily
+	IntervalFamily
 )
 
 var (
@@ -254,6 +256,16 @@ var (
 	// Bytes is the type of a list of raw byte values.
 	Bytes = &T{InternalType: InternalType{
 		Family: BytesFamily, Oid: githubcomlibpqoid.T_bytea, Locale: &emptyLocale}}
+
+	// TimestampTZ is the type of a value specifying year, month, day, hour,
+	// minute, and second, as well as an associated timezone. By default, it
+	// has microsecond precision.
+	TimestampTZ = &T{InternalType: InternalType{
+		Family: TimestampTZFamily, Oid: githubcomlibpqoid.T_timestamptz, Locale: &emptyLocale}}
+
+	// Interval is the type of a span of time.
+	Interval = &T{InternalType: InternalType{
+		Family: IntervalFamily, Oid: githubcomlibpqoid.T_interval, Locale: &emptyLocale}}
 )
 
 // Convenience list of pre-constructed types. Caller code can use any of these
@@ -272,5 +284,7 @@ var (
 		Float,
 		String,
 		Bytes,
+		TimestampTZ,
+		Interval,
 	}
 )
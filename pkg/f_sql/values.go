@@ -0,0 +1,37 @@
+package sql
+
+import (
+	"context"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/c_catalog/colinfo"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/e_sem/tree"
+)
+
+// valuesNode returns rows which were computed when the statement was
+// planned, such as the rows of a virtual table.
+type valuesNode struct {
+	columns colinfo.ResultColumns
+	rows    []tree.Datums
+
+	// nextRow is the position of the next row to return.
+	nextRow int
+}
+
+func (n *valuesNode) startExec(runParams) error {
+	return nil
+}
+
+func (n *valuesNode) Next(runParams) (bool, error) {
+	if n.nextRow >= len(n.rows) {
+		return false, nil
+	}
+	n.nextRow++
+	return true, nil
+}
+
+func (n *valuesNode) Values() tree.Datums {
+	return n.rows[n.nextRow-1]
+}
+
+func (n *valuesNode) Close(context.Context) {
+	n.rows = nil
+}
@@ -1,6 +1,13 @@
 package sql
 
-import kv "github.com/dborchard/tiny_crdb/pkg/g_kv"
+import (
+	jobs "github.com/dborchard/tiny_crdb/pkg/f_jobs"
+	"github.com/dborchard/tiny_crdb/pkg/f_sql/contention"
+	kv "github.com/dborchard/tiny_crdb/pkg/g_kv"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvclient/rangefeed"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/stop"
+)
 
 // An ExecutorConfig encompasses the auxiliary objects and configuration
 // required to create an executor.
@@ -8,6 +15,15 @@ import kv "github.com/dborchard/tiny_crdb/pkg/g_kv"
 // an Executor; the rest will have sane defaults set if omitted.
 type ExecutorConfig struct {
 	DB             *kv.DB
+	Clock          *hlc.Clock
+	Stopper        *stop.Stopper
 	InternalDB     *InternalDB
 	DistSQLPlanner *DistSQLPlanner
+	// JobRegistry runs the jobs of the node. The ExecutorConfig is the
+	// execution context of the jobs.
+	JobRegistry      *jobs.Registry
+	RangeFeedFactory *rangefeed.Factory
+	// ContentionRegistry aggregates the contention events of the statements
+	// run by the node.
+	ContentionRegistry *contention.Registry
 }
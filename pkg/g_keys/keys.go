@@ -0,0 +1,531 @@
+// Package keys defines the layout of the system keys: the keys in the local
+// keyspace that hold data used by KV itself, such as transaction records,
+// rather than data written by clients.
+package keys
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/uuid"
+)
+
+var (
+	// LocalPrefix is the prefix for all local keys. Local keys sort before
+	// all client keys, and are never addressed directly by clients.
+	LocalPrefix = roachpb.Key("\x01")
+	// LocalMax is the end of the local key range. It is itself a valid
+	// client key.
+	LocalMax = roachpb.Key("\x02")
+
+	// LocalRangeIDPrefix is the prefix identifying per-range data
+	// indexed by Range ID. The Range ID is appended to this prefix,
+	// followed by a suffix identifying the sort of data. Range-ID local
+	// keys are not addressable: they are only read and written by the
+	// replicas of the range itself.
+	LocalRangeIDPrefix = roachpb.Key(makeKey(LocalPrefix, roachpb.Key("i")))
+	// LocalRangeStatsLegacySuffix is the suffix for range statistics.
+	LocalRangeStatsLegacySuffix = roachpb.Key("stat")
+	// LocalRangeAppliedStateSuffix is the suffix for the range applied
+	// state key, which holds the index and term of the last Raft entry
+	// applied to the range's state.
+	LocalRangeAppliedStateSuffix = roachpb.Key("rask")
+	// LocalRangeLeaseSuffix is the suffix for a range lease.
+	LocalRangeLeaseSuffix = roachpb.Key("rll-")
+	// LocalRangeIDUnreplicatedInfix is the infix of the range-ID keys which
+	// are not replicated: each replica writes its own version of them.
+	LocalRangeIDUnreplicatedInfix = roachpb.Key("u")
+	// LocalRaftHardStateSuffix is the suffix for the Raft HardState.
+	LocalRaftHardStateSuffix = roachpb.Key("rfth")
+	// LocalRaftLogSuffix is the suffix for the Raft log. The index of the
+	// entry is appended to it.
+	LocalRaftLogSuffix = roachpb.Key("rftl")
+	// LocalRaftTruncatedStateSuffix is the suffix for the
+	// RaftTruncatedState, which identifies the entry preceding the first
+	// entry of the Raft log.
+	LocalRaftTruncatedStateSuffix = roachpb.Key("rftt")
+
+	// LocalRangePrefix is the prefix identifying per-range data indexed by
+	// range key (either start key, or some key in the range). The key is
+	// appended to this prefix, encoded using EncodeBytes. The specific sort
+	// of per-range metadata is identified by one of the suffixes listed
+	// below, along with potentially additional encoded key info, such as
+	// the txn ID in the case of a transaction record.
+	LocalRangePrefix = roachpb.Key(makeKey(LocalPrefix, roachpb.Key("k")))
+	// LocalTransactionSuffix specifies the key suffix for transaction
+	// records. The additional detail is the transaction id.
+	LocalTransactionSuffix = roachpb.Key("txn-")
+	// LocalRangeDescriptorSuffix is the suffix for keys storing range
+	// descriptors. The value is a struct of type RangeDescriptor.
+	LocalRangeDescriptorSuffix = roachpb.Key("rdsc")
+
+	// LocalStorePrefix is the prefix identifying per-store data. Store-local
+	// keys are not replicated: they describe the store they are written to
+	// and are never addressed through KV.
+	LocalStorePrefix = roachpb.Key(makeKey(LocalPrefix, roachpb.Key("s")))
+	// localStoreIdentSuffix stores an immutable identifier for this store,
+	// created when the store is first bootstrapped.
+	localStoreIdentSuffix = []byte("iden")
+
+	// Meta1Prefix is the first level of key addressing. It is selected such
+	// that all range addressing records sort before any system tables which
+	// they might describe. The value is a RangeDescriptor struct.
+	Meta1Prefix = roachpb.Key{0x02}
+	// Meta2Prefix is the second level of key addressing. The value is a
+	// RangeDescriptor struct.
+	Meta2Prefix = roachpb.Key{0x03}
+	// Meta1KeyMax is the end of the range of the first level of key
+	// addressing. The value is a RangeDescriptor struct.
+	Meta1KeyMax = roachpb.Key(makeKey(Meta1Prefix, roachpb.RKeyMax))
+	// Meta2KeyMax is the end of the range of the second level of key
+	// addressing. The value is a RangeDescriptor struct.
+	Meta2KeyMax = roachpb.Key(makeKey(Meta2Prefix, roachpb.RKeyMax))
+	// MetaMin is the start of the range of addressing keys.
+	MetaMin = Meta1Prefix
+	// MetaMax is the end of the range of addressing keys.
+	MetaMax = roachpb.Key{0x04}
+
+	// SystemPrefix indicates the beginning of the key range for global,
+	// system data which are replicated across the cluster.
+	SystemPrefix = roachpb.Key{0x04}
+	// SystemMax is the end of the system key range.
+	SystemMax = roachpb.Key{0x05}
+	// NodeLivenessPrefix specifies the key prefix for the node liveness
+	// table. Note that this should sort before the rest of the system
+	// keyspace in order to limit the number of ranges which must use
+	// expiration-based range leases instead of the more efficient
+	// node-liveness epoch-based range leases.
+	NodeLivenessPrefix = roachpb.Key(makeKey(SystemPrefix, roachpb.Key("\x00liveness-")))
+	// NodeLivenessKeyMax is the maximum value for any node liveness key.
+	NodeLivenessKeyMax = NodeLivenessPrefix.PrefixEnd()
+	// NodeIDGenerator is the global node ID generator sequence. The value
+	// is the last allocated node ID.
+	NodeIDGenerator = roachpb.Key(makeKey(SystemPrefix, roachpb.Key("node-idgen")))
+	// StoreIDGenerator is the global store ID generator sequence. The value
+	// is the last allocated store ID.
+	StoreIDGenerator = roachpb.Key(makeKey(SystemPrefix, roachpb.Key("store-idgen")))
+	// RangeIDGenerator is the global range ID generator sequence. The value
+	// is the last allocated range ID.
+	RangeIDGenerator = roachpb.Key(makeKey(SystemPrefix, roachpb.Key("range-idgen")))
+	// DescIDGenerator is the global descriptor ID generator sequence. The
+	// value is the last allocated descriptor ID.
+	DescIDGenerator = roachpb.Key(makeKey(SystemPrefix, roachpb.Key("desc-idgen")))
+	// DescMetadataPrefix is the key prefix for the descriptors of the SQL
+	// tables. The descriptor ID is appended to it.
+	DescMetadataPrefix = roachpb.Key(makeKey(SystemPrefix, roachpb.Key("descriptor-")))
+	// NamespacePrefix is the key prefix for the mapping of the names of the
+	// SQL tables to their descriptor IDs. The name is appended to it.
+	NamespacePrefix = roachpb.Key(makeKey(SystemPrefix, roachpb.Key("namespace-")))
+	// JobIDGenerator is the global job ID generator sequence. The value is
+	// the last allocated job ID.
+	JobIDGenerator = roachpb.Key(makeKey(SystemPrefix, roachpb.Key("job-idgen")))
+	// JobsPrefix is the key prefix for the records of the jobs. The job ID
+	// is appended to it.
+	JobsPrefix = roachpb.Key(makeKey(SystemPrefix, roachpb.Key("jobs-")))
+
+	// TableDataMin is the start of the range of table data keys. SQL row keys
+	// are made of the table and index IDs, the encoded primary key columns
+	// and a column family suffix; see GetRowPrefixLength.
+	TableDataMin = roachpb.Key{0x88}
+	// TableDataMax is the end of the range of table data keys.
+	TableDataMax = roachpb.Key{0xfe}
+)
+
+// StoreIdentKey returns a store-local key for the store metadata.
+func StoreIdentKey() roachpb.Key {
+	return makeKey(LocalStorePrefix, localStoreIdentSuffix)
+}
+
+// TransactionKey returns a transaction key based on the provided
+// transaction key and ID. The base key is encoded in order to
+// guarantee that all transaction records for a range sort together.
+// The base key is addressed first, so that the records of transactions
+// anchored on local keys, such as range descriptors, are stored with the
+// range that holds their anchor.
+func TransactionKey(key roachpb.Key, txnID uuid.UUID) roachpb.Key {
+	return MakeRangeKey(MustAddr(key).AsRawKey(), LocalTransactionSuffix, roachpb.Key(txnID.GetBytes()))
+}
+
+// RangeDescriptorKey returns a range-local key for the descriptor
+// for the range with specified key.
+func RangeDescriptorKey(key roachpb.RKey) roachpb.Key {
+	return MakeRangeKey(key.AsRawKey(), LocalRangeDescriptorSuffix, nil)
+}
+
+// RangeStatsLegacyKey returns the key for accessing the MVCCStats struct for
+// the specified Range ID.
+func RangeStatsLegacyKey(rangeID roachpb.RangeID) roachpb.Key {
+	return makeKey(MakeRangeIDPrefix(rangeID), LocalRangeStatsLegacySuffix)
+}
+
+// RangeAppliedStateKey returns the key for the RangeAppliedState of the
+// specified Range ID.
+func RangeAppliedStateKey(rangeID roachpb.RangeID) roachpb.Key {
+	return makeKey(MakeRangeIDPrefix(rangeID), LocalRangeAppliedStateSuffix)
+}
+
+// RangeLeaseKey returns a system-local key for a range lease.
+func RangeLeaseKey(rangeID roachpb.RangeID) roachpb.Key {
+	return makeKey(MakeRangeIDPrefix(rangeID), LocalRangeLeaseSuffix)
+}
+
+// NodeLivenessKey returns the key for the liveness record of the node.
+func NodeLivenessKey(nodeID roachpb.NodeID) roachpb.Key {
+	return binary.BigEndian.AppendUint32(makeKey(NodeLivenessPrefix), uint32(nodeID))
+}
+
+// RaftHardStateKey returns the key for the Raft HardState of the replica of
+// the specified Range ID.
+func RaftHardStateKey(rangeID roachpb.RangeID) roachpb.Key {
+	return makeKey(MakeRangeIDUnreplicatedPrefix(rangeID), LocalRaftHardStateSuffix)
+}
+
+// RaftLogPrefix returns the prefix of the keys of the Raft log of the
+// replica of the specified Range ID.
+func RaftLogPrefix(rangeID roachpb.RangeID) roachpb.Key {
+	return makeKey(MakeRangeIDUnreplicatedPrefix(rangeID), LocalRaftLogSuffix)
+}
+
+// RaftLogKey returns the key of the Raft log entry at the specified index.
+// Entries sort by index.
+func RaftLogKey(rangeID roachpb.RangeID, logIndex uint64) roachpb.Key {
+	return binary.BigEndian.AppendUint64(RaftLogPrefix(rangeID), logIndex)
+}
+
+// RaftTruncatedStateKey returns the key for the RaftTruncatedState of the
+// replica of the specified Range ID.
+func RaftTruncatedStateKey(rangeID roachpb.RangeID) roachpb.Key {
+	return makeKey(MakeRangeIDUnreplicatedPrefix(rangeID), LocalRaftTruncatedStateSuffix)
+}
+
+// MakeRangeIDUnreplicatedPrefix creates the prefix of the unreplicated
+// range-ID keys of rangeID.
+func MakeRangeIDUnreplicatedPrefix(rangeID roachpb.RangeID) roachpb.Key {
+	return makeKey(MakeRangeIDPrefix(rangeID), LocalRangeIDUnreplicatedInfix)
+}
+
+// MakeRangeIDPrefix creates a range-local key prefix from rangeID.
+func MakeRangeIDPrefix(rangeID roachpb.RangeID) roachpb.Key {
+	buf := makeKey(LocalRangeIDPrefix)
+	return binary.BigEndian.AppendUint64(buf, uint64(rangeID))
+}
+
+// MakeRangeKey creates a range-local key based on the range
+// start key, metadata key suffix, and optional detail (e.g. the
+// transaction ID for a txn record, etc.).
+func MakeRangeKey(key, suffix, detail roachpb.Key) roachpb.Key {
+	if len(suffix) != 4 {
+		panic("suffix len must be 4")
+	}
+	buf := makeKey(LocalRangePrefix)
+	buf = encodeBytesAscending(buf, key)
+	buf = append(buf, suffix...)
+	buf = append(buf, detail...)
+	return buf
+}
+
+// MakeRangeKeyPrefix creates a key prefix under which all range-local keys
+// can be found.
+func MakeRangeKeyPrefix(key roachpb.RKey) roachpb.Key {
+	buf := makeKey(LocalRangePrefix)
+	return encodeBytesAscending(buf, key)
+}
+
+// DecodeRangeKey decodes the range key into range start key, suffix and
+// optional detail (may be nil).
+func DecodeRangeKey(key roachpb.Key) (startKey, suffix, detail roachpb.Key, err error) {
+	if !bytes.HasPrefix(key, LocalRangePrefix) {
+		return nil, nil, nil, fmt.Errorf("key %q does not have %q prefix", key, LocalRangePrefix)
+	}
+	// Cut the prefix and decode the start key.
+	b := key[len(LocalRangePrefix):]
+	b, startKey, err = decodeBytesAscending(b)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if len(b) < 4 {
+		return nil, nil, nil, fmt.Errorf("key %q does not have suffix of length 4", key)
+	}
+	// Cut the suffix.
+	suffix = b[:4]
+	detail = b[4:]
+	return startKey, suffix, detail, nil
+}
+
+// IsLocal performs a cheap check that returns true iff a range-local key is
+// passed, that is, a key for which `Addr` would return a non-identical
+// RKey (or a decoding error).
+func IsLocal(k roachpb.Key) bool {
+	return len(k) > 0 && k.Compare(LocalMax) < 0 && k.Compare(LocalPrefix) >= 0
+}
+
+// Addr returns the address for the key, used to lookup the range containing
+// the key. In the normal case, this is simply the key's value. However, for
+// local keys, such as transaction records, the address is the inline key
+// that appears after the local range prefix. The statement that Addr is the
+// identity for non-local keys means that the range containing a local key is
+// the range containing the key it is anchored at.
+func Addr(k roachpb.Key) (roachpb.RKey, error) {
+	for {
+		if !IsLocal(k) {
+			return roachpb.RKey(k), nil
+		}
+		if !bytes.HasPrefix(k, LocalRangePrefix) {
+			return nil, fmt.Errorf("local key %s malformed; should start with %s", k, LocalRangePrefix)
+		}
+		_, key, err := decodeBytesAscending(k[len(LocalRangePrefix):])
+		if err != nil {
+			return nil, err
+		}
+		// The inline key may itself be a local key.
+		k = key
+	}
+}
+
+// MustAddr calls Addr and panics on errors.
+func MustAddr(k roachpb.Key) roachpb.RKey {
+	rk, err := Addr(k)
+	if err != nil {
+		panic(fmt.Sprintf("failure resolving %s: %v", k, err))
+	}
+	return rk
+}
+
+// AddrUpperBound returns the address of an (exclusive) EndKey, used to
+// lookup ranges containing the keys strictly smaller than that key. For a
+// local key, the address of the key is followed by a null byte, since the
+// local key sorts after the key it is anchored at, and so after all keys
+// that address to that same key.
+func AddrUpperBound(k roachpb.Key) (roachpb.RKey, error) {
+	rk, err := Addr(k)
+	if err != nil {
+		return rk, err
+	}
+	if IsLocal(k) {
+		// The upper bound for a range-local key that addresses to key k
+		// is the key directly after k.
+		rk = rk.Next()
+	}
+	return rk, nil
+}
+
+// SpanAddr is like Addr, but it takes a Span instead of a single key and
+// applies the key transformation to the start and end keys in the span,
+// returning an RSpan.
+func SpanAddr(span roachpb.Span) (roachpb.RSpan, error) {
+	rk, err := Addr(span.Key)
+	if err != nil {
+		return roachpb.RSpan{}, err
+	}
+	var rek roachpb.RKey
+	if len(span.EndKey) > 0 {
+		rek, err = AddrUpperBound(span.EndKey)
+		if err != nil {
+			return roachpb.RSpan{}, err
+		}
+	}
+	return roachpb.RSpan{Key: rk, EndKey: rek}, nil
+}
+
+// RangeMetaKey returns a range metadata (meta1, meta2) indexing key for the
+// given key.
+//
+// For ordinary keys this returns a level 2 metadata key - for level 2 keys,
+// it returns a level 1 key. For level 1 keys and local keys, KeyMin is
+// returned.
+func RangeMetaKey(key roachpb.RKey) roachpb.RKey {
+	if len(key) == 0 {
+		return roachpb.RKeyMin
+	}
+	var prefix roachpb.Key
+	switch key[0] {
+	case Meta1Prefix[0]:
+		return roachpb.RKeyMin
+	case Meta2Prefix[0]:
+		prefix = Meta1Prefix
+		key = key[len(Meta2Prefix):]
+	default:
+		prefix = Meta2Prefix
+	}
+	return roachpb.RKey(makeKey(prefix, key))
+}
+
+// MetaScanBounds returns the range [start,end) within which the desired meta
+// record can be found by means of a forward scan, for the given meta key.
+// The meta record of the range containing a key k is stored at the meta key
+// of the range's end key, which sorts strictly after the meta key of k.
+func MetaScanBounds(key roachpb.RKey) (roachpb.RSpan, error) {
+	if key.Equal(roachpb.RKeyMin) {
+		// Special case KeyMin, the meta key of the keys of the first range:
+		// its record is the first meta1 record.
+		return roachpb.RSpan{
+			Key:    roachpb.RKey(Meta1Prefix),
+			EndKey: roachpb.RKey(Meta1Prefix.PrefixEnd()),
+		}, nil
+	}
+	if key.Compare(roachpb.RKey(MetaMin)) < 0 || key.Compare(roachpb.RKey(MetaMax)) >= 0 {
+		return roachpb.RSpan{}, fmt.Errorf("%s is not a meta key", key)
+	}
+	if key.Equal(Meta2KeyMax) {
+		return roachpb.RSpan{}, fmt.Errorf("Meta2KeyMax can't be used as the key of scan: %s", key)
+	}
+	if key.Equal(Meta1KeyMax) {
+		// Special case Meta1KeyMax: it is the meta key of the last meta2
+		// range, whose meta1 record is stored at Meta1KeyMax itself.
+		return roachpb.RSpan{
+			Key:    roachpb.RKey(Meta1KeyMax),
+			EndKey: roachpb.RKey(Meta1KeyMax).Next(),
+		}, nil
+	}
+	// Otherwise find the first entry greater than the given key, within
+	// the meta level of the key.
+	return roachpb.RSpan{
+		Key:    key.Next(),
+		EndKey: roachpb.RKey(key[:len(Meta1Prefix)]).PrefixEnd(),
+	}, nil
+}
+
+// IsValidSplitKey returns whether the key is a valid split key. Local keys
+// cannot be split at, since they are addressed to the range of their anchor
+// key, and neither can the meta keys: the meta1 and meta2 records live in a
+// single range, whose descriptor is found without a meta lookup.
+func IsValidSplitKey(key roachpb.Key) bool {
+	return key.Compare(MetaMax) >= 0
+}
+
+// intZero is the single-byte ascending varint encoding of zero. Values up to
+// 109 are encoded in a single byte as intZero plus the value.
+const intZero = 136
+
+// GetRowPrefixLength returns the length of the row prefix of the key. A table
+// key's suffix is a column family ID, whose encoded length is encoded as a
+// single-byte varint in the key's last byte; the row prefix is the key
+// without that suffix. The keys of the column families of a SQL row share its
+// row prefix. Keys that are not table keys are their own row prefix.
+func GetRowPrefixLength(key roachpb.Key) (int, error) {
+	if key.Compare(TableDataMin) < 0 || key.Compare(TableDataMax) >= 0 {
+		return len(key), nil
+	}
+	n := len(key)
+	colFamIDLen := int(key[n-1]) - intZero
+	// The column family ID length was encoded as a single-byte varint, and
+	// must be followed by at least the table ID.
+	if colFamIDLen < 0 || colFamIDLen >= n-1 {
+		return 0, fmt.Errorf("%s: malformed table key", key)
+	}
+	return n - colFamIDLen - 1, nil
+}
+
+// EnsureSafeSplitKey transforms an SQL table key such that it is a valid split
+// key (i.e. does not occur in the middle of a row).
+func EnsureSafeSplitKey(key roachpb.Key) (roachpb.Key, error) {
+	idx, err := GetRowPrefixLength(key)
+	if err != nil {
+		return nil, err
+	}
+	return key[:idx], nil
+}
+
+// Range returns a key range encompassing the key ranges of all requests.
+func Range(reqs []kvpb.RequestUnion) (roachpb.RSpan, error) {
+	from := roachpb.RKeyMax
+	to := roachpb.RKeyMin
+	for _, arg := range reqs {
+		req := arg.GetInner()
+		h := req.Header()
+		key, err := Addr(h.Key)
+		if err != nil {
+			return roachpb.RSpan{}, err
+		}
+		if key.Less(from) {
+			// Key is smaller than `from`.
+			from = key
+		}
+		if !key.Less(to) {
+			// Key.Next() is larger than `to`.
+			if bytes.Compare(key, roachpb.RKeyMax) > 0 {
+				return roachpb.RSpan{}, fmt.Errorf("%s must be less than KeyMax", key)
+			}
+			to = key.Next()
+		}
+
+		if len(h.EndKey) == 0 {
+			continue
+		}
+		endKey, err := AddrUpperBound(h.EndKey)
+		if err != nil {
+			return roachpb.RSpan{}, err
+		}
+		if bytes.Compare(roachpb.RKeyMax, endKey) < 0 {
+			return roachpb.RSpan{}, fmt.Errorf("%s must be less than or equal to KeyMax", endKey)
+		}
+		if to.Less(endKey) {
+			// EndKey is larger than `to`.
+			to = endKey
+		}
+	}
+	return roachpb.RSpan{Key: from, EndKey: to}, nil
+}
+
+func makeKey(keys ...[]byte) []byte {
+	var n int
+	for _, k := range keys {
+		n += len(k)
+	}
+	buf := make([]byte, 0, n)
+	for _, k := range keys {
+		buf = append(buf, k...)
+	}
+	return buf
+}
+
+const (
+	escape      byte = 0x00
+	escapedTerm byte = 0x01
+	escaped00   byte = 0xff
+)
+
+// encodeBytesAscending encodes the []byte value using an escape-based
+// encoding. The encoded value is terminated with the sequence
+// "\x00\x01" which is guaranteed to not occur elsewhere in the encoded
+// value. The encoded bytes are appended to the supplied buffer and the
+// resulting buffer is returned. Encoded values sort in the same order as
+// the values they encode.
+func encodeBytesAscending(b []byte, data []byte) []byte {
+	for _, c := range data {
+		b = append(b, c)
+		if c == escape {
+			b = append(b, escaped00)
+		}
+	}
+	return append(b, escape, escapedTerm)
+}
+
+// decodeBytesAscending decodes a []byte value from the input buffer which
+// was encoded using encodeBytesAscending. The remainder of the input buffer
+// and the decoded []byte are returned.
+func decodeBytesAscending(b []byte) ([]byte, []byte, error) {
+	var r []byte
+	for {
+		i := bytes.IndexByte(b, escape)
+		if i == -1 {
+			return nil, nil, fmt.Errorf("did not find terminator %#x in buffer %#x", escape, b)
+		}
+		if i+1 >= len(b) {
+			return nil, nil, fmt.Errorf("malformed escape in buffer %#x", b)
+		}
+		v := b[i+1]
+		if v == escapedTerm {
+			r = append(r, b[:i]...)
+			return b[i+2:], r, nil
+		}
+		if v != escaped00 {
+			return nil, nil, fmt.Errorf("unknown escape sequence: %#x %#x", escape, v)
+		}
+		r = append(r, b[:i]...)
+		r = append(r, escape)
+		b = b[i+2:]
+	}
+}
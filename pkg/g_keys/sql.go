@@ -0,0 +1,59 @@
+package keys
+
+import (
+	"fmt"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/encoding"
+)
+
+// MakeTablePrefix returns the key prefix used for the table's data.
+func MakeTablePrefix(tableID uint32) roachpb.Key {
+	return encoding.EncodeUvarintAscending(nil, uint64(tableID))
+}
+
+// MakeIndexPrefix returns the key prefix used for the index's data.
+func MakeIndexPrefix(tableID, indexID uint32) roachpb.Key {
+	key := MakeTablePrefix(tableID)
+	return encoding.EncodeUvarintAscending(key, uint64(indexID))
+}
+
+// DecodeTablePrefix validates that the given key has a table prefix,
+// returning the remainder of the key (with the prefix removed) and the
+// decoded descriptor ID of the table.
+func DecodeTablePrefix(key roachpb.Key) ([]byte, uint32, error) {
+	if key.Compare(TableDataMin) < 0 || key.Compare(TableDataMax) >= 0 {
+		return nil, 0, fmt.Errorf("%s: not a table key", key)
+	}
+	rem, id, err := encoding.DecodeUvarintAscending(key)
+	return rem, uint32(id), err
+}
+
+// DecodeIndexPrefix validates that the given key has a table and index
+// prefix, returning the remainder of the key (with the prefix removed) and
+// the decoded IDs of the table and index, respectively.
+func DecodeIndexPrefix(key roachpb.Key) ([]byte, uint32, uint32, error) {
+	rem, tableID, err := DecodeTablePrefix(key)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	rem, indexID, err := encoding.DecodeUvarintAscending(rem)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	return rem, tableID, uint32(indexID), nil
+}
+
+// DescMetadataKey returns the key for the descriptor with the given ID.
+func DescMetadataKey(descID uint32) roachpb.Key {
+	return encoding.EncodeUvarintAscending(makeKey(DescMetadataPrefix), uint64(descID))
+}
+
+// NamespaceKey returns the key mapping the table name to its descriptor ID.
+func NamespaceKey(name string) roachpb.Key {
+	return makeKey(NamespacePrefix, []byte(name))
+}
+
+// JobKey returns the key for the record of the job with the given ID.
+func JobKey(jobID int64) roachpb.Key {
+	return encoding.EncodeUvarintAscending(makeKey(JobsPrefix), uint64(jobID))
+}
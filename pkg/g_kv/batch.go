@@ -1,8 +1,12 @@
 package kv
 
 import (
+	"context"
+	"fmt"
 	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/concurrency/lock"
 	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
 )
 
 // Batch provides for the parallel execution of a number of database
@@ -15,6 +19,9 @@ type Batch struct {
 	// The Txn the batch is associated with. This field may be nil if the batch
 	// was not created via Txn.NewBatch.
 	txn *Txn
+	// Header is the header for the batch. It is sent along with the requests
+	// when the batch is run.
+	Header kvpb.Header
 	// Results contains an entry for each operation added to the batch. The order
 	// of the results matches the order the operations were added to the
 	// batch. For example:
@@ -59,7 +66,298 @@ func (b *Batch) Put(key, value interface{}) {
 		// value. If the intention was indeed to delete the key, use Del() instead.
 		panic("can't Put an empty Value; did you mean to Del() instead?")
 	}
-	//b.put(key, value, false)
+	b.put(key, value)
+}
+
+func (b *Batch) put(key, value interface{}) {
+	k, err := marshalKey(key)
+	if err != nil {
+		b.initResult(0, err)
+		return
+	}
+	v, err := marshalValue(value)
+	if err != nil {
+		b.initResult(0, err)
+		return
+	}
+	b.appendReqs(&kvpb.PutRequest{RequestHeader: kvpb.RequestHeader{Key: k}, Value: v})
+	b.approxMutationReqBytes += len(k) + len(v.RawBytes)
+	b.initResult(1, nil)
+}
+
+// Get retrieves the value for a key. A new result will be appended to the batch
+// which will contain a single row.
+//
+//	r, err := db.Get("a")
+//	// string(r.Rows[0].Key) == "a"
+//
+// key can be either a byte slice or a string.
+func (b *Batch) Get(key interface{}) {
+	b.get(key, lock.None)
+}
+
+// GetForUpdate retrieves the value for a key. An Exclusive lock with
+// unreplicated durability is acquired on the key, if it exists. A new result
+// will be appended to the batch which will contain a single row.
+//
+//	r, err := db.GetForUpdate("a")
+//	// string(r.Rows[0].Key) == "a"
+//
+// key can be either a byte slice or a string.
+func (b *Batch) GetForUpdate(key interface{}) {
+	b.get(key, lock.Exclusive)
+}
+
+// GetForShare retrieves the value for a key. A Shared lock with unreplicated
+// durability is acquired on the key, if it exists. A new result will be
+// appended to the batch which will contain a single row.
+//
+// key can be either a byte slice or a string.
+func (b *Batch) GetForShare(key interface{}) {
+	b.get(key, lock.Shared)
+}
+
+func (b *Batch) get(key interface{}, str lock.Strength) {
+	k, err := marshalKey(key)
+	if err != nil {
+		b.initResult(0, err)
+		return
+	}
+	b.appendReqs(&kvpb.GetRequest{RequestHeader: kvpb.RequestHeader{Key: k}, KeyLockingStrength: str})
+	b.initResult(1, nil)
+}
+
+// Del deletes one or more keys.
+//
+// A new result will be appended to the batch and each key will have a
+// corresponding row in the returned Result.
+//
+// key can be either a byte slice or a string.
+func (b *Batch) Del(keys ...interface{}) {
+	reqs := make([]kvpb.Request, 0, len(keys))
+	for _, key := range keys {
+		k, err := marshalKey(key)
+		if err != nil {
+			b.initResult(0, err)
+			return
+		}
+		reqs = append(reqs, &kvpb.DeleteRequest{RequestHeader: kvpb.RequestHeader{Key: k}})
+		b.approxMutationReqBytes += len(k)
+	}
+	b.appendReqs(reqs...)
+	b.initResult(len(reqs), nil)
+}
+
+// Scan retrieves the key/values between begin (inclusive) and end (exclusive) in
+// ascending order.
+//
+// A new result will be appended to the batch which will contain "rows" (each
+// row is a key/value pair) and Result.Err will indicate success or failure.
+//
+// key can be either a byte slice or a string.
+func (b *Batch) Scan(s, e interface{}) {
+	b.scan(s, e, lock.None)
+}
+
+// ScanForUpdate retrieves the key/values between begin (inclusive) and end
+// (exclusive) in ascending order. Exclusive locks with unreplicated
+// durability are acquired on each of the returned keys.
+//
+// A new result will be appended to the batch which will contain "rows" (each
+// row is a key/value pair) and Result.Err will indicate success or failure.
+//
+// key can be either a byte slice or a string.
+func (b *Batch) ScanForUpdate(s, e interface{}) {
+	b.scan(s, e, lock.Exclusive)
+}
+
+// ScanForShare retrieves the key/values between begin (inclusive) and end
+// (exclusive) in ascending order. Shared locks with unreplicated durability
+// are acquired on each of the returned keys.
+//
+// A new result will be appended to the batch which will contain "rows" (each
+// row is a key/value pair) and Result.Err will indicate success or failure.
+//
+// key can be either a byte slice or a string.
+func (b *Batch) ScanForShare(s, e interface{}) {
+	b.scan(s, e, lock.Shared)
+}
+
+func (b *Batch) scan(s, e interface{}, str lock.Strength) {
+	begin, err := marshalKey(s)
+	if err != nil {
+		b.initResult(0, err)
+		return
+	}
+	end, err := marshalKey(e)
+	if err != nil {
+		b.initResult(0, err)
+		return
+	}
+	b.appendReqs(&kvpb.ScanRequest{RequestHeader: kvpb.RequestHeader{Key: begin, EndKey: end}, KeyLockingStrength: str})
+	b.initResult(1, nil)
+}
+
+// adminSplit is only exported on DB. It is here for symmetry with the
+// other operations.
+func (b *Batch) adminSplit(splitKeyIn interface{}, expirationTime hlc.Timestamp) {
+	splitKey, err := marshalKey(splitKeyIn)
+	if err != nil {
+		b.initResult(0, err)
+		return
+	}
+	b.appendReqs(&kvpb.AdminSplitRequest{
+		RequestHeader:  kvpb.RequestHeader{Key: splitKey},
+		SplitKey:       splitKey,
+		ExpirationTime: expirationTime,
+	})
+	b.initResult(1, nil)
+}
+
+// adminMerge is only exported on DB. It is here for symmetry with the
+// other operations.
+func (b *Batch) adminMerge(key interface{}) {
+	k, err := marshalKey(key)
+	if err != nil {
+		b.initResult(0, err)
+		return
+	}
+	b.appendReqs(&kvpb.AdminMergeRequest{RequestHeader: kvpb.RequestHeader{Key: k}})
+	b.initResult(1, nil)
+}
+
+// adminChangeReplicas is only exported on DB. It is here for symmetry with
+// the other operations.
+func (b *Batch) adminChangeReplicas(
+	key interface{}, expDesc roachpb.RangeDescriptor, chgs []kvpb.ReplicationChange,
+) {
+	k, err := marshalKey(key)
+	if err != nil {
+		b.initResult(0, err)
+		return
+	}
+	b.appendReqs(&kvpb.AdminChangeReplicasRequest{
+		RequestHeader:   kvpb.RequestHeader{Key: k},
+		ExpDesc:         expDesc,
+		InternalChanges: chgs,
+	})
+	b.initResult(1, nil)
+}
+
+// adminTransferLease is only exported on DB. It is here for symmetry with
+// the other operations.
+func (b *Batch) adminTransferLease(key interface{}, target roachpb.StoreID) {
+	k, err := marshalKey(key)
+	if err != nil {
+		b.initResult(0, err)
+		return
+	}
+	b.appendReqs(&kvpb.AdminTransferLeaseRequest{
+		RequestHeader: kvpb.RequestHeader{Key: k},
+		Target:        target,
+	})
+	b.initResult(1, nil)
+}
+
+// AddRawRequest adds the specified requests to the batch. Their responses are
+// not decoded into Results; they can be retrieved through RawResponse once the
+// batch has run.
+func (b *Batch) AddRawRequest(reqs ...kvpb.Request) {
+	b.raw = true
+	for _, args := range reqs {
+		b.appendReqs(args)
+		b.initResult(1 /* calls */, nil)
+	}
+}
+
+// RawResponse returns the BatchResponse which was the result of a successful
+// execution of the batch, and nil otherwise.
+func (b *Batch) RawResponse() *kvpb.BatchResponse {
+	return b.response
+}
+
+func (b *Batch) appendReqs(args ...kvpb.Request) {
+	for _, args := range args {
+		b.reqs = append(b.reqs, kvpb.RequestUnion{})
+		b.reqs[len(b.reqs)-1].MustSetInner(args)
+	}
+}
+
+// initResult appends a result for an operation made up of the given number
+// of requests. A non-nil err records an error encountered while constructing
+// the operation; such a batch is not sent.
+func (b *Batch) initResult(calls int, err error) {
+	if b.Results == nil {
+		b.Results = b.resultsBuf[:0]
+	}
+	b.Results = append(b.Results, Result{calls: calls, Err: err})
+}
+
+// prepare returns the first error encountered while constructing the batch,
+// if any.
+func (b *Batch) prepare() error {
+	for _, r := range b.Results {
+		if r.Err != nil {
+			return r.Err
+		}
+	}
+	return nil
+}
+
+// fillResults walks through the results and updates them either with the
+// data or error which was the result of running the batch previously.
+func (b *Batch) fillResults(ctx context.Context) {
+	offset := 0
+	for i := range b.Results {
+		result := &b.Results[i]
+
+		for k := 0; k < result.calls; k++ {
+			args := b.reqs[offset+k].GetInner()
+
+			var reply kvpb.Response
+			// It's possible that result.Err was populated early, for example
+			// when PutProto is called and the proto marshaling errored out.
+			// In that case, we don't want to mutate this result's error
+			// further.
+			if result.Err == nil {
+				// The outcome of each result is that of the batch as a whole.
+				result.Err = b.pErr.GoError()
+				if result.Err == nil {
+					reply = b.response.Responses[offset+k].GetInner()
+				}
+			}
+
+			switch req := args.(type) {
+			case *kvpb.GetRequest:
+				row := KeyValue{Key: req.Key}
+				if result.Err == nil {
+					row.Value = reply.(*kvpb.GetResponse).Value
+				}
+				result.Rows = append(result.Rows, row)
+			case *kvpb.PutRequest:
+				row := KeyValue{Key: req.Key}
+				if result.Err == nil {
+					row.Value = &req.Value
+				}
+				result.Rows = append(result.Rows, row)
+			case *kvpb.DeleteRequest:
+				if result.Err == nil && reply.(*kvpb.DeleteResponse).FoundKey {
+					result.Keys = append(result.Keys, req.Key)
+				}
+			case *kvpb.ScanRequest:
+				if result.Err == nil {
+					rows := reply.(*kvpb.ScanResponse).Rows
+					for j := range rows {
+						result.Rows = append(result.Rows, KeyValue{
+							Key:   rows[j].Key,
+							Value: &rows[j].Value,
+						})
+					}
+				}
+			}
+		}
+		offset += result.calls
+	}
 }
 
 // Result holds the result for a single DB or Txn operation (e.g. Get, Put,
@@ -90,3 +388,52 @@ type KeyValue struct {
 	Key   roachpb.Key
 	Value *roachpb.Value
 }
+
+// getOneRow returns the single row of the single result of the batch, or the
+// error with which the batch failed.
+func getOneRow(runErr error, b *Batch) (KeyValue, error) {
+	if runErr != nil {
+		return KeyValue{}, runErr
+	}
+	return b.Results[0].Rows[0], nil
+}
+
+// marshalKey converts the key argument of a Batch operation into a
+// roachpb.Key.
+func marshalKey(k interface{}) (roachpb.Key, error) {
+	switch t := k.(type) {
+	case string:
+		return roachpb.Key(t), nil
+	case roachpb.Key:
+		return t, nil
+	case []byte:
+		return roachpb.Key(t), nil
+	}
+	return nil, fmt.Errorf("unable to marshal key: %T %q", k, k)
+}
+
+// marshalValue converts the value argument of a Batch operation into a
+// roachpb.Value. Values of types without a dedicated encoding are marshaled
+// as protos.
+func marshalValue(v interface{}) (roachpb.Value, error) {
+	var r roachpb.Value
+	switch t := v.(type) {
+	case *roachpb.Value:
+		return *t, nil
+	case roachpb.Value:
+		return t, nil
+	case string:
+		r.SetString(t)
+	case []byte:
+		r.SetBytes(t)
+	case int:
+		r.SetInt(int64(t))
+	case int64:
+		r.SetInt(t)
+	default:
+		if err := r.SetProto(t); err != nil {
+			return r, err
+		}
+	}
+	return r, nil
+}
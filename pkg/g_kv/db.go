@@ -2,6 +2,10 @@ package kv
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
 	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
 	"github.com/dborchard/tiny_crdb/pkg/z_util/stop"
 )
@@ -32,6 +36,111 @@ func NewDBWithContext(factory TxnSenderFactory, clock *hlc.Clock, ctx DBContext)
 	}
 }
 
+// Clock returns the DB's hlc.Clock.
+func (db *DB) Clock() *hlc.Clock {
+	return db.clock
+}
+
+// NonTransactionalSender returns a Sender that can be used for sending
+// non-transactional requests.
+func (db *DB) NonTransactionalSender() Sender {
+	return db.factory.NonTransactionalSender()
+}
+
+// Run executes the operations queued up within a batch. Before executing any
+// of the operations the batch is first checked to see if there were any errors
+// during its construction (e.g. failure to marshal a proto message).
+//
+// The operations within a batch are run in parallel and the order is
+// non-deterministic. It is an unspecified behavior to modify and retrieve the
+// same key within a batch.
+//
+// Upon completion, Batch.Results will contain the results for each
+// operation. The order of the results matches the order the operations were
+// added to the batch.
+func (db *DB) Run(ctx context.Context, b *Batch) error {
+	return sendAndFill(ctx, db.send, b)
+}
+
+// AdminSplit splits the range at splitKey. The split key must be a valid
+// split key which is not the start key of its range. The new range may not be
+// merged back into its left neighbour by the merge queue until the
+// expiration time; see kvpb.AdminSplitRequest.
+//
+// splitKey can be either a byte slice or a string.
+func (db *DB) AdminSplit(
+	ctx context.Context, splitKey interface{}, expirationTime hlc.Timestamp,
+) error {
+	b := &Batch{}
+	b.adminSplit(splitKey, expirationTime)
+	return db.Run(ctx, b)
+}
+
+// AdminMerge merges the range containing key and the subsequent range. After
+// the merge operation is complete, the range containing key will contain all
+// of the key/value pairs of the subsequent range and the subsequent range
+// will no longer exist.
+//
+// key can be either a byte slice or a string.
+func (db *DB) AdminMerge(ctx context.Context, key interface{}) error {
+	b := &Batch{}
+	b.adminMerge(key)
+	return db.Run(ctx, b)
+}
+
+// AdminTransferLease transfers the lease of the range containing key to the
+// replica of the range on the target store. The transfer is performed by the
+// current leaseholder; see kvpb.AdminTransferLeaseRequest.
+//
+// key can be either a byte slice or a string.
+func (db *DB) AdminTransferLease(
+	ctx context.Context, key interface{}, target roachpb.StoreID,
+) error {
+	b := &Batch{}
+	b.adminTransferLease(key, target)
+	return db.Run(ctx, b)
+}
+
+// AdminChangeReplicas adds or removes a set of replicas for a range. The
+// range containing key must have the expected descriptor, and the changes
+// are made through a joint configuration; see
+// kvpb.AdminChangeReplicasRequest. The descriptor of the range once the
+// changes have been made is returned.
+func (db *DB) AdminChangeReplicas(
+	ctx context.Context,
+	key interface{},
+	expDesc roachpb.RangeDescriptor,
+	chgs []kvpb.ReplicationChange,
+) (*roachpb.RangeDescriptor, error) {
+	b := &Batch{}
+	b.adminChangeReplicas(key, expDesc, chgs)
+	if err := db.Run(ctx, b); err != nil {
+		return nil, err
+	}
+	responses := b.RawResponse().Responses
+	if len(responses) == 0 {
+		return nil, errors.New("unexpected empty responses for AdminChangeReplicas")
+	}
+	resp, ok := responses[0].GetInner().(*kvpb.AdminChangeReplicasResponse)
+	if !ok {
+		return nil, fmt.Errorf("unexpected response of type %T for AdminChangeReplicas",
+			responses[0].GetInner())
+	}
+	desc := resp.Desc
+	return &desc, nil
+}
+
+// send runs the specified calls synchronously in a single batch and returns
+// any errors. Returns (nil, nil) for an empty batch.
+func (db *DB) send(
+	ctx context.Context, ba *kvpb.BatchRequest,
+) (*kvpb.BatchResponse, *kvpb.Error) {
+	if len(ba.Requests) == 0 {
+		return nil, nil
+	}
+	return db.NonTransactionalSender().Send(ctx, ba)
+}
+
 func (db *DB) Txn(ctx context.Context, retryable func(context.Context, *Txn) error) error {
 	return db.TxnWithAdmissionControl(ctx, retryable)
 }
@@ -2,26 +2,169 @@ package kvcoord
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	keys "github.com/dborchard/tiny_crdb/pkg/g_keys"
+	kv "github.com/dborchard/tiny_crdb/pkg/g_kv"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvclient/rangecache"
 	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/closedts"
+	"github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/stop"
+	"time"
 )
 
+const (
+	// defaultRangeLookupPrefetchCount is the number of descriptors of the
+	// ranges following the one containing a looked up key that are
+	// prefetched into the range cache.
+	defaultRangeLookupPrefetchCount = 8
+	// maxRangeKeyMismatchRetries is the number of times a partial batch is
+	// retried after a RangeKeyMismatchError before the error is returned to
+	// the client. Each retry follows a refresh of the range cache, so in
+	// the absence of concurrent splits and merges a single retry suffices.
+	maxRangeKeyMismatchRetries = 10
+	// sendErrorInitialBackoff and sendErrorMaxBackoff bound the backoff
+	// between the attempts to send a batch to a range none of whose replicas
+	// served it.
+	sendErrorInitialBackoff = 10 * time.Millisecond
+	sendErrorMaxBackoff     = time.Second
+)
+
+// FirstRangeProvider is capable of providing DistSender with the descriptor
+// of the first range in the cluster, which holds the meta1 addressing
+// records and therefore cannot itself be looked up through them.
+type FirstRangeProvider interface {
+	// GetFirstRangeDescriptor returns the RangeDescriptor for the first
+	// range in the cluster.
+	GetFirstRangeDescriptor() (*roachpb.RangeDescriptor, error)
+}
+
+// DistSenderConfig holds configuration and auxiliary objects that can be
+// passed to NewDistSender.
+type DistSenderConfig struct {
+	Clock   *hlc.Clock
+	Stopper *stop.Stopper
+	// FirstRangeProvider provides the descriptor of the first range. It is
+	// required unless RangeDescriptorDB is set.
+	FirstRangeProvider FirstRangeProvider
+	// RangeDescriptorDB, if set, is used to look up range descriptors
+	// instead of the meta addressing records.
+	RangeDescriptorDB rangecache.RangeDescriptorDB
+	// TransportFactory creates the Transports used to send requests to the
+	// replicas of a range.
+	TransportFactory TransportFactory
+	// RangeDescriptorCacheSize is the number of descriptors held by the
+	// range cache. If zero, rangecache.DefaultRangeCacheSize is used.
+	RangeDescriptorCacheSize int
+	// RangeLookupPrefetchCount is the number of descriptors prefetched into
+	// the range cache on every lookup. If zero,
+	// defaultRangeLookupPrefetchCount is used.
+	RangeLookupPrefetchCount int64
+	// NodeIDGetter returns the ID of the node of the DistSender, or zero
+	// while it is unknown. Follower reads are sent to the replica of the
+	// node, if any.
+	NodeIDGetter func() roachpb.NodeID
+	// FollowerReadLag is the staleness of the reads which are expected to
+	// be served by any replica, as follower reads. If zero, the lag of the
+	// default closed timestamps is used.
+	FollowerReadLag time.Duration
+}
+
 // A DistSender provides methods to access Cockroach's monolithic,
 // distributed key value store. Each method invocation triggers a
 // lookup or lookups to find replica metadata for implicated key
 // ranges. RPCs are sent to one or more of the replicas to satisfy
 // the method invocation.
 type DistSender struct {
+	clock   *hlc.Clock
+	stopper *stop.Stopper
+	// firstRangeProvider provides the descriptor of the first range.
+	firstRangeProvider FirstRangeProvider
+	// rangeCache caches the descriptors of the ranges, keyed by their
+	// spans.
+	rangeCache *rangecache.RangeCache
+	// rangeLookupPrefetchCount is the number of descriptors prefetched on
+	// every range lookup.
+	rangeLookupPrefetchCount int64
+	transportFactory         TransportFactory
+	// nodeIDGetter returns the ID of the node of the DistSender, if known.
+	nodeIDGetter func() roachpb.NodeID
+	// followerReadLag is the staleness of the reads which are sent to the
+	// closest replica rather than to the leaseholder.
+	followerReadLag time.Duration
 }
 
+var _ kv.Sender = &DistSender{}
+var _ rangecache.RangeDescriptorDB = &DistSender{}
+
 // NewDistSender returns a batch.Sender instance which connects to the
-// Cockroach cluster via the supplied gossip instance. Supplying a
-// DistSenderContext or the fields within is optional. For omitted values, sane
-// defaults will be used.
-func NewDistSender() *DistSender {
-	ds := &DistSender{}
+// Cockroach cluster through the supplied TransportFactory, locating ranges
+// through the meta addressing records reachable from the first range. For
+// omitted optional fields of the DistSenderConfig, sane defaults will be
+// used.
+func NewDistSender(cfg DistSenderConfig) *DistSender {
+	ds := &DistSender{
+		clock:                    cfg.Clock,
+		stopper:                  cfg.Stopper,
+		firstRangeProvider:       cfg.FirstRangeProvider,
+		rangeLookupPrefetchCount: cfg.RangeLookupPrefetchCount,
+		transportFactory:         cfg.TransportFactory,
+		nodeIDGetter:             cfg.NodeIDGetter,
+		followerReadLag:          cfg.FollowerReadLag,
+	}
+	if ds.rangeLookupPrefetchCount == 0 {
+		ds.rangeLookupPrefetchCount = defaultRangeLookupPrefetchCount
+	}
+	if ds.followerReadLag == 0 {
+		ds.followerReadLag = closedts.FollowerReadLag(
+			closedts.DefaultTargetDuration, closedts.DefaultSideTransportCloseInterval)
+	}
+	var rdb rangecache.RangeDescriptorDB = ds
+	if cfg.RangeDescriptorDB != nil {
+		rdb = cfg.RangeDescriptorDB
+	}
+	ds.rangeCache = rangecache.NewRangeCache(rdb, cfg.RangeDescriptorCacheSize)
 	return ds
 }
 
+// RangeDescriptorCache gives access to the DistSender's range cache.
+func (ds *DistSender) RangeDescriptorCache() *rangecache.RangeCache {
+	return ds.rangeCache
+}
+
+// RangeLookup implements the RangeDescriptorDB interface.
+//
+// It uses kv.RangeLookup to perform a lookup scan for the provided key,
+// using the DistSender itself as the kv.Sender. This means that the scan
+// will recurse into DistSender, which will in turn use the range cache again
+// to lookup the RangeDescriptor necessary to retrieve the meta record.
+func (ds *DistSender) RangeLookup(
+	ctx context.Context, key roachpb.RKey,
+) ([]roachpb.RangeDescriptor, error) {
+	// In this case, the requested key is stored in the cluster's first
+	// range. Return the first range, which is always provided and not
+	// queried from the datastore.
+	if keys.RangeMetaKey(key).Equal(roachpb.RKeyMin) {
+		desc, err := ds.FirstRange()
+		if err != nil {
+			return nil, err
+		}
+		return []roachpb.RangeDescriptor{*desc}, nil
+	}
+	return kv.RangeLookup(ctx, ds, key.AsRawKey(), ds.rangeLookupPrefetchCount)
+}
+
+// FirstRange returns the RangeDescriptor for the first range in the
+// cluster, using the FirstRangeProvider.
+func (ds *DistSender) FirstRange() (*roachpb.RangeDescriptor, error) {
+	if ds.firstRangeProvider == nil {
+		return nil, errors.New("range descriptor lookup not supported: no first range provider")
+	}
+	return ds.firstRangeProvider.GetFirstRangeDescriptor()
+}
+
 // Send implements the batch.Sender interface. It subdivides the Batch
 // into batches admissible for sending (preventing certain illegal
 // mixtures of requests), executes each individual part (which may
@@ -32,6 +175,570 @@ func NewDistSender() *DistSender {
 func (ds *DistSender) Send(
 	ctx context.Context, ba *kvpb.BatchRequest,
 ) (*kvpb.BatchResponse, *kvpb.Error) {
-	//TODO implement me
-	panic("implement me")
+	if err := ds.initAndVerifyBatch(ba); err != nil {
+		return nil, kvpb.NewError(err)
+	}
+	if ba.Txn == nil && ba.Timestamp.IsEmpty() && ds.clock != nil {
+		// Non-transactional batches that span ranges are evaluated at a
+		// single timestamp, chosen here, so that they observe a consistent
+		// snapshot across ranges.
+		ba = ba.ShallowCopy()
+		ba.Timestamp = ds.clock.Now()
+	}
+
+	rs, err := keys.Range(ba.Requests)
+	if err != nil {
+		return nil, kvpb.NewError(err)
+	}
+	br, pErr := ds.divideAndSendBatchToRanges(ctx, ba, rs)
+	if pErr != nil {
+		return nil, pErr
+	}
+	return br, nil
+}
+
+// initAndVerifyBatch verifies that the batch can be sent.
+func (ds *DistSender) initAndVerifyBatch(ba *kvpb.BatchRequest) error {
+	if len(ba.Requests) == 0 {
+		return errors.New("empty batch")
+	}
+	if ba.MaxSpanRequestKeys != 0 {
+		// Verify that the batch contains only requests that can be resumed
+		// after the limit is reached.
+		for _, req := range ba.Requests {
+			switch inner := req.GetInner(); inner.(type) {
+			case *kvpb.ScanRequest, *kvpb.GetRequest:
+			default:
+				return fmt.Errorf("batch with limit contains %s request", inner.Method())
+			}
+		}
+	}
+	return nil
+}
+
+// partialBatch is the part of a batch that is sent to a single range.
+type partialBatch struct {
+	ba   *kvpb.BatchRequest
+	rs   roachpb.RSpan
+	desc *roachpb.RangeDescriptor
+	// positions maps the requests of the partial batch to their positions
+	// in the batch that it was truncated from.
+	positions []int
+}
+
+// divideAndSendBatchToRanges sends the supplied batch to all of the ranges
+// which comprise the span specified by rs. The batch request is trimmed
+// against each range which is part of the span and sent to that range; the
+// parts are sent in parallel, unless the batch has a key limit, in which
+// case they are sent in key order until the limit is exhausted. The
+// responses are merged into a single response, with the responses of every
+// request in the order of the original batch.
+//
+// If the batch contains an EndTxn request that does not perform a parallel
+// commit, the part containing it is sent last, once all other parts have
+// succeeded, so that the transaction is only committed after all of its
+// writes have been performed.
+func (ds *DistSender) divideAndSendBatchToRanges(
+	ctx context.Context, ba *kvpb.BatchRequest, rs roachpb.RSpan,
+) (*kvpb.BatchResponse, *kvpb.Error) {
+	desc, err := ds.rangeCache.Lookup(ctx, rs.Key)
+	if err != nil {
+		return nil, kvpb.NewError(err)
+	}
+	// Fast path: the batch is contained in a single range.
+	if desc.ContainsKeyRange(rs.Key, rs.EndKey) {
+		return ds.sendPartialBatch(ctx, ba, rs, desc)
+	}
+
+	br := &kvpb.BatchResponse{}
+	br.Responses = make([]kvpb.ResponseUnion, len(ba.Requests))
+	if ba.MaxSpanRequestKeys != 0 {
+		return ds.sendLimitedBatchToRanges(ctx, ba, rs, desc, br)
+	}
+
+	// Divide the batch by range.
+	var parts []partialBatch
+	for {
+		curRS, ok := rs.Intersect(desc.RSpan())
+		if !ok {
+			return nil, kvpb.NewErrorf("range %s does not intersect batch span %s", desc, rs)
+		}
+		truncReqs, positions, err := truncate(ba.Requests, curRS)
+		if err != nil {
+			return nil, kvpb.NewError(err)
+		}
+		if len(positions) > 0 {
+			truncBA := ba.ShallowCopy()
+			truncBA.Requests = truncReqs
+			parts = append(parts, partialBatch{ba: truncBA, rs: curRS, desc: desc, positions: positions})
+		}
+		if !desc.EndKey.Less(rs.EndKey) {
+			break
+		}
+		if desc, err = ds.rangeCache.Lookup(ctx, desc.EndKey); err != nil {
+			return nil, kvpb.NewError(err)
+		}
+	}
+
+	// Pull out the part containing the EndTxn, if it must be sent last.
+	var last *partialBatch
+	if et, ok := ba.GetArg(kvpb.EndTxn); ok && !et.(*kvpb.EndTxnRequest).IsParallelCommit() {
+		for i := range parts {
+			if _, ok := parts[i].ba.GetArg(kvpb.EndTxn); ok {
+				lastPart := parts[i]
+				last = &lastPart
+				parts = append(parts[:i:i], parts[i+1:]...)
+				break
+			}
+		}
+	}
+
+	// Send the parts in parallel.
+	type response struct {
+		br   *kvpb.BatchResponse
+		pErr *kvpb.Error
+	}
+	responseChs := make([]chan response, len(parts))
+	for i := range parts {
+		part := parts[i]
+		ch := make(chan response, 1)
+		responseChs[i] = ch
+		send := func(ctx context.Context) {
+			br, pErr := ds.sendPartialBatch(ctx, part.ba, part.rs, part.desc)
+			ch <- response{br: br, pErr: pErr}
+		}
+		if i == len(parts)-1 || ds.stopper == nil ||
+			ds.stopper.RunAsyncTask(ctx, "kv.DistSender: sending partial batch", send) != nil {
+			// Send the last part, or all parts if async tasks cannot be
+			// run, on this goroutine.
+			send(ctx)
+		}
+	}
+	// Wait for all the parts to complete, even in case of errors, so that
+	// the batch is not used after returning.
+	var pErr *kvpb.Error
+	for i, ch := range responseChs {
+		resp := <-ch
+		if pErr != nil {
+			continue
+		}
+		if resp.pErr != nil {
+			pErr = remapError(resp.pErr, parts[i].positions)
+			continue
+		}
+		if err := br.Combine(resp.br, parts[i].positions); err != nil {
+			pErr = kvpb.NewError(err)
+		}
+	}
+	if pErr != nil {
+		return nil, pErr
+	}
+
+	if last != nil {
+		// All the writes succeeded; send the EndTxn. The transaction's
+		// timestamp may have been pushed by the other parts.
+		lastBA := last.ba
+		if br.Txn != nil {
+			lastBA = lastBA.ShallowCopy()
+			lastBA.Txn = br.Txn
+		}
+		lastBR, pErr := ds.sendPartialBatch(ctx, lastBA, last.rs, last.desc)
+		if pErr != nil {
+			return nil, remapError(pErr, last.positions)
+		}
+		if err := br.Combine(lastBR, last.positions); err != nil {
+			return nil, kvpb.NewError(err)
+		}
+	}
+	return br, nil
+}
+
+// sendLimitedBatchToRanges sends a batch with a key limit to the ranges
+// spanned by rs, one range after the other in key order, starting with the
+// provided descriptor of the first of them. The limit is decreased by the
+// number of keys returned from each range; once it is exhausted, the
+// remaining requests are given resume spans instead of being sent.
+func (ds *DistSender) sendLimitedBatchToRanges(
+	ctx context.Context,
+	ba *kvpb.BatchRequest,
+	rs roachpb.RSpan,
+	desc *roachpb.RangeDescriptor,
+	br *kvpb.BatchResponse,
+) (*kvpb.BatchResponse, *kvpb.Error) {
+	remaining := ba.MaxSpanRequestKeys
+	for {
+		curRS, ok := rs.Intersect(desc.RSpan())
+		if !ok {
+			return nil, kvpb.NewErrorf("range %s does not intersect batch span %s", desc, rs)
+		}
+		truncReqs, positions, err := truncate(ba.Requests, curRS)
+		if err != nil {
+			return nil, kvpb.NewError(err)
+		}
+		resumed := false
+		if len(positions) > 0 {
+			truncBA := ba.ShallowCopy()
+			truncBA.Requests = truncReqs
+			truncBA.MaxSpanRequestKeys = remaining
+			partBR, pErr := ds.sendPartialBatch(ctx, truncBA, curRS, desc)
+			if pErr != nil {
+				return nil, remapError(pErr, positions)
+			}
+			for _, resp := range partBR.Responses {
+				h := resp.GetInner().Header()
+				remaining -= h.NumKeys
+				if h.ResumeSpan != nil {
+					resumed = true
+				}
+			}
+			if err := br.Combine(partBR, positions); err != nil {
+				return nil, kvpb.NewError(err)
+			}
+		}
+		if !desc.EndKey.Less(rs.EndKey) {
+			break
+		}
+		if resumed || remaining <= 0 {
+			// The limit was reached; the rest of the batch is skipped.
+			fillSkippedResponses(ba, br, desc.EndKey)
+			return br, nil
+		}
+		if desc, err = ds.rangeCache.Lookup(ctx, desc.EndKey); err != nil {
+			return nil, kvpb.NewError(err)
+		}
+	}
+	fillSkippedResponses(ba, br, rs.EndKey)
+	return br, nil
+}
+
+// fillSkippedResponses fills in responses and ResumeSpans for requests
+// when a batch finished without fully processing the requested key spans
+// for (some of) the requests in the batch. This can happen when processing
+// has met the batch key limit. nextKey is the first key that was not
+// processed.
+func fillSkippedResponses(ba *kvpb.BatchRequest, br *kvpb.BatchResponse, nextKey roachpb.RKey) {
+	// Some requests might have no response at all if they were skipped.
+	for i := range br.Responses {
+		if br.Responses[i].GetInner() == nil {
+			br.Responses[i].MustSetInner(kvpb.CreateReply(ba.Requests[i].GetInner()))
+		}
+	}
+	// Set or correct the ResumeSpan as necessary.
+	for i, resp := range br.Responses {
+		req := ba.Requests[i].GetInner()
+		hdr := resp.GetInner().Header()
+		maybeSetResumeSpan(req, &hdr, nextKey)
+		resp.GetInner().SetHeader(hdr)
+	}
+}
+
+// maybeSetResumeSpan sets or corrects the ResumeSpan in the response header,
+// if necessary. nextKey is the first key that was not processed.
+func maybeSetResumeSpan(req kvpb.Request, hdr *kvpb.ResponseHeader, nextKey roachpb.RKey) {
+	if _, ok := req.(*kvpb.GetRequest); ok {
+		// This is a Get request. There are three possibilities:
+		//
+		//  1. The request was completed. In this case we don't want a
+		//     ResumeSpan.
+		//
+		//  2. The request was not completed but it was part of a request
+		//     that made it to a kvserver (i.e. it was part of the last range
+		//     we operated on). In this case the ResumeSpan should be set by
+		//     the kvserver and we can leave it alone.
+		//
+		//  3. The request was not completed and was not sent to a kvserver
+		//     (it was beyond the last range we operated on). In this case we
+		//     need to set the ResumeSpan here.
+		if hdr.ResumeSpan != nil {
+			// Case 2.
+			return
+		}
+		key := req.Header().Span().Key
+		if addr, err := keys.Addr(key); err == nil && !addr.Less(nextKey) {
+			// The key is beyond the keys that were processed.
+			hdr.ResumeSpan = &roachpb.Span{Key: key}
+		}
+		return
+	}
+	if !kvpb.IsRange(req) {
+		return
+	}
+
+	origSpan := req.Header().Span()
+	if hdr.ResumeSpan != nil {
+		// The ResumeSpan.Key might be set to the StartKey of a range;
+		// correctly set it to the Key of the original request span if the
+		// resume span is outside the original request span.
+		if hdr.ResumeSpan.Key.Compare(origSpan.Key) < 0 {
+			hdr.ResumeSpan.Key = origSpan.Key
+		}
+		// The ResumeSpan.EndKey might be set to the EndKey of a range
+		// because that's what a kvserver will set it to.
+		hdr.ResumeSpan.EndKey = origSpan.EndKey
+	} else if nextKey.AsRawKey().Compare(origSpan.EndKey) < 0 {
+		// Some keys have yet to be processed.
+		hdr.ResumeSpan = &origSpan
+		if nextKey.AsRawKey().Compare(origSpan.Key) > 0 {
+			// The original span has been partially processed.
+			hdr.ResumeSpan.Key = nextKey.AsRawKey()
+		}
+	}
+}
+
+// remapError remaps the index of an error returned for a partial batch to
+// the index of the corresponding request in the batch that the partial batch
+// was truncated from.
+func remapError(pErr *kvpb.Error, positions []int) *kvpb.Error {
+	if pErr.Index != nil && int(pErr.Index.Index) < len(positions) {
+		pErr.SetErrorIndex(int32(positions[pErr.Index.Index]))
+	}
+	return pErr
+}
+
+// sendPartialBatch sends the supplied batch to the range specified by desc,
+// which must contain the span rs. If the range rejects the batch with a
+// RangeKeyMismatchError, the range cache is updated with the descriptors
+// returned by the error, and the batch is retried: it is re-divided into
+// parts if the span no longer fits in a single range, for instance because
+// the range was split. A RangeNotFoundError, returned by a range which was
+// merged away, is retried after a fresh lookup.
+//
+// A batch which could not be delivered to any replica of the range, for
+// instance while the range elects a leader, is retried with exponential
+// backoff after a fresh lookup, until the context is canceled.
+func (ds *DistSender) sendPartialBatch(
+	ctx context.Context, ba *kvpb.BatchRequest, rs roachpb.RSpan, desc *roachpb.RangeDescriptor,
+) (*kvpb.BatchResponse, *kvpb.Error) {
+	backoff := sendErrorInitialBackoff
+	for attempt := 0; ; attempt++ {
+		if desc == nil {
+			var err error
+			if desc, err = ds.rangeCache.Lookup(ctx, rs.Key); err != nil {
+				return nil, kvpb.NewError(err)
+			}
+			if !desc.ContainsKeyRange(rs.Key, rs.EndKey) {
+				// The span is now split across several ranges.
+				return ds.divideAndSendBatchToRanges(ctx, ba, rs)
+			}
+		}
+
+		br, pErr := ds.sendToReplicas(ctx, ba, desc)
+		if pErr == nil {
+			return br, nil
+		}
+		var sErr *sendError
+		if errors.As(pErr.GoError(), &sErr) {
+			// The replicas may have moved, or the range may be electing a
+			// leader.
+			ds.rangeCache.Evict(desc)
+			desc = nil
+			select {
+			case <-time.After(backoff):
+			case <-ds.stopper.ShouldQuiesce():
+				return nil, pErr
+			case <-ctx.Done():
+				return nil, kvpb.NewError(ctx.Err())
+			}
+			if backoff *= 2; backoff > sendErrorMaxBackoff {
+				backoff = sendErrorMaxBackoff
+			}
+			continue
+		}
+		if attempt >= maxRangeKeyMismatchRetries {
+			return nil, pErr
+		}
+		switch tErr := pErr.GetDetail().(type) {
+		case *kvpb.RangeKeyMismatchError:
+			// The range cache is stale. Evict the descriptor that the batch
+			// was routed with, and insert the descriptors that the replica
+			// returned, which are at least as fresh.
+			ds.rangeCache.Evict(desc)
+			descs := make([]roachpb.RangeDescriptor, len(tErr.Ranges))
+			for i, ri := range tErr.Ranges {
+				descs[i] = ri.Desc
+			}
+			ds.rangeCache.Insert(descs...)
+		case *kvpb.RangeNotFoundError:
+			// The range no longer exists, for instance because it was merged
+			// into its left neighbour. Evict the descriptor and look the
+			// span up again.
+			ds.rangeCache.Evict(desc)
+		default:
+			return nil, pErr
+		}
+		desc = nil
+	}
+}
+
+// sendToReplicas sends a batch to the replicas of the range specified by
+// desc, trying them in the order given by the Transport until one of them
+// returns a response.
+//
+// Only the leaseholder of the range serves requests, and the cached
+// leaseholder is tried first. A replica which does not hold the lease returns
+// a NotLeaseHolderError, in which case the leaseholder is cached and tried
+// next if the error names it, and the next replica is tried otherwise; the
+// same goes for the leader named by a NotLeaderError. A replica which was
+// removed from the range returns a RangeNotFoundError, and the next replica
+// is tried. The replica which serves the batch is cached as the leaseholder.
+// If no replica serves the batch, a sendError is returned.
+//
+// A batch which any replica is expected to serve as a follower read is sent
+// to the closest replica instead: that of the DistSender's node, if any. It
+// is not cached as the leaseholder.
+//
+// The batch carries the clock reading of the DistSender's node, and the
+// clock is updated with that of the node which serves it. The batch fails if
+// that reading is too far ahead to be trusted.
+func (ds *DistSender) sendToReplicas(
+	ctx context.Context, ba *kvpb.BatchRequest, desc *roachpb.RangeDescriptor,
+) (*kvpb.BatchResponse, *kvpb.Error) {
+	if ds.transportFactory == nil {
+		return nil, kvpb.NewErrorf("no transport to send batch to range %s", desc)
+	}
+	transport, err := ds.transportFactory(desc.Replicas())
+	if err != nil {
+		return nil, kvpb.NewError(err)
+	}
+	ba = ba.ShallowCopy()
+	ba.RangeID = desc.RangeID
+	if lh, ok := ds.rangeCache.Leaseholder(desc.StartKey); ok {
+		transport.MoveToFront(lh)
+	}
+	followerRead := ds.canSendToFollower(ba)
+	if followerRead {
+		if local, ok := ds.localReplica(desc); ok {
+			transport.MoveToFront(local)
+		}
+	}
+
+	var lastErr error
+	// Redirections to the leaseholder are bounded, as replicas may point to
+	// each other while the lease changes hands.
+	redirects := 0
+	for !transport.IsExhausted() {
+		ba.Replica = transport.NextReplica()
+		if ds.clock != nil {
+			ba.Now = ds.clock.NowAsClockTimestamp()
+		}
+		br, err := transport.SendNext(ctx, ba)
+		if err != nil {
+			// The request could not be delivered; try the next replica.
+			lastErr = err
+			if ctx.Err() != nil {
+				return nil, kvpb.NewError(ctx.Err())
+			}
+			continue
+		}
+		if err := ds.updateClock(ctx, br); err != nil {
+			// The reply of a node whose clock is too far ahead is not
+			// trusted; the batch may have been evaluated all the same.
+			return nil, kvpb.NewError(err)
+		}
+		if br.Error != nil {
+			pErr := br.Error
+			br.Error = nil
+			switch tErr := pErr.GetDetail().(type) {
+			case *kvpb.NotLeaseHolderError:
+				lastErr = tErr
+				if tErr.Lease != nil && redirects < len(desc.InternalReplicas) {
+					ds.rangeCache.UpdateLease(desc.StartKey, *tErr.Lease)
+					if transport.MoveToFront(tErr.Lease.Replica) {
+						redirects++
+					}
+				}
+				continue
+			case *kvpb.NotLeaderError:
+				lastErr = tErr
+				if tErr.Leader != nil && redirects < len(desc.InternalReplicas) &&
+					transport.MoveToFront(*tErr.Leader) {
+					redirects++
+				}
+				continue
+			case *kvpb.RangeNotFoundError:
+				if len(desc.InternalReplicas) > 1 {
+					lastErr = tErr
+					continue
+				}
+			}
+			return nil, pErr
+		}
+		if followerRead {
+			return br, nil
+		}
+		if lh, ok := ds.rangeCache.Leaseholder(desc.StartKey); !ok || lh.ReplicaID != ba.Replica.ReplicaID {
+			ds.rangeCache.UpdateLease(desc.StartKey, roachpb.Lease{Replica: ba.Replica})
+		}
+		return br, nil
+	}
+	return nil, kvpb.NewError(newSendError(
+		fmt.Sprintf("sending to all replicas of r%d failed; last error: %v", desc.RangeID, lastErr)))
+}
+
+// updateClock updates the clock of the DistSender with the clock reading of
+// the node which served the batch, or returned an error. As in Store.Send, a
+// reading further ahead of the physical clock than the maximum clock offset
+// is rejected, and leaves the clock untouched.
+func (ds *DistSender) updateClock(ctx context.Context, br *kvpb.BatchResponse) error {
+	if ds.clock == nil {
+		return nil
+	}
+	now := br.Now
+	if br.Error != nil {
+		now = br.Error.Now
+	}
+	if now.IsEmpty() {
+		return nil
+	}
+	return ds.clock.UpdateAndCheckMaxOffset(ctx, now)
+}
+
+// canSendToFollower returns whether the batch is expected to be served by any
+// replica of its range, as a follower read: it is a read-only batch which
+// acquires no lock, of a transaction which wrote nothing, at a timestamp
+// which the closed timestamps of the ranges are expected to have reached.
+// Replicas which haven't closed the timestamp redirect the batch to the
+// leaseholder.
+func (ds *DistSender) canSendToFollower(ba *kvpb.BatchRequest) bool {
+	if ds.clock == nil || !ba.IsReadOnly() || ba.IsLocking() {
+		return false
+	}
+	ts := ba.Timestamp
+	if ba.Txn != nil {
+		if ba.Txn.IsLocking() {
+			return false
+		}
+		ts = ba.Txn.ReadTimestamp
+	}
+	return ts.LessEq(ds.clock.Now().Add(-ds.followerReadLag.Nanoseconds(), 0))
+}
+
+// localReplica returns the replica of the range on the DistSender's node, if
+// any.
+func (ds *DistSender) localReplica(desc *roachpb.RangeDescriptor) (roachpb.ReplicaDescriptor, bool) {
+	if ds.nodeIDGetter == nil {
+		return roachpb.ReplicaDescriptor{}, false
+	}
+	nodeID := ds.nodeIDGetter()
+	for _, repl := range desc.InternalReplicas {
+		if nodeID != 0 && repl.NodeID == nodeID {
+			return repl, true
+		}
+	}
+	return roachpb.ReplicaDescriptor{}, false
+}
+
+// sendError indicates that a batch could not be delivered to any of the
+// replicas of a range.
+type sendError struct {
+	message string
+}
+
+// newSendError creates a sendError.
+func newSendError(msg string) *sendError {
+	return &sendError{message: msg}
+}
+
+func (s *sendError) Error() string {
+	return "failed to send RPC: " + s.message
 }
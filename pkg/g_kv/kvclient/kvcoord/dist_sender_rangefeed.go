@@ -0,0 +1,278 @@
+package kvcoord
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	keys "github.com/dborchard/tiny_crdb/pkg/g_keys"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"sync"
+	"time"
+)
+
+// RangeFeed divides a RangeFeed request on range boundaries and establishes a
+// RangeFeed to each of the individual ranges. It streams back results on the
+// provided channel until the context is canceled or a non-retryable error
+// occurs, which is returned.
+//
+// The rangefeed of a range is re-established from the last checkpoint that
+// it emitted when it is disconnected: when the range is split or merged, the
+// span of the rangefeed is divided again on the new range boundaries. The
+// values emitted above that checkpoint may therefore be emitted more than
+// once, and the checkpoints of the ranges of the span may go backwards as the
+// rangefeeds of new ranges catch up. Each checkpoint covers the span of a
+// single rangefeed.
+func (ds *DistSender) RangeFeed(
+	ctx context.Context,
+	spans []roachpb.Span,
+	startAfter hlc.Timestamp,
+	withDiff bool,
+	eventCh chan<- *kvpb.RangeFeedEvent,
+) error {
+	if len(spans) == 0 {
+		return errors.New("expected at least 1 span, got none")
+	}
+	g := newRangeFeedGroup(ctx)
+	for _, span := range spans {
+		rs, err := keys.SpanAddr(span)
+		if err != nil {
+			g.cancel()
+			return err
+		}
+		g.goCtx(func(ctx context.Context) error {
+			return ds.divideAndSendRangeFeedToRanges(ctx, g, rs, startAfter, withDiff, eventCh)
+		})
+	}
+	return g.wait()
+}
+
+// divideAndSendRangeFeedToRanges establishes a partial rangefeed to each of
+// the ranges which the span overlaps, in the group.
+func (ds *DistSender) divideAndSendRangeFeedToRanges(
+	ctx context.Context,
+	g *rangeFeedGroup,
+	rs roachpb.RSpan,
+	startAfter hlc.Timestamp,
+	withDiff bool,
+	eventCh chan<- *kvpb.RangeFeedEvent,
+) error {
+	nextRS := rs
+	for {
+		desc, err := ds.rangeCache.Lookup(ctx, nextRS.Key)
+		if err != nil {
+			return err
+		}
+		curRS, ok := nextRS.Intersect(desc.RSpan())
+		if !ok {
+			return fmt.Errorf("range %s does not intersect rangefeed span %s", desc, nextRS)
+		}
+		g.goCtx(func(ctx context.Context) error {
+			return ds.partialRangeFeed(ctx, g, curRS, startAfter, withDiff, desc, eventCh)
+		})
+		if !desc.EndKey.Less(nextRS.EndKey) {
+			return nil
+		}
+		nextRS.Key = desc.EndKey
+	}
+}
+
+// partialRangeFeed establishes a RangeFeed to the range specified by desc,
+// which must contain the span rs, and re-establishes it from its last
+// checkpoint whenever it is disconnected with a retryable error. If the
+// range no longer contains the span, for instance because it was split, the
+// span is divided again on the new range boundaries.
+func (ds *DistSender) partialRangeFeed(
+	ctx context.Context,
+	g *rangeFeedGroup,
+	rs roachpb.RSpan,
+	startAfter hlc.Timestamp,
+	withDiff bool,
+	desc *roachpb.RangeDescriptor,
+	eventCh chan<- *kvpb.RangeFeedEvent,
+) error {
+	span := rs.AsRawSpanWithNoLocals()
+	backoff := sendErrorInitialBackoff
+	for {
+		if desc == nil {
+			var err error
+			if desc, err = ds.rangeCache.Lookup(ctx, rs.Key); err != nil {
+				return err
+			}
+			if !desc.ContainsKeyRange(rs.Key, rs.EndKey) {
+				// The span is now split across several ranges.
+				return ds.divideAndSendRangeFeedToRanges(ctx, g, rs, startAfter, withDiff, eventCh)
+			}
+		}
+
+		pErr, err := ds.singleRangeFeed(ctx, span, &startAfter, withDiff, desc, eventCh)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err == nil {
+			switch tErr := pErr.GetDetail().(type) {
+			case *kvpb.RangeFeedRetryError:
+				// The range was split, merged or its replica was removed: its
+				// descriptor is stale. A slow consumer simply reconnects.
+				if tErr.Reason != kvpb.RangeFeedRetryError_REASON_SLOW_CONSUMER {
+					ds.rangeCache.Evict(desc)
+					desc = nil
+				}
+				continue
+			case *kvpb.RangeKeyMismatchError:
+				ds.rangeCache.Evict(desc)
+				descs := make([]roachpb.RangeDescriptor, len(tErr.Ranges))
+				for i, ri := range tErr.Ranges {
+					descs[i] = ri.Desc
+				}
+				ds.rangeCache.Insert(descs...)
+				desc = nil
+				continue
+			case *kvpb.RangeNotFoundError:
+				ds.rangeCache.Evict(desc)
+				desc = nil
+				continue
+			default:
+				return pErr.GoError()
+			}
+		}
+		// The rangefeed could not be established, or its stream was
+		// interrupted. Retry with exponential backoff after a fresh lookup.
+		ds.rangeCache.Evict(desc)
+		desc = nil
+		select {
+		case <-time.After(backoff):
+		case <-ds.stopper.ShouldQuiesce():
+			return errors.New("rangefeed: node quiescing")
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if backoff *= 2; backoff > sendErrorMaxBackoff {
+			backoff = sendErrorMaxBackoff
+		}
+	}
+}
+
+// singleRangeFeed establishes a RangeFeed to the range specified by desc,
+// trying its replicas in the order given by the Transport until one of them
+// serves it. The events of the rangefeed are sent on eventCh, and startAfter
+// is forwarded to the timestamps of its checkpoints.
+//
+// It returns the error with which the replica ended the rangefeed, or an
+// error if the rangefeed could not be established with any replica or was
+// interrupted.
+func (ds *DistSender) singleRangeFeed(
+	ctx context.Context,
+	span roachpb.Span,
+	startAfter *hlc.Timestamp,
+	withDiff bool,
+	desc *roachpb.RangeDescriptor,
+	eventCh chan<- *kvpb.RangeFeedEvent,
+) (*kvpb.Error, error) {
+	if ds.transportFactory == nil {
+		return nil, fmt.Errorf("no transport to establish rangefeed to range %s", desc)
+	}
+	transport, err := ds.transportFactory(desc.Replicas())
+	if err != nil {
+		return nil, err
+	}
+	if lh, ok := ds.rangeCache.Leaseholder(desc.StartKey); ok {
+		transport.MoveToFront(lh)
+	}
+	sink := &rangeFeedEventSink{ctx: ctx, send: func(event *kvpb.RangeFeedEvent) error {
+		if event.Checkpoint != nil {
+			startAfter.Forward(event.Checkpoint.ResolvedTS)
+		}
+		select {
+		case eventCh <- event:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}}
+
+	args := &kvpb.RangeFeedRequest{Span: span, WithDiff: withDiff}
+	args.RangeID = desc.RangeID
+	var lastErr error
+	for !transport.IsExhausted() {
+		args.Replica = transport.NextReplica()
+		args.Timestamp = *startAfter
+		pErr, err := transport.RangeFeedNext(ctx, args, sink)
+		if err != nil {
+			lastErr = err
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			continue
+		}
+		if pErr != nil {
+			if _, ok := pErr.GetDetail().(*kvpb.RangeNotFoundError); ok && len(desc.InternalReplicas) > 1 {
+				// The replica was removed from the range.
+				lastErr = pErr.GoError()
+				continue
+			}
+			return pErr, nil
+		}
+		return nil, newSendError(fmt.Sprintf("rangefeed to r%d ended without an error", desc.RangeID))
+	}
+	return nil, newSendError(
+		fmt.Sprintf("sending rangefeed to all replicas of r%d failed; last error: %v", desc.RangeID, lastErr))
+}
+
+// rangeFeedEventSink is a kvpb.RangeFeedEventSink which hands the events of a
+// rangefeed to a function.
+type rangeFeedEventSink struct {
+	ctx  context.Context
+	send func(*kvpb.RangeFeedEvent) error
+}
+
+var _ kvpb.RangeFeedEventSink = (*rangeFeedEventSink)(nil)
+
+// Context implements the kvpb.RangeFeedEventSink interface.
+func (s *rangeFeedEventSink) Context() context.Context {
+	return s.ctx
+}
+
+// Send implements the kvpb.RangeFeedEventSink interface.
+func (s *rangeFeedEventSink) Send(event *kvpb.RangeFeedEvent) error {
+	return s.send(event)
+}
+
+// rangeFeedGroup runs the partial rangefeeds of a RangeFeed call. The first
+// error returned by a partial rangefeed cancels the others.
+type rangeFeedGroup struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	once   sync.Once
+	err    error
+}
+
+func newRangeFeedGroup(ctx context.Context) *rangeFeedGroup {
+	g := &rangeFeedGroup{}
+	g.ctx, g.cancel = context.WithCancel(ctx)
+	return g
+}
+
+// goCtx runs f in a goroutine, with the context of the group.
+func (g *rangeFeedGroup) goCtx(f func(ctx context.Context) error) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		if err := f(g.ctx); err != nil {
+			g.once.Do(func() {
+				g.err = err
+				g.cancel()
+			})
+		}
+	}()
+}
+
+// wait waits for the goroutines of the group to return, and returns the first
+// error that one of them returned.
+func (g *rangeFeedGroup) wait() error {
+	g.wg.Wait()
+	g.cancel()
+	return g.err
+}
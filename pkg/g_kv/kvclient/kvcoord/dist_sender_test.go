@@ -0,0 +1,260 @@
+package kvcoord
+
+import (
+	"context"
+	keys "github.com/dborchard/tiny_crdb/pkg/g_keys"
+	kv "github.com/dborchard/tiny_crdb/pkg/g_kv"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	storage "github.com/dborchard/tiny_crdb/pkg/h_storage"
+	"github.com/dborchard/tiny_crdb/pkg/z_testutils/kvclientutils"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/stop"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testCluster is a set of ranges sharing a single engine. Each range only
+// serves requests that fall within its descriptor, which allows tests to
+// split ranges behind the back of the DistSender.
+type testCluster struct {
+	t     *testing.T
+	eng   storage.Engine
+	clock *hlc.Clock
+	eval  kv.SenderFunc
+
+	mu    sync.Mutex
+	descs map[roachpb.RangeID]roachpb.RangeDescriptor
+}
+
+func newTestCluster(t *testing.T) *testCluster {
+	eng, err := storage.Open(context.Background(), storage.Location{})
+	require.NoError(t, err)
+	t.Cleanup(eng.Close)
+	clock := hlc.NewClock(hlc.UnixNano, time.Nanosecond)
+	tc := &testCluster{
+		t:     t,
+		eng:   eng,
+		clock: clock,
+		eval:  newEvalSender(eng, clock),
+		descs: make(map[roachpb.RangeID]roachpb.RangeDescriptor),
+	}
+	// r1 holds the meta records and the user keys below "b".
+	r1 := tc.makeDesc(1, roachpb.RKeyMin, roachpb.RKey("b"))
+	tc.putMeta(keys.Meta1KeyMax, r1)
+	tc.addRange(r1)
+	tc.addRange(tc.makeDesc(2, roachpb.RKey("b"), roachpb.RKey("d")))
+	tc.addRange(tc.makeDesc(3, roachpb.RKey("d"), roachpb.RKeyMax))
+	return tc
+}
+
+func (tc *testCluster) makeDesc(
+	rangeID roachpb.RangeID, start, end roachpb.RKey,
+) roachpb.RangeDescriptor {
+	return roachpb.RangeDescriptor{
+		RangeID:  rangeID,
+		StartKey: start,
+		EndKey:   end,
+		InternalReplicas: []roachpb.ReplicaDescriptor{
+			{NodeID: 1, StoreID: 1, ReplicaID: 1},
+		},
+		NextReplicaID: 2,
+	}
+}
+
+// addRange installs the descriptor and its meta2 record.
+func (tc *testCluster) addRange(desc roachpb.RangeDescriptor) {
+	tc.mu.Lock()
+	tc.descs[desc.RangeID] = desc
+	tc.mu.Unlock()
+	tc.putMeta(keys.RangeMetaKey(desc.EndKey).AsRawKey(), desc)
+}
+
+func (tc *testCluster) putMeta(key roachpb.Key, desc roachpb.RangeDescriptor) {
+	err := storage.MVCCPutProto(
+		context.Background(), tc.eng, key, tc.clock.Now(), &desc, storage.MVCCWriteOptions{},
+	)
+	require.NoError(tc.t, err)
+}
+
+// GetFirstRangeDescriptor implements the FirstRangeProvider interface.
+func (tc *testCluster) GetFirstRangeDescriptor() (*roachpb.RangeDescriptor, error) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	desc := tc.descs[1]
+	return &desc, nil
+}
+
+// send evaluates the batch on the range addressed by its header, rejecting
+// it if the range does not contain all of its keys.
+func (tc *testCluster) send(
+	ctx context.Context, ba *kvpb.BatchRequest,
+) (*kvpb.BatchResponse, *kvpb.Error) {
+	tc.mu.Lock()
+	desc, ok := tc.descs[ba.RangeID]
+	tc.mu.Unlock()
+	if !ok {
+		return nil, kvpb.NewErrorf("r%d not found", ba.RangeID)
+	}
+	rs, err := keys.Range(ba.Requests)
+	if err != nil {
+		return nil, kvpb.NewError(err)
+	}
+	if !desc.ContainsKeyRange(rs.Key, rs.EndKey) {
+		return nil, kvpb.NewError(kvpb.NewRangeKeyMismatchError(rs.Key.AsRawKey(), rs.EndKey.AsRawKey(), &desc))
+	}
+	return tc.eval(ctx, ba)
+}
+
+func (tc *testCluster) newDistSender() *DistSender {
+	return NewDistSender(DistSenderConfig{
+		Clock:              tc.clock,
+		Stopper:            stop.NewStopper(),
+		FirstRangeProvider: tc,
+		TransportFactory:   SenderTransportFactory(kv.SenderFunc(tc.send)),
+	})
+}
+
+func putKeys(t *testing.T, ds *DistSender, ks ...string) {
+	ba := &kvpb.BatchRequest{}
+	for _, k := range ks {
+		ba.Add(&kvpb.PutRequest{
+			RequestHeader: kvpb.RequestHeader{Key: roachpb.Key(k)},
+			Value:         roachpb.MakeValueFromString(k),
+		})
+	}
+	_, pErr := ds.Send(context.Background(), ba)
+	require.Nil(t, pErr)
+}
+
+func scanKeys(t *testing.T, ds *DistSender, start, end roachpb.Key, limit int64) ([]string, *roachpb.Span) {
+	ba := &kvpb.BatchRequest{}
+	ba.MaxSpanRequestKeys = limit
+	ba.Add(&kvpb.ScanRequest{RequestHeader: kvpb.RequestHeader{Key: start, EndKey: end}})
+	br, pErr := ds.Send(context.Background(), ba)
+	require.Nil(t, pErr)
+	resp := br.Responses[0].GetInner().(*kvpb.ScanResponse)
+	var res []string
+	for _, row := range resp.Rows {
+		res = append(res, string(row.Key))
+	}
+	return res, resp.ResumeSpan
+}
+
+// TestDistSenderMultiRangeBatch verifies that batches spanning several
+// ranges are divided, sent to each range, and recombined in key order.
+func TestDistSenderMultiRangeBatch(t *testing.T) {
+	tc := newTestCluster(t)
+	ds := tc.newDistSender()
+
+	all := []string{"a", "a2", "b", "c", "c2", "d", "e", "f"}
+	putKeys(t, ds, "f", "a", "c", "e", "a2", "d", "b", "c2")
+
+	res, resume := scanKeys(t, ds, roachpb.Key("a"), roachpb.Key("z"), 0)
+	require.Equal(t, all, res)
+	require.Nil(t, resume)
+	require.Equal(t, 3, ds.RangeDescriptorCache().NumCached())
+
+	// A limited scan is sent to the ranges sequentially and returns a resume
+	// span where it stopped.
+	var got []string
+	start := roachpb.Key("a")
+	for {
+		res, resume := scanKeys(t, ds, start, roachpb.Key("z"), 3)
+		require.LessOrEqual(t, len(res), 3)
+		got = append(got, res...)
+		if resume == nil {
+			break
+		}
+		start = resume.Key
+	}
+	require.Equal(t, all, got)
+}
+
+// TestDistSenderRetriesOnRangeKeyMismatch verifies that the DistSender
+// refreshes its range cache and retries when a range rejects a request
+// because its cached descriptor is stale.
+func TestDistSenderRetriesOnRangeKeyMismatch(t *testing.T) {
+	tc := newTestCluster(t)
+	ds := tc.newDistSender()
+
+	putKeys(t, ds, "a", "b", "c", "e")
+	desc, ok := ds.RangeDescriptorCache().GetCached(roachpb.RKey("c"))
+	require.True(t, ok)
+	require.Equal(t, roachpb.RangeID(2), desc.RangeID)
+
+	// Split r2 at "c" without telling the DistSender.
+	lhs := tc.makeDesc(2, roachpb.RKey("b"), roachpb.RKey("c"))
+	lhs.Generation = 1
+	rhs := tc.makeDesc(4, roachpb.RKey("c"), roachpb.RKey("d"))
+	rhs.Generation = 1
+	tc.addRange(lhs)
+	tc.addRange(rhs)
+
+	putKeys(t, ds, "c2")
+	res, _ := scanKeys(t, ds, roachpb.Key("a"), roachpb.Key("z"), 0)
+	require.Equal(t, []string{"a", "b", "c", "c2", "e"}, res)
+
+	desc, ok = ds.RangeDescriptorCache().GetCached(roachpb.RKey("c"))
+	require.True(t, ok)
+	require.Equal(t, roachpb.RangeID(4), desc.RangeID)
+}
+
+// TestDistSenderRejectsUntrustworthyClock verifies that a batch fails when the
+// node which serves it replies with a clock reading further ahead than the
+// maximum clock offset, and that the clock of the DistSender is left
+// untouched.
+func TestDistSenderRejectsUntrustworthyClock(t *testing.T) {
+	tc := newTestCluster(t)
+	const maxOffset = 500 * time.Millisecond
+	clock := hlc.NewClock(hlc.UnixNano, maxOffset)
+	ahead := clock.NowAsClockTimestamp()
+	ahead.WallTime += (2 * maxOffset).Nanoseconds()
+	ds := NewDistSender(DistSenderConfig{
+		Clock:              clock,
+		Stopper:            stop.NewStopper(),
+		FirstRangeProvider: tc,
+		TransportFactory: SenderTransportFactory(kv.SenderFunc(
+			func(ctx context.Context, ba *kvpb.BatchRequest) (*kvpb.BatchResponse, *kvpb.Error) {
+				br, pErr := tc.send(ctx, ba)
+				if pErr != nil {
+					pErr.Now = ahead
+				} else {
+					br.Now = ahead
+				}
+				return br, pErr
+			})),
+	})
+
+	ba := &kvpb.BatchRequest{}
+	ba.Add(&kvpb.GetRequest{RequestHeader: kvpb.RequestHeader{Key: roachpb.Key("a")}})
+	_, pErr := ds.Send(context.Background(), ba)
+	require.NotNil(t, pErr)
+	var uErr *hlc.UntrustworthyRemoteWallTimeError
+	require.ErrorAs(t, pErr.GoError(), &uErr)
+	require.True(t, clock.Now().Less(ahead.ToTimestamp()))
+}
+
+// TestDistSenderTxn verifies that a transaction writing to several ranges
+// commits through the DistSender.
+func TestDistSenderTxn(t *testing.T) {
+	tc := newTestCluster(t)
+	ds := tc.newDistSender()
+	factory := NewTxnCoordSenderFactory(TxnCoordSenderFactoryConfig{Clock: tc.clock}, ds)
+	db := kv.NewDB(context.Background(), factory, tc.clock, stop.NewStopper())
+
+	ctx := context.Background()
+	require.NoError(t, db.Txn(ctx, func(ctx context.Context, txn *kv.Txn) error {
+		if err := txn.Put(ctx, "a", "1"); err != nil {
+			return err
+		}
+		return txn.Put(ctx, "e", "2")
+	}))
+	require.NoError(t, db.Txn(ctx, func(ctx context.Context, txn *kv.Txn) error {
+		require.Equal(t, "1", kvclientutils.GetString(t, ctx, txn, "a"))
+		require.Equal(t, "2", kvclientutils.GetString(t, ctx, txn, "e"))
+		return nil
+	}))
+}
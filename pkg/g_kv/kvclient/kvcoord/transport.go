@@ -0,0 +1,345 @@
+package kvcoord
+
+import (
+	"context"
+	"fmt"
+	kv "github.com/dborchard/tiny_crdb/pkg/g_kv"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_rpc/nodedialer"
+	"io"
+)
+
+// TransportFactory encapsulates all interaction with the RPC subsystem,
+// allowing it to be mocked out for testing. The factory function returns a
+// Transport object which is used to send requests to one or more replicas
+// of a range.
+type TransportFactory func(replicas []roachpb.ReplicaDescriptor) (Transport, error)
+
+// Transport objects can send RPCs to one or more replicas of a range.
+// All calls to Transport methods are made from a single thread, so
+// Transports are not required to be thread-safe.
+type Transport interface {
+	// IsExhausted returns true if there are no more replicas to try.
+	IsExhausted() bool
+
+	// SendNext synchronously sends the BatchRequest to the next replica.
+	// May panic if the transport is exhausted.
+	//
+	// An error is returned if the request could not be delivered to the
+	// replica, in which case the next replica may be tried. Errors
+	// encountered while evaluating the request are returned in the
+	// response's Error field.
+	SendNext(context.Context, *kvpb.BatchRequest) (*kvpb.BatchResponse, error)
+
+	// NextReplica returns the replica descriptor of the replica to be tried
+	// in the next call to SendNext. May panic if the transport is exhausted.
+	NextReplica() roachpb.ReplicaDescriptor
+
+	// MoveToFront locates the specified replica and moves it to be the next
+	// one tried, even if it was already tried. It returns false if the
+	// transport cannot reach the replica.
+	MoveToFront(roachpb.ReplicaDescriptor) bool
+
+	// RangeFeedNext synchronously establishes a rangefeed with the next
+	// replica, and sends the events of the rangefeed to the sink until it
+	// ends. May panic if the transport is exhausted.
+	//
+	// Like for SendNext, an error is returned if the request could not be
+	// delivered to the replica, or if the rangefeed was interrupted. The
+	// error with which the replica ended the rangefeed is returned as a
+	// *kvpb.Error.
+	RangeFeedNext(
+		context.Context, *kvpb.RangeFeedRequest, kvpb.RangeFeedEventSink,
+	) (*kvpb.Error, error)
+}
+
+// RangeFeedSender is a kv.Sender which also serves rangefeeds, such as the
+// stores of a node. The Transports which send requests through a kv.Sender
+// establish rangefeeds through it if it is a RangeFeedSender.
+type RangeFeedSender interface {
+	kv.Sender
+	RangeFeed(*kvpb.RangeFeedRequest, kvpb.RangeFeedEventSink) *kvpb.Error
+}
+
+// rangeFeedThroughSender establishes a rangefeed through the sender, if it is
+// a RangeFeedSender.
+func rangeFeedThroughSender(
+	sender kv.Sender, args *kvpb.RangeFeedRequest, sink kvpb.RangeFeedEventSink,
+) (*kvpb.Error, error) {
+	rfs, ok := sender.(RangeFeedSender)
+	if !ok {
+		return nil, fmt.Errorf("%T does not serve rangefeeds", sender)
+	}
+	return rfs.RangeFeed(args, sink), nil
+}
+
+// SenderTransportFactory wraps a kv.Sender for use as a KV Transport.
+// This is useful for tests that want to use DistSender without a full RPC
+// stack, and for sending requests to the replicas of the local node.
+func SenderTransportFactory(sender kv.Sender) TransportFactory {
+	return func(replicas []roachpb.ReplicaDescriptor) (Transport, error) {
+		// Always send to the first replica.
+		var replica roachpb.ReplicaDescriptor
+		if len(replicas) > 0 {
+			replica = replicas[0]
+		}
+		return &senderTransport{sender: sender, replica: replica}, nil
+	}
+}
+
+// senderTransport is a Transport which sends requests to a single replica
+// through a kv.Sender.
+type senderTransport struct {
+	sender  kv.Sender
+	replica roachpb.ReplicaDescriptor
+	called  bool
+}
+
+// IsExhausted implements the Transport interface.
+func (s *senderTransport) IsExhausted() bool {
+	return s.called
+}
+
+// SendNext implements the Transport interface.
+func (s *senderTransport) SendNext(
+	ctx context.Context, ba *kvpb.BatchRequest,
+) (*kvpb.BatchResponse, error) {
+	if s.called {
+		panic("called an exhausted transport")
+	}
+	s.called = true
+	br, pErr := s.sender.Send(ctx, ba)
+	if br == nil {
+		br = &kvpb.BatchResponse{}
+	}
+	if br.Error != nil {
+		panic("sender returned BatchResponse with Error field set")
+	}
+	br.Error = pErr
+	return br, nil
+}
+
+// NextReplica implements the Transport interface.
+func (s *senderTransport) NextReplica() roachpb.ReplicaDescriptor {
+	if s.IsExhausted() {
+		return roachpb.ReplicaDescriptor{}
+	}
+	return s.replica
+}
+
+// MoveToFront implements the Transport interface.
+func (s *senderTransport) MoveToFront(replica roachpb.ReplicaDescriptor) bool {
+	if s.replica.ReplicaID != replica.ReplicaID {
+		return false
+	}
+	s.called = false
+	return true
+}
+
+// RangeFeedNext implements the Transport interface.
+func (s *senderTransport) RangeFeedNext(
+	ctx context.Context, args *kvpb.RangeFeedRequest, sink kvpb.RangeFeedEventSink,
+) (*kvpb.Error, error) {
+	if s.called {
+		panic("called an exhausted transport")
+	}
+	s.called = true
+	return rangeFeedThroughSender(s.sender, args, sink)
+}
+
+// LoopbackTransportFactory returns a TransportFactory whose Transports send
+// requests to the replicas of a range in the order of the range's
+// descriptor, through the kv.Sender that dial returns for the node of each
+// replica. It suits clusters whose nodes run in a single process.
+func LoopbackTransportFactory(dial func(roachpb.NodeID) (kv.Sender, error)) TransportFactory {
+	return func(replicas []roachpb.ReplicaDescriptor) (Transport, error) {
+		return &loopbackTransport{
+			dial:     dial,
+			replicas: append([]roachpb.ReplicaDescriptor(nil), replicas...),
+		}, nil
+	}
+}
+
+// loopbackTransport is a Transport which sends requests to the replicas of a
+// range through the senders of their nodes.
+type loopbackTransport struct {
+	dial     func(roachpb.NodeID) (kv.Sender, error)
+	replicas []roachpb.ReplicaDescriptor
+	// next is the index of the next replica to try.
+	next int
+}
+
+// IsExhausted implements the Transport interface.
+func (t *loopbackTransport) IsExhausted() bool {
+	return t.next >= len(t.replicas)
+}
+
+// SendNext implements the Transport interface. The request is not delivered
+// if the node of the replica cannot be dialed.
+func (t *loopbackTransport) SendNext(
+	ctx context.Context, ba *kvpb.BatchRequest,
+) (*kvpb.BatchResponse, error) {
+	if t.IsExhausted() {
+		panic("called an exhausted transport")
+	}
+	replica := t.replicas[t.next]
+	t.next++
+	sender, err := t.dial(replica.NodeID)
+	if err != nil {
+		return nil, err
+	}
+	br, pErr := sender.Send(ctx, ba)
+	if br == nil {
+		br = &kvpb.BatchResponse{}
+	}
+	br.Error = pErr
+	return br, nil
+}
+
+// RangeFeedNext implements the Transport interface. The request is not
+// delivered if the node of the replica cannot be dialed.
+func (t *loopbackTransport) RangeFeedNext(
+	ctx context.Context, args *kvpb.RangeFeedRequest, sink kvpb.RangeFeedEventSink,
+) (*kvpb.Error, error) {
+	if t.IsExhausted() {
+		panic("called an exhausted transport")
+	}
+	replica := t.replicas[t.next]
+	t.next++
+	sender, err := t.dial(replica.NodeID)
+	if err != nil {
+		return nil, err
+	}
+	return rangeFeedThroughSender(sender, args, sink)
+}
+
+// NextReplica implements the Transport interface.
+func (t *loopbackTransport) NextReplica() roachpb.ReplicaDescriptor {
+	if t.IsExhausted() {
+		return roachpb.ReplicaDescriptor{}
+	}
+	return t.replicas[t.next]
+}
+
+// MoveToFront implements the Transport interface.
+func (t *loopbackTransport) MoveToFront(replica roachpb.ReplicaDescriptor) bool {
+	for i := range t.replicas {
+		if t.replicas[i].ReplicaID != replica.ReplicaID {
+			continue
+		}
+		if i < t.next {
+			// The replica was already tried: it is tried again, in place of
+			// the last replica tried.
+			t.next--
+		}
+		t.replicas[i], t.replicas[t.next] = t.replicas[t.next], t.replicas[i]
+		return true
+	}
+	return false
+}
+
+// GRPCTransportFactory returns a TransportFactory whose Transports send
+// requests to the replicas of a range in the order of the range's
+// descriptor, through the Internal service of their nodes. The requests to
+// the replicas of the local node skip gRPC.
+func GRPCTransportFactory(nodeDialer *nodedialer.Dialer) TransportFactory {
+	return func(replicas []roachpb.ReplicaDescriptor) (Transport, error) {
+		return &grpcTransport{
+			nodeDialer: nodeDialer,
+			replicas:   append([]roachpb.ReplicaDescriptor(nil), replicas...),
+		}, nil
+	}
+}
+
+// grpcTransport is a Transport which sends requests to the replicas of a
+// range through the Internal clients of their nodes.
+type grpcTransport struct {
+	nodeDialer *nodedialer.Dialer
+	replicas   []roachpb.ReplicaDescriptor
+	// next is the index of the next replica to try.
+	next int
+}
+
+// IsExhausted implements the Transport interface.
+func (t *grpcTransport) IsExhausted() bool {
+	return t.next >= len(t.replicas)
+}
+
+// SendNext implements the Transport interface. The request is not delivered
+// if the node of the replica cannot be dialed or the RPC fails.
+func (t *grpcTransport) SendNext(
+	ctx context.Context, ba *kvpb.BatchRequest,
+) (*kvpb.BatchResponse, error) {
+	if t.IsExhausted() {
+		panic("called an exhausted transport")
+	}
+	replica := t.replicas[t.next]
+	t.next++
+	client, err := t.nodeDialer.DialInternalClient(ctx, replica.NodeID)
+	if err != nil {
+		return nil, err
+	}
+	return client.Batch(ctx, ba)
+}
+
+// RangeFeedNext implements the Transport interface. The events of the
+// rangefeed are received through a gRPC stream, whose last event carries the
+// error which ended the rangefeed, if any.
+func (t *grpcTransport) RangeFeedNext(
+	ctx context.Context, args *kvpb.RangeFeedRequest, sink kvpb.RangeFeedEventSink,
+) (*kvpb.Error, error) {
+	if t.IsExhausted() {
+		panic("called an exhausted transport")
+	}
+	replica := t.replicas[t.next]
+	t.next++
+	client, err := t.nodeDialer.DialInternalClient(ctx, replica.NodeID)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := client.RangeFeed(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		event, err := stream.Recv()
+		if err == io.EOF {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if event.Error != nil {
+			pErr := event.Error.Error
+			return &pErr, nil
+		}
+		if err := sink.Send(event); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// NextReplica implements the Transport interface.
+func (t *grpcTransport) NextReplica() roachpb.ReplicaDescriptor {
+	if t.IsExhausted() {
+		return roachpb.ReplicaDescriptor{}
+	}
+	return t.replicas[t.next]
+}
+
+// MoveToFront implements the Transport interface.
+func (t *grpcTransport) MoveToFront(replica roachpb.ReplicaDescriptor) bool {
+	for i := range t.replicas {
+		if t.replicas[i].ReplicaID != replica.ReplicaID {
+			continue
+		}
+		if i < t.next {
+			// The replica was already tried: it is tried again, in place of
+			// the last replica tried.
+			t.next--
+		}
+		t.replicas[i], t.replicas[t.next] = t.replicas[t.next], t.replicas[i]
+		return true
+	}
+	return false
+}
@@ -0,0 +1,102 @@
+package kvcoord
+
+import (
+	"fmt"
+	keys "github.com/dborchard/tiny_crdb/pkg/g_keys"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+)
+
+// truncate restricts all requests to the given key range and returns new,
+// truncated, requests. All returned requests are "truncated" to the given
+// span, and requests that are found to not overlap with the span are
+// dropped. Along with the truncated requests, the positions of these
+// requests in the original batch are returned.
+//
+// Range requests may only use range-local keys if the whole request
+// addresses a single key, i.e. if it is contained in the given span.
+func truncate(reqs []kvpb.RequestUnion, rs roachpb.RSpan) ([]kvpb.RequestUnion, []int, error) {
+	truncateOne := func(args kvpb.Request) (bool, roachpb.Span, error) {
+		header := args.Header()
+		if !kvpb.IsRange(args) {
+			// This is a point request.
+			if len(header.EndKey) > 0 {
+				return false, roachpb.Span{}, fmt.Errorf("%T is not a range command, but EndKey is set", args)
+			}
+			addr, err := keys.Addr(header.Key)
+			if err != nil {
+				return false, roachpb.Span{}, err
+			}
+			if !rs.ContainsKey(addr) {
+				return false, roachpb.Span{}, nil
+			}
+			return true, header.Span(), nil
+		}
+
+		// We're dealing with a range-spanning request.
+		local := false
+		keyAddr, err := keys.Addr(header.Key)
+		if err != nil {
+			return false, roachpb.Span{}, err
+		}
+		if l, r := keys.IsLocal(header.Key), keys.IsLocal(header.EndKey); l || r {
+			if !l || !r {
+				return false, roachpb.Span{}, fmt.Errorf("local key mixed with global key in range")
+			}
+			local = true
+		}
+		if keyAddr.Less(rs.Key) {
+			// rs.Key can't be local because it contains range split points,
+			// which are never local.
+			if local {
+				return false, roachpb.Span{}, fmt.Errorf("cannot truncate local range request %s to %s", header.Span(), rs)
+			}
+			header.Key = rs.Key.AsRawKey()
+		}
+		endKeyAddr, err := keys.AddrUpperBound(header.EndKey)
+		if err != nil {
+			return false, roachpb.Span{}, err
+		}
+		if !endKeyAddr.Less(rs.EndKey) && !endKeyAddr.Equal(rs.EndKey) {
+			// rs.EndKey can't be local because it contains range split
+			// points, which are never local.
+			if local {
+				return false, roachpb.Span{}, fmt.Errorf("cannot truncate local range request %s to %s", header.Span(), rs)
+			}
+			header.EndKey = rs.EndKey.AsRawKey()
+		}
+		// Check whether the truncation has left any keys in the range. If
+		// not, we need to cut it out of the request.
+		if header.Key.Compare(header.EndKey) >= 0 {
+			return false, roachpb.Span{}, nil
+		}
+		return true, header.Span(), nil
+	}
+
+	var positions []int
+	var truncReqs []kvpb.RequestUnion
+	for pos, arg := range reqs {
+		inner := arg.GetInner()
+		hasRequest, newSpan, err := truncateOne(inner)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !hasRequest {
+			continue
+		}
+		origSpan := inner.Header().Span()
+		if !origSpan.Key.Equal(newSpan.Key) || !origSpan.EndKey.Equal(newSpan.EndKey) {
+			// Copy the request before truncating it; the original belongs to
+			// the caller.
+			inner = inner.ShallowCopy()
+			h := inner.Header()
+			h.Key, h.EndKey = newSpan.Key, newSpan.EndKey
+			inner.SetHeader(h)
+		}
+		var union kvpb.RequestUnion
+		union.MustSetInner(inner)
+		truncReqs = append(truncReqs, union)
+		positions = append(positions, pos)
+	}
+	return truncReqs, positions, nil
+}
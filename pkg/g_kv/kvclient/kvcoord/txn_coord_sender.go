@@ -0,0 +1,830 @@
+package kvcoord
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	kv "github.com/dborchard/tiny_crdb/pkg/g_kv"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/concurrency/isolation"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/uuid"
+	"sync"
+)
+
+// txnState represents states relating to whether an EndTxn request needs
+// to be sent.
+type txnState int
+
+const (
+	// txnPending is the normal state for ongoing transactions.
+	txnPending txnState = iota
+
+	// txnRetryableError means that the transaction encountered a
+	// TransactionRetryWithProtoRefreshError, and calls to Send() fail in this
+	// state. It is possible to move back to txnPending by calling
+	// ClearRetryableErr() or by rolling back to a savepoint, when the error
+	// allows for it.
+	txnRetryableError
+
+	// txnError means that a batch encountered a non-retriable error. Further
+	// batches except EndTxn(commit=false) will be rejected.
+	txnError
+
+	// txnFinalized means that an EndTxn(commit=true) has been executed
+	// successfully, or an EndTxn(commit=false) was sent - regardless of
+	// whether it executed successfully or not. Further batches except
+	// EndTxn(commit=false) will be rejected; a second rollback is allowed
+	// in case the first one fails.
+	txnFinalized
+)
+
+// String implements the fmt.Stringer interface.
+func (s txnState) String() string {
+	switch s {
+	case txnPending:
+		return "txnPending"
+	case txnRetryableError:
+		return "txnRetryableError"
+	case txnError:
+		return "txnError"
+	case txnFinalized:
+		return "txnFinalized"
+	default:
+		return fmt.Sprintf("txnState(%d)", int(s))
+	}
+}
+
+// A TxnCoordSender is the production implementation of client.TxnSender. It is
+// a Sender which wraps a lower-level Sender (a DistSender) to which it sends
+// commands. It works on behalf of the client to keep a transaction's state
+// (e.g. intents) and to perform periodic heartbeating of the transaction
+// required when necessary.  Unlike other senders, TxnCoordSender is not a
+// singleton - an instance is created for every transaction by the
+// TxnCoordSenderFactory.
+//
+// Among the functions it performs are:
+// - Heartbeating of the transaction record. Note that heartbeating is done only
+// from the root transaction coordinator, in the event that multiple
+// coordinators are active (i.e. in a distributed SQL flow).
+// - Accumulating lock spans.
+// - Attaching lock spans to EndTxn requests, for cleanup.
+// - Committing transactions in parallel with their last writes.
+// - Handles retriable errors by either bumping the transaction's epoch or, in
+// case of TransactionAbortedErrors, cleaning up the transaction (in this case,
+// the client.Txn is expected to create a new TxnCoordSender instance
+// transparently for the higher-level client).
+//
+// Since it is stateful, the TxnCoordSender needs to understand when a
+// transaction is "finished" and the state can be destroyed. As such there's a
+// contract that the client.Txn needs obey. Read-only transactions don't matter
+// - they're stateless. For the others, once an intent write is sent by the
+// client, the TxnCoordSender considers the transactions completed in the
+// following situations:
+// - A batch containing an EndTxns (commit or rollback) succeeds.
+// - A batch containing an EndTxn(commit=false) succeeds or fails. Only
+// more rollback attempts can follow a rollback attempt.
+// - A batch returns a TransactionAbortedError. As mentioned above, the client
+// is expected to create a new TxnCoordSender for the next transaction attempt.
+//
+// Note that "1PC" batches (i.e. batches containing both a Begin and an
+// EndTxn) are no exception from the contract - if the batch fails, the
+// client is expected to send a rollback (or perform another transaction attempt
+// in case of retriable errors).
+type TxnCoordSender struct {
+	mu struct {
+		sync.Mutex
+
+		txnState txnState
+
+		// storedRetryableErr is set when txnState == txnRetryableError. This
+		// storedRetryableErr is returned to clients on Send().
+		storedRetryableErr *kvpb.TransactionRetryWithProtoRefreshError
+
+		// storedErr is set when txnState == txnError. This storedErr is returned
+		// to clients on Send().
+		storedErr *kvpb.Error
+
+		// active is set whenever the transaction has sent any requests.
+		active bool
+
+		// txn is the Transaction proto attached to all the requests and updated on
+		// all the responses.
+		txn roachpb.Transaction
+
+		// userPriority is the txn's priority. Used when restarting the transaction.
+		userPriority roachpb.UserPriority
+	}
+
+	// A pre-allocation of the interceptor stack. The interceptors are ordered
+	// from the client (kv.Txn) down to the wrapped sender.
+	interceptorAlloc struct {
+		arr [5]txnInterceptor
+		txnHeartbeater
+		txnSeqNumAllocator
+		txnPipeliner
+		txnCommitter
+		txnSpanRefresher
+		txnLockGatekeeper // not in interceptorStack array.
+	}
+
+	// The sequence of interceptors that a client's request will pass through
+	// before being handed to the wrapped sender.
+	interceptorStack []txnInterceptor
+	lockedSender
+
+	// clock is used to establish new read snapshots for transactions running
+	// under isolation levels with per-statement read snapshots, and to pick
+	// the timestamp of transactions created for retries.
+	clock *hlc.Clock
+
+	// typ specifies whether this transaction is the top level,
+	// or one of potentially many distributed transactions.
+	typ kv.TxnType
+}
+
+var _ kv.TxnSender = &TxnCoordSender{}
+
+// txnInterceptors are pluggable request interceptors that transform requests
+// and responses and can perform operations in the context of a transaction. A
+// TxnCoordSender maintains a stack of txnInterceptors that it calls into under
+// lock whenever it sends a request.
+type txnInterceptor interface {
+	lockedSender
+
+	// setWrapped sets the txnInterceptor wrapped lockedSender.
+	setWrapped(wrapped lockedSender)
+
+	// populateLeafInputState populates the given input payload
+	// for a LeafTxn.
+	populateLeafInputState(*roachpb.LeafTxnInputState)
+
+	// initializeLeaf updates any internal state held inside the interceptor
+	// from the given LeafTxn input state.
+	initializeLeaf(*roachpb.LeafTxnInputState)
+
+	// populateLeafFinalState populates the final payload
+	// for a LeafTxn to bring back into a RootTxn.
+	populateLeafFinalState(*roachpb.LeafTxnFinalState)
+
+	// importLeafFinalState updates any internal state held inside the
+	// interceptor from the given LeafTxn final state.
+	importLeafFinalState(context.Context, *roachpb.LeafTxnFinalState) error
+
+	// createSavepointLocked is used to populate a savepoint with all the state
+	// that needs to be restored on a rollback.
+	createSavepointLocked(context.Context, *savepoint)
+
+	// rollbackToSavepointLocked is used to restore the state previously saved
+	// by createSavepointLocked().
+	rollbackToSavepointLocked(context.Context, savepoint)
+
+	// epochBumpedLocked resets the interceptor in the case of a txn epoch
+	// increment.
+	epochBumpedLocked()
+
+	// closeLocked closes the interceptor. It is called when the TxnCoordSender
+	// shuts down due to either a txn commit or a txn abort. The method will
+	// be called exactly once from cleanupTxnLocked.
+	closeLocked()
+}
+
+// lockedSender is like a client.Sender but requires the caller to hold the
+// TxnCoordSender lock to send requests.
+type lockedSender interface {
+	// SendLocked sends the batch request and receives a batch response. It
+	// requires that the TxnCoordSender lock be held when called, but this lock
+	// is not held for the entire duration of the call. Instead, the lock is
+	// released immediately before the batch is sent to a lower-level Sender and
+	// is re-acquired when the response is returned.
+	// WARNING: because the lock is released when calling this method and
+	// re-acquired before it returned, callers cannot rely on a single mutual
+	// exclusion zone mainted across the call.
+	SendLocked(context.Context, *kvpb.BatchRequest) (*kvpb.BatchResponse, *kvpb.Error)
+}
+
+func newRootTxnCoordSender(
+	tcf *TxnCoordSenderFactory, txn *roachpb.Transaction, pri roachpb.UserPriority,
+) kv.TxnSender {
+	if txn.ID == (uuid.UUID{}) {
+		panic(fmt.Sprintf("uninitialized txn in RootTransactionalSender: %s", txn))
+	}
+	if txn.Status != roachpb.PENDING {
+		panic(fmt.Sprintf("unexpected non-pending txn in RootTransactionalSender: %s", txn))
+	}
+
+	tcs := &TxnCoordSender{
+		clock: tcf.clock,
+		typ:   kv.RootTxn,
+	}
+	tcs.mu.txnState = txnPending
+	tcs.mu.userPriority = pri
+
+	// Create a stack of request/response interceptors. All of the objects in
+	// this stack are pre-allocated on the TxnCoordSender struct, so this just
+	// initializes the interceptors and pieces them together. It then adds a
+	// txnLockGatekeeper at the bottom of the stack to connect it with the
+	// TxnCoordSender's wrapped sender.
+	tcs.interceptorAlloc.txnLockGatekeeper = txnLockGatekeeper{
+		wrapped: tcf.wrapped,
+		mu:      &tcs.mu.Mutex,
+	}
+	tcs.interceptorAlloc.txnHeartbeater.init(
+		&tcs.mu.Mutex,
+		&tcs.mu.txn,
+		&tcs.interceptorAlloc.txnLockGatekeeper,
+		tcf.stopper,
+		tcf.clock,
+		tcf.heartbeatInterval,
+	)
+	tcs.interceptorAlloc.txnCommitter.init(&tcs.mu.Mutex, tcf.stopper)
+	tcs.interceptorAlloc.arr = [...]txnInterceptor{
+		&tcs.interceptorAlloc.txnHeartbeater,
+		&tcs.interceptorAlloc.txnSeqNumAllocator,
+		&tcs.interceptorAlloc.txnPipeliner,
+		&tcs.interceptorAlloc.txnCommitter,
+		&tcs.interceptorAlloc.txnSpanRefresher,
+	}
+	tcs.interceptorStack = tcs.interceptorAlloc.arr[:]
+
+	tcs.connectInterceptors()
+	tcs.mu.txn.Update(txn)
+	return tcs
+}
+
+// newLeafTxnCoordSender creates a TxnCoordSender for a leaf transaction,
+// initialized from the state of its root. Leaf transactions only perform
+// reads; they do not acquire locks, and cannot commit or roll back the
+// transaction.
+func newLeafTxnCoordSender(
+	tcf *TxnCoordSenderFactory, tis *roachpb.LeafTxnInputState,
+) kv.TxnSender {
+	txn := &tis.Txn
+	if txn.ID == (uuid.UUID{}) {
+		panic(fmt.Sprintf("uninitialized txn in LeafTransactionalSender: %s", txn))
+	}
+	if txn.Status != roachpb.PENDING {
+		panic(fmt.Sprintf("unexpected non-pending txn in LeafTransactionalSender: %s", txn))
+	}
+
+	tcs := &TxnCoordSender{
+		clock: tcf.clock,
+		typ:   kv.LeafTxn,
+	}
+	tcs.mu.txnState = txnPending
+	// No need to initialize tcs.mu.userPriority here,
+	// this field is only used in root txns.
+
+	// Create a stack of request/response interceptors. The leaf has no use
+	// for the txnPipeliner, since it does not acquire locks, nor for the
+	// txnHeartbeater, since only the root heartbeats the transaction record.
+	tcs.interceptorAlloc.txnLockGatekeeper = txnLockGatekeeper{
+		wrapped: tcf.wrapped,
+		mu:      &tcs.mu.Mutex,
+	}
+	tcs.interceptorAlloc.arr = [len(tcs.interceptorAlloc.arr)]txnInterceptor{
+		&tcs.interceptorAlloc.txnSeqNumAllocator,
+		&tcs.interceptorAlloc.txnSpanRefresher,
+	}
+	tcs.interceptorStack = tcs.interceptorAlloc.arr[:2]
+
+	tcs.connectInterceptors()
+	tcs.mu.txn.Update(txn)
+	for _, reqInt := range tcs.interceptorStack {
+		reqInt.initializeLeaf(tis)
+	}
+	return tcs
+}
+
+func (tc *TxnCoordSender) connectInterceptors() {
+	for i, reqInt := range tc.interceptorStack {
+		if i < len(tc.interceptorStack)-1 {
+			reqInt.setWrapped(tc.interceptorStack[i+1])
+		} else {
+			reqInt.setWrapped(&tc.interceptorAlloc.txnLockGatekeeper)
+		}
+	}
+	tc.lockedSender = tc.interceptorStack[0]
+}
+
+// Send is part of the client.TxnSender interface.
+func (tc *TxnCoordSender) Send(
+	ctx context.Context, ba *kvpb.BatchRequest,
+) (*kvpb.BatchResponse, *kvpb.Error) {
+	// NOTE: The locking here is unusual. Although it might look like it, we are
+	// NOT holding the lock continuously for the duration of the Send. We lock
+	// here, and unlock at the botton of the interceptor stack, in the
+	// txnLockGatekeeper. The we lock again in that interceptor when the response
+	// comes, and unlock again in the defer below.
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	tc.mu.active = true
+
+	if pErr := tc.maybeRejectClientLocked(ctx, ba); pErr != nil {
+		return nil, pErr
+	}
+
+	if tc.typ == kv.LeafTxn {
+		if _, ok := ba.GetArg(kvpb.EndTxn); ok {
+			return nil, kvpb.NewErrorf("cannot commit or roll back a LeafTxn; batch: %s", ba)
+		}
+		if ba.IsLocking() {
+			return nil, kvpb.NewErrorf("LeafTxn incompatible with locking request; batch: %s", ba)
+		}
+	}
+
+	if ba.IsSingleEndTxnRequest() && !tc.interceptorAlloc.txnPipeliner.hasAcquiredLocks() {
+		return nil, tc.finalizeNonLockingTxnLocked(ctx, ba)
+	}
+
+	// Clone the Txn's Proto so that future modifications can be made without
+	// worrying about synchronization.
+	ba = ba.ShallowCopy()
+	ba.Txn = tc.mu.txn.Clone()
+
+	// Send the command through the txnInterceptor stack.
+	br, pErr := tc.lockedSender.SendLocked(ctx, ba)
+
+	pErr = tc.updateStateLocked(ctx, ba, br, pErr)
+
+	// If we succeeded to commit, or we attempted to rollback, we move to
+	// txnFinalized.
+	if req, ok := ba.GetArg(kvpb.EndTxn); ok {
+		etReq := req.(*kvpb.EndTxnRequest)
+		if etReq.Commit {
+			if pErr == nil {
+				tc.finalizeAndCleanupTxnLocked(ctx)
+			}
+		} else {
+			// Rollbacks always move us to txnFinalized.
+			tc.finalizeAndCleanupTxnLocked(ctx)
+		}
+	}
+
+	if pErr != nil {
+		return nil, pErr
+	}
+
+	if br != nil && br.Txn != nil && br.Txn.ID != ba.Txn.ID {
+		return nil, kvpb.NewError(fmt.Errorf("unexpected response txn %s on batch for txn %s",
+			br.Txn.Short(), ba.Txn.Short()))
+	}
+
+	// Update our record of this transaction.
+	if br.Txn != nil {
+		br.Txn = tc.mu.txn.Clone()
+	}
+	return br, nil
+}
+
+// finalizeNonLockingTxnLocked finalizes a non-locking txn, either marking it
+// as committed or aborted. It is equivalent, but cheaper than, sending an
+// EndTxnRequest. A non-locking txn doesn't have a transaction record, so
+// there's no need to send any request to the server. An EndTxnRequest for a
+// non-locking txn is elided by the txnCommitter interceptor. However, calling
+// this and short-circuting even earlier is even more efficient (and shows in
+// benchmarks).
+func (tc *TxnCoordSender) finalizeNonLockingTxnLocked(
+	ctx context.Context, ba *kvpb.BatchRequest,
+) *kvpb.Error {
+	et := ba.Requests[0].GetInner().(*kvpb.EndTxnRequest)
+	if et.Commit {
+		// A non-locking transaction is subject to its deadline just like one
+		// that sends its EndTxn to the server.
+		deadline := et.Deadline
+		if !deadline.IsEmpty() && deadline.LessEq(tc.mu.txn.WriteTimestamp) {
+			txn := tc.mu.txn.Clone()
+			pErr := kvpb.NewErrorWithTxn(kvpb.NewTxnDeadlineExceededErr(txn, deadline), txn)
+			// The retryable error is transformed like any other, preparing the
+			// transaction's next attempt.
+			ba = ba.ShallowCopy()
+			ba.Txn = txn
+			return tc.updateStateLocked(ctx, ba, nil /* br */, pErr)
+		}
+		tc.mu.txn.Status = roachpb.COMMITTED
+	} else {
+		tc.mu.txn.Status = roachpb.ABORTED
+	}
+	tc.finalizeAndCleanupTxnLocked(ctx)
+	return nil
+}
+
+// maybeRejectClientLocked checks whether the transaction is in a state that
+// prevents it from continuing, such as the heartbeat having detected the
+// transaction to have been aborted.
+//
+// ba is the batch that the client is trying to send. It's inspected because
+// rollbacks are always allowed. Can be nil.
+func (tc *TxnCoordSender) maybeRejectClientLocked(
+	ctx context.Context, ba *kvpb.BatchRequest,
+) *kvpb.Error {
+	if ba != nil && ba.IsSingleEndTxnRequest() {
+		et := ba.Requests[0].GetInner().(*kvpb.EndTxnRequest)
+		if !et.Commit {
+			// As a special case, we allow rollbacks to be sent at any time. Any
+			// rollback attempt moves the TxnCoordSender state to txnFinalized, but
+			// higher layers are free to retry rollbacks if they want (and they do,
+			// for example, when the context was canceled while txn.Rollback() was
+			// running).
+			return nil
+		}
+	}
+
+	switch tc.mu.txnState {
+	case txnPending:
+		// All good.
+	case txnRetryableError:
+		return kvpb.NewError(tc.mu.storedRetryableErr)
+	case txnError:
+		return tc.mu.storedErr
+	case txnFinalized:
+		msg := fmt.Sprintf("client already committed or rolled back the transaction. "+
+			"Trying to execute: %s", ba)
+		return kvpb.NewErrorWithTxn(errors.New(msg), &tc.mu.txn)
+	}
+
+	// If the transaction was aborted, for example by a concurrent pusher,
+	// reject the client without sending further requests.
+	if tc.mu.txn.Status == roachpb.ABORTED {
+		abortedErr := kvpb.NewErrorWithTxn(
+			kvpb.NewTransactionAbortedError(kvpb.ABORT_REASON_CLIENT_REJECT), &tc.mu.txn)
+		if tc.typ == kv.LeafTxn {
+			// Leaf txns return raw retriable errors (which get handled by the
+			// root) rather than TransactionRetryWithProtoRefreshError.
+			return abortedErr
+		}
+		// Root txns handle retriable errors.
+		return kvpb.NewError(tc.handleRetryableErrLocked(ctx, abortedErr))
+	}
+	return nil
+}
+
+// updateStateLocked updates the transaction state in both the success and
+// error cases. It also updates retryable errors with the updated transaction
+// for use by client restarts.
+func (tc *TxnCoordSender) updateStateLocked(
+	ctx context.Context, ba *kvpb.BatchRequest, br *kvpb.BatchResponse, pErr *kvpb.Error,
+) *kvpb.Error {
+	if pErr == nil {
+		tc.mu.txn.Update(br.Txn)
+		return nil
+	}
+
+	// Leaf transactions do not handle retryable errors themselves; the
+	// errors are passed on to the root, which is in charge of preparing
+	// the next attempt.
+	if isRetryableErr(pErr) && tc.typ == kv.RootTxn {
+		if pErr.GetTxn() != nil && pErr.GetTxn().ID != ba.Txn.ID {
+			return kvpb.NewError(fmt.Errorf("retryable error for the wrong txn. ba.Txn: %s. pErr: %s",
+				ba.Txn, pErr))
+		}
+		return kvpb.NewError(tc.handleRetryableErrLocked(ctx, pErr))
+	}
+
+	// This is the non-retriable error case. The transaction's state is updated
+	// from the error, but the client may continue using the transaction, for
+	// example by rolling back to a savepoint.
+	if errTxn := pErr.GetTxn(); errTxn != nil {
+		tc.mu.txn.Update(errTxn)
+	}
+	return pErr
+}
+
+// isRetryableErr returns whether the error is one that the transaction can
+// recover from by retrying, either as a whole or, for some isolation levels,
+// by retrying just the statement that hit the error.
+func isRetryableErr(pErr *kvpb.Error) bool {
+	switch pErr.GetDetail().(type) {
+	case *kvpb.TransactionAbortedError, *kvpb.TransactionRetryError, *kvpb.WriteTooOldError:
+		return true
+	default:
+		return false
+	}
+}
+
+// handleRetryableErrLocked takes a retriable error and creates a
+// TransactionRetryWithProtoRefreshError containing the transaction that needs
+// to be used by the next attempt. It also moves the TxnCoordSender to the
+// txnRetryableError state. The next attempt is prepared as follows:
+//
+//   - A TransactionAbortedError means that the transaction is dead. A new
+//     transaction, with a new ID, must be used for the next attempt and the
+//     client is expected to create a new TxnCoordSender for it.
+//   - A WriteTooOldError encountered by a transaction whose isolation level
+//     establishes a new read snapshot per statement only requires the
+//     statement to be retried: the transaction remains in the same epoch and
+//     its write timestamp moves above the conflicting write.
+//   - Every other retriable error restarts the transaction at a new epoch,
+//     above the timestamp that caused the error.
+func (tc *TxnCoordSender) handleRetryableErrLocked(
+	ctx context.Context, pErr *kvpb.Error,
+) *kvpb.TransactionRetryWithProtoRefreshError {
+	errTxn := tc.mu.txn.Clone()
+	errTxn.Update(pErr.GetTxn())
+
+	var nextTxn roachpb.Transaction
+	switch tErr := pErr.GetDetail().(type) {
+	case *kvpb.TransactionAbortedError:
+		// The transaction is dead; it will not be able to commit and the
+		// client must start a new one.
+		tc.mu.txn.Status = roachpb.ABORTED
+		nextTxn = roachpb.MakeTransaction(
+			errTxn.Name, nil /* baseKey */, errTxn.IsoLevel, tc.mu.userPriority, tc.clock.Now())
+		// Use the priority communicated back by the server.
+		nextTxn.Priority = errTxn.Priority
+		tc.cleanupTxnLocked(ctx)
+
+	case *kvpb.WriteTooOldError:
+		nextTxn = *errTxn
+		nextTxn.WriteTimestamp.Forward(tErr.ActualTimestamp)
+		if !nextTxn.IsoLevel.PerStatementReadSnapshot() {
+			nextTxn.Restart(nextTxn.WriteTimestamp)
+		}
+
+	default:
+		nextTxn = *errTxn
+		nextTxn.Restart(nextTxn.WriteTimestamp)
+	}
+
+	retErr := kvpb.NewTransactionRetryWithProtoRefreshError(
+		pErr.String(), errTxn.ID, errTxn.Epoch, nextTxn)
+	tc.mu.txnState = txnRetryableError
+	tc.mu.storedRetryableErr = retErr
+	return retErr
+}
+
+// GetRetryableErr is part of the kv.TxnSender interface.
+func (tc *TxnCoordSender) GetRetryableErr(
+	ctx context.Context,
+) *kvpb.TransactionRetryWithProtoRefreshError {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if tc.mu.txnState == txnRetryableError {
+		return tc.mu.storedRetryableErr
+	}
+	return nil
+}
+
+// ClearRetryableErr is part of the kv.TxnSender interface.
+func (tc *TxnCoordSender) ClearRetryableErr(ctx context.Context) error {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if tc.mu.txnState != txnRetryableError {
+		return errors.New("cannot clear retryable error, in state: " + tc.mu.txnState.String())
+	}
+	if tc.mu.storedRetryableErr.PrevTxnAborted() {
+		return errors.New("cannot clear retryable error, txn aborted")
+	}
+	tc.applyNextTxnLocked(&tc.mu.storedRetryableErr.NextTransaction)
+	return nil
+}
+
+// applyNextTxnLocked moves the transaction to the state described by the
+// NextTransaction of a retryable error, resetting the interceptors if the
+// transaction's epoch was bumped, and moves the TxnCoordSender back to the
+// txnPending state.
+func (tc *TxnCoordSender) applyNextTxnLocked(nextTxn *roachpb.Transaction) {
+	if tc.mu.txn.Epoch < nextTxn.Epoch {
+		for _, reqInt := range tc.interceptorStack {
+			reqInt.epochBumpedLocked()
+		}
+	}
+	tc.mu.txn.Update(nextTxn)
+	tc.mu.txnState = txnPending
+	tc.mu.storedRetryableErr = nil
+}
+
+// Step is part of the kv.TxnSender interface.
+func (tc *TxnCoordSender) Step(ctx context.Context, allowReadTimestampStep bool) error {
+	if tc.typ != kv.RootTxn {
+		return errors.New("cannot step in non-root txn")
+	}
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if allowReadTimestampStep && tc.shouldStepReadTimestampLocked() {
+		tc.manualStepReadTimestampLocked()
+	}
+	return tc.interceptorAlloc.txnSeqNumAllocator.manualStepReadSeqLocked(ctx)
+}
+
+// shouldStepReadTimestampLocked returns whether the transaction establishes a
+// new read snapshot when it is stepped.
+func (tc *TxnCoordSender) shouldStepReadTimestampLocked() bool {
+	return tc.mu.txn.IsoLevel.PerStatementReadSnapshot() && !tc.mu.txn.ReadTimestampFixed
+}
+
+// manualStepReadTimestampLocked advances the transaction's read timestamp to
+// the current time, establishing a new read snapshot that observes all writes
+// committed before the call. The write timestamp is forwarded with it, so the
+// writes of the new statement are never below its reads.
+func (tc *TxnCoordSender) manualStepReadTimestampLocked() {
+	now := tc.clock.Now()
+	now.Forward(tc.mu.txn.WriteTimestamp)
+	tc.mu.txn.BumpReadTimestamp(now)
+}
+
+// ConfigureStepping is part of the kv.TxnSender interface.
+func (tc *TxnCoordSender) ConfigureStepping(
+	ctx context.Context, mode kv.SteppingMode,
+) (prevMode kv.SteppingMode) {
+	if tc.typ != kv.RootTxn {
+		panic("cannot configure stepping in non-root txn")
+	}
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return tc.interceptorAlloc.txnSeqNumAllocator.configureSteppingLocked(mode)
+}
+
+// GetSteppingMode is part of the kv.TxnSender interface.
+func (tc *TxnCoordSender) GetSteppingMode(ctx context.Context) (curMode kv.SteppingMode) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	curMode = kv.SteppingDisabled
+	if tc.interceptorAlloc.txnSeqNumAllocator.steppingModeEnabled {
+		curMode = kv.SteppingEnabled
+	}
+	return curMode
+}
+
+// finalizeAndCleanupTxnLocked marks the transaction state as finalized and
+// closes all interceptors.
+func (tc *TxnCoordSender) finalizeAndCleanupTxnLocked(ctx context.Context) {
+	tc.mu.txnState = txnFinalized
+	tc.cleanupTxnLocked(ctx)
+}
+
+// cleanupTxnLocked closes all the interceptors.
+func (tc *TxnCoordSender) cleanupTxnLocked(ctx context.Context) {
+	// Close each interceptor.
+	for _, reqInt := range tc.interceptorStack {
+		reqInt.closeLocked()
+	}
+}
+
+// GetLeafTxnInputState is part of the kv.TxnSender interface.
+func (tc *TxnCoordSender) GetLeafTxnInputState(
+	ctx context.Context,
+) (*roachpb.LeafTxnInputState, error) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	// Leaf txns must not be created in a txn that is already known to be
+	// aborted, for example by the heartbeat loop; the client is rejected with
+	// a retryable error instead.
+	if pErr := tc.maybeRejectClientLocked(ctx, nil /* ba */); pErr != nil {
+		return nil, pErr.GoError()
+	}
+	if err := tc.checkTxnPendingLocked(); err != nil {
+		return nil, err
+	}
+
+	// Copy mutable state so access is safe for the caller.
+	tis := &roachpb.LeafTxnInputState{Txn: tc.mu.txn}
+	for _, reqInt := range tc.interceptorStack {
+		reqInt.populateLeafInputState(tis)
+	}
+	return tis, nil
+}
+
+// GetLeafTxnFinalState is part of the kv.TxnSender interface.
+func (tc *TxnCoordSender) GetLeafTxnFinalState(
+	ctx context.Context,
+) (*roachpb.LeafTxnFinalState, error) {
+	if tc.typ != kv.LeafTxn {
+		return nil, errors.New("GetLeafTxnFinalState() called on root txn")
+	}
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	// Copy mutable state so access is safe for the caller.
+	tfs := &roachpb.LeafTxnFinalState{Txn: tc.mu.txn}
+	for _, reqInt := range tc.interceptorStack {
+		reqInt.populateLeafFinalState(tfs)
+	}
+	return tfs, nil
+}
+
+// UpdateRootWithLeafFinalState is part of the kv.TxnSender interface.
+func (tc *TxnCoordSender) UpdateRootWithLeafFinalState(
+	ctx context.Context, tfs *roachpb.LeafTxnFinalState,
+) error {
+	if tc.typ != kv.RootTxn {
+		return errors.New("UpdateRootWithLeafFinalState() called on leaf txn")
+	}
+	if tfs.Txn.ID == (uuid.UUID{}) {
+		return errors.New("UpdateRootWithLeafFinalState() called with uninitialized leaf state")
+	}
+
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	// If the leaf ran in an attempt of the transaction that has since been
+	// abandoned, either because the transaction was aborted and replaced or
+	// because its epoch was bumped, its state is stale and is ignored. This
+	// can happen when a leaf returns after the root hit a retryable error.
+	if tc.mu.txn.ID != tfs.Txn.ID || tfs.Txn.Epoch < tc.mu.txn.Epoch {
+		return nil
+	}
+	if tc.mu.txnState != txnPending {
+		return nil
+	}
+
+	tc.mu.txn.Update(&tfs.Txn)
+	for _, reqInt := range tc.interceptorStack {
+		if err := reqInt.importLeafFinalState(ctx, tfs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkTxnPendingLocked returns an error if the transaction is not in the
+// txnPending state.
+func (tc *TxnCoordSender) checkTxnPendingLocked() error {
+	switch tc.mu.txnState {
+	case txnPending:
+		return nil
+	case txnRetryableError:
+		return tc.mu.storedRetryableErr
+	case txnError:
+		return tc.mu.storedErr.GoError()
+	default:
+		return errors.New("operation invalid for finalized txn")
+	}
+}
+
+// TestingCloneTxn is part of the kv.TxnSender interface.
+func (tc *TxnCoordSender) TestingCloneTxn() *roachpb.Transaction {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return tc.mu.txn.Clone()
+}
+
+// SetIsoLevel is part of the kv.TxnSender interface.
+func (tc *TxnCoordSender) SetIsoLevel(isoLevel isolation.Level) error {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if isoLevel == tc.mu.txn.IsoLevel {
+		return nil
+	}
+	if tc.mu.active {
+		return errors.New("cannot change the isolation level of a running transaction")
+	}
+	tc.mu.txn.IsoLevel = isoLevel
+	return nil
+}
+
+// IsoLevel is part of the kv.TxnSender interface.
+func (tc *TxnCoordSender) IsoLevel() isolation.Level {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return tc.mu.txn.IsoLevel
+}
+
+// TxnStatus is part of the kv.TxnSender interface.
+func (tc *TxnCoordSender) TxnStatus() roachpb.TransactionStatus {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return tc.mu.txn.Status
+}
+
+// ReadTimestamp is part of the kv.TxnSender interface.
+func (tc *TxnCoordSender) ReadTimestamp() hlc.Timestamp {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return tc.mu.txn.ReadTimestamp
+}
+
+// ProvisionalCommitTimestamp is part of the kv.TxnSender interface.
+func (tc *TxnCoordSender) ProvisionalCommitTimestamp() hlc.Timestamp {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return tc.mu.txn.WriteTimestamp
+}
+
+// ReadTimestampFixed is part of the kv.TxnSender interface.
+func (tc *TxnCoordSender) ReadTimestampFixed() bool {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return tc.mu.txn.ReadTimestampFixed
+}
+
+// CommitTimestamp is part of the kv.TxnSender interface.
+func (tc *TxnCoordSender) CommitTimestamp() (hlc.Timestamp, error) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	txn := &tc.mu.txn
+	switch txn.Status {
+	case roachpb.COMMITTED:
+		return txn.WriteTimestamp, nil
+	case roachpb.ABORTED:
+		return hlc.Timestamp{}, errors.New("CommitTimestamp called on aborted transaction")
+	}
+	if txn.IsoLevel != isolation.Serializable {
+		return hlc.Timestamp{}, fmt.Errorf("unsupported isolation level: %d", txn.IsoLevel)
+	}
+	// Fix the read timestamp so that the transaction cannot commit at a later
+	// timestamp than the one returned.
+	txn.ReadTimestampFixed = true
+	return txn.ReadTimestamp, nil
+}
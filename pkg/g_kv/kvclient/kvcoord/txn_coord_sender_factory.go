@@ -3,33 +3,64 @@ package kvcoord
 import (
 	kv "github.com/dborchard/tiny_crdb/pkg/g_kv"
 	"github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/stop"
+	"time"
 )
 
 // TxnCoordSenderFactory implements kv.TxnSenderFactory.
 type TxnCoordSenderFactory struct {
-	wrapped kv.Sender
+	clock             *hlc.Clock
+	stopper           *stop.Stopper
+	heartbeatInterval time.Duration
+	wrapped           kv.Sender
+}
+
+var _ kv.TxnSenderFactory = &TxnCoordSenderFactory{}
+
+// TxnCoordSenderFactoryConfig holds configuration and auxiliary objects that can
+// be passed to NewTxnCoordSenderFactory.
+type TxnCoordSenderFactoryConfig struct {
+	Clock *hlc.Clock
+	// Stopper runs the heartbeat loops of the transactions. If nil, the
+	// transaction records are never heartbeated.
+	Stopper *stop.Stopper
+
+	// HeartbeatInterval is the interval at which transaction records are
+	// heartbeated. Defaults to DefaultTxnHeartbeatInterval.
+	HeartbeatInterval time.Duration
 }
 
 // NewTxnCoordSenderFactory creates a new TxnCoordSenderFactory. The
 // factory creates new instances of TxnCoordSenders.
-func NewTxnCoordSenderFactory(wrapped kv.Sender) *TxnCoordSenderFactory {
+func NewTxnCoordSenderFactory(
+	cfg TxnCoordSenderFactoryConfig, wrapped kv.Sender,
+) *TxnCoordSenderFactory {
 	tcf := &TxnCoordSenderFactory{
-		wrapped: wrapped,
+		clock:             cfg.Clock,
+		stopper:           cfg.Stopper,
+		heartbeatInterval: cfg.HeartbeatInterval,
+		wrapped:           wrapped,
+	}
+	if tcf.heartbeatInterval == 0 {
+		tcf.heartbeatInterval = DefaultTxnHeartbeatInterval
 	}
 	return tcf
 }
 
-func (t TxnCoordSenderFactory) RootTransactionalSender(txn *roachpb.Transaction, pri roachpb.UserPriority) kv.TxnSender {
-	//TODO implement me
-	panic("implement me")
+// RootTransactionalSender is part of the TxnSenderFactory interface.
+func (t *TxnCoordSenderFactory) RootTransactionalSender(
+	txn *roachpb.Transaction, pri roachpb.UserPriority,
+) kv.TxnSender {
+	return newRootTxnCoordSender(t, txn, pri)
 }
 
-func (t TxnCoordSenderFactory) LeafTransactionalSender(tis *roachpb.LeafTxnInputState) kv.TxnSender {
-	//TODO implement me
-	panic("implement me")
+// LeafTransactionalSender is part of the TxnSenderFactory interface.
+func (t *TxnCoordSenderFactory) LeafTransactionalSender(tis *roachpb.LeafTxnInputState) kv.TxnSender {
+	return newLeafTxnCoordSender(t, tis)
 }
 
-func (t TxnCoordSenderFactory) NonTransactionalSender() kv.Sender {
-	//TODO implement me
-	panic("implement me")
+// NonTransactionalSender is part of the TxnSenderFactory interface.
+func (t *TxnCoordSenderFactory) NonTransactionalSender() kv.Sender {
+	return t.wrapped
 }
@@ -0,0 +1,183 @@
+package kvcoord
+
+import (
+	"context"
+	"errors"
+	kv "github.com/dborchard/tiny_crdb/pkg/g_kv"
+	"github.com/dborchard/tiny_crdb/pkg/h_storage/enginepb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/uuid"
+)
+
+// savepoint captures the state in the TxnCoordSender necessary to restore that
+// state upon a savepoint rollback.
+type savepoint struct {
+	// active is a snapshot of TxnCoordSender.active.
+	active bool
+
+	// txnID and epoch are set for savepoints with the active field set.
+	// txnID and epoch are used to disallow rollbacks past transaction restarts.
+	// Savepoints without the active field set are allowed to be used to rollback
+	// past transaction restarts too, because it's trivial to rollback to the
+	// beginning of the transaction.
+	txnID uuid.UUID
+	epoch enginepb.TxnEpoch
+
+	// seqNum represents the write seq num at the time the savepoint was created.
+	// On rollback, it configures the txn to ignore all seqnums from this value
+	// until the most recent seqnum.
+	seqNum enginepb.TxnSeq
+}
+
+var _ kv.SavepointToken = (*savepoint)(nil)
+
+// Initial implements the client.SavepointToken interface.
+func (s *savepoint) Initial() bool {
+	return !s.active
+}
+
+// ErrSavepointOperationInErrorTxn is reported when CreateSavepoint() or
+// ReleaseSavepoint() is called over a txn currently in error.
+var ErrSavepointOperationInErrorTxn = errors.New(
+	"cannot create or release savepoint after an error has occurred")
+
+// errSavepointInvalidAfterTxnRestart is reported when RollbackToSavepoint()
+// or ReleaseSavepoint() is called with a savepoint created in an earlier
+// epoch of the transaction.
+var errSavepointInvalidAfterTxnRestart = errors.New(
+	"cannot rollback to savepoint after a transaction restart")
+
+// CreateSavepoint is part of the kv.TxnSender interface.
+func (tc *TxnCoordSender) CreateSavepoint(ctx context.Context) (kv.SavepointToken, error) {
+	if tc.typ != kv.RootTxn {
+		return nil, errors.New("cannot get savepoint in non-root txn")
+	}
+
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	if err := tc.assertNotFinalized(); err != nil {
+		return nil, err
+	}
+
+	if tc.mu.txnState != txnPending {
+		return nil, ErrSavepointOperationInErrorTxn
+	}
+
+	s := &savepoint{
+		active: tc.mu.active,
+		txnID:  tc.mu.txn.ID,
+		epoch:  tc.mu.txn.Epoch,
+	}
+	for _, reqInt := range tc.interceptorStack {
+		reqInt.createSavepointLocked(ctx, s)
+	}
+
+	return s, nil
+}
+
+// RollbackToSavepoint is part of the kv.TxnSender interface.
+func (tc *TxnCoordSender) RollbackToSavepoint(ctx context.Context, s kv.SavepointToken) error {
+	if tc.typ != kv.RootTxn {
+		return errors.New("cannot rollback savepoint in non-root txn")
+	}
+
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	if err := tc.assertNotFinalized(); err != nil {
+		return err
+	}
+
+	// We don't allow rollback to savepoint after errors that moved the txn to
+	// the txnError state. Errors that leave the txn in the txnPending state
+	// (e.g. a WriteIntentError) can be rolled back over.
+	if tc.mu.txnState == txnError {
+		return tc.mu.storedErr.GoError()
+	}
+
+	// Retryable errors can be rolled back over only if they did not require
+	// the transaction to restart from the beginning, i.e. if they allow for
+	// the statement that hit them to be retried. In that case, the
+	// transaction moves to the state prepared for its next attempt.
+	if tc.mu.txnState == txnRetryableError {
+		if tc.mu.storedRetryableErr.TxnMustRestartFromBeginning() {
+			return tc.mu.storedRetryableErr
+		}
+		tc.applyNextTxnLocked(&tc.mu.storedRetryableErr.NextTransaction)
+	}
+
+	sp := s.(*savepoint)
+	if err := tc.checkSavepointLocked(sp); err != nil {
+		return err
+	}
+
+	// Restore the transaction's state, in case we're rewinding after an error.
+	tc.mu.txnState = txnPending
+
+	tc.mu.active = sp.active
+
+	for _, reqInt := range tc.interceptorStack {
+		reqInt.rollbackToSavepointLocked(ctx, *sp)
+	}
+
+	// If there's been any more writes since the savepoint was created, they'll
+	// need to be ignored.
+	if sp.seqNum < tc.interceptorAlloc.txnSeqNumAllocator.writeSeq {
+		tc.mu.txn.AddIgnoredSeqNumRange(
+			enginepb.IgnoredSeqNumRange{
+				Start: sp.seqNum + 1, End: tc.interceptorAlloc.txnSeqNumAllocator.writeSeq,
+			})
+	}
+
+	return nil
+}
+
+// ReleaseSavepoint is part of the kv.TxnSender interface.
+func (tc *TxnCoordSender) ReleaseSavepoint(ctx context.Context, s kv.SavepointToken) error {
+	if tc.typ != kv.RootTxn {
+		return errors.New("cannot release savepoint in non-root txn")
+	}
+
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	if tc.mu.txnState != txnPending {
+		return ErrSavepointOperationInErrorTxn
+	}
+
+	sp := s.(*savepoint)
+	return tc.checkSavepointLocked(sp)
+}
+
+// checkSavepointLocked checks whether the provided savepoint is still valid.
+// Returns errSavepointInvalidAfterTxnRestart if the savepoint is not an
+// "initial" one and the transaction has restarted since the savepoint was
+// created.
+func (tc *TxnCoordSender) checkSavepointLocked(s *savepoint) error {
+	// Only savepoints taken before any activity are allowed to be used after a
+	// transaction restart.
+	if s.Initial() {
+		return nil
+	}
+	if s.txnID != tc.mu.txn.ID {
+		return errSavepointInvalidAfterTxnRestart
+	}
+	if s.epoch != tc.mu.txn.Epoch {
+		return errSavepointInvalidAfterTxnRestart
+	}
+
+	if s.seqNum < 0 || s.seqNum > tc.interceptorAlloc.txnSeqNumAllocator.writeSeq {
+		return errors.New("invalid savepoint: seqnum is out of range")
+	}
+
+	return nil
+}
+
+// assertNotFinalized returns an error if the transaction has already been
+// committed or rolled back.
+func (tc *TxnCoordSender) assertNotFinalized() error {
+	if tc.mu.txnState == txnFinalized {
+		return errors.New("operation invalid for finalized txn")
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package kvcoord
+
+import (
+	"context"
+	kv "github.com/dborchard/tiny_crdb/pkg/g_kv"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/dborchard/tiny_crdb/pkg/h_storage/enginepb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/stop"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+// TestSavepointsIgnoreRolledBackWrites verifies that rolling back to a
+// savepoint adds the sequence numbers of the writes performed since the
+// savepoint to the transaction's ignored list, and that the list travels with
+// subsequent requests and with the EndTxn.
+func TestSavepointsIgnoreRolledBackWrites(t *testing.T) {
+	ctx := context.Background()
+	var last *kvpb.BatchRequest
+	sender := kv.SenderFunc(func(_ context.Context, ba *kvpb.BatchRequest) (*kvpb.BatchResponse, *kvpb.Error) {
+		last = ba
+		br := &kvpb.BatchResponse{}
+		br.Txn = ba.Txn.Clone()
+		for _, ru := range ba.Requests {
+			if _, ok := ru.GetInner().(*kvpb.EndTxnRequest); ok {
+				br.Txn.Status = roachpb.COMMITTED
+			}
+			br.Add(kvpb.CreateReply(ru.GetInner()))
+		}
+		return br, nil
+	})
+	clock := hlc.NewClock(hlc.UnixNano, time.Nanosecond)
+	factory := NewTxnCoordSenderFactory(TxnCoordSenderFactoryConfig{Clock: clock}, sender)
+	db := kv.NewDB(ctx, factory, clock, stop.NewStopper())
+	txn := kv.NewTxn(ctx, db)
+
+	require.NoError(t, txn.Put(ctx, "a", "1"))
+	sp, err := txn.CreateSavepoint(ctx)
+	require.NoError(t, err)
+	require.False(t, sp.Initial())
+	require.NoError(t, txn.Put(ctx, "b", "2"))
+	require.NoError(t, txn.Put(ctx, "c", "3"))
+	require.NoError(t, txn.RollbackToSavepoint(ctx, sp))
+
+	_, err = txn.Get(ctx, "b")
+	require.NoError(t, err)
+	require.Equal(t, []enginepb.IgnoredSeqNumRange{{Start: 2, End: 3}}, last.Txn.IgnoredSeqNums)
+	require.Equal(t, enginepb.TxnSeq(3), last.Requests[0].GetInner().Header().Sequence)
+
+	require.NoError(t, txn.ReleaseSavepoint(ctx, sp))
+	require.NoError(t, txn.Commit(ctx))
+	et := last.Requests[0].GetInner().(*kvpb.EndTxnRequest)
+	require.Len(t, et.LockSpans, 3)
+	require.Equal(t, []enginepb.IgnoredSeqNumRange{{Start: 2, End: 3}}, last.Txn.IgnoredSeqNums)
+}
@@ -0,0 +1,544 @@
+package kvcoord
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	kv "github.com/dborchard/tiny_crdb/pkg/g_kv"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/batcheval"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/concurrency/isolation"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	storage "github.com/dborchard/tiny_crdb/pkg/h_storage"
+	"github.com/dborchard/tiny_crdb/pkg/z_testutils/kvclientutils"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/stop"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newEvalSender returns a sender that evaluates batches directly against the
+// provided engine, standing in for the KV server of node 1. Transactional
+// batches are evaluated at the transaction's read timestamp and record an
+// observed timestamp for the node.
+func newEvalSender(eng storage.Engine, clock *hlc.Clock) kv.SenderFunc {
+	var mu sync.Mutex
+	evalCtx := (&batcheval.MockEvalCtx{Clock: clock}).EvalContext()
+	return func(ctx context.Context, ba *kvpb.BatchRequest) (*kvpb.BatchResponse, *kvpb.Error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		h := ba.Header
+		if h.Txn != nil {
+			h.Txn = h.Txn.Clone()
+			h.Timestamp = h.Txn.ReadTimestamp
+			h.Txn.UpdateObservedTimestamp(1, clock.NowAsClockTimestamp())
+		} else if h.Timestamp.IsEmpty() {
+			h.Timestamp = clock.Now()
+		}
+
+		batch := eng.NewBatch()
+		defer batch.Close()
+		br := &kvpb.BatchResponse{}
+		for i, ru := range ba.Requests {
+			args := ru.GetInner()
+			if h.Txn != nil {
+				h.Txn.Sequence = args.Header().Sequence
+			}
+			cmd, ok := batcheval.LookupCommand(args.Method())
+			if !ok {
+				return nil, kvpb.NewErrorf("unknown command %s", args.Method())
+			}
+			reply := kvpb.CreateReply(args)
+			cArgs := batcheval.CommandArgs{EvalCtx: evalCtx, Header: h, Args: args}
+			var err error
+			if cmd.EvalRW != nil {
+				_, err = cmd.EvalRW(ctx, batch, cArgs, reply)
+			} else {
+				_, err = cmd.EvalRO(ctx, batch, cArgs, reply)
+			}
+			if err != nil {
+				pErr := kvpb.NewErrorWithTxn(err, ba.Txn)
+				pErr.SetErrorIndex(int32(i))
+				return nil, pErr
+			}
+			if h.Txn != nil {
+				h.Txn.Update(reply.Header().Txn)
+			}
+			br.Add(reply)
+		}
+		if err := batch.Commit(false /* sync */); err != nil {
+			return nil, kvpb.NewError(err)
+		}
+		br.Txn = h.Txn
+		return br, nil
+	}
+}
+
+func newTestDB(t *testing.T) *kv.DB {
+	eng, err := storage.Open(context.Background(), storage.Location{})
+	require.NoError(t, err)
+	t.Cleanup(eng.Close)
+	clock := hlc.NewClock(hlc.UnixNano, time.Nanosecond)
+	factory := NewTxnCoordSenderFactory(TxnCoordSenderFactoryConfig{Clock: clock}, newEvalSender(eng, clock))
+	return kv.NewDB(context.Background(), factory, clock, stop.NewStopper())
+}
+
+// TestTxnCoordSenderReadCommittedStepsReadTimestamp verifies that stepping a
+// Read Committed transaction establishes a new read snapshot that observes
+// the writes committed since the previous one, while the read snapshot of a
+// Serializable transaction is unaffected by steps.
+func TestTxnCoordSenderReadCommittedStepsReadTimestamp(t *testing.T) {
+	ctx := context.Background()
+	for _, isoLevel := range []isolation.Level{isolation.Serializable, isolation.ReadCommitted} {
+		t.Run(isoLevel.String(), func(t *testing.T) {
+			db := newTestDB(t)
+			txn := kv.NewTxn(ctx, db)
+			require.NoError(t, txn.SetIsoLevel(isoLevel))
+			require.Equal(t, "", kvclientutils.GetString(t, ctx, txn, "a"))
+
+			require.NoError(t, db.Txn(ctx, func(ctx context.Context, txn *kv.Txn) error {
+				return txn.Put(ctx, "a", "1")
+			}))
+			require.Equal(t, "", kvclientutils.GetString(t, ctx, txn, "a"))
+
+			require.NoError(t, txn.Step(ctx, true /* allowReadTimestampStep */))
+			if isoLevel == isolation.ReadCommitted {
+				require.Equal(t, "1", kvclientutils.GetString(t, ctx, txn, "a"))
+			} else {
+				require.Equal(t, "", kvclientutils.GetString(t, ctx, txn, "a"))
+			}
+			require.NoError(t, txn.Commit(ctx))
+		})
+	}
+}
+
+// TestTxnCoordSenderReadCommittedWriteWriteConflict verifies that a
+// write-write conflict requires a Read Committed transaction to retry only the
+// statement that hit it, after rolling back to a savepoint, while a
+// Serializable transaction must restart from the beginning.
+func TestTxnCoordSenderReadCommittedWriteWriteConflict(t *testing.T) {
+	ctx := context.Background()
+	for _, isoLevel := range []isolation.Level{isolation.Serializable, isolation.ReadCommitted} {
+		t.Run(isoLevel.String(), func(t *testing.T) {
+			db := newTestDB(t)
+			txn := kv.NewTxn(ctx, db)
+			require.NoError(t, txn.SetIsoLevel(isoLevel))
+			require.NoError(t, txn.Put(ctx, "a", "txn"))
+
+			require.NoError(t, db.Txn(ctx, func(ctx context.Context, txn *kv.Txn) error {
+				return txn.Put(ctx, "b", "other")
+			}))
+
+			sp, err := txn.CreateSavepoint(ctx)
+			require.NoError(t, err)
+			err = txn.Put(ctx, "b", "txn")
+			var retryErr *kvpb.TransactionRetryWithProtoRefreshError
+			require.True(t, errors.As(err, &retryErr), "unexpected error: %v", err)
+
+			if isoLevel == isolation.Serializable {
+				require.True(t, retryErr.TxnMustRestartFromBeginning())
+				require.Error(t, txn.RollbackToSavepoint(ctx, sp))
+				require.NoError(t, txn.Rollback(ctx))
+				return
+			}
+
+			// Retry the statement on a new read snapshot.
+			require.False(t, retryErr.TxnMustRestartFromBeginning())
+			require.NoError(t, txn.RollbackToSavepoint(ctx, sp))
+			require.NoError(t, txn.Step(ctx, true /* allowReadTimestampStep */))
+			require.NoError(t, txn.Put(ctx, "b", "txn"))
+			require.NoError(t, txn.Commit(ctx))
+
+			// Both the writes performed before the savepoint and the retried
+			// write committed.
+			reader := kv.NewTxn(ctx, db)
+			require.Equal(t, "txn", kvclientutils.GetString(t, ctx, reader, "a"))
+			require.Equal(t, "txn", kvclientutils.GetString(t, ctx, reader, "b"))
+			require.NoError(t, reader.Commit(ctx))
+		})
+	}
+}
+
+// TestTxnRetriesAfterWriteWriteConflict verifies that DB.Txn transparently
+// retries the closure after a write-write conflict, at every isolation level.
+func TestTxnRetriesAfterWriteWriteConflict(t *testing.T) {
+	ctx := context.Background()
+	for _, isoLevel := range []isolation.Level{isolation.Serializable, isolation.ReadCommitted} {
+		t.Run(isoLevel.String(), func(t *testing.T) {
+			db := newTestDB(t)
+			attempts := 0
+			require.NoError(t, db.Txn(ctx, func(ctx context.Context, txn *kv.Txn) error {
+				attempts++
+				if err := txn.SetIsoLevel(isoLevel); err != nil {
+					return err
+				}
+				if err := txn.Put(ctx, "a", "txn"); err != nil {
+					return err
+				}
+				if attempts == 1 {
+					if err := db.Txn(ctx, func(ctx context.Context, txn *kv.Txn) error {
+						return txn.Put(ctx, "b", "other")
+					}); err != nil {
+						return err
+					}
+				}
+				return txn.Put(ctx, "b", "txn")
+			}))
+			require.Equal(t, 2, attempts)
+
+			reader := kv.NewTxn(ctx, db)
+			require.Equal(t, "txn", kvclientutils.GetString(t, ctx, reader, "b"))
+			require.NoError(t, reader.Commit(ctx))
+		})
+	}
+}
+
+// TestLeafTxnUpdatesRoot verifies that a leaf transaction reads at the state
+// of its root, rejects writes and attempts to finalize the transaction, and
+// that its final state brings the refresh spans and observed timestamps it
+// accumulated back into the root.
+func TestLeafTxnUpdatesRoot(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	txn := kv.NewTxn(ctx, db)
+	require.NoError(t, txn.Put(ctx, "a", "root"))
+	// Forget what the root learned from its own write, so that anything
+	// found below comes from the leaf.
+	root := txn.Sender().(*TxnCoordSender)
+	root.mu.txn.ObservedTimestamps = nil
+	root.interceptorAlloc.txnSpanRefresher.refreshFootprint = nil
+
+	tis, err := txn.GetLeafTxnInputState(ctx)
+	require.NoError(t, err)
+	leaf := kv.NewLeafTxn(ctx, db, tis)
+	require.Equal(t, "root", kvclientutils.GetString(t, ctx, leaf, "a"))
+	require.Error(t, leaf.Put(ctx, "b", "leaf"))
+	require.Error(t, leaf.Commit(ctx))
+	require.Error(t, leaf.Rollback(ctx))
+	_, err = txn.GetLeafTxnFinalState(ctx)
+	require.Error(t, err)
+
+	tfs, err := leaf.GetLeafTxnFinalState(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []roachpb.Span{{Key: roachpb.Key("a")}}, tfs.RefreshSpans)
+	require.NotEmpty(t, tfs.Txn.ObservedTimestamps)
+
+	require.NoError(t, txn.UpdateRootWithLeafFinalState(ctx, tfs))
+	require.Equal(t, tfs.RefreshSpans, root.interceptorAlloc.txnSpanRefresher.refreshFootprint)
+	require.Equal(t, tfs.Txn.ObservedTimestamps, txn.TestingCloneTxn().ObservedTimestamps)
+	require.NoError(t, txn.Commit(ctx))
+}
+
+// TestTxnRefreshAfterWriteTimestampPush verifies that a Serializable
+// transaction whose write timestamp was pushed commits by refreshing its
+// reads, including those performed by its leaves, and that it must restart if
+// one of them was written to by another transaction in the meantime.
+func TestTxnRefreshAfterWriteTimestampPush(t *testing.T) {
+	ctx := context.Background()
+	for _, conflict := range []bool{false, true} {
+		t.Run(fmt.Sprintf("conflict=%t", conflict), func(t *testing.T) {
+			eng, err := storage.Open(ctx, storage.Location{})
+			require.NoError(t, err)
+			defer eng.Close()
+			clock := hlc.NewClock(hlc.UnixNano, time.Nanosecond)
+			evalSender := newEvalSender(eng, clock)
+			// Push the write timestamp of transactions on their writes, as the
+			// timestamp cache would after a read of the key by another
+			// transaction.
+			sender := kv.SenderFunc(func(ctx context.Context, ba *kvpb.BatchRequest) (*kvpb.BatchResponse, *kvpb.Error) {
+				br, pErr := evalSender(ctx, ba)
+				if _, ok := ba.GetArg(kvpb.Put); ok && pErr == nil {
+					br.Txn.WriteTimestamp = clock.Now()
+				}
+				return br, pErr
+			})
+			factory := NewTxnCoordSenderFactory(TxnCoordSenderFactoryConfig{Clock: clock}, sender)
+			db := kv.NewDB(ctx, factory, clock, stop.NewStopper())
+
+			txn := kv.NewTxn(ctx, db)
+			tis, err := txn.GetLeafTxnInputState(ctx)
+			require.NoError(t, err)
+			leaf := kv.NewLeafTxn(ctx, db, tis)
+			require.Equal(t, "", kvclientutils.GetString(t, ctx, leaf, "a"))
+			tfs, err := leaf.GetLeafTxnFinalState(ctx)
+			require.NoError(t, err)
+			require.NoError(t, txn.UpdateRootWithLeafFinalState(ctx, tfs))
+
+			if conflict {
+				require.NoError(t, db.Txn(ctx, func(ctx context.Context, txn *kv.Txn) error {
+					return txn.Put(ctx, "a", "other")
+				}))
+			}
+			require.NoError(t, txn.Put(ctx, "b", "txn"))
+			err = txn.Commit(ctx)
+
+			if conflict {
+				var retryErr *kvpb.TransactionRetryWithProtoRefreshError
+				require.True(t, errors.As(err, &retryErr), "unexpected error: %v", err)
+				require.NoError(t, txn.Rollback(ctx))
+				return
+			}
+			require.NoError(t, err)
+			committed := txn.TestingCloneTxn()
+			require.Equal(t, committed.WriteTimestamp, committed.ReadTimestamp)
+			require.True(t, tis.Txn.ReadTimestamp.Less(committed.ReadTimestamp))
+		})
+	}
+}
+
+// TestLeafTxnInputStateAbortedTxn verifies that no leaf can be created in a
+// transaction that is known to be aborted, and that the caller gets a
+// retryable error instead.
+func TestLeafTxnInputStateAbortedTxn(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	txn := kv.NewTxn(ctx, db)
+	require.NoError(t, txn.Put(ctx, "a", "txn"))
+	tc := txn.Sender().(*TxnCoordSender)
+	tc.mu.Lock()
+	tc.mu.txn.Status = roachpb.ABORTED
+	tc.mu.Unlock()
+
+	_, err := txn.GetLeafTxnInputState(ctx)
+	var retryErr *kvpb.TransactionRetryWithProtoRefreshError
+	require.True(t, errors.As(err, &retryErr), "unexpected error: %v", err)
+	require.True(t, retryErr.PrevTxnAborted())
+}
+
+// TestTxnCommitDeadline verifies that a deadline can only be lowered, and that
+// a transaction whose commit timestamp has reached its deadline fails to
+// commit with a retryable error, whether or not it acquired locks.
+func TestTxnCommitDeadline(t *testing.T) {
+	ctx := context.Background()
+	for _, locking := range []bool{false, true} {
+		name := "read-only"
+		if locking {
+			name = "locking"
+		}
+		t.Run(name, func(t *testing.T) {
+			db := newTestDB(t)
+			txn := kv.NewTxn(ctx, db)
+			readTS := txn.TestingCloneTxn().ReadTimestamp
+			require.False(t, txn.DeadlineLikelySufficient())
+
+			require.Error(t, txn.UpdateDeadline(ctx, hlc.Timestamp{WallTime: readTS.WallTime - 1}))
+			far := hlc.Timestamp{WallTime: readTS.WallTime + int64(time.Hour)}
+			require.NoError(t, txn.UpdateDeadline(ctx, far))
+			require.True(t, txn.DeadlineLikelySufficient())
+
+			// Raising the deadline is ignored; lowering it takes effect.
+			require.NoError(t, txn.UpdateDeadline(ctx, far.Next()))
+			require.True(t, txn.DeadlineLikelySufficient())
+			require.NoError(t, txn.UpdateDeadline(ctx, readTS))
+			require.False(t, txn.DeadlineLikelySufficient())
+
+			if locking {
+				require.NoError(t, txn.Put(ctx, "a", "txn"))
+			}
+			err := txn.Commit(ctx)
+			var retryErr *kvpb.TransactionRetryWithProtoRefreshError
+			require.True(t, errors.As(err, &retryErr), "unexpected error: %v", err)
+			require.Contains(t, retryErr.Msg, kvpb.RETRY_COMMIT_DEADLINE_EXCEEDED.String())
+			require.NoError(t, txn.Rollback(ctx))
+		})
+	}
+}
+
+// TestTxnHeartbeaterDetectsAbort verifies that the heartbeat loop of a
+// transaction that has acquired locks notices when its record is aborted by
+// a concurrent pusher, and that the client is then rejected with a
+// retryable error.
+func TestTxnHeartbeaterDetectsAbort(t *testing.T) {
+	ctx := context.Background()
+	eng, err := storage.Open(ctx, storage.Location{})
+	require.NoError(t, err)
+	defer eng.Close()
+	clock := hlc.NewClock(hlc.UnixNano, time.Nanosecond)
+	stopper := stop.NewStopper()
+	defer stopper.Stop(ctx)
+	sender := newEvalSender(eng, clock)
+	factory := NewTxnCoordSenderFactory(TxnCoordSenderFactoryConfig{
+		Clock:             clock,
+		Stopper:           stopper,
+		HeartbeatInterval: 5 * time.Millisecond,
+	}, sender)
+	db := kv.NewDB(ctx, factory, clock, stopper)
+
+	txn := kv.NewTxn(ctx, db)
+	require.NoError(t, txn.Put(ctx, "a", "1"))
+	proto := txn.TestingCloneTxn()
+	require.Equal(t, []byte("a"), proto.Key)
+
+	// Abort the transaction's record, as a concurrent pusher would.
+	pusher := roachpb.MakeTransaction("pusher", nil, isolation.Serializable, roachpb.MaxUserPriority, clock.Now())
+	ba := &kvpb.BatchRequest{}
+	ba.Timestamp = clock.Now()
+	ba.Add(&kvpb.PushTxnRequest{
+		RequestHeader: kvpb.RequestHeader{Key: proto.Key},
+		PusherTxn:     pusher,
+		PusheeTxn:     proto.TxnMeta,
+		PushType:      kvpb.PUSH_ABORT,
+	})
+	_, pErr := sender.Send(ctx, ba)
+	require.Nil(t, pErr)
+
+	require.Eventually(t, func() bool {
+		return txn.TestingCloneTxn().Status == roachpb.ABORTED
+	}, 10*time.Second, time.Millisecond)
+
+	err = txn.Put(ctx, "b", "2")
+	var retryErr *kvpb.TransactionRetryWithProtoRefreshError
+	require.True(t, errors.As(err, &retryErr), "unexpected error: %v", err)
+	require.True(t, retryErr.PrevTxnAborted())
+}
+
+// TestTxnCommitInBatchParallelCommit verifies that committing a transaction
+// in the same batch as its last writes stages the transaction record with
+// the batch's writes in flight, and that the commit is then made explicit,
+// resolving every lock of the transaction.
+func TestTxnCommitInBatchParallelCommit(t *testing.T) {
+	ctx := context.Background()
+	eng, err := storage.Open(ctx, storage.Location{})
+	require.NoError(t, err)
+	defer eng.Close()
+	clock := hlc.NewClock(hlc.UnixNano, time.Nanosecond)
+	evalSender := newEvalSender(eng, clock)
+	var endTxns []kvpb.EndTxnRequest
+	sender := kv.SenderFunc(func(ctx context.Context, ba *kvpb.BatchRequest) (*kvpb.BatchResponse, *kvpb.Error) {
+		if et, ok := ba.GetArg(kvpb.EndTxn); ok {
+			endTxns = append(endTxns, *et.(*kvpb.EndTxnRequest))
+		}
+		return evalSender(ctx, ba)
+	})
+	factory := NewTxnCoordSenderFactory(TxnCoordSenderFactoryConfig{Clock: clock}, sender)
+	db := kv.NewDB(ctx, factory, clock, stop.NewStopper())
+
+	require.NoError(t, db.Txn(ctx, func(ctx context.Context, txn *kv.Txn) error {
+		if err := txn.Put(ctx, "a", "1"); err != nil {
+			return err
+		}
+		b := txn.NewBatch()
+		b.Put("b", "2")
+		b.Put("c", "3")
+		return txn.CommitInBatch(ctx, b)
+	}))
+
+	require.Len(t, endTxns, 2)
+	staging, explicit := endTxns[0], endTxns[1]
+	require.True(t, staging.IsParallelCommit())
+	require.Equal(t, []roachpb.Span{{Key: roachpb.Key("a")}}, staging.LockSpans)
+	require.Equal(t, []roachpb.SequencedWrite{
+		{Key: roachpb.Key("b"), Sequence: 2},
+		{Key: roachpb.Key("c"), Sequence: 3},
+	}, staging.InFlightWrites)
+	require.False(t, explicit.IsParallelCommit())
+	require.Len(t, explicit.LockSpans, 3)
+
+	reader := kv.NewTxn(ctx, db)
+	require.Equal(t, "1", kvclientutils.GetString(t, ctx, reader, "a"))
+	require.Equal(t, "2", kvclientutils.GetString(t, ctx, reader, "b"))
+	require.Equal(t, "3", kvclientutils.GetString(t, ctx, reader, "c"))
+	require.NoError(t, reader.Commit(ctx))
+}
+
+// TestTxnParallelCommitInFlightWritePushed verifies that a transaction whose
+// in-flight write was pushed above the staging timestamp of its parallel
+// commit commits at the pushed timestamp if it tolerates write skew, and must
+// retry otherwise.
+func TestTxnParallelCommitInFlightWritePushed(t *testing.T) {
+	ctx := context.Background()
+	for _, isoLevel := range []isolation.Level{isolation.Serializable, isolation.ReadCommitted} {
+		t.Run(isoLevel.String(), func(t *testing.T) {
+			eng, err := storage.Open(ctx, storage.Location{})
+			require.NoError(t, err)
+			defer eng.Close()
+			clock := hlc.NewClock(hlc.UnixNano, time.Nanosecond)
+			evalSender := newEvalSender(eng, clock)
+			// Push the write timestamp of the transaction above the staging
+			// timestamp, as the timestamp cache would after a read of an
+			// in-flight write by another transaction.
+			var endTxns []kvpb.EndTxnRequest
+			var pushedTS hlc.Timestamp
+			sender := kv.SenderFunc(func(ctx context.Context, ba *kvpb.BatchRequest) (*kvpb.BatchResponse, *kvpb.Error) {
+				et, ok := ba.GetArg(kvpb.EndTxn)
+				if ok {
+					endTxns = append(endTxns, *et.(*kvpb.EndTxnRequest))
+				}
+				br, pErr := evalSender(ctx, ba)
+				if ok && et.(*kvpb.EndTxnRequest).IsParallelCommit() && pErr == nil {
+					pushedTS = clock.Now()
+					br.Txn.WriteTimestamp = pushedTS
+				}
+				return br, pErr
+			})
+			factory := NewTxnCoordSenderFactory(TxnCoordSenderFactoryConfig{Clock: clock}, sender)
+			db := kv.NewDB(ctx, factory, clock, stop.NewStopper())
+
+			txn := kv.NewTxn(ctx, db)
+			require.NoError(t, txn.SetIsoLevel(isoLevel))
+			require.NoError(t, txn.Put(ctx, "a", "1"))
+			b := txn.NewBatch()
+			b.Put("b", "2")
+			err = txn.CommitInBatch(ctx, b)
+
+			if isoLevel == isolation.Serializable {
+				var retryErr *kvpb.TransactionRetryWithProtoRefreshError
+				require.True(t, errors.As(err, &retryErr), "unexpected error: %v", err)
+				require.NoError(t, txn.Rollback(ctx))
+				return
+			}
+
+			require.NoError(t, err)
+			require.Len(t, endTxns, 2)
+			require.True(t, endTxns[0].IsParallelCommit())
+			require.False(t, endTxns[1].IsParallelCommit())
+			require.Len(t, endTxns[1].LockSpans, 2)
+			committed := txn.TestingCloneTxn()
+			require.Equal(t, roachpb.COMMITTED, committed.Status)
+			require.Equal(t, pushedTS, committed.WriteTimestamp)
+
+			reader := kv.NewTxn(ctx, db)
+			require.Equal(t, "1", kvclientutils.GetString(t, ctx, reader, "a"))
+			require.Equal(t, "2", kvclientutils.GetString(t, ctx, reader, "b"))
+			require.NoError(t, reader.Commit(ctx))
+		})
+	}
+}
+
+// TestTxnCommitTimestampAfterWriteTimestampPush verifies that the commit
+// timestamp of a committed transaction is its write timestamp, which a Read
+// Committed transaction may commit at after it was pushed above its read
+// timestamp.
+func TestTxnCommitTimestampAfterWriteTimestampPush(t *testing.T) {
+	ctx := context.Background()
+	eng, err := storage.Open(ctx, storage.Location{})
+	require.NoError(t, err)
+	defer eng.Close()
+	clock := hlc.NewClock(hlc.UnixNano, time.Nanosecond)
+	evalSender := newEvalSender(eng, clock)
+	// Push the write timestamp of the transaction on its write, as the
+	// timestamp cache would after a read of the key by another transaction.
+	sender := kv.SenderFunc(func(ctx context.Context, ba *kvpb.BatchRequest) (*kvpb.BatchResponse, *kvpb.Error) {
+		br, pErr := evalSender(ctx, ba)
+		if _, ok := ba.GetArg(kvpb.Put); ok && pErr == nil {
+			br.Txn.WriteTimestamp = clock.Now()
+		}
+		return br, pErr
+	})
+	factory := NewTxnCoordSenderFactory(TxnCoordSenderFactoryConfig{Clock: clock}, sender)
+	db := kv.NewDB(ctx, factory, clock, stop.NewStopper())
+
+	txn := kv.NewTxn(ctx, db)
+	require.NoError(t, txn.SetIsoLevel(isolation.ReadCommitted))
+	require.NoError(t, txn.Put(ctx, "a", "1"))
+	require.NoError(t, txn.Commit(ctx))
+
+	committed := txn.TestingCloneTxn()
+	require.True(t, committed.ReadTimestamp.Less(committed.WriteTimestamp))
+	commitTS, err := txn.Sender().CommitTimestamp()
+	require.NoError(t, err)
+	require.Equal(t, committed.WriteTimestamp, commitTS)
+}
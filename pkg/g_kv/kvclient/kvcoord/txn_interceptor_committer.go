@@ -0,0 +1,263 @@
+package kvcoord
+
+import (
+	"context"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/stop"
+	"sync"
+)
+
+// txnCommitter is a txnInterceptor that concerns itself with committing and
+// rolling back transactions. It intercepts EndTxn requests and coordinates
+// their execution, either by issuing them as is, or by coordinating their
+// execution in parallel with the rest of their batch.
+//
+// The latter operation, which we define as a "parallel commit", allows a
+// transaction to commit in a single round of distributed consensus instead of
+// two: the EndTxn request is sent along with the transaction's last writes,
+// which it declares as in-flight. Instead of committing the transaction
+// record, the EndTxn moves it to the STAGING state. The transaction is then
+// "implicitly committed" as soon as all of its in-flight writes have
+// succeeded at or below the timestamp at which the record was staged: anyone
+// who finds the STAGING record can verify this condition by querying the
+// in-flight writes, and can recover the transaction to its final state if its
+// coordinator disappears (see txnrecovery.Manager).
+//
+// Once the batch returns successfully, the coordinator knows that every
+// in-flight write succeeded, so it reports the commit to the client right
+// away. It then makes the commit "explicit" asynchronously, by sending a
+// second EndTxn that moves the record to the COMMITTED state and resolves the
+// transaction's locks.
+//
+// The interceptor does not attempt a parallel commit for batches that
+// contain no writes, since the EndTxn would then have no in-flight writes to
+// run in parallel with. A batch containing all of the transaction's writes
+// may also be committed by the server in one phase, without writing a
+// transaction record at all; the interceptor detects this from the status of
+// the returned transaction.
+type txnCommitter struct {
+	wrapped lockedSender
+	// stopper is used to make commits explicit asynchronously. If nil, they
+	// are made explicit synchronously, before the client is notified of the
+	// commit.
+	stopper *stop.Stopper
+	mu      sync.Locker
+}
+
+// init initializes the txnCommitter. This method exists instead of a
+// constructor because txnCommitters are pre-allocated on the TxnCoordSender.
+func (tc *txnCommitter) init(mu sync.Locker, stopper *stop.Stopper) {
+	tc.mu = mu
+	tc.stopper = stopper
+}
+
+// SendLocked implements the lockedSender interface.
+func (tc *txnCommitter) SendLocked(
+	ctx context.Context, ba *kvpb.BatchRequest,
+) (*kvpb.BatchResponse, *kvpb.Error) {
+	// If the batch does not include an EndTxn request, pass it through.
+	rArgs, hasET := ba.GetArg(kvpb.EndTxn)
+	if !hasET {
+		return tc.wrapped.SendLocked(ctx, ba)
+	}
+	et := rArgs.(*kvpb.EndTxnRequest)
+
+	if len(et.Key) != 0 {
+		return nil, kvpb.NewErrorf("EndTxn must not have a Key set")
+	}
+	// The EndTxn is addressed to the transaction's anchor key, where its
+	// record lives.
+	et.Key = ba.Txn.Key
+
+	// Determine whether the commit can run in parallel with the rest of the
+	// batch. If not, send the EndTxn as is. A commit trigger must run when the
+	// transaction is explicitly committed, so it rules out parallel commits.
+	if !et.Commit || et.InternalCommitTrigger != nil || !canCommitInParallel(ba) {
+		return tc.wrapped.SendLocked(ctx, ba)
+	}
+
+	// Declare the point writes in the batch as in-flight, and remove them from
+	// the lock spans attached to the EndTxn: while the transaction is STAGING,
+	// its in-flight writes are not known to have succeeded.
+	etCopy := *et
+	etCopy.InFlightWrites = nil
+	inFlight := make(map[string]struct{})
+	for _, ru := range ba.Requests[:len(ba.Requests)-1] {
+		req := ru.GetInner()
+		if !kvpb.IsIntentWrite(req) {
+			continue
+		}
+		h := req.Header()
+		etCopy.InFlightWrites = append(etCopy.InFlightWrites,
+			roachpb.SequencedWrite{Key: h.Key, Sequence: h.Sequence})
+		inFlight[string(h.Key)] = struct{}{}
+	}
+	etCopy.LockSpans = nil
+	for _, sp := range et.LockSpans {
+		if _, ok := inFlight[string(sp.Key)]; ok && len(sp.EndKey) == 0 {
+			continue
+		}
+		etCopy.LockSpans = append(etCopy.LockSpans, sp)
+	}
+	reqs := append([]kvpb.RequestUnion(nil), ba.Requests...)
+	reqs[len(reqs)-1].MustSetInner(&etCopy)
+	ba = ba.ShallowCopy()
+	ba.Requests = reqs
+
+	br, pErr := tc.wrapped.SendLocked(ctx, ba)
+	if pErr != nil {
+		// If the batch failed, the transaction record may have been staged
+		// even though one of the in-flight writes failed. The transaction is
+		// then not implicitly committed, and the record is either replaced by
+		// the next attempt or rolled back by the client.
+		return nil, pErr
+	}
+
+	// If the transaction was committed directly, for instance because the
+	// server committed it in one phase, there is nothing left to do.
+	if br.Txn == nil || br.Txn.Status != roachpb.STAGING {
+		return br, nil
+	}
+
+	lockSpans := append([]roachpb.Span(nil), etCopy.LockSpans...)
+	for _, w := range etCopy.InFlightWrites {
+		lockSpans = append(lockSpans, roachpb.Span{Key: w.Key})
+	}
+
+	// Determine whether any of the in-flight writes was pushed above the
+	// timestamp at which the record was staged. If so, the transaction is not
+	// implicitly committed. A transaction which tolerates write skew may
+	// commit at the pushed timestamp, since its writes all succeeded; any
+	// other transaction must retry.
+	etResp := br.Responses[len(br.Responses)-1].GetInner().(*kvpb.EndTxnResponse)
+	if stagingTxn := etResp.Txn; stagingTxn != nil &&
+		stagingTxn.WriteTimestamp.Less(br.Txn.WriteTimestamp) {
+		txn := br.Txn.Clone()
+		txn.Status = roachpb.PENDING
+		if !txn.IsoLevel.ToleratesWriteSkew() {
+			return nil, kvpb.NewErrorWithTxn(kvpb.NewTransactionRetryError(
+				kvpb.RETRY_SERIALIZABLE, "in-flight write pushed above staging timestamp"), txn)
+		}
+		return tc.retryTxnCommitAfterFailedParallelCommitLocked(ctx, ba, br, txn, lockSpans)
+	}
+
+	// All of the in-flight writes succeeded, so the transaction is implicitly
+	// committed. Make the commit explicit and report it to the client.
+	tc.makeTxnCommitExplicitLocked(ctx, br.Txn.Clone(), lockSpans)
+	br.Txn = br.Txn.Clone()
+	br.Txn.Status = roachpb.COMMITTED
+	return br, nil
+}
+
+// canCommitInParallel determines whether the batch can issue its committing
+// EndTxn in parallel with the rest of its requests. This is possible if the
+// batch contains at least one write and none of its writes are ranged: every
+// write in the batch must be a point write whose success can later be
+// verified with a QueryIntent. Locking reads prevent a parallel commit, since
+// the locks they acquire cannot be verified this way.
+func canCommitInParallel(ba *kvpb.BatchRequest) bool {
+	var hasWrites bool
+	for _, ru := range ba.Requests[:len(ba.Requests)-1] {
+		req := ru.GetInner()
+		switch {
+		case kvpb.IsIntentWrite(req):
+			if kvpb.IsRange(req) {
+				return false
+			}
+			hasWrites = true
+		case kvpb.IsLocking(req):
+			return false
+		}
+	}
+	return hasWrites
+}
+
+// retryTxnCommitAfterFailedParallelCommitLocked commits a transaction whose
+// parallel commit failed because one of its in-flight writes was pushed above
+// the staging timestamp. The writes have all succeeded, so the EndTxn is sent
+// again on its own, at the pushed timestamp, with the in-flight writes among
+// its lock spans. The record then moves from STAGING to COMMITTED directly.
+func (tc *txnCommitter) retryTxnCommitAfterFailedParallelCommitLocked(
+	ctx context.Context,
+	ba *kvpb.BatchRequest,
+	br *kvpb.BatchResponse,
+	txn *roachpb.Transaction,
+	lockSpans []roachpb.Span,
+) (*kvpb.BatchResponse, *kvpb.Error) {
+	etIdx := len(ba.Requests) - 1
+	et := *ba.Requests[etIdx].GetInner().(*kvpb.EndTxnRequest)
+	et.InFlightWrites = nil
+	et.LockSpans = lockSpans
+	baSuffix := ba.ShallowCopy()
+	baSuffix.Txn = txn
+	baSuffix.Requests = nil
+	baSuffix.Add(&et)
+
+	brSuffix, pErr := tc.wrapped.SendLocked(ctx, baSuffix)
+	if pErr != nil {
+		return nil, pErr
+	}
+	br.Txn = brSuffix.Txn
+	br.Responses[etIdx] = brSuffix.Responses[0]
+	return br, nil
+}
+
+// makeTxnCommitExplicitLocked sends an EndTxn request that moves the STAGING
+// transaction record to the COMMITTED state and resolves the transaction's
+// locks. If the interceptor has a stopper, the request is sent
+// asynchronously. Failures are ignored: the record then remains STAGING and
+// is eventually recovered by a concurrent transaction that runs into one of
+// the transaction's locks.
+func (tc *txnCommitter) makeTxnCommitExplicitLocked(
+	ctx context.Context, txn *roachpb.Transaction, lockSpans []roachpb.Span,
+) {
+	ba := &kvpb.BatchRequest{}
+	ba.Txn = txn
+	ba.Add(&kvpb.EndTxnRequest{
+		RequestHeader: kvpb.RequestHeader{Key: txn.Key},
+		Commit:        true,
+		LockSpans:     lockSpans,
+	})
+	if tc.stopper == nil {
+		_, _ = tc.wrapped.SendLocked(ctx, ba)
+		return
+	}
+	_ = tc.stopper.RunAsyncTask(context.Background(), "txnCommitter: making txn commit explicit",
+		func(ctx context.Context) {
+			tc.mu.Lock()
+			defer tc.mu.Unlock()
+			_, _ = tc.wrapped.SendLocked(ctx, ba)
+		})
+}
+
+// setWrapped implements the txnInterceptor interface.
+func (tc *txnCommitter) setWrapped(wrapped lockedSender) {
+	tc.wrapped = wrapped
+}
+
+// populateLeafInputState is part of the txnInterceptor interface.
+func (*txnCommitter) populateLeafInputState(*roachpb.LeafTxnInputState) {}
+
+// initializeLeaf is part of the txnInterceptor interface.
+func (*txnCommitter) initializeLeaf(*roachpb.LeafTxnInputState) {}
+
+// populateLeafFinalState is part of the txnInterceptor interface.
+func (*txnCommitter) populateLeafFinalState(*roachpb.LeafTxnFinalState) {}
+
+// importLeafFinalState is part of the txnInterceptor interface.
+func (*txnCommitter) importLeafFinalState(context.Context, *roachpb.LeafTxnFinalState) error {
+	return nil
+}
+
+// createSavepointLocked is part of the txnInterceptor interface.
+func (*txnCommitter) createSavepointLocked(context.Context, *savepoint) {}
+
+// rollbackToSavepointLocked is part of the txnInterceptor interface.
+func (*txnCommitter) rollbackToSavepointLocked(context.Context, savepoint) {}
+
+// epochBumpedLocked implements the txnInterceptor interface.
+func (*txnCommitter) epochBumpedLocked() {}
+
+// closeLocked implements the txnInterceptor interface.
+func (*txnCommitter) closeLocked() {}
@@ -0,0 +1,307 @@
+package kvcoord
+
+import (
+	"context"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/stop"
+	"sync"
+	"time"
+)
+
+// DefaultTxnHeartbeatInterval is how often a transaction coordinator
+// heartbeats the transaction record of a transaction that has acquired
+// locks. It must be comfortably below txnwait.TxnLivenessThreshold so
+// that concurrent pushers do not consider the transaction abandoned.
+const DefaultTxnHeartbeatInterval = time.Second
+
+// txnHeartbeater is a txnInterceptor in charge of a transaction's heartbeat
+// loop. Transaction coordinators heartbeat their transaction record
+// periodically to indicate the liveness of their transaction. Other actors
+// like concurrent transactions check a transaction record's heartbeat
+// timestamp to determine whether the transaction is still live (see
+// txnwait.IsExpired); a transaction whose record has not been heartbeated
+// recently can be aborted by anyone who runs into one of its locks.
+//
+// The interceptor is also in charge of choosing the transaction's anchor
+// key: the key of the first locking request sent by the transaction, at
+// which its transaction record is located.
+//
+// When the heartbeat loop discovers that the transaction record has been
+// aborted, it marks the transaction as ABORTED, so that the client is
+// rejected on its next request (see maybeRejectClientLocked), and it
+// asynchronously rolls back the transaction to clean up its locks.
+//
+// Only root transactions heartbeat their record; the interceptor is not part
+// of the interceptor stack of leaf transactions.
+type txnHeartbeater struct {
+	wrapped lockedSender
+
+	// gatekeeper is the sender to which heartbeat requests are sent. It is
+	// the bottom of the interceptor stack, so heartbeats bypass the other
+	// interceptors.
+	gatekeeper lockedSender
+
+	// stopper is used to run the heartbeat loop. If nil, the transaction
+	// record is never heartbeated.
+	stopper      *stop.Stopper
+	clock        *hlc.Clock
+	loopInterval time.Duration
+
+	// mu contains state protected by the TxnCoordSender's mutex.
+	mu struct {
+		sync.Locker
+
+		// txn is a reference to the TxnCoordSender's proto.
+		txn *roachpb.Transaction
+
+		// loopStarted indicates whether the heartbeat loop has been launched
+		// for the transaction or not. It remains true once the loop terminates.
+		loopStarted bool
+
+		// loopCancel is a function to cancel the context of the heartbeat
+		// loop. Non-nil if the heartbeat loop is currently running.
+		loopCancel func()
+	}
+}
+
+// init initializes the txnHeartbeater. This method exists instead of a
+// constructor because txnHeartbeaters are pre-allocated on the TxnCoordSender.
+func (h *txnHeartbeater) init(
+	mu sync.Locker,
+	txn *roachpb.Transaction,
+	gatekeeper lockedSender,
+	stopper *stop.Stopper,
+	clock *hlc.Clock,
+	loopInterval time.Duration,
+) {
+	h.stopper = stopper
+	h.clock = clock
+	h.loopInterval = loopInterval
+	h.gatekeeper = gatekeeper
+	h.mu.Locker = mu
+	h.mu.txn = txn
+}
+
+// SendLocked is part of the txnInterceptor interface.
+func (h *txnHeartbeater) SendLocked(
+	ctx context.Context, ba *kvpb.BatchRequest,
+) (*kvpb.BatchResponse, *kvpb.Error) {
+	if ba.IsLocking() {
+		// If this is the first locking request of the transaction, anchor the
+		// transaction at the key of that request. The transaction record will
+		// be written at this key.
+		if len(h.mu.txn.Key) == 0 {
+			for _, ru := range ba.Requests {
+				req := ru.GetInner()
+				if kvpb.IsLocking(req) {
+					anchor := req.Header().Key
+					h.mu.txn.Key = anchor
+					// Put the anchor also in the ba's copy of the txn, since this
+					// batch was prepared before we had an anchor.
+					ba.Txn.Key = anchor
+					break
+				}
+			}
+		}
+
+		// Start the heartbeat loop if it has not already started.
+		if !h.mu.loopStarted {
+			h.startHeartbeatLoopLocked(ctx)
+		}
+	}
+
+	// Forward the batch through the wrapped lockedSender.
+	return h.wrapped.SendLocked(ctx, ba)
+}
+
+// setWrapped is part of the txnInterceptor interface.
+func (h *txnHeartbeater) setWrapped(wrapped lockedSender) {
+	h.wrapped = wrapped
+}
+
+// populateLeafInputState is part of the txnInterceptor interface.
+func (*txnHeartbeater) populateLeafInputState(*roachpb.LeafTxnInputState) {}
+
+// initializeLeaf is part of the txnInterceptor interface.
+func (*txnHeartbeater) initializeLeaf(*roachpb.LeafTxnInputState) {}
+
+// populateLeafFinalState is part of the txnInterceptor interface.
+func (*txnHeartbeater) populateLeafFinalState(*roachpb.LeafTxnFinalState) {}
+
+// importLeafFinalState is part of the txnInterceptor interface.
+func (*txnHeartbeater) importLeafFinalState(context.Context, *roachpb.LeafTxnFinalState) error {
+	return nil
+}
+
+// createSavepointLocked is part of the txnInterceptor interface.
+func (*txnHeartbeater) createSavepointLocked(context.Context, *savepoint) {}
+
+// rollbackToSavepointLocked is part of the txnInterceptor interface.
+func (*txnHeartbeater) rollbackToSavepointLocked(context.Context, savepoint) {}
+
+// epochBumpedLocked is part of the txnInterceptor interface.
+func (h *txnHeartbeater) epochBumpedLocked() {}
+
+// closeLocked is part of the txnInterceptor interface.
+func (h *txnHeartbeater) closeLocked() {
+	h.cancelHeartbeatLoopLocked()
+}
+
+// startHeartbeatLoopLocked starts a heartbeat loop in a different goroutine.
+func (h *txnHeartbeater) startHeartbeatLoopLocked(ctx context.Context) {
+	if h.stopper == nil {
+		// Heartbeats are disabled.
+		return
+	}
+	if h.mu.loopStarted {
+		panic("attempting to start a second heartbeat loop")
+	}
+	h.mu.loopStarted = true
+
+	// The heartbeat loop is decoupled from the context of the request that
+	// started it: it outlives that request and runs until the transaction is
+	// finalized or the stopper quiesces.
+	hbCtx, cancel := context.WithCancel(context.Background())
+	h.mu.loopCancel = cancel
+	if err := h.stopper.RunAsyncTask(hbCtx, "kv.TxnCoordSender: heartbeat loop", h.heartbeatLoop); err != nil {
+		h.mu.loopCancel = nil
+		cancel()
+	}
+}
+
+// cancelHeartbeatLoopLocked stops the heartbeat loop, if it is running.
+func (h *txnHeartbeater) cancelHeartbeatLoopLocked() {
+	if h.heartbeatLoopRunningLocked() {
+		h.mu.loopCancel()
+		h.mu.loopCancel = nil
+	}
+}
+
+// heartbeatLoopRunningLocked returns whether the heartbeat loop is running.
+func (h *txnHeartbeater) heartbeatLoopRunningLocked() bool {
+	return h.mu.loopCancel != nil
+}
+
+// heartbeatLoop periodically sends a HeartbeatTxn request to the transaction
+// record, stopping in the event the transaction is aborted or committed, or
+// the loop is canceled.
+func (h *txnHeartbeater) heartbeatLoop(ctx context.Context) {
+	ticker := time.NewTicker(h.loopInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if !h.heartbeat(ctx) {
+				// The loop has been canceled or the transaction has been
+				// finalized.
+				return
+			}
+		case <-ctx.Done():
+			// Transaction finished normally.
+			return
+		case <-h.stopper.ShouldQuiesce():
+			return
+		}
+	}
+}
+
+// heartbeat sends a HeartbeatTxnRequest to the txn record. Returns true if
+// the heartbeat loop should continue, false otherwise.
+func (h *txnHeartbeater) heartbeat(ctx context.Context) bool {
+	// Like with the TxnCoordSender, the locking here is peculiar. The lock is
+	// not held continuously throughout this method: it is acquired here and
+	// then released in the txnLockGatekeeper while the request is in flight.
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// The loop was canceled while we were waiting for the lock.
+	if ctx.Err() != nil {
+		return false
+	}
+
+	// If the txn is no longer pending, there's nothing to heartbeat.
+	if h.mu.txn.Status != roachpb.PENDING {
+		return false
+	}
+
+	txn := h.mu.txn.Clone()
+	ba := &kvpb.BatchRequest{}
+	ba.Txn = txn
+	ba.Add(&kvpb.HeartbeatTxnRequest{
+		RequestHeader: kvpb.RequestHeader{
+			Key: txn.Key,
+		},
+		Now: h.clock.Now(),
+	})
+
+	// Send the heartbeat request directly through the gatekeeper. This
+	// bypasses much of the TxnCoordSender stack, as heartbeats do not need
+	// sequence numbers or to be tracked as locks.
+	br, pErr := h.gatekeeper.SendLocked(ctx, ba)
+
+	// If the loop was canceled while the request was in flight, the
+	// transaction was finalized by the client; ignore the response.
+	if ctx.Err() != nil {
+		return false
+	}
+
+	if pErr != nil {
+		if _, ok := pErr.GetDetail().(*kvpb.TransactionAbortedError); ok {
+			// The transaction record was aborted, for example by a concurrent
+			// pusher. Mark the transaction as aborted so that the client is
+			// rejected on its next request, and clean up its locks.
+			h.mu.txn.Status = roachpb.ABORTED
+			h.abortTxnAsyncLocked(ctx)
+			h.cancelHeartbeatLoopLocked()
+			return false
+		}
+		// Other errors are transient from the perspective of the heartbeat
+		// loop; retry on the next tick.
+		return true
+	}
+	respTxn := br.Responses[0].GetInner().(*kvpb.HeartbeatTxnResponse).Txn
+	if respTxn == nil {
+		respTxn = br.Txn
+	}
+
+	// Tear down the heartbeat loop if the response transaction is finalized.
+	if respTxn != nil && respTxn.Status.IsFinalized() {
+		switch respTxn.Status {
+		case roachpb.COMMITTED:
+			// Shut down the heartbeat loop without doing anything else.
+			// We must be racing with an EndTxn request.
+		case roachpb.ABORTED:
+			// Roll back the transaction record to clean up its locks.
+			h.mu.txn.Status = roachpb.ABORTED
+			h.abortTxnAsyncLocked(ctx)
+		}
+		h.cancelHeartbeatLoopLocked()
+		return false
+	}
+	return true
+}
+
+// abortTxnAsyncLocked sends an EndTxn(commit=false) asynchronously. The
+// purpose is to resolve the locks of an aborted transaction as soon as
+// possible; the TxnCoordSender rejects the client on its next request.
+func (h *txnHeartbeater) abortTxnAsyncLocked(ctx context.Context) {
+	txn := h.mu.txn.Clone()
+	ba := &kvpb.BatchRequest{}
+	ba.Txn = txn
+	ba.Add(&kvpb.EndTxnRequest{
+		RequestHeader: kvpb.RequestHeader{Key: txn.Key},
+		Commit:        false,
+	})
+
+	_ = h.stopper.RunAsyncTask(context.Background(), "txnHeartbeater: aborting txn",
+		func(ctx context.Context) {
+			h.mu.Lock()
+			defer h.mu.Unlock()
+			// Send the abort through the rest of the interceptor stack, so that
+			// the txnPipeliner attaches the lock spans to the EndTxn.
+			_, _ = h.wrapped.SendLocked(ctx, ba)
+		})
+}
@@ -0,0 +1,112 @@
+package kvcoord
+
+import (
+	"context"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+)
+
+// txnPipeliner is a txnInterceptor that tracks the locks acquired by a
+// transaction so that they can be resolved when the transaction finishes.
+//
+// The interceptor records the key spans of every locking request that passes
+// through it in its lock footprint. When the transaction commits or aborts,
+// the footprint is attached to the EndTxn request, which then resolves the
+// locks in each of the spans.
+//
+// The lock footprint is not affected by savepoint rollbacks: the locks
+// acquired after a savepoint was created remain held, and the intents written
+// after it remain in place (their values are ignored through the txn's ignored
+// seqnum list), so they still need to be resolved when the transaction
+// finishes.
+type txnPipeliner struct {
+	wrapped lockedSender
+
+	// lockFootprint contains spans where locks have been acquired at some
+	// point by the transaction.
+	lockFootprint []roachpb.Span
+}
+
+// SendLocked implements the lockedSender interface.
+func (tp *txnPipeliner) SendLocked(
+	ctx context.Context, ba *kvpb.BatchRequest,
+) (*kvpb.BatchResponse, *kvpb.Error) {
+	// Record the spans of the locking requests before sending them. Even if
+	// the batch fails, its locks may have been acquired and so they need to
+	// be resolved when the transaction finishes.
+	for _, ru := range ba.Requests {
+		req := ru.GetInner()
+		if kvpb.IsLocking(req) {
+			tp.lockFootprint = append(tp.lockFootprint, req.Header().Span())
+		}
+	}
+
+	ba = tp.attachLocksToEndTxn(ba)
+	return tp.wrapped.SendLocked(ctx, ba)
+}
+
+// attachLocksToEndTxn attaches the lock footprint to the EndTxn request in
+// the batch, if there is one.
+func (tp *txnPipeliner) attachLocksToEndTxn(ba *kvpb.BatchRequest) *kvpb.BatchRequest {
+	args, hasET := ba.GetArg(kvpb.EndTxn)
+	if !hasET {
+		return ba
+	}
+	et := args.(*kvpb.EndTxnRequest)
+	if len(et.LockSpans) > 0 {
+		return ba
+	}
+	// Copy the EndTxn request and the request slice so that the caller's batch
+	// is not modified.
+	etCopy := *et
+	etCopy.LockSpans = append([]roachpb.Span(nil), tp.lockFootprint...)
+	reqs := append([]kvpb.RequestUnion(nil), ba.Requests...)
+	reqs[len(reqs)-1].MustSetInner(&etCopy)
+	ba = ba.ShallowCopy()
+	ba.Requests = reqs
+	return ba
+}
+
+// hasAcquiredLocks returns whether the interceptor has made an attempt to
+// acquire any locks, whether doing so was known to be successful or not.
+func (tp *txnPipeliner) hasAcquiredLocks() bool {
+	return len(tp.lockFootprint) > 0
+}
+
+// setWrapped implements the txnInterceptor interface.
+func (tp *txnPipeliner) setWrapped(wrapped lockedSender) {
+	tp.wrapped = wrapped
+}
+
+// populateLeafInputState is part of the txnInterceptor interface.
+func (tp *txnPipeliner) populateLeafInputState(*roachpb.LeafTxnInputState) {}
+
+// initializeLeaf is part of the txnInterceptor interface.
+func (tp *txnPipeliner) initializeLeaf(*roachpb.LeafTxnInputState) {}
+
+// populateLeafFinalState is part of the txnInterceptor interface.
+func (tp *txnPipeliner) populateLeafFinalState(*roachpb.LeafTxnFinalState) {}
+
+// importLeafFinalState is part of the txnInterceptor interface.
+func (tp *txnPipeliner) importLeafFinalState(context.Context, *roachpb.LeafTxnFinalState) error {
+	// Leaf transactions do not acquire locks, so there is nothing to import.
+	return nil
+}
+
+// createSavepointLocked is part of the txnInterceptor interface.
+func (tp *txnPipeliner) createSavepointLocked(context.Context, *savepoint) {}
+
+// rollbackToSavepointLocked is part of the txnInterceptor interface.
+func (tp *txnPipeliner) rollbackToSavepointLocked(context.Context, savepoint) {
+	// The lock footprint is deliberately kept; see the comment on
+	// txnPipeliner.
+}
+
+// epochBumpedLocked implements the txnInterceptor interface.
+func (tp *txnPipeliner) epochBumpedLocked() {
+	// The lock footprint is deliberately kept: the locks acquired in earlier
+	// epochs still need to be resolved when the transaction finishes.
+}
+
+// closeLocked implements the txnInterceptor interface.
+func (tp *txnPipeliner) closeLocked() {}
@@ -0,0 +1,174 @@
+package kvcoord
+
+import (
+	"context"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+)
+
+// txnSpanRefresher is a txnInterceptor that collects the read spans of a
+// serializable transaction, so that it can commit after its write timestamp
+// was pushed. The spans are the transaction's "refresh spans": to move its
+// read timestamp forward without restarting, the transaction verifies that
+// none of them has been written to between its original and its new read
+// timestamp. A serializable transaction can only commit at the timestamp at
+// which it read, so when its write timestamp is above its read timestamp, its
+// reads are refreshed before the batch which commits it is sent. If the
+// refresh fails, the transaction must restart.
+//
+// Only transactions that do not tolerate write skew need their reads to be
+// refreshed; transactions running under weaker isolation levels may commit
+// at a timestamp above the one at which they read, so no refresh spans are
+// collected for them.
+//
+// Refresh spans survive savepoint rollbacks: the reads performed after a
+// savepoint may have influenced the writes that remain. They are discarded
+// when the transaction's epoch is bumped, as a restarted transaction reads
+// everything again at its new read timestamp.
+//
+// In a distributed transaction, leaf coordinators collect refresh spans for
+// the reads they perform and hand them to the root coordinator through their
+// LeafTxnFinalState.
+type txnSpanRefresher struct {
+	wrapped lockedSender
+
+	// refreshFootprint contains key spans which were read during the
+	// transaction. In case the transaction's timestamp needs to be pushed, we
+	// can avoid a retriable error by "refreshing" these spans: verifying that
+	// there have been no changes to their data in between the timestamp at
+	// which they were read and the higher timestamp we want to move to.
+	refreshFootprint []roachpb.Span
+}
+
+// SendLocked implements the lockedSender interface.
+func (sr *txnSpanRefresher) SendLocked(
+	ctx context.Context, ba *kvpb.BatchRequest,
+) (*kvpb.BatchResponse, *kvpb.Error) {
+	if ba.Txn.IsoLevel.ToleratesWriteSkew() {
+		return sr.wrapped.SendLocked(ctx, ba)
+	}
+
+	ba, pErr := sr.maybeRefreshPreemptivelyLocked(ctx, ba)
+	if pErr != nil {
+		return nil, pErr
+	}
+	br, pErr := sr.wrapped.SendLocked(ctx, ba)
+	if pErr != nil {
+		return nil, pErr
+	}
+	sr.appendRefreshSpans(ba, br)
+	return br, nil
+}
+
+// maybeRefreshPreemptivelyLocked refreshes the reads of a transaction whose
+// write timestamp was pushed above its read timestamp, before the batch which
+// commits it is sent: the EndTxn would otherwise be rejected with a
+// RETRY_SERIALIZABLE error. If the refresh succeeds, the batch is returned
+// with its transaction's read timestamp moved up to the write timestamp.
+func (sr *txnSpanRefresher) maybeRefreshPreemptivelyLocked(
+	ctx context.Context, ba *kvpb.BatchRequest,
+) (*kvpb.BatchRequest, *kvpb.Error) {
+	if et, hasET := ba.GetArg(kvpb.EndTxn); !hasET || !et.(*kvpb.EndTxnRequest).Commit {
+		return ba, nil
+	}
+	if ba.Txn.WriteTimestamp.LessEq(ba.Txn.ReadTimestamp) || ba.Txn.ReadTimestampFixed {
+		return ba, nil
+	}
+	refreshTxn := ba.Txn.Clone()
+	refreshTxn.BumpReadTimestamp(ba.Txn.WriteTimestamp)
+	if pErr := sr.tryRefreshTxnSpansLocked(ctx, ba.Txn.ReadTimestamp, refreshTxn); pErr != nil {
+		return nil, kvpb.NewErrorWithTxn(kvpb.NewTransactionRetryError(
+			kvpb.RETRY_SERIALIZABLE, "failed preemptive refresh: "+pErr.String()), ba.Txn)
+	}
+	ba = ba.ShallowCopy()
+	ba.Txn = refreshTxn
+	return ba, nil
+}
+
+// tryRefreshTxnSpansLocked verifies that none of the refresh spans has been
+// written to between refreshFrom and the read timestamp of refreshTxn.
+func (sr *txnSpanRefresher) tryRefreshTxnSpansLocked(
+	ctx context.Context, refreshFrom hlc.Timestamp, refreshTxn *roachpb.Transaction,
+) *kvpb.Error {
+	if len(sr.refreshFootprint) == 0 {
+		return nil
+	}
+	ba := &kvpb.BatchRequest{}
+	ba.Txn = refreshTxn
+	for _, sp := range sr.refreshFootprint {
+		if len(sp.EndKey) == 0 {
+			sp.EndKey = sp.Key.Next()
+		}
+		ba.Add(&kvpb.RefreshRangeRequest{
+			RequestHeader: kvpb.RequestHeaderFromSpan(sp),
+			RefreshFrom:   refreshFrom,
+		})
+	}
+	_, pErr := sr.wrapped.SendLocked(ctx, ba)
+	return pErr
+}
+
+// appendRefreshSpans appends the spans read by the batch to the refresh
+// footprint. The spans of reads that stopped early because of a limit only
+// cover the part of the keyspace that was actually read.
+func (sr *txnSpanRefresher) appendRefreshSpans(ba *kvpb.BatchRequest, br *kvpb.BatchResponse) {
+	for i, ru := range ba.Requests {
+		req := ru.GetInner()
+		if !kvpb.IsReadOnly(req) {
+			continue
+		}
+		span := req.Header().Span()
+		if i < len(br.Responses) {
+			if resume := br.Responses[i].GetInner().Header().ResumeSpan; resume != nil {
+				if resume.Key.Equal(span.Key) {
+					// Nothing was read.
+					continue
+				}
+				span.EndKey = resume.Key
+			}
+		}
+		sr.refreshFootprint = append(sr.refreshFootprint, span)
+	}
+}
+
+// setWrapped implements the txnInterceptor interface.
+func (sr *txnSpanRefresher) setWrapped(wrapped lockedSender) {
+	sr.wrapped = wrapped
+}
+
+// populateLeafInputState is part of the txnInterceptor interface.
+func (sr *txnSpanRefresher) populateLeafInputState(*roachpb.LeafTxnInputState) {}
+
+// initializeLeaf is part of the txnInterceptor interface.
+func (sr *txnSpanRefresher) initializeLeaf(*roachpb.LeafTxnInputState) {}
+
+// populateLeafFinalState is part of the txnInterceptor interface.
+func (sr *txnSpanRefresher) populateLeafFinalState(tfs *roachpb.LeafTxnFinalState) {
+	tfs.RefreshSpans = append([]roachpb.Span(nil), sr.refreshFootprint...)
+}
+
+// importLeafFinalState is part of the txnInterceptor interface.
+func (sr *txnSpanRefresher) importLeafFinalState(
+	ctx context.Context, tfs *roachpb.LeafTxnFinalState,
+) error {
+	sr.refreshFootprint = append(sr.refreshFootprint, tfs.RefreshSpans...)
+	return nil
+}
+
+// createSavepointLocked is part of the txnInterceptor interface.
+func (sr *txnSpanRefresher) createSavepointLocked(context.Context, *savepoint) {}
+
+// rollbackToSavepointLocked is part of the txnInterceptor interface.
+func (sr *txnSpanRefresher) rollbackToSavepointLocked(context.Context, savepoint) {
+	// The refresh footprint is deliberately kept; see the comment on
+	// txnSpanRefresher.
+}
+
+// epochBumpedLocked implements the txnInterceptor interface.
+func (sr *txnSpanRefresher) epochBumpedLocked() {
+	sr.refreshFootprint = nil
+}
+
+// closeLocked implements the txnInterceptor interface.
+func (sr *txnSpanRefresher) closeLocked() {}
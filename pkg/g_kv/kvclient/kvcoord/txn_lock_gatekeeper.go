@@ -0,0 +1,29 @@
+package kvcoord
+
+import (
+	"context"
+	kv "github.com/dborchard/tiny_crdb/pkg/g_kv"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	"sync"
+)
+
+// txnLockGatekeeper is a lockedSender that sits at the bottom of the
+// TxnCoordSender's interceptor stack and handles unlocking the TxnCoordSender's
+// mutex when sending a request and locking the TxnCoordSender's mutex when
+// receiving a response. It allows the entire txnInterceptor stack to operate
+// under lock without needing to worry about unlocking at the correct time.
+type txnLockGatekeeper struct {
+	wrapped kv.Sender
+	mu      sync.Locker // shared with TxnCoordSender
+}
+
+// SendLocked implements the lockedSender interface.
+func (gs *txnLockGatekeeper) SendLocked(
+	ctx context.Context, ba *kvpb.BatchRequest,
+) (*kvpb.BatchResponse, *kvpb.Error) {
+	// Note the funky locking here: we unlock for the duration of the call and
+	// the lock again.
+	gs.mu.Unlock()
+	defer gs.mu.Lock()
+	return gs.wrapped.Send(ctx, ba)
+}
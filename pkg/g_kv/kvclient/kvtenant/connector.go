@@ -2,9 +2,22 @@ package kvtenant
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
 	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	rpc "github.com/dborchard/tiny_crdb/pkg/g_rpc"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/stop"
+	"math/rand"
 	"sync"
+	"time"
+)
+
+// dialInitialBackoff and dialMaxBackoff bound the backoff between the
+// attempts of the connector to dial the KV nodes.
+const (
+	dialInitialBackoff = 50 * time.Millisecond
+	dialMaxBackoff     = 3 * time.Second
 )
 
 type connectorFactory struct {
@@ -47,6 +60,7 @@ type Connector interface {
 //
 // See below for the connector's roles.
 type connector struct {
+	rpcContext                         *rpc.Context
 	addrs                              []string
 	earlyShutdownIfMissingTenantRecord bool
 
@@ -60,9 +74,9 @@ type connector struct {
 }
 
 // NewConnector creates a new connector.
-// NOTE: Calling Start will set cfg.RPCContext.ClusterID.
 func NewConnector(cfg ConnectorConfig, addrs []string) Connector {
 	c := &connector{
+		rpcContext:                         cfg.RPCContext,
 		addrs:                              addrs,
 		earlyShutdownIfMissingTenantRecord: cfg.ShutdownTenantConnectorEarlyIfNoRecordPresent,
 	}
@@ -73,11 +87,49 @@ func NewConnector(cfg ConnectorConfig, addrs []string) Connector {
 	return c
 }
 
-// Start launches the connector's worker thread and waits for it to successfully
-// connect to a KV node. Start returns once the connector has determined the
-// cluster's ID and set connector.rpcContext.ClusterID.
+// Start dials the KV nodes until it successfully connects to one of them.
+// The addresses are tried in a random order, so that the connectors of a
+// tenant spread over the nodes, and all of them are retried with an
+// exponential backoff until ctx is canceled or the stopper quiesces.
 func (c *connector) Start(ctx context.Context) error {
-	return nil
+	if len(c.addrs) == 0 {
+		return errors.New("no KV node addresses to connect to")
+	}
+	backoff := dialInitialBackoff
+	for {
+		client, err := c.dialAddrs(ctx)
+		if err == nil {
+			c.mu.Lock()
+			c.mu.client = client
+			c.mu.Unlock()
+			return nil
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return fmt.Errorf("connecting to KV nodes: %w (last error: %v)", ctx.Err(), err)
+		case <-c.rpcContext.Stopper.ShouldQuiesce():
+			return stop.ErrUnavailable
+		}
+		if backoff *= 2; backoff > dialMaxBackoff {
+			backoff = dialMaxBackoff
+		}
+	}
+}
+
+// dialAddrs attempts to dial each of the connector's addresses, in a random
+// order, and returns a client connected to the first which succeeds.
+func (c *connector) dialAddrs(ctx context.Context) (*client, error) {
+	var lastErr error
+	for _, i := range rand.Perm(len(c.addrs)) {
+		conn, err := c.rpcContext.GRPCDialNode(c.addrs[i]).Connect(ctx)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return &client{InternalClient: kvpb.NewInternalClient(conn)}, nil
+	}
+	return nil, lastErr
 }
 
 // client represents an RPC client that proxies to a KV instance.
@@ -1,11 +1,16 @@
 package kvtenant
 
+import rpc "github.com/dborchard/tiny_crdb/pkg/g_rpc"
+
 // Factory is a hook for binaries that include CCL code to inject a
 // ConnectorFactory.
 var Factory ConnectorFactory = connectorFactory{}
 
 // ConnectorConfig encompasses the configuration required to create a Connector.
 type ConnectorConfig struct {
+	// RPCContext is the RPC context through which the connector dials the KV
+	// nodes.
+	RPCContext *rpc.Context
 	// ShutdownTenantConnectorEarlyIfNoRecordPresent, if set, will cause the
 	// tenant connector to be shut down early if no record is present in the
 	// system.tenants table. This is useful for tests that want to verify that
@@ -0,0 +1,14 @@
+// Package kvclient holds the interfaces shared by the clients of the KV
+// layer.
+package kvclient
+
+import roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+
+// NodeDescStore stores a collection of NodeDescriptors.
+//
+// Implementations of the interface are expected to be threadsafe.
+type NodeDescStore interface {
+	// GetNodeDescriptor looks up the descriptor of the node by ID. It returns
+	// an error if the node is not known by the store.
+	GetNodeDescriptor(roachpb.NodeID) (*roachpb.NodeDescriptor, error)
+}
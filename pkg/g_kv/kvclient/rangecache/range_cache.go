@@ -0,0 +1,237 @@
+// Package rangecache provides a cache of range descriptors, used by the
+// DistSender to route requests to the ranges containing their keys without
+// looking up the meta addressing records for every request.
+package rangecache
+
+import (
+	"container/list"
+	"context"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"sort"
+	"sync"
+)
+
+// DefaultRangeCacheSize is the default number of range descriptors held by a
+// RangeCache.
+const DefaultRangeCacheSize = 1 << 16
+
+// RangeDescriptorDB is a type which can query range descriptors from an
+// underlying datastore. This interface is used by RangeCache to initially
+// retrieve information which will be cached.
+type RangeDescriptorDB interface {
+	// RangeLookup takes a key to look up descriptors for. It returns the
+	// descriptor of the range containing the key, followed by the
+	// descriptors of zero or more of the ranges that follow it, which are
+	// prefetched into the cache.
+	RangeLookup(ctx context.Context, key roachpb.RKey) ([]roachpb.RangeDescriptor, error)
+}
+
+// RangeCache is used to retrieve range descriptors for arbitrary keys.
+// Descriptors are initially queried from storage using a RangeDescriptorDB,
+// but are cached for subsequent lookups. The cache holds at most a fixed
+// number of descriptors, evicting the least recently used ones.
+//
+// The cache can hold stale descriptors, for instance after a range was
+// split. Users that find out that a descriptor is stale, typically because a
+// replica rejected a request with a RangeKeyMismatchError, evict it and
+// insert the fresher descriptors that they learned about.
+//
+// Concurrent lookups of the same key that miss the cache are not coalesced;
+// each of them queries the RangeDescriptorDB.
+type RangeCache struct {
+	db   RangeDescriptorDB
+	size int
+
+	mu struct {
+		sync.Mutex
+		// entries holds the cached descriptors, sorted by end key. Cached
+		// descriptors never overlap.
+		entries []*cacheEntry
+		// lru orders the entries by recency of use, the most recently used
+		// first.
+		lru *list.List
+	}
+}
+
+// cacheEntry is a descriptor held by the RangeCache, along with the lease of
+// the range as last learned by the cache's user, if any.
+type cacheEntry struct {
+	desc  roachpb.RangeDescriptor
+	lease roachpb.Lease
+	elem  *list.Element
+}
+
+// NewRangeCache returns a new RangeCache which uses the given
+// RangeDescriptorDB as the underlying source of range descriptors, and which
+// holds at most size descriptors.
+func NewRangeCache(db RangeDescriptorDB, size int) *RangeCache {
+	if size <= 0 {
+		size = DefaultRangeCacheSize
+	}
+	rc := &RangeCache{db: db, size: size}
+	rc.mu.lru = list.New()
+	return rc
+}
+
+// Lookup returns the descriptor of the range containing the given key,
+// looking it up in the RangeDescriptorDB if it is not cached. The returned
+// descriptor is a copy that the caller may hold on to.
+func (rc *RangeCache) Lookup(ctx context.Context, key roachpb.RKey) (*roachpb.RangeDescriptor, error) {
+	if desc, ok := rc.GetCached(key); ok {
+		return desc, nil
+	}
+	descs, err := rc.db.RangeLookup(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	rc.Insert(descs...)
+	desc := descs[0]
+	return &desc, nil
+}
+
+// GetCached returns the cached descriptor of the range containing the given
+// key, if any.
+func (rc *RangeCache) GetCached(key roachpb.RKey) (*roachpb.RangeDescriptor, bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	i := rc.searchLocked(key)
+	if i == len(rc.mu.entries) {
+		return nil, false
+	}
+	e := rc.mu.entries[i]
+	if !e.desc.ContainsKey(key) {
+		return nil, false
+	}
+	rc.mu.lru.MoveToFront(e.elem)
+	desc := e.desc
+	return &desc, true
+}
+
+// Insert inserts the given descriptors into the cache. Cached descriptors
+// that overlap with an inserted one are evicted, unless one of them is known
+// to be newer, i.e. has a higher generation, in which case the inserted
+// descriptor is dropped instead.
+func (rc *RangeCache) Insert(descs ...roachpb.RangeDescriptor) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	for _, desc := range descs {
+		rc.insertLocked(desc)
+	}
+}
+
+func (rc *RangeCache) insertLocked(desc roachpb.RangeDescriptor) {
+	// Find the cached entries that overlap with the descriptor: they start
+	// at the first entry whose end key is above the descriptor's start key.
+	start := rc.searchLocked(desc.StartKey)
+	end := start
+	for end < len(rc.mu.entries) && rc.mu.entries[end].desc.StartKey.Less(desc.EndKey) {
+		if rc.mu.entries[end].desc.Generation > desc.Generation {
+			// A newer descriptor is already cached.
+			return
+		}
+		end++
+	}
+	for _, e := range rc.mu.entries[start:end] {
+		rc.mu.lru.Remove(e.elem)
+	}
+	e := &cacheEntry{desc: desc}
+	e.elem = rc.mu.lru.PushFront(e)
+	entries := append([]*cacheEntry(nil), rc.mu.entries[:start]...)
+	entries = append(entries, e)
+	rc.mu.entries = append(entries, rc.mu.entries[end:]...)
+
+	for rc.mu.lru.Len() > rc.size {
+		rc.removeLocked(rc.mu.lru.Back().Value.(*cacheEntry))
+	}
+}
+
+// Evict removes the given descriptor from the cache. The cached descriptor
+// of the range is only removed if it is the same as, or older than, the
+// provided one: a fresher descriptor inserted concurrently is retained.
+func (rc *RangeCache) Evict(desc *roachpb.RangeDescriptor) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	i := rc.searchLocked(desc.StartKey)
+	if i == len(rc.mu.entries) {
+		return
+	}
+	e := rc.mu.entries[i]
+	if e.desc.RangeID != desc.RangeID || e.desc.Generation > desc.Generation {
+		return
+	}
+	rc.removeLocked(e)
+}
+
+// UpdateLease records the lease of the range containing the given key, whose
+// descriptor must be cached and must include the leaseholder. The lease is
+// ignored if the cached one is newer, i.e. has a higher sequence; a
+// speculative lease, without a sequence, always replaces the cached one.
+func (rc *RangeCache) UpdateLease(key roachpb.RKey, lease roachpb.Lease) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	i := rc.searchLocked(key)
+	if i == len(rc.mu.entries) {
+		return
+	}
+	e := rc.mu.entries[i]
+	if !e.desc.ContainsKey(key) {
+		return
+	}
+	if _, ok := e.desc.GetReplicaDescriptorByID(lease.Replica.ReplicaID); !ok {
+		return
+	}
+	if lease.Sequence != 0 && lease.Sequence < e.lease.Sequence {
+		return
+	}
+	e.lease = lease
+}
+
+// Leaseholder returns the cached leaseholder of the range containing the
+// given key, if it is known.
+func (rc *RangeCache) Leaseholder(key roachpb.RKey) (roachpb.ReplicaDescriptor, bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	i := rc.searchLocked(key)
+	if i == len(rc.mu.entries) {
+		return roachpb.ReplicaDescriptor{}, false
+	}
+	e := rc.mu.entries[i]
+	if !e.desc.ContainsKey(key) || e.lease.Empty() {
+		return roachpb.ReplicaDescriptor{}, false
+	}
+	return e.lease.Replica, true
+}
+
+// Clear removes all descriptors from the cache.
+func (rc *RangeCache) Clear() {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.mu.entries = nil
+	rc.mu.lru.Init()
+}
+
+// NumCached returns the number of descriptors in the cache.
+func (rc *RangeCache) NumCached() int {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return len(rc.mu.entries)
+}
+
+// searchLocked returns the index of the first cached entry whose end key is
+// above the given key, or the number of entries if there is none.
+func (rc *RangeCache) searchLocked(key roachpb.RKey) int {
+	return sort.Search(len(rc.mu.entries), func(i int) bool {
+		return key.Less(rc.mu.entries[i].desc.EndKey)
+	})
+}
+
+// removeLocked removes the given entry from the cache.
+func (rc *RangeCache) removeLocked(e *cacheEntry) {
+	rc.mu.lru.Remove(e.elem)
+	for i, other := range rc.mu.entries {
+		if other == e {
+			rc.mu.entries = append(rc.mu.entries[:i], rc.mu.entries[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package rangefeed
+
+import (
+	"context"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"time"
+)
+
+// Option configures a RangeFeed.
+type Option interface {
+	set(*config)
+}
+
+type config struct {
+	retryInitialBackoff time.Duration
+	retryMaxBackoff     time.Duration
+
+	withInitialScan   bool
+	onInitialScanDone OnInitialScanDone
+	withDiff          bool
+
+	onCheckpoint      OnCheckpoint
+	onFrontierAdvance OnFrontierAdvance
+	onInternalError   OnInternalError
+}
+
+type optionFunc func(*config)
+
+func (o optionFunc) set(c *config) { o(c) }
+
+func initConfig(c *config, options []Option) {
+	*c = config{
+		retryInitialBackoff: 50 * time.Millisecond,
+		retryMaxBackoff:     5 * time.Second,
+	}
+	for _, o := range options {
+		o.set(c)
+	}
+}
+
+// OnInitialScanDone is called when an initial scan is finished before any rows
+// from the rangefeed are supplied.
+type OnInitialScanDone func(ctx context.Context)
+
+// WithInitialScan enables an initial scan of the data in the spans of the
+// rangefeed, as of its initial timestamp, before the rangefeed itself is
+// started. The callback, which may be nil, is called once the scan is done.
+func WithInitialScan(f OnInitialScanDone) Option {
+	return optionFunc(func(c *config) {
+		c.withInitialScan = true
+		c.onInitialScanDone = f
+	})
+}
+
+// WithDiff makes an option to set whether rangefeed events carry the previous
+// value in addition to the new value.
+func WithDiff(withDiff bool) Option {
+	return optionFunc(func(c *config) {
+		c.withDiff = withDiff
+	})
+}
+
+// WithRetry configures the backoff with which the rangefeed is restarted
+// after an error.
+func WithRetry(initialBackoff, maxBackoff time.Duration) Option {
+	return optionFunc(func(c *config) {
+		c.retryInitialBackoff = initialBackoff
+		c.retryMaxBackoff = maxBackoff
+	})
+}
+
+// OnCheckpoint is called when a rangefeed checkpoint occurs.
+type OnCheckpoint func(ctx context.Context, checkpoint *kvpb.RangeFeedCheckpoint)
+
+// WithOnCheckpoint sets up a callback that's invoked whenever a check point
+// event is emitted.
+func WithOnCheckpoint(f OnCheckpoint) Option {
+	return optionFunc(func(c *config) {
+		c.onCheckpoint = f
+	})
+}
+
+// OnFrontierAdvance is called when the rangefeed frontier is advanced with the
+// new frontier timestamp.
+type OnFrontierAdvance func(ctx context.Context, timestamp hlc.Timestamp)
+
+// WithOnFrontierAdvance sets up a callback that's invoked whenever the
+// rangefeed frontier is advanced: all the spans of the rangefeed have been
+// resolved up to the new timestamp.
+func WithOnFrontierAdvance(f OnFrontierAdvance) Option {
+	return optionFunc(func(c *config) {
+		c.onFrontierAdvance = f
+	})
+}
+
+// OnInternalError is called when the rangefeed encounters an error, after
+// which it is restarted from its frontier.
+type OnInternalError func(ctx context.Context, err error)
+
+// WithOnInternalError sets up a callback that's invoked whenever the
+// rangefeed or its initial scan fail, before they are retried.
+func WithOnInternalError(f OnInternalError) Option {
+	return optionFunc(func(c *config) {
+		c.onInternalError = f
+	})
+}
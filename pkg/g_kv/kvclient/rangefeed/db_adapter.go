@@ -0,0 +1,59 @@
+package rangefeed
+
+import (
+	"context"
+	kv "github.com/dborchard/tiny_crdb/pkg/g_kv"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvclient/kvcoord"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+)
+
+// dbAdapter is an implementation of the DB interface which uses a kv.DB for
+// its scans and the DistSender for its rangefeeds.
+type dbAdapter struct {
+	db         *kv.DB
+	distSender *kvcoord.DistSender
+}
+
+var _ DB = (*dbAdapter)(nil)
+
+func newDBAdapter(db *kv.DB, distSender *kvcoord.DistSender) *dbAdapter {
+	return &dbAdapter{db: db, distSender: distSender}
+}
+
+// RangeFeed is part of the DB interface.
+func (dbc *dbAdapter) RangeFeed(
+	ctx context.Context,
+	spans []roachpb.Span,
+	startFrom hlc.Timestamp,
+	withDiff bool,
+	eventC chan<- *kvpb.RangeFeedEvent,
+) error {
+	return dbc.distSender.RangeFeed(ctx, spans, startFrom, withDiff, eventC)
+}
+
+// Scan is part of the DB interface. The spans are scanned with a
+// non-transactional batch, at the provided timestamp.
+func (dbc *dbAdapter) Scan(
+	ctx context.Context, spans []roachpb.Span, asOf hlc.Timestamp, rowFn func(value roachpb.KeyValue),
+) error {
+	b := &kv.Batch{}
+	b.Header.Timestamp = asOf
+	for _, sp := range spans {
+		b.Scan(sp.Key, sp.EndKey)
+	}
+	if err := dbc.db.Run(ctx, b); err != nil {
+		return err
+	}
+	for _, res := range b.Results {
+		for _, row := range res.Rows {
+			kv := roachpb.KeyValue{Key: row.Key}
+			if row.Value != nil {
+				kv.Value = *row.Value
+			}
+			rowFn(kv)
+		}
+	}
+	return nil
+}
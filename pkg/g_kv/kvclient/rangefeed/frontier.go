@@ -0,0 +1,78 @@
+package rangefeed
+
+import (
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"sort"
+)
+
+// frontierEntry is a span of a frontier, along with its timestamp.
+type frontierEntry struct {
+	span roachpb.Span
+	ts   hlc.Timestamp
+}
+
+// spanFrontier tracks the timestamp up to which each span of a set of spans
+// is resolved, and the minimum of these timestamps: the frontier. The
+// entries are kept sorted by key, and never overlap.
+type spanFrontier struct {
+	entries []frontierEntry
+}
+
+// makeSpanFrontier returns a frontier over the provided spans, which are all
+// resolved up to the initial timestamp.
+func makeSpanFrontier(initial hlc.Timestamp, spans ...roachpb.Span) *spanFrontier {
+	f := &spanFrontier{}
+	for _, sp := range spans {
+		f.entries = append(f.entries, frontierEntry{span: sp, ts: initial})
+	}
+	sort.Slice(f.entries, func(i, j int) bool {
+		return f.entries[i].span.Key.Compare(f.entries[j].span.Key) < 0
+	})
+	return f
+}
+
+// Frontier returns the minimum timestamp of the tracked spans.
+func (f *spanFrontier) Frontier() hlc.Timestamp {
+	var min hlc.Timestamp
+	for i, e := range f.entries {
+		if i == 0 || e.ts.Less(min) {
+			min = e.ts
+		}
+	}
+	return min
+}
+
+// Forward forwards the timestamp of the tracked parts of the span. Returns
+// whether the frontier advanced as a result.
+func (f *spanFrontier) Forward(span roachpb.Span, ts hlc.Timestamp) bool {
+	prev := f.Frontier()
+	var entries []frontierEntry
+	for _, e := range f.entries {
+		if !e.span.Overlaps(span) || !e.ts.Less(ts) {
+			entries = append(entries, e)
+			continue
+		}
+		// Split the entry into the parts before, inside and after the span.
+		if e.span.Key.Compare(span.Key) < 0 {
+			entries = append(entries, frontierEntry{
+				span: roachpb.Span{Key: e.span.Key, EndKey: span.Key}, ts: e.ts,
+			})
+		}
+		inner := e.span
+		if inner.Key.Compare(span.Key) < 0 {
+			inner.Key = span.Key
+		}
+		if span.EndKey.Compare(inner.EndKey) < 0 {
+			inner.EndKey = span.EndKey
+		}
+		entries = append(entries, frontierEntry{span: inner, ts: ts})
+		if span.EndKey.Compare(e.span.EndKey) < 0 {
+			entries = append(entries, frontierEntry{
+				span: roachpb.Span{Key: span.EndKey, EndKey: e.span.EndKey}, ts: e.ts,
+			})
+		}
+	}
+	f.entries = entries
+	return prev.Less(f.Frontier())
+}
@@ -0,0 +1,274 @@
+// Package rangefeed provides a useful client abstraction atop of the rangefeed
+// functionality exported by the DistSender: a RangeFeed runs a rangefeed over
+// a set of spans, optionally preceded by an initial scan, and transparently
+// restarts it from its frontier when it fails.
+package rangefeed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	kv "github.com/dborchard/tiny_crdb/pkg/g_kv"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvclient/kvcoord"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/stop"
+	"sync"
+	"time"
+)
+
+// DB is an adapter to the underlying KV store.
+type DB interface {
+	// RangeFeed runs a rangefeed on a given span with the given arguments.
+	// It encapsulates the RangeFeed method on DistSender.
+	RangeFeed(
+		ctx context.Context,
+		spans []roachpb.Span,
+		startFrom hlc.Timestamp,
+		withDiff bool,
+		eventC chan<- *kvpb.RangeFeedEvent,
+	) error
+
+	// Scan encapsulates scanning the spans at a given point in time. The
+	// rowFn is called for each row of the spans.
+	Scan(
+		ctx context.Context, spans []roachpb.Span, asOf hlc.Timestamp, rowFn func(value roachpb.KeyValue),
+	) error
+}
+
+// Factory is used to construct RangeFeeds.
+type Factory struct {
+	stopper *stop.Stopper
+	client  DB
+}
+
+// NewFactory constructs a new Factory, whose RangeFeeds scan through the
+// provided DB and run their rangefeeds through the DistSender.
+func NewFactory(stopper *stop.Stopper, db *kv.DB, distSender *kvcoord.DistSender) *Factory {
+	return newFactory(stopper, newDBAdapter(db, distSender))
+}
+
+func newFactory(stopper *stop.Stopper, client DB) *Factory {
+	return &Factory{
+		stopper: stopper,
+		client:  client,
+	}
+}
+
+// RangeFeed constructs a new rangefeed and runs it in an async task.
+//
+// The rangefeed can be stopped via Close(); otherwise, it will stop when the
+// server shuts down.
+//
+// The only error which can be returned will indicate that the server is being
+// shut down.
+func (f *Factory) RangeFeed(
+	ctx context.Context,
+	name string,
+	spans []roachpb.Span,
+	initialTimestamp hlc.Timestamp,
+	onValue OnValue,
+	options ...Option,
+) (*RangeFeed, error) {
+	r := f.New(name, initialTimestamp, onValue, options...)
+	if err := r.Start(ctx, spans); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// New constructs a new RangeFeed (without running it).
+func (f *Factory) New(
+	name string, initialTimestamp hlc.Timestamp, onValue OnValue, options ...Option,
+) *RangeFeed {
+	r := RangeFeed{
+		client:  f.client,
+		stopper: f.stopper,
+
+		initialTimestamp: initialTimestamp,
+		name:             name,
+		onValue:          onValue,
+
+		stopped: make(chan struct{}),
+	}
+	initConfig(&r.config, options)
+	return &r
+}
+
+// OnValue is called for each rangefeed value.
+type OnValue func(ctx context.Context, value *kvpb.RangeFeedValue)
+
+// RangeFeed represents a running RangeFeed.
+type RangeFeed struct {
+	config
+	name    string
+	client  DB
+	stopper *stop.Stopper
+
+	initialTimestamp hlc.Timestamp
+	spans            []roachpb.Span
+
+	onValue OnValue
+
+	closeOnce sync.Once
+	cancel    context.CancelFunc
+	stopped   chan struct{}
+
+	started bool
+}
+
+// Start kicks off the rangefeed in an async task over the provided spans. The
+// values written after the initial timestamp of the rangefeed are passed to
+// its OnValue callback, in order for each key but possibly more than once.
+// Start may only be called once.
+func (f *RangeFeed) Start(ctx context.Context, spans []roachpb.Span) error {
+	if len(spans) == 0 {
+		return errors.New("expected at least 1 span, got none")
+	}
+	if f.started {
+		return fmt.Errorf("rangefeed %s: already started", f.name)
+	}
+	f.started = true
+	f.spans = append([]roachpb.Span(nil), spans...)
+	frontier := makeSpanFrontier(f.initialTimestamp, f.spans...)
+
+	ctx, f.cancel = f.stopper.WithCancelOnQuiesce(context.WithoutCancel(ctx))
+	if err := f.stopper.RunAsyncTask(ctx, "rangefeed: "+f.name, func(ctx context.Context) {
+		f.run(ctx, frontier)
+	}); err != nil {
+		f.cancel()
+		close(f.stopped)
+		return err
+	}
+	return nil
+}
+
+// Close closes the RangeFeed and waits for it to shut down; it does so
+// idempotently. It waits for the currently running handler, if any, to
+// complete and guarantees that no future handlers will be invoked after this
+// point.
+func (f *RangeFeed) Close() {
+	f.closeOnce.Do(func() {
+		if f.cancel != nil {
+			f.cancel()
+		}
+		if f.started {
+			<-f.stopped
+		}
+	})
+}
+
+// run will run the RangeFeed until the context is canceled. The initial scan
+// and the rangefeed are retried, and the rangefeed is restarted from its frontier, with exponential backoff, whenever it fails.
+func (f *RangeFeed) run(ctx context.Context, frontier *spanFrontier) {
+	defer close(f.stopped)
+	backoff := f.retryInitialBackoff
+	wait := func() bool {
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return false
+		}
+		if backoff *= 2; backoff > f.retryMaxBackoff {
+			backoff = f.retryMaxBackoff
+		}
+		return true
+	}
+
+	if f.withInitialScan {
+		for {
+			err := f.runInitialScan(ctx)
+			if err == nil {
+				break
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			if f.onInternalError != nil {
+				f.onInternalError(ctx, err)
+			}
+			if !wait() {
+				return
+			}
+		}
+		if f.onInitialScanDone != nil {
+			f.onInitialScanDone(ctx)
+		}
+		backoff = f.retryInitialBackoff
+	}
+
+	for {
+		start := time.Now()
+		err := f.runOnce(ctx, frontier)
+		if ctx.Err() != nil {
+			return
+		}
+		if f.onInternalError != nil {
+			f.onInternalError(ctx, err)
+		}
+		if time.Since(start) > f.retryMaxBackoff {
+			// The rangefeed ran for a while before failing; don't penalize it
+			// for earlier failures.
+			backoff = f.retryInitialBackoff
+		}
+		if !wait() {
+			return
+		}
+	}
+}
+
+// runInitialScan scans the spans of the rangefeed as of its initial
+// timestamp, and passes the rows to the OnValue callback.
+func (f *RangeFeed) runInitialScan(ctx context.Context) error {
+	return f.client.Scan(ctx, f.spans, f.initialTimestamp, func(kv roachpb.KeyValue) {
+		v := kvpb.RangeFeedValue{Key: kv.Key, Value: kv.Value}
+		if v.Value.Timestamp.IsEmpty() {
+			v.Value.Timestamp = f.initialTimestamp
+		}
+		f.onValue(ctx, &v)
+	})
+}
+
+// runOnce runs the rangefeed from the frontier until it fails, and processes
+// its events.
+func (f *RangeFeed) runOnce(ctx context.Context, frontier *spanFrontier) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	eventCh := make(chan *kvpb.RangeFeedEvent)
+	errCh := make(chan error, 1)
+	ts := frontier.Frontier()
+	go func() {
+		errCh <- f.client.RangeFeed(ctx, f.spans, ts, f.withDiff, eventCh)
+	}()
+	for {
+		select {
+		case ev := <-eventCh:
+			f.processEvent(ctx, frontier, ev)
+		case err := <-errCh:
+			if err == nil {
+				err = fmt.Errorf("rangefeed %s: ended without an error", f.name)
+			}
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// processEvent passes an event of the rangefeed to the callbacks.
+func (f *RangeFeed) processEvent(
+	ctx context.Context, frontier *spanFrontier, ev *kvpb.RangeFeedEvent,
+) {
+	switch {
+	case ev.Val != nil:
+		f.onValue(ctx, ev.Val)
+	case ev.Checkpoint != nil:
+		if frontier.Forward(ev.Checkpoint.Span, ev.Checkpoint.ResolvedTS) && f.onFrontierAdvance != nil {
+			f.onFrontierAdvance(ctx, frontier.Frontier())
+		}
+		if f.onCheckpoint != nil {
+			f.onCheckpoint(ctx, ev.Checkpoint)
+		}
+	}
+}
@@ -1,18 +1,777 @@
 package kvpb
 
+import (
+	"context"
+	"fmt"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/concurrency/lock"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/dborchard/tiny_crdb/pkg/h_storage/enginepb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"google.golang.org/grpc"
+	"time"
+)
+
+// Header is metadata for a BatchRequest. It is shared by all the requests in
+// the batch.
+type Header struct {
+	// timestamp specifies time at which reads or writes should be performed. If
+	// the timestamp is set to zero value, its value is initialized to the wall
+	// time of the server node.
+	//
+	// Transactional requests are not allowed to set this field; they must rely
+	// on the server to set it from txn.ReadTimestamp.
+	Timestamp hlc.Timestamp
+	// txn is set non-nil if a transaction is underway. To start a txn, the first
+	// request should set this field to non-nil with name and isolation level set.
+	// The response will contain the fully-initialized transaction with txn ID,
+	// priority, initial timestamp, and maximum timestamp.
+	Txn *roachpb.Transaction
+	// user_priority allows any command's priority to be biased from the default
+	// random priority. It specifies a multiple. If set to 0.5, the chosen
+	// priority will be 1/2x as likely to beat any default random priority. If
+	// set to 1, a default random priority is chosen. If set to 2, the chosen
+	// priority will be 2x as likely to beat any default random priority, and so
+	// on. As a special case, 0 priority is treated the same as 1. This value is
+	// ignored if txn is specified. The min and max user priorities are set to
+	// MinUserPriority and MaxUserPriority in data.go.
+	UserPriority roachpb.UserPriority
+	// If set to a non-zero value, the total number of keys touched by requests
+	// in the batch is limited. A resume span will be provided on the response
+	// of the requests that were not able to run to completion before the limit
+	// was reached.
+	MaxSpanRequestKeys int64
+	// wait_policy specifies the policy used to handle lock conflicts that
+	// the requests in the batch encounter: whether to block on the
+	// conflicting locks, to raise an error, or to skip over the keys that
+	// are locked. See the documentation on lock.WaitPolicy.
+	WaitPolicy lock.WaitPolicy
+	// RangeID specifies the ID of the Raft consensus group which the key
+	// range belongs to. This is used by the receiving node to route the
+	// request to the correct range. It is set by the DistSender.
+	RangeID roachpb.RangeID
+	// Replica specifies the destination of the request. It is set by the
+	// DistSender.
+	Replica roachpb.ReplicaDescriptor
+	// Now is the clock reading of the sender of the batch when it was sent.
+	// The node which receives the batch updates its clock with it, and
+	// rejects the batch if it is further ahead of its physical clock than
+	// the maximum clock offset. It is set by the DistSender.
+	Now hlc.ClockTimestamp
+}
+
+// BatchRequest is a batch of requests sharing a Header.
 type BatchRequest struct {
-	Requests interface{}
+	Header
+	Requests []RequestUnion
+}
+
+// BatchResponse_Header is the header of a BatchResponse.
+type BatchResponse_Header struct {
+	// txn is non-nil if the request specified a non-nil
+	// transaction. The transaction timestamp and/or priority may have
+	// been updated, depending on the outcome of the request.
+	Txn *roachpb.Transaction
+	// timestamp is set only for non-transactional responses and denotes the
+	// timestamp at which the batch executed.
+	Timestamp hlc.Timestamp
+	// now is the clock reading of the node which served the batch, with which
+	// the sender of the batch updates its clock.
+	Now hlc.ClockTimestamp
+	// error is non-nil if an error occurred while the batch was evaluated by
+	// a remote replica. It is only set on responses returned by a Transport;
+	// the DistSender moves it into the *Error it returns, so that higher
+	// levels never observe it.
+	Error *Error
+	// contention_events are the events of the requests of the batch waiting
+	// on the locks of other transactions before they evaluated.
+	ContentionEvents []ContentionEvent
+}
+
+// ContentionEvent describes the wait of a request on a lock held by another
+// transaction, or on a request of another transaction ahead of it in the
+// wait-queue of the lock.
+type ContentionEvent struct {
+	// Key is the key of the lock that the request waited on.
+	Key roachpb.Key
+	// TxnMeta is the transaction that the request waited on.
+	TxnMeta enginepb.TxnMeta
+	// Duration is the amount of time that the request waited.
+	Duration time.Duration
 }
 
+// BatchResponse is the response to a BatchRequest.
 type BatchResponse struct {
+	BatchResponse_Header
+	Responses []ResponseUnion
+}
+
+// InternalClient is the client API of the Internal service, through which
+// nodes send batches to the replicas of other nodes.
+type InternalClient interface {
+	// Batch sends a batch to the node. Errors encountered while evaluating
+	// the batch are returned in the response's Error field; the returned
+	// error is set if the batch could not be delivered.
+	Batch(ctx context.Context, in *BatchRequest, opts ...grpc.CallOption) (*BatchResponse, error)
+	// RangeFeed establishes a rangefeed on a replica of the node, whose
+	// events are streamed back until the rangefeed fails or ctx is
+	// canceled. The error of a failed rangefeed is sent as its last event.
+	RangeFeed(ctx context.Context, in *RangeFeedRequest, opts ...grpc.CallOption) (Internal_RangeFeedClient, error)
+}
+
+// Internal_RangeFeedClient is the client side of the stream of a rangefeed.
+type Internal_RangeFeedClient interface {
+	Recv() (*RangeFeedEvent, error)
+	grpc.ClientStream
+}
+
+// InternalServer is the server API of the Internal service.
+type InternalServer interface {
+	// Batch serves a batch sent by another node.
+	Batch(context.Context, *BatchRequest) (*BatchResponse, error)
+	// RangeFeed serves a rangefeed established by another node.
+	RangeFeed(*RangeFeedRequest, Internal_RangeFeedServer) error
+}
+
+// Internal_RangeFeedServer is the server side of the stream of a rangefeed.
+type Internal_RangeFeedServer interface {
+	Send(*RangeFeedEvent) error
+	grpc.ServerStream
+}
+
+// RangeFeedEventSink is an interface for sending a single rangefeed event.
+// The server side of the stream of a rangefeed implements it.
+type RangeFeedEventSink interface {
+	// Context returns the context of the rangefeed, which is canceled once
+	// the client goes away.
+	Context() context.Context
+	// Send sends the event to the client of the rangefeed.
+	Send(*RangeFeedEvent) error
+}
+
+// RangeFeedRequest is a request that expresses the intention to establish a
+// RangeFeed stream over the provided span, starting at the specified
+// timestamp: the values written above the timestamp are streamed back.
+type RangeFeedRequest struct {
+	Header
+	Span roachpb.Span
+	// WithDiff specifies whether RangeFeedValue events should include the
+	// previous value of the key that they update.
+	WithDiff bool
+}
+
+// RangeFeedValue is a variant of RangeFeedEvent that represents an update to
+// the specified key with the provided value.
+type RangeFeedValue struct {
+	Key roachpb.Key
+	// Value is the committed value of the key, and its timestamp. The value
+	// of a deletion is empty.
+	Value roachpb.Value
+	// PrevValue is the value of the key which the update replaced, if the
+	// rangefeed was established WithDiff. It is empty if the key had no
+	// value, and carries no timestamp.
+	PrevValue roachpb.Value
+}
+
+// RangeFeedCheckpoint is a variant of RangeFeedEvent that represents the
+// promotion of all values across the specified span to be "resolved" at the
+// provided timestamp: no further values at or below it will be emitted for
+// the span.
+type RangeFeedCheckpoint struct {
+	Span       roachpb.Span
+	ResolvedTS hlc.Timestamp
+}
+
+// RangeFeedError is a variant of RangeFeedEvent that indicates that an error
+// occurred during the processing of the RangeFeed. If emitted, a RangeFeed
+// will also be terminated.
+type RangeFeedError struct {
+	Error Error
+}
+
+// RangeFeedEvent is a union of all event types that may be returned on a
+// RangeFeed response stream. Exactly one of its fields is set.
+type RangeFeedEvent struct {
+	Val        *RangeFeedValue
+	Checkpoint *RangeFeedCheckpoint
+	Error      *RangeFeedError
+}
+
+// GetValue returns the event held by the union.
+func (e *RangeFeedEvent) GetValue() interface{} {
+	switch {
+	case e.Val != nil:
+		return e.Val
+	case e.Checkpoint != nil:
+		return e.Checkpoint
+	case e.Error != nil:
+		return e.Error
+	default:
+		return nil
+	}
+}
+
+// RequestHeader is supplied with every storage node request.
+type RequestHeader struct {
+	// The key for request. If the request operates on a range, this
+	// represents the starting key for the range.
+	Key roachpb.Key
+	// The end key is empty if the request spans only a single key. Otherwise,
+	// it must order strictly after Key. In such a case, the header indicates
+	// that the operation takes place on the key range from Key to EndKey,
+	// including Key and excluding EndKey.
+	EndKey roachpb.Key
+	// A zero-indexed transactional sequence number.
+	Sequence enginepb.TxnSeq
+}
+
+// Span returns the key range that the RequestHeader operates over.
+func (h RequestHeader) Span() roachpb.Span {
+	return roachpb.Span{Key: h.Key, EndKey: h.EndKey}
+}
+
+// RequestHeaderFromSpan creates a RequestHeader addressed at the specified
+// key span.
+func RequestHeaderFromSpan(s roachpb.Span) RequestHeader {
+	return RequestHeader{Key: s.Key, EndKey: s.EndKey}
+}
+
+// ResponseHeader is returned with every storage node response.
+type ResponseHeader struct {
+	// txn is non-nil if the request specified a non-nil transaction.
+	// The transaction timestamp and/or priority may have been updated,
+	// depending on the outcome of the request.
+	Txn *roachpb.Transaction
+	// The next span to resume from when the response doesn't cover the full
+	// span requested. This can happen when a bound on the keys is set through
+	// max_span_request_keys in the batch header.
+	ResumeSpan *roachpb.Span
+	// The number of keys operated on.
+	NumKeys int64
+}
+
+// A GetRequest is the argument for the Get() method.
+type GetRequest struct {
+	RequestHeader
+	// KeyLockingStrength instructs the Get to acquire a lock on the target
+	// key, if it exists, with the specified strength. The lock is
+	// Unreplicated: it is held in the lock table of the range's leaseholder
+	// and is released when the transaction finishes. A strength of
+	// lock.None, the default, reads without acquiring a lock.
+	KeyLockingStrength lock.Strength
+}
+
+// A GetResponse is the return value from the Get() method.
+// If the key doesn't exist, Value will be nil.
+type GetResponse struct {
+	ResponseHeader
+	Value *roachpb.Value
+}
+
+// A PutRequest is the argument to the Put() method.
+type PutRequest struct {
+	RequestHeader
+	Value roachpb.Value
+}
+
+// A PutResponse is the return value from the Put() method.
+type PutResponse struct {
+	ResponseHeader
+}
+
+// A DeleteRequest is the argument to the Delete() method.
+type DeleteRequest struct {
+	RequestHeader
+}
+
+// A DeleteResponse is the return value from the Delete() method.
+type DeleteResponse struct {
+	ResponseHeader
+	// True if there was a key that got deleted. A tombstone is written
+	// unconditionally, regardless of whether the key is found.
+	FoundKey bool
+}
+
+// A ScanRequest is the argument to the Scan() method. It specifies the
+// start and end keys for an ascending scan of [start,end).
+type ScanRequest struct {
+	RequestHeader
+	// KeyLockingStrength instructs the Scan to acquire a lock on each of the
+	// keys that it returns, with the specified strength. See the
+	// documentation on GetRequest.KeyLockingStrength.
+	KeyLockingStrength lock.Strength
+}
+
+// A ScanResponse is the return value from the Scan() method.
+type ScanResponse struct {
+	ResponseHeader
+	// Empty if no rows were scanned.
+	Rows []roachpb.KeyValue
+}
+
+// An EndTxnRequest is the argument to the EndTxn() method. It specifies
+// whether to commit or roll back an extant transaction.
+type EndTxnRequest struct {
+	RequestHeader
+	// False to abort and rollback.
+	Commit bool
+	// If set, deadline represents the maximum (exclusive) timestamp at which
+	// the transaction can commit (i.e. the maximum timestamp for the txn's
+	// reads and writes).
+	Deadline hlc.Timestamp
+	// The lock spans that the transaction has acquired and which the
+	// EndTxn must resolve.
+	LockSpans []roachpb.Span
+	// Set of in-flight writes that the transaction is committing in parallel
+	// with this request. If set, the EndTxn moves the transaction record to
+	// the STAGING state instead of committing it, and the transaction is
+	// implicitly committed once all of the in-flight writes have succeeded.
+	// The in-flight writes are disjoint from the lock spans.
+	InFlightWrites []roachpb.SequencedWrite
+	// Optional commit triggers. Note that commit triggers are for
+	// internal use only and will cause an error if requested through the
+	// external-facing KV API.
+	InternalCommitTrigger *roachpb.InternalCommitTrigger
+}
+
+// An EndTxnResponse is the return value from the EndTxn() method. The final
+// transaction record is returned as part of the response header.
+type EndTxnResponse struct {
+	ResponseHeader
+	// True if the transaction was committed using the one-phase commit
+	// optimization: its writes were applied without intents and no
+	// transaction record was written.
+	OnePhaseCommit bool
+}
+
+// IsParallelCommit returns whether the EndTxn request is attempting to perform
+// a parallel commit.
+func (etr *EndTxnRequest) IsParallelCommit() bool {
+	return etr.Commit && len(etr.InFlightWrites) > 0
+}
+
+// A ResolveIntentRequest is arguments to the ResolveIntent() method. It is
+// sent by transaction coordinators after success calling PushTxn to clean up
+// write intents: either to remove, commit or move them forward in time.
+type ResolveIntentRequest struct {
+	RequestHeader
+	// The transaction whose intent is being resolved.
+	IntentTxn enginepb.TxnMeta
+	// The status of the transaction.
+	Status roachpb.TransactionStatus
+	// The list of ignored seqnum ranges as per the Transaction record.
+	IgnoredSeqNums []enginepb.IgnoredSeqNumRange
+}
+
+// A ResolveIntentResponse is the return value from the ResolveIntent() method.
+type ResolveIntentResponse struct {
+	ResponseHeader
+}
+
+// A RefreshRangeRequest is arguments to the RefreshRange() method. It is sent
+// by a transaction whose read timestamp is about to move forward, to verify
+// that the key range it read has not been written to by other transactions
+// between the timestamp at which it read it and its new read timestamp. The
+// request is evaluated at the transaction's new read timestamp.
+type RefreshRangeRequest struct {
+	RequestHeader
+	// The timestamp at which the span was last read, above which the
+	// transaction's reads are verified.
+	RefreshFrom hlc.Timestamp
+}
+
+// A RefreshRangeResponse is the return value from the RefreshRange() method.
+type RefreshRangeResponse struct {
+	ResponseHeader
+}
+
+// A HeartbeatTxnRequest is arguments to the HeartbeatTxn()
+// method. It's sent by transaction coordinators to let the system
+// know that the transaction is still ongoing. Note that this
+// heartbeat message is different from the heartbeat message in the
+// gossip protocol.
+type HeartbeatTxnRequest struct {
+	RequestHeader
+	// The timestamp at which the heartbeat was sent, read from the
+	// coordinator's clock.
+	Now hlc.Timestamp
+}
+
+// A HeartbeatTxnResponse is the return value from the HeartbeatTxn()
+// method. It returns the transaction info in the response header. The
+// returned transaction lets the coordinator know the disposition of the
+// transaction (i.e. aborted, committed, or pending).
+type HeartbeatTxnResponse struct {
+	ResponseHeader
+}
+
+// PushTxnType determines what action to take when pushing a transaction.
+type PushTxnType int32
+
+const (
+	// Push the timestamp forward if possible to accommodate a concurrent reader.
+	PUSH_TIMESTAMP PushTxnType = 0
+	// Abort the transaction if possible to accommodate a concurrent writer.
+	PUSH_ABORT PushTxnType = 1
+	// Abort the transaction if it's abandoned, but don't attempt to mutate it
+	// otherwise.
+	PUSH_TOUCH PushTxnType = 2
+)
+
+// String implements fmt.Stringer.
+func (t PushTxnType) String() string {
+	switch t {
+	case PUSH_TIMESTAMP:
+		return "PUSH_TIMESTAMP"
+	case PUSH_ABORT:
+		return "PUSH_ABORT"
+	case PUSH_TOUCH:
+		return "PUSH_TOUCH"
+	default:
+		return fmt.Sprintf("PushTxnType(%d)", int32(t))
+	}
+}
+
+// A PushTxnRequest is arguments to the PushTxn() method. It's sent by
+// readers or writers which have encountered an "intent" laid down by
+// another transaction. The goal is to resolve the conflict. Note that
+// args.Key should be set to the txn ID of args.pushee_txn, not
+// args.Txn, as is usual. This RPC is addressed to the range which
+// owns the pushee's txn record.
+//
+// Resolution is trivial if the txn which owns the intent has either
+// been committed or aborted already. Otherwise, the existing txn can
+// either be aborted (for write/write conflicts), or its commit
+// timestamp can be moved forward (for read/write conflicts). The
+// course of action is determined by the specified push type, and by
+// the owning txn's status, liveness and priority.
+type PushTxnRequest struct {
+	RequestHeader
+	// Transaction which encountered the intent, if applicable. For a
+	// non-transactional pusher, pusher_txn will only have the priority set (in
+	// particular, ID won't be set). Used to compare priorities and timestamps.
+	PusherTxn roachpb.Transaction
+	// Transaction whose intent is being pushed.
+	PusheeTxn enginepb.TxnMeta
+	// PushTo is the timestamp which PusheeTxn should be pushed to. During
+	// conflict resolution, it should be set just after the timestamp of the
+	// conflicting read or write.
+	PushTo hlc.Timestamp
+	// Readers set this to PUSH_TIMESTAMP to move pushee_txn's provisional
+	// commit timestamp forward. Writers set this to PUSH_ABORT to request
+	// that pushee_txn be aborted if possible. Inconsistent readers set
+	// this to PUSH_TOUCH to determine whether the pushee can be aborted
+	// due to inactivity (based on the now field).
+	PushType PushTxnType
+	// Forces the push by overriding the normal expiration and priority checks
+	// in PushTxn to either abort or push the timestamp.
+	Force bool
+}
+
+// A PushTxnResponse is the return value from the PushTxn() method. It
+// returns success and the resulting state of PusheeTxn if the
+// conflict was resolved in favor of the caller; the caller should
+// subsequently invoke ResolveIntent() on the conflicted key. It
+// returns an error otherwise.
+type PushTxnResponse struct {
+	ResponseHeader
+	// pushee_txn is non-nil if the transaction was pushed and contains
+	// the current value of the transaction.
+	PusheeTxn roachpb.Transaction
+}
+
+// A QueryTxnRequest is arguments to the QueryTxn() method. It's sent by
+// transactions which are waiting in the txnwait.Queue, to learn about the
+// status of the transactions they are waiting on, and about the
+// transactions waiting on them.
+type QueryTxnRequest struct {
+	RequestHeader
+	// Transaction record to query.
+	Txn enginepb.TxnMeta
+}
+
+// A QueryTxnResponse is the return value from the QueryTxn() method.
+type QueryTxnResponse struct {
+	ResponseHeader
+	// Contains the current state of the queried transaction. If the queried
+	// transaction record does not exist, this will be empty.
+	QueriedTxn roachpb.Transaction
+	// Specifies a list of transactions which are waiting on the txn.
+	WaitingTxns []enginepb.TxnMeta
+}
+
+// A QueryIntentRequest is arguments to the QueryIntent() method. It visits
+// the specified key and checks whether an intent is present for the given
+// transaction.
+type QueryIntentRequest struct {
+	RequestHeader
+	// The TxnMeta that the intent is expected to have. Specifically, whether
+	// an intent is a match or not is defined as whether an intent exists that
+	// could be committed by the provided transaction. If an intent is found
+	// at the specified key, the intent is only considered a match if it has
+	// the same ID, the same epoch, a provisional commit timestamp that is
+	// equal to or less than that in the provided transaction, and a sequence
+	// number that is equal to or greater than that in the provided
+	// transaction.
+	Txn enginepb.TxnMeta
+}
+
+// A QueryIntentResponse is the return value from the QueryIntent() method.
+type QueryIntentResponse struct {
+	ResponseHeader
+	// Whether an intent matching the request was found.
+	FoundIntent bool
+}
+
+// A RecoverTxnRequest is arguments to the RecoverTxn() method. It is sent
+// during the recovery process for a transaction abandoned in the STAGING
+// state. The sender is expected to have queried all of the abandoned
+// transaction's in-flight writes and determined whether they all succeeded
+// or not. This is used to determine whether the result of the recovery
+// should be committing the abandoned transaction or aborting it.
+type RecoverTxnRequest struct {
+	RequestHeader
+	// Transaction record to recover.
+	Txn enginepb.TxnMeta
+	// Did all of the STAGING transaction's writes succeed? If so, the
+	// transaction is implicitly committed and the commit can be made explicit
+	// by giving its record a COMMITTED status. If not, the transaction can be
+	// aborted as long as a write that was found to have failed was prevented
+	// from ever succeeding in the future.
+	ImplicitlyCommitted bool
+}
+
+// A RecoverTxnResponse is the return value from the RecoverTxn() method.
+type RecoverTxnResponse struct {
+	ResponseHeader
+	// Contains the finalized state of the recovered transaction.
+	RecoveredTxn roachpb.Transaction
+}
+
+// TruncateLogRequest is used to remove a prefix of the raft log. While there
+// is no requirement for correctness that the raft log truncation be
+// synchronized across replicas, it is not required either: each replica
+// applies the truncation to its own log. Replicas that fall behind the
+// truncated index catch up through a snapshot.
+type TruncateLogRequest struct {
+	RequestHeader
+	// Log entries < this index are to be discarded.
+	Index uint64
+	// RangeID is used to double check that the correct range is being
+	// truncated. The header specifies a span, start and end keys, but not
+	// the range id itself. The range may have changed from the one specified
+	// in the header, in the case of a merge.
+	RangeID roachpb.RangeID
+	// ExpectedFirstIndex is the expected first index of the raft log of the
+	// evaluating replica. The truncation is a no-op if it doesn't match.
+	ExpectedFirstIndex uint64
 }
 
-type Error struct {
-	Error error
+// TruncateLogResponse is the response to a TruncateLog() operation.
+type TruncateLogResponse struct {
+	ResponseHeader
 }
 
-type InternalClient struct {
+// A RequestLeaseRequest is arguments to the RequestLease() method. It is sent
+// by the store on behalf of one of its ranges upon receipt of a command
+// requiring a lease when none is found, and to extend the store's own
+// lease.
+type RequestLeaseRequest struct {
+	RequestHeader
+	Lease roachpb.Lease
+	// PrevLease is the lease which the requester believes to be the current
+	// lease of the range. The request is rejected if the lease changed in the
+	// meantime.
+	PrevLease roachpb.Lease
 }
 
-type RequestUnion struct {
+// A RequestLeaseResponse is the response to a RequestLease() or
+// TransferLease() operation.
+type RequestLeaseResponse struct {
+	ResponseHeader
 }
+
+// A TransferLeaseRequest represents the arguments to the TransferLease()
+// method. It is sent by a replica that currently holds the range lease and
+// wants to transfer it away.
+//
+// Like a RequestLease() request, TransferLease() promotes a replica to be the
+// holder of the range lease. Unlike RequestLease() it is evaluated by the
+// outgoing leaseholder, which stops serving requests until the transfer
+// applies.
+type TransferLeaseRequest struct {
+	RequestHeader
+	Lease roachpb.Lease
+	// PrevLease is the lease of the outgoing leaseholder.
+	PrevLease roachpb.Lease
+}
+
+// An AdminSplitRequest is the argument to the AdminSplit() method. The
+// existing range which contains header.key is split by
+// split_key. If split_key is not specified, then this method will
+// determine a split key that is roughly halfway through the
+// range. The existing range is resized to cover only its start key
+// to the split key. The new range created by the split starts at the
+// split key and extends to the original range's end key. If split_key
+// is known, header.key should also be set to split_key.
+//
+// New range IDs for each of the split range's replica and a new Raft
+// ID are generated by the operation. Split requests are done in the
+// context of a distributed transaction which updates range addressing
+// records, range metadata and finally, provides a commit trigger to
+// update bookkeeping and instantiate the new range on commit.
+//
+// The new range contains range replicas located on the same stores;
+// no range data is moved during this operation. The split can be
+// thought of as a mostly logical operation, though some other
+// metadata (e.g. abort span and range stats) must be copied or
+// recomputed.
+//
+// The expiration time is the time until which the new range may not be
+// merged back into its left neighbour by the merge queue. A zero expiration
+// time allows the merge queue to merge it as soon as it sees fit;
+// hlc.MaxTimestamp prevents it from ever doing so.
+type AdminSplitRequest struct {
+	RequestHeader
+	SplitKey       roachpb.Key
+	ExpirationTime hlc.Timestamp
+}
+
+// An AdminSplitResponse is the return value from the AdminSplit()
+// method.
+type AdminSplitResponse struct {
+	ResponseHeader
+}
+
+// An AdminMergeRequest is the argument to the AdminMerge() method. A
+// merge is performed by calling AdminMerge on the range which is
+// the left-hand side of the merge. The range to its right is
+// subsumed: its data is kept in place, and the left-hand range's
+// descriptor is extended to cover it.
+//
+// The merge is performed in a distributed transaction which updates
+// the range addressing records and the range descriptors, and
+// provides a commit trigger to update bookkeeping and remove the
+// subsumed range on commit.
+type AdminMergeRequest struct {
+	RequestHeader
+}
+
+// An AdminMergeResponse is the return value from the AdminMerge()
+// method.
+type AdminMergeResponse struct {
+	ResponseHeader
+}
+
+// ReplicationChange specifies the type and target of a replication change
+// operation.
+type ReplicationChange struct {
+	ChangeType roachpb.ReplicaChangeType
+	Target     roachpb.ReplicationTarget
+}
+
+// MakeReplicationChanges returns a slice of changes of the given type with an
+// item for each target.
+func MakeReplicationChanges(
+	changeType roachpb.ReplicaChangeType, targets ...roachpb.ReplicationTarget,
+) []ReplicationChange {
+	chgs := make([]ReplicationChange, 0, len(targets))
+	for _, target := range targets {
+		chgs = append(chgs, ReplicationChange{ChangeType: changeType, Target: target})
+	}
+	return chgs
+}
+
+// An AdminChangeReplicasRequest is the argument to the AdminChangeReplicas()
+// method. A change replicas operation allows adding or removing a set of
+// replicas for a range.
+//
+// The changes are made through an atomic replication change: the range
+// first enters a joint configuration, in which the added replicas are
+// incoming voters and the removed ones outgoing voters, and then leaves it.
+// Each step is a distributed transaction which updates the range
+// descriptor and its addressing record, and provides a commit trigger that
+// changes the configuration of the range's Raft group when it applies.
+type AdminChangeReplicasRequest struct {
+	RequestHeader
+	// ExpDesc is the expected current range descriptor to modify. If the
+	// range descriptor is not identical to ExpDesc for the request will fail.
+	ExpDesc roachpb.RangeDescriptor
+	// InternalChanges are the replication changes to make.
+	InternalChanges []ReplicationChange
+}
+
+// An AdminChangeReplicasResponse is the return value from the
+// AdminChangeReplicas() method.
+type AdminChangeReplicasResponse struct {
+	ResponseHeader
+	// Desc is the descriptor of the range once the changes have been made.
+	Desc roachpb.RangeDescriptor
+}
+
+// An AdminTransferLeaseRequest is the argument to the AdminTransferLease()
+// method. A lease transfer allows an external entity to control the lease
+// holder for a range. The target of the lease transfer needs to be a valid
+// replica of the range.
+type AdminTransferLeaseRequest struct {
+	RequestHeader
+	// Target is the store of the replica to which the lease is transferred.
+	Target roachpb.StoreID
+}
+
+// An AdminTransferLeaseResponse is the return value from the
+// AdminTransferLease() method.
+type AdminTransferLeaseResponse struct {
+	ResponseHeader
+}
+
+// combinable is implemented by response types whose corresponding
+// requests may cross range boundaries, such as Scan. When the DistSender
+// splits such a request by range, it combines the responses of the
+// individual ranges into a single response.
+type combinable interface {
+	combine(combinable) error
+}
+
+// CombineResponses attempts to combine the two provided responses. If both
+// of the responses are combinable, they will be combined. If neither are
+// combinable, the function is a no-op and returns a nil error. If one of the
+// responses is combinable and the other isn't, the function returns an
+// error.
+func CombineResponses(left, right Response) error {
+	cLeft, lOK := left.(combinable)
+	cRight, rOK := right.(combinable)
+	if lOK && rOK {
+		return cLeft.combine(cRight)
+	} else if lOK != rOK {
+		return fmt.Errorf("can not combine %T and %T", left, right)
+	}
+	return nil
+}
+
+// combine is used by range-spanning Response types (e.g. Scan) to merge
+// their headers.
+func (rh *ResponseHeader) combine(otherRH ResponseHeader) error {
+	if rh.Txn != nil && otherRH.Txn == nil {
+		rh.Txn = nil
+	}
+	if rh.ResumeSpan != nil {
+		return fmt.Errorf("combining %+v with %+v", rh.ResumeSpan, otherRH.ResumeSpan)
+	}
+	rh.ResumeSpan = otherRH.ResumeSpan
+	rh.NumKeys += otherRH.NumKeys
+	return nil
+}
+
+// combine implements the combinable interface.
+func (sr *ScanResponse) combine(c combinable) error {
+	otherSR := c.(*ScanResponse)
+	if sr != nil {
+		sr.Rows = append(sr.Rows, otherSR.Rows...)
+		if err := sr.ResponseHeader.combine(otherSR.Header()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var _ combinable = &ScanResponse{}
@@ -0,0 +1,119 @@
+package kvpb
+
+import (
+	"context"
+	"google.golang.org/grpc"
+)
+
+// This file holds the gRPC bindings of the Internal service, which would be
+// generated from its protobuf definition.
+
+const (
+	// internalBatchMethod is the full name of the Internal.Batch method.
+	internalBatchMethod = "/cockroach.roachpb.Internal/Batch"
+	// internalRangeFeedMethod is the full name of the Internal.RangeFeed
+	// method.
+	internalRangeFeedMethod = "/cockroach.roachpb.Internal/RangeFeed"
+)
+
+type internalClient struct {
+	cc grpc.ClientConnInterface
+}
+
+// NewInternalClient returns an InternalClient which sends its calls over cc.
+func NewInternalClient(cc grpc.ClientConnInterface) InternalClient {
+	return &internalClient{cc: cc}
+}
+
+// Batch implements the InternalClient interface.
+func (c *internalClient) Batch(
+	ctx context.Context, in *BatchRequest, opts ...grpc.CallOption,
+) (*BatchResponse, error) {
+	out := new(BatchResponse)
+	if err := c.cc.Invoke(ctx, internalBatchMethod, in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// RangeFeed implements the InternalClient interface.
+func (c *internalClient) RangeFeed(
+	ctx context.Context, in *RangeFeedRequest, opts ...grpc.CallOption,
+) (Internal_RangeFeedClient, error) {
+	stream, err := c.cc.NewStream(ctx, &internalServiceDesc.Streams[0], internalRangeFeedMethod, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &internalRangeFeedClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type internalRangeFeedClient struct {
+	grpc.ClientStream
+}
+
+// Recv implements the Internal_RangeFeedClient interface.
+func (x *internalRangeFeedClient) Recv() (*RangeFeedEvent, error) {
+	m := new(RangeFeedEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// RegisterInternalServer registers the Internal service of srv with s.
+func RegisterInternalServer(s grpc.ServiceRegistrar, srv InternalServer) {
+	s.RegisterService(&internalServiceDesc, srv)
+}
+
+func internalBatchHandler(
+	srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor,
+) (interface{}, error) {
+	in := new(BatchRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(InternalServer).Batch(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: internalBatchMethod}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(InternalServer).Batch(ctx, req.(*BatchRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func internalRangeFeedHandler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(RangeFeedRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(InternalServer).RangeFeed(m, &internalRangeFeedServer{stream})
+}
+
+type internalRangeFeedServer struct {
+	grpc.ServerStream
+}
+
+// Send implements the Internal_RangeFeedServer interface.
+func (x *internalRangeFeedServer) Send(m *RangeFeedEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+var internalServiceDesc = grpc.ServiceDesc{
+	ServiceName: "cockroach.roachpb.Internal",
+	HandlerType: (*InternalServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "Batch", Handler: internalBatchHandler},
+	},
+	Streams: []grpc.StreamDesc{
+		{StreamName: "RangeFeed", Handler: internalRangeFeedHandler, ServerStreams: true},
+	},
+	Metadata: "roachpb/api.proto",
+}
@@ -0,0 +1,215 @@
+package kvpb
+
+import (
+	"fmt"
+	"github.com/dborchard/tiny_crdb/pkg/h_storage/enginepb"
+)
+
+// Add adds a request to the batch request. It's a convenience method;
+// requests may also be added directly into the slice.
+func (ba *BatchRequest) Add(requests ...Request) {
+	for _, args := range requests {
+		ba.Requests = append(ba.Requests, RequestUnion{})
+		ba.Requests[len(ba.Requests)-1].MustSetInner(args)
+	}
+}
+
+// Add adds a response to the batch response. It's a convenience method;
+// responses may also be added directly.
+func (br *BatchResponse) Add(reply Response) {
+	br.Responses = append(br.Responses, ResponseUnion{})
+	br.Responses[len(br.Responses)-1].MustSetInner(reply)
+}
+
+// Combine combines each inner response of the BatchResponse with the
+// corresponding response in otherBatch, merging their headers. positions
+// maps the responses of otherBatch to their positions in the receiver, which
+// must already have an entry for every position; entries that are still
+// empty are filled in with the corresponding response.
+func (br *BatchResponse) Combine(otherBatch *BatchResponse, positions []int) error {
+	// Combine the headers.
+	br.Timestamp.Forward(otherBatch.Timestamp)
+	if br.Txn != nil {
+		br.Txn.Update(otherBatch.Txn)
+	} else if otherBatch.Txn != nil {
+		br.Txn = otherBatch.Txn.Clone()
+	}
+	br.ContentionEvents = append(br.ContentionEvents, otherBatch.ContentionEvents...)
+	// Combine the responses.
+	for i := range otherBatch.Responses {
+		pos := positions[i]
+		if br.Responses[pos].GetInner() == nil {
+			br.Responses[pos] = otherBatch.Responses[i]
+			continue
+		}
+		valLeft := br.Responses[pos].GetInner()
+		valRight := otherBatch.Responses[i].GetInner()
+		if err := CombineResponses(valLeft, valRight); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// IsReadOnly returns true if all requests within are read-only.
+func (ba *BatchRequest) IsReadOnly() bool {
+	if len(ba.Requests) == 0 {
+		return false
+	}
+	for _, union := range ba.Requests {
+		if !IsReadOnly(union.GetInner()) {
+			return false
+		}
+	}
+	return true
+}
+
+// IsAdmin returns true iff the BatchRequest contains an admin request.
+func (ba *BatchRequest) IsAdmin() bool {
+	for _, union := range ba.Requests {
+		if IsAdmin(union.GetInner()) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsLocking returns true if the batch contains a request that acquires
+// locks.
+func (ba *BatchRequest) IsLocking() bool {
+	for _, union := range ba.Requests {
+		if IsLocking(union.GetInner()) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetArg returns a request of the given type if one is contained in the
+// Batch. The request returned is the first of its kind, with the exception
+// of EndTxn, where only the last one is returned.
+func (ba *BatchRequest) GetArg(method Method) (Request, bool) {
+	if method == EndTxn {
+		if length := len(ba.Requests); length > 0 {
+			if req := ba.Requests[length-1].GetInner(); req.Method() == EndTxn {
+				return req, true
+			}
+		}
+		return nil, false
+	}
+
+	for _, arg := range ba.Requests {
+		if req := arg.GetInner(); req.Method() == method {
+			return req, true
+		}
+	}
+	return nil, false
+}
+
+// IsCompleteTransaction determines whether a batch contains every write in a
+// transaction. It relies on the sequence numbers assigned to the requests by
+// the transaction coordinator: writes and the EndTxn request are given
+// consecutive sequence numbers starting at 1, so the batch is complete if it
+// contains the writes at every sequence number below the EndTxn's.
+func (ba *BatchRequest) IsCompleteTransaction() bool {
+	et, hasET := ba.GetArg(EndTxn)
+	if !hasET || !et.(*EndTxnRequest).Commit {
+		return false
+	}
+	maxSeq := et.Header().Sequence
+	switch maxSeq {
+	case 0:
+		// Ignore batches that were not assigned sequence numbers.
+		return false
+	case 1:
+		// The transaction performed no writes.
+		return true
+	}
+	if int(maxSeq) > len(ba.Requests) {
+		// Fast path.
+		return false
+	}
+	// Check whether any sequence numbers were skipped between 1 and the
+	// EndTxn's sequence number. A Batch is only a complete transaction if it
+	// contains every write that the transaction performed.
+	nextSeq := enginepb.TxnSeq(1)
+	for _, args := range ba.Requests {
+		req := args.GetInner()
+		seq := req.Header().Sequence
+		if seq > nextSeq {
+			return false
+		}
+		if seq == nextSeq {
+			if !IsIntentWrite(req) {
+				return false
+			}
+			nextSeq++
+			if nextSeq == maxSeq {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// IsSingleEndTxnRequest returns true iff the batch contains a single request,
+// and that request is an EndTxnRequest.
+func (ba *BatchRequest) IsSingleEndTxnRequest() bool {
+	if len(ba.Requests) == 1 {
+		_, ok := ba.Requests[0].GetInner().(*EndTxnRequest)
+		return ok
+	}
+	return false
+}
+
+// IsSinglePushTxnRequest returns true iff the batch contains a single
+// request, and that request is a PushTxnRequest.
+func (ba *BatchRequest) IsSinglePushTxnRequest() bool {
+	if len(ba.Requests) == 1 {
+		_, ok := ba.Requests[0].GetInner().(*PushTxnRequest)
+		return ok
+	}
+	return false
+}
+
+// IsSingleSkipsLeaseCheckRequest returns true iff the batch contains a
+// single request, and that request has the skipsLeaseCheck flag set.
+func (ba *BatchRequest) IsSingleSkipsLeaseCheckRequest() bool {
+	return len(ba.Requests) == 1 && SkipsLeaseCheck(ba.Requests[0].GetInner())
+}
+
+// ShallowCopy returns a shallow copy of the receiver.
+func (ba *BatchRequest) ShallowCopy() *BatchRequest {
+	shallowCopy := *ba
+	return &shallowCopy
+}
+
+// Methods returns a slice of the contained methods.
+func (ba *BatchRequest) Methods() []Method {
+	var res []Method
+	for _, arg := range ba.Requests {
+		res = append(res, arg.GetInner().Method())
+	}
+	return res
+}
+
+// String gives a brief summary of the contained requests and keys in the batch.
+func (ba BatchRequest) String() string {
+	var str string
+	for i, arg := range ba.Requests {
+		if i > 0 {
+			str += ", "
+		}
+		req := arg.GetInner()
+		h := req.Header()
+		if len(h.EndKey) > 0 {
+			str += fmt.Sprintf("%s [%s,%s)", req.Method(), h.Key, h.EndKey)
+		} else {
+			str += fmt.Sprintf("%s [%s]", req.Method(), h.Key)
+		}
+	}
+	if ba.Txn != nil {
+		str += fmt.Sprintf(", [txn: %s]", ba.Txn.Short())
+	}
+	return str
+}
@@ -0,0 +1,50 @@
+package kvpb
+
+import (
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/dborchard/tiny_crdb/pkg/h_storage/enginepb"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+// TestBatchIsCompleteTransaction verifies that a batch is only considered a
+// complete transaction if it contains every write of the transaction below
+// the sequence number of its committing EndTxn.
+func TestBatchIsCompleteTransaction(t *testing.T) {
+	get := func(seq enginepb.TxnSeq) Request {
+		return &GetRequest{RequestHeader: RequestHeader{Key: roachpb.Key("a"), Sequence: seq}}
+	}
+	put := func(seq enginepb.TxnSeq) Request {
+		return &PutRequest{RequestHeader: RequestHeader{Key: roachpb.Key("a"), Sequence: seq}}
+	}
+	endTxn := func(seq enginepb.TxnSeq, commit bool) Request {
+		return &EndTxnRequest{RequestHeader: RequestHeader{Key: roachpb.Key("a"), Sequence: seq}, Commit: commit}
+	}
+	testCases := []struct {
+		name     string
+		reqs     []Request
+		complete bool
+	}{
+		{"no EndTxn", []Request{put(1), put(2)}, false},
+		{"rollback", []Request{put(1), endTxn(2, false)}, false},
+		{"no sequence numbers", []Request{put(0), endTxn(0, true)}, false},
+		{"EndTxn without writes", []Request{endTxn(1, true)}, true},
+		{"EndTxn without writes after reads", []Request{get(0), get(0), endTxn(1, true)}, true},
+		{"contiguous writes", []Request{put(1), put(2), endTxn(3, true)}, true},
+		{"contiguous writes and reads", []Request{put(1), get(1), put(2), endTxn(3, true)}, true},
+		{"earlier writes", []Request{put(3), endTxn(4, true)}, false},
+		{"non-contiguous sequence numbers", []Request{put(1), put(3), get(3), endTxn(4, true)}, false},
+		{"read at a missing sequence number", []Request{put(1), get(2), get(2), endTxn(3, true)}, false},
+		// The writes at sequence numbers 2 and 3 were sent in an earlier batch
+		// and rolled back to a savepoint; they remain writes of the
+		// transaction, which the batch does not contain.
+		{"savepoint gap", []Request{put(1), put(4), put(5), endTxn(6, true)}, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ba := &BatchRequest{}
+			ba.Add(tc.reqs...)
+			require.Equal(t, tc.complete, ba.IsCompleteTransaction())
+		})
+	}
+}
@@ -0,0 +1,802 @@
+package kvpb
+
+import (
+	"errors"
+	"fmt"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/dborchard/tiny_crdb/pkg/h_storage/enginepb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/uuid"
+	"time"
+)
+
+// ErrorDetailInterface is an interface for each error detail.
+type ErrorDetailInterface interface {
+	error
+	// Type returns the error's type.
+	Type() ErrorDetailType
+}
+
+// ErrorDetailType identifies the type of KV error.
+type ErrorDetailType int
+
+// This lists all ErrorDetail types. The numeric values in this list are used to
+// identify corresponding timeseries.
+const (
+	NotLeaderErrType           ErrorDetailType = 1
+	RangeNotFoundErrType       ErrorDetailType = 2
+	RangeKeyMismatchErrType    ErrorDetailType = 3
+	WriteIntentErrType         ErrorDetailType = 6
+	WriteTooOldErrType         ErrorDetailType = 7
+	TransactionAbortedErrType  ErrorDetailType = 9
+	TransactionPushErrType     ErrorDetailType = 10
+	TransactionRetryErrType    ErrorDetailType = 11
+	AmbiguousResultErrType     ErrorDetailType = 26
+	IndeterminateCommitErrType ErrorDetailType = 35
+	LeaseRejectedErrType       ErrorDetailType = 13
+	ReplicaUnavailableErrType  ErrorDetailType = 45
+	NotLeaseHolderErrType      ErrorDetailType = 46
+	RangeFeedRetryErrType      ErrorDetailType = 38
+	// When adding new error types, don't forget to update NumErrors below.
+
+	// CommunicationErrType indicates a gRPC error; this is not an ErrorDetail.
+	// The value 22 is chosen because it's reserved in the errors proto.
+	CommunicationErrType ErrorDetailType = 22
+	// InternalErrType indicates a pErr that doesn't carry a detail.
+	InternalErrType ErrorDetailType = 25
+)
+
+// Error is a generic representation including a string message, a
+// transaction and an optional detail.
+type Error struct {
+	// goError is the original Go error; it carries the message and, if set,
+	// the structured detail of the error.
+	goError error
+	// If an ErrorDetail is present, it may contain additional structured data
+	// about the error.
+	detail ErrorDetailInterface
+	// The transaction in which the error occurred. Use GetTxn to read and
+	// UpdateTxn to write.
+	UnexposedTxn *roachpb.Transaction
+	// If set, the index of the request within the Batch which caused the
+	// error.
+	Index *ErrPosition
+	// Now is the clock reading of the node which returned the error, with
+	// which the sender of the batch updates its clock.
+	Now hlc.ClockTimestamp
+}
+
+// ErrPosition describes the position of an error in a Batch. A simple nullable
+// primitive field would break compatibility with proto3, where primitive
+// fields are no longer allowed to be nullable.
+type ErrPosition struct {
+	Index int32
+}
+
+// NewError creates an Error from the given error.
+func NewError(err error) *Error {
+	if err == nil {
+		return nil
+	}
+	e := &Error{goError: err}
+	var detail ErrorDetailInterface
+	if errors.As(err, &detail) {
+		e.detail = detail
+	}
+	return e
+}
+
+// NewErrorWithTxn creates an Error from the given error and a transaction.
+//
+// txn is cloned before being stored in Error.
+func NewErrorWithTxn(err error, txn *roachpb.Transaction) *Error {
+	e := NewError(err)
+	e.SetTxn(txn)
+	return e
+}
+
+// NewErrorf creates an Error from the given error message. It is a
+// passthrough to fmt.Errorf, with an additional prefix containing the
+// filename and line number.
+func NewErrorf(format string, a ...interface{}) *Error {
+	return NewError(fmt.Errorf(format, a...))
+}
+
+// String implements fmt.Stringer.
+func (e *Error) String() string {
+	if e == nil {
+		return "<nil>"
+	}
+	return e.goError.Error()
+}
+
+// GoError returns a Go error converted from Error. If the error is a
+// transaction retry error, it returns the error itself wrapped in a
+// TransactionRetryWithProtoRefreshError.
+func (e *Error) GoError() error {
+	if e == nil {
+		return nil
+	}
+	return e.goError
+}
+
+// GetDetail returns an error detail associated with the error, or nil.
+func (e *Error) GetDetail() ErrorDetailInterface {
+	if e == nil {
+		return nil
+	}
+	return e.detail
+}
+
+// SetTxn sets the error transaction and resets the error message.
+// The argument is cloned before being stored in the Error.
+func (e *Error) SetTxn(txn *roachpb.Transaction) {
+	e.UnexposedTxn = txn.Clone()
+}
+
+// GetTxn returns the txn.
+func (e *Error) GetTxn() *roachpb.Transaction {
+	if e == nil {
+		return nil
+	}
+	return e.UnexposedTxn
+}
+
+// UpdateTxn updates the error transaction.
+func (e *Error) UpdateTxn(o *roachpb.Transaction) {
+	if o == nil {
+		return
+	}
+	if e.UnexposedTxn == nil {
+		e.UnexposedTxn = o.Clone()
+	} else {
+		e.UnexposedTxn.Update(o)
+	}
+}
+
+// SetErrorIndex sets the index of the error.
+func (e *Error) SetErrorIndex(index int32) {
+	e.Index = &ErrPosition{Index: index}
+}
+
+// WriteIntentError indicates that one or more write intent belonging to
+// another transaction were encountered leading to a read/write or write/write
+// conflict. The keys at which the intent was encountered are set, as are the
+// txn records for the intents' transactions.
+type WriteIntentError struct {
+	Intents []roachpb.Intent
+	// Reason is the reason for the error, if it is returned to the client
+	// instead of being handled by the concurrency manager.
+	Reason WriteIntentError_Reason
+}
+
+// WriteIntentError_Reason specifies why a WriteIntentError was returned to
+// the client.
+type WriteIntentError_Reason int32
+
+const (
+	// The reason for the WriteIntentError is unspecified. This will only be
+	// set if the error is handled by the concurrency manager.
+	WriteIntentError_REASON_UNSPECIFIED WriteIntentError_Reason = 0
+	// The request used an Error wait policy because it did not want to wait
+	// on locks and it encountered a conflicting lock held by an active
+	// transaction.
+	WriteIntentError_REASON_WAIT_POLICY WriteIntentError_Reason = 1
+)
+
+// String implements fmt.Stringer.
+func (r WriteIntentError_Reason) String() string {
+	switch r {
+	case WriteIntentError_REASON_UNSPECIFIED:
+		return "REASON_UNSPECIFIED"
+	case WriteIntentError_REASON_WAIT_POLICY:
+		return "REASON_WAIT_POLICY"
+	default:
+		return fmt.Sprintf("WriteIntentError_Reason(%d)", int32(r))
+	}
+}
+
+var _ ErrorDetailInterface = &WriteIntentError{}
+
+func (e *WriteIntentError) Error() string {
+	if len(e.Intents) == 1 {
+		return fmt.Sprintf("conflicting intents on %s [txn: %s]", e.Intents[0].Key, e.Intents[0].Txn.Short())
+	}
+	return fmt.Sprintf("conflicting intents on %d keys", len(e.Intents))
+}
+
+// Type is part of the ErrorDetailInterface.
+func (e *WriteIntentError) Type() ErrorDetailType {
+	return WriteIntentErrType
+}
+
+// WriteTooOldError indicates that a write encountered a versioned value newer
+// than its timestamp, making it impossible to rewrite history. The write is
+// instead done at actual timestamp, which is the timestamp of the existing
+// version+1.
+type WriteTooOldError struct {
+	Timestamp       hlc.Timestamp
+	ActualTimestamp hlc.Timestamp
+}
+
+var _ ErrorDetailInterface = &WriteTooOldError{}
+
+// NewWriteTooOldError creates a new write too old error. The function accepts
+// the timestamp of the operation that hit the error, along with the timestamp
+// immediately after the existing write which had a higher timestamp and which
+// caused the error.
+func NewWriteTooOldError(operationTS, actualTS hlc.Timestamp) *WriteTooOldError {
+	return &WriteTooOldError{Timestamp: operationTS, ActualTimestamp: actualTS}
+}
+
+func (e *WriteTooOldError) Error() string {
+	return fmt.Sprintf("WriteTooOldError: write at timestamp %v too old; must write at or above %v",
+		e.Timestamp, e.ActualTimestamp)
+}
+
+// Type is part of the ErrorDetailInterface.
+func (e *WriteTooOldError) Type() ErrorDetailType {
+	return WriteTooOldErrType
+}
+
+// TransactionAbortedReason specifies what caused a TransactionAbortedError.
+type TransactionAbortedReason int32
+
+const (
+	// For backwards compatibility.
+	ABORT_REASON_UNKNOWN TransactionAbortedReason = 0
+	// A BeginTransaction, HeartbeatTxn, or EndTxn(commit=true) request found
+	// an aborted transaction record. Another txn must have written this record
+	// - that other txn probably ran into one of our intents and pushed our
+	// transaction record successfully. Either a high-priority conflict or a
+	// dead transaction.
+	ABORT_REASON_ABORTED_RECORD_FOUND TransactionAbortedReason = 1
+	// The client is trying to use a transaction that's already been aborted.
+	// The TxnCoordSender detects this. Either the client is misusing a txn, or
+	// the TxnCoordSender found out about the transaction being aborted async
+	// through the heartbeat loop.
+	ABORT_REASON_CLIENT_REJECT TransactionAbortedReason = 3
+	// The txn was trying to push another and found out that it itself got
+	// aborted somehow while waiting for the push.
+	ABORT_REASON_PUSHER_ABORTED TransactionAbortedReason = 4
+)
+
+// TransactionAbortedError indicates that the client should retry the
+// transaction (and use a different txn id, as opposed to
+// TransactionRetryError). This most often happens when the transaction was
+// aborted by another concurrent transaction. Upon seeing this error, the
+// client is supposed to reset its Transaction proto and try the transaction
+// again.
+type TransactionAbortedError struct {
+	Reason TransactionAbortedReason
+}
+
+var _ ErrorDetailInterface = &TransactionAbortedError{}
+
+// NewTransactionAbortedError initializes a new TransactionAbortedError.
+func NewTransactionAbortedError(reason TransactionAbortedReason) *TransactionAbortedError {
+	return &TransactionAbortedError{Reason: reason}
+}
+
+func (e *TransactionAbortedError) Error() string {
+	return fmt.Sprintf("TransactionAbortedError(%d)", e.Reason)
+}
+
+// Type is part of the ErrorDetailInterface.
+func (e *TransactionAbortedError) Type() ErrorDetailType {
+	return TransactionAbortedErrType
+}
+
+// TransactionPushError indicates that the transaction could not continue
+// because it encountered a write intent from another transaction which
+// it was unable to push.
+type TransactionPushError struct {
+	PusheeTxn roachpb.Transaction
+}
+
+var _ ErrorDetailInterface = &TransactionPushError{}
+
+// NewTransactionPushError initializes a new TransactionPushError.
+func NewTransactionPushError(pusheeTxn roachpb.Transaction) *TransactionPushError {
+	// Note: this error will cause a txn restart. The error that the client
+	// receives contains a txn that might have a modified priority.
+	return &TransactionPushError{PusheeTxn: pusheeTxn}
+}
+
+func (e *TransactionPushError) Error() string {
+	return fmt.Sprintf("failed to push %s", e.PusheeTxn.Short())
+}
+
+// Type is part of the ErrorDetailInterface.
+func (e *TransactionPushError) Type() ErrorDetailType {
+	return TransactionPushErrType
+}
+
+// TransactionRetryReason specifies what caused a TransactionRetryError.
+type TransactionRetryReason int32
+
+const (
+	// For backwards compatibility.
+	RETRY_REASON_UNKNOWN TransactionRetryReason = 0
+	// A concurrent writer finished first, causing restart.
+	RETRY_WRITE_TOO_OLD TransactionRetryReason = 1
+	// A SERIALIZABLE transaction had its timestamp moved forward.
+	RETRY_SERIALIZABLE TransactionRetryReason = 3
+	// An asynchronous write was observed to have failed.
+	RETRY_ASYNC_WRITE_FAILURE TransactionRetryReason = 5
+	// The transaction exceeded its deadline.
+	RETRY_COMMIT_DEADLINE_EXCEEDED TransactionRetryReason = 6
+)
+
+// String implements fmt.Stringer.
+func (r TransactionRetryReason) String() string {
+	switch r {
+	case RETRY_REASON_UNKNOWN:
+		return "RETRY_REASON_UNKNOWN"
+	case RETRY_WRITE_TOO_OLD:
+		return "RETRY_WRITE_TOO_OLD"
+	case RETRY_SERIALIZABLE:
+		return "RETRY_SERIALIZABLE"
+	case RETRY_ASYNC_WRITE_FAILURE:
+		return "RETRY_ASYNC_WRITE_FAILURE"
+	case RETRY_COMMIT_DEADLINE_EXCEEDED:
+		return "RETRY_COMMIT_DEADLINE_EXCEEDED"
+	default:
+		return fmt.Sprintf("TransactionRetryReason(%d)", int32(r))
+	}
+}
+
+// TransactionRetryError indicates that the transaction must be retried,
+// usually with an increased transaction timestamp.
+type TransactionRetryError struct {
+	Reason   TransactionRetryReason
+	ExtraMsg string
+}
+
+var _ ErrorDetailInterface = &TransactionRetryError{}
+
+// NewTransactionRetryError initializes a new TransactionRetryError.
+func NewTransactionRetryError(
+	reason TransactionRetryReason, extraMsg string,
+) *TransactionRetryError {
+	return &TransactionRetryError{Reason: reason, ExtraMsg: extraMsg}
+}
+
+// NewTxnDeadlineExceededErr returns the retry error used to reject the commit
+// of a transaction whose provisional commit timestamp exceeded its deadline.
+// It is returned both by the coordinator, which rejects such commits before
+// sending them, and by the evaluation of EndTxn.
+func NewTxnDeadlineExceededErr(
+	txn *roachpb.Transaction, deadline hlc.Timestamp,
+) *TransactionRetryError {
+	exceededBy := time.Duration(txn.WriteTimestamp.WallTime - deadline.WallTime)
+	extraMsg := fmt.Sprintf(
+		"txn timestamp pushed too much; deadline exceeded by %s (%v > %v)",
+		exceededBy, txn.WriteTimestamp, deadline)
+	return NewTransactionRetryError(RETRY_COMMIT_DEADLINE_EXCEEDED, extraMsg)
+}
+
+func (e *TransactionRetryError) Error() string {
+	msg := ""
+	if e.ExtraMsg != "" {
+		msg = " - " + e.ExtraMsg
+	}
+	return fmt.Sprintf("TransactionRetryError: retry txn (%s%s)", e.Reason, msg)
+}
+
+// Type is part of the ErrorDetailInterface.
+func (e *TransactionRetryError) Type() ErrorDetailType {
+	return TransactionRetryErrType
+}
+
+// TransactionRetryWithProtoRefreshError is an error detailing a retryable
+// transaction error. It is produced by the TxnCoordSender from the retryable
+// errors returned by the server (e.g. TransactionRetryError,
+// WriteTooOldError), and carries the transaction proto to be used for the
+// next attempt.
+type TransactionRetryWithProtoRefreshError struct {
+	// A user-readable message.
+	Msg string
+	// The ID of the transaction being restarted. The client is supposed to
+	// check this against the ID of its current transaction.
+	PrevTxnID uuid.UUID
+	// The epoch of the transaction being restarted.
+	PrevTxnEpoch enginepb.TxnEpoch
+	// The Transaction that should be used by next attempts. Depending on the
+	// original cause of this method, this can either be the same Transaction
+	// as before, but with an incremented epoch and timestamp, or a completely
+	// new Transaction.
+	NextTransaction roachpb.Transaction
+}
+
+// NewTransactionRetryWithProtoRefreshError creates a
+// TransactionRetryWithProtoRefreshError.
+func NewTransactionRetryWithProtoRefreshError(
+	msg string, prevTxnID uuid.UUID, prevTxnEpoch enginepb.TxnEpoch, nextTxn roachpb.Transaction,
+) *TransactionRetryWithProtoRefreshError {
+	return &TransactionRetryWithProtoRefreshError{
+		Msg:             msg,
+		PrevTxnID:       prevTxnID,
+		PrevTxnEpoch:    prevTxnEpoch,
+		NextTransaction: nextTxn,
+	}
+}
+
+func (e *TransactionRetryWithProtoRefreshError) Error() string {
+	return fmt.Sprintf("TransactionRetryWithProtoRefreshError: %s", e.Msg)
+}
+
+// PrevTxnAborted returns true if this error originated from a
+// TransactionAbortedError. If true, the client will need to create a new
+// transaction, as opposed to continuing with the existing one at a bumped
+// epoch.
+func (e *TransactionRetryWithProtoRefreshError) PrevTxnAborted() bool {
+	return e.NextTransaction.ID != e.PrevTxnID
+}
+
+// TxnMustRestartFromBeginning returns true if the transaction must restart
+// from the beginning, i.e. if its epoch was bumped or it was aborted. If
+// false, the transaction may instead retry just the statement that hit the
+// error, which is possible for isolation levels that establish a new read
+// snapshot for each statement.
+func (e *TransactionRetryWithProtoRefreshError) TxnMustRestartFromBeginning() bool {
+	return e.PrevTxnAborted() || e.PrevTxnEpoch < e.NextTransaction.Epoch
+}
+
+// IndeterminateCommitError reports that a transaction was encountered in a
+// STAGING state. When this happens, the transaction's status is
+// indeterminate: it is either implicitly committed, if all of its in-flight
+// writes succeeded, or it is still in progress and may or may not go on to
+// commit. The transaction recovery process must be run to determine which
+// is the case, and to move the transaction record to an explicit status.
+type IndeterminateCommitError struct {
+	StagingTxn roachpb.Transaction
+}
+
+var _ ErrorDetailInterface = &IndeterminateCommitError{}
+
+// NewIndeterminateCommitError initializes a new IndeterminateCommitError.
+func NewIndeterminateCommitError(txn roachpb.Transaction) *IndeterminateCommitError {
+	return &IndeterminateCommitError{StagingTxn: txn}
+}
+
+func (e *IndeterminateCommitError) Error() string {
+	return fmt.Sprintf("found txn in indeterminate STAGING state %s", e.StagingTxn.Short())
+}
+
+// Type is part of the ErrorDetailInterface.
+func (e *IndeterminateCommitError) Type() ErrorDetailType {
+	return IndeterminateCommitErrType
+}
+
+// ReplicaUnavailableError indicates that a replica is unable to serve
+// requests, typically because its circuit breaker has tripped after a
+// replication proposal got stuck. Requests to the replica fail fast with this
+// error instead of hanging until the replica recovers.
+type ReplicaUnavailableError struct {
+	// RangeID is the ID of the range to which the replica belongs.
+	RangeID roachpb.RangeID
+	// Span is the span of keys addressed by the range.
+	Span roachpb.Span
+	// Cause is the reason for which the replica is unavailable.
+	Cause error
+}
+
+var _ ErrorDetailInterface = &ReplicaUnavailableError{}
+
+// NewReplicaUnavailableError initializes a new *ReplicaUnavailableError. It
+// provides more context to the cause of the unavailability.
+func NewReplicaUnavailableError(
+	cause error, rangeID roachpb.RangeID, span roachpb.Span,
+) *ReplicaUnavailableError {
+	return &ReplicaUnavailableError{RangeID: rangeID, Span: span, Cause: cause}
+}
+
+func (e *ReplicaUnavailableError) Error() string {
+	return fmt.Sprintf("replica unavailable: r%d:%s unable to serve request: %v",
+		e.RangeID, e.Span, e.Cause)
+}
+
+// Unwrap returns the cause of the unavailability.
+func (e *ReplicaUnavailableError) Unwrap() error {
+	return e.Cause
+}
+
+// Type is part of the ErrorDetailInterface.
+func (e *ReplicaUnavailableError) Type() ErrorDetailType {
+	return ReplicaUnavailableErrType
+}
+
+// A NotLeaderError indicates that the current range is not the leader of its
+// Raft group. Only the leader proposes commands. If the leader is known, it
+// is returned as a hint, so that the sender retries on it.
+type NotLeaderError struct {
+	// Replica is the replica which rejected the request.
+	Replica roachpb.ReplicaDescriptor
+	// Leader is the leader of the range, if known.
+	Leader  *roachpb.ReplicaDescriptor
+	RangeID roachpb.RangeID
+}
+
+var _ ErrorDetailInterface = &NotLeaderError{}
+
+// NewNotLeaderError returns a NotLeaderError initialized with the replica
+// which rejected the request, and the leader of the range if known.
+func NewNotLeaderError(
+	replica roachpb.ReplicaDescriptor, leader *roachpb.ReplicaDescriptor, rangeID roachpb.RangeID,
+) *NotLeaderError {
+	return &NotLeaderError{Replica: replica, Leader: leader, RangeID: rangeID}
+}
+
+func (e *NotLeaderError) Error() string {
+	msg := fmt.Sprintf("[NotLeaderError] r%d: replica %s not leader", e.RangeID, e.Replica)
+	if e.Leader != nil {
+		msg += fmt.Sprintf("; current leader is %s", *e.Leader)
+	} else {
+		msg += "; leader unknown"
+	}
+	return msg
+}
+
+// Type is part of the ErrorDetailInterface.
+func (e *NotLeaderError) Type() ErrorDetailType {
+	return NotLeaderErrType
+}
+
+// A NotLeaseHolderError indicates that the current range is not the lease
+// holder. If the lease holder is known, its lease is returned as a hint, so
+// that the sender retries on it. The hint may also be a speculative lease
+// naming the leader of the range's Raft group, which is the replica that
+// acquires the lease when none is valid.
+type NotLeaseHolderError struct {
+	// Replica is the replica which rejected the request.
+	Replica roachpb.ReplicaDescriptor
+	// Lease is the current lease of the range, if known.
+	Lease   *roachpb.Lease
+	RangeID roachpb.RangeID
+	// CustomMsg, if set, describes why the replica cannot serve the request.
+	CustomMsg string
+}
+
+var _ ErrorDetailInterface = &NotLeaseHolderError{}
+
+// NewNotLeaseHolderError returns a NotLeaseHolderError initialized with the
+// replica which rejected the request, and the lease of the range if known.
+func NewNotLeaseHolderError(
+	lease roachpb.Lease, proposerStoreID roachpb.StoreID, rangeDesc *roachpb.RangeDescriptor, msg string,
+) *NotLeaseHolderError {
+	err := &NotLeaseHolderError{
+		RangeID:   rangeDesc.RangeID,
+		CustomMsg: msg,
+	}
+	if replica, ok := rangeDesc.GetReplicaDescriptor(proposerStoreID); ok {
+		err.Replica = replica
+	}
+	if !lease.Empty() {
+		// The lease hint is only useful if its holder is a replica of the
+		// range.
+		if _, ok := rangeDesc.GetReplicaDescriptorByID(lease.Replica.ReplicaID); ok {
+			err.Lease = &lease
+		}
+	}
+	return err
+}
+
+func (e *NotLeaseHolderError) Error() string {
+	msg := fmt.Sprintf("[NotLeaseHolderError] r%d: ", e.RangeID)
+	if e.CustomMsg != "" {
+		msg += e.CustomMsg + "; "
+	}
+	msg += fmt.Sprintf("replica %s not lease holder", e.Replica)
+	if e.Lease != nil {
+		msg += fmt.Sprintf("; current lease is %s", e.Lease)
+	} else {
+		msg += "; lease holder unknown"
+	}
+	return msg
+}
+
+// Type is part of the ErrorDetailInterface.
+func (e *NotLeaseHolderError) Type() ErrorDetailType {
+	return NotLeaseHolderErrType
+}
+
+// A LeaseRejectedError indicates that the requested replica could not
+// acquire the desired lease because of an existing range lease.
+type LeaseRejectedError struct {
+	Message   string
+	Requested roachpb.Lease
+	Existing  roachpb.Lease
+}
+
+var _ ErrorDetailInterface = &LeaseRejectedError{}
+
+// NewLeaseRejectedError returns a LeaseRejectedError for the lease which
+// could not be installed over the existing one.
+func NewLeaseRejectedError(message string, existing, requested roachpb.Lease) *LeaseRejectedError {
+	return &LeaseRejectedError{Message: message, Existing: existing, Requested: requested}
+}
+
+func (e *LeaseRejectedError) Error() string {
+	return fmt.Sprintf("cannot replace lease %s with %s: %s", e.Existing, e.Requested, e.Message)
+}
+
+// Type is part of the ErrorDetailInterface.
+func (e *LeaseRejectedError) Type() ErrorDetailType {
+	return LeaseRejectedErrType
+}
+
+// An AmbiguousResultError indicates that a request may have succeeded or
+// failed, but the response was not received and the final result is
+// ambiguous. This happens when the proposer of a command stops waiting for
+// its application, for instance because the request's context was canceled.
+type AmbiguousResultError struct {
+	// Cause is the reason for which the result is ambiguous.
+	Cause error
+}
+
+var _ ErrorDetailInterface = &AmbiguousResultError{}
+
+// NewAmbiguousResultError initializes a new AmbiguousResultError with the
+// provided cause.
+func NewAmbiguousResultError(cause error) *AmbiguousResultError {
+	return &AmbiguousResultError{Cause: cause}
+}
+
+func (e *AmbiguousResultError) Error() string {
+	return fmt.Sprintf("result is ambiguous: %v", e.Cause)
+}
+
+// Unwrap returns the cause of the ambiguity.
+func (e *AmbiguousResultError) Unwrap() error {
+	return e.Cause
+}
+
+// Type is part of the ErrorDetailInterface.
+func (e *AmbiguousResultError) Type() ErrorDetailType {
+	return AmbiguousResultErrType
+}
+
+// A RangeNotFoundError indicates that a command was sent to a range that is
+// not hosted on the target store.
+type RangeNotFoundError struct {
+	RangeID roachpb.RangeID
+	// StoreID may be set to the store on which the range was not found.
+	StoreID roachpb.StoreID
+}
+
+var _ ErrorDetailInterface = &RangeNotFoundError{}
+
+// NewRangeNotFoundError initializes a new RangeNotFoundError for the given
+// RangeID and, optionally, a StoreID.
+func NewRangeNotFoundError(rangeID roachpb.RangeID, storeID roachpb.StoreID) *RangeNotFoundError {
+	return &RangeNotFoundError{RangeID: rangeID, StoreID: storeID}
+}
+
+func (e *RangeNotFoundError) Error() string {
+	msg := fmt.Sprintf("r%d was not found", e.RangeID)
+	if e.StoreID != 0 {
+		msg += fmt.Sprintf(" on s%d", e.StoreID)
+	}
+	return msg
+}
+
+// Type is part of the ErrorDetailInterface.
+func (e *RangeNotFoundError) Type() ErrorDetailType {
+	return RangeNotFoundErrType
+}
+
+// RangeKeyMismatchError indicates that a command was sent to a range which
+// did not contain the key(s) specified by the command. This happens when the
+// sender's range cache is stale, for instance because the range was split or
+// merged. The error carries descriptors of the ranges that the replica knows
+// about, so that the sender can update its cache before retrying.
+type RangeKeyMismatchError struct {
+	RequestStartKey roachpb.Key
+	RequestEndKey   roachpb.Key
+	// Ranges contains information intended for the client's range cache.
+	// The first entry is the range that the request was sent to, as known by
+	// the replica that rejected it.
+	Ranges []roachpb.RangeInfo
+}
+
+var _ ErrorDetailInterface = &RangeKeyMismatchError{}
+
+// NewRangeKeyMismatchError initializes a new RangeKeyMismatchError.
+//
+// desc is the range that the request was sent to; it must not be nil.
+func NewRangeKeyMismatchError(start, end roachpb.Key, desc *roachpb.RangeDescriptor) *RangeKeyMismatchError {
+	if desc == nil {
+		panic("NewRangeKeyMismatchError with nil descriptor")
+	}
+	return &RangeKeyMismatchError{
+		RequestStartKey: start,
+		RequestEndKey:   end,
+		Ranges:          []roachpb.RangeInfo{{Desc: *desc}},
+	}
+}
+
+func (e *RangeKeyMismatchError) Error() string {
+	return fmt.Sprintf("key range %s-%s outside of bounds of range %s",
+		e.RequestStartKey, e.RequestEndKey, e.Ranges[0].Desc.RSpan())
+}
+
+// Type is part of the ErrorDetailInterface.
+func (e *RangeKeyMismatchError) Type() ErrorDetailType {
+	return RangeKeyMismatchErrType
+}
+
+// MismatchedRange returns the range info for the range that the request was
+// erroneously routed to.
+func (e *RangeKeyMismatchError) MismatchedRange() roachpb.RangeInfo {
+	return e.Ranges[0]
+}
+
+// AppendRangeInfo appends info about a group of ranges to the set returned
+// to the client.
+func (e *RangeKeyMismatchError) AppendRangeInfo(descs ...roachpb.RangeDescriptor) {
+	for _, desc := range descs {
+		e.Ranges = append(e.Ranges, roachpb.RangeInfo{Desc: desc})
+	}
+}
+
+// RangeFeedRetryError_Reason is the reason for which a rangefeed was
+// disconnected. The client retries the rangefeed from its last checkpoint.
+type RangeFeedRetryError_Reason int32
+
+const (
+	// RangeFeedRetryError_REASON_REPLICA_REMOVED indicates that the replica
+	// serving the rangefeed was removed from its range.
+	RangeFeedRetryError_REASON_REPLICA_REMOVED RangeFeedRetryError_Reason = 0
+	// RangeFeedRetryError_REASON_RANGE_SPLIT indicates that the range was
+	// split: the client retries the rangefeed over the ranges covering its
+	// span.
+	RangeFeedRetryError_REASON_RANGE_SPLIT RangeFeedRetryError_Reason = 1
+	// RangeFeedRetryError_REASON_RANGE_MERGED indicates that the range was
+	// merged with its right neighbour, or into its left neighbour.
+	RangeFeedRetryError_REASON_RANGE_MERGED RangeFeedRetryError_Reason = 2
+	// RangeFeedRetryError_REASON_RAFT_SNAPSHOT indicates that the replica
+	// applied a Raft snapshot, which replaced its data without logical
+	// operations.
+	RangeFeedRetryError_REASON_RAFT_SNAPSHOT RangeFeedRetryError_Reason = 3
+	// RangeFeedRetryError_REASON_SLOW_CONSUMER indicates that the client of
+	// the rangefeed did not keep up with the events of the range.
+	RangeFeedRetryError_REASON_SLOW_CONSUMER RangeFeedRetryError_Reason = 5
+)
+
+var rangeFeedRetryErrorReasonNames = map[RangeFeedRetryError_Reason]string{
+	RangeFeedRetryError_REASON_REPLICA_REMOVED: "REASON_REPLICA_REMOVED",
+	RangeFeedRetryError_REASON_RANGE_SPLIT:     "REASON_RANGE_SPLIT",
+	RangeFeedRetryError_REASON_RANGE_MERGED:    "REASON_RANGE_MERGED",
+	RangeFeedRetryError_REASON_RAFT_SNAPSHOT:   "REASON_RAFT_SNAPSHOT",
+	RangeFeedRetryError_REASON_SLOW_CONSUMER:   "REASON_SLOW_CONSUMER",
+}
+
+func (r RangeFeedRetryError_Reason) String() string {
+	if name, ok := rangeFeedRetryErrorReasonNames[r]; ok {
+		return name
+	}
+	return fmt.Sprintf("RangeFeedRetryError_Reason(%d)", int32(r))
+}
+
+// A RangeFeedRetryError indicates that a rangefeed was disconnected, often
+// because of a range lifecycle event, and can be retried.
+type RangeFeedRetryError struct {
+	Reason RangeFeedRetryError_Reason
+}
+
+var _ ErrorDetailInterface = &RangeFeedRetryError{}
+
+// NewRangeFeedRetryError initializes a new RangeFeedRetryError.
+func NewRangeFeedRetryError(reason RangeFeedRetryError_Reason) *RangeFeedRetryError {
+	return &RangeFeedRetryError{Reason: reason}
+}
+
+func (e *RangeFeedRetryError) Error() string {
+	return fmt.Sprintf("retry rangefeed (%s)", e.Reason)
+}
+
+// Type is part of the ErrorDetailInterface.
+func (e *RangeFeedRetryError) Type() ErrorDetailType {
+	return RangeFeedRetryErrType
+}
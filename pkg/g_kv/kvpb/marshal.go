@@ -0,0 +1,267 @@
+package kvpb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"reflect"
+)
+
+// The messages of this package are sent between nodes in the encoding of
+// protoutil, which is JSON. The requests and responses of a batch, and the
+// details of errors, are held in interfaces, so their encodings are tagged
+// with their type, like the oneofs that they mirror on the wire.
+
+// requestTypes maps each method to a constructor of its request.
+var requestTypes = map[Method]func() Request{
+	Get:                 func() Request { return &GetRequest{} },
+	Put:                 func() Request { return &PutRequest{} },
+	Delete:              func() Request { return &DeleteRequest{} },
+	Scan:                func() Request { return &ScanRequest{} },
+	EndTxn:              func() Request { return &EndTxnRequest{} },
+	ResolveIntent:       func() Request { return &ResolveIntentRequest{} },
+	HeartbeatTxn:        func() Request { return &HeartbeatTxnRequest{} },
+	PushTxn:             func() Request { return &PushTxnRequest{} },
+	QueryTxn:            func() Request { return &QueryTxnRequest{} },
+	QueryIntent:         func() Request { return &QueryIntentRequest{} },
+	RefreshRange:        func() Request { return &RefreshRangeRequest{} },
+	RecoverTxn:          func() Request { return &RecoverTxnRequest{} },
+	TruncateLog:         func() Request { return &TruncateLogRequest{} },
+	RequestLease:        func() Request { return &RequestLeaseRequest{} },
+	TransferLease:       func() Request { return &TransferLeaseRequest{} },
+	AdminSplit:          func() Request { return &AdminSplitRequest{} },
+	AdminMerge:          func() Request { return &AdminMergeRequest{} },
+	AdminChangeReplicas: func() Request { return &AdminChangeReplicasRequest{} },
+	AdminTransferLease:  func() Request { return &AdminTransferLeaseRequest{} },
+}
+
+// responseMethods maps the type of each response to the method of a request
+// which it replies to. Responses shared by several methods map to the lowest
+// of them.
+var responseMethods = func() map[reflect.Type]Method {
+	m := make(map[reflect.Type]Method, len(requestTypes))
+	for method := Get; method <= AdminTransferLease; method++ {
+		typ := reflect.TypeOf(CreateReply(requestTypes[method]()))
+		if _, ok := m[typ]; !ok {
+			m[typ] = method
+		}
+	}
+	return m
+}()
+
+// errorDetailTypes maps each type of error detail to a constructor of the
+// detail.
+var errorDetailTypes = map[ErrorDetailType]func() ErrorDetailInterface{
+	NotLeaderErrType:           func() ErrorDetailInterface { return &NotLeaderError{} },
+	RangeNotFoundErrType:       func() ErrorDetailInterface { return &RangeNotFoundError{} },
+	RangeKeyMismatchErrType:    func() ErrorDetailInterface { return &RangeKeyMismatchError{} },
+	WriteIntentErrType:         func() ErrorDetailInterface { return &WriteIntentError{} },
+	WriteTooOldErrType:         func() ErrorDetailInterface { return &WriteTooOldError{} },
+	TransactionAbortedErrType:  func() ErrorDetailInterface { return &TransactionAbortedError{} },
+	TransactionPushErrType:     func() ErrorDetailInterface { return &TransactionPushError{} },
+	TransactionRetryErrType:    func() ErrorDetailInterface { return &TransactionRetryError{} },
+	AmbiguousResultErrType:     func() ErrorDetailInterface { return &AmbiguousResultError{} },
+	IndeterminateCommitErrType: func() ErrorDetailInterface { return &IndeterminateCommitError{} },
+	LeaseRejectedErrType:       func() ErrorDetailInterface { return &LeaseRejectedError{} },
+	ReplicaUnavailableErrType:  func() ErrorDetailInterface { return &ReplicaUnavailableError{} },
+	NotLeaseHolderErrType:      func() ErrorDetailInterface { return &NotLeaseHolderError{} },
+	RangeFeedRetryErrType:      func() ErrorDetailInterface { return &RangeFeedRetryError{} },
+}
+
+// unionJSON is the encoding of RequestUnion and ResponseUnion. The value is
+// tagged with the method of the request, which determines its type.
+type unionJSON struct {
+	Method Method
+	Value  json.RawMessage
+}
+
+// MarshalJSON implements json.Marshaler.
+func (ru RequestUnion) MarshalJSON() ([]byte, error) {
+	if ru.Value == nil {
+		return []byte("null"), nil
+	}
+	value, err := json.Marshal(ru.Value)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(unionJSON{Method: ru.Value.Method(), Value: value})
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (ru *RequestUnion) UnmarshalJSON(data []byte) error {
+	var enc *unionJSON
+	if err := json.Unmarshal(data, &enc); err != nil || enc == nil {
+		return err
+	}
+	newReq, ok := requestTypes[enc.Method]
+	if !ok {
+		return fmt.Errorf("unknown request method %d", enc.Method)
+	}
+	req := newReq()
+	if err := json.Unmarshal(enc.Value, req); err != nil {
+		return err
+	}
+	ru.Value = req
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler.
+func (ru ResponseUnion) MarshalJSON() ([]byte, error) {
+	if ru.Value == nil {
+		return []byte("null"), nil
+	}
+	method, ok := responseMethods[reflect.TypeOf(ru.Value)]
+	if !ok {
+		return nil, fmt.Errorf("unsupported response type %T", ru.Value)
+	}
+	value, err := json.Marshal(ru.Value)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(unionJSON{Method: method, Value: value})
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (ru *ResponseUnion) UnmarshalJSON(data []byte) error {
+	var enc *unionJSON
+	if err := json.Unmarshal(data, &enc); err != nil || enc == nil {
+		return err
+	}
+	newReq, ok := requestTypes[enc.Method]
+	if !ok {
+		return fmt.Errorf("unknown request method %d", enc.Method)
+	}
+	resp := CreateReply(newReq())
+	if err := json.Unmarshal(enc.Value, resp); err != nil {
+		return err
+	}
+	ru.Value = resp
+	return nil
+}
+
+// errorJSON is the encoding of Error. The Go error is sent as its message,
+// along with its detail, if any, tagged with the detail's type.
+type errorJSON struct {
+	Message      string
+	DetailType   ErrorDetailType `json:",omitempty"`
+	Detail       json.RawMessage `json:",omitempty"`
+	UnexposedTxn *roachpb.Transaction
+	Index        *ErrPosition
+	Now          hlc.ClockTimestamp
+}
+
+// MarshalJSON implements json.Marshaler.
+func (e *Error) MarshalJSON() ([]byte, error) {
+	enc := errorJSON{
+		Message:      e.String(),
+		UnexposedTxn: e.UnexposedTxn,
+		Index:        e.Index,
+		Now:          e.Now,
+	}
+	if e.detail != nil {
+		detail, err := json.Marshal(e.detail)
+		if err != nil {
+			return nil, err
+		}
+		enc.DetailType, enc.Detail = e.detail.Type(), detail
+	}
+	return json.Marshal(enc)
+}
+
+// UnmarshalJSON implements json.Unmarshaler. An error whose message is not
+// the one of its detail is decoded into an error which wraps the detail.
+func (e *Error) UnmarshalJSON(data []byte) error {
+	var enc errorJSON
+	if err := json.Unmarshal(data, &enc); err != nil {
+		return err
+	}
+	*e = Error{UnexposedTxn: enc.UnexposedTxn, Index: enc.Index, Now: enc.Now}
+	if enc.DetailType == 0 {
+		e.goError = errors.New(enc.Message)
+		return nil
+	}
+	newDetail, ok := errorDetailTypes[enc.DetailType]
+	if !ok {
+		return fmt.Errorf("unknown error detail type %d", enc.DetailType)
+	}
+	detail := newDetail()
+	if err := json.Unmarshal(enc.Detail, detail); err != nil {
+		return err
+	}
+	e.detail, e.goError = detail, detail
+	if detail.Error() != enc.Message {
+		e.goError = &wrappedDetailError{msg: enc.Message, detail: detail}
+	}
+	return nil
+}
+
+// wrappedDetailError is a decoded error which wrapped its detail.
+type wrappedDetailError struct {
+	msg    string
+	detail ErrorDetailInterface
+}
+
+func (e *wrappedDetailError) Error() string { return e.msg }
+
+// Unwrap returns the detail of the error.
+func (e *wrappedDetailError) Unwrap() error { return e.detail }
+
+// causeJSON is the encoding of the details which hold the error that caused
+// them. The cause is sent as its message.
+type causeJSON struct {
+	Cause string `json:",omitempty"`
+}
+
+func marshalCause(cause error) causeJSON {
+	if cause == nil {
+		return causeJSON{}
+	}
+	return causeJSON{Cause: cause.Error()}
+}
+
+func (c causeJSON) cause() error {
+	if c.Cause == "" {
+		return nil
+	}
+	return errors.New(c.Cause)
+}
+
+// MarshalJSON implements json.Marshaler.
+func (e *AmbiguousResultError) MarshalJSON() ([]byte, error) {
+	return json.Marshal(marshalCause(e.Cause))
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (e *AmbiguousResultError) UnmarshalJSON(data []byte) error {
+	var enc causeJSON
+	if err := json.Unmarshal(data, &enc); err != nil {
+		return err
+	}
+	e.Cause = enc.cause()
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler.
+func (e *ReplicaUnavailableError) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		RangeID roachpb.RangeID
+		Span    roachpb.Span
+		causeJSON
+	}{e.RangeID, e.Span, marshalCause(e.Cause)})
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (e *ReplicaUnavailableError) UnmarshalJSON(data []byte) error {
+	var enc struct {
+		RangeID roachpb.RangeID
+		Span    roachpb.Span
+		causeJSON
+	}
+	if err := json.Unmarshal(data, &enc); err != nil {
+		return err
+	}
+	e.RangeID, e.Span, e.Cause = enc.RangeID, enc.Span, enc.cause()
+	return nil
+}
@@ -0,0 +1,63 @@
+package kvpb
+
+import (
+	"errors"
+	"fmt"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/protoutil"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+// TestBatchMarshalRoundTrip verifies that batches, their responses and their
+// errors survive the encoding in which they are sent between nodes.
+func TestBatchMarshalRoundTrip(t *testing.T) {
+	ba := &BatchRequest{}
+	ba.RangeID = 3
+	ba.Now = hlc.ClockTimestamp{WallTime: 10, Logical: 1}
+	ba.Add(&PutRequest{
+		RequestHeader: RequestHeader{Key: roachpb.Key("a"), Sequence: 1},
+		Value:         roachpb.MakeValueFromString("1"),
+	})
+	ba.Add(&ScanRequest{RequestHeader: RequestHeader{Key: roachpb.Key("a"), EndKey: roachpb.Key("c")}})
+	data, err := protoutil.Marshal(ba)
+	require.NoError(t, err)
+	var decodedBA BatchRequest
+	require.NoError(t, protoutil.Unmarshal(data, &decodedBA))
+	require.Equal(t, ba, &decodedBA)
+
+	value := roachpb.MakeValueFromString("1")
+	br := &BatchResponse{}
+	br.Add(&GetResponse{Value: &value})
+	// TransferLease and RequestLease share their response.
+	br.Add(CreateReply(&TransferLeaseRequest{}))
+	data, err = protoutil.Marshal(br)
+	require.NoError(t, err)
+	var decodedBR BatchResponse
+	require.NoError(t, protoutil.Unmarshal(data, &decodedBR))
+	require.Equal(t, br, &decodedBR)
+
+	// Errors keep their message and their detail, even if the detail is
+	// wrapped or holds a cause.
+	for _, goErr := range []error{
+		errors.New("boom"),
+		NewRangeNotFoundError(3, 2),
+		fmt.Errorf("sending to r3: %w", NewRangeNotFoundError(3, 2)),
+		NewAmbiguousResultError(errors.New("context canceled")),
+	} {
+		pErr := NewError(goErr)
+		pErr.SetErrorIndex(1)
+		data, err := protoutil.Marshal(&BatchResponse{BatchResponse_Header: BatchResponse_Header{Error: pErr}})
+		require.NoError(t, err)
+		var decoded BatchResponse
+		require.NoError(t, protoutil.Unmarshal(data, &decoded))
+		require.Equal(t, goErr.Error(), decoded.Error.String())
+		require.Equal(t, pErr.Index, decoded.Error.Index)
+		require.Equal(t, pErr.GetDetail(), decoded.Error.GetDetail())
+		if detail := pErr.GetDetail(); detail != nil {
+			var rnf *RangeNotFoundError
+			require.Equal(t, errors.As(goErr, &rnf), errors.As(decoded.Error.GoError(), &rnf))
+		}
+	}
+}
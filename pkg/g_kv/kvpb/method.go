@@ -0,0 +1,98 @@
+package kvpb
+
+// Method is the enumerated type for methods.
+type Method int
+
+//go:generate stringer -type=Method
+const (
+	// Get fetches the value for a key from the KV map, respecting a
+	// possibly historical timestamp. If the timestamp is 0, returns
+	// the most recent value.
+	Get Method = iota
+	// Put sets the value for a key at the specified timestamp. If the
+	// timestamp is 0, the value is set with the current time as timestamp.
+	Put
+	// Delete creates a tombstone value for the specified key, indicating
+	// the value has been deleted.
+	Delete
+	// Scan fetches the values for all keys which fall between
+	// args.Key and args.EndKey, with the latest values up to the
+	// specified timestamp.
+	Scan
+	// EndTxn either commits or aborts an ongoing transaction.
+	EndTxn
+	// ResolveIntent resolves existing write intents for a key.
+	ResolveIntent
+	// RefreshRange verifies that no values were written to a key range
+	// between the timestamp from which it is refreshed and the transaction's
+	// read timestamp.
+	RefreshRange
+	// HeartbeatTxn sends a periodic heartbeat to extant
+	// transaction rows to indicate the client is still alive and
+	// the transaction should not be considered abandoned.
+	HeartbeatTxn
+	// PushTxn attempts to resolve read or write conflicts between
+	// transactions. Both the pusher (args.Txn) and the pushee
+	// (args.pushee_txn) must be supplied. However, args.Key should match
+	// args.PusheeTxn.ID. If the pushee is already committed or aborted,
+	// nothing happens. Otherwise, the push succeeds if the pushee's record
+	// has expired, or if the pusher's priority allows it to push the
+	// pushee; the pusher waits in the txnwait.Queue otherwise.
+	PushTxn
+	// QueryTxn fetches the current state of the designated transaction,
+	// along with the transactions that are waiting on it.
+	QueryTxn
+	// QueryIntent checks whether the specified intent exists.
+	QueryIntent
+	// RecoverTxn attempts to recover an abandoned STAGING transaction. It
+	// specifies whether all of the abandoned transaction's in-flight writes
+	// succeeded or whether any failed. This is used to determine whether the
+	// result of the recovery should be committing the abandoned transaction
+	// or aborting it.
+	RecoverTxn
+	// TruncateLog discards a prefix of the raft log.
+	TruncateLog
+	// RequestLease requests a range lease for a replica.
+	RequestLease
+	// TransferLease transfers the range lease from a lease holder to a new one.
+	TransferLease
+	// AdminSplit is called to coordinate a split of a range.
+	AdminSplit
+	// AdminMerge is called to coordinate a merge of two adjacent ranges.
+	AdminMerge
+	// AdminChangeReplicas is called to add or remove replicas for a range.
+	AdminChangeReplicas
+	// AdminTransferLease is called to initiate a range lease transfer to a
+	// specific range replica.
+	AdminTransferLease
+)
+
+var methodNames = map[Method]string{
+	Get:           "Get",
+	Put:           "Put",
+	Delete:        "Delete",
+	Scan:          "Scan",
+	EndTxn:        "EndTxn",
+	ResolveIntent: "ResolveIntent",
+	RefreshRange:  "RefreshRange",
+	HeartbeatTxn:  "HeartbeatTxn",
+	PushTxn:       "PushTxn",
+	QueryTxn:      "QueryTxn",
+	QueryIntent:   "QueryIntent",
+	RecoverTxn:    "RecoverTxn",
+	TruncateLog:   "TruncateLog",
+	RequestLease:  "RequestLease",
+	TransferLease: "TransferLease",
+	AdminSplit:    "AdminSplit",
+	AdminMerge:    "AdminMerge",
+
+	AdminChangeReplicas: "AdminChangeReplicas",
+	AdminTransferLease:  "AdminTransferLease",
+}
+
+func (m Method) String() string {
+	if s, ok := methodNames[m]; ok {
+		return s
+	}
+	return "Method(?)"
+}
@@ -0,0 +1,420 @@
+package kvpb
+
+import "github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/concurrency/lock"
+
+// Request is an interface for RPC requests.
+type Request interface {
+	// Header returns the request header.
+	Header() RequestHeader
+	// SetHeader sets the request header.
+	SetHeader(RequestHeader)
+	// Method returns the request method.
+	Method() Method
+	// ShallowCopy returns a shallow copy of the receiver.
+	ShallowCopy() Request
+	flags() flag
+}
+
+// Response is an interface for RPC responses.
+type Response interface {
+	// Header returns the response header.
+	Header() ResponseHeader
+	// SetHeader sets the response header.
+	SetHeader(ResponseHeader)
+}
+
+type flag int
+
+const (
+	isRead          flag = 1 << iota // read-only cmds don't go through raft, but may run on lease holder
+	isWrite                          // write cmds go through raft and must be proposed on lease holder
+	isTxn                            // txn commands may be part of a transaction
+	isLocking                        // locking cmds acquire locks for their transaction
+	isIntentWrite                    // intent write cmds leave intents when they succeed
+	isRange                          // range commands may span multiple keys
+	isAdmin                          // admin cmds don't go through raft, but run on lease holder
+	isAlone                          // requests which must be alone in a batch
+	updatesTSCache                   // commands which update the timestamp cache
+	appliesTSCache                   // commands which apply the timestamp cache and closed timestamp
+	skipsLeaseCheck                  // commands which skip the check that the evaluating replica has a valid lease
+)
+
+// IsReadOnly returns true iff the request is read-only. A request is
+// read-only if it does not go through raft, meaning that it cannot
+// change any replicated state. However, read-only requests may still
+// acquire locks with an unreplicated durability level; see IsLocking.
+func IsReadOnly(args Request) bool {
+	flags := args.flags()
+	return (flags&isRead) != 0 && (flags&isWrite) == 0
+}
+
+// IsAdmin returns true if the request is an admin request.
+func IsAdmin(args Request) bool {
+	return (args.flags() & isAdmin) != 0
+}
+
+// IsLocking returns true if the request acquires locks when used within
+// a transaction.
+func IsLocking(args Request) bool {
+	return (args.flags() & isLocking) != 0
+}
+
+// IsIntentWrite returns true if the request produces write intents at
+// the request's sequence number when used within a transaction.
+func IsIntentWrite(args Request) bool {
+	return (args.flags() & isIntentWrite) != 0
+}
+
+// IsRange returns true if the command is range-based and must include
+// a start and an end key.
+func IsRange(args Request) bool {
+	return (args.flags() & isRange) != 0
+}
+
+// IsTransactional returns true if the request may be part of a
+// transaction.
+func IsTransactional(args Request) bool {
+	return (args.flags() & isTxn) != 0
+}
+
+// UpdatesTimestampCache returns whether the request must update
+// the timestamp cache upon evaluation.
+func UpdatesTimestampCache(args Request) bool {
+	return (args.flags() & updatesTSCache) != 0
+}
+
+// AppliesTimestampCache returns whether the command is a write that
+// applies the timestamp cache, possibly pushing its write timestamp
+// forward.
+func AppliesTimestampCache(args Request) bool {
+	return (args.flags() & appliesTSCache) != 0
+}
+
+// SkipsLeaseCheck returns whether the request skips the check that the
+// evaluating replica holds a valid lease: the lease requests themselves, which
+// check the lease on their own.
+func SkipsLeaseCheck(args Request) bool {
+	return (args.flags() & skipsLeaseCheck) != 0
+}
+
+// Header implements the Request interface.
+func (rh RequestHeader) Header() RequestHeader {
+	return rh
+}
+
+// SetHeader implements the Request interface.
+func (rh *RequestHeader) SetHeader(other RequestHeader) {
+	*rh = other
+}
+
+// Header implements the Response interface for ResponseHeader.
+func (rh ResponseHeader) Header() ResponseHeader {
+	return rh
+}
+
+// SetHeader implements the Response interface.
+func (rh *ResponseHeader) SetHeader(other ResponseHeader) {
+	*rh = other
+}
+
+// Method implements the Request interface.
+func (*GetRequest) Method() Method { return Get }
+
+// Method implements the Request interface.
+func (*PutRequest) Method() Method { return Put }
+
+// Method implements the Request interface.
+func (*DeleteRequest) Method() Method { return Delete }
+
+// Method implements the Request interface.
+func (*ScanRequest) Method() Method { return Scan }
+
+// Method implements the Request interface.
+func (*EndTxnRequest) Method() Method { return EndTxn }
+
+// Method implements the Request interface.
+func (*ResolveIntentRequest) Method() Method { return ResolveIntent }
+
+// Method implements the Request interface.
+func (*RefreshRangeRequest) Method() Method { return RefreshRange }
+
+// Method implements the Request interface.
+func (*HeartbeatTxnRequest) Method() Method { return HeartbeatTxn }
+
+// Method implements the Request interface.
+func (*PushTxnRequest) Method() Method { return PushTxn }
+
+// Method implements the Request interface.
+func (*QueryTxnRequest) Method() Method { return QueryTxn }
+
+// Method implements the Request interface.
+func (*QueryIntentRequest) Method() Method { return QueryIntent }
+
+// Method implements the Request interface.
+func (*RecoverTxnRequest) Method() Method { return RecoverTxn }
+
+// Method implements the Request interface.
+func (*TruncateLogRequest) Method() Method { return TruncateLog }
+
+// Method implements the Request interface.
+func (*RequestLeaseRequest) Method() Method { return RequestLease }
+
+// Method implements the Request interface.
+func (*TransferLeaseRequest) Method() Method { return TransferLease }
+
+// Method implements the Request interface.
+func (*AdminSplitRequest) Method() Method { return AdminSplit }
+
+// Method implements the Request interface.
+func (*AdminMergeRequest) Method() Method { return AdminMerge }
+
+// Method implements the Request interface.
+func (*AdminChangeReplicasRequest) Method() Method { return AdminChangeReplicas }
+
+// Method implements the Request interface.
+func (*AdminTransferLeaseRequest) Method() Method { return AdminTransferLease }
+
+// ShallowCopy implements the Request interface.
+func (gr *GetRequest) ShallowCopy() Request {
+	shallowCopy := *gr
+	return &shallowCopy
+}
+
+// ShallowCopy implements the Request interface.
+func (pr *PutRequest) ShallowCopy() Request {
+	shallowCopy := *pr
+	return &shallowCopy
+}
+
+// ShallowCopy implements the Request interface.
+func (dr *DeleteRequest) ShallowCopy() Request {
+	shallowCopy := *dr
+	return &shallowCopy
+}
+
+// ShallowCopy implements the Request interface.
+func (sr *ScanRequest) ShallowCopy() Request {
+	shallowCopy := *sr
+	return &shallowCopy
+}
+
+// ShallowCopy implements the Request interface.
+func (etr *EndTxnRequest) ShallowCopy() Request {
+	shallowCopy := *etr
+	return &shallowCopy
+}
+
+// ShallowCopy implements the Request interface.
+func (rir *ResolveIntentRequest) ShallowCopy() Request {
+	shallowCopy := *rir
+	return &shallowCopy
+}
+
+// ShallowCopy implements the Request interface.
+func (rrr *RefreshRangeRequest) ShallowCopy() Request {
+	shallowCopy := *rrr
+	return &shallowCopy
+}
+
+// ShallowCopy implements the Request interface.
+func (htr *HeartbeatTxnRequest) ShallowCopy() Request {
+	shallowCopy := *htr
+	return &shallowCopy
+}
+
+// ShallowCopy implements the Request interface.
+func (ptr *PushTxnRequest) ShallowCopy() Request {
+	shallowCopy := *ptr
+	return &shallowCopy
+}
+
+// ShallowCopy implements the Request interface.
+func (qtr *QueryTxnRequest) ShallowCopy() Request {
+	shallowCopy := *qtr
+	return &shallowCopy
+}
+
+// ShallowCopy implements the Request interface.
+func (qir *QueryIntentRequest) ShallowCopy() Request {
+	shallowCopy := *qir
+	return &shallowCopy
+}
+
+// ShallowCopy implements the Request interface.
+func (rtr *RecoverTxnRequest) ShallowCopy() Request {
+	shallowCopy := *rtr
+	return &shallowCopy
+}
+
+// ShallowCopy implements the Request interface.
+func (tlr *TruncateLogRequest) ShallowCopy() Request {
+	shallowCopy := *tlr
+	return &shallowCopy
+}
+
+// ShallowCopy implements the Request interface.
+func (rlr *RequestLeaseRequest) ShallowCopy() Request {
+	shallowCopy := *rlr
+	return &shallowCopy
+}
+
+// ShallowCopy implements the Request interface.
+func (tlr *TransferLeaseRequest) ShallowCopy() Request {
+	shallowCopy := *tlr
+	return &shallowCopy
+}
+
+// ShallowCopy implements the Request interface.
+func (asr *AdminSplitRequest) ShallowCopy() Request {
+	shallowCopy := *asr
+	return &shallowCopy
+}
+
+// ShallowCopy implements the Request interface.
+func (amr *AdminMergeRequest) ShallowCopy() Request {
+	shallowCopy := *amr
+	return &shallowCopy
+}
+
+// ShallowCopy implements the Request interface.
+func (acrr *AdminChangeReplicasRequest) ShallowCopy() Request {
+	shallowCopy := *acrr
+	return &shallowCopy
+}
+
+// ShallowCopy implements the Request interface.
+func (atlr *AdminTransferLeaseRequest) ShallowCopy() Request {
+	shallowCopy := *atlr
+	return &shallowCopy
+}
+
+func (gr *GetRequest) flags() flag {
+	maybeLocking := flagForLockStrength(gr.KeyLockingStrength)
+	return isRead | isTxn | updatesTSCache | maybeLocking
+}
+func (sr *ScanRequest) flags() flag {
+	maybeLocking := flagForLockStrength(sr.KeyLockingStrength)
+	return isRead | isRange | isTxn | updatesTSCache | maybeLocking
+}
+
+// flagForLockStrength returns isLocking if the provided lock strength
+// acquires locks, and no flag otherwise.
+func flagForLockStrength(l lock.Strength) flag {
+	if l != lock.None {
+		return isLocking
+	}
+	return 0
+}
+
+func (*PutRequest) flags() flag {
+	return isWrite | isTxn | isLocking | isIntentWrite | appliesTSCache
+}
+func (*DeleteRequest) flags() flag {
+	return isWrite | isTxn | isLocking | isIntentWrite | appliesTSCache
+}
+func (*EndTxnRequest) flags() flag        { return isWrite | isTxn | isAlone }
+func (*ResolveIntentRequest) flags() flag { return isWrite }
+func (*RefreshRangeRequest) flags() flag  { return isRead | isTxn | isRange | updatesTSCache }
+func (*HeartbeatTxnRequest) flags() flag  { return isWrite | isTxn }
+func (*PushTxnRequest) flags() flag       { return isWrite }
+func (*QueryTxnRequest) flags() flag      { return isRead }
+func (*QueryIntentRequest) flags() flag   { return isRead | updatesTSCache }
+func (*RecoverTxnRequest) flags() flag    { return isWrite }
+func (*TruncateLogRequest) flags() flag   { return isWrite }
+func (*RequestLeaseRequest) flags() flag {
+	return isWrite | isAlone | skipsLeaseCheck
+}
+func (*TransferLeaseRequest) flags() flag {
+	return isWrite | isAlone | skipsLeaseCheck
+}
+func (*AdminSplitRequest) flags() flag { return isAdmin | isAlone }
+func (*AdminMergeRequest) flags() flag { return isAdmin | isAlone }
+func (*AdminChangeReplicasRequest) flags() flag {
+	return isAdmin | isAlone
+}
+func (*AdminTransferLeaseRequest) flags() flag { return isAdmin | isAlone }
+
+// CreateReply creates a new response object for the given request.
+func CreateReply(req Request) Response {
+	switch req.(type) {
+	case *GetRequest:
+		return &GetResponse{}
+	case *PutRequest:
+		return &PutResponse{}
+	case *DeleteRequest:
+		return &DeleteResponse{}
+	case *ScanRequest:
+		return &ScanResponse{}
+	case *EndTxnRequest:
+		return &EndTxnResponse{}
+	case *ResolveIntentRequest:
+		return &ResolveIntentResponse{}
+	case *RefreshRangeRequest:
+		return &RefreshRangeResponse{}
+	case *HeartbeatTxnRequest:
+		return &HeartbeatTxnResponse{}
+	case *PushTxnRequest:
+		return &PushTxnResponse{}
+	case *QueryTxnRequest:
+		return &QueryTxnResponse{}
+	case *QueryIntentRequest:
+		return &QueryIntentResponse{}
+	case *RecoverTxnRequest:
+		return &RecoverTxnResponse{}
+	case *TruncateLogRequest:
+		return &TruncateLogResponse{}
+	case *RequestLeaseRequest:
+		return &RequestLeaseResponse{}
+	case *TransferLeaseRequest:
+		return &RequestLeaseResponse{}
+	case *AdminSplitRequest:
+		return &AdminSplitResponse{}
+	case *AdminMergeRequest:
+		return &AdminMergeResponse{}
+	case *AdminChangeReplicasRequest:
+		return &AdminChangeReplicasResponse{}
+	case *AdminTransferLeaseRequest:
+		return &AdminTransferLeaseResponse{}
+	default:
+		panic("unsupported request: " + req.Method().String())
+	}
+}
+
+// RequestUnion wraps a single Request; it mirrors the oneof used on the wire.
+type RequestUnion struct {
+	Value Request
+}
+
+// GetInner returns the Request contained in the union.
+func (ru RequestUnion) GetInner() Request {
+	return ru.Value
+}
+
+// MustSetInner sets the Request contained in the union. It panics if the
+// request is nil.
+func (ru *RequestUnion) MustSetInner(r Request) {
+	if r == nil {
+		panic("nil request")
+	}
+	ru.Value = r
+}
+
+// ResponseUnion wraps a single Response; it mirrors the oneof used on the
+// wire.
+type ResponseUnion struct {
+	Value Response
+}
+
+// GetInner returns the Response contained in the union.
+func (ru ResponseUnion) GetInner() Response {
+	return ru.Value
+}
+
+// MustSetInner sets the Response contained in the union. It panics if the
+// response is nil.
+func (ru *ResponseUnion) MustSetInner(r Response) {
+	if r == nil {
+		panic("nil response")
+	}
+	ru.Value = r
+}
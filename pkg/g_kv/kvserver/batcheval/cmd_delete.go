@@ -0,0 +1,28 @@
+package batcheval
+
+import (
+	"context"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/batcheval/result"
+	storage "github.com/dborchard/tiny_crdb/pkg/h_storage"
+)
+
+func init() {
+	RegisterReadWriteCommand(kvpb.Delete, DefaultDeclareIsolatedKeys, Delete)
+}
+
+// Delete deletes the key and value specified by key.
+func Delete(
+	ctx context.Context, readWriter storage.ReadWriter, cArgs CommandArgs, resp kvpb.Response,
+) (result.Result, error) {
+	args := cArgs.Args.(*kvpb.DeleteRequest)
+	h := cArgs.Header
+	reply := resp.(*kvpb.DeleteResponse)
+
+	opts := storage.MVCCWriteOptions{
+		Txn: h.Txn,
+	}
+	var err error
+	reply.FoundKey, err = storage.MVCCDelete(ctx, readWriter, args.Key, h.Timestamp, opts)
+	return result.Result{}, err
+}
@@ -0,0 +1,335 @@
+package batcheval
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	keys "github.com/dborchard/tiny_crdb/pkg/g_keys"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/batcheval/result"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/kvserverpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/lockspanset"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/spanset"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	storage "github.com/dborchard/tiny_crdb/pkg/h_storage"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+)
+
+func init() {
+	RegisterReadWriteCommand(kvpb.EndTxn, declareKeysEndTxn, EndTxn)
+}
+
+func declareKeysEndTxn(
+	header *kvpb.Header,
+	req kvpb.Request,
+	latchSpans *spanset.SpanSet,
+	_ *lockspanset.LockSpanSet,
+) {
+	et := req.(*kvpb.EndTxnRequest)
+	// The transaction record is written on the range holding the
+	// transaction's anchor key.
+	if header.Txn != nil {
+		latchSpans.AddNonMVCC(spanset.SpanReadWrite, roachpb.Span{Key: keys.TransactionKey(header.Txn.Key, header.Txn.ID)})
+	}
+	// The transaction's locks are resolved synchronously, so latch them to
+	// keep concurrent readers and writers out while they are updated.
+	for _, span := range et.LockSpans {
+		latchSpans.AddNonMVCC(spanset.SpanReadWrite, span)
+	}
+	if st := et.InternalCommitTrigger.GetSplitTrigger(); st != nil {
+		// The split computes the stats of the right-hand side from its data,
+		// and creates its range-local state. Keep writers out of the
+		// right-hand side until the split has applied.
+		latchSpans.AddNonMVCC(spanset.SpanReadOnly, roachpb.Span{
+			Key:    st.RightDesc.StartKey.AsRawKey(),
+			EndKey: st.RightDesc.EndKey.AsRawKey(),
+		})
+		latchSpans.AddNonMVCC(spanset.SpanReadWrite, roachpb.Span{
+			Key:    keys.MakeRangeKeyPrefix(st.RightDesc.StartKey),
+			EndKey: keys.MakeRangeKeyPrefix(st.RightDesc.EndKey),
+		})
+	}
+}
+
+// ErrTransactionUnsupported is returned when a non-transactional command is
+// evaluated in the context of a transaction.
+var ErrTransactionUnsupported = errors.New("not supported within a transaction")
+
+// EndTxn either commits or aborts (rolls back) an extant transaction according
+// to the args.Commit parameter. Rolling back an already rolled-back txn is ok.
+//
+// The transaction's locks are resolved synchronously as part of the
+// evaluation, according to the final status of the transaction. This
+// requires all of the lock spans to be local to the evaluating engine.
+// The finalized transaction record is written alongside.
+//
+// If the request declares in-flight writes, it performs a parallel commit:
+// the transaction record is moved to the STAGING state along with the set of
+// in-flight writes, and no locks are resolved. The transaction is implicitly
+// committed once all of its in-flight writes have succeeded; its coordinator
+// then makes the commit explicit with a second EndTxn, and anyone else who
+// finds the STAGING record abandoned can recover it (see txnrecovery).
+//
+// Only the locks held on the range are resolved synchronously; those held on
+// other ranges are resolved asynchronously once the request has applied. A
+// committed EndTxn may carry an internal commit trigger, which splits or
+// merges the range when the commit applies.
+func EndTxn(
+	ctx context.Context, readWriter storage.ReadWriter, cArgs CommandArgs, resp kvpb.Response,
+) (result.Result, error) {
+	args := cArgs.Args.(*kvpb.EndTxnRequest)
+	h := cArgs.Header
+	reply := resp.(*kvpb.EndTxnResponse)
+
+	if h.Txn == nil {
+		return result.Result{}, errors.New("EndTxn must be run within a transaction")
+	}
+	if h.Txn.Status.IsFinalized() {
+		return result.Result{}, fmt.Errorf("cannot end transaction in status %s", h.Txn.Status)
+	}
+	reply.Txn = h.Txn.Clone()
+
+	// Fetch existing transaction record, if any. It may have been updated by
+	// concurrent pushers since the coordinator last heard of it.
+	existing, ok, err := readTxnRecord(ctx, readWriter, h.Txn.TxnMeta)
+	if err != nil {
+		return result.Result{}, err
+	}
+	if ok {
+		switch existing.Status {
+		case roachpb.ABORTED:
+			if args.Commit {
+				// The transaction was aborted by a pusher. Its locks are
+				// cleaned up by the rollback that the coordinator issues
+				// upon receiving this error.
+				return result.Result{}, kvpb.NewTransactionAbortedError(kvpb.ABORT_REASON_ABORTED_RECORD_FOUND)
+			}
+		case roachpb.COMMITTED:
+			return result.Result{}, fmt.Errorf("transaction %s already committed", existing.Short())
+		case roachpb.STAGING:
+			// The record was staged by a parallel commit. The coordinator may
+			// make the commit explicit, stage the record again in a later
+			// epoch, or roll the transaction back if the parallel commit
+			// failed.
+		}
+		// A pusher may have moved the transaction's commit timestamp forward.
+		reply.Txn.WriteTimestamp.Forward(existing.WriteTimestamp)
+		reply.Txn.LastHeartbeat.Forward(existing.LastHeartbeat)
+	}
+
+	if args.Commit {
+		if IsEndTxnExceedingDeadline(reply.Txn.WriteTimestamp, args.Deadline) {
+			return result.Result{}, kvpb.NewTxnDeadlineExceededErr(reply.Txn, args.Deadline)
+		}
+		if retry, reason, extraMsg := IsEndTxnTriggeringRetryError(reply.Txn); retry {
+			return result.Result{}, kvpb.NewTransactionRetryError(reason, extraMsg)
+		}
+		if args.IsParallelCommit() {
+			if args.InternalCommitTrigger != nil {
+				return result.Result{}, errors.New("cannot perform a parallel commit with a commit trigger")
+			}
+			// Stage the transaction record. Its locks are resolved once the
+			// commit is made explicit.
+			reply.Txn.Status = roachpb.STAGING
+			record := *reply.Txn
+			record.LockSpans = args.LockSpans
+			record.InFlightWrites = args.InFlightWrites
+			if err := writeTxnRecord(ctx, readWriter, &record); err != nil {
+				return result.Result{}, err
+			}
+			return result.Result{}, nil
+		}
+		reply.Txn.Status = roachpb.COMMITTED
+	} else {
+		reply.Txn.Status = roachpb.ABORTED
+	}
+
+	desc := cArgs.EvalCtx.Desc()
+	if mt := args.InternalCommitTrigger.GetMergeTrigger(); mt != nil && args.Commit {
+		// The locks held on the subsumed range are local to the merged range.
+		desc = &mt.LeftDesc
+	}
+	resolvedLocks, externalLocks, err := resolveLocalLocks(ctx, desc, readWriter, args.LockSpans, reply.Txn)
+	if err != nil {
+		return result.Result{}, err
+	}
+
+	// Persist the finalized transaction record, so that concurrent pushers
+	// and the transaction's own heartbeats observe its final status.
+	if err := writeTxnRecord(ctx, readWriter, reply.Txn); err != nil {
+		return result.Result{}, err
+	}
+
+	res := result.Result{
+		Local: result.LocalResult{
+			ResolvedLocks: resolvedLocks,
+			UpdatedTxns:   []*roachpb.Transaction{reply.Txn},
+			ExternalLocks: externalLocks,
+		},
+	}
+	if args.Commit && args.InternalCommitTrigger != nil {
+		if err := runCommitTrigger(cArgs.EvalCtx.Desc(), args.InternalCommitTrigger, &res); err != nil {
+			return result.Result{}, err
+		}
+	}
+	return res, nil
+}
+
+// runCommitTrigger validates the internal commit trigger of a committing
+// transaction against the range's descriptor, and records it in the result,
+// so that the range is split or merged, or its replicas are changed, when the
+// commit applies.
+func runCommitTrigger(
+	desc *roachpb.RangeDescriptor, ct *roachpb.InternalCommitTrigger, res *result.Result,
+) error {
+	if st := ct.GetSplitTrigger(); st != nil {
+		if st.LeftDesc.RangeID != desc.RangeID ||
+			!st.LeftDesc.StartKey.Equal(desc.StartKey) ||
+			!st.LeftDesc.EndKey.Equal(st.RightDesc.StartKey) ||
+			!st.RightDesc.EndKey.Equal(desc.EndKey) {
+			return fmt.Errorf("split trigger [%s, %s] does not match range %s",
+				&st.LeftDesc, &st.RightDesc, desc)
+		}
+		res.Replicated.Split = st
+		return nil
+	}
+	if mt := ct.GetMergeTrigger(); mt != nil {
+		if mt.LeftDesc.RangeID != desc.RangeID ||
+			!mt.LeftDesc.StartKey.Equal(desc.StartKey) ||
+			!mt.RightDesc.StartKey.Equal(desc.EndKey) ||
+			!mt.LeftDesc.EndKey.Equal(mt.RightDesc.EndKey) {
+			return fmt.Errorf("merge trigger [%s, %s] does not match range %s",
+				&mt.LeftDesc, &mt.RightDesc, desc)
+		}
+		res.Replicated.Merge = &kvserverpb.Merge{MergeTrigger: *mt}
+		return nil
+	}
+	if crt := ct.GetChangeReplicasTrigger(); crt != nil {
+		if crt.Desc == nil || crt.Desc.RangeID != desc.RangeID ||
+			!crt.Desc.StartKey.Equal(desc.StartKey) || !crt.Desc.EndKey.Equal(desc.EndKey) {
+			return fmt.Errorf("change replicas trigger %s does not match range %s", crt.Desc, desc)
+		}
+		res.Replicated.ChangeReplicas = crt
+		return nil
+	}
+	return errors.New("unknown commit trigger")
+}
+
+// IsEndTxnExceedingDeadline returns true if the transaction's provisional
+// commit timestamp exceeded its deadline. If so, the transaction should not be
+// allowed to commit.
+func IsEndTxnExceedingDeadline(commitTS hlc.Timestamp, deadline hlc.Timestamp) bool {
+	return !deadline.IsEmpty() && deadline.LessEq(commitTS)
+}
+
+// IsEndTxnTriggeringRetryError returns true if the EndTxnRequest cannot be
+// committed and needs to return a TransactionRetryError. It also returns the
+// reason and possibly an extra message to be used for the error.
+func IsEndTxnTriggeringRetryError(
+	txn *roachpb.Transaction,
+) (retry bool, reason kvpb.TransactionRetryReason, extraMsg string) {
+	// If the isolation level allows for write skew, the transaction may commit
+	// at a timestamp above the timestamp at which it read.
+	if txn.IsoLevel.ToleratesWriteSkew() {
+		return false, 0, ""
+	}
+	// A serializable transaction can only commit at the timestamp at which it
+	// performed its reads.
+	if txn.WriteTimestamp != txn.ReadTimestamp {
+		return true, kvpb.RETRY_SERIALIZABLE, ""
+	}
+	return false, 0, ""
+}
+
+// resolveLocalLocks synchronously resolves the locks in the provided lock
+// spans which are held on the range described by desc, according to the
+// status of the finalized transaction. An update is returned for every such
+// lock span, whether or not an intent was found there, so that unreplicated
+// locks held in the lock table are released as well. The updates for the
+// locks held outside of the range are returned separately, to be resolved
+// through the ranges which hold them.
+//
+// A ranged lock span, such as that of a locking scan, may be held partly on
+// the range and partly outside of it, in which case it is split.
+func resolveLocalLocks(
+	ctx context.Context,
+	desc *roachpb.RangeDescriptor,
+	readWriter storage.ReadWriter,
+	lockSpans []roachpb.Span,
+	txn *roachpb.Transaction,
+) (resolved, external []roachpb.LockUpdate, _ error) {
+	for _, span := range lockSpans {
+		if len(span.EndKey) > 0 {
+			local, ext, err := splitLockSpan(desc, span)
+			if err != nil {
+				return nil, nil, err
+			}
+			for _, sp := range ext {
+				external = append(external, roachpb.MakeLockUpdate(txn, sp))
+			}
+			if local == nil {
+				continue
+			}
+			update := roachpb.MakeLockUpdate(txn, *local)
+			if _, err := storage.MVCCResolveWriteIntentRange(ctx, readWriter, update); err != nil {
+				return nil, nil, err
+			}
+			resolved = append(resolved, update)
+			continue
+		}
+		update := roachpb.MakeLockUpdate(txn, span)
+		addr, err := keys.Addr(span.Key)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !desc.ContainsKey(addr) {
+			external = append(external, update)
+			continue
+		}
+		if _, err := storage.MVCCResolveWriteIntent(ctx, readWriter, update); err != nil {
+			return nil, nil, err
+		}
+		resolved = append(resolved, update)
+	}
+	return resolved, external, nil
+}
+
+// splitLockSpan splits a ranged lock span into its part held on the range
+// described by desc, if any, and its parts held outside of it.
+func splitLockSpan(
+	desc *roachpb.RangeDescriptor, span roachpb.Span,
+) (local *roachpb.Span, external []roachpb.Span, _ error) {
+	rspan, err := keys.SpanAddr(span)
+	if err != nil {
+		return nil, nil, err
+	}
+	if rspan.Key.Less(desc.StartKey) {
+		external = append(external, roachpb.Span{
+			Key: span.Key, EndKey: roachpb.Key(minRKey(rspan.EndKey, desc.StartKey)),
+		})
+	}
+	if desc.EndKey.Less(rspan.EndKey) {
+		external = append(external, roachpb.Span{
+			Key: roachpb.Key(maxRKey(rspan.Key, desc.EndKey)), EndKey: span.EndKey,
+		})
+	}
+	if in, ok := rspan.Intersect(desc.RSpan()); ok {
+		sp := in.AsRawSpanWithNoLocals()
+		local = &sp
+	}
+	return local, external, nil
+}
+
+func minRKey(a, b roachpb.RKey) roachpb.RKey {
+	if a.Less(b) {
+		return a
+	}
+	return b
+}
+
+func maxRKey(a, b roachpb.RKey) roachpb.RKey {
+	if a.Less(b) {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,44 @@
+package batcheval
+
+import (
+	"context"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/batcheval/result"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/concurrency/lock"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	storage "github.com/dborchard/tiny_crdb/pkg/h_storage"
+)
+
+func init() {
+	RegisterReadOnlyCommand(kvpb.Get, DefaultDeclareIsolatedKeys, Get)
+}
+
+// Get returns the value for a specified key. If the request has a locking
+// strength and the key exists, an unreplicated lock is acquired on the key.
+func Get(
+	ctx context.Context, reader storage.Reader, cArgs CommandArgs, resp kvpb.Response,
+) (result.Result, error) {
+	args := cArgs.Args.(*kvpb.GetRequest)
+	h := cArgs.Header
+	reply := resp.(*kvpb.GetResponse)
+
+	getRes, err := storage.MVCCGet(ctx, reader, args.Key, h.Timestamp, storage.MVCCGetOptions{
+		Txn:                h.Txn,
+		KeyLockingStrength: args.KeyLockingStrength,
+		SkipLocked:         h.WaitPolicy == lock.SkipLocked,
+		LockTable:          cArgs.Concurrency,
+	})
+	if err != nil {
+		return result.Result{}, err
+	}
+	if getRes.Value != nil {
+		reply.NumKeys = 1
+	}
+	reply.Value = getRes.Value
+
+	if args.KeyLockingStrength != lock.None && h.Txn != nil && getRes.Value != nil {
+		acq := roachpb.MakeLockAcquisition(&h.Txn.TxnMeta, args.Key, lock.Unreplicated, args.KeyLockingStrength)
+		return result.WithAcquiredLocks(acq), nil
+	}
+	return result.Result{}, nil
+}
@@ -0,0 +1,76 @@
+package batcheval
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/batcheval/result"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/lockspanset"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/spanset"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	storage "github.com/dborchard/tiny_crdb/pkg/h_storage"
+)
+
+func init() {
+	RegisterReadWriteCommand(kvpb.HeartbeatTxn, declareKeysHeartbeatTransaction, HeartbeatTxn)
+}
+
+func declareKeysHeartbeatTransaction(
+	header *kvpb.Header,
+	req kvpb.Request,
+	latchSpans *spanset.SpanSet,
+	_ *lockspanset.LockSpanSet,
+) {
+	declareKeysWriteTransaction(header, req, latchSpans)
+}
+
+// HeartbeatTxn updates the transaction status and heartbeat
+// timestamp after receiving transaction heartbeat messages from
+// coordinator. The transaction record is created if it does not exist
+// yet. Returns the updated transaction.
+func HeartbeatTxn(
+	ctx context.Context, readWriter storage.ReadWriter, cArgs CommandArgs, resp kvpb.Response,
+) (result.Result, error) {
+	args := cArgs.Args.(*kvpb.HeartbeatTxnRequest)
+	h := cArgs.Header
+	reply := resp.(*kvpb.HeartbeatTxnResponse)
+
+	if h.Txn == nil {
+		return result.Result{}, errors.New("HeartbeatTxn must be run within a transaction")
+	}
+	if args.Now.IsEmpty() {
+		return result.Result{}, fmt.Errorf("now not specified for heartbeat")
+	}
+
+	txn, ok, err := readTxnRecord(ctx, readWriter, h.Txn.TxnMeta)
+	if err != nil {
+		return result.Result{}, err
+	}
+	if !ok {
+		// No existing transaction record was found. Create the record from the
+		// coordinator's view of the transaction.
+		txn = *h.Txn.Clone()
+		txn.Status = roachpb.PENDING
+		txn.LockSpans = nil
+	}
+
+	switch txn.Status {
+	case roachpb.ABORTED:
+		// The transaction was aborted, for instance by a concurrent pusher.
+		// The coordinator finds out through its heartbeat.
+		return result.Result{}, kvpb.NewTransactionAbortedError(kvpb.ABORT_REASON_ABORTED_RECORD_FOUND)
+	case roachpb.COMMITTED:
+		return result.Result{}, fmt.Errorf("cannot heartbeat txn %s in status %s", txn.Short(), txn.Status)
+	}
+
+	txn.LastHeartbeat.Forward(args.Now)
+	if err := writeTxnRecord(ctx, readWriter, &txn); err != nil {
+		return result.Result{}, err
+	}
+
+	reply.Txn = &txn
+	return result.Result{
+		Local: result.LocalResult{UpdatedTxns: []*roachpb.Transaction{&txn}},
+	}, nil
+}
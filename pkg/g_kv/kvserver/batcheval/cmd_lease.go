@@ -0,0 +1,81 @@
+package batcheval
+
+import (
+	"context"
+	"fmt"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/batcheval/result"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/stateloader"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	storage "github.com/dborchard/tiny_crdb/pkg/h_storage"
+)
+
+// checkCanReceiveLease checks whether the replica of the range named by the
+// lease can hold it: it must be a voter of the range.
+func checkCanReceiveLease(lease roachpb.Lease, desc *roachpb.RangeDescriptor) error {
+	repDesc, ok := desc.GetReplicaDescriptorByID(lease.Replica.ReplicaID)
+	if !ok || repDesc.StoreID != lease.Replica.StoreID {
+		return fmt.Errorf("replica %s not found in %s", lease.Replica, desc)
+	}
+	if repDesc.Type != roachpb.VOTER_FULL {
+		return fmt.Errorf("replica %s of type %s cannot hold lease", repDesc, repDesc.Type)
+	}
+	return nil
+}
+
+// evalNewLease checks that the lease contains a valid interval and that the
+// new lease holder is still a member of the replica set, and then proceeds
+// to write the new lease to the batch, emitting an appropriate trigger.
+//
+// The new lease might be a lease for a range that didn't previously have an
+// active lease, might be an extension or a lease transfer.
+func evalNewLease(
+	ctx context.Context,
+	rec EvalContext,
+	readWriter storage.ReadWriter,
+	lease roachpb.Lease,
+	prevLease roachpb.Lease,
+) (result.Result, error) {
+	// Ensure either an Epoch is set or Start < Expiration.
+	if (lease.Type() == roachpb.LeaseExpiration && lease.GetExpiration().LessEq(lease.Start.ToTimestamp())) ||
+		(lease.Type() == roachpb.LeaseEpoch && lease.Expiration != nil) ||
+		lease.Type() == roachpb.LeaseNone {
+		// This amounts to a bug.
+		return newFailedLeaseTrigger(), kvpb.NewLeaseRejectedError(
+			fmt.Sprintf("illegal lease: epoch=%d, interval=[%d,%d)",
+				lease.Epoch, lease.Start.WallTime, lease.GetExpiration().WallTime),
+			prevLease, lease)
+	}
+
+	// Verify that requesting replica is part of the current replica set.
+	if err := checkCanReceiveLease(lease, rec.Desc()); err != nil {
+		return newFailedLeaseTrigger(), kvpb.NewLeaseRejectedError(err.Error(), prevLease, lease)
+	}
+
+	// Set the sequence number of the lease: extensions keep that of the
+	// previous lease, new leases increment it. Commands proposed under the
+	// previous lease are rejected if they apply under the new one.
+	if prevLease.Equivalent(lease) {
+		lease.Sequence = prevLease.Sequence
+	} else {
+		lease.Sequence = prevLease.Sequence + 1
+	}
+
+	// Store the lease to disk & in-memory.
+	if err := stateloader.Make(rec.Desc().RangeID).SetLease(ctx, readWriter, lease); err != nil {
+		return newFailedLeaseTrigger(), err
+	}
+
+	var pd result.Result
+	pd.Replicated.Lease = &lease
+	pd.Replicated.IsLeaseRequest = true
+	return pd, nil
+}
+
+// newFailedLeaseTrigger returns the result of a lease request or transfer
+// which failed to evaluate.
+func newFailedLeaseTrigger() result.Result {
+	var trigger result.Result
+	trigger.Replicated.IsLeaseRequest = true
+	return trigger
+}
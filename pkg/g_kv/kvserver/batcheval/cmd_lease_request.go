@@ -0,0 +1,65 @@
+package batcheval
+
+import (
+	"context"
+	keys "github.com/dborchard/tiny_crdb/pkg/g_keys"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/batcheval/result"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/lockspanset"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/spanset"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	storage "github.com/dborchard/tiny_crdb/pkg/h_storage"
+)
+
+func init() {
+	RegisterReadWriteCommand(kvpb.RequestLease, declareKeysRequestLease, RequestLease)
+}
+
+func declareKeysRequestLease(
+	header *kvpb.Header,
+	_ kvpb.Request,
+	latchSpans *spanset.SpanSet,
+	_ *lockspanset.LockSpanSet,
+) {
+	latchSpans.AddNonMVCC(spanset.SpanReadWrite, roachpb.Span{Key: keys.RangeLeaseKey(header.RangeID)})
+}
+
+// RequestLease sets the range lease for this range. The command fails if
+// the lease of the range changed since the request was made, on the basis of
+// its PrevLease. If this range replica is already the lease holder, the
+// lease keeps its start and its expiration is extended. For a new lease, all
+// duties required of the range lease holder are commenced once the command
+// applies, including bumping the timestamp cache to the start of the lease.
+func RequestLease(
+	ctx context.Context, readWriter storage.ReadWriter, cArgs CommandArgs, resp kvpb.Response,
+) (result.Result, error) {
+	args := cArgs.Args.(*kvpb.RequestLeaseRequest)
+
+	// NOTE: we use the range's current lease as prevLease instead of
+	// args.PrevLease so that we can detect lease requests that will
+	// inevitably fail early and reject them with a detailed
+	// LeaseRejectedError before going through Raft.
+	prevLease := cArgs.EvalCtx.GetLease()
+	newLease := args.Lease
+	if prevLease.Sequence != args.PrevLease.Sequence || prevLease.Replica != args.PrevLease.Replica {
+		// The lease changed since the request was sent: the request was
+		// made on the basis of stale information.
+		return newFailedLeaseTrigger(), kvpb.NewLeaseRejectedError(
+			"lease changed since the request was made", prevLease, newLease)
+	}
+
+	// If this is a lease extension by the same holder, the new lease keeps
+	// the start of the previous one, which makes them equivalent.
+	isExtension := prevLease.Replica.StoreID == newLease.Replica.StoreID &&
+		prevLease.Type() == newLease.Type()
+	if isExtension {
+		newLease.Start = prevLease.Start
+		if newLease.Type() == roachpb.LeaseExpiration &&
+			newLease.GetExpiration().Less(prevLease.GetExpiration()) {
+			// Don't shorten the lease.
+			exp := prevLease.GetExpiration()
+			newLease.Expiration = &exp
+		}
+	}
+	return evalNewLease(ctx, cArgs.EvalCtx, readWriter, newLease, prevLease)
+}
@@ -0,0 +1,72 @@
+package batcheval
+
+import (
+	"context"
+	keys "github.com/dborchard/tiny_crdb/pkg/g_keys"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/batcheval/result"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/lockspanset"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/spanset"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	storage "github.com/dborchard/tiny_crdb/pkg/h_storage"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+)
+
+func init() {
+	RegisterReadWriteCommand(kvpb.TransferLease, declareKeysTransferLease, TransferLease)
+}
+
+func declareKeysTransferLease(
+	header *kvpb.Header,
+	_ kvpb.Request,
+	latchSpans *spanset.SpanSet,
+	_ *lockspanset.LockSpanSet,
+) {
+	// TransferLease must not run concurrently with any other request so it
+	// uses latches to synchronize with all other reads and writes on the
+	// outgoing leaseholder. Additionally, it observes the state of the
+	// timestamp cache and so it uses latches to wait for all in-flight
+	// requests to complete.
+	//
+	// Because of this, it declares a non-MVCC write over every key in the
+	// range, which conflicts with all other requests.
+	latchSpans.AddNonMVCC(spanset.SpanReadWrite, roachpb.Span{Key: keys.RangeLeaseKey(header.RangeID)})
+	latchSpans.AddNonMVCC(spanset.SpanReadWrite, roachpb.Span{Key: roachpb.KeyMin, EndKey: roachpb.KeyMax})
+}
+
+// TransferLease sets the lease holder for the range.
+// Unlike with RequestLease(), the new lease is allowed to overlap the old one,
+// the contract being that the transfer must have been initiated by the (soon
+// ex-) lease holder which must have dropped all of its lease holder powers
+// before proposing.
+//
+// The new lease starts above every read served by the outgoing leaseholder,
+// which are all complete once the latches of the transfer are acquired, and
+// above the timestamps it closed, at which followers may serve reads: the
+// incoming leaseholder bumps its timestamp cache to the start of the lease,
+// and so serves no write below those reads.
+func TransferLease(
+	ctx context.Context, readWriter storage.ReadWriter, cArgs CommandArgs, resp kvpb.Response,
+) (result.Result, error) {
+	args := cArgs.Args.(*kvpb.TransferLeaseRequest)
+
+	// NOTE: we use the range's current lease as prevLease instead of
+	// args.PrevLease so that we can detect lease transfers that will
+	// inevitably fail early and reject them with a detailed
+	// LeaseRejectedError before going through Raft.
+	prevLease := cArgs.EvalCtx.GetLease()
+	newLease := args.Lease
+	if prevLease.Sequence != args.PrevLease.Sequence || prevLease.Replica != args.PrevLease.Replica {
+		return newFailedLeaseTrigger(), kvpb.NewLeaseRejectedError(
+			"lease changed since the transfer was initiated", prevLease, newLease)
+	}
+
+	start := cArgs.EvalCtx.Clock().Now()
+	start.Forward(cArgs.EvalCtx.GetMaxReadTimestamp())
+	newLease.Start = hlc.ClockTimestamp(start)
+	if newLease.Type() == roachpb.LeaseExpiration && newLease.GetExpiration().LessEq(start) {
+		return newFailedLeaseTrigger(), kvpb.NewLeaseRejectedError(
+			"transferred lease expires before it starts", prevLease, newLease)
+	}
+	return evalNewLease(ctx, cArgs.EvalCtx, readWriter, newLease, prevLease)
+}
@@ -0,0 +1,185 @@
+package batcheval
+
+import (
+	"context"
+	"fmt"
+	keys "github.com/dborchard/tiny_crdb/pkg/g_keys"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/batcheval/result"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/lockspanset"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/spanset"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/txnwait"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	storage "github.com/dborchard/tiny_crdb/pkg/h_storage"
+)
+
+func init() {
+	RegisterReadWriteCommand(kvpb.PushTxn, declareKeysPushTransaction, PushTxn)
+}
+
+func declareKeysPushTransaction(
+	_ *kvpb.Header,
+	req kvpb.Request,
+	latchSpans *spanset.SpanSet,
+	_ *lockspanset.LockSpanSet,
+) {
+	pr := req.(*kvpb.PushTxnRequest)
+	latchSpans.AddNonMVCC(spanset.SpanReadWrite, roachpb.Span{Key: keys.TransactionKey(pr.PusheeTxn.Key, pr.PusheeTxn.ID)})
+}
+
+// PushTxn resolves conflicts between concurrent txns (or between
+// a non-transactional reader or writer and a txn) in several ways,
+// depending on the statuses and priorities of the conflicting
+// transactions. The PushTxn operation is invoked by a "pusher"
+// (args.PusherTxn -- the writer trying to abort a conflicting txn
+// or the reader trying to push a conflicting txn's commit timestamp
+// forward), who attempts to resolve a conflict with a "pushee"
+// (args.PusheeTxn -- the pushee txn whose intent(s) caused the
+// conflict). A pusher is either transactional, in which case
+// PusherTxn is completely initialized, or not, in which case the
+// PusherTxn has only the priority set.
+//
+// The request arrives and immediately tries to determine the current
+// disposition of the pushee transaction by reading its transaction
+// record. If it finds one, it continues with the push. If not, it
+// uses knowledge from the existence of the conflicting intent to
+// synthesize the pushee's record.
+//
+// Txn already committed/aborted: If the pushee txn is committed or
+// aborted return success.
+//
+// Txn record expired: If the pushee txn has not been heartbeated for
+// longer than txnwait.TxnLivenessThreshold, it is considered abandoned
+// and is aborted, whatever the push type.
+//
+// Txn record staging: If the pushee txn is STAGING and the push would
+// otherwise succeed, an IndeterminateCommitError is returned. The pushee
+// may be implicitly committed, so the pusher must recover it using the
+// txnrecovery.Manager before it can proceed.
+//
+// Otherwise, the push succeeds if it is forced, if the pusher's priority
+// allows it to push the pushee (see txnwait.CanPushWithPriority), or if
+// it is a timestamp push of a transaction which tolerates write skew, and
+// can therefore commit at a pushed timestamp without having to refresh.
+// Failing that, it returns a TransactionPushError, and the pusher waits in
+// the txnwait.Queue.
+//
+// If the push succeeds, the pushee's record is updated: for PUSH_ABORT,
+// the pushee is aborted; for PUSH_TIMESTAMP, the pushee's write timestamp
+// is forwarded to args.PushTo. The pusher is then free to resolve the
+// pushee's conflicting intents.
+func PushTxn(
+	ctx context.Context, readWriter storage.ReadWriter, cArgs CommandArgs, resp kvpb.Response,
+) (result.Result, error) {
+	args := cArgs.Args.(*kvpb.PushTxnRequest)
+	h := cArgs.Header
+	reply := resp.(*kvpb.PushTxnResponse)
+
+	if h.Txn != nil {
+		return result.Result{}, ErrTransactionUnsupported
+	}
+	if args.PusherTxn.ID == args.PusheeTxn.ID {
+		return result.Result{}, fmt.Errorf("cannot push self")
+	}
+	if args.PushType == kvpb.PUSH_TIMESTAMP && args.PushTo.IsEmpty() {
+		return result.Result{}, fmt.Errorf("PUSH_TIMESTAMP requires a PushTo timestamp")
+	}
+
+	// Fetch existing transaction; if missing, we're allowed to abort.
+	existing, ok, err := readTxnRecord(ctx, readWriter, args.PusheeTxn)
+	if err != nil {
+		return result.Result{}, err
+	}
+	if ok {
+		reply.PusheeTxn = existing
+		// Forward the pushee's state with what the pusher learned from the
+		// conflicting intent.
+		reply.PusheeTxn.WriteTimestamp.Forward(args.PusheeTxn.WriteTimestamp)
+	} else {
+		// There is no transaction record for the pushee. Synthesize one from
+		// the conflicting intent's metadata.
+		reply.PusheeTxn = SynthesizeTxnFromMeta(args.PusheeTxn)
+	}
+
+	// If already committed or aborted, return success.
+	if reply.PusheeTxn.Status.IsFinalized() {
+		// Trivial noop.
+		return result.Result{}, nil
+	}
+
+	// If we're trying to move the timestamp forward, and it's already
+	// far enough forward, return success.
+	pushType := args.PushType
+	if pushType == kvpb.PUSH_TIMESTAMP && args.PushTo.LessEq(reply.PusheeTxn.WriteTimestamp) {
+		// Trivial noop.
+		return result.Result{}, nil
+	}
+
+	now := cArgs.EvalCtx.Clock().Now()
+	var pusherWins bool
+	switch {
+	case txnwait.IsExpired(now, &reply.PusheeTxn):
+		// When cleaning up, actually clean up (as opposed to simply pushing
+		// the garbage in the path of future writers).
+		pushType = kvpb.PUSH_ABORT
+		pusherWins = true
+	case pushType == kvpb.PUSH_TOUCH:
+		// If just attempting to cleanup old or already-committed txns,
+		// pusher always fails.
+		pusherWins = false
+	case args.Force:
+		pusherWins = true
+	case txnwait.CanPushWithPriority(args.PusherTxn.Priority, reply.PusheeTxn.Priority):
+		pusherWins = true
+	case pushType == kvpb.PUSH_TIMESTAMP && reply.PusheeTxn.IsoLevel.ToleratesWriteSkew():
+		// A transaction running under a weak isolation level can commit at
+		// a timestamp above its read timestamp, so pushing it forward does
+		// not force it to restart.
+		pusherWins = true
+	default:
+		pusherWins = false
+	}
+
+	if !pusherWins {
+		return result.Result{}, kvpb.NewTransactionPushError(reply.PusheeTxn)
+	}
+
+	// If the pushee is STAGING, it may have been implicitly committed: all of
+	// its in-flight writes may have succeeded, in which case it must not be
+	// aborted or have its timestamp moved. The pusher must first recover the
+	// transaction to determine its outcome.
+	if reply.PusheeTxn.Status == roachpb.STAGING {
+		return result.Result{}, kvpb.NewIndeterminateCommitError(reply.PusheeTxn)
+	}
+
+	// Upgrade priority of pushed transaction to one less than pusher's.
+	if reply.PusheeTxn.Priority < args.PusherTxn.Priority-1 {
+		reply.PusheeTxn.Priority = args.PusherTxn.Priority - 1
+	}
+
+	// Determine what to do with the pushee, based on the push type.
+	switch pushType {
+	case kvpb.PUSH_ABORT:
+		// If aborting the transaction, set the new status.
+		reply.PusheeTxn.Status = roachpb.ABORTED
+	case kvpb.PUSH_TIMESTAMP:
+		// Otherwise, move the pushee's provisional commit timestamp forward
+		// to the requested timestamp. The pushee will not be able to commit
+		// beneath it.
+		reply.PusheeTxn.WriteTimestamp.Forward(args.PushTo)
+	default:
+		return result.Result{}, fmt.Errorf("unexpected push type: %v", pushType)
+	}
+
+	// Persist the pushed transaction record, so that the pushee's
+	// coordinator finds out about the push when it next heartbeats or
+	// attempts to commit.
+	if err := writeTxnRecord(ctx, readWriter, &reply.PusheeTxn); err != nil {
+		return result.Result{}, err
+	}
+
+	pushee := reply.PusheeTxn.Clone()
+	return result.Result{
+		Local: result.LocalResult{UpdatedTxns: []*roachpb.Transaction{pushee}},
+	}, nil
+}
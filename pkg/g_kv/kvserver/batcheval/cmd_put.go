@@ -0,0 +1,25 @@
+package batcheval
+
+import (
+	"context"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/batcheval/result"
+	storage "github.com/dborchard/tiny_crdb/pkg/h_storage"
+)
+
+func init() {
+	RegisterReadWriteCommand(kvpb.Put, DefaultDeclareIsolatedKeys, Put)
+}
+
+// Put sets the value for a specified key.
+func Put(
+	ctx context.Context, readWriter storage.ReadWriter, cArgs CommandArgs, resp kvpb.Response,
+) (result.Result, error) {
+	args := cArgs.Args.(*kvpb.PutRequest)
+	h := cArgs.Header
+
+	opts := storage.MVCCWriteOptions{
+		Txn: h.Txn,
+	}
+	return result.Result{}, storage.MVCCPut(ctx, readWriter, args.Key, h.Timestamp, args.Value, opts)
+}
@@ -0,0 +1,52 @@
+package batcheval
+
+import (
+	"context"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/batcheval/result"
+	storage "github.com/dborchard/tiny_crdb/pkg/h_storage"
+)
+
+func init() {
+	RegisterReadOnlyCommand(kvpb.QueryIntent, DefaultDeclareKeys, QueryIntent)
+}
+
+// QueryIntent checks if an intent exists for the specified transaction at the
+// given key, at or below the transaction's provisional commit timestamp and
+// reflecting the write at the queried sequence number, and sets FoundIntent
+// accordingly. Evaluation only reads the intent; it does not prevent a missing
+// intent from being written in the future. Once the request is evaluated,
+// Replica.updateTimestampCache (replica_tscache.go) bumps the timestamp cache
+// over the key of a missing intent, so that a later write by the queried
+// transaction is pushed and cannot take part in an implicit commit.
+//
+// An intent that was pushed above the queried transaction's provisional
+// commit timestamp is not considered found, since the transaction could not
+// have committed at that timestamp.
+func QueryIntent(
+	ctx context.Context, reader storage.Reader, cArgs CommandArgs, resp kvpb.Response,
+) (result.Result, error) {
+	args := cArgs.Args.(*kvpb.QueryIntentRequest)
+	h := cArgs.Header
+	reply := resp.(*kvpb.QueryIntentResponse)
+
+	if h.Txn != nil {
+		return result.Result{}, ErrTransactionUnsupported
+	}
+
+	meta, err := storage.MVCCGetIntentMeta(ctx, reader, args.Key)
+	if err != nil {
+		return result.Result{}, err
+	}
+	if meta == nil || meta.Txn.ID != args.Txn.ID || meta.Txn.Epoch != args.Txn.Epoch {
+		return result.Result{}, nil
+	}
+	if args.Txn.WriteTimestamp.Less(meta.Timestamp) {
+		// The intent was pushed.
+		return result.Result{}, nil
+	}
+	// The write is reflected in the intent if it was made at or before the
+	// intent's latest sequence number; later writes to the key build on it.
+	reply.FoundIntent = args.Txn.Sequence <= meta.Txn.Sequence
+	return result.Result{}, nil
+}
@@ -0,0 +1,65 @@
+package batcheval
+
+import (
+	"context"
+	keys "github.com/dborchard/tiny_crdb/pkg/g_keys"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/batcheval/result"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/lockspanset"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/spanset"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	storage "github.com/dborchard/tiny_crdb/pkg/h_storage"
+)
+
+func init() {
+	RegisterReadOnlyCommand(kvpb.QueryTxn, declareKeysQueryTransaction, QueryTxn)
+}
+
+func declareKeysQueryTransaction(
+	_ *kvpb.Header,
+	req kvpb.Request,
+	latchSpans *spanset.SpanSet,
+	_ *lockspanset.LockSpanSet,
+) {
+	qr := req.(*kvpb.QueryTxnRequest)
+	latchSpans.AddNonMVCC(spanset.SpanReadOnly, roachpb.Span{Key: keys.TransactionKey(qr.Txn.Key, qr.Txn.ID)})
+}
+
+// QueryTxn fetches the current state of a transaction.
+// This method is used to continually update the state of a txn
+// which is blocked waiting to resolve a conflicting intent. It
+// fetches the complete transaction record to determine whether
+// priority or status has changed and also fetches a list of
+// other txns which are waiting on this transaction in order
+// to find dependency cycles.
+func QueryTxn(
+	ctx context.Context, reader storage.Reader, cArgs CommandArgs, resp kvpb.Response,
+) (result.Result, error) {
+	args := cArgs.Args.(*kvpb.QueryTxnRequest)
+	h := cArgs.Header
+	reply := resp.(*kvpb.QueryTxnResponse)
+
+	if h.Txn != nil {
+		return result.Result{}, ErrTransactionUnsupported
+	}
+
+	txn, ok, err := readTxnRecord(ctx, reader, args.Txn)
+	if err != nil {
+		return result.Result{}, err
+	}
+	if ok {
+		reply.QueriedTxn = txn
+	} else {
+		// The transaction hasn't written a transaction record yet.
+		// Synthesize it from the provided TxnMeta.
+		reply.QueriedTxn = SynthesizeTxnFromMeta(args.Txn)
+	}
+
+	// Get the list of txns waiting on this txn.
+	if cArgs.EvalCtx != nil {
+		if q := cArgs.EvalCtx.GetTxnWaitQueue(); q != nil {
+			reply.WaitingTxns = q.GetDependents(args.Txn.ID)
+		}
+	}
+	return result.Result{}, nil
+}
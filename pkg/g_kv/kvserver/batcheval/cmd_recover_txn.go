@@ -0,0 +1,135 @@
+package batcheval
+
+import (
+	"context"
+	"fmt"
+	keys "github.com/dborchard/tiny_crdb/pkg/g_keys"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/batcheval/result"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/lockspanset"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/spanset"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	storage "github.com/dborchard/tiny_crdb/pkg/h_storage"
+)
+
+func init() {
+	RegisterReadWriteCommand(kvpb.RecoverTxn, declareKeysRecoverTransaction, RecoverTxn)
+}
+
+func declareKeysRecoverTransaction(
+	_ *kvpb.Header,
+	req kvpb.Request,
+	latchSpans *spanset.SpanSet,
+	_ *lockspanset.LockSpanSet,
+) {
+	rr := req.(*kvpb.RecoverTxnRequest)
+	latchSpans.AddNonMVCC(spanset.SpanReadWrite, roachpb.Span{Key: keys.TransactionKey(rr.Txn.Key, rr.Txn.ID)})
+}
+
+// RecoverTxn attempts to recover the specified transaction from an
+// indeterminate commit state. Transactions enter this state when abandoned
+// after updating their transaction record with a STAGING status. The RecoverTxn
+// operation is invoked by a caller who encounters a transaction in this state
+// after they have already queried all of the STAGING transaction's declared
+// in-flight writes. The caller specifies whether all of these in-flight writes
+// were found to have succeeded. If all of the writes succeeded, the
+// transaction is implicitly committed and the commit is made explicit. If one
+// or more of the writes is missing, the transaction is aborted.
+//
+// The recovery must not be fooled by a transaction that has moved on since
+// its in-flight writes were queried: if the record is found in a different
+// epoch or at a different timestamp than the one queried, the recovered
+// transaction is returned as is and the caller may retry.
+func RecoverTxn(
+	ctx context.Context, readWriter storage.ReadWriter, cArgs CommandArgs, resp kvpb.Response,
+) (result.Result, error) {
+	args := cArgs.Args.(*kvpb.RecoverTxnRequest)
+	h := cArgs.Header
+	reply := resp.(*kvpb.RecoverTxnResponse)
+
+	if h.Txn != nil {
+		return result.Result{}, ErrTransactionUnsupported
+	}
+	if !args.Key.Equal(args.Txn.Key) {
+		return result.Result{}, fmt.Errorf("request key %s does not match txn key %s", args.Key, args.Txn.Key)
+	}
+
+	// Fetch transaction record; if missing, the transaction was never staged.
+	existing, ok, err := readTxnRecord(ctx, readWriter, args.Txn)
+	if err != nil {
+		return result.Result{}, err
+	}
+	if !ok {
+		return result.Result{}, fmt.Errorf("txn record for %s missing during recovery", args.Txn.ID)
+	}
+	reply.RecoveredTxn = existing
+
+	// The transaction may have been finalized by a concurrent recovery or by
+	// its own coordinator. If so, there is nothing left to do.
+	if reply.RecoveredTxn.Status.IsFinalized() {
+		return result.Result{}, nil
+	}
+
+	// Determine whether the transaction record has changed since the
+	// in-flight writes were queried.
+	legalChange := args.Txn.Epoch < reply.RecoveredTxn.Epoch ||
+		args.Txn.WriteTimestamp.Less(reply.RecoveredTxn.WriteTimestamp)
+
+	if args.ImplicitlyCommitted {
+		// The transaction was implicitly committed, so its record must still
+		// be STAGING and must not have changed: a transaction cannot restart
+		// or move its timestamp after it was implicitly committed.
+		switch {
+		case reply.RecoveredTxn.Status != roachpb.STAGING:
+			return result.Result{}, fmt.Errorf(
+				"programming error: found %s record for implicitly committed transaction: %s",
+				reply.RecoveredTxn.Status, reply.RecoveredTxn.Short())
+		case legalChange:
+			return result.Result{}, fmt.Errorf(
+				"programming error: epoch or timestamp change after implicit commit: %s",
+				reply.RecoveredTxn.Short())
+		}
+		reply.RecoveredTxn.Status = roachpb.COMMITTED
+	} else {
+		// The transaction was not implicitly committed. If the record moved
+		// on, the transaction is no longer abandoned and the recovery is a
+		// no-op. Otherwise, the missing in-flight write cannot succeed in the
+		// future, so the transaction can be aborted.
+		if legalChange {
+			return result.Result{}, nil
+		}
+		if reply.RecoveredTxn.Status == roachpb.PENDING {
+			return result.Result{}, fmt.Errorf(
+				"programming error: cannot recover PENDING transaction in same epoch: %s",
+				reply.RecoveredTxn.Short())
+		}
+		reply.RecoveredTxn.Status = roachpb.ABORTED
+	}
+
+	// Resolve the transaction's locks, including its in-flight writes, which
+	// are not part of its lock spans while it is STAGING.
+	lockSpans := append([]roachpb.Span(nil), reply.RecoveredTxn.LockSpans...)
+	for _, w := range reply.RecoveredTxn.InFlightWrites {
+		lockSpans = append(lockSpans, roachpb.Span{Key: w.Key})
+	}
+	reply.RecoveredTxn.LockSpans = lockSpans
+	reply.RecoveredTxn.InFlightWrites = nil
+	resolvedLocks, externalLocks, err := resolveLocalLocks(
+		ctx, cArgs.EvalCtx.Desc(), readWriter, lockSpans, &reply.RecoveredTxn)
+	if err != nil {
+		return result.Result{}, err
+	}
+
+	if err := writeTxnRecord(ctx, readWriter, &reply.RecoveredTxn); err != nil {
+		return result.Result{}, err
+	}
+
+	recovered := reply.RecoveredTxn.Clone()
+	return result.Result{
+		Local: result.LocalResult{
+			ResolvedLocks: resolvedLocks,
+			UpdatedTxns:   []*roachpb.Transaction{recovered},
+			ExternalLocks: externalLocks,
+		},
+	}, nil
+}
@@ -0,0 +1,97 @@
+package batcheval
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/batcheval/result"
+	storage "github.com/dborchard/tiny_crdb/pkg/h_storage"
+	"github.com/dborchard/tiny_crdb/pkg/h_storage/enginepb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/protoutil"
+)
+
+func init() {
+	RegisterReadOnlyCommand(kvpb.RefreshRange, DefaultDeclareKeys, RefreshRange)
+}
+
+// RefreshRange checks that no values were written to the key range of the
+// request in the interval (RefreshFrom, ReadTimestamp] of the transaction,
+// and that no other transaction holds an intent there at or below the read
+// timestamp. If either is found, the transaction cannot move its reads of the
+// range to its new read timestamp, and a TransactionRetryError is returned.
+//
+// The intents of the refreshing transaction itself are ignored. Once the
+// request is evaluated, the timestamp cache is bumped over the range up to
+// the read timestamp, so that the verified interval cannot be written to
+// afterwards.
+func RefreshRange(
+	ctx context.Context, reader storage.Reader, cArgs CommandArgs, resp kvpb.Response,
+) (result.Result, error) {
+	args := cArgs.Args.(*kvpb.RefreshRangeRequest)
+	h := cArgs.Header
+
+	if h.Txn == nil {
+		return result.Result{}, errors.New("cannot refresh without a transaction")
+	}
+	refreshTo := h.Txn.ReadTimestamp
+
+	iter, err := reader.NewMVCCIterator(ctx, storage.MVCCKeyAndIntentsIterKind, storage.IterOptions{
+		LowerBound: args.Key,
+		UpperBound: args.EndKey,
+	})
+	if err != nil {
+		return result.Result{}, err
+	}
+	defer iter.Close()
+
+	// ownIntent is set while iterating over the versions of a key whose
+	// intent belongs to the refreshing transaction; the provisional value of
+	// the intent is then skipped.
+	var ownIntent *enginepb.MVCCMetadata
+	for iter.SeekGE(storage.MakeMVCCMetadataKey(args.Key)); ; iter.Next() {
+		if valid, err := iter.Valid(); err != nil {
+			return result.Result{}, err
+		} else if !valid {
+			break
+		}
+		unsafeKey := iter.UnsafeKey()
+		if !unsafeKey.IsValue() {
+			unsafeValue, err := iter.UnsafeValue()
+			if err != nil {
+				return result.Result{}, err
+			}
+			var meta enginepb.MVCCMetadata
+			if err := protoutil.Unmarshal(unsafeValue, &meta); err != nil {
+				return result.Result{}, fmt.Errorf("unable to decode MVCCMetadata: %w", err)
+			}
+			ownIntent = nil
+			if meta.Txn == nil {
+				continue
+			}
+			if meta.Txn.ID == h.Txn.ID {
+				ownIntent = &meta
+				continue
+			}
+			if meta.Timestamp.LessEq(refreshTo) {
+				return result.Result{}, kvpb.NewTransactionRetryError(kvpb.RETRY_SERIALIZABLE,
+					fmt.Sprintf("refresh encountered an intent of txn %s on key %s",
+						meta.Txn.ID.Short(), unsafeKey.Key))
+			}
+			continue
+		}
+		if ownIntent != nil {
+			if unsafeKey.Timestamp == ownIntent.Timestamp {
+				continue
+			}
+			ownIntent = nil
+		}
+		if unsafeKey.Timestamp.LessEq(args.RefreshFrom) || refreshTo.Less(unsafeKey.Timestamp) {
+			continue
+		}
+		return result.Result{}, kvpb.NewTransactionRetryError(kvpb.RETRY_SERIALIZABLE,
+			fmt.Sprintf("refresh encountered a value written at %v on key %s",
+				unsafeKey.Timestamp, unsafeKey.Key))
+	}
+	return result.Result{}, nil
+}
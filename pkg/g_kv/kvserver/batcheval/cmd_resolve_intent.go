@@ -0,0 +1,54 @@
+package batcheval
+
+import (
+	"context"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/batcheval/result"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	storage "github.com/dborchard/tiny_crdb/pkg/h_storage"
+)
+
+func init() {
+	RegisterReadWriteCommand(kvpb.ResolveIntent, DefaultDeclareKeys, ResolveIntent)
+}
+
+// ResolveIntent resolves a write intent from the specified key
+// according to the status of the transaction which created it. If the request
+// has an end key, the write intents of the transaction in the key range are
+// resolved.
+func ResolveIntent(
+	ctx context.Context, readWriter storage.ReadWriter, cArgs CommandArgs, resp kvpb.Response,
+) (result.Result, error) {
+	args := cArgs.Args.(*kvpb.ResolveIntentRequest)
+	h := cArgs.Header
+
+	if h.Txn != nil {
+		return result.Result{}, ErrTransactionUnsupported
+	}
+
+	update := roachpb.LockUpdate{
+		Span:           args.Span(),
+		Txn:            args.IntentTxn,
+		Status:         args.Status,
+		IgnoredSeqNums: args.IgnoredSeqNums,
+	}
+	var res result.Result
+	if len(update.EndKey) > 0 {
+		// The range may hold unreplicated locks of the transaction in the span
+		// even where there are no intents, so the update is always passed on
+		// to the lock table.
+		if _, err := storage.MVCCResolveWriteIntentRange(ctx, readWriter, update); err != nil {
+			return result.Result{}, err
+		}
+		res.Local.ResolvedLocks = []roachpb.LockUpdate{update}
+		return res, nil
+	}
+	ok, err := storage.MVCCResolveWriteIntent(ctx, readWriter, update)
+	if err != nil {
+		return result.Result{}, err
+	}
+	if ok {
+		res.Local.ResolvedLocks = []roachpb.LockUpdate{update}
+	}
+	return res, nil
+}
@@ -0,0 +1,58 @@
+package batcheval
+
+import (
+	"context"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/batcheval/result"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/concurrency/lock"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	storage "github.com/dborchard/tiny_crdb/pkg/h_storage"
+)
+
+func init() {
+	RegisterReadOnlyCommand(kvpb.Scan, DefaultDeclareIsolatedKeys, Scan)
+}
+
+// Scan scans the key range specified by start key through end key in
+// ascending order up to some maximum number of results. maxKeys stores the
+// number of scan results remaining for this batch (MaxInt64 for no limit).
+// If the request has a locking strength, an unreplicated lock is acquired on
+// each of the keys returned.
+func Scan(
+	ctx context.Context, reader storage.Reader, cArgs CommandArgs, resp kvpb.Response,
+) (result.Result, error) {
+	args := cArgs.Args.(*kvpb.ScanRequest)
+	h := cArgs.Header
+	reply := resp.(*kvpb.ScanResponse)
+
+	scanRes, err := storage.MVCCScan(ctx, reader, args.Key, args.EndKey, h.Timestamp, storage.MVCCScanOptions{
+		Txn:                h.Txn,
+		MaxKeys:            h.MaxSpanRequestKeys,
+		KeyLockingStrength: args.KeyLockingStrength,
+		SkipLocked:         h.WaitPolicy == lock.SkipLocked,
+		LockTable:          cArgs.Concurrency,
+	})
+	if err != nil {
+		return result.Result{}, err
+	}
+	reply.NumKeys = scanRes.NumKeys
+	reply.ResumeSpan = scanRes.ResumeSpan
+	reply.Rows = scanRes.KVs
+
+	if args.KeyLockingStrength != lock.None && h.Txn != nil {
+		return result.WithAcquiredLocks(acquireLocksOnKeys(scanRes.KVs, h.Txn, args.KeyLockingStrength)...), nil
+	}
+	return result.Result{}, nil
+}
+
+// acquireLocksOnKeys returns the unreplicated lock acquisitions of the
+// transaction on each of the scanned keys.
+func acquireLocksOnKeys(
+	kvs []roachpb.KeyValue, txn *roachpb.Transaction, str lock.Strength,
+) []roachpb.LockAcquisition {
+	acqs := make([]roachpb.LockAcquisition, len(kvs))
+	for i := range kvs {
+		acqs[i] = roachpb.MakeLockAcquisition(&txn.TxnMeta, kvs[i].Key, lock.Unreplicated, str)
+	}
+	return acqs
+}
@@ -0,0 +1,67 @@
+package batcheval
+
+import (
+	"context"
+	keys "github.com/dborchard/tiny_crdb/pkg/g_keys"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/batcheval/result"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/kvserverpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/lockspanset"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/spanset"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	storage "github.com/dborchard/tiny_crdb/pkg/h_storage"
+)
+
+func init() {
+	RegisterReadWriteCommand(kvpb.TruncateLog, declareKeysTruncateLog, TruncateLog)
+}
+
+func declareKeysTruncateLog(
+	_ *kvpb.Header,
+	req kvpb.Request,
+	latchSpans *spanset.SpanSet,
+	_ *lockspanset.LockSpanSet,
+) {
+	tr := req.(*kvpb.TruncateLogRequest)
+	latchSpans.AddNonMVCC(spanset.SpanReadWrite, roachpb.Span{Key: keys.RaftTruncatedStateKey(tr.RangeID)})
+}
+
+// TruncateLog discards a prefix of the raft log. Truncating part of a log that
+// has already been truncated has no effect. If this range is not the one
+// specified within the request body, the request will also be ignored.
+//
+// The command writes nothing: the entries are removed by each replica when
+// the command applies, as directed by the RaftTruncatedState of its result.
+func TruncateLog(
+	ctx context.Context, readWriter storage.ReadWriter, cArgs CommandArgs, resp kvpb.Response,
+) (result.Result, error) {
+	args := cArgs.Args.(*kvpb.TruncateLogRequest)
+
+	// After a merge, it's possible that this request was sent to the wrong
+	// range based on the start key. This will cancel the request if this is
+	// not the range specified in the request body.
+	rangeID := cArgs.EvalCtx.Desc().RangeID
+	if rangeID != args.RangeID {
+		return result.Result{}, nil
+	}
+
+	firstIndex := cArgs.EvalCtx.GetFirstIndex()
+	if firstIndex >= args.Index || firstIndex != args.ExpectedFirstIndex {
+		// The log was truncated since the request was sent.
+		return result.Result{}, nil
+	}
+
+	// The term of the last entry removed from the log is recorded in the
+	// truncated state, which the log's entries then follow.
+	term, err := cArgs.EvalCtx.GetTerm(args.Index - 1)
+	if err != nil {
+		return result.Result{}, err
+	}
+
+	var pd result.Result
+	pd.Replicated.RaftTruncatedState = &kvserverpb.RaftTruncatedState{
+		Index: args.Index - 1,
+		Term:  term,
+	}
+	return pd, nil
+}
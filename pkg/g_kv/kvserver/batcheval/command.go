@@ -0,0 +1,92 @@
+package batcheval
+
+import (
+	"context"
+	"fmt"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/batcheval/result"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/concurrency"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/lockspanset"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/spanset"
+	storage "github.com/dborchard/tiny_crdb/pkg/h_storage"
+)
+
+// CommandArgs contains all the arguments to a command.
+type CommandArgs struct {
+	// EvalCtx gives access to the state of the replica evaluating the
+	// command.
+	EvalCtx EvalContext
+	// Header is the header of the batch that the request is part of. For
+	// transactional requests, Header.Timestamp is the transaction's read
+	// timestamp.
+	Header kvpb.Header
+	// Args is the request being evaluated.
+	Args kvpb.Request
+	// Concurrency is the concurrency guard of the request's batch, which
+	// gives access to the lock table to requests that skip locked keys. It
+	// may be nil.
+	Concurrency *concurrency.Guard
+}
+
+// DeclareKeysFunc adds all key spans that a command touches to the latchSpans
+// set. It then adds all key spans within which that command expects to have
+// isolation from conflicting transactions to the lockSpans set, along with
+// the strength with which the command accesses them.
+type DeclareKeysFunc func(
+	header *kvpb.Header,
+	request kvpb.Request,
+	latchSpans *spanset.SpanSet,
+	lockSpans *lockspanset.LockSpanSet,
+)
+
+// A Command is the implementation of a single request within a BatchRequest.
+type Command struct {
+	// DeclareKeys adds all keys this command touches, and when (if
+	// applicable), to the given SpanSet.
+	DeclareKeys DeclareKeysFunc
+
+	// EvalRW and EvalRO contain the command's evaluation logic. Exactly one of
+	// them is set: read-write commands implement EvalRW and read-only commands
+	// implement EvalRO.
+	//
+	// Commands must evaluate deterministically: the same request against the
+	// same engine state must produce the same result.
+	EvalRW func(context.Context, storage.ReadWriter, CommandArgs, kvpb.Response) (result.Result, error)
+	EvalRO func(context.Context, storage.Reader, CommandArgs, kvpb.Response) (result.Result, error)
+}
+
+var cmds = make(map[kvpb.Method]Command)
+
+// RegisterReadWriteCommand makes a read-write command available for execution.
+// It must only be called before any evaluation takes place.
+func RegisterReadWriteCommand(
+	method kvpb.Method,
+	declare DeclareKeysFunc,
+	fn func(context.Context, storage.ReadWriter, CommandArgs, kvpb.Response) (result.Result, error),
+) {
+	register(method, Command{DeclareKeys: declare, EvalRW: fn})
+}
+
+// RegisterReadOnlyCommand makes a read-only command available for execution.
+// It must only be called before any evaluation takes place.
+func RegisterReadOnlyCommand(
+	method kvpb.Method,
+	declare DeclareKeysFunc,
+	fn func(context.Context, storage.Reader, CommandArgs, kvpb.Response) (result.Result, error),
+) {
+	register(method, Command{DeclareKeys: declare, EvalRO: fn})
+}
+
+func register(method kvpb.Method, command Command) {
+	if _, ok := cmds[method]; ok {
+		panic(fmt.Sprintf("cannot overwrite previously registered method %v", method))
+	}
+	cmds[method] = command
+}
+
+// LookupCommand returns the command for the given method, with the boolean
+// indicating success or failure.
+func LookupCommand(method kvpb.Method) (Command, bool) {
+	command, ok := cmds[method]
+	return command, ok
+}
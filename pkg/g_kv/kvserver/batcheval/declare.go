@@ -0,0 +1,68 @@
+package batcheval
+
+import (
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/concurrency/lock"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/lockspanset"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/spanset"
+)
+
+// DefaultDeclareKeys is the default implementation of Command.DeclareKeys.
+// It declares a latch over the request's span, at the batch's timestamp,
+// but no lock spans: the request does not expect isolation from conflicting
+// transactions.
+func DefaultDeclareKeys(
+	header *kvpb.Header,
+	req kvpb.Request,
+	latchSpans *spanset.SpanSet,
+	_ *lockspanset.LockSpanSet,
+) {
+	access := spanset.SpanReadWrite
+	if kvpb.IsReadOnly(req) && !kvpb.IsLocking(req) {
+		access = spanset.SpanReadOnly
+	}
+	latchSpans.AddMVCC(access, req.Header().Span(), header.Timestamp)
+}
+
+// DefaultDeclareIsolatedKeys is similar to DefaultDeclareKeys, but it
+// declares lock spans in addition to latch spans. When used in conjunction
+// with optimistic locking, the lock spans are used to check for conflicts
+// with locks held by other transactions.
+//
+// Non-locking reads declare their span with lock.None strength: they only
+// conflict with locks held at or below their timestamp. Locking reads declare
+// the strength with which they lock the keys that they read, and writes
+// declare lock.Intent.
+func DefaultDeclareIsolatedKeys(
+	header *kvpb.Header,
+	req kvpb.Request,
+	latchSpans *spanset.SpanSet,
+	lockSpans *lockspanset.LockSpanSet,
+) {
+	access := spanset.SpanReadOnly
+	str := lock.None
+	if kvpb.IsReadOnly(req) {
+		if kvpb.IsLocking(req) {
+			access = spanset.SpanReadWrite
+			str = keyLockingStrength(req)
+		}
+	} else {
+		access = spanset.SpanReadWrite
+		str = lock.Intent
+	}
+	latchSpans.AddMVCC(access, req.Header().Span(), header.Timestamp)
+	lockSpans.Add(str, req.Header().Span())
+}
+
+// keyLockingStrength returns the strength with which the locking read
+// request locks the keys that it reads.
+func keyLockingStrength(req kvpb.Request) lock.Strength {
+	switch t := req.(type) {
+	case *kvpb.GetRequest:
+		return t.KeyLockingStrength
+	case *kvpb.ScanRequest:
+		return t.KeyLockingStrength
+	default:
+		return lock.None
+	}
+}
@@ -0,0 +1,87 @@
+package batcheval
+
+import (
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/txnwait"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+)
+
+// EvalContext is the interface through which command evaluation accesses the
+// in-memory state of a Replica. Any state that may be consulted by a command
+// must be exposed through it.
+type EvalContext interface {
+	// Clock returns the clock of the node evaluating the command.
+	Clock() *hlc.Clock
+	// GetTxnWaitQueue returns the queue in which the pushers of the
+	// transactions whose records are held by the range wait. It may be nil.
+	GetTxnWaitQueue() *txnwait.Queue
+	// Desc returns the descriptor of the range.
+	Desc() *roachpb.RangeDescriptor
+	// GetFirstIndex returns the index of the first entry of the replica's
+	// Raft log.
+	GetFirstIndex() uint64
+	// GetTerm returns the term of the entry of the replica's Raft log at the
+	// index.
+	GetTerm(i uint64) (uint64, error)
+	// GetLease returns the lease of the range, as of the last command
+	// applied by the replica.
+	GetLease() roachpb.Lease
+	// GetMaxReadTimestamp returns the highest timestamp at which the range's
+	// data was read, as recorded in the timestamp cache, or may have been
+	// read by follower reads.
+	GetMaxReadTimestamp() hlc.Timestamp
+}
+
+// MockEvalCtx is a dummy implementation of EvalContext for testing purposes.
+// For technical reasons, the interface is implemented by a wrapper .EvalContext().
+type MockEvalCtx struct {
+	Clock        *hlc.Clock
+	TxnWaitQueue *txnwait.Queue
+	// Desc defaults to a range spanning the entire keyspace.
+	Desc *roachpb.RangeDescriptor
+	// FirstIndex and Term are the first index of the Raft log, and the term
+	// of all its entries.
+	FirstIndex uint64
+	Term       uint64
+	// Lease is the lease of the range, and MaxReadTimestamp the highest
+	// timestamp at which it was read.
+	Lease            roachpb.Lease
+	MaxReadTimestamp hlc.Timestamp
+}
+
+// EvalContext returns the MockEvalCtx as an EvalContext. It will reflect future
+// modifications to the underlying MockEvalContext.
+func (m *MockEvalCtx) EvalContext() EvalContext {
+	return &mockEvalCtxImpl{MockEvalCtx: m}
+}
+
+type mockEvalCtxImpl struct {
+	// Hide the fields of MockEvalCtx which have names that conflict with some
+	// of the interface methods.
+	*MockEvalCtx
+}
+
+func (m *mockEvalCtxImpl) Clock() *hlc.Clock {
+	return m.MockEvalCtx.Clock
+}
+func (m *mockEvalCtxImpl) GetTxnWaitQueue() *txnwait.Queue {
+	return m.MockEvalCtx.TxnWaitQueue
+}
+func (m *mockEvalCtxImpl) Desc() *roachpb.RangeDescriptor {
+	if m.MockEvalCtx.Desc == nil {
+		return &roachpb.RangeDescriptor{RangeID: 1, StartKey: roachpb.RKeyMin, EndKey: roachpb.RKeyMax}
+	}
+	return m.MockEvalCtx.Desc
+}
+func (m *mockEvalCtxImpl) GetFirstIndex() uint64 {
+	return m.MockEvalCtx.FirstIndex
+}
+func (m *mockEvalCtxImpl) GetTerm(uint64) (uint64, error) {
+	return m.MockEvalCtx.Term, nil
+}
+func (m *mockEvalCtxImpl) GetLease() roachpb.Lease {
+	return m.MockEvalCtx.Lease
+}
+func (m *mockEvalCtxImpl) GetMaxReadTimestamp() hlc.Timestamp {
+	return m.MockEvalCtx.MaxReadTimestamp
+}
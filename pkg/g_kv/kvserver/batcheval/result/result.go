@@ -0,0 +1,102 @@
+package result
+
+import (
+	"errors"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/kvserverpb"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+)
+
+// LocalResult is data belonging to an evaluated command that is only used on
+// the node on which the command was proposed. Note that the proposing node
+// may die before the local results are processed, so any side effects here
+// are only best-effort.
+type LocalResult struct {
+	// AcquiredLocks stores any newly acquired or re-acquired locks.
+	AcquiredLocks []roachpb.LockAcquisition
+	// ResolvedLocks stores any resolved lock spans, either with finalized or
+	// pending statuses.
+	ResolvedLocks []roachpb.LockUpdate
+	// UpdatedTxns stores transaction records that have been updated by
+	// calls to EndTxn, PushTxn or HeartbeatTxn.
+	UpdatedTxns []*roachpb.Transaction
+	// ExternalLocks stores the locks of finalized transactions which are held
+	// outside of the range, and which are resolved asynchronously once the
+	// command has applied.
+	ExternalLocks []roachpb.LockUpdate
+}
+
+// IsZero reports whether lResult is the zero value.
+func (lResult *LocalResult) IsZero() bool {
+	return len(lResult.AcquiredLocks) == 0 && len(lResult.ResolvedLocks) == 0 &&
+		len(lResult.UpdatedTxns) == 0 && len(lResult.ExternalLocks) == 0
+}
+
+// Result is the result of evaluating a KV request. That is, the
+// proposer (which holds the lease, at least in the case in which the command
+// will complete successfully) has evaluated the request and is holding on to:
+//
+// a) changes to be written to disk when applying the command
+// b) changes to the state which may require special handling (i.e. code
+// execution) on all Replicas
+// c) data which isn't sent to the followers but the proposer needs for tasks
+// it must run when the command has applied (such as resolving intents).
+type Result struct {
+	Local        LocalResult
+	Replicated   kvserverpb.ReplicatedEvalResult
+	LogicalOpLog *kvserverpb.LogicalOpLog
+}
+
+// IsZero reports whether p is the zero value.
+func (p *Result) IsZero() bool {
+	return p.Local.IsZero() && p.Replicated.IsZero() && p.LogicalOpLog == nil
+}
+
+// MergeAndDestroy absorbs the supplied Result while validating that the
+// resulting Result makes sense. The argument should not be used after
+// being passed to this method.
+func (p *Result) MergeAndDestroy(q Result) error {
+	p.Local.AcquiredLocks = append(p.Local.AcquiredLocks, q.Local.AcquiredLocks...)
+	p.Local.ResolvedLocks = append(p.Local.ResolvedLocks, q.Local.ResolvedLocks...)
+	p.Local.UpdatedTxns = append(p.Local.UpdatedTxns, q.Local.UpdatedTxns...)
+	p.Local.ExternalLocks = append(p.Local.ExternalLocks, q.Local.ExternalLocks...)
+
+	if q.Replicated.Split != nil || q.Replicated.Merge != nil || q.Replicated.ChangeReplicas != nil {
+		if p.Replicated.Split != nil || p.Replicated.Merge != nil || p.Replicated.ChangeReplicas != nil {
+			return errors.New("conflicting split, merge or replica change")
+		}
+		p.Replicated.Split = q.Replicated.Split
+		p.Replicated.Merge = q.Replicated.Merge
+		p.Replicated.ChangeReplicas = q.Replicated.ChangeReplicas
+	}
+	if q.Replicated.RaftTruncatedState != nil {
+		if p.Replicated.RaftTruncatedState != nil {
+			return errors.New("conflicting RaftTruncatedState")
+		}
+		p.Replicated.RaftTruncatedState = q.Replicated.RaftTruncatedState
+	}
+	if q.Replicated.Lease != nil {
+		if p.Replicated.Lease != nil {
+			return errors.New("conflicting lease")
+		}
+		p.Replicated.Lease = q.Replicated.Lease
+	}
+	p.Replicated.IsLeaseRequest = p.Replicated.IsLeaseRequest || q.Replicated.IsLeaseRequest
+	p.Replicated.Delta.Add(q.Replicated.Delta)
+	if q.LogicalOpLog != nil {
+		if p.LogicalOpLog == nil {
+			p.LogicalOpLog = q.LogicalOpLog
+		} else {
+			p.LogicalOpLog.Ops = append(p.LogicalOpLog.Ops, q.LogicalOpLog.Ops...)
+		}
+	}
+	return nil
+}
+
+// WithAcquiredLocks creates a Result communicating that the supplied lock
+// acquisitions (or re-acquisitions) were performed by the caller. This is
+// typically used by read-only requests that acquire unreplicated locks.
+func WithAcquiredLocks(acqs ...roachpb.LockAcquisition) Result {
+	var pd Result
+	pd.Local.AcquiredLocks = acqs
+	return pd
+}
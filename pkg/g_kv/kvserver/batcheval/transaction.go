@@ -0,0 +1,65 @@
+package batcheval
+
+import (
+	"context"
+	keys "github.com/dborchard/tiny_crdb/pkg/g_keys"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/spanset"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	storage "github.com/dborchard/tiny_crdb/pkg/h_storage"
+	"github.com/dborchard/tiny_crdb/pkg/h_storage/enginepb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+)
+
+// declareKeysWriteTransaction declares a write latch on the record of the
+// transaction in the request's header.
+func declareKeysWriteTransaction(header *kvpb.Header, req kvpb.Request, latchSpans *spanset.SpanSet) {
+	if header.Txn != nil {
+		latchSpans.AddNonMVCC(spanset.SpanReadWrite, roachpb.Span{
+			Key: keys.TransactionKey(req.Header().Key, header.Txn.ID),
+		})
+	}
+}
+
+// SynthesizeTxnFromMeta creates a synthetic transaction object from
+// the provided transaction metadata. The synthetic transaction is not
+// meant to be persisted, but can serve as a representation of the
+// transaction for outside observation. The function assumes that it
+// is only used for transactions without a transaction record; such a
+// transaction is PENDING and was last known to be active when it
+// started, so it expires TxnLivenessThreshold after its MinTimestamp.
+func SynthesizeTxnFromMeta(meta enginepb.TxnMeta) roachpb.Transaction {
+	return roachpb.Transaction{
+		TxnMeta:       meta,
+		Status:        roachpb.PENDING,
+		LastHeartbeat: meta.MinTimestamp,
+	}
+}
+
+// readTxnRecord reads the record of the transaction described by meta. The
+// returned boolean is false if the transaction has no record.
+func readTxnRecord(
+	ctx context.Context, reader storage.Reader, meta enginepb.TxnMeta,
+) (roachpb.Transaction, bool, error) {
+	var txn roachpb.Transaction
+	key := keys.TransactionKey(meta.Key, meta.ID)
+	ok, err := storage.MVCCGetProto(ctx, reader, key, hlc.Timestamp{}, &txn, storage.MVCCGetOptions{})
+	return txn, ok, err
+}
+
+// writeTxnRecord persists the transaction record. Transaction records are
+// unversioned: each write replaces the previous state of the record. Only
+// the fields of the transaction that are meaningful to other transactions
+// are persisted.
+func writeTxnRecord(ctx context.Context, readWriter storage.ReadWriter, txn *roachpb.Transaction) error {
+	record := roachpb.Transaction{
+		TxnMeta:        txn.TxnMeta,
+		Name:           txn.Name,
+		Status:         txn.Status,
+		LastHeartbeat:  txn.LastHeartbeat,
+		LockSpans:      txn.LockSpans,
+		InFlightWrites: txn.InFlightWrites,
+	}
+	key := keys.TransactionKey(txn.Key, txn.ID)
+	return storage.MVCCPutProto(ctx, readWriter, key, hlc.Timestamp{}, &record, storage.MVCCWriteOptions{})
+}
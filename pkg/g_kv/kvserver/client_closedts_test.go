@@ -0,0 +1,98 @@
+package kvserver_test
+
+import (
+	"context"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/dborchard/tiny_crdb/pkg/z_testutils/testcluster"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+// followerStore returns a store of the cluster which holds a replica of the
+// range containing the key, but not its lease.
+func followerStore(t *testing.T, tc *testcluster.TestCluster, key string) *kvserver.Store {
+	holder, err := tc.LeaseHolderStore(roachpb.Key(key))
+	require.NoError(t, err)
+	return tc.Server(int(holder.StoreID()) % tc.NumServers()).Store()
+}
+
+// sendGet sends a non-transactional Get of the key at the timestamp to the
+// store.
+func sendGet(
+	t *testing.T, s *kvserver.Store, key string, ts hlc.Timestamp,
+) (*kvpb.GetResponse, *kvpb.Error) {
+	ba := &kvpb.BatchRequest{}
+	ba.Timestamp = ts
+	ba.Add(&kvpb.GetRequest{RequestHeader: kvpb.RequestHeader{Key: roachpb.Key(key)}})
+	br, pErr := s.Send(context.Background(), ba)
+	if pErr != nil {
+		return nil, pErr
+	}
+	return br.Responses[0].GetInner().(*kvpb.GetResponse), nil
+}
+
+// TestFollowerReadsBelowClosedTimestamp verifies that the followers of an
+// idle range learn of its closed timestamp through the side transport, and
+// serve the reads at or below it without the lease, while they redirect the
+// more recent reads to the leaseholder.
+func TestFollowerReadsBelowClosedTimestamp(t *testing.T) {
+	tc := testcluster.StartTestCluster(t, 3)
+	putString(t, tc.Server(0).DB(), "a", "1")
+
+	follower := followerStore(t, tc, "a")
+	repl := follower.LookupReplica(roachpb.RKey("a"))
+	ts := follower.Clock().Now()
+	require.Eventually(t, func() bool {
+		return ts.LessEq(repl.GetCurrentClosedTimestamp())
+	}, 10*time.Second, time.Millisecond)
+
+	resp, pErr := sendGet(t, follower, "a", ts)
+	require.Nil(t, pErr)
+	require.NotNil(t, resp.Value)
+	b, err := resp.Value.GetBytes()
+	require.NoError(t, err)
+	require.Equal(t, "1", string(b))
+	require.False(t, repl.OwnsValidLease())
+
+	_, pErr = sendGet(t, follower, "a", hlc.MaxTimestamp.Prev())
+	require.IsType(t, &kvpb.NotLeaseHolderError{}, pErr.GetDetail())
+}
+
+// TestWritesAboveClosedTimestamp verifies that the leaseholder of a range
+// moves the writes that it serves above its closed timestamp, so that they
+// don't invalidate the follower reads served below it.
+func TestWritesAboveClosedTimestamp(t *testing.T) {
+	ctx := context.Background()
+	tc := testcluster.StartTestCluster(t, 3)
+	putString(t, tc.Server(0).DB(), "a", "1")
+
+	holder, err := tc.LeaseHolderStore(roachpb.Key("a"))
+	require.NoError(t, err)
+	follower := followerStore(t, tc, "a")
+	followerRepl := follower.LookupReplica(roachpb.RKey("a"))
+	old := holder.Clock().Now()
+	require.Eventually(t, func() bool {
+		return old.LessEq(followerRepl.GetCurrentClosedTimestamp())
+	}, 10*time.Second, time.Millisecond)
+
+	ba := &kvpb.BatchRequest{}
+	ba.Timestamp = old
+	ba.Add(&kvpb.PutRequest{
+		RequestHeader: kvpb.RequestHeader{Key: roachpb.Key("a")},
+		Value:         roachpb.MakeValueFromString("2"),
+	})
+	br, pErr := holder.Send(ctx, ba)
+	require.Nil(t, pErr)
+	require.True(t, old.Less(br.Timestamp))
+
+	// The follower reads at the old timestamp still see the old value.
+	resp, pErr := sendGet(t, follower, "a", old)
+	require.Nil(t, pErr)
+	b, err := resp.Value.GetBytes()
+	require.NoError(t, err)
+	require.Equal(t, "1", string(b))
+}
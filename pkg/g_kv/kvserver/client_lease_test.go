@@ -0,0 +1,146 @@
+package kvserver_test
+
+import (
+	"context"
+	keys "github.com/dborchard/tiny_crdb/pkg/g_keys"
+	kv "github.com/dborchard/tiny_crdb/pkg/g_kv"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/kvserverpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/liveness/livenesspb"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/dborchard/tiny_crdb/pkg/z_testutils/kvclientutils"
+	"github.com/dborchard/tiny_crdb/pkg/z_testutils/testcluster"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+// TestLeaseAcquiredOnDemand verifies that the ranges acquire their leases
+// when they first serve requests: epoch-based leases for the user data, and
+// expiration-based leases for the liveness records.
+func TestLeaseAcquiredOnDemand(t *testing.T) {
+	tc := testcluster.StartTestCluster(t, 3)
+	putString(t, tc.Server(1).DB(), "a", "1")
+
+	s, err := tc.LeaseHolderStore(roachpb.Key("a"))
+	require.NoError(t, err)
+	lease := s.LookupReplica(roachpb.RKey("a")).GetLease()
+	require.Equal(t, roachpb.LeaseEpoch, lease.Type())
+	require.Equal(t, s.StoreID(), lease.Replica.StoreID)
+
+	livenessKey := keys.NodeLivenessKey(1)
+	s, err = tc.LeaseHolderStore(livenessKey)
+	require.NoError(t, err)
+	lease = s.LookupReplica(roachpb.RKey(livenessKey)).GetLease()
+	require.Equal(t, roachpb.LeaseExpiration, lease.Type())
+}
+
+// TestLeaseTransfer verifies that AdminTransferLease moves the lease of a
+// range to the target store, whose replica then becomes the leader of the
+// range and serves its writes.
+func TestLeaseTransfer(t *testing.T) {
+	ctx := context.Background()
+	tc := testcluster.StartTestCluster(t, 3)
+	putString(t, tc.Server(0).DB(), "a", "1")
+
+	holder, err := tc.LeaseHolderStore(roachpb.Key("a"))
+	require.NoError(t, err)
+	target := holder.StoreID()%3 + 1
+	prevLease := holder.LookupReplica(roachpb.RKey("a")).GetLease()
+	// The leaseholder only transfers the lease to a node that it sees live.
+	holderLiveness := tc.Server(int(holder.StoreID()) - 1).NodeLiveness()
+	require.Eventually(t, func() bool {
+		live, err := holderLiveness.IsLive(roachpb.NodeID(target))
+		return err == nil && live
+	}, 10*time.Second, time.Millisecond)
+	require.NoError(t, tc.Server(0).DB().AdminTransferLease(ctx, "a", target))
+
+	targetStore := tc.Server(int(target) - 1).Store()
+	require.Eventually(t, func() bool {
+		return targetStore.LookupReplica(roachpb.RKey("a")).OwnsValidLease()
+	}, 10*time.Second, time.Millisecond)
+	lease := targetStore.LookupReplica(roachpb.RKey("a")).GetLease()
+	require.Equal(t, prevLease.Sequence+1, lease.Sequence)
+
+	// The former leader transfers its leadership to the new leaseholder.
+	require.Eventually(t, func() bool {
+		leader, err := tc.LeaderStore(roachpb.Key("a"))
+		return err == nil && leader.StoreID() == target
+	}, 10*time.Second, time.Millisecond)
+
+	putString(t, tc.Server(2).DB(), "a", "2")
+	requireValueReplicated(t, tc, "a", "2", 0, 1, 2)
+	require.NoError(t, tc.Server(1).DB().Txn(ctx, func(ctx context.Context, txn *kv.Txn) error {
+		require.Equal(t, "2", kvclientutils.GetString(t, ctx, txn, "a"))
+		return nil
+	}))
+}
+
+// TestLeaseFailover verifies that the epoch-based lease of a stopped node is
+// revoked once its liveness record expires, by incrementing the epoch of the
+// record, and that another replica acquires the lease.
+func TestLeaseFailover(t *testing.T) {
+	tc := testcluster.StartTestCluster(t, 3)
+	putString(t, tc.Server(0).DB(), "a", "1")
+
+	holder, err := tc.LeaseHolderStore(roachpb.Key("a"))
+	require.NoError(t, err)
+	prevLease := holder.LookupReplica(roachpb.RKey("a")).GetLease()
+	idx := int(holder.StoreID()) - 1
+	tc.StopServer(idx)
+
+	other := tc.Server((idx + 1) % 3)
+	putString(t, other.DB(), "a", "2")
+	holder, err = tc.LeaseHolderStore(roachpb.Key("a"))
+	require.NoError(t, err)
+	require.NotEqual(t, prevLease.Replica.StoreID, holder.StoreID())
+
+	require.Eventually(t, func() bool {
+		l, ok := other.NodeLiveness().GetLiveness(prevLease.Replica.NodeID)
+		return ok && l.Epoch > prevLease.Epoch
+	}, 10*time.Second, time.Millisecond)
+}
+
+// TestLeaseRevocationOfLiveNode verifies that a replica which finds the
+// liveness record of the leaseholder's node expired in its stale cache, while
+// the node is live, does not acquire the lease: the lease request fails with a
+// NotLeaseHolderError pointing to the leaseholder, and the cache is refreshed.
+func TestLeaseRevocationOfLiveNode(t *testing.T) {
+	ctx := context.Background()
+	tc := testcluster.StartTestCluster(t, 3)
+	putString(t, tc.Server(0).DB(), "a", "1")
+
+	holder, err := tc.LeaseHolderStore(roachpb.Key("a"))
+	require.NoError(t, err)
+	lease := holder.LookupReplica(roachpb.RKey("a")).GetLease()
+	require.Equal(t, roachpb.LeaseEpoch, lease.Type())
+	other := tc.Server(int(holder.StoreID()) % 3)
+	nl := other.NodeLiveness()
+	var live livenesspb.Liveness
+	require.Eventually(t, func() bool {
+		var ok bool
+		live, ok = nl.GetLiveness(lease.Replica.NodeID)
+		return ok && live.Epoch == lease.Epoch
+	}, 10*time.Second, time.Millisecond)
+
+	stale := live
+	stale.Expiration = hlc.Timestamp{WallTime: 1}
+	st := kvserverpb.LeaseStatus{
+		Lease:    lease,
+		Now:      other.Clock().NowAsClockTimestamp(),
+		State:    kvserverpb.LeaseState_EXPIRED,
+		Liveness: stale,
+	}
+	err = other.Store().LookupReplica(roachpb.RKey("a")).RequestEpochLease(ctx, st)
+	var nlhe *kvpb.NotLeaseHolderError
+	require.ErrorAs(t, err, &nlhe)
+	require.NotNil(t, nlhe.Lease)
+	require.Equal(t, lease.Replica, nlhe.Lease.Replica)
+
+	refreshed, ok := nl.GetLiveness(lease.Replica.NodeID)
+	require.True(t, ok)
+	require.Equal(t, lease.Epoch, refreshed.Epoch)
+	require.True(t, refreshed.IsLive(other.Clock().Now()))
+	require.True(t, holder.LookupReplica(roachpb.RKey("a")).OwnsValidLease())
+}
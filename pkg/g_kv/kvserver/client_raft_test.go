@@ -0,0 +1,298 @@
+package kvserver_test
+
+import (
+	"context"
+	"fmt"
+	kv "github.com/dborchard/tiny_crdb/pkg/g_kv"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/stateloader"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	storage "github.com/dborchard/tiny_crdb/pkg/h_storage"
+	"github.com/dborchard/tiny_crdb/pkg/z_testutils/kvclientutils"
+	"github.com/dborchard/tiny_crdb/pkg/z_testutils/testcluster"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+// putString writes the value of the key in a transaction.
+func putString(t *testing.T, db *kv.DB, key, value string) {
+	require.NoError(t, db.Txn(context.Background(), func(ctx context.Context, txn *kv.Txn) error {
+		return txn.Put(ctx, key, value)
+	}))
+}
+
+// requireValueReplicated waits for the engine of each of the nodes with the
+// indexes to hold the value of the key.
+func requireValueReplicated(
+	t *testing.T, tc *testcluster.TestCluster, key, value string, idxs ...int,
+) {
+	ctx := context.Background()
+	for _, idx := range idxs {
+		require.Eventually(t, func() bool {
+			res, err := storage.MVCCGet(ctx, tc.Engine(idx), roachpb.Key(key),
+				hlc.MaxTimestamp, storage.MVCCGetOptions{})
+			if err != nil || res.Value == nil {
+				return false
+			}
+			b, err := res.Value.GetBytes()
+			return err == nil && string(b) == value
+		}, 10*time.Second, time.Millisecond, "n%d does not hold %s=%s", idx+1, key, value)
+	}
+}
+
+// TestRaftReplicatesWrites verifies that writes are applied by all the
+// replicas of their range, and that they can be sent from any node.
+func TestRaftReplicatesWrites(t *testing.T) {
+	ctx := context.Background()
+	tc := testcluster.StartTestCluster(t, 3)
+
+	putString(t, tc.Server(0).DB(), "a", "1")
+	requireValueReplicated(t, tc, "a", "1", 0, 1, 2)
+
+	require.NoError(t, tc.Server(2).DB().Txn(ctx, func(ctx context.Context, txn *kv.Txn) error {
+		if err := txn.Put(ctx, "b", "2"); err != nil {
+			return err
+		}
+		return txn.Put(ctx, "c", "3")
+	}))
+	requireValueReplicated(t, tc, "b", "2", 0, 1, 2)
+	requireValueReplicated(t, tc, "c", "3", 0, 1, 2)
+}
+
+// TestRaftLeaderRestart verifies that a range elects a new leader when its
+// leader's node is stopped, and that the node catches up on the writes it
+// missed once it is restarted.
+func TestRaftLeaderRestart(t *testing.T) {
+	ctx := context.Background()
+	tc := testcluster.StartTestCluster(t, 3)
+	putString(t, tc.Server(0).DB(), "a", "1")
+
+	leader, err := tc.LeaderStore(roachpb.Key("a"))
+	require.NoError(t, err)
+	leaderIdx := int(leader.NodeID()) - 1
+	otherIdx := (leaderIdx + 1) % tc.NumServers()
+	tc.StopServer(leaderIdx)
+
+	putString(t, tc.Server(otherIdx).DB(), "a", "2")
+	newLeader, err := tc.LeaderStore(roachpb.Key("a"))
+	require.NoError(t, err)
+	require.NotEqual(t, leader.NodeID(), newLeader.NodeID())
+
+	require.NoError(t, tc.RestartServer(leaderIdx))
+	requireValueReplicated(t, tc, "a", "2", 0, 1, 2)
+	require.NoError(t, tc.Server(leaderIdx).DB().Txn(ctx, func(ctx context.Context, txn *kv.Txn) error {
+		require.Equal(t, "2", kvclientutils.GetString(t, ctx, txn, "a"))
+		return nil
+	}))
+}
+
+// TestRaftWritesAcrossLeaderChange verifies that the writes in flight while
+// the leader of their range is stopped, whose proposals may be dropped or
+// replaced by the entries of the next leader, are applied once the range
+// elects a new leader.
+func TestRaftWritesAcrossLeaderChange(t *testing.T) {
+	ctx := context.Background()
+	tc := testcluster.StartTestCluster(t, 3)
+	putString(t, tc.Server(0).DB(), "a", "1")
+
+	leader, err := tc.LeaderStore(roachpb.Key("a"))
+	require.NoError(t, err)
+	leaderIdx := int(leader.NodeID()) - 1
+	otherIdxs := []int{(leaderIdx + 1) % tc.NumServers(), (leaderIdx + 2) % tc.NumServers()}
+	db := tc.Server(otherIdxs[0]).DB()
+
+	const numWrites = 10
+	errCh := make(chan error, numWrites)
+	for i := 0; i < numWrites; i++ {
+		key := fmt.Sprintf("k%d", i)
+		go func() {
+			errCh <- db.Txn(ctx, func(ctx context.Context, txn *kv.Txn) error {
+				return txn.Put(ctx, key, "v")
+			})
+		}()
+	}
+	tc.StopServer(leaderIdx)
+	for i := 0; i < numWrites; i++ {
+		require.NoError(t, <-errCh)
+	}
+	for i := 0; i < numWrites; i++ {
+		requireValueReplicated(t, tc, fmt.Sprintf("k%d", i), "v", otherIdxs...)
+	}
+}
+
+// TestRaftRemoveReplica verifies that a replica is removed from its range
+// through a joint configuration, after which the range keeps serving writes
+// and the removed replica's data is cleared.
+func TestRaftRemoveReplica(t *testing.T) {
+	ctx := context.Background()
+	tc := testcluster.StartTestCluster(t, 3)
+	putString(t, tc.Server(0).DB(), "a", "1")
+	requireValueReplicated(t, tc, "a", "1", 0, 1, 2)
+
+	leader, err := tc.LeaderStore(roachpb.Key("a"))
+	require.NoError(t, err)
+	repl := leader.LookupReplica(roachpb.RKey("a"))
+	desc := *repl.Desc()
+	var target roachpb.ReplicationTarget
+	for _, rd := range desc.InternalReplicas {
+		if rd.StoreID != leader.StoreID() {
+			target = roachpb.ReplicationTarget{NodeID: rd.NodeID, StoreID: rd.StoreID}
+			break
+		}
+	}
+
+	newDesc, err := tc.Server(0).DB().AdminChangeReplicas(ctx, "a", desc,
+		kvpb.MakeReplicationChanges(roachpb.REMOVE_VOTER, target))
+	require.NoError(t, err)
+	require.Len(t, newDesc.InternalReplicas, 2)
+	require.False(t, newDesc.InAtomicReplicationChange())
+	_, ok := newDesc.GetReplicaDescriptor(target.StoreID)
+	require.False(t, ok)
+
+	removedIdx := int(target.NodeID) - 1
+	removedStore := tc.Server(removedIdx).Store()
+	require.Eventually(t, func() bool {
+		_, err := removedStore.GetReplica(desc.RangeID)
+		return err != nil
+	}, 10*time.Second, time.Millisecond)
+	res, err := storage.MVCCGet(ctx, tc.Engine(removedIdx), roachpb.Key("a"),
+		hlc.MaxTimestamp, storage.MVCCGetOptions{})
+	require.NoError(t, err)
+	require.Nil(t, res.Value)
+
+	putString(t, tc.Server(removedIdx).DB(), "a", "2")
+	for i := 0; i < tc.NumServers(); i++ {
+		if i != removedIdx {
+			requireValueReplicated(t, tc, "a", "2", i)
+		}
+	}
+}
+
+// TestRaftRemoveReplicaWhileDown verifies that a replica removed from its
+// range while its node is down, which therefore never applies its removal, is
+// garbage-collected once the node restarts.
+func TestRaftRemoveReplicaWhileDown(t *testing.T) {
+	ctx := context.Background()
+	tc := testcluster.StartTestCluster(t, 3)
+	putString(t, tc.Server(0).DB(), "a", "1")
+	requireValueReplicated(t, tc, "a", "1", 0, 1, 2)
+
+	leader, err := tc.LeaderStore(roachpb.Key("a"))
+	require.NoError(t, err)
+	desc := *leader.LookupReplica(roachpb.RKey("a")).Desc()
+	var target roachpb.ReplicationTarget
+	for _, rd := range desc.InternalReplicas {
+		if rd.StoreID != leader.StoreID() {
+			target = roachpb.ReplicationTarget{NodeID: rd.NodeID, StoreID: rd.StoreID}
+			break
+		}
+	}
+	removedIdx := int(target.NodeID) - 1
+	tc.StopServer(removedIdx)
+
+	_, err = leader.DB().AdminChangeReplicas(ctx, "a", desc,
+		kvpb.MakeReplicationChanges(roachpb.REMOVE_VOTER, target))
+	require.NoError(t, err)
+
+	require.NoError(t, tc.RestartServer(removedIdx))
+	removedStore := tc.Server(removedIdx).Store()
+	require.Eventually(t, func() bool {
+		_, err := removedStore.GetReplica(desc.RangeID)
+		return err != nil
+	}, 10*time.Second, 10*time.Millisecond)
+	res, err := storage.MVCCGet(ctx, tc.Engine(removedIdx), roachpb.Key("a"),
+		hlc.MaxTimestamp, storage.MVCCGetOptions{})
+	require.NoError(t, err)
+	require.Nil(t, res.Value)
+}
+
+// TestRaftAddReplicaSnapshot verifies that a replica added to a range is
+// created on its store from an INITIAL snapshot of the range, and then
+// applies the range's writes.
+func TestRaftAddReplicaSnapshot(t *testing.T) {
+	ctx := context.Background()
+	tc := testcluster.StartTestCluster(t, 3)
+	putString(t, tc.Server(0).DB(), "a", "1")
+	requireValueReplicated(t, tc, "a", "1", 0, 1, 2)
+
+	leader, err := tc.LeaderStore(roachpb.Key("a"))
+	require.NoError(t, err)
+	desc := *leader.LookupReplica(roachpb.RKey("a")).Desc()
+	var target roachpb.ReplicationTarget
+	for _, rd := range desc.InternalReplicas {
+		if rd.StoreID != leader.StoreID() {
+			target = roachpb.ReplicationTarget{NodeID: rd.NodeID, StoreID: rd.StoreID}
+			break
+		}
+	}
+	targetIdx := int(target.NodeID) - 1
+	newDesc, err := tc.Server(0).DB().AdminChangeReplicas(ctx, "a", desc,
+		kvpb.MakeReplicationChanges(roachpb.REMOVE_VOTER, target))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		_, err := tc.Server(targetIdx).Store().GetReplica(desc.RangeID)
+		return err != nil
+	}, 10*time.Second, time.Millisecond)
+
+	// The value written while the store holds no replica of the range is part
+	// of the snapshot.
+	putString(t, tc.Server(0).DB(), "a", "2")
+	newDesc, err = tc.Server(0).DB().AdminChangeReplicas(ctx, "a", *newDesc,
+		kvpb.MakeReplicationChanges(roachpb.ADD_VOTER, target))
+	require.NoError(t, err)
+	require.Len(t, newDesc.InternalReplicas, 3)
+	rd, ok := newDesc.GetReplicaDescriptor(target.StoreID)
+	require.True(t, ok)
+	require.Equal(t, roachpb.VOTER_FULL, rd.Type)
+
+	repl, err := tc.Server(targetIdx).Store().GetReplica(desc.RangeID)
+	require.NoError(t, err)
+	require.Equal(t, rd.ReplicaID, repl.ReplicaID())
+	requireValueReplicated(t, tc, "a", "2", targetIdx)
+
+	putString(t, tc.Server(targetIdx).DB(), "a", "3")
+	requireValueReplicated(t, tc, "a", "3", 0, 1, 2)
+}
+
+// TestRaftSnapshotAfterLogTruncation verifies that a follower which needs
+// entries truncated from the log of its leader catches up through a Raft
+// snapshot of the range.
+func TestRaftSnapshotAfterLogTruncation(t *testing.T) {
+	ctx := context.Background()
+	tc := testcluster.StartTestCluster(t, 3)
+	putString(t, tc.Server(0).DB(), "a", "1")
+	requireValueReplicated(t, tc, "a", "1", 0, 1, 2)
+
+	leader, err := tc.LeaderStore(roachpb.Key("a"))
+	require.NoError(t, err)
+	leaderIdx := int(leader.NodeID()) - 1
+	followerIdx := (leaderIdx + 1) % tc.NumServers()
+	rangeID := leader.LookupReplica(roachpb.RKey("a")).RangeID
+	tc.StopServer(followerIdx)
+	rsl := stateloader.Make(rangeID)
+	followerLastIndex, err := rsl.LoadLastIndex(ctx, tc.Engine(followerIdx))
+	require.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		putString(t, tc.Server(leaderIdx).DB(), "a", fmt.Sprintf("%d", i+2))
+	}
+	// Once the leader deems the stopped follower inactive, it truncates the
+	// entries that the follower needs.
+	require.Eventually(t, func() bool {
+		require.NoError(t, leader.ForceRaftLogScanAndProcess(ctx))
+		ts, err := rsl.LoadRaftTruncatedState(ctx, tc.Engine(leaderIdx))
+		require.NoError(t, err)
+		return ts.Index > followerLastIndex
+	}, 10*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, tc.RestartServer(followerIdx))
+	requireValueReplicated(t, tc, "a", "11", 0, 1, 2)
+	ts, err := rsl.LoadRaftTruncatedState(ctx, tc.Engine(followerIdx))
+	require.NoError(t, err)
+	require.Greater(t, ts.Index, followerLastIndex)
+
+	putString(t, tc.Server(followerIdx).DB(), "a", "12")
+	requireValueReplicated(t, tc, "a", "12", 0, 1, 2)
+}
@@ -0,0 +1,131 @@
+package kvserver_test
+
+import (
+	"context"
+	kv "github.com/dborchard/tiny_crdb/pkg/g_kv"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvclient/rangefeed"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/dborchard/tiny_crdb/pkg/z_testutils/testcluster"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+	"time"
+)
+
+// rangeFeedRecorder records the values and the frontier of a rangefeed.
+type rangeFeedRecorder struct {
+	mu       sync.Mutex
+	values   map[string]string
+	frontier hlc.Timestamp
+}
+
+func (r *rangeFeedRecorder) onValue(_ context.Context, v *kvpb.RangeFeedValue) {
+	b, _ := v.Value.GetBytes()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.values[string(v.Key)] = string(b)
+}
+
+func (r *rangeFeedRecorder) onFrontierAdvance(_ context.Context, ts hlc.Timestamp) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.frontier = ts
+}
+
+func (r *rangeFeedRecorder) value(key string) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	v, ok := r.values[key]
+	return v, ok
+}
+
+func (r *rangeFeedRecorder) getFrontier() hlc.Timestamp {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.frontier
+}
+
+// TestRangeFeed verifies that a rangefeed catches up on the values written
+// after its start timestamp, streams the values written later, holds back its
+// frontier below the unresolved intents, and survives the split of its range.
+func TestRangeFeed(t *testing.T) {
+	ctx := context.Background()
+	tc := testcluster.StartTestCluster(t, 3)
+	ts := tc.Server(0)
+	db := ts.DB()
+
+	putString(t, db, "a", "1")
+	startTS := ts.Clock().Now()
+	putString(t, db, "a", "2")
+
+	rec := &rangeFeedRecorder{values: map[string]string{}}
+	f := rangefeed.NewFactory(ts.Stopper(), db, ts.DistSender())
+	span := roachpb.Span{Key: roachpb.Key("a"), EndKey: roachpb.Key("z")}
+	r, err := f.RangeFeed(ctx, "test", []roachpb.Span{span}, startTS, rec.onValue,
+		rangefeed.WithOnFrontierAdvance(rec.onFrontierAdvance))
+	require.NoError(t, err)
+	defer r.Close()
+
+	waitForValue := func(key, value string) {
+		require.Eventually(t, func() bool {
+			v, ok := rec.value(key)
+			return ok && v == value
+		}, 10*time.Second, time.Millisecond)
+	}
+
+	// The catch-up scan only outputs the values above the start timestamp.
+	waitForValue("a", "2")
+	putString(t, db, "b", "3")
+	waitForValue("b", "3")
+
+	// An open transaction holds back the frontier below its intent, even
+	// once the closed timestamp of the range has passed it. The commit is then
+	// pushed above the closed timestamp, and retried.
+	wrote := make(chan hlc.Timestamp, 1)
+	commit := make(chan struct{})
+	txnErr := make(chan error, 1)
+	go func() {
+		txnErr <- db.Txn(ctx, func(ctx context.Context, txn *kv.Txn) error {
+			if err := txn.Put(ctx, "c", "4"); err != nil {
+				return err
+			}
+			select {
+			case wrote <- txn.TestingCloneTxn().WriteTimestamp:
+				<-commit
+			default:
+			}
+			return nil
+		})
+	}()
+	intentTS := <-wrote
+	repl := ts.Store().LookupReplica(roachpb.RKey("c"))
+	require.Eventually(t, func() bool {
+		return intentTS.Less(repl.GetCurrentClosedTimestamp())
+	}, 10*time.Second, time.Millisecond)
+	require.Eventually(t, func() bool {
+		return !rec.getFrontier().IsEmpty()
+	}, 10*time.Second, time.Millisecond)
+	require.True(t, rec.getFrontier().Less(intentTS))
+	_, ok := rec.value("c")
+	require.False(t, ok)
+
+	close(commit)
+	require.NoError(t, <-txnErr)
+	waitForValue("c", "4")
+	require.Eventually(t, func() bool {
+		return intentTS.Less(rec.getFrontier())
+	}, 10*time.Second, time.Millisecond)
+
+	// The rangefeed is re-established on both sides of a split.
+	require.NoError(t, db.AdminSplit(ctx, "m", hlc.Timestamp{}))
+	putString(t, db, "d", "5")
+	putString(t, db, "n", "6")
+	waitForValue("d", "5")
+	waitForValue("n", "6")
+	splitTS := ts.Clock().Now()
+	require.Eventually(t, func() bool {
+		return splitTS.LessEq(rec.getFrontier())
+	}, 10*time.Second, time.Millisecond)
+}
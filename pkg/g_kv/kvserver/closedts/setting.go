@@ -0,0 +1,39 @@
+// Package closedts holds the closed timestamp mechanism of the ranges.
+//
+// The leaseholder of a range closes timestamps: it promises not to serve any
+// write at or below its closed timestamp, which trails the present by a
+// target duration. The closed timestamp is published to the followers of the
+// range along with the commands proposed by the leaseholder and, for ranges
+// which see no writes, through a side transport. A follower which has
+// applied the commands up to the point at which a timestamp was closed holds
+// all the data at or below it, and serves reads there without the lease.
+package closedts
+
+import (
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"time"
+)
+
+const (
+	// DefaultTargetDuration is the default lag of the closed timestamps of
+	// the ranges behind the present.
+	DefaultTargetDuration = 3 * time.Second
+	// DefaultSideTransportCloseInterval is the default interval at which
+	// the leaseholders publish their closed timestamps through the side
+	// transport.
+	DefaultSideTransportCloseInterval = 200 * time.Millisecond
+)
+
+// TargetForPolicy returns the timestamp that a leaseholder attempts to close
+// at the clock reading now: the reading, lagging by the target duration.
+func TargetForPolicy(now hlc.ClockTimestamp, targetDuration time.Duration) hlc.Timestamp {
+	return now.ToTimestamp().Add(-targetDuration.Nanoseconds(), 0)
+}
+
+// FollowerReadLag returns the staleness of the timestamps at which reads can
+// be expected to be served by any replica. It accounts for the target lag of
+// the closed timestamps, and for the interval at which they are published
+// through the side transport, with some leeway.
+func FollowerReadLag(targetDuration, sideTransportInterval time.Duration) time.Duration {
+	return targetDuration + 2*sideTransportInterval
+}
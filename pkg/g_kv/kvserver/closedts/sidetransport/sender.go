@@ -0,0 +1,143 @@
+// Package sidetransport publishes the closed timestamps of the ranges whose
+// leaseholders see no writes, which otherwise only reach the followers along
+// with the commands of the leaseholders.
+package sidetransport
+
+import (
+	"context"
+	"fmt"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/closedts"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/stop"
+	"time"
+)
+
+// RangeUpdate is the closed timestamp of a range, as published by its
+// leaseholder.
+type RangeUpdate struct {
+	RangeID         roachpb.RangeID
+	ClosedTimestamp hlc.Timestamp
+	// AppliedIndex is the index of the Raft log up to which a follower
+	// must have applied the commands of the range for the closed timestamp
+	// to hold on it.
+	AppliedIndex uint64
+}
+
+// Update is the message sent by the sender of a store to another store: the
+// closed timestamps of the ranges led by the sender, of which the recipient
+// holds followers.
+type Update struct {
+	FromStoreID roachpb.StoreID
+	Ranges      []RangeUpdate
+}
+
+// BumpSideTransportClosedResult is the outcome of a replica's attempt to
+// close a timestamp for the side transport.
+type BumpSideTransportClosedResult struct {
+	// OK is set if the replica holds the lease of its range, and published
+	// ClosedTimestamp.
+	OK              bool
+	ClosedTimestamp hlc.Timestamp
+	// AppliedIndex is the index up to which the followers must have
+	// applied the commands of the range: that of the last command proposed
+	// by the leaseholder, or applied by it.
+	AppliedIndex uint64
+	// Desc is the descriptor of the range, whose replicas are the
+	// recipients of the closed timestamp.
+	Desc *roachpb.RangeDescriptor
+}
+
+// Replica is the interface of the replicas whose closed timestamps the
+// sender publishes.
+type Replica interface {
+	// BumpSideTransportClosed closes timestamps up to the target, if the
+	// replica holds a valid lease of its range and has no write in flight
+	// at or below it.
+	BumpSideTransportClosed(
+		ctx context.Context, now hlc.ClockTimestamp, target hlc.Timestamp,
+	) BumpSideTransportClosedResult
+}
+
+// SenderConfig configures a Sender.
+type SenderConfig struct {
+	Clock     *hlc.Clock
+	Stopper   *stop.Stopper
+	Transport Transport
+	// StoreID is the store whose replicas the sender publishes the closed
+	// timestamps of.
+	StoreID roachpb.StoreID
+	// VisitReplicas calls the function on each replica of the store, until
+	// it returns false.
+	VisitReplicas func(func(Replica) bool)
+	// TargetDuration is the lag of the closed timestamps behind the
+	// present.
+	TargetDuration time.Duration
+	// CloseInterval is the interval at which the closed timestamps are
+	// published.
+	CloseInterval time.Duration
+}
+
+// Sender periodically closes timestamps on the leaseholders of a store, and
+// publishes them to the stores holding their followers. Delivery is
+// best-effort: the next publication supersedes a dropped one.
+type Sender struct {
+	cfg SenderConfig
+}
+
+// NewSender returns a Sender for the store.
+func NewSender(cfg SenderConfig) *Sender {
+	return &Sender{cfg: cfg}
+}
+
+// Run starts publishing the closed timestamps, until the stopper quiesces.
+func (s *Sender) Run(ctx context.Context) error {
+	taskName := fmt.Sprintf("closedts side transport: s%d", s.cfg.StoreID)
+	return s.cfg.Stopper.RunAsyncTask(ctx, taskName, func(ctx context.Context) {
+		ticker := time.NewTicker(s.cfg.CloseInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.publish(ctx)
+			case <-s.cfg.Stopper.ShouldQuiesce():
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	})
+}
+
+// publish closes timestamps on the leaseholders of the store, and sends them
+// to the stores of their followers.
+func (s *Sender) publish(ctx context.Context) {
+	now := s.cfg.Clock.NowAsClockTimestamp()
+	target := closedts.TargetForPolicy(now, s.cfg.TargetDuration)
+	updates := make(map[roachpb.StoreID]*Update)
+	s.cfg.VisitReplicas(func(r Replica) bool {
+		res := r.BumpSideTransportClosed(ctx, now, target)
+		if !res.OK {
+			return true
+		}
+		for _, replDesc := range res.Desc.InternalReplicas {
+			if replDesc.StoreID == s.cfg.StoreID {
+				continue
+			}
+			u, ok := updates[replDesc.StoreID]
+			if !ok {
+				u = &Update{FromStoreID: s.cfg.StoreID}
+				updates[replDesc.StoreID] = u
+			}
+			u.Ranges = append(u.Ranges, RangeUpdate{
+				RangeID:         res.Desc.RangeID,
+				ClosedTimestamp: res.ClosedTimestamp,
+				AppliedIndex:    res.AppliedIndex,
+			})
+		}
+		return true
+	})
+	for storeID, u := range updates {
+		s.cfg.Transport.Send(storeID, u)
+	}
+}
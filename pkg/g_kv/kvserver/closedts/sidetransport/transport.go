@@ -0,0 +1,95 @@
+package sidetransport
+
+import (
+	"context"
+	"fmt"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/stop"
+	"sync"
+)
+
+// sendBufferSize is the number of updates which may be queued for a store
+// before further updates are dropped.
+const sendBufferSize = 16
+
+// Receiver is the interface that must be implemented by the recipients of
+// the updates of the side transport.
+type Receiver interface {
+	// HandleSideTransportUpdate is called for each update addressed to the
+	// receiving store. The ranges of which the store holds no replica are
+	// ignored.
+	HandleSideTransportUpdate(ctx context.Context, update *Update)
+}
+
+// Transport delivers the updates of the side transport between the stores
+// of a cluster. Delivery is best-effort.
+type Transport interface {
+	// Listen registers the receiver of the updates addressed to the store,
+	// until the stopper quiesces.
+	Listen(stopper *stop.Stopper, storeID roachpb.StoreID, receiver Receiver) error
+	// Send queues the update for delivery to the store. It returns false if
+	// the update was dropped.
+	Send(storeID roachpb.StoreID, update *Update) bool
+}
+
+// loopbackTransport is a Transport which delivers updates between the stores
+// of a single process. Each store drains the queue of its updates from a
+// task of its stopper, so that a stopped store no longer receives updates.
+type loopbackTransport struct {
+	mu     sync.Mutex
+	queues map[roachpb.StoreID]chan *Update
+}
+
+var _ Transport = &loopbackTransport{}
+
+// NewLoopbackTransport returns a Transport which delivers updates between
+// the stores of the process.
+func NewLoopbackTransport() Transport {
+	return &loopbackTransport{queues: make(map[roachpb.StoreID]chan *Update)}
+}
+
+// Listen implements the Transport interface.
+func (t *loopbackTransport) Listen(
+	stopper *stop.Stopper, storeID roachpb.StoreID, receiver Receiver,
+) error {
+	q := make(chan *Update, sendBufferSize)
+	t.mu.Lock()
+	t.queues[storeID] = q
+	t.mu.Unlock()
+
+	ctx := context.Background()
+	return stopper.RunAsyncTask(ctx, fmt.Sprintf("closedts side transport: receiver s%d", storeID), func(ctx context.Context) {
+		defer func() {
+			t.mu.Lock()
+			if t.queues[storeID] == q {
+				delete(t.queues, storeID)
+			}
+			t.mu.Unlock()
+		}()
+		for {
+			select {
+			case u := <-q:
+				receiver.HandleSideTransportUpdate(ctx, u)
+			case <-stopper.ShouldQuiesce():
+				return
+			}
+		}
+	})
+}
+
+// Send implements the Transport interface. The updates are immutable once
+// sent, and so are not copied.
+func (t *loopbackTransport) Send(storeID roachpb.StoreID, update *Update) bool {
+	t.mu.Lock()
+	q, ok := t.queues[storeID]
+	t.mu.Unlock()
+	if !ok {
+		return false
+	}
+	select {
+	case q <- update:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,48 @@
+package closedts
+
+import "github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+
+// RemovalToken identifies a timestamp tracked by a Tracker.
+type RemovalToken int64
+
+// Tracker tracks the timestamps of the writes which a leaseholder is
+// evaluating and proposing, so that it doesn't close a timestamp at or above
+// any of them. A write is tracked from the point at which its timestamp is
+// fixed until it is proposed, from where on the closed timestamp carried by
+// its command, or by any later one, is applied after it.
+//
+// A Tracker is not safe for concurrent use: the replica synchronizes it with
+// the closing of its timestamps.
+type Tracker struct {
+	next    RemovalToken
+	tracked map[RemovalToken]hlc.Timestamp
+}
+
+// NewTracker returns an empty Tracker.
+func NewTracker() *Tracker {
+	return &Tracker{tracked: make(map[RemovalToken]hlc.Timestamp)}
+}
+
+// Track adds the timestamp to the tracker. The returned token untracks it.
+func (t *Tracker) Track(ts hlc.Timestamp) RemovalToken {
+	t.next++
+	t.tracked[t.next] = ts
+	return t.next
+}
+
+// Untrack removes the timestamp identified by the token from the tracker.
+func (t *Tracker) Untrack(tok RemovalToken) {
+	delete(t.tracked, tok)
+}
+
+// LowerBound returns the lowest tracked timestamp, or an empty timestamp if
+// nothing is tracked.
+func (t *Tracker) LowerBound() hlc.Timestamp {
+	var lb hlc.Timestamp
+	for _, ts := range t.tracked {
+		if lb.IsEmpty() || ts.Less(lb) {
+			lb = ts
+		}
+	}
+	return lb
+}
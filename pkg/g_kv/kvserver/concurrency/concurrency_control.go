@@ -0,0 +1,209 @@
+// Package concurrency provides a concurrency manager structure that
+// encapsulates the details of concurrency control and contention handling for
+// serializable key-value transactions.
+package concurrency
+
+import (
+	"context"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/concurrency/lock"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/concurrency/poison"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/lockspanset"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/spanlatch"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/spanset"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/dborchard/tiny_crdb/pkg/h_storage/enginepb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+)
+
+// Manager is a structure that sequences incoming requests and provides
+// isolation between requests that intend to perform conflicting operations.
+// During sequencing, conflicts are discovered and any found are resolved
+// through a combination of passive queuing and active pushing. Once a request
+// has been sequenced, it is free to evaluate without concerns of conflicting
+// with other in-flight requests due to the isolation provided by the manager.
+// This isolation is guaranteed for the lifetime of the request but terminates
+// once the request completes.
+//
+// A request is sequenced in three steps:
+//
+//  1. it acquires latches on the spans that it declared, which provide
+//     mutual exclusion with the other requests being evaluated on overlapping
+//     spans. Latches are held only for the duration of evaluation.
+//  2. it scans the lock table for locks held by other transactions on the
+//     spans that it declared. Locks, unlike latches, are held by transactions
+//     until they commit or abort.
+//  3. if it found a conflicting lock, it releases its latches and waits in
+//     the lock's wait-queue until the lock is released, pushing the lock
+//     holder's transaction if it is not released soon. Waiters are released
+//     in FIFO order. The request then repeats the sequencing.
+//
+// Transactions that acquire locks inform the manager through the LockManager
+// interface, and the locks are released when they are resolved.
+type Manager interface {
+	RequestSequencer
+	LockManager
+
+	// TestingLockTableString returns a string representation of the lock
+	// table, for use in tests.
+	TestingLockTableString() string
+}
+
+// RequestSequencer is concerned with the sequencing of concurrent requests. It
+// is one of the roles of Manager.
+type RequestSequencer interface {
+	// SequenceReq acquires latches, checks for locks, and queues / waits /
+	// pushes as necessary. It returns a Guard that must be eventually released
+	// through FinishReq once the request has finished evaluating.
+	//
+	// An optional existing request Guard can be provided to SequenceReq. This
+	// allows the request's position in lock wait-queues to be retained across
+	// sequencing attempts. If provided, the guard should not be holding
+	// latches already.
+	SequenceReq(context.Context, *Guard, Request) (*Guard, *kvpb.Error)
+
+	// FinishReq marks the request as complete, releasing any protection the
+	// request had against conflicting requests and allowing conflicting
+	// requests that are blocked on this one to proceed. The guard should not
+	// be used after being released.
+	FinishReq(*Guard)
+
+	// PoisonReq idempotently marks a Guard as poisoned, indicating that its
+	// latches may be held for an indefinite amount of time. Requests waiting
+	// on this Guard will be notified. Latch acquisitions under
+	// poison.Policy_Error react to this by failing with a
+	// poison.PoisonedError, while requests under poison.Policy_Wait continue
+	// waiting, but propagate the poisoning upwards.
+	//
+	// See poison.Policy for details.
+	PoisonReq(*Guard)
+}
+
+// LockManager is concerned with tracking locks that are stored on the
+// manager's range. It is one of the roles of Manager.
+type LockManager interface {
+	// HandleWriterIntentError consumes a WriteIntentError by informing the
+	// concurrency manager about the replicated write intents that were
+	// discovered during evaluation, without being found in the lock table.
+	// The request's latches are released, and the returned guard must be
+	// passed back to SequenceReq, which waits on the discovered intents.
+	HandleWriterIntentError(context.Context, *Guard, *kvpb.WriteIntentError) (*Guard, *kvpb.Error)
+
+	// OnLockAcquired informs the concurrency manager that a transaction has
+	// acquired a new lock or re-acquired an existing lock that it already
+	// held.
+	OnLockAcquired(context.Context, *roachpb.LockAcquisition)
+
+	// OnLockUpdated informs the concurrency manager that a transaction has
+	// updated or released a lock or range of locks that it previously held.
+	OnLockUpdated(context.Context, *roachpb.LockUpdate)
+
+	// OnRangeLeaseUpdated informs the concurrency manager that its range's
+	// lease has been updated. A replica which is not the leaseholder clears
+	// its lock table: the replicated locks are rediscovered by the next
+	// leaseholder, and the unreplicated ones are lost. The requests waiting
+	// on the locks are released, and find out that the replica no longer
+	// serves them.
+	OnRangeLeaseUpdated(isLeaseholder bool)
+}
+
+// IntentResolver is an interface used by the concurrency manager to push
+// the transactions holding conflicting locks and to resolve their locks once
+// pushed.
+type IntentResolver interface {
+	// PushTransaction pushes the provided transaction. The method will push
+	// the provided pushee transaction immediately, if possible. Otherwise, it
+	// will block until the pushee transaction is finalized or eventually can
+	// be pushed successfully.
+	PushTransaction(
+		context.Context, *enginepb.TxnMeta, kvpb.Header, kvpb.PushTxnType,
+	) (*roachpb.Transaction, *kvpb.Error)
+
+	// ResolveIntent synchronously resolves the provided intent.
+	ResolveIntent(context.Context, roachpb.LockUpdate) *kvpb.Error
+}
+
+// Request is the input to Manager.SequenceReq. The struct contains all of the
+// information necessary to sequence a KV request and determine which locks
+// and other in-flight requests it conflicts with.
+type Request struct {
+	// The (optional) transaction that sent the request.
+	Txn *roachpb.Transaction
+
+	// The timestamp that the request should evaluate at. Should be set to
+	// Txn.ReadTimestamp if Txn is non-nil.
+	Timestamp hlc.Timestamp
+
+	// The wait policy of the request. Determines how the request should
+	// behave when it encounters conflicting locks held by other active
+	// transactions.
+	WaitPolicy lock.WaitPolicy
+
+	// The poison.Policy to use for this Request. Determines how the request
+	// should behave when it encounters poisoned latches, i.e. latches held by
+	// requests that are not expected to complete in a timely manner.
+	PoisonPolicy poison.Policy
+
+	// The individual requests in the batch.
+	Requests []kvpb.RequestUnion
+
+	// The maximal set of spans that the request will access. Latches will be
+	// acquired for these spans.
+	LatchSpans *spanset.SpanSet
+
+	// The maximal set of spans within which the request expects to have
+	// isolation from conflicting transactions, along with the strength with
+	// which it accesses them. Conflicting locks within these spans will be
+	// queued on and conditionally pushed. Spans with a locking strength are
+	// those on which the request acquires locks.
+	LockSpans *lockspanset.LockSpanSet
+}
+
+// txnMeta returns the TxnMeta of the request's transaction, or nil if the
+// request is non-transactional.
+func (r *Request) txnMeta() *enginepb.TxnMeta {
+	if r.Txn == nil {
+		return nil
+	}
+	return &r.Txn.TxnMeta
+}
+
+// Guard is returned from Manager.SequenceReq. The guard is passed back in to
+// Manager.FinishReq to release the request's resources when it has completed.
+type Guard struct {
+	Req Request
+	lg  *spanlatch.Guard
+	ltg *lockTableGuardImpl
+
+	// contentionEvents are the events of the request waiting on the locks of
+	// other transactions, across all of its sequencing attempts.
+	contentionEvents []kvpb.ContentionEvent
+}
+
+// HoldingLatches returned whether the guard is holding latches or not.
+func (g *Guard) HoldingLatches() bool {
+	return g != nil && g.lg != nil
+}
+
+// ContentionEvents returns the events of the request waiting on the locks of
+// other transactions before it was sequenced.
+func (g *Guard) ContentionEvents() []kvpb.ContentionEvent {
+	return g.contentionEvents
+}
+
+func (g *Guard) addContentionEvent(ev kvpb.ContentionEvent) {
+	g.contentionEvents = append(g.contentionEvents, ev)
+}
+
+// IsKeyLockedByConflictingTxn returns whether the specified key is locked by
+// a conflicting transaction, given the caller's own desired locking strength.
+// It allows the guard to be used as a storage.LockTableView by requests that
+// skip locked keys during evaluation.
+func (g *Guard) IsKeyLockedByConflictingTxn(
+	key roachpb.Key, str lock.Strength,
+) (bool, *enginepb.TxnMeta) {
+	if g == nil || g.ltg == nil {
+		return false, nil
+	}
+	return g.ltg.IsKeyLockedByConflictingTxn(key, str)
+}
@@ -0,0 +1,157 @@
+package concurrency
+
+import (
+	"context"
+	"fmt"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/spanlatch"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+)
+
+// managerImpl implements the Manager interface.
+type managerImpl struct {
+	// Synchronizes conflicting in-flight requests.
+	lm spanlatch.Manager
+	// Synchronizes conflicting in-progress transactions.
+	lt *lockTableImpl
+	// Waits for locks that conflict with a request to be released.
+	ltw lockTableWaiterImpl
+}
+
+// Config contains the dependencies to construct a Manager.
+type Config struct {
+	// IntentResolver is used to push the transactions holding conflicting
+	// locks and to resolve their locks. If nil, waiting requests never push
+	// the lock holders and wait for their locks to be released.
+	IntentResolver IntentResolver
+}
+
+// NewManager creates a new concurrency Manager structure.
+func NewManager(cfg Config) Manager {
+	lt := newLockTable()
+	return &managerImpl{
+		lm: spanlatch.Make(),
+		lt: lt,
+		ltw: lockTableWaiterImpl{
+			lt: lt,
+			ir: cfg.IntentResolver,
+		},
+	}
+}
+
+// SequenceReq implements the RequestSequencer interface.
+func (m *managerImpl) SequenceReq(
+	ctx context.Context, prev *Guard, req Request,
+) (*Guard, *kvpb.Error) {
+	var g *Guard
+	if prev == nil {
+		g = &Guard{Req: req}
+	} else {
+		if prev.HoldingLatches() {
+			panic("SequenceReq called with guard holding latches")
+		}
+		g = prev
+		g.Req = req
+	}
+
+	for {
+		// Acquire latches for the request. This synchronizes the request with
+		// all conflicting in-flight requests.
+		if !g.HoldingLatches() {
+			lg, err := m.lm.Acquire(ctx, req.LatchSpans, req.PoisonPolicy)
+			if err != nil {
+				m.FinishReq(g)
+				return nil, kvpb.NewError(err)
+			}
+			g.lg = lg
+		}
+
+		// Some requests don't need to acquire locks or wait on the lock
+		// table.
+		if req.LockSpans == nil || req.LockSpans.Empty() {
+			return g, nil
+		}
+
+		// Scan for conflicting locks.
+		g.ltg = m.lt.ScanAndEnqueue(req, g.ltg)
+		if !g.ltg.ShouldWait() {
+			return g, nil
+		}
+
+		// Release the latches while waiting, so that the lock holder's
+		// requests, and other requests, can proceed. The request then waits
+		// on the conflicting lock.
+		m.lm.Release(g.lg)
+		g.lg = nil
+		if pErr := m.ltw.WaitOn(ctx, req, g.ltg, g.addContentionEvent); pErr != nil {
+			m.FinishReq(g)
+			return nil, pErr
+		}
+	}
+}
+
+// FinishReq implements the RequestSequencer interface.
+func (m *managerImpl) FinishReq(g *Guard) {
+	if g.lg != nil {
+		m.lm.Release(g.lg)
+		g.lg = nil
+	}
+	if g.ltg != nil {
+		m.lt.Dequeue(g.ltg)
+		g.ltg = nil
+	}
+}
+
+// PoisonReq implements the RequestSequencer interface.
+func (m *managerImpl) PoisonReq(g *Guard) {
+	if g.lg != nil {
+		m.lm.Poison(g.lg)
+	}
+}
+
+// HandleWriterIntentError implements the LockManager interface.
+func (m *managerImpl) HandleWriterIntentError(
+	ctx context.Context, g *Guard, t *kvpb.WriteIntentError,
+) (*Guard, *kvpb.Error) {
+	if g.ltg == nil {
+		return nil, kvpb.NewError(fmt.Errorf(
+			"cannot handle WriteIntentError %v for request without lockTableGuard; were lock spans declared for this request?", t))
+	}
+
+	// Add a discovered lock to lock-table for each intent and enter each
+	// lock's wait-queue.
+	for i := range t.Intents {
+		m.lt.AddDiscoveredLock(&t.Intents[i], g.ltg)
+	}
+
+	// Release the Guard's latches but continue to remain in lock wait-queues
+	// by not releasing lockWaitQueueGuards. We expect the caller of this
+	// method to then re-sequence the Request by calling SequenceReq with the
+	// un-latched Guard. This is analogous to iterating through the loop in
+	// SequenceReq.
+	m.lm.Release(g.lg)
+	g.lg = nil
+	return g, nil
+}
+
+// OnLockAcquired implements the LockManager interface.
+func (m *managerImpl) OnLockAcquired(ctx context.Context, acq *roachpb.LockAcquisition) {
+	m.lt.AcquireLock(acq)
+}
+
+// OnLockUpdated implements the LockManager interface.
+func (m *managerImpl) OnLockUpdated(ctx context.Context, up *roachpb.LockUpdate) {
+	m.lt.UpdateLocks(up)
+}
+
+// OnRangeLeaseUpdated implements the LockManager interface.
+func (m *managerImpl) OnRangeLeaseUpdated(isLeaseholder bool) {
+	if !isLeaseholder {
+		m.lt.Clear()
+	}
+}
+
+// TestingLockTableString implements the Manager interface.
+func (m *managerImpl) TestingLockTableString() string {
+	return m.lt.String()
+}
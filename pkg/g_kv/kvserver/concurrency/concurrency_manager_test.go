@@ -0,0 +1,384 @@
+package concurrency
+
+import (
+	"context"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/concurrency/isolation"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/concurrency/lock"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/lockspanset"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/spanset"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/dborchard/tiny_crdb/pkg/h_storage/enginepb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func makeTxn(name string, ts int64) *roachpb.Transaction {
+	txn := roachpb.MakeTransaction(name, roachpb.Key(name), isolation.Serializable,
+		roachpb.NormalUserPriority, hlc.Timestamp{WallTime: ts})
+	return &txn
+}
+
+// makeReq creates a request of the provided transaction that writes (or
+// reads, if write is false) the provided key.
+func makeReq(txn *roachpb.Transaction, key string, write bool) Request {
+	str := lock.None
+	if write {
+		str = lock.Intent
+	}
+	return makeLockingReq(txn, key, str, lock.Block)
+}
+
+// makeLockingReq creates a request of the provided transaction that accesses
+// the provided key with the provided strength and wait policy.
+func makeLockingReq(
+	txn *roachpb.Transaction, key string, str lock.Strength, wp lock.WaitPolicy,
+) Request {
+	access := spanset.SpanReadOnly
+	if str == lock.Intent {
+		access = spanset.SpanReadWrite
+	}
+	span := roachpb.Span{Key: roachpb.Key(key)}
+	latchSpans, lockSpans := spanset.New(), lockspanset.New()
+	latchSpans.AddMVCC(access, span, txn.ReadTimestamp)
+	lockSpans.Add(str, span)
+	return Request{
+		WaitPolicy: wp,
+		Txn:        txn,
+		Timestamp:  txn.ReadTimestamp,
+		LatchSpans: latchSpans,
+		LockSpans:  lockSpans,
+	}
+}
+
+func acquire(t *testing.T, m Manager, txn *roachpb.Transaction, key string) {
+	g, pErr := m.SequenceReq(context.Background(), nil, makeReq(txn, key, true))
+	require.Nil(t, pErr)
+	m.OnLockAcquired(context.Background(),
+		&roachpb.LockAcquisition{Span: roachpb.Span{Key: roachpb.Key(key)}, Txn: txn.TxnMeta, Durability: lock.Unreplicated, Strength: lock.Exclusive})
+	m.FinishReq(g)
+}
+
+func release(m Manager, txn *roachpb.Transaction, key string, status roachpb.TransactionStatus) {
+	up := roachpb.MakeLockUpdate(txn, roachpb.Span{Key: roachpb.Key(key)})
+	up.Status = status
+	m.OnLockUpdated(context.Background(), &up)
+}
+
+// TestConcurrencyManagerFIFOWaiters verifies that writers waiting on a lock
+// are let through one at a time, in the order in which they queued, when the
+// lock is released.
+func TestConcurrencyManagerFIFOWaiters(t *testing.T) {
+	m := NewManager(Config{})
+	holder := makeTxn("holder", 10)
+	acquire(t, m, holder, "k")
+
+	var mu sync.Mutex
+	var order []string
+	guards := make(chan *Guard, 3)
+	waiters := []*roachpb.Transaction{makeTxn("w1", 20), makeTxn("w2", 20), makeTxn("w3", 20)}
+	for i, txn := range waiters {
+		txn := txn
+		go func() {
+			g, pErr := m.SequenceReq(context.Background(), nil, makeReq(txn, "k", true))
+			if pErr != nil {
+				t.Error(pErr)
+				return
+			}
+			mu.Lock()
+			order = append(order, txn.Name)
+			mu.Unlock()
+			guards <- g
+		}()
+		// Wait for the waiter to enter the lock's wait-queue before starting
+		// the next one, to determine the queue order.
+		require.Eventually(t, func() bool {
+			return m.(*managerImpl).lt.queueLen("k") == i+1
+		}, 10*time.Second, time.Millisecond)
+	}
+
+	// Releasing the lock lets the first waiter through, but not the others:
+	// they wait for the first waiter to finish.
+	release(m, holder, "k", roachpb.COMMITTED)
+	for i := range waiters {
+		var g *Guard
+		select {
+		case g = <-guards:
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for waiter")
+		}
+		select {
+		case <-guards:
+			t.Fatal("waiters let through concurrently")
+		case <-time.After(10 * time.Millisecond):
+		}
+		mu.Lock()
+		require.Equal(t, waiters[i].Name, order[i])
+		mu.Unlock()
+		m.FinishReq(g)
+	}
+	require.Equal(t, "num=0\n", m.TestingLockTableString())
+}
+
+// TestConcurrencyManagerReadsBelowLock verifies that non-locking reads do
+// not wait on locks held at higher timestamps, but do wait on locks held at
+// lower timestamps.
+func TestConcurrencyManagerReadsBelowLock(t *testing.T) {
+	m := NewManager(Config{})
+	holder := makeTxn("holder", 10)
+	acquire(t, m, holder, "k")
+
+	g, pErr := m.SequenceReq(context.Background(), nil, makeReq(makeTxn("reader", 5), "k", false))
+	require.Nil(t, pErr)
+	m.FinishReq(g)
+
+	done := make(chan struct{})
+	go func() {
+		g, pErr := m.SequenceReq(context.Background(), nil, makeReq(makeTxn("reader", 15), "k", false))
+		if pErr != nil {
+			t.Error(pErr)
+		} else {
+			m.FinishReq(g)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("read above lock did not wait")
+	case <-time.After(10 * time.Millisecond):
+	}
+	release(m, holder, "k", roachpb.ABORTED)
+	<-done
+}
+
+// TestConcurrencyManagerContentionEvents verifies that a request that waits
+// on a lock reports the wait as a contention event on its guard, blaming the
+// lock holder.
+func TestConcurrencyManagerContentionEvents(t *testing.T) {
+	m := NewManager(Config{})
+	holder := makeTxn("holder", 10)
+	acquire(t, m, holder, "k")
+
+	// An uncontended request does not report any event.
+	g, pErr := m.SequenceReq(context.Background(), nil, makeReq(makeTxn("other", 20), "other", true))
+	require.Nil(t, pErr)
+	require.Empty(t, g.ContentionEvents())
+	m.FinishReq(g)
+
+	guards := make(chan *Guard, 1)
+	go func() {
+		g, pErr := m.SequenceReq(context.Background(), nil, makeReq(makeTxn("waiter", 20), "k", true))
+		if pErr != nil {
+			t.Error(pErr)
+			close(guards)
+			return
+		}
+		guards <- g
+	}()
+	require.Eventually(t, func() bool {
+		return m.(*managerImpl).lt.queueLen("k") == 1
+	}, 10*time.Second, time.Millisecond)
+	const wait = 20 * time.Millisecond
+	time.Sleep(wait)
+	release(m, holder, "k", roachpb.COMMITTED)
+
+	g = <-guards
+	require.NotNil(t, g)
+	defer m.FinishReq(g)
+	events := g.ContentionEvents()
+	require.Len(t, events, 1)
+	require.Equal(t, roachpb.Key("k"), events[0].Key)
+	require.Equal(t, holder.ID, events[0].TxnMeta.ID)
+	require.GreaterOrEqual(t, events[0].Duration, wait)
+}
+
+type testIntentResolver struct {
+	mu       sync.Mutex
+	pushed   []enginepb.TxnMeta
+	resolved []roachpb.LockUpdate
+}
+
+func (ir *testIntentResolver) PushTransaction(
+	ctx context.Context, pushee *enginepb.TxnMeta, h kvpb.Header, pushType kvpb.PushTxnType,
+) (*roachpb.Transaction, *kvpb.Error) {
+	ir.mu.Lock()
+	defer ir.mu.Unlock()
+	ir.pushed = append(ir.pushed, *pushee)
+	txn := &roachpb.Transaction{TxnMeta: *pushee, Status: roachpb.ABORTED}
+	return txn, nil
+}
+
+func (ir *testIntentResolver) ResolveIntent(ctx context.Context, up roachpb.LockUpdate) *kvpb.Error {
+	ir.mu.Lock()
+	defer ir.mu.Unlock()
+	ir.resolved = append(ir.resolved, up)
+	return nil
+}
+
+// TestConcurrencyManagerDiscoveredLock verifies that a request that discovers
+// an intent during evaluation waits on it, pushes its transaction, and
+// resolves the intent before proceeding.
+func TestConcurrencyManagerDiscoveredLock(t *testing.T) {
+	defer func(prev time.Duration) { LockTableDeadlockDetectionPushDelay = prev }(LockTableDeadlockDetectionPushDelay)
+	LockTableDeadlockDetectionPushDelay = time.Millisecond
+
+	ir := &testIntentResolver{}
+	m := NewManager(Config{IntentResolver: ir})
+	ctx := context.Background()
+	writer := makeTxn("writer", 20)
+	req := makeReq(writer, "k", true)
+	g, pErr := m.SequenceReq(ctx, nil, req)
+	require.Nil(t, pErr)
+
+	// Evaluation found an intent that the lock table did not know about.
+	intentTxn := makeTxn("intent", 10)
+	g, pErr = m.HandleWriterIntentError(ctx, g, &kvpb.WriteIntentError{
+		Intents: []roachpb.Intent{roachpb.MakeIntent(&intentTxn.TxnMeta, roachpb.Key("k"))},
+	})
+	require.Nil(t, pErr)
+	require.False(t, g.HoldingLatches())
+
+	g, pErr = m.SequenceReq(ctx, g, req)
+	require.Nil(t, pErr)
+	require.True(t, g.HoldingLatches())
+	m.FinishReq(g)
+
+	ir.mu.Lock()
+	defer ir.mu.Unlock()
+	require.Len(t, ir.pushed, 1)
+	require.Equal(t, intentTxn.ID, ir.pushed[0].ID)
+	require.Len(t, ir.resolved, 1)
+	require.Equal(t, roachpb.ABORTED, ir.resolved[0].Status)
+	require.Equal(t, "num=0\n", m.TestingLockTableString())
+}
+
+// queueLen returns the length of the wait-queue of the lock on the key.
+func (t *lockTableImpl) queueLen(key string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if l, ok := t.mu.locks[key]; ok {
+		return len(l.queue)
+	}
+	return 0
+}
+
+func acquireWithStrength(
+	t *testing.T, m Manager, txn *roachpb.Transaction, key string, str lock.Strength,
+) {
+	g, pErr := m.SequenceReq(context.Background(), nil, makeLockingReq(txn, key, str, lock.Block))
+	require.Nil(t, pErr)
+	acq := roachpb.MakeLockAcquisition(&txn.TxnMeta, roachpb.Key(key), lock.Unreplicated, str)
+	m.OnLockAcquired(context.Background(), &acq)
+	m.FinishReq(g)
+}
+
+// TestConcurrencyManagerLockStrengths verifies that Shared locks are
+// compatible with each other and with non-locking reads, but not with
+// Exclusive locks, which also block non-locking reads above them.
+func TestConcurrencyManagerLockStrengths(t *testing.T) {
+	m := NewManager(Config{})
+	ctx := context.Background()
+	s1, s2 := makeTxn("s1", 10), makeTxn("s2", 10)
+	acquireWithStrength(t, m, s1, "k", lock.Shared)
+	acquireWithStrength(t, m, s2, "k", lock.Shared)
+	require.Equal(t, 2, strings.Count(m.TestingLockTableString(), "str: Shared"))
+
+	// Non-locking reads do not wait on Shared locks.
+	g, pErr := m.SequenceReq(ctx, nil, makeReq(makeTxn("reader", 20), "k", false))
+	require.Nil(t, pErr)
+	m.FinishReq(g)
+
+	// An Exclusive locking request waits for both Shared locks.
+	done := make(chan struct{})
+	x := makeTxn("x", 20)
+	go func() {
+		defer close(done)
+		acquireWithStrength(t, m, x, "k", lock.Exclusive)
+	}()
+	require.Eventually(t, func() bool {
+		return m.(*managerImpl).lt.queueLen("k") == 1
+	}, 10*time.Second, time.Millisecond)
+	release(m, s1, "k", roachpb.COMMITTED)
+	select {
+	case <-done:
+		t.Fatal("exclusive lock acquired while a shared lock is held")
+	case <-time.After(10 * time.Millisecond):
+	}
+	release(m, s2, "k", roachpb.COMMITTED)
+	<-done
+
+	// The Exclusive lock blocks non-locking reads above it, but not below it.
+	g, pErr = m.SequenceReq(ctx, nil, makeReq(makeTxn("reader", 15), "k", false))
+	require.Nil(t, pErr)
+	m.FinishReq(g)
+	g, pErr = m.SequenceReq(ctx, nil, makeLockingReq(makeTxn("reader", 25), "k", lock.None, lock.SkipLocked))
+	require.Nil(t, pErr)
+	locked, holder := g.IsKeyLockedByConflictingTxn(roachpb.Key("k"), lock.None)
+	require.True(t, locked)
+	require.Equal(t, x.ID, holder.ID)
+	m.FinishReq(g)
+}
+
+// TestConcurrencyManagerWaitPolicyError verifies that a request with an Error
+// wait policy returns a WriteIntentError instead of waiting on a lock held by
+// an active transaction.
+func TestConcurrencyManagerWaitPolicyError(t *testing.T) {
+	m := NewManager(Config{IntentResolver: &activeIntentResolver{}})
+	holder := makeTxn("holder", 10)
+	acquireWithStrength(t, m, holder, "k", lock.Exclusive)
+
+	_, pErr := m.SequenceReq(context.Background(), nil, makeLockingReq(makeTxn("nowait", 20), "k", lock.Exclusive, lock.Error))
+	require.NotNil(t, pErr)
+	wiErr, ok := pErr.GetDetail().(*kvpb.WriteIntentError)
+	require.True(t, ok)
+	require.Equal(t, kvpb.WriteIntentError_REASON_WAIT_POLICY, wiErr.Reason)
+	require.Equal(t, holder.ID, wiErr.Intents[0].Txn.ID)
+}
+
+// activeIntentResolver is an IntentResolver whose pushes with PUSH_TOUCH
+// fail, as the pushees are active.
+type activeIntentResolver struct {
+	testIntentResolver
+}
+
+func (ir *activeIntentResolver) PushTransaction(
+	ctx context.Context, pushee *enginepb.TxnMeta, h kvpb.Header, pushType kvpb.PushTxnType,
+) (*roachpb.Transaction, *kvpb.Error) {
+	if pushType != kvpb.PUSH_TOUCH {
+		return ir.testIntentResolver.PushTransaction(ctx, pushee, h, pushType)
+	}
+	return nil, kvpb.NewError(kvpb.NewTransactionPushError(roachpb.Transaction{TxnMeta: *pushee}))
+}
+
+// TestConcurrencyManagerRangedSpans verifies that a request with a ranged
+// span conflicts with the first lock in key order within the span, and that
+// a ranged lock update only affects the locks of its transaction in the span.
+func TestConcurrencyManagerRangedSpans(t *testing.T) {
+	m := NewManager(Config{IntentResolver: &activeIntentResolver{}})
+	h1, h2 := makeTxn("h1", 10), makeTxn("h2", 10)
+	for _, key := range []string{"e", "a", "c"} {
+		acquireWithStrength(t, m, h1, key, lock.Exclusive)
+	}
+	acquireWithStrength(t, m, h2, "d", lock.Exclusive)
+
+	req := makeLockingReq(makeTxn("nowait", 20), "b", lock.Exclusive, lock.Error)
+	req.LockSpans = lockspanset.New()
+	req.LockSpans.Add(lock.Exclusive, roachpb.Span{Key: roachpb.Key("b"), EndKey: roachpb.Key("e")})
+	_, pErr := m.SequenceReq(context.Background(), nil, req)
+	require.NotNil(t, pErr)
+	wiErr, ok := pErr.GetDetail().(*kvpb.WriteIntentError)
+	require.True(t, ok)
+	require.Equal(t, roachpb.Key("c"), wiErr.Intents[0].Key)
+	require.Equal(t, h1.ID, wiErr.Intents[0].Txn.ID)
+
+	up := roachpb.MakeLockUpdate(h1, roachpb.Span{Key: roachpb.Key("a"), EndKey: roachpb.Key("e")})
+	up.Status = roachpb.COMMITTED
+	m.OnLockUpdated(context.Background(), &up)
+	s := m.TestingLockTableString()
+	require.True(t, strings.HasPrefix(s, "num=2\n lock: \"d\"\n"), s)
+	require.Contains(t, s, " lock: \"e\"\n")
+}
@@ -1,8 +1,71 @@
 package isolation
 
+import "fmt"
+
+// Level is the isolation level of a transaction. The levels are listed from
+// the weakest to the strongest guarantees below.
 type Level int32
 
 const (
+	// Serializable provides the strongest isolation guarantees. Transactions
+	// observe a single consistent snapshot across all of their statements and
+	// must commit at the timestamp at which they read (refreshing their reads
+	// if their write timestamp is pushed). Write skew is not permitted.
 	Serializable Level = 0
-	Snapshot     Level = 1
+	// Snapshot transactions observe a single consistent snapshot across all of
+	// their statements, but may commit at a later timestamp than the one at
+	// which they read. Write skew is permitted.
+	Snapshot Level = 1
+	// ReadCommitted transactions establish a new read snapshot for each of
+	// their statements, so every statement observes the writes committed
+	// before it began. Like Snapshot transactions, they may commit at a later
+	// timestamp than the one at which they read. Write skew is permitted.
+	ReadCommitted Level = 2
 )
+
+// WeakerThan returns whether the receiver's isolation level is weaker than the
+// parameter's isolation level.
+func (l Level) WeakerThan(l2 Level) bool {
+	return l.strength() < l2.strength()
+}
+
+// strength orders the levels from the weakest to the strongest.
+func (l Level) strength() int {
+	switch l {
+	case ReadCommitted:
+		return 0
+	case Snapshot:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// ToleratesWriteSkew returns whether the isolation level permits write skew. In
+// an MVCC system, this property can be expressed as whether the isolation level
+// allows transactions to write and commit at an MVCC timestamp above the MVCC
+// timestamp of its read snapshot(s).
+func (l Level) ToleratesWriteSkew() bool {
+	return l.WeakerThan(Serializable)
+}
+
+// PerStatementReadSnapshot returns whether the isolation level establishes a
+// new read snapshot for each statement. If not, a single read snapshot is used
+// for the entire transaction.
+func (l Level) PerStatementReadSnapshot() bool {
+	return l == ReadCommitted
+}
+
+// String implements the fmt.Stringer interface.
+func (l Level) String() string {
+	switch l {
+	case Serializable:
+		return "Serializable"
+	case Snapshot:
+		return "Snapshot"
+	case ReadCommitted:
+		return "ReadCommitted"
+	default:
+		return fmt.Sprintf("Level(%d)", int32(l))
+	}
+}
@@ -0,0 +1,208 @@
+// Package lock provides type definitions for locking-related concepts used by
+// concurrency control in the key-value layer.
+package lock
+
+import (
+	"fmt"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+)
+
+// Strength represents the different locking modes that determine how key-values
+// can be accessed by concurrent transactions.
+//
+// Locking modes apply to locks that are held with a per-key granularity. It is
+// up to users of the key-value layer to decide on which keys to acquire locks
+// for when imposing structure that can span multiple keys, such as SQL rows
+// (see column families and secondary indexes).
+//
+// Locking modes have differing levels of strength, growing from "weakest" to
+// "strongest" in the order that the variants are presented in the enumeration.
+// The "stronger" a locking mode, the more protection it provides for the lock
+// holder but the more restrictive it is to concurrent transactions attempting
+// to access the same keys.
+//
+// The following matrix presents the compatibility of locking strengths with
+// one another. A cell with an X means that the two strengths are incompatible
+// with each other and that they can not both be held on a given key by
+// different transactions, concurrently. A cell without an X means that the two
+// strengths are compatible with each other and that they can be held on a
+// given key by different transactions, concurrently.
+//
+//	+-----------+-----------+-----------+-----------+-----------+
+//	|           |   None    |  Shared   | Exclusive |  Intent   |
+//	+-----------+-----------+-----------+-----------+-----------+
+//	| None      |           |           |    X^†    |    X^†    |
+//	+-----------+-----------+-----------+-----------+-----------+
+//	| Shared    |           |           |     X     |     X     |
+//	+-----------+-----------+-----------+-----------+-----------+
+//	| Exclusive |    X^†    |     X     |     X     |     X     |
+//	+-----------+-----------+-----------+-----------+-----------+
+//	| Intent    |    X^†    |     X     |     X     |     X     |
+//	+-----------+-----------+-----------+-----------+-----------+
+//
+// [†] reads under optimistic concurrency control in CockroachDB only conflict
+// with Exclusive and Intent locks if the read's timestamp is equal to or
+// greater than the lock's timestamp.
+type Strength int32
+
+const (
+	// None represents the absence of a lock or the intention to acquire locks.
+	// It corresponds to the behavior of transactions performing key-value
+	// reads under optimistic concurrency control. No locks are acquired on
+	// the keys read by these requests when they evaluate. However, the reads
+	// do respect Exclusive and Intent locks held by other transactions at or
+	// below their read timestamp.
+	None Strength = 0
+	// Shared (S) locks are used by read-only operations and allow concurrent
+	// transactions to read under pessimistic concurrency control. Shared locks
+	// are compatible with each other but are not compatible with Exclusive or
+	// Intent locks. This means that multiple transactions can hold a Shared
+	// lock on the same key at the same time, but no other transaction can
+	// modify the key at the same time.
+	//
+	// SQL's FOR SHARE and FOR KEY SHARE locking clauses acquire Shared locks.
+	Shared Strength = 1
+	// Exclusive (X) locks are used by read-write and read-only operations and
+	// provide a transaction with exclusive access to a key. When an Exclusive
+	// lock is held by a transaction on a given key, no other transaction can
+	// write to that key or acquire a lock on it. Non-locking reads at or
+	// above the lock's timestamp wait for the lock to be released.
+	//
+	// SQL's FOR UPDATE and FOR NO KEY UPDATE locking clauses acquire
+	// Exclusive locks.
+	Exclusive Strength = 2
+	// Intent (I) locks are used by read-write operations and provide a
+	// transaction with exclusive access to a key. Intent locks are the only
+	// locks that are replicated: they are write intents, stored alongside the
+	// provisional value that the transaction wrote to the key.
+	Intent Strength = 3
+)
+
+// String returns a string representation of the Strength.
+func (s Strength) String() string {
+	switch s {
+	case None:
+		return "None"
+	case Shared:
+		return "Shared"
+	case Exclusive:
+		return "Exclusive"
+	case Intent:
+		return "Intent"
+	default:
+		return fmt.Sprintf("Strength(%d)", int32(s))
+	}
+}
+
+// WaitPolicy specifies the behavior of a request when it encounters conflicting
+// locks held by other active transactions.
+type WaitPolicy int32
+
+const (
+	// Block indicates that if a request encounters a conflicting lock held by
+	// another active transaction, it should wait for the conflicting lock to
+	// be released before proceeding.
+	Block WaitPolicy = 0
+	// Error indicates that if a request encounters a conflicting lock held by
+	// another active transaction, it should raise an error instead of
+	// blocking. If the request encounters a conflicting lock that was
+	// abandoned by an inactive transaction, it removes the lock and proceeds.
+	//
+	// SQL's NOWAIT locking clause uses this policy.
+	Error WaitPolicy = 1
+	// SkipLocked indicates that if a request encounters a conflicting lock
+	// held by another transaction while scanning, it should skip over the key
+	// that is locked instead of blocking and later acquiring a lock on it.
+	//
+	// SQL's SKIP LOCKED locking clause uses this policy.
+	SkipLocked WaitPolicy = 2
+)
+
+// String returns a string representation of the WaitPolicy.
+func (p WaitPolicy) String() string {
+	switch p {
+	case Block:
+		return "Block"
+	case Error:
+		return "Error"
+	case SkipLocked:
+		return "SkipLocked"
+	default:
+		return fmt.Sprintf("WaitPolicy(%d)", int32(p))
+	}
+}
+
+// Mode determines the level of protection a lock provides to the lock holder.
+// All locks that are held by transactions have a mode associated with them;
+// the mode of a request's access to a key is used to determine whether the
+// request conflicts with the locks held on the key.
+type Mode struct {
+	// Strength is the strength of the lock or of the access.
+	Strength Strength
+	// Timestamp is the timestamp at which the lock is held, or at which a
+	// non-locking read reads.
+	Timestamp hlc.Timestamp
+}
+
+// MakeModeNone constructs a Mode with strength None, for a non-locking read
+// at the provided timestamp.
+func MakeModeNone(ts hlc.Timestamp) Mode {
+	return Mode{Strength: None, Timestamp: ts}
+}
+
+// Conflicts returns whether the provided lock modes conflict with one another,
+// per the compatibility matrix documented on Strength. The function is
+// symmetric.
+func Conflicts(m1, m2 Mode) bool {
+	if m1.Strength == None && m2.Strength == None {
+		return false
+	}
+	if m2.Strength == None {
+		m1, m2 = m2, m1
+	}
+	if m1.Strength == None {
+		// A non-locking read only conflicts with Exclusive and Intent locks
+		// held at or below its timestamp.
+		if m2.Strength == Shared {
+			return false
+		}
+		return m2.Timestamp.LessEq(m1.Timestamp)
+	}
+	// Shared locks are compatible with each other; all other combinations of
+	// locking strengths conflict.
+	return !(m1.Strength == Shared && m2.Strength == Shared)
+}
+
+// Durability represents the different durability properties of a lock
+// acquired by a transaction. Durability levels provide varying degrees of
+// survivability, often in exchange for the cost of lock acquisition.
+type Durability int32
+
+const (
+	// Unreplicated locks are held only on a single Replica in a Range, which
+	// is typically the leaseholder. Unreplicated locks are very fast to
+	// acquire and release because they are held in memory or on fast local
+	// storage and require no cross-node coordination to update. In exchange,
+	// Unreplicated locks provide no guarantee of survivability across lease
+	// transfers or leaseholder crashes.
+	Unreplicated Durability = 0
+	// Replicated locks are held on at least a quorum of Replicas in a Range.
+	// They are slower to acquire and release than Unreplicated locks because
+	// updating them requires both cross-node coordination and interaction
+	// with durable storage. In exchange, Replicated locks provide a guarantee
+	// of survivability across lease transfers, leaseholder crashes, and other
+	// forms of failure events. Write intents are Replicated locks.
+	Replicated Durability = 1
+)
+
+// String returns a string representation of the Durability.
+func (d Durability) String() string {
+	switch d {
+	case Unreplicated:
+		return "Unreplicated"
+	case Replicated:
+		return "Replicated"
+	default:
+		return "Unknown"
+	}
+}
@@ -0,0 +1,605 @@
+package concurrency
+
+import (
+	"fmt"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/concurrency/lock"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/lockspanset"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/dborchard/tiny_crdb/pkg/h_storage/enginepb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/uuid"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// waitKind indicates the kind of waiting a request has to do.
+type waitKind int
+
+const (
+	_ waitKind = iota
+
+	// waitFor indicates that the request is waiting on another transaction
+	// to release its lock, or for a request ahead of it in the lock's
+	// wait-queue to finish.
+	waitFor
+
+	// doneWaiting indicates that the request is done waiting on this pass
+	// through the lock table and should make another call to ScanAndEnqueue.
+	doneWaiting
+)
+
+// waitingState specifies what the request is waiting on.
+type waitingState struct {
+	kind waitKind
+
+	// Fields below are populated for waitFor.
+
+	// txn is the transaction holding the lock, or the transaction of the
+	// request ahead of this one in the wait-queue if the lock is not held.
+	// It is nil if the lock is not held and the request ahead is
+	// non-transactional. It is a copy taken under the lock table's mutex, as
+	// the TxnMeta of a holder is updated in place when it reacquires the lock,
+	// and the state is read by the waiter without the mutex.
+	txn *enginepb.TxnMeta
+	// key is the key of the lock that the request is waiting on.
+	key roachpb.Key
+	// held is true if the lock is held.
+	held bool
+	// guardStrength is the strength with which the request accesses the
+	// key, which conflicts with the lock.
+	guardStrength lock.Strength
+}
+
+// lockTableImpl is an in-memory lock table. It tracks the locks held by
+// transactions on the keys of a range, along with a wait-queue for each of
+// them, and is used to sequence requests that conflict with these locks.
+//
+// The lock table contains two kinds of locks:
+//
+//   - locks acquired through the concurrency manager by transactions that
+//     evaluated on this range. See OnLockAcquired.
+//   - replicated locks (write intents) found in storage by requests during
+//     evaluation, which the lock table was not aware of. See
+//     AddDiscoveredLock.
+//
+// Locks are held with a strength (see lock.Strength). A lock held with
+// Shared strength may be held by several transactions at once; a lock held
+// with Exclusive or Intent strength has a single holder.
+//
+// A request scanning the lock table conflicts with a lock if the lock is held
+// by another transaction in a mode that conflicts with the strength with
+// which the request accesses the key (see lock.Conflicts). Non-locking reads
+// only conflict with Exclusive and Intent locks at or below their timestamp.
+// A locking request also conflicts with a lock that is not held by a
+// conflicting transaction, if a locking request with a conflicting strength
+// that entered its wait-queue before it is still waiting or evaluating: this
+// ensures that locking requests acquire a contended lock in the order in
+// which they queued on it.
+//
+// Requests with a SkipLocked wait policy do not wait in the lock table.
+// Instead, they skip over the locked keys during evaluation, using their
+// guard as a storage.LockTableView. Requests with an Error wait policy do not
+// wait behind the requests queued ahead of them.
+//
+// When a lock is released, or the request ahead of a waiter leaves the
+// wait-queue, the waiters in the queue are re-evaluated in FIFO order and
+// notified of their new waiting state.
+type lockTableImpl struct {
+	mu struct {
+		sync.Mutex
+		// seqNum is the sequence number of the last request that scanned the
+		// lock table. Sequence numbers order the requests in the wait-queues.
+		seqNum uint64
+		// locks contains the tracked locks, keyed by the lock's key.
+		locks map[string]*lockState
+		// ordered contains the same locks as locks, ordered by key, so that
+		// the locks in a span can be found by seeking to its start key.
+		ordered []*lockState
+	}
+}
+
+// lockState is the state of a single lock in the lock table.
+type lockState struct {
+	key roachpb.Key
+
+	// holders are the transactions holding the lock. The lock is not held if
+	// the slice is empty. Only Shared locks can have multiple holders.
+	holders []*lockHolder
+
+	// queue contains the requests waiting on the lock, or that were waiting
+	// on the lock and are now evaluating, ordered by sequence number.
+	queue []queuedGuard
+}
+
+// lockHolder is a transaction holding a lock.
+type lockHolder struct {
+	txn        enginepb.TxnMeta
+	strength   lock.Strength
+	durability lock.Durability
+}
+
+// mode returns the lock mode in which the lock is held.
+func (h *lockHolder) mode() lock.Mode {
+	return lock.Mode{Strength: h.strength, Timestamp: h.txn.WriteTimestamp}
+}
+
+// queuedGuard is a request in a lock's wait-queue.
+type queuedGuard struct {
+	g   *lockTableGuardImpl
+	str lock.Strength
+}
+
+// lockTableGuardImpl is the guard of a request that scanned the lock table.
+// It tracks the request's position in the wait-queues and its current
+// waiting state.
+type lockTableGuardImpl struct {
+	lt         *lockTableImpl
+	seqNum     uint64
+	txn        *enginepb.TxnMeta
+	ts         hlc.Timestamp
+	spans      *lockspanset.LockSpanSet
+	waitPolicy lock.WaitPolicy
+
+	// queuedOn contains the locks on whose wait-queues the request is. It is
+	// protected by lockTableImpl.mu.
+	queuedOn map[*lockState]struct{}
+
+	mu struct {
+		sync.Mutex
+		state waitingState
+		// signal is notified whenever the waiting state changes.
+		signal chan struct{}
+	}
+}
+
+func newLockTable() *lockTableImpl {
+	lt := &lockTableImpl{}
+	lt.mu.locks = make(map[string]*lockState)
+	return lt
+}
+
+// ShouldWait returns whether the request must wait in the lock table
+// before evaluating.
+func (g *lockTableGuardImpl) ShouldWait() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.mu.state.kind == waitFor
+}
+
+// NewStateChan returns the channel that is notified when the waiting state
+// of the request changes.
+func (g *lockTableGuardImpl) NewStateChan() chan struct{} {
+	return g.mu.signal
+}
+
+// CurrentState returns the latest waiting state.
+func (g *lockTableGuardImpl) CurrentState() waitingState {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.mu.state
+}
+
+func (g *lockTableGuardImpl) updateState(state waitingState) {
+	g.mu.Lock()
+	g.mu.state = state
+	g.mu.Unlock()
+	g.notify()
+}
+
+func (g *lockTableGuardImpl) notify() {
+	select {
+	case g.mu.signal <- struct{}{}:
+	default:
+	}
+}
+
+// isSameTxn returns whether the request belongs to the provided transaction.
+func (g *lockTableGuardImpl) isSameTxn(txn *enginepb.TxnMeta) bool {
+	return g.txn != nil && txn != nil && g.txn.ID == txn.ID
+}
+
+// ScanAndEnqueue scans the lock table for locks that conflict with the
+// request, and enqueues the request on the first one found. If the request
+// has already scanned the lock table, its guard must be passed back in so
+// that it retains its positions in the wait-queues. The returned guard's
+// ShouldWait indicates whether the request must wait.
+func (t *lockTableImpl) ScanAndEnqueue(req Request, g *lockTableGuardImpl) *lockTableGuardImpl {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if g == nil {
+		t.mu.seqNum++
+		g = &lockTableGuardImpl{
+			lt:         t,
+			seqNum:     t.mu.seqNum,
+			txn:        req.txnMeta(),
+			ts:         req.Timestamp,
+			spans:      req.LockSpans,
+			waitPolicy: req.WaitPolicy,
+			queuedOn:   make(map[*lockState]struct{}),
+		}
+		g.mu.signal = make(chan struct{}, 1)
+	} else {
+		// The request may have been pushed to a higher timestamp since its
+		// last scan.
+		g.ts = req.Timestamp
+		g.spans = req.LockSpans
+	}
+	if g.waitPolicy == lock.SkipLocked {
+		// Requests that skip locked keys never wait in the lock table. They
+		// consult it during evaluation instead.
+		g.updateState(waitingState{kind: doneWaiting})
+		return g
+	}
+	g.updateState(t.findConflictLocked(g))
+	return g
+}
+
+// IsKeyLockedByConflictingTxn returns whether the key is locked by a
+// transaction other than the request's own, in a mode that conflicts with the
+// provided strength. If so, one of the conflicting lock holders is returned.
+// It implements the storage.LockTableView interface.
+func (g *lockTableGuardImpl) IsKeyLockedByConflictingTxn(
+	key roachpb.Key, str lock.Strength,
+) (bool, *enginepb.TxnMeta) {
+	t := g.lt
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	l, ok := t.mu.locks[string(key)]
+	if !ok {
+		return false, nil
+	}
+	if h := l.conflictingHolder(g, str); h != nil {
+		txn := h.txn
+		return true, &txn
+	}
+	return false, nil
+}
+
+// findConflictLocked scans the lock table for the first lock conflicting with
+// the request, enqueuing the request on it, and returns the request's
+// resulting waiting state. Spans are scanned from the strongest strength to
+// the weakest, and keys are scanned in order.
+func (t *lockTableImpl) findConflictLocked(g *lockTableGuardImpl) waitingState {
+	for str := lock.Intent; str >= lock.None; str-- {
+		for _, span := range g.spans.GetSpans(str) {
+			for _, l := range t.locksInSpanLocked(span) {
+				if state, ok := l.conflictsWith(g, str); ok {
+					l.enqueue(g, str)
+					return state
+				}
+			}
+		}
+	}
+	return waitingState{kind: doneWaiting}
+}
+
+// locksInSpanLocked returns the locks whose keys are in the span, in key
+// order. The returned slice aliases the lock table's ordered locks, so it
+// must not be retained after locks are added or removed.
+func (t *lockTableImpl) locksInSpanLocked(span roachpb.Span) []*lockState {
+	if len(span.EndKey) == 0 {
+		if l, ok := t.mu.locks[string(span.Key)]; ok {
+			return []*lockState{l}
+		}
+		return nil
+	}
+	start := t.seekLocked(span.Key)
+	end := start + sort.Search(len(t.mu.ordered)-start, func(i int) bool {
+		return t.mu.ordered[start+i].key.Compare(span.EndKey) >= 0
+	})
+	return t.mu.ordered[start:end]
+}
+
+// seekLocked returns the index in the ordered locks of the first lock whose
+// key is not less than the provided key.
+func (t *lockTableImpl) seekLocked(key roachpb.Key) int {
+	return sort.Search(len(t.mu.ordered), func(i int) bool {
+		return t.mu.ordered[i].key.Compare(key) >= 0
+	})
+}
+
+// conflictsWith returns whether the request conflicts with the lock when
+// accessing it with the provided strength and, if so, the waiting state that
+// the request should adopt.
+func (l *lockState) conflictsWith(g *lockTableGuardImpl, str lock.Strength) (waitingState, bool) {
+	state := waitingState{kind: waitFor, key: l.key, guardStrength: str}
+	if h := l.conflictingHolder(g, str); h != nil {
+		txn := h.txn
+		state.txn = &txn
+		state.held = true
+		return state, true
+	}
+
+	// The lock is not held in a conflicting mode. Non-locking reads never
+	// wait for the requests queued on it, nor do requests that raise an
+	// error instead of waiting, but locking requests wait for the locking
+	// requests with a conflicting strength that queued on the lock before
+	// them.
+	if str == lock.None || g.waitPolicy == lock.Error {
+		return waitingState{}, false
+	}
+	for _, qg := range l.queue {
+		if qg.g.seqNum >= g.seqNum {
+			break
+		}
+		if qg.str == lock.None || g.isSameTxn(qg.g.txn) {
+			continue
+		}
+		if lock.Conflicts(lock.Mode{Strength: qg.str}, lock.Mode{Strength: str}) {
+			if qg.g.txn != nil {
+				txn := *qg.g.txn
+				state.txn = &txn
+			}
+			return state, true
+		}
+	}
+	return waitingState{}, false
+}
+
+// conflictingHolder returns a holder of the lock, other than the request's
+// own transaction, that holds the lock in a mode conflicting with the
+// provided strength, or nil if there is none.
+func (l *lockState) conflictingHolder(g *lockTableGuardImpl, str lock.Strength) *lockHolder {
+	mode := lock.Mode{Strength: str, Timestamp: g.ts}
+	for _, h := range l.holders {
+		if g.isSameTxn(&h.txn) {
+			// A transaction does not conflict with its own locks.
+			continue
+		}
+		if lock.Conflicts(mode, h.mode()) {
+			return h
+		}
+	}
+	return nil
+}
+
+// holder returns the lock's holder of the provided transaction, or nil if
+// the transaction does not hold the lock.
+func (l *lockState) holder(txnID uuid.UUID) *lockHolder {
+	for _, h := range l.holders {
+		if h.txn.ID == txnID {
+			return h
+		}
+	}
+	return nil
+}
+
+// removeHolder removes the provided holder from the lock's holders.
+func (l *lockState) removeHolder(h *lockHolder) {
+	for i := range l.holders {
+		if l.holders[i] == h {
+			l.holders = append(l.holders[:i], l.holders[i+1:]...)
+			return
+		}
+	}
+}
+
+// enqueue adds the request to the lock's wait-queue, in sequence number
+// order, if it is not already queued. If it is, its strength is upgraded to
+// the provided one if stronger.
+func (l *lockState) enqueue(g *lockTableGuardImpl, str lock.Strength) {
+	if _, ok := g.queuedOn[l]; ok {
+		for i := range l.queue {
+			if l.queue[i].g == g && str > l.queue[i].str {
+				l.queue[i].str = str
+			}
+		}
+		return
+	}
+	i := sort.Search(len(l.queue), func(i int) bool {
+		return l.queue[i].g.seqNum > g.seqNum
+	})
+	l.queue = append(l.queue, queuedGuard{})
+	copy(l.queue[i+1:], l.queue[i:])
+	l.queue[i] = queuedGuard{g: g, str: str}
+	g.queuedOn[l] = struct{}{}
+}
+
+// dequeue removes the request from the lock's wait-queue.
+func (l *lockState) dequeue(g *lockTableGuardImpl) {
+	for i := range l.queue {
+		if l.queue[i].g == g {
+			l.queue = append(l.queue[:i], l.queue[i+1:]...)
+			break
+		}
+	}
+	delete(g.queuedOn, l)
+}
+
+// Dequeue removes the request from all of the wait-queues that it is in. It
+// must be called when the request finishes, whether or not it waited. The
+// requests queued behind it are informed.
+func (t *lockTableImpl) Dequeue(g *lockTableGuardImpl) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var changed []*lockState
+	for l := range g.queuedOn {
+		l.dequeue(g)
+		changed = append(changed, l)
+	}
+	for _, l := range changed {
+		t.maybeRemoveLocked(l)
+	}
+	t.reevaluateWaitersLocked(changed)
+}
+
+// AddDiscoveredLock informs the lock table of a replicated lock (write
+// intent) that was discovered in storage during evaluation, and enqueues the
+// request that discovered it on the lock.
+func (t *lockTableImpl) AddDiscoveredLock(intent *roachpb.Intent, g *lockTableGuardImpl) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	l := t.getOrCreateLocked(intent.Key)
+	if h := l.holder(intent.Txn.ID); h == nil {
+		l.holders = append(l.holders, &lockHolder{
+			txn:        intent.Txn,
+			strength:   lock.Intent,
+			durability: lock.Replicated,
+		})
+	} else {
+		h.strength = lock.Intent
+		h.durability = lock.Replicated
+	}
+	str := lock.None
+	for s := lock.Intent; s > lock.None; s-- {
+		for _, span := range g.spans.GetSpans(s) {
+			if span.ContainsKey(intent.Key) && s > str {
+				str = s
+			}
+		}
+	}
+	l.enqueue(g, str)
+}
+
+// AcquireLock informs the lock table that a transaction has acquired a lock
+// with the provided strength. Requests of the transaction that were queued
+// on the lock leave its wait-queue, as the transaction now holds it.
+func (t *lockTableImpl) AcquireLock(acq *roachpb.LockAcquisition) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	l := t.getOrCreateLocked(acq.Key)
+	h := l.holder(acq.Txn.ID)
+	switch {
+	case h == nil:
+		h = &lockHolder{txn: acq.Txn, strength: acq.Strength, durability: acq.Durability}
+		l.holders = append(l.holders, h)
+	case h.txn.Epoch < acq.Txn.Epoch:
+		*h = lockHolder{txn: acq.Txn, strength: acq.Strength, durability: acq.Durability}
+	default:
+		h.txn.WriteTimestamp.Forward(acq.Txn.WriteTimestamp)
+		if acq.Strength > h.strength {
+			h.strength = acq.Strength
+		}
+		if acq.Durability > h.durability {
+			h.durability = acq.Durability
+		}
+	}
+	for i := 0; i < len(l.queue); {
+		if qg := l.queue[i].g; qg.isSameTxn(&h.txn) {
+			l.dequeue(qg)
+			continue
+		}
+		i++
+	}
+	t.reevaluateWaitersLocked([]*lockState{l})
+}
+
+// UpdateLocks informs the lock table that a transaction has updated or
+// released the locks that it holds in the provided span. A finalized status
+// releases the locks; a pending status moves the locks to the transaction's
+// new timestamp.
+func (t *lockTableImpl) UpdateLocks(up *roachpb.LockUpdate) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var changed []*lockState
+	for _, l := range t.locksInSpanLocked(up.Span) {
+		h := l.holder(up.Txn.ID)
+		if h == nil {
+			continue
+		}
+		switch {
+		case up.Status.IsFinalized():
+			l.removeHolder(h)
+		case h.txn.Epoch < up.Txn.Epoch:
+			// The locks acquired in previous epochs are released when the
+			// transaction restarts, unless they are replicated.
+			if h.durability == lock.Unreplicated {
+				l.removeHolder(h)
+			}
+		default:
+			h.txn.WriteTimestamp.Forward(up.Txn.WriteTimestamp)
+		}
+		changed = append(changed, l)
+	}
+	for _, l := range changed {
+		t.maybeRemoveLocked(l)
+	}
+	t.reevaluateWaitersLocked(changed)
+}
+
+// Clear removes all the locks from the lock table. The requests waiting on
+// them are released, and the locks are then removed along with their
+// wait-queues.
+func (t *lockTableImpl) Clear() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	changed := append([]*lockState(nil), t.mu.ordered...)
+	for _, l := range changed {
+		l.holders = nil
+	}
+	t.reevaluateWaitersLocked(changed)
+	for _, l := range changed {
+		t.maybeRemoveLocked(l)
+	}
+}
+
+// reevaluateWaitersLocked recomputes the waiting state of the requests
+// queued on the provided locks, in FIFO order, after the locks changed.
+func (t *lockTableImpl) reevaluateWaitersLocked(changed []*lockState) {
+	var waiters []*lockTableGuardImpl
+	seen := make(map[*lockTableGuardImpl]struct{})
+	for _, l := range changed {
+		for _, qg := range l.queue {
+			if _, ok := seen[qg.g]; !ok {
+				seen[qg.g] = struct{}{}
+				waiters = append(waiters, qg.g)
+			}
+		}
+	}
+	sort.Slice(waiters, func(i, j int) bool { return waiters[i].seqNum < waiters[j].seqNum })
+	for _, g := range waiters {
+		if g.CurrentState().kind != waitFor {
+			// The request is not waiting. If it was, it is now evaluating or
+			// about to re-scan the lock table.
+			continue
+		}
+		g.updateState(t.findConflictLocked(g))
+	}
+}
+
+func (t *lockTableImpl) getOrCreateLocked(key roachpb.Key) *lockState {
+	l, ok := t.mu.locks[string(key)]
+	if !ok {
+		l = &lockState{key: key}
+		t.mu.locks[string(key)] = l
+		i := t.seekLocked(key)
+		t.mu.ordered = append(t.mu.ordered, nil)
+		copy(t.mu.ordered[i+1:], t.mu.ordered[i:])
+		t.mu.ordered[i] = l
+	}
+	return l
+}
+
+// maybeRemoveLocked removes the lock from the lock table if it is neither
+// held nor has requests in its wait-queue.
+func (t *lockTableImpl) maybeRemoveLocked(l *lockState) {
+	if len(l.holders) == 0 && len(l.queue) == 0 {
+		if t.mu.locks[string(l.key)] != l {
+			// The lock was already removed.
+			return
+		}
+		delete(t.mu.locks, string(l.key))
+		i := t.seekLocked(l.key)
+		t.mu.ordered = append(t.mu.ordered[:i], t.mu.ordered[i+1:]...)
+	}
+}
+
+// String returns a string representation of the lock table.
+func (t *lockTableImpl) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "num=%d\n", len(t.mu.locks))
+	for _, l := range t.mu.ordered {
+		fmt.Fprintf(&buf, " lock: %s\n", l.key)
+		for _, h := range l.holders {
+			fmt.Fprintf(&buf, "  holder: txn: %s, ts: %v, str: %s, dur: %s\n",
+				h.txn.Short(), h.txn.WriteTimestamp, h.strength, h.durability)
+		}
+		for _, qg := range l.queue {
+			fmt.Fprintf(&buf, "   queued %s: req: %d\n", qg.str, qg.g.seqNum)
+		}
+	}
+	return buf.String()
+}
@@ -0,0 +1,228 @@
+package concurrency
+
+import (
+	"context"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/concurrency/lock"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"time"
+)
+
+// LockTableDeadlockDetectionPushDelay is the amount of time that a request
+// waits on a conflicting lock before pushing the lock's holder. Pushing the
+// holder enters the pusher into the txnwait.Queue of the holder's
+// transaction record, which detects abandoned transactions and deadlocks.
+// The delay avoids the cost of pushing in the common case where the lock is
+// released quickly.
+var LockTableDeadlockDetectionPushDelay = 100 * time.Millisecond
+
+// lockTableWaiterImpl waits in lock wait-queues for the locks that a request
+// conflicts with to be released, pushing the transactions holding them if
+// they are not released after LockTableDeadlockDetectionPushDelay.
+type lockTableWaiterImpl struct {
+	lt *lockTableImpl
+	// ir is used to push the lock holders and resolve their locks. If nil,
+	// lock holders are never pushed.
+	ir IntentResolver
+}
+
+// WaitOn accepts and waits on a lockTableGuard that has returned true from
+// ShouldWait.
+//
+// The method waits until the guard's waiting state indicates that the
+// request is done waiting, and the request should scan the lock table again.
+// While waiting, it pushes the transaction of the lock holder, or of the
+// request ahead of it in the wait-queue, once the push delay elapses.
+//
+// Requests with an Error wait policy do not wait. They push the lock holder
+// immediately, only to clean up abandoned locks, and return a
+// WriteIntentError if the lock holder is still active.
+//
+// Each wait of the request on a transaction is reported to onEvent as a
+// ContentionEvent, once the request stops waiting on it.
+func (w *lockTableWaiterImpl) WaitOn(
+	ctx context.Context, req Request, guard *lockTableGuardImpl, onEvent func(kvpb.ContentionEvent),
+) *kvpb.Error {
+	var timer *time.Timer
+	var timerC <-chan time.Time
+	var timerWaitingState waitingState
+	h := contentionEventTracer{onEvent: onEvent}
+	defer func() {
+		h.emit()
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+
+	for {
+		select {
+		case <-guard.NewStateChan():
+			state := guard.CurrentState()
+			switch state.kind {
+			case doneWaiting:
+				return nil
+
+			case waitFor:
+				if req.WaitPolicy == lock.Error {
+					if pErr := w.pushLockTxnOrErr(ctx, req, state); pErr != nil {
+						return pErr
+					}
+					// The lock was abandoned and has been removed. The guard
+					// is notified of its new state.
+					continue
+				}
+				h.notify(state)
+				if w.ir == nil || state.txn == nil {
+					// Nothing to push; the request waits to be signaled.
+					timerC = nil
+					continue
+				}
+				if timerC != nil && timerWaitingState.txn.ID == state.txn.ID &&
+					timerWaitingState.key.Equal(state.key) {
+					// Still waiting on the same transaction and lock.
+					continue
+				}
+				if timer == nil {
+					timer = time.NewTimer(LockTableDeadlockDetectionPushDelay)
+				} else {
+					timer.Stop()
+					timer.Reset(LockTableDeadlockDetectionPushDelay)
+				}
+				timerC = timer.C
+				timerWaitingState = state
+
+			default:
+				panic("unexpected waiting state")
+			}
+
+		case <-timerC:
+			timerC = nil
+			if pErr := w.pushLockTxn(ctx, req, timerWaitingState); pErr != nil {
+				return pErr
+			}
+
+		case <-ctx.Done():
+			return kvpb.NewError(ctx.Err())
+		}
+	}
+}
+
+// pushLockTxn pushes the transaction the request is waiting on. Writers push
+// it to abort it, readers push its timestamp above their own. Once the push
+// succeeds, the conflicting lock, if held, is resolved, which releases it or
+// moves it above the reader's timestamp.
+func (w *lockTableWaiterImpl) pushLockTxn(
+	ctx context.Context, req Request, ws waitingState,
+) *kvpb.Error {
+	h := kvpb.Header{
+		Timestamp: req.Timestamp,
+		Txn:       req.Txn,
+	}
+	pushType := kvpb.PUSH_ABORT
+	if ws.guardStrength == lock.None {
+		pushType = kvpb.PUSH_TIMESTAMP
+	}
+	pusheeTxn, pErr := w.ir.PushTransaction(ctx, ws.txn, h, pushType)
+	if pErr != nil {
+		return pErr
+	}
+	return w.resolveLock(ctx, ws, pusheeTxn)
+}
+
+// pushLockTxnOrErr pushes the transaction holding the lock that a request
+// with an Error wait policy conflicts with, using a PUSH_TOUCH push. The push
+// only succeeds if the lock holder is abandoned or finalized, in which case
+// its lock is resolved. Otherwise, a WriteIntentError is returned.
+func (w *lockTableWaiterImpl) pushLockTxnOrErr(
+	ctx context.Context, req Request, ws waitingState,
+) *kvpb.Error {
+	intent := roachpb.MakeIntent(ws.txn, ws.key)
+	lockErr := kvpb.NewError(&kvpb.WriteIntentError{
+		Intents: []roachpb.Intent{intent},
+		Reason:  kvpb.WriteIntentError_REASON_WAIT_POLICY,
+	})
+	if w.ir == nil || !ws.held {
+		return lockErr
+	}
+	h := kvpb.Header{
+		Timestamp:  req.Timestamp,
+		Txn:        req.Txn,
+		WaitPolicy: req.WaitPolicy,
+	}
+	pusheeTxn, pErr := w.ir.PushTransaction(ctx, ws.txn, h, kvpb.PUSH_TOUCH)
+	if pErr != nil {
+		if _, ok := pErr.GetDetail().(*kvpb.TransactionPushError); ok {
+			return lockErr
+		}
+		return pErr
+	}
+	return w.resolveLock(ctx, ws, pusheeTxn)
+}
+
+// resolveLock resolves the lock that the request waits on, if it is held,
+// once its holder has been pushed.
+func (w *lockTableWaiterImpl) resolveLock(
+	ctx context.Context, ws waitingState, pusheeTxn *roachpb.Transaction,
+) *kvpb.Error {
+	if !ws.held {
+		// The request was waiting on a request ahead of it in the wait-queue,
+		// not on a lock. There is nothing to resolve.
+		return nil
+	}
+
+	resolve := roachpb.MakeLockUpdate(pusheeTxn, roachpb.Span{Key: ws.key})
+	if pErr := w.ir.ResolveIntent(ctx, resolve); pErr != nil {
+		return pErr
+	}
+	// Inform the lock table directly, in case the lock was not replicated
+	// and the resolution did not go through the concurrency manager.
+	w.lt.UpdateLocks(&resolve)
+	return nil
+}
+
+// contentionEventTracer turns the successive waiting states of a request
+// into ContentionEvents: an event is emitted each time the request stops
+// waiting on a transaction and a key, covering the time that it waited on
+// them.
+type contentionEventTracer struct {
+	onEvent func(kvpb.ContentionEvent)
+	// waiting is the transaction and key that the request is waiting on,
+	// since start. Its txn is nil if the request is not waiting on a
+	// transaction.
+	waiting waitingState
+	start   time.Time
+}
+
+// notify informs the tracer of the request's new waiting state, emitting
+// the event of the previous wait if the request now waits on another
+// transaction or key.
+func (h *contentionEventTracer) notify(ws waitingState) {
+	if h.waiting.txn != nil && ws.txn != nil &&
+		h.waiting.txn.ID == ws.txn.ID && h.waiting.key.Equal(ws.key) {
+		// Still waiting on the same transaction and key.
+		return
+	}
+	h.emit()
+	if ws.txn == nil {
+		// Waiting on a non-transactional request, which there is no
+		// transaction to blame for.
+		return
+	}
+	h.waiting = ws
+	h.start = time.Now()
+}
+
+// emit emits the event of the current wait, if any.
+func (h *contentionEventTracer) emit() {
+	if h.waiting.txn == nil {
+		return
+	}
+	if h.onEvent != nil {
+		h.onEvent(kvpb.ContentionEvent{
+			Key:      h.waiting.key,
+			TxnMeta:  *h.waiting.txn,
+			Duration: time.Since(h.start),
+		})
+	}
+	h.waiting = waitingState{}
+}
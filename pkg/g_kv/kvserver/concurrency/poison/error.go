@@ -0,0 +1,33 @@
+package poison
+
+import (
+	"errors"
+	"fmt"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+)
+
+// PoisonedError indicates that a request failed fast because it encountered
+// a poisoned latch, in accordance with its Policy_Error.
+type PoisonedError struct {
+	// Span is the span of the poisoned latch.
+	Span roachpb.Span
+	// Timestamp is the timestamp of the poisoned latch.
+	Timestamp hlc.Timestamp
+}
+
+// NewPoisonedError instantiates a *PoisonedError referencing a poisoned latch
+// (identified by span and timestamp).
+func NewPoisonedError(span roachpb.Span, ts hlc.Timestamp) *PoisonedError {
+	return &PoisonedError{Span: span, Timestamp: ts}
+}
+
+func (e *PoisonedError) Error() string {
+	return fmt.Sprintf("encountered poisoned latch %s@%v", e.Span, e.Timestamp)
+}
+
+// IsPoisonedError returns true if the error contains a *PoisonedError.
+func IsPoisonedError(err error) bool {
+	var pe *PoisonedError
+	return errors.As(err, &pe)
+}
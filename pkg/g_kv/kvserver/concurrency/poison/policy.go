@@ -0,0 +1,42 @@
+// Package poison contains the policies and errors used to poison latches.
+//
+// A latch is poisoned when the request holding it is not expected to release
+// it in a timely manner, for instance because the request's replication
+// proposal is stuck on an unavailable range. Requests waiting on a poisoned
+// latch then behave according to their Policy.
+package poison
+
+// Policy determines how a request will react to encountering a poisoned
+// latch. A poisoned latch is a latch for which the holder is unable to make
+// progress. That is, waiters of this latch should not expect to be able to
+// acquire this latch "for some time"; in practice this is the case of an
+// unavailable Replica.
+//
+// The name is inspired by Rust's mutexes, which undergo poisoning when a
+// thread panics while holding the mutex.
+type Policy int32
+
+const (
+	// Policy_Wait instructs a request to continue waiting upon encountering
+	// a poisoned latch.
+	//
+	// A request with this policy waits on a poisoned latch like on any other
+	// latch, but it poisons its own latches in turn, so that requests waiting
+	// on it can react to the poisoning as well.
+	Policy_Wait Policy = 0
+	// Policy_Error instructs a request to return an error upon encountering
+	// a poisoned latch.
+	Policy_Error Policy = 1
+)
+
+var policyNames = map[Policy]string{
+	Policy_Wait:  "Wait",
+	Policy_Error: "Error",
+}
+
+func (p Policy) String() string {
+	if name, ok := policyNames[p]; ok {
+		return name
+	}
+	return "Unknown"
+}
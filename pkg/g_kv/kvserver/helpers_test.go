@@ -0,0 +1,30 @@
+package kvserver
+
+import (
+	"context"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/kvserverpb"
+)
+
+// ForceRaftLogScanAndProcess processes the replicas which lead their range
+// with the Raft log queue, regardless of its thresholds.
+func (s *Store) ForceRaftLogScanAndProcess(ctx context.Context) error {
+	var err error
+	s.VisitReplicas(func(repl *Replica) bool {
+		if repl.isLeaderReady() {
+			_, err = s.raftLogQueue.process(ctx, repl)
+		}
+		return err == nil
+	})
+	return err
+}
+
+// RequestEpochLease requests an epoch-based lease of the range for the
+// replica, in place of the lease whose status is provided.
+func (r *Replica) RequestEpochLease(ctx context.Context, st kvserverpb.LeaseStatus) error {
+	replDesc, ok := r.Desc().GetReplicaDescriptorByID(r.ReplicaID())
+	if !ok {
+		return kvpb.NewRangeNotFoundError(r.RangeID, r.store.StoreID())
+	}
+	return r.requestLease(ctx, st, replDesc, false /* useExpiration */)
+}
@@ -0,0 +1,107 @@
+// Package intentresolver pushes the transactions whose locks conflict with
+// requests, and resolves those locks once the transactions are finalized or
+// pushed.
+package intentresolver
+
+import (
+	"context"
+	kv "github.com/dborchard/tiny_crdb/pkg/g_kv"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/dborchard/tiny_crdb/pkg/h_storage/enginepb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/stop"
+)
+
+// Config contains the dependencies to construct an IntentResolver.
+type Config struct {
+	Clock *hlc.Clock
+	// DB is used to send the PushTxn and ResolveIntent requests.
+	DB *kv.DB
+	// Stopper runs the asynchronous intent resolution tasks. If nil,
+	// intents are resolved synchronously.
+	Stopper *stop.Stopper
+}
+
+// IntentResolver manages the process of pushing transactions and
+// resolving intents. It implements the concurrency.IntentResolver
+// interface.
+type IntentResolver struct {
+	clock   *hlc.Clock
+	db      *kv.DB
+	stopper *stop.Stopper
+}
+
+// New creates an new IntentResolver.
+func New(c Config) *IntentResolver {
+	return &IntentResolver{
+		clock:   c.Clock,
+		db:      c.DB,
+		stopper: c.Stopper,
+	}
+}
+
+// PushTransaction takes a transaction and pushes its record using the
+// specified push type and request header. It returns the transaction proto
+// corresponding to the pushed transaction.
+func (ir *IntentResolver) PushTransaction(
+	ctx context.Context, pushTxn *enginepb.TxnMeta, h kvpb.Header, pushType kvpb.PushTxnType,
+) (*roachpb.Transaction, *kvpb.Error) {
+	pushTo := h.Timestamp.Next()
+	var pusherTxn roachpb.Transaction
+	if h.Txn != nil {
+		pusherTxn = *h.Txn
+	} else {
+		// A non-transactional pusher only carries a priority.
+		pusherTxn.Priority = roachpb.MakePriority(h.UserPriority)
+	}
+	b := &kv.Batch{}
+	b.Header.Timestamp = ir.clock.Now()
+	b.AddRawRequest(&kvpb.PushTxnRequest{
+		RequestHeader: kvpb.RequestHeader{Key: pushTxn.Key},
+		PusherTxn:     pusherTxn,
+		PusheeTxn:     *pushTxn,
+		PushTo:        pushTo,
+		PushType:      pushType,
+	})
+	if err := ir.db.Run(ctx, b); err != nil {
+		return nil, kvpb.NewError(err)
+	}
+	resp := b.RawResponse().Responses[0].GetInner().(*kvpb.PushTxnResponse)
+	return &resp.PusheeTxn, nil
+}
+
+// ResolveIntent synchronously resolves an intent according to the status
+// of the transaction that wrote it.
+func (ir *IntentResolver) ResolveIntent(ctx context.Context, intent roachpb.LockUpdate) *kvpb.Error {
+	b := &kv.Batch{}
+	b.AddRawRequest(&kvpb.ResolveIntentRequest{
+		RequestHeader:  kvpb.RequestHeader{Key: intent.Key},
+		IntentTxn:      intent.Txn,
+		Status:         intent.Status,
+		IgnoredSeqNums: intent.IgnoredSeqNums,
+	})
+	if err := ir.db.Run(ctx, b); err != nil {
+		return kvpb.NewError(err)
+	}
+	return nil
+}
+
+// ResolveIntentsAsync resolves the intents of finalized transactions in the
+// background. Failures are ignored: an intent that is left behind is resolved
+// by the next request that runs into it, which finds its transaction
+// finalized.
+func (ir *IntentResolver) ResolveIntentsAsync(ctx context.Context, intents []roachpb.LockUpdate) {
+	resolve := func(ctx context.Context) {
+		for _, intent := range intents {
+			_ = ir.ResolveIntent(ctx, intent)
+		}
+	}
+	if ir.stopper == nil {
+		resolve(ctx)
+		return
+	}
+	// The resolution outlives the request that triggered it.
+	ctx = context.WithoutCancel(ctx)
+	_ = ir.stopper.RunAsyncTask(ctx, "intentresolver: resolve intents", resolve)
+}
@@ -0,0 +1,80 @@
+package kvserverpb
+
+import (
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/liveness/livenesspb"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+)
+
+// LeaseState is the state of a range lease at a point in time.
+type LeaseState int32
+
+const (
+	// LeaseState_ERROR indicates that the lease can't be used or acquired,
+	// because the liveness record of its holder is not known.
+	LeaseState_ERROR LeaseState = iota
+	// LeaseState_VALID indicates that the lease is not expired at the
+	// current clock time and can be used to serve requests.
+	LeaseState_VALID
+	// LeaseState_EXPIRED indicates that the lease can't be used. An expired
+	// lease may become valid for the same leaseholder on RequestLease (for
+	// expiration leases), or once the epoch of its holder's liveness record
+	// is heartbeated again (for epoch leases); any other replica must first
+	// revoke it.
+	LeaseState_EXPIRED
+)
+
+func (s LeaseState) String() string {
+	switch s {
+	case LeaseState_ERROR:
+		return "ERROR"
+	case LeaseState_VALID:
+		return "VALID"
+	case LeaseState_EXPIRED:
+		return "EXPIRED"
+	default:
+		return "LeaseState(?)"
+	}
+}
+
+// LeaseStatus holds the lease state, the current clock time at which the
+// state is accurate, and the liveness record of the lease holder, for
+// epoch-based leases.
+type LeaseStatus struct {
+	// Lease which this status describes.
+	Lease roachpb.Lease
+	// Now is the clock reading at which the status was computed.
+	Now hlc.ClockTimestamp
+	// RequestTime is the timestamp of the request for which the status was
+	// computed. The lease must not expire at or below it.
+	RequestTime hlc.Timestamp
+	// State of the lease at Now and RequestTime.
+	State LeaseState
+	// Liveness is the liveness record of the lease holder at Now, for
+	// epoch-based leases.
+	Liveness livenesspb.Liveness
+}
+
+// IsValid returns whether the lease was valid at the time that the lease
+// status was computed.
+func (st LeaseStatus) IsValid() bool {
+	return st.State == LeaseState_VALID
+}
+
+// OwnedBy returns whether the lease is owned by the given store.
+func (st LeaseStatus) OwnedBy(storeID roachpb.StoreID) bool {
+	return st.Lease.OwnedBy(storeID)
+}
+
+// Expiration returns the expiration of the lease: that of the liveness
+// record of its holder, for epoch-based leases.
+func (st LeaseStatus) Expiration() hlc.Timestamp {
+	switch st.Lease.Type() {
+	case roachpb.LeaseExpiration:
+		return st.Lease.GetExpiration()
+	case roachpb.LeaseEpoch:
+		return st.Liveness.Expiration
+	default:
+		return hlc.Timestamp{}
+	}
+}
@@ -0,0 +1,87 @@
+// Package kvserverpb holds the messages of the kvserver package which are
+// replicated through Raft or sent between stores.
+package kvserverpb
+
+import (
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/dborchard/tiny_crdb/pkg/h_storage/enginepb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+)
+
+// Merge is the replicated part of a range merge: the MergeTrigger, along
+// with the point up to which the subsumed range must have applied its
+// commands before the merge applies.
+type Merge struct {
+	roachpb.MergeTrigger
+	// RightAppliedIndex is the applied index of the subsumed range when it
+	// was frozen by the merge. Every replica of the subsumed range must have
+	// applied its log up to this index before the merge applies, so that the
+	// merged range holds all of its data.
+	RightAppliedIndex uint64
+}
+
+// ReplicatedEvalResult is the structured information which together with a
+// batch of writes constitutes the proposal payload of a command. It describes
+// the changes to the range's state, beyond its data, which are made by the
+// command when it applies on every replica.
+type ReplicatedEvalResult struct {
+	// Split is set when the command commits a range split. The range's
+	// descriptor is narrowed to the left-hand side, and a new range is
+	// created for the right-hand side.
+	Split *roachpb.SplitTrigger
+	// Merge is set when the command commits a range merge. The range's
+	// descriptor is widened to subsume the right-hand range, which is
+	// removed.
+	Merge *Merge
+	// ChangeReplicas is set when the command commits a change of the range's
+	// replicas. The command is proposed as a Raft configuration change.
+	ChangeReplicas *roachpb.ChangeReplicasTrigger
+	// RaftTruncatedState is set when the command truncates the Raft log.
+	// Each replica removes the entries up to its index from its own log,
+	// unless it has already done so.
+	RaftTruncatedState *RaftTruncatedState
+	// Lease is set when the command installs a new lease for the range.
+	// IsLeaseRequest is set along with it, so that a rejection of the
+	// command is reported to its proposer as a LeaseRejectedError.
+	Lease          *roachpb.Lease
+	IsLeaseRequest bool
+	// Delta is the effect of the command on the MVCCStats of the range.
+	Delta enginepb.MVCCStats
+}
+
+// IsZero reports whether r is the zero value.
+func (r *ReplicatedEvalResult) IsZero() bool {
+	return r.Split == nil && r.Merge == nil && r.ChangeReplicas == nil &&
+		r.RaftTruncatedState == nil && r.Lease == nil && !r.IsLeaseRequest &&
+		r.Delta == (enginepb.MVCCStats{})
+}
+
+// RaftCommand is the payload of a Raft log entry: a batch of writes evaluated
+// by the leaseholder, along with the changes to the range's state that the
+// batch makes.
+type RaftCommand struct {
+	// ProposerLeaseSequence is the sequence of the lease under which the
+	// command was evaluated. A command is rejected when it applies if the
+	// range's lease changed since, as its evaluation may not account for the
+	// requests served by the new leaseholder.
+	ProposerLeaseSequence roachpb.LeaseSequence
+	ReplicatedEvalResult  ReplicatedEvalResult
+	// ClosedTimestamp is the timestamp closed by the leaseholder when it
+	// proposed the command, if any: the leaseholder serves no write at or
+	// below it past the command. Once the command applies, followers serve
+	// reads at or below it.
+	ClosedTimestamp *hlc.Timestamp
+	// WriteBatch is the representation of the batch of writes, as returned
+	// by storage.WriteBatch.Repr.
+	WriteBatch []byte
+	// LogicalOpLog contains a series of logical MVCC operations that
+	// correspond to the physical operations being made in the WriteBatch.
+	// They feed the rangefeeds of the range.
+	LogicalOpLog *LogicalOpLog
+}
+
+// LogicalOpLog is a log of logical MVCC operations. A slice of
+// MVCCLogicalOps.
+type LogicalOpLog struct {
+	Ops []enginepb.MVCCLogicalOp
+}
@@ -0,0 +1,108 @@
+package kvserverpb
+
+import (
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"go.etcd.io/raft/v3/raftpb"
+)
+
+// RaftTruncatedState contains metadata about the truncated portion of the
+// Raft log: the index and term of the last entry removed from the log.
+type RaftTruncatedState struct {
+	// Index is the index of the last entry removed from the log.
+	Index uint64
+	// Term is the term of the last entry removed from the log.
+	Term uint64
+}
+
+// RaftMessageRequest is the request used to send Raft messages between the
+// replicas of a range, through a RaftTransport.
+type RaftMessageRequest struct {
+	RangeID     roachpb.RangeID
+	FromReplica roachpb.ReplicaDescriptor
+	ToReplica   roachpb.ReplicaDescriptor
+	Message     raftpb.Message
+}
+
+// SnapshotRequest_Type is the type of a snapshot.
+type SnapshotRequest_Type int32
+
+const (
+	// SnapshotRequest_RAFT is a snapshot requested by the Raft group of the
+	// range, to catch up a follower which needs entries truncated from the
+	// log of its leader.
+	SnapshotRequest_RAFT SnapshotRequest_Type = iota
+	// SnapshotRequest_INITIAL is the snapshot sent to a new replica of the
+	// range, once it is added to the range.
+	SnapshotRequest_INITIAL
+)
+
+func (t SnapshotRequest_Type) String() string {
+	switch t {
+	case SnapshotRequest_RAFT:
+		return "RAFT"
+	case SnapshotRequest_INITIAL:
+		return "INITIAL"
+	default:
+		return "SnapshotRequest_Type(?)"
+	}
+}
+
+// SnapshotRequest_Header is the first message of a snapshot stream. It
+// describes the snapshot which follows.
+type SnapshotRequest_Header struct {
+	// Desc is the descriptor of the range, as of the snapshot.
+	Desc roachpb.RangeDescriptor
+	// RaftMessageRequest is the MsgSnap of the snapshot, whose metadata
+	// carries the index and term of the last entry applied to the range's
+	// state in the snapshot.
+	RaftMessageRequest RaftMessageRequest
+	// Type is the type of the snapshot.
+	Type SnapshotRequest_Type
+	// RangeSize is the size of the range's data, as per its MVCCStats.
+	RangeSize int64
+}
+
+// SnapshotRequest is a message of a snapshot stream: its header, or one of
+// the SSTables of the range's data which follow it.
+type SnapshotRequest struct {
+	// Header is set on the first message of the stream only.
+	Header *SnapshotRequest_Header
+	// SSTChunk is an SSTable holding part of the range's data.
+	SSTChunk []byte
+	// Final is set on the last message of the stream.
+	Final bool
+}
+
+// SnapshotResponse_Status is the status of a SnapshotResponse.
+type SnapshotResponse_Status int32
+
+const (
+	// SnapshotResponse_ERROR means that the snapshot was rejected, or could
+	// not be applied.
+	SnapshotResponse_ERROR SnapshotResponse_Status = iota
+	// SnapshotResponse_ACCEPTED means that the receiver accepted the
+	// snapshot described by the header, and awaits its data.
+	SnapshotResponse_ACCEPTED
+	// SnapshotResponse_APPLIED means that the receiver applied the snapshot.
+	SnapshotResponse_APPLIED
+)
+
+func (s SnapshotResponse_Status) String() string {
+	switch s {
+	case SnapshotResponse_ERROR:
+		return "ERROR"
+	case SnapshotResponse_ACCEPTED:
+		return "ACCEPTED"
+	case SnapshotResponse_APPLIED:
+		return "APPLIED"
+	default:
+		return "SnapshotResponse_Status(?)"
+	}
+}
+
+// SnapshotResponse is the response of the receiver of a snapshot stream.
+type SnapshotResponse struct {
+	Status SnapshotResponse_Status
+	// Message explains an ERROR status.
+	Message string
+}
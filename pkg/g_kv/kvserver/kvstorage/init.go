@@ -2,31 +2,57 @@ package kvstorage
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	keys "github.com/dborchard/tiny_crdb/pkg/g_keys"
 	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
 	storage "github.com/dborchard/tiny_crdb/pkg/h_storage"
 	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
 )
 
+// ErrStoreNotBootstrapped is returned by ReadStoreIdent when the engine does
+// not hold a store ident, i.e. when it has not been initialized yet.
+var ErrStoreNotBootstrapped = errors.New("store has not been bootstrapped")
+
 // InitEngine writes a new store ident to the underlying engine. To
 // ensure that no crufty data already exists in the engine, it scans
 // the engine contents before writing the new store ident. The engine
-// should be completely empty save for a cluster version, which must
-// already have been persisted to it. Returns an error if this is not
-// the case.
+// should be completely empty. Returns an error if this is not the case.
 func InitEngine(ctx context.Context, eng storage.Engine, ident roachpb.StoreIdent) error {
+	res, err := storage.MVCCScan(ctx, eng, roachpb.KeyMin, roachpb.KeyMax, hlc.MaxTimestamp,
+		storage.MVCCScanOptions{Inconsistent: true, MaxKeys: 1})
+	if err != nil {
+		return err
+	}
+	if len(res.KVs) > 0 {
+		return fmt.Errorf("engine is not empty; found key %s", res.KVs[0].Key)
+	}
+
 	batch := eng.NewBatch()
+	defer batch.Close()
 	if err := storage.MVCCPutProto(
 		ctx,
 		batch,
-		roachpb.Key{},
+		keys.StoreIdentKey(),
 		hlc.Timestamp{},
+		&ident,
+		storage.MVCCWriteOptions{},
 	); err != nil {
-		batch.Close()
-		return err
-	}
-	if err := batch.Commit(true /* sync */); err != nil {
 		return err
 	}
+	return batch.Commit(true /* sync */)
+}
 
-	return nil
+// ReadStoreIdent reads the StoreIdent from the store. It returns
+// ErrStoreNotBootstrapped if the ident is missing.
+func ReadStoreIdent(ctx context.Context, eng storage.Engine) (roachpb.StoreIdent, error) {
+	var ident roachpb.StoreIdent
+	ok, err := storage.MVCCGetProto(
+		ctx, eng, keys.StoreIdentKey(), hlc.Timestamp{}, &ident, storage.MVCCGetOptions{})
+	if err != nil {
+		return roachpb.StoreIdent{}, err
+	} else if !ok {
+		return roachpb.StoreIdent{}, ErrStoreNotBootstrapped
+	}
+	return ident, nil
 }
@@ -0,0 +1,46 @@
+package kvstorage
+
+import (
+	"bytes"
+	"context"
+	keys "github.com/dborchard/tiny_crdb/pkg/g_keys"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	storage "github.com/dborchard/tiny_crdb/pkg/h_storage"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+)
+
+// IterateRangeDescriptorsFromDisk calls the provided function with each
+// descriptor from the provided Engine. The return values of this method and
+// fn have semantics similar to engine.MVCCIterate.
+//
+// Range descriptors are stored at range-local keys, so they all sort
+// together under the range-local prefix, interleaved with the other
+// range-local keys (such as transaction records), which are skipped.
+func IterateRangeDescriptorsFromDisk(
+	ctx context.Context, reader storage.Reader, fn func(desc roachpb.RangeDescriptor) error,
+) error {
+	start := keys.LocalRangePrefix
+	end := keys.LocalRangePrefix.PrefixEnd()
+	res, err := storage.MVCCScan(ctx, reader, start, end, hlc.MaxTimestamp,
+		storage.MVCCScanOptions{Inconsistent: true})
+	if err != nil {
+		return err
+	}
+	for _, kv := range res.KVs {
+		_, suffix, _, err := keys.DecodeRangeKey(kv.Key)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(suffix, keys.LocalRangeDescriptorSuffix) {
+			continue
+		}
+		var desc roachpb.RangeDescriptor
+		if err := kv.Value.GetProto(&desc); err != nil {
+			return err
+		}
+		if err := fn(desc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
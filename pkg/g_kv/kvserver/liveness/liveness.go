@@ -0,0 +1,312 @@
+// Package liveness maintains the liveness records of the nodes of a cluster.
+// Each node heartbeats its own record, which keeps it live until the record's
+// expiration, and epoch-based range leases are tied to the epoch of their
+// holder's record: they are valid for as long as the record is live, and are
+// revoked by incrementing its epoch once it has expired.
+package liveness
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	keys "github.com/dborchard/tiny_crdb/pkg/g_keys"
+	kv "github.com/dborchard/tiny_crdb/pkg/g_kv"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/liveness/livenesspb"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/stop"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultLivenessThreshold is the duration for which a heartbeat keeps
+	// the record of a node live.
+	defaultLivenessThreshold = 9 * time.Second
+	// defaultHeartbeatInterval is the interval at which a node heartbeats
+	// its record, well within the liveness threshold.
+	defaultHeartbeatInterval = 4500 * time.Millisecond
+)
+
+var (
+	// ErrRecordCacheMiss is returned when the liveness record of a node is
+	// not known, for instance before the node heartbeated it for the first
+	// time.
+	ErrRecordCacheMiss = errors.New("liveness record not found in cache")
+	// ErrEpochIncremented is returned when a heartbeat finds that the epoch
+	// of the node's record was incremented by another node. The leases held
+	// by the node under its previous epoch are no longer valid.
+	ErrEpochIncremented = errors.New("heartbeat failed on epoch increment")
+	// ErrEpochAlreadyIncremented is returned by IncrementEpoch when the
+	// epoch of the record was already incremented.
+	ErrEpochAlreadyIncremented = errors.New("epoch already incremented")
+	// ErrLiveNode is returned by IncrementEpoch when the record of the node
+	// is still live.
+	ErrLiveNode = errors.New("cannot increment epoch on live node")
+)
+
+// NodeLivenessOptions is the arguments to NewNodeLiveness.
+type NodeLivenessOptions struct {
+	DB      *kv.DB
+	Clock   *hlc.Clock
+	Stopper *stop.Stopper
+	// LivenessThreshold is the duration for which a heartbeat keeps the
+	// record of a node live. If zero, defaultLivenessThreshold is used.
+	LivenessThreshold time.Duration
+	// HeartbeatInterval is the interval between the heartbeats of the node's
+	// record, which also refresh the cache of the records of the other
+	// nodes. If zero, defaultHeartbeatInterval is used.
+	HeartbeatInterval time.Duration
+}
+
+// NodeLiveness is a centralized failure detector that coordinates with the
+// epoch-based range system to provide for leases of indefinite length
+// (replacing frequent per-range lease renewals with heartbeats to the
+// liveness system).
+//
+// The records are stored in the node liveness span, which is served with
+// expiration-based leases so as not to depend on itself. Every node caches
+// the records of all the nodes, which it refreshes along with the heartbeats
+// of its own record.
+type NodeLiveness struct {
+	db                *kv.DB
+	clock             *hlc.Clock
+	stopper           *stop.Stopper
+	livenessThreshold time.Duration
+	heartbeatInterval time.Duration
+
+	mu struct {
+		sync.RWMutex
+		// nodeID is the ID of the node, once started.
+		nodeID roachpb.NodeID
+		// records caches the latest known liveness records, by node.
+		records map[roachpb.NodeID]livenesspb.Liveness
+		// selfHeartbeated is closed once the record of the node is cached,
+		// after its first successful heartbeat.
+		selfHeartbeated chan struct{}
+	}
+}
+
+// NewNodeLiveness returns a new instance of NodeLiveness configured
+// with the specified options.
+func NewNodeLiveness(opts NodeLivenessOptions) *NodeLiveness {
+	nl := &NodeLiveness{
+		db:                opts.DB,
+		clock:             opts.Clock,
+		stopper:           opts.Stopper,
+		livenessThreshold: opts.LivenessThreshold,
+		heartbeatInterval: opts.HeartbeatInterval,
+	}
+	if nl.livenessThreshold == 0 {
+		nl.livenessThreshold = defaultLivenessThreshold
+	}
+	if nl.heartbeatInterval == 0 {
+		nl.heartbeatInterval = defaultHeartbeatInterval
+	}
+	nl.mu.records = make(map[roachpb.NodeID]livenesspb.Liveness)
+	nl.mu.selfHeartbeated = make(chan struct{})
+	return nl
+}
+
+// Start starts a periodic heartbeat of the liveness record of the node,
+// which also refreshes the cached records of the other nodes. The first
+// heartbeat of a node whose record exists increments its epoch: the leases
+// held by a previous incarnation of the node are not carried over.
+func (nl *NodeLiveness) Start(ctx context.Context, nodeID roachpb.NodeID) error {
+	nl.mu.Lock()
+	nl.mu.nodeID = nodeID
+	nl.mu.Unlock()
+	return nl.stopper.RunAsyncTask(ctx, "liveness: heartbeat loop", func(ctx context.Context) {
+		ctx, cancel := nl.stopper.WithCancelOnQuiesce(ctx)
+		defer cancel()
+		ticker := time.NewTicker(nl.heartbeatInterval)
+		defer ticker.Stop()
+		for {
+			// Failed heartbeats are retried at the next interval; the
+			// record expires if they keep failing.
+			_ = nl.heartbeat(ctx)
+			_ = nl.refreshRecords(ctx)
+			select {
+			case <-ticker.C:
+			case <-nl.stopper.ShouldQuiesce():
+				return
+			}
+		}
+	})
+}
+
+// heartbeat extends the expiration of the node's liveness record, creating
+// the record if it does not exist. It fails with ErrEpochIncremented if the
+// epoch of the record was incremented since the previous heartbeat, in which
+// case the next heartbeat extends the record under its new epoch.
+func (nl *NodeLiveness) heartbeat(ctx context.Context) error {
+	self, haveSelf := nl.Self()
+	nodeID := nl.nodeID()
+	var newLiveness livenesspb.Liveness
+	err := nl.db.Txn(ctx, func(ctx context.Context, txn *kv.Txn) error {
+		cur, found, err := getLiveness(ctx, txn, nodeID)
+		if err != nil {
+			return err
+		}
+		switch {
+		case !found:
+			newLiveness = livenesspb.Liveness{NodeID: nodeID, Epoch: 1}
+		case !haveSelf:
+			newLiveness = cur
+			newLiveness.Epoch++
+		case cur.Epoch != self.Epoch:
+			newLiveness = cur
+			return ErrEpochIncremented
+		default:
+			newLiveness = cur
+		}
+		newLiveness.Expiration = nl.clock.Now().Add(nl.livenessThreshold.Nanoseconds(), 0)
+		return txn.Put(ctx, keys.NodeLivenessKey(nodeID), &newLiveness)
+	})
+	if err == nil || errors.Is(err, ErrEpochIncremented) {
+		nl.maybeUpdate(newLiveness)
+	}
+	return err
+}
+
+// refreshRecords refreshes the cached liveness records of the other nodes.
+// The record of the node itself is only learned through its heartbeats, so
+// that its first heartbeat is not mistaken for the extension of the record
+// of a previous incarnation.
+func (nl *NodeLiveness) refreshRecords(ctx context.Context) error {
+	var records []livenesspb.Liveness
+	if err := nl.db.Txn(ctx, func(ctx context.Context, txn *kv.Txn) error {
+		records = records[:0]
+		kvs, err := txn.Scan(ctx, keys.NodeLivenessPrefix, keys.NodeLivenessKeyMax, 0 /* maxRows */)
+		if err != nil {
+			return err
+		}
+		for _, kv := range kvs {
+			var l livenesspb.Liveness
+			if err := kv.Value.GetProto(&l); err != nil {
+				return err
+			}
+			records = append(records, l)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	nodeID := nl.nodeID()
+	for _, l := range records {
+		if l.NodeID != nodeID {
+			nl.maybeUpdate(l)
+		}
+	}
+	return nil
+}
+
+// IncrementEpoch is called to attempt to revoke the epoch-based leases of a
+// node whose liveness record has expired, by incrementing the epoch of its
+// record. The liveness is that which the caller found expired. It fails if
+// the record is live again, and returns ErrEpochAlreadyIncremented if its
+// epoch was already incremented.
+func (nl *NodeLiveness) IncrementEpoch(ctx context.Context, liveness livenesspb.Liveness) error {
+	var newLiveness livenesspb.Liveness
+	err := nl.db.Txn(ctx, func(ctx context.Context, txn *kv.Txn) error {
+		cur, found, err := getLiveness(ctx, txn, liveness.NodeID)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return fmt.Errorf("liveness record of n%d not found", liveness.NodeID)
+		}
+		newLiveness = cur
+		if cur.Epoch > liveness.Epoch {
+			return ErrEpochAlreadyIncremented
+		}
+		if cur.IsLive(nl.clock.Now()) {
+			return fmt.Errorf("n%d: %w", liveness.NodeID, ErrLiveNode)
+		}
+		newLiveness.Epoch++
+		return txn.Put(ctx, keys.NodeLivenessKey(liveness.NodeID), &newLiveness)
+	})
+	if err == nil || errors.Is(err, ErrEpochAlreadyIncremented) || errors.Is(err, ErrLiveNode) {
+		nl.maybeUpdate(newLiveness)
+	}
+	return err
+}
+
+// Self returns the liveness record of the node, as of its last heartbeat. It
+// returns false if the node has not heartbeated its record yet.
+func (nl *NodeLiveness) Self() (livenesspb.Liveness, bool) {
+	return nl.GetLiveness(nl.nodeID())
+}
+
+// SelfHeartbeated returns a channel which is closed once the node has
+// heartbeated its liveness record, from which point Self finds the record.
+func (nl *NodeLiveness) SelfHeartbeated() <-chan struct{} {
+	nl.mu.RLock()
+	defer nl.mu.RUnlock()
+	return nl.mu.selfHeartbeated
+}
+
+// GetLiveness returns the cached liveness record of the node, and whether it
+// is known.
+func (nl *NodeLiveness) GetLiveness(nodeID roachpb.NodeID) (livenesspb.Liveness, bool) {
+	nl.mu.RLock()
+	defer nl.mu.RUnlock()
+	l, ok := nl.mu.records[nodeID]
+	return l, ok
+}
+
+// IsLive returns whether the node is live, according to its cached liveness
+// record.
+func (nl *NodeLiveness) IsLive(nodeID roachpb.NodeID) (bool, error) {
+	l, ok := nl.GetLiveness(nodeID)
+	if !ok {
+		return false, ErrRecordCacheMiss
+	}
+	return l.IsLive(nl.clock.Now()), nil
+}
+
+func (nl *NodeLiveness) nodeID() roachpb.NodeID {
+	nl.mu.RLock()
+	defer nl.mu.RUnlock()
+	return nl.mu.nodeID
+}
+
+// maybeUpdate replaces the cached liveness record of the node, unless the
+// cached one is newer: it has a higher epoch, or the same epoch and a later
+// expiration.
+func (nl *NodeLiveness) maybeUpdate(l livenesspb.Liveness) {
+	if l.NodeID == 0 {
+		return
+	}
+	nl.mu.Lock()
+	defer nl.mu.Unlock()
+	if old, ok := nl.mu.records[l.NodeID]; ok {
+		if old.Epoch > l.Epoch || (old.Epoch == l.Epoch && l.Expiration.Less(old.Expiration)) {
+			return
+		}
+	}
+	nl.mu.records[l.NodeID] = l
+	if l.NodeID == nl.mu.nodeID {
+		select {
+		case <-nl.mu.selfHeartbeated:
+		default:
+			close(nl.mu.selfHeartbeated)
+		}
+	}
+}
+
+// getLiveness reads the liveness record of the node in the transaction,
+// locking it.
+func getLiveness(
+	ctx context.Context, txn *kv.Txn, nodeID roachpb.NodeID,
+) (livenesspb.Liveness, bool, error) {
+	res, err := txn.GetForUpdate(ctx, keys.NodeLivenessKey(nodeID))
+	if err != nil || res.Value == nil {
+		return livenesspb.Liveness{}, false, err
+	}
+	var l livenesspb.Liveness
+	if err := res.Value.GetProto(&l); err != nil {
+		return livenesspb.Liveness{}, false, err
+	}
+	return l, true, nil
+}
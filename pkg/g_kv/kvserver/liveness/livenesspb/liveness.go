@@ -0,0 +1,34 @@
+// Package livenesspb holds the liveness records of the nodes of a cluster.
+package livenesspb
+
+import (
+	"fmt"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+)
+
+// Liveness holds information about a node's latest heartbeat and epoch.
+//
+// NOTE: Care must be taken when changing the encoding of this proto
+// because it is used as part of conditional put operations.
+type Liveness struct {
+	NodeID roachpb.NodeID
+	// Epoch is a monotonically-increasing value for node liveness. It
+	// may be incremented if the liveness record expires (current time
+	// is later than the expiration timestamp). The epoch of a node
+	// invalidates the epoch-based leases held under its previous epochs.
+	Epoch int64
+	// Expiration is the time at which the liveness record expires, unless
+	// the node heartbeats it again before then.
+	Expiration hlc.Timestamp
+}
+
+// IsLive returns whether the node is considered live at the given time.
+func (l *Liveness) IsLive(now hlc.Timestamp) bool {
+	return now.Less(l.Expiration)
+}
+
+func (l Liveness) String() string {
+	return fmt.Sprintf("liveness(nid:%d epo:%d exp:%d.%09d,%d)", l.NodeID, l.Epoch,
+		l.Expiration.WallTime/1e9, l.Expiration.WallTime%1e9, l.Expiration.Logical)
+}
@@ -0,0 +1,73 @@
+// Package lockspanset provides LockSpanSet, the set of key spans, along with
+// the strength with which they are accessed, declared by a request before it
+// is evaluated. LockSpanSets are used to scan the lock table of the
+// concurrency manager, and are to locks what spanset.SpanSets are to latches.
+package lockspanset
+
+import (
+	"fmt"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/concurrency/lock"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"strings"
+)
+
+// NumLockStrength is the number of lock strengths.
+const NumLockStrength = int(lock.Intent) + 1
+
+// LockSpanSet tracks the set of key spans, broken down by the strength with
+// which they are accessed, within which a request expects to have isolation
+// from conflicting transactions. Spans accessed with strength lock.None are
+// read without acquiring locks. The LockSpanSet is not thread-safe.
+type LockSpanSet struct {
+	spans [NumLockStrength][]roachpb.Span
+}
+
+// New creates a new empty LockSpanSet.
+func New() *LockSpanSet {
+	return &LockSpanSet{}
+}
+
+// String prints a string representation of the LockSpanSet.
+func (l *LockSpanSet) String() string {
+	var buf strings.Builder
+	for st := lock.Strength(0); int(st) < NumLockStrength; st++ {
+		for _, span := range l.GetSpans(st) {
+			fmt.Fprintf(&buf, "%s: %s\n", st, span)
+		}
+	}
+	return buf.String()
+}
+
+// Len returns the total number of spans tracked across all strengths.
+func (l *LockSpanSet) Len() int {
+	var count int
+	for st := range l.spans {
+		count += len(l.spans[st])
+	}
+	return count
+}
+
+// Empty returns whether the set contains any spans across all strengths.
+func (l *LockSpanSet) Empty() bool {
+	return l.Len() == 0
+}
+
+// Copy copies the LockSpanSet.
+func (l *LockSpanSet) Copy() *LockSpanSet {
+	n := &LockSpanSet{}
+	for st := range l.spans {
+		n.spans[st] = append(n.spans[st], l.spans[st]...)
+	}
+	return n
+}
+
+// Add adds the supplied span to the LockSpanSet to be accessed with the
+// given lock strength.
+func (l *LockSpanSet) Add(str lock.Strength, span roachpb.Span) {
+	l.spans[str] = append(l.spans[str], span)
+}
+
+// GetSpans returns a slice of spans accessed with the given strength.
+func (l *LockSpanSet) GetSpans(str lock.Strength) []roachpb.Span {
+	return l.spans[str]
+}
@@ -0,0 +1,88 @@
+package kvserver
+
+import (
+	"context"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+)
+
+// mergeQueue manages a queue of ranges slated to be merged with their
+// right-hand neighbour. A range is merged when it is smaller than
+// StoreConfig.RangeMinBytes, as long as the merged range would not be split
+// again right away: the combined size must stay below
+// StoreConfig.RangeMaxBytes, and the combined request rate well below
+// StoreConfig.SplitQPSThreshold. Ranges are never merged across the initial
+// split keys of the cluster, nor into a range whose sticky bit is set.
+type mergeQueue struct {
+	*baseQueue
+}
+
+// newMergeQueue returns a new instance of mergeQueue.
+func newMergeQueue(store *Store) *mergeQueue {
+	mq := &mergeQueue{}
+	mq.baseQueue = newBaseQueue("merge", mq, store, queueConfig{needsLease: true})
+	return mq
+}
+
+// shouldQueue determines whether a range should be queued for merging with
+// its right-hand neighbour. Smaller ranges have a higher priority.
+func (mq *mergeQueue) shouldQueue(ctx context.Context, repl *Replica) (bool, float64) {
+	desc := repl.Desc()
+	if !canMergeRight(desc) {
+		return false, 0
+	}
+	sizeRatio := float64(repl.GetMVCCStats().Total()) / float64(mq.store.cfg.RangeMinBytes)
+	if sizeRatio >= 1 {
+		return false, 0
+	}
+	return true, 1 - sizeRatio
+}
+
+// process merges the range with its right-hand neighbour, if the merged range
+// would be neither too large nor too busy. The neighbour must be served by the
+// store, and have its replicas on the same stores.
+func (mq *mergeQueue) process(ctx context.Context, lhsRepl *Replica) (bool, error) {
+	lhsDesc := lhsRepl.Desc()
+	rhsRepl := mq.store.LookupReplica(lhsDesc.EndKey)
+	if rhsRepl == nil || !rhsRepl.isLeaseholderReady() {
+		return false, nil
+	}
+	rhsDesc := rhsRepl.Desc()
+	if !replicaSetsEqual(lhsDesc, rhsDesc) {
+		return false, nil
+	}
+	if now := mq.store.Clock().Now(); now.Less(rhsDesc.StickyBit) {
+		return false, nil
+	}
+	lhsStats, rhsStats := lhsRepl.GetMVCCStats(), rhsRepl.GetMVCCStats()
+	if lhsStats.Total()+rhsStats.Total() >= mq.store.cfg.RangeMaxBytes {
+		return false, nil
+	}
+	// The merged range must not be split again by the split queue as soon as
+	// it is merged.
+	if lhsRepl.load.QPS()+rhsRepl.load.QPS() >= mq.store.cfg.SplitQPSThreshold/2 {
+		return false, nil
+	}
+	if _, pErr := lhsRepl.AdminMerge(ctx, kvpb.AdminMergeRequest{
+		RequestHeader: kvpb.RequestHeader{Key: lhsDesc.StartKey.AsRawKey()},
+	}); pErr != nil {
+		return false, pErr.GoError()
+	}
+	return true, nil
+}
+
+// canMergeRight returns whether the range may be merged with its right-hand
+// neighbour. The last range has no such neighbour, the meta range cannot be
+// merged, and the initial split keys separate the meta and system ranges
+// from the rest of the keyspace.
+func canMergeRight(desc *roachpb.RangeDescriptor) bool {
+	if desc.EndKey.Equal(roachpb.RKeyMax) || !canSplit(desc) {
+		return false
+	}
+	for _, key := range initialSplitKeys {
+		if desc.EndKey.Equal(key) {
+			return false
+		}
+	}
+	return true
+}
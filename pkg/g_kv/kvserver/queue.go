@@ -0,0 +1,147 @@
+package kvserver
+
+import (
+	"context"
+	"fmt"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"sort"
+	"sync"
+)
+
+// queueImpl is implemented by the queues which process the replicas of a
+// store, such as the split and merge queues.
+type queueImpl interface {
+	// shouldQueue determines whether the replica should be processed by the
+	// queue, and if so, with which priority. Replicas with higher priorities
+	// are processed first.
+	shouldQueue(ctx context.Context, repl *Replica) (shouldQ bool, priority float64)
+
+	// process processes the replica. It returns whether the replica was
+	// acted upon; a replica may turn out not to need processing once the
+	// queue takes a closer look at it.
+	process(ctx context.Context, repl *Replica) (processed bool, err error)
+}
+
+// queueConfig holds the settings of a replica queue.
+type queueConfig struct {
+	// needsLease restricts the queue to the replicas which hold the lease of
+	// their range. Queues which act upon the range as a whole, such as the
+	// split queue, need it; the replica GC queue processes replicas which
+	// may no longer be part of their range.
+	needsLease bool
+}
+
+// baseQueue is the base implementation of the replica queues. The replicas of
+// the store are offered to the queue by the store's scanner; those which the
+// queue's implementation accepts are processed in order of priority.
+type baseQueue struct {
+	name  string
+	impl  queueImpl
+	store *Store
+	queueConfig
+
+	mu struct {
+		sync.Mutex
+		disabled bool
+		// processing holds the replicas being processed by
+		// maybeProcessAsync.
+		processing map[roachpb.RangeID]struct{}
+	}
+}
+
+func newBaseQueue(name string, impl queueImpl, store *Store, cfg queueConfig) *baseQueue {
+	bq := &baseQueue{name: name, impl: impl, store: store, queueConfig: cfg}
+	bq.mu.processing = make(map[roachpb.RangeID]struct{})
+	return bq
+}
+
+// SetDisabled turns queue processing off or on as directed.
+func (bq *baseQueue) SetDisabled(disabled bool) {
+	bq.mu.Lock()
+	defer bq.mu.Unlock()
+	bq.mu.disabled = disabled
+}
+
+func (bq *baseQueue) isDisabled() bool {
+	bq.mu.Lock()
+	defer bq.mu.Unlock()
+	return bq.mu.disabled
+}
+
+// scanAndProcess offers every replica of the store to the queue, and
+// processes those that it accepts, in order of priority. Replicas destroyed
+// while the queue is processed, such as by a merge, are skipped. The first
+// processing error is returned, once all the replicas have been processed.
+func (bq *baseQueue) scanAndProcess(ctx context.Context) error {
+	if bq.isDisabled() {
+		return nil
+	}
+	type queueItem struct {
+		repl     *Replica
+		priority float64
+	}
+	var items []queueItem
+	bq.store.VisitReplicas(func(repl *Replica) bool {
+		// The replicas of a range are processed by its leaseholder, for the
+		// queues which need the lease.
+		if bq.needsLease && !repl.isLeaseholderReady() {
+			return true
+		}
+		if shouldQ, priority := bq.impl.shouldQueue(ctx, repl); shouldQ {
+			items = append(items, queueItem{repl: repl, priority: priority})
+		}
+		return true
+	})
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].priority > items[j].priority
+	})
+
+	var firstErr error
+	for _, item := range items {
+		if item.repl.IsDestroyed() != nil {
+			continue
+		}
+		if _, err := bq.impl.process(ctx, item.repl); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("%s: r%d: %w", bq.name, item.repl.RangeID, err)
+		}
+	}
+	return firstErr
+}
+
+// maybeProcessAsync offers the replica to the queue outside of the store's
+// scans, such as when a change of its state calls for it, and processes it in
+// an async task if the queue accepts it. A replica is processed by at most one
+// such task at a time.
+func (bq *baseQueue) maybeProcessAsync(ctx context.Context, repl *Replica) {
+	if bq.isDisabled() {
+		return
+	}
+	bq.mu.Lock()
+	if _, ok := bq.mu.processing[repl.RangeID]; ok {
+		bq.mu.Unlock()
+		return
+	}
+	bq.mu.processing[repl.RangeID] = struct{}{}
+	bq.mu.Unlock()
+	done := func() {
+		bq.mu.Lock()
+		delete(bq.mu.processing, repl.RangeID)
+		bq.mu.Unlock()
+	}
+
+	taskName := fmt.Sprintf("%s: processing r%d", bq.name, repl.RangeID)
+	if err := bq.store.Stopper().RunAsyncTask(ctx, taskName, func(ctx context.Context) {
+		defer done()
+		ctx, cancel := bq.store.Stopper().WithCancelOnQuiesce(ctx)
+		defer cancel()
+		if bq.needsLease && !repl.isLeaseholderReady() {
+			return
+		}
+		if shouldQ, _ := bq.impl.shouldQueue(ctx, repl); !shouldQ || repl.IsDestroyed() != nil {
+			return
+		}
+		_, _ = bq.impl.process(ctx, repl)
+	}); err != nil {
+		done()
+	}
+}
@@ -0,0 +1,118 @@
+package kvserver
+
+import (
+	"context"
+	"fmt"
+	keys "github.com/dborchard/tiny_crdb/pkg/g_keys"
+	kv "github.com/dborchard/tiny_crdb/pkg/g_kv"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+// TestSplitQueueBySize verifies that the split queue splits ranges which are
+// larger than RangeMaxBytes, until none of them is.
+func TestSplitQueueBySize(t *testing.T) {
+	ctx := context.Background()
+	const maxBytes = 2 << 10
+	store, db := createTestStore(t)
+	store.cfg.RangeMaxBytes = maxBytes
+	var ks []string
+	for i := 0; i < 200; i++ {
+		ks = append(ks, fmt.Sprintf("key-%03d", i))
+	}
+	writeTestKeys(t, db, ks...)
+	require.Equal(t, 3, store.ReplicaCount())
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, store.splitQueue.scanAndProcess(ctx))
+	}
+	require.Less(t, 3, store.ReplicaCount())
+	var liveCount int64
+	store.VisitReplicas(func(repl *Replica) bool {
+		requireStatsConsistent(t, repl)
+		// The meta and system ranges hold single rows, such as the range ID
+		// generator, whose versions cannot be split apart. The range-local
+		// data of a range, such as its descriptor, is not split either.
+		if !repl.Desc().StartKey.Less(roachpb.RKey(keys.SystemMax)) {
+			ms := repl.GetMVCCStats()
+			require.LessOrEqual(t, ms.KeyBytes+ms.ValBytes, int64(maxBytes), repl.Desc())
+			liveCount += ms.LiveCount
+		}
+		return true
+	})
+	require.Equal(t, int64(len(ks)), liveCount)
+}
+
+// TestSplitQueueByLoad verifies that the split queue splits a range which
+// serves more requests than SplitQPSThreshold, at the median of the keys it
+// serves.
+func TestSplitQueueByLoad(t *testing.T) {
+	ctx := context.Background()
+	store, db := createTestStore(t)
+	store.cfg.SplitQPSThreshold = 10
+	require.NoError(t, store.splitQueue.scanAndProcess(ctx))
+	require.Equal(t, 3, store.ReplicaCount())
+
+	for i := 0; i < 100; i++ {
+		b := &kv.Batch{}
+		b.Get(fmt.Sprintf("key-%02d", i))
+		require.NoError(t, db.Run(ctx, b))
+	}
+	require.NoError(t, store.splitQueue.scanAndProcess(ctx))
+	require.Equal(t, 4, store.ReplicaCount())
+	rhs := store.LookupReplica(roachpb.RKey("key-99"))
+	require.True(t, roachpb.RKey("key-00").Less(rhs.Desc().StartKey))
+}
+
+// TestMergeQueue verifies that the merge queue merges small ranges into their
+// left-hand neighbour, unless the sticky bit of the right-hand range is set.
+func TestMergeQueue(t *testing.T) {
+	ctx := context.Background()
+	store, db := createTestStore(t)
+	writeTestKeys(t, db, "a", "b", "c", "d", "e")
+	require.NoError(t, db.AdminSplit(ctx, "b", hlc.Timestamp{}))
+	require.NoError(t, db.AdminSplit(ctx, "d", hlc.MaxTimestamp))
+	require.NoError(t, db.AdminSplit(ctx, "e",
+		hlc.Timestamp{WallTime: store.Clock().Now().Add(time.Hour.Nanoseconds(), 0).WallTime}))
+	require.Equal(t, 6, store.ReplicaCount())
+
+	require.NoError(t, store.mergeQueue.scanAndProcess(ctx))
+	require.Equal(t, 5, store.ReplicaCount())
+	merged := store.LookupReplica(roachpb.RKey("b"))
+	require.Equal(t, merged, store.LookupReplica(roachpb.RKey("a")))
+	require.Equal(t, roachpb.RKey("d"), merged.Desc().EndKey)
+	requireStatsConsistent(t, merged)
+
+	// Ranges are not merged across the initial split keys.
+	store.VisitReplicas(func(repl *Replica) bool {
+		desc := repl.Desc()
+		require.False(t, desc.StartKey.Less(roachpb.RKey("\x05")) && roachpb.RKey("\x05").Less(desc.EndKey))
+		return true
+	})
+}
+
+// TestRaftLogQueue verifies that the Raft log queue truncates the log of a
+// range once enough of its entries have been applied, and that the range
+// keeps serving requests.
+func TestRaftLogQueue(t *testing.T) {
+	ctx := context.Background()
+	store, db := createTestStoreWithConfig(t, StoreConfig{RaftLogQueueStaleThreshold: 10})
+	repl := store.LookupReplica(roachpb.RKey("a"))
+	require.NoError(t, store.raftLogQueue.scanAndProcess(ctx))
+	firstIndex := repl.GetFirstIndex()
+
+	for i := 0; i < 20; i++ {
+		writeTestKeys(t, db, fmt.Sprintf("key-%02d", i))
+	}
+	require.NoError(t, store.raftLogQueue.scanAndProcess(ctx))
+	newFirstIndex := repl.GetFirstIndex()
+	require.Less(t, firstIndex+10, newFirstIndex)
+	_, err := repl.GetTerm(newFirstIndex - 2)
+	require.Error(t, err)
+
+	writeTestKeys(t, db, "z")
+	requireStatsConsistent(t, repl)
+}
@@ -0,0 +1,127 @@
+package kvserver
+
+import (
+	"context"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	raft "go.etcd.io/raft/v3"
+)
+
+// raftLogQueue manages a queue of replicas slated to have their Raft logs
+// truncated, either because the number of entries which its followers no
+// longer need exceeds StoreConfig.RaftLogQueueStaleThreshold, or because the
+// size of the log exceeds StoreConfig.RaftLogQueueStaleSize. The truncation
+// is a command of its own, TruncateLog, which every replica of the range
+// applies to its own log.
+type raftLogQueue struct {
+	*baseQueue
+}
+
+// newRaftLogQueue returns a new instance of raftLogQueue.
+func newRaftLogQueue(store *Store) *raftLogQueue {
+	rlq := &raftLogQueue{}
+	rlq.baseQueue = newBaseQueue("raftlog", rlq, store, queueConfig{needsLease: true})
+	return rlq
+}
+
+// truncateDecision describes a truncation of the Raft log of a range, from
+// its first index up to, but excluding, NewFirstIndex.
+type truncateDecision struct {
+	FirstIndex    uint64
+	LastIndex     uint64
+	NewFirstIndex uint64
+	// LogSize is the size of the log, as per ComputeRaftLogSize.
+	LogSize int64
+}
+
+// NumTruncatableIndexes returns the number of entries which the decision
+// removes from the log.
+func (td *truncateDecision) NumTruncatableIndexes() uint64 {
+	if td.NewFirstIndex < td.FirstIndex {
+		return 0
+	}
+	return td.NewFirstIndex - td.FirstIndex
+}
+
+// computeTruncateDecision computes the truncation of the Raft log of the
+// replica, the leader of its range. The log is truncated up to the applied
+// index of the leader, unless followers still need some of these entries:
+// the log is then truncated up to the entries that the active followers
+// hold, and those that they are being sent in a snapshot. Inactive
+// followers, and all the lagging ones once the log exceeds
+// StoreConfig.RaftLogQueueStaleSize, catch up through snapshots instead.
+func (rlq *raftLogQueue) computeTruncateDecision(
+	ctx context.Context, r *Replica,
+) (truncateDecision, error) {
+	r.mu.RLock()
+	td := truncateDecision{
+		FirstIndex:    r.mu.truncatedState.Index + 1,
+		LastIndex:     r.mu.lastIndex,
+		NewFirstIndex: r.mu.state.RaftAppliedIndex + 1,
+	}
+	status := r.mu.internalRaftGroup.Status()
+	r.mu.RUnlock()
+	if status.RaftState != raft.StateLeader {
+		td.NewFirstIndex = td.FirstIndex
+		return td, nil
+	}
+
+	var err error
+	if td.LogSize, err = r.stateLoader.ComputeRaftLogSize(ctx, r.store.Engine()); err != nil {
+		return truncateDecision{}, err
+	}
+	for id, pr := range status.Progress {
+		if id == status.ID {
+			continue
+		}
+		if pr.PendingSnapshot != 0 && pr.PendingSnapshot+1 < td.NewFirstIndex {
+			td.NewFirstIndex = pr.PendingSnapshot + 1
+		}
+		if pr.RecentActive && td.LogSize <= rlq.store.cfg.RaftLogQueueStaleSize &&
+			pr.Match+1 < td.NewFirstIndex {
+			td.NewFirstIndex = pr.Match + 1
+		}
+	}
+	if td.NewFirstIndex < td.FirstIndex {
+		td.NewFirstIndex = td.FirstIndex
+	}
+	return td, nil
+}
+
+// shouldQueue determines whether the Raft log of the range should be
+// truncated. The priority is the number of entries which the truncation
+// removes.
+func (rlq *raftLogQueue) shouldQueue(ctx context.Context, repl *Replica) (bool, float64) {
+	td, err := rlq.computeTruncateDecision(ctx, repl)
+	if err != nil {
+		return false, 0
+	}
+	n := td.NumTruncatableIndexes()
+	shouldQ := n >= rlq.store.cfg.RaftLogQueueStaleThreshold ||
+		(n > 0 && td.LogSize > rlq.store.cfg.RaftLogQueueStaleSize)
+	return shouldQ, float64(n)
+}
+
+// process truncates the Raft log of the range, if any of its entries can be
+// removed.
+func (rlq *raftLogQueue) process(ctx context.Context, repl *Replica) (bool, error) {
+	td, err := rlq.computeTruncateDecision(ctx, repl)
+	if err != nil {
+		return false, err
+	}
+	if td.NumTruncatableIndexes() == 0 {
+		return false, nil
+	}
+	desc := repl.Desc()
+	ba := &kvpb.BatchRequest{}
+	ba.RangeID = repl.RangeID
+	ba.Add(&kvpb.TruncateLogRequest{
+		RequestHeader:      kvpb.RequestHeader{Key: desc.StartKey.AsRawKey()},
+		Index:              td.NewFirstIndex,
+		RangeID:            repl.RangeID,
+		ExpectedFirstIndex: td.FirstIndex,
+	})
+	if _, pErr := rlq.store.Send(ctx, ba); pErr != nil {
+		return false, pErr.GoError()
+	}
+	return true, nil
+}
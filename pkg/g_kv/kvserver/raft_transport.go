@@ -0,0 +1,266 @@
+package kvserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/kvserverpb"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/protoutil"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/stop"
+	"sync"
+)
+
+// raftSendBufferSize is the number of Raft messages which may be queued for
+// a store before further messages are dropped. Raft retransmits the dropped
+// messages.
+const raftSendBufferSize = 10000
+
+// RaftMessageHandler is the interface that must be implemented by the
+// receivers of Raft messages.
+type RaftMessageHandler interface {
+	// HandleRaftRequest is called for each Raft message addressed to a
+	// replica of the receiving store.
+	HandleRaftRequest(ctx context.Context, req *kvserverpb.RaftMessageRequest) error
+	// HandleSnapshot is called for each snapshot streamed to a replica of
+	// the receiving store. The handler receives the snapshot from the stream
+	// and responds to its sender.
+	HandleSnapshot(ctx context.Context, stream IncomingSnapshotStream) error
+}
+
+// OutgoingSnapshotStream is the sending side of a snapshot stream.
+type OutgoingSnapshotStream interface {
+	Send(*kvserverpb.SnapshotRequest) error
+	Recv() (*kvserverpb.SnapshotResponse, error)
+}
+
+// IncomingSnapshotStream is the receiving side of a snapshot stream.
+type IncomingSnapshotStream interface {
+	Send(*kvserverpb.SnapshotResponse) error
+	Recv() (*kvserverpb.SnapshotRequest, error)
+}
+
+// RaftTransport delivers the Raft messages exchanged by the replicas of the
+// stores of a cluster. Delivery is best-effort.
+type RaftTransport interface {
+	// Listen registers the handler of the messages addressed to the store,
+	// until the stopper quiesces.
+	Listen(stopper *stop.Stopper, storeID roachpb.StoreID, handler RaftMessageHandler) error
+	// SendAsync queues the message for delivery to the store of its
+	// recipient. It returns false if the message was dropped.
+	SendAsync(req *kvserverpb.RaftMessageRequest) bool
+	// SnapshotStream opens a stream to the handler of the snapshots
+	// addressed to the store. The stream is closed once the handler
+	// returns, or once the context is canceled.
+	SnapshotStream(ctx context.Context, storeID roachpb.StoreID) (OutgoingSnapshotStream, error)
+}
+
+// loopbackRaftTransport is a RaftTransport which delivers messages between
+// the stores of a single process. Each store drains the queue of its
+// messages from a task of its stopper, so that a stopped store no longer
+// receives messages, and doesn't block its senders.
+type loopbackRaftTransport struct {
+	mu       sync.Mutex
+	queues   map[roachpb.StoreID]chan *kvserverpb.RaftMessageRequest
+	handlers map[roachpb.StoreID]loopbackHandler
+}
+
+// loopbackHandler is the handler of the messages addressed to a store,
+// along with the stopper of the store, whose tasks run the handler.
+type loopbackHandler struct {
+	handler RaftMessageHandler
+	stopper *stop.Stopper
+}
+
+var _ RaftTransport = &loopbackRaftTransport{}
+
+// NewLoopbackRaftTransport returns a RaftTransport which delivers messages
+// between the stores of the process.
+func NewLoopbackRaftTransport() RaftTransport {
+	return &loopbackRaftTransport{
+		queues:   make(map[roachpb.StoreID]chan *kvserverpb.RaftMessageRequest),
+		handlers: make(map[roachpb.StoreID]loopbackHandler),
+	}
+}
+
+// Listen implements the RaftTransport interface.
+func (t *loopbackRaftTransport) Listen(
+	stopper *stop.Stopper, storeID roachpb.StoreID, handler RaftMessageHandler,
+) error {
+	q := make(chan *kvserverpb.RaftMessageRequest, raftSendBufferSize)
+	t.mu.Lock()
+	t.queues[storeID] = q
+	t.handlers[storeID] = loopbackHandler{handler: handler, stopper: stopper}
+	t.mu.Unlock()
+
+	ctx := context.Background()
+	return stopper.RunAsyncTask(ctx, fmt.Sprintf("raft transport: s%d", storeID), func(ctx context.Context) {
+		defer func() {
+			t.mu.Lock()
+			if t.queues[storeID] == q {
+				delete(t.queues, storeID)
+				delete(t.handlers, storeID)
+			}
+			t.mu.Unlock()
+		}()
+		for {
+			select {
+			case req := <-q:
+				// Errors are those of messages for replicas which the store
+				// doesn't hold, or no longer holds.
+				_ = handler.HandleRaftRequest(ctx, req)
+			case <-stopper.ShouldQuiesce():
+				return
+			}
+		}
+	})
+}
+
+// SendAsync implements the RaftTransport interface. The message is copied,
+// as it would be by a network transport, so that the sender and the
+// recipient don't share its entries.
+func (t *loopbackRaftTransport) SendAsync(req *kvserverpb.RaftMessageRequest) bool {
+	t.mu.Lock()
+	q, ok := t.queues[req.ToReplica.StoreID]
+	t.mu.Unlock()
+	if !ok {
+		return false
+	}
+	var clone kvserverpb.RaftMessageRequest
+	if err := cloneMessage(req, &clone); err != nil {
+		return false
+	}
+	select {
+	case q <- &clone:
+		return true
+	default:
+		return false
+	}
+}
+
+// SnapshotStream implements the RaftTransport interface. The handler of the
+// store runs in a task of the store's stopper, and the messages of the
+// stream are copied, as they would be by a network transport.
+func (t *loopbackRaftTransport) SnapshotStream(
+	ctx context.Context, storeID roachpb.StoreID,
+) (OutgoingSnapshotStream, error) {
+	t.mu.Lock()
+	h, ok := t.handlers[storeID]
+	t.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("s%d not found", storeID)
+	}
+	s := &loopbackSnapshotStream{
+		ctx:     ctx,
+		stopper: h.stopper,
+		reqs:    make(chan *kvserverpb.SnapshotRequest, 1),
+		resps:   make(chan *kvserverpb.SnapshotResponse, 1),
+		done:    make(chan struct{}),
+	}
+	taskName := fmt.Sprintf("raft transport: snapshot to s%d", storeID)
+	if err := h.stopper.RunAsyncTask(context.Background(), taskName, func(ctx context.Context) {
+		defer close(s.done)
+		// Errors are reported to the sender by the handler.
+		_ = h.handler.HandleSnapshot(ctx, (*loopbackIncomingSnapshotStream)(s))
+	}); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// loopbackSnapshotStream is the sending side of a snapshot stream of a
+// loopbackRaftTransport. Its loopbackIncomingSnapshotStream counterpart is
+// the receiving side.
+type loopbackSnapshotStream struct {
+	// ctx is the context of the sender.
+	ctx context.Context
+	// stopper is the stopper of the receiving store.
+	stopper *stop.Stopper
+	reqs    chan *kvserverpb.SnapshotRequest
+	resps   chan *kvserverpb.SnapshotResponse
+	// done is closed once the handler of the receiving store returns.
+	done chan struct{}
+}
+
+var _ OutgoingSnapshotStream = &loopbackSnapshotStream{}
+
+// errSnapshotStreamClosed is returned by the snapshot streams of a
+// loopbackRaftTransport once the other side is gone.
+var errSnapshotStreamClosed = errors.New("snapshot stream closed")
+
+// Send implements the OutgoingSnapshotStream interface.
+func (s *loopbackSnapshotStream) Send(req *kvserverpb.SnapshotRequest) error {
+	var clone kvserverpb.SnapshotRequest
+	if err := cloneMessage(req, &clone); err != nil {
+		return err
+	}
+	select {
+	case s.reqs <- &clone:
+		return nil
+	case <-s.done:
+		return errSnapshotStreamClosed
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	}
+}
+
+// Recv implements the OutgoingSnapshotStream interface.
+func (s *loopbackSnapshotStream) Recv() (*kvserverpb.SnapshotResponse, error) {
+	select {
+	case resp := <-s.resps:
+		return resp, nil
+	case <-s.done:
+		// The handler may have responded before returning.
+		select {
+		case resp := <-s.resps:
+			return resp, nil
+		default:
+			return nil, errSnapshotStreamClosed
+		}
+	case <-s.ctx.Done():
+		return nil, s.ctx.Err()
+	}
+}
+
+// loopbackIncomingSnapshotStream is the receiving side of a
+// loopbackSnapshotStream.
+type loopbackIncomingSnapshotStream loopbackSnapshotStream
+
+var _ IncomingSnapshotStream = &loopbackIncomingSnapshotStream{}
+
+// Send implements the IncomingSnapshotStream interface.
+func (s *loopbackIncomingSnapshotStream) Send(resp *kvserverpb.SnapshotResponse) error {
+	var clone kvserverpb.SnapshotResponse
+	if err := cloneMessage(resp, &clone); err != nil {
+		return err
+	}
+	select {
+	case s.resps <- &clone:
+		return nil
+	case <-s.ctx.Done():
+		return errSnapshotStreamClosed
+	case <-s.stopper.ShouldQuiesce():
+		return stop.ErrUnavailable
+	}
+}
+
+// Recv implements the IncomingSnapshotStream interface.
+func (s *loopbackIncomingSnapshotStream) Recv() (*kvserverpb.SnapshotRequest, error) {
+	select {
+	case req := <-s.reqs:
+		return req, nil
+	case <-s.ctx.Done():
+		return nil, errSnapshotStreamClosed
+	case <-s.stopper.ShouldQuiesce():
+		return nil, stop.ErrUnavailable
+	}
+}
+
+// cloneMessage copies the message into clone through its encoding.
+func cloneMessage(msg, clone protoutil.Message) error {
+	data, err := protoutil.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return protoutil.Unmarshal(data, clone)
+}
@@ -0,0 +1,117 @@
+package rangefeed
+
+import (
+	"context"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	storage "github.com/dborchard/tiny_crdb/pkg/h_storage"
+	"github.com/dborchard/tiny_crdb/pkg/h_storage/enginepb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/protoutil"
+)
+
+// catchUpScan iterates over all committed values in the span that were
+// written after the start timestamp and outputs them as RangeFeedValue
+// events. The values of each key are output in ascending timestamp order.
+// Intents are not output: they are published as values by the processor if
+// and when they are committed.
+//
+// If withDiff is set, each event carries the previous value of its key,
+// which is the next older version of the key, if any.
+func catchUpScan(
+	ctx context.Context,
+	snap storage.Reader,
+	span roachpb.Span,
+	startTS hlc.Timestamp,
+	withDiff bool,
+	outputFn func(*kvpb.RangeFeedEvent) error,
+) error {
+	it, err := snap.NewMVCCIterator(ctx, storage.MVCCKeyAndIntentsIterKind, storage.IterOptions{
+		LowerBound:   span.Key,
+		UpperBound:   span.EndKey,
+		ReadCategory: storage.RangefeedReadCategory,
+	})
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+
+	// The versions of a key are seen from newest to oldest, so the events for
+	// the current key are buffered and output in reverse once the iterator
+	// moves on to the next key.
+	var curKey roachpb.Key
+	var intentTS hlc.Timestamp
+	var reorderBuf []*kvpb.RangeFeedEvent
+	var prevVal []byte
+	flush := func() error {
+		for i := len(reorderBuf) - 1; i >= 0; i-- {
+			if withDiff {
+				if i == len(reorderBuf)-1 {
+					reorderBuf[i].Val.PrevValue.RawBytes = prevVal
+				} else {
+					reorderBuf[i].Val.PrevValue.RawBytes = reorderBuf[i+1].Val.Value.RawBytes
+				}
+			}
+			if err := outputFn(reorderBuf[i]); err != nil {
+				return err
+			}
+		}
+		reorderBuf = reorderBuf[:0]
+		prevVal = nil
+		return nil
+	}
+
+	for it.SeekGE(storage.MakeMVCCMetadataKey(span.Key)); ; it.Next() {
+		if ok, err := it.Valid(); err != nil {
+			return err
+		} else if !ok {
+			break
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		unsafeKey := it.UnsafeKey()
+		if !unsafeKey.Key.Equal(curKey) {
+			if err := flush(); err != nil {
+				return err
+			}
+			curKey = append(curKey[:0], unsafeKey.Key...)
+			intentTS = hlc.Timestamp{}
+		}
+		unsafeVal, err := it.UnsafeValue()
+		if err != nil {
+			return err
+		}
+
+		if !unsafeKey.IsValue() {
+			// An intent's metadata. Remember the timestamp of its provisional
+			// value, which must be skipped.
+			var meta enginepb.MVCCMetadata
+			if err := protoutil.Unmarshal(unsafeVal, &meta); err != nil {
+				return err
+			}
+			if meta.Txn != nil {
+				intentTS = meta.Timestamp
+			}
+			continue
+		}
+		if !intentTS.IsEmpty() && unsafeKey.Timestamp == intentTS {
+			continue
+		}
+
+		if startTS.Less(unsafeKey.Timestamp) {
+			reorderBuf = append(reorderBuf, &kvpb.RangeFeedEvent{Val: &kvpb.RangeFeedValue{
+				Key: append(roachpb.Key(nil), unsafeKey.Key...),
+				Value: roachpb.Value{
+					RawBytes:  append([]byte(nil), unsafeVal...),
+					Timestamp: unsafeKey.Timestamp,
+				},
+			}})
+		} else if withDiff && len(reorderBuf) > 0 && prevVal == nil {
+			// The newest version at or below the start timestamp is the previous
+			// value of the oldest version output for the key.
+			prevVal = append([]byte{}, unsafeVal...)
+		}
+	}
+	return flush()
+}
@@ -0,0 +1,446 @@
+// Package rangefeed implements the server side of rangefeeds: a Processor per
+// range which turns the logical MVCC operations applied by the range into a
+// stream of value events and checkpoints for each of its registrations.
+package rangefeed
+
+import (
+	"context"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	storage "github.com/dborchard/tiny_crdb/pkg/h_storage"
+	"github.com/dborchard/tiny_crdb/pkg/h_storage/enginepb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/protoutil"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/stop"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultCheckpointInterval is the default interval at which the processor
+	// polls the closed timestamp of its range.
+	defaultCheckpointInterval = 200 * time.Millisecond
+	// defaultPushTxnsInterval is the default interval at which the processor
+	// pushes the transactions holding back its resolved timestamp.
+	defaultPushTxnsInterval = time.Second
+	// defaultPushTxnsAge is the default age that the timestamp of a
+	// transaction must reach before the processor pushes it.
+	defaultPushTxnsAge = 10 * time.Second
+	// defaultEventChanCap is the default capacity of the event buffer of each
+	// registration.
+	defaultEventChanCap = 4096
+)
+
+// TxnPusher is capable of pushing transactions to a new timestamp and
+// cleaning up the intents of transactions that are found to be committed.
+type TxnPusher interface {
+	// PushTxns attempts to push the specified transactions to a new
+	// timestamp. It returns the resulting transaction protos.
+	PushTxns(context.Context, []enginepb.TxnMeta, hlc.Timestamp) ([]*roachpb.Transaction, error)
+	// ResolveIntents resolves the specified intents.
+	ResolveIntents(ctx context.Context, intents []roachpb.LockUpdate) error
+}
+
+// Config encompasses the configuration required to create a Processor.
+type Config struct {
+	Clock   *hlc.Clock
+	Stopper *stop.Stopper
+	// Span is the span of the range that the processor publishes events for.
+	Span roachpb.RSpan
+	// ClosedTimestamp returns the current closed timestamp of the range. All
+	// logical operations at or below it must have been consumed by the
+	// processor by the time it is returned.
+	ClosedTimestamp func() hlc.Timestamp
+	// TxnPusher is used to push the transactions whose intents hold back the
+	// resolved timestamp for too long.
+	TxnPusher TxnPusher
+	// OnEmpty, if set, is called when the processor stops itself because its
+	// last registration was removed.
+	OnEmpty func()
+
+	// CheckpointInterval is the interval at which the processor polls the
+	// closed timestamp of its range and publishes checkpoints.
+	CheckpointInterval time.Duration
+	// PushTxnsInterval is the interval at which the processor pushes old
+	// transactions.
+	PushTxnsInterval time.Duration
+	// PushTxnsAge is the age, relative to the present time, above which the
+	// transactions holding back the resolved timestamp are pushed.
+	PushTxnsAge time.Duration
+	// EventChanCap is the capacity of the event buffer of each registration.
+	EventChanCap int
+}
+
+// SetDefaults initializes unset fields in Config to values suitable for use
+// by a Processor.
+func (sc *Config) SetDefaults() {
+	if sc.CheckpointInterval == 0 {
+		sc.CheckpointInterval = defaultCheckpointInterval
+	}
+	if sc.PushTxnsInterval == 0 {
+		sc.PushTxnsInterval = defaultPushTxnsInterval
+	}
+	if sc.PushTxnsAge == 0 {
+		sc.PushTxnsAge = defaultPushTxnsAge
+	}
+	if sc.EventChanCap == 0 {
+		sc.EventChanCap = defaultEventChanCap
+	}
+}
+
+// A Processor manages a set of rangefeed registrations and handles the
+// routing of logical updates to these registrations. While routing logical
+// updates to rangefeed registrations, the processor performs two important
+// tasks:
+//  1. it translates logical updates into rangefeed events.
+//  2. it transforms a range-level closed timestamp to a rangefeed-level
+//     resolved timestamp.
+//
+// The processor is fed synchronously by the replica as it applies commands,
+// under the replica's raftMu, so the events of a range are published in the
+// order in which they were applied.
+type Processor struct {
+	Config
+
+	mu struct {
+		sync.Mutex
+		regs    map[*registration]struct{}
+		rts     resolvedTimestamp
+		stopped bool
+	}
+	stopC chan struct{}
+}
+
+// NewProcessor creates a new rangefeed Processor. The corresponding goroutine
+// should be launched using the Start method.
+func NewProcessor(cfg Config) *Processor {
+	cfg.SetDefaults()
+	p := &Processor{
+		Config: cfg,
+		stopC:  make(chan struct{}),
+	}
+	p.mu.regs = make(map[*registration]struct{})
+	p.mu.rts = makeResolvedTimestamp()
+	return p
+}
+
+// Start initializes the resolved timestamp of the processor from the intents
+// found in the snapshot of its range, and launches the goroutine that
+// advances the resolved timestamp. The snapshot must reflect all logical
+// operations applied before the processor is first fed.
+func (p *Processor) Start(ctx context.Context, snap storage.Reader) error {
+	if err := p.initIntents(ctx, snap); err != nil {
+		return err
+	}
+	ctx = context.WithoutCancel(ctx)
+	return p.Stopper.RunAsyncTask(ctx, "rangefeed: processor", p.run)
+}
+
+// initIntents scans the intents of the processor's span and starts tracking
+// them in the resolved timestamp.
+func (p *Processor) initIntents(ctx context.Context, snap storage.Reader) error {
+	span := p.Span.AsRawSpanWithNoLocals()
+	it, err := snap.NewMVCCIterator(ctx, storage.MVCCKeyAndIntentsIterKind, storage.IterOptions{
+		LowerBound:   span.Key,
+		UpperBound:   span.EndKey,
+		ReadCategory: storage.RangefeedReadCategory,
+	})
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for it.SeekGE(storage.MakeMVCCMetadataKey(span.Key)); ; it.Next() {
+		if ok, err := it.Valid(); err != nil {
+			return err
+		} else if !ok {
+			return nil
+		}
+		unsafeKey := it.UnsafeKey()
+		if unsafeKey.IsValue() {
+			continue
+		}
+		unsafeVal, err := it.UnsafeValue()
+		if err != nil {
+			return err
+		}
+		var meta enginepb.MVCCMetadata
+		if err := protoutil.Unmarshal(unsafeVal, &meta); err != nil {
+			return err
+		}
+		if meta.Txn == nil {
+			continue
+		}
+		p.mu.rts.ConsumeLogicalOp(enginepb.MVCCLogicalOp{WriteIntent: &enginepb.MVCCWriteIntentOp{
+			TxnID:           meta.Txn.ID,
+			TxnKey:          meta.Txn.Key,
+			TxnMinTimestamp: meta.Txn.MinTimestamp,
+			Key:             append(roachpb.Key(nil), unsafeKey.Key...),
+			Timestamp:       meta.Timestamp,
+		}})
+	}
+}
+
+// run advances the resolved timestamp of the processor as the closed
+// timestamp of its range advances, and periodically pushes the transactions
+// that hold it back.
+func (p *Processor) run(ctx context.Context) {
+	ticker := time.NewTicker(p.CheckpointInterval)
+	defer ticker.Stop()
+	var lastPush time.Time
+	for {
+		select {
+		case <-ticker.C:
+			p.ForwardClosedTS(p.ClosedTimestamp())
+			if now := time.Now(); now.Sub(lastPush) >= p.PushTxnsInterval {
+				lastPush = now
+				p.pushOldTxns(ctx)
+			}
+		case <-p.stopC:
+			return
+		case <-p.Stopper.ShouldQuiesce():
+			p.StopWithErr(kvpb.NewErrorf("node quiescing"))
+			return
+		}
+	}
+}
+
+// Register registers the stream over the specified span of keys. The
+// registration first outputs the values written after startTS, read by a
+// catch-up scan of catchUpSnap, and then the events published by the
+// processor. The snapshot must have been taken atomically with the call, with
+// respect to the logical operations fed to the processor; it is closed by the
+// registration.
+//
+// Once the registration is disconnected, the error that disconnected it is
+// sent on errC. Returns false, without taking ownership of the snapshot, if
+// the processor is stopped.
+func (p *Processor) Register(
+	span roachpb.RSpan,
+	startTS hlc.Timestamp,
+	catchUpSnap storage.Reader,
+	withDiff bool,
+	stream kvpb.RangeFeedEventSink,
+	errC chan<- *kvpb.Error,
+) bool {
+	r := newRegistration(
+		span.AsRawSpanWithNoLocals(), startTS, catchUpSnap, withDiff, p.EventChanCap, stream, errC,
+	)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.mu.stopped {
+		return false
+	}
+	p.mu.regs[r] = struct{}{}
+	// Let the registration know of the current resolved timestamp, which it
+	// outputs once its catch-up scan is complete.
+	if ts := p.mu.rts.Get(); !ts.IsEmpty() {
+		r.publish(&kvpb.RangeFeedEvent{Checkpoint: &kvpb.RangeFeedCheckpoint{ResolvedTS: ts}})
+	}
+
+	ctx, cancel := p.Stopper.WithCancelOnQuiesce(stream.Context())
+	if err := p.Stopper.RunAsyncTask(ctx, "rangefeed: output loop", func(ctx context.Context) {
+		defer cancel()
+		r.runOutputLoop(ctx, p.unregister)
+	}); err != nil {
+		cancel()
+		delete(p.mu.regs, r)
+		return false
+	}
+	return true
+}
+
+// unregister removes the registration from the processor. The processor
+// stops itself once its last registration is removed.
+func (p *Processor) unregister(r *registration) {
+	p.mu.Lock()
+	delete(p.mu.regs, r)
+	empty := !p.mu.stopped && len(p.mu.regs) == 0
+	if empty {
+		p.stopLocked()
+	}
+	p.mu.Unlock()
+	if empty && p.OnEmpty != nil {
+		p.OnEmpty()
+	}
+}
+
+// Len returns the number of registrations attached to the processor.
+func (p *Processor) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.mu.regs)
+}
+
+// ResolvedTimestamp returns the current resolved timestamp of the processor.
+func (p *Processor) ResolvedTimestamp() hlc.Timestamp {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.mu.rts.Get()
+}
+
+// StopWithErr shuts down the processor and disconnects all of its
+// registrations with the provided error.
+func (p *Processor) StopWithErr(pErr *kvpb.Error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.mu.stopped {
+		return
+	}
+	for r := range p.mu.regs {
+		r.disconnect(pErr)
+	}
+	p.stopLocked()
+}
+
+func (p *Processor) stopLocked() {
+	p.mu.stopped = true
+	close(p.stopC)
+}
+
+// ConsumeLogicalOps informs the processor of the logical operations applied
+// by its range. The values of the operations, and their previous values if
+// any registration needs them, must be populated.
+func (p *Processor) ConsumeLogicalOps(ops ...enginepb.MVCCLogicalOp) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.mu.stopped {
+		return
+	}
+	advanced := false
+	for _, op := range ops {
+		var key roachpb.Key
+		var event *kvpb.RangeFeedEvent
+		switch t := op.GetValue().(type) {
+		case *enginepb.MVCCWriteValueOp:
+			key = t.Key
+			event = newValueEvent(t.Key, t.Timestamp, t.Value, t.PrevValue)
+		case *enginepb.MVCCWriteIntentOp:
+			key = t.Key
+		case *enginepb.MVCCUpdateIntentOp:
+			key = t.Key
+		case *enginepb.MVCCCommitIntentOp:
+			key = t.Key
+			event = newValueEvent(t.Key, t.Timestamp, t.Value, t.PrevValue)
+		case *enginepb.MVCCAbortIntentOp:
+			key = t.Key
+		default:
+			panic("unknown logical op")
+		}
+		if !p.Span.ContainsKey(roachpb.RKey(key)) {
+			// Range-local keys, such as transaction records, are not published.
+			continue
+		}
+		if p.mu.rts.ConsumeLogicalOp(op) {
+			advanced = true
+		}
+		if event != nil {
+			p.publishLocked(event)
+		}
+	}
+	if advanced {
+		p.publishCheckpointLocked()
+	}
+}
+
+// ForwardClosedTS informs the processor that the closed timestamp of its
+// range has advanced.
+func (p *Processor) ForwardClosedTS(closedTS hlc.Timestamp) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.mu.stopped {
+		return
+	}
+	if p.mu.rts.ForwardClosedTS(closedTS) {
+		p.publishCheckpointLocked()
+	}
+}
+
+// pushOldTxns pushes the transactions whose intents hold the resolved
+// timestamp back by more than PushTxnsAge. Transactions that are still pending
+// are pushed above the present time, which lets the resolved timestamp
+// advance past their intents. The intents of finalized transactions are
+// resolved, which removes them from the resolved timestamp once the
+// resolutions are applied.
+func (p *Processor) pushOldTxns(ctx context.Context) {
+	now := p.Clock.Now()
+	pushBefore := now.Add(-p.PushTxnsAge.Nanoseconds(), 0)
+	p.mu.Lock()
+	oldTxns := p.mu.rts.intentQ.Before(pushBefore)
+	metas := make([]enginepb.TxnMeta, len(oldTxns))
+	for i, txn := range oldTxns {
+		metas[i] = txn.asTxnMeta()
+	}
+	p.mu.Unlock()
+	if len(metas) == 0 {
+		return
+	}
+
+	pushed, err := p.TxnPusher.PushTxns(ctx, metas, now)
+	if err != nil {
+		// The push is retried on the next interval.
+		return
+	}
+
+	var intents []roachpb.LockUpdate
+	p.mu.Lock()
+	advanced := false
+	for _, txn := range pushed {
+		unresolved, ok := p.mu.rts.intentQ.txns[txn.ID]
+		if !ok {
+			continue
+		}
+		switch txn.Status {
+		case roachpb.PENDING:
+			if p.mu.rts.ConsumeLogicalOp(enginepb.MVCCLogicalOp{UpdateIntent: &enginepb.MVCCUpdateIntentOp{
+				TxnID:     txn.ID,
+				Timestamp: txn.WriteTimestamp,
+			}}) {
+				advanced = true
+			}
+		case roachpb.COMMITTED, roachpb.ABORTED:
+			for key := range unresolved.keys {
+				intents = append(intents, roachpb.MakeLockUpdate(txn, roachpb.Span{Key: roachpb.Key(key)}))
+			}
+			if txn.Status == roachpb.ABORTED {
+				// An aborted transaction can never commit, so its intents no
+				// longer hold back the resolved timestamp.
+				if p.mu.rts.AbortTxn(txn.ID) {
+					advanced = true
+				}
+			}
+		}
+	}
+	if advanced && !p.mu.stopped {
+		p.publishCheckpointLocked()
+	}
+	p.mu.Unlock()
+
+	if len(intents) > 0 {
+		_ = p.TxnPusher.ResolveIntents(ctx, intents)
+	}
+}
+
+func (p *Processor) publishLocked(event *kvpb.RangeFeedEvent) {
+	for r := range p.mu.regs {
+		r.publish(event)
+	}
+}
+
+func (p *Processor) publishCheckpointLocked() {
+	p.publishLocked(&kvpb.RangeFeedEvent{Checkpoint: &kvpb.RangeFeedCheckpoint{
+		ResolvedTS: p.mu.rts.Get(),
+	}})
+}
+
+func newValueEvent(
+	key roachpb.Key, ts hlc.Timestamp, value, prevValue []byte,
+) *kvpb.RangeFeedEvent {
+	return &kvpb.RangeFeedEvent{Val: &kvpb.RangeFeedValue{
+		Key:       key,
+		Value:     roachpb.Value{RawBytes: value, Timestamp: ts},
+		PrevValue: roachpb.Value{RawBytes: prevValue},
+	}}
+}
@@ -0,0 +1,156 @@
+package rangefeed
+
+import (
+	"context"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	storage "github.com/dborchard/tiny_crdb/pkg/h_storage"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"sync"
+)
+
+// registration is an instance of a rangefeed subscriber who has registered to
+// receive updates for a specific range of keys. Updates are delivered to its
+// stream until the registration is disconnected, either by the processor or
+// because the stream failed.
+//
+// Events published to the registration are buffered in a channel that is
+// drained by the registration's output loop, so that a slow stream never
+// blocks the processor. If the buffer fills up, the registration is
+// disconnected with a RangeFeedRetryError and its client is expected to
+// reconnect from the last checkpoint it received.
+type registration struct {
+	// Input.
+	span             roachpb.Span
+	catchUpTimestamp hlc.Timestamp
+	withDiff         bool
+	// catchUpSnap is the snapshot of the range from which the catch-up scan is
+	// read. It is taken when the registration is created, which ensures that
+	// the catch-up scan and the published events neither overlap nor leave a
+	// gap. It is owned by the output loop, which closes it.
+	catchUpSnap storage.Reader
+
+	// Output.
+	stream kvpb.RangeFeedEventSink
+	errC   chan<- *kvpb.Error
+
+	// Internal.
+	buf chan *kvpb.RangeFeedEvent
+	mu  struct {
+		sync.Mutex
+		// disconnected is closed when the registration is disconnected, and err
+		// holds the error that disconnected it.
+		disconnected chan struct{}
+		err          *kvpb.Error
+	}
+}
+
+func newRegistration(
+	span roachpb.Span,
+	startTS hlc.Timestamp,
+	catchUpSnap storage.Reader,
+	withDiff bool,
+	bufferSz int,
+	stream kvpb.RangeFeedEventSink,
+	errC chan<- *kvpb.Error,
+) *registration {
+	r := &registration{
+		span:             span,
+		catchUpTimestamp: startTS,
+		withDiff:         withDiff,
+		catchUpSnap:      catchUpSnap,
+		stream:           stream,
+		errC:             errC,
+		buf:              make(chan *kvpb.RangeFeedEvent, bufferSz),
+	}
+	r.mu.disconnected = make(chan struct{})
+	return r
+}
+
+// publish attempts to send a single event to the output buffer for this
+// registration. If the output buffer is full, the registration is
+// disconnected. Value events that are not relevant to the registration are
+// dropped, and checkpoints are trimmed to the registration's span.
+func (r *registration) publish(event *kvpb.RangeFeedEvent) {
+	switch {
+	case event.Val != nil:
+		if !r.span.ContainsKey(event.Val.Key) {
+			return
+		}
+		if !r.catchUpTimestamp.Less(event.Val.Value.Timestamp) {
+			// The value was output by the catch-up scan.
+			return
+		}
+		if !r.withDiff && event.Val.PrevValue.RawBytes != nil {
+			val := *event.Val
+			val.PrevValue = roachpb.Value{}
+			event = &kvpb.RangeFeedEvent{Val: &val}
+		}
+	case event.Checkpoint != nil:
+		event = &kvpb.RangeFeedEvent{Checkpoint: &kvpb.RangeFeedCheckpoint{
+			Span:       r.span,
+			ResolvedTS: event.Checkpoint.ResolvedTS,
+		}}
+	}
+	select {
+	case r.buf <- event:
+	default:
+		r.disconnect(kvpb.NewError(kvpb.NewRangeFeedRetryError(kvpb.RangeFeedRetryError_REASON_SLOW_CONSUMER)))
+	}
+}
+
+// disconnect disconnects the registration with the provided error. Only the
+// first error is retained; later calls are no-ops.
+func (r *registration) disconnect(pErr *kvpb.Error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	select {
+	case <-r.mu.disconnected:
+	default:
+		r.mu.err = pErr
+		close(r.mu.disconnected)
+	}
+}
+
+// runOutputLoop runs the catch-up scan of the registration, if any, and then
+// forwards the buffered events to the stream until the registration is
+// disconnected. The error that ended the registration is sent on errC.
+func (r *registration) runOutputLoop(ctx context.Context, unregister func(*registration)) {
+	err := r.outputLoop(ctx)
+	if r.catchUpSnap != nil {
+		r.catchUpSnap.Close()
+		r.catchUpSnap = nil
+	}
+	if err != nil {
+		r.disconnect(kvpb.NewError(err))
+	}
+	unregister(r)
+	r.mu.Lock()
+	pErr := r.mu.err
+	r.mu.Unlock()
+	r.errC <- pErr
+}
+
+func (r *registration) outputLoop(ctx context.Context) error {
+	if r.catchUpSnap != nil {
+		if err := catchUpScan(
+			ctx, r.catchUpSnap, r.span, r.catchUpTimestamp, r.withDiff, r.stream.Send,
+		); err != nil {
+			return err
+		}
+		r.catchUpSnap.Close()
+		r.catchUpSnap = nil
+	}
+	for {
+		select {
+		case event := <-r.buf:
+			if err := r.stream.Send(event); err != nil {
+				return err
+			}
+		case <-r.mu.disconnected:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package rangefeed
+
+import (
+	"bytes"
+	"container/heap"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/dborchard/tiny_crdb/pkg/h_storage/enginepb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/uuid"
+)
+
+// A rangefeed's "resolved timestamp" is defined as the timestamp at which no
+// future updates will be emitted to the feed at or before. The timestamp is
+// monotonically increasing and is communicated through RangeFeedCheckpoint
+// notifications whenever it changes.
+//
+// The resolved timestamp is closely tied to a Range's closed timestamp, but
+// these concepts are not the same. Fundamentally, a closed timestamp is a
+// property of a Range that restricts its state such that no "visible" data
+// mutations are permitted at equal or earlier timestamps. This enables the
+// guarantee that if the closed timestamp conditions are met, a follower
+// replica has all state necessary to satisfy reads at or before the CT.
+//
+// A resolved timestamp is a property of a rangefeed that restrict its state
+// such that no value notifications will be emitted at equal or earlier
+// timestamps. The key difference here is that data mutations are allowed on a
+// Range beneath a closed timestamp, as long as they are not externally
+// visible. This is not true of the resolved timestamp because a rangefeed is
+// driven directly off the state of a Range through its Raft log updates. As
+// such, all changes to a Range beneath a given timestamp that will end up
+// published on a rangefeed, including intent resolution, must be made before
+// the resolved timestamp can advance to that timestamp.
+//
+// Because of this, the resolved timestamp is computed as the minimum of the
+// closed timestamp and the timestamp immediately preceding that of the
+// earliest unresolved intent on the range:
+//
+//	resolved_timestamp = min(closed_timestamp, min(unresolved_intents).Prev())
+type resolvedTimestamp struct {
+	closedTS   hlc.Timestamp
+	resolvedTS hlc.Timestamp
+	intentQ    unresolvedIntentQueue
+}
+
+func makeResolvedTimestamp() resolvedTimestamp {
+	return resolvedTimestamp{intentQ: makeUnresolvedIntentQueue()}
+}
+
+// Get returns the current value of the resolved timestamp.
+func (rts *resolvedTimestamp) Get() hlc.Timestamp {
+	return rts.resolvedTS
+}
+
+// ForwardClosedTS indicates that the closed timestamp that serves as the basis
+// for the resolved timestamp has advanced. Returns whether this advanced the
+// resolved timestamp.
+func (rts *resolvedTimestamp) ForwardClosedTS(newClosedTS hlc.Timestamp) bool {
+	if rts.closedTS.Forward(newClosedTS) {
+		return rts.recompute()
+	}
+	return false
+}
+
+// ConsumeLogicalOp informs the resolved timestamp of the occurrence of a logical
+// operation within its range of tracked keys. This allows the structure to
+// update its internal intent tracking to reflect the change. Returns whether
+// this caused the resolved timestamp to move forward.
+func (rts *resolvedTimestamp) ConsumeLogicalOp(op enginepb.MVCCLogicalOp) bool {
+	if rts.consumeLogicalOp(op) {
+		return rts.recompute()
+	}
+	return false
+}
+
+// AbortTxn informs the resolved timestamp that the transaction was aborted,
+// so its intents, which will all be removed, no longer need to be tracked.
+// Returns whether this caused the resolved timestamp to move forward.
+func (rts *resolvedTimestamp) AbortTxn(txnID uuid.UUID) bool {
+	if rts.intentQ.Del(txnID) {
+		return rts.recompute()
+	}
+	return false
+}
+
+func (rts *resolvedTimestamp) consumeLogicalOp(op enginepb.MVCCLogicalOp) bool {
+	switch t := op.GetValue().(type) {
+	case *enginepb.MVCCWriteValueOp:
+		// Writes outside of a transaction don't affect the unresolved intents,
+		// and they are always above the closed timestamp.
+		return false
+
+	case *enginepb.MVCCWriteIntentOp:
+		return rts.intentQ.AddKey(t.TxnID, t.TxnKey, t.TxnMinTimestamp, t.Key, t.Timestamp)
+
+	case *enginepb.MVCCUpdateIntentOp:
+		return rts.intentQ.UpdateTS(t.TxnID, t.Timestamp)
+
+	case *enginepb.MVCCCommitIntentOp:
+		return rts.intentQ.RemoveKey(t.TxnID, t.Key)
+
+	case *enginepb.MVCCAbortIntentOp:
+		return rts.intentQ.RemoveKey(t.TxnID, t.Key)
+
+	default:
+		panic("unknown logical op")
+	}
+}
+
+// recompute computes the resolved timestamp based on its respective closed
+// timestamp and the in-flight intents that it is tracking. The method is
+// called after each input is applied to the resolvedTimestamp. Returns
+// whether the resolved timestamp moved forward.
+func (rts *resolvedTimestamp) recompute() bool {
+	newTS := rts.closedTS
+	if txn := rts.intentQ.Oldest(); txn != nil {
+		newTS.Backward(txn.timestamp.Prev())
+	}
+	// The resolved timestamp never regresses. An intent below it can only be
+	// discovered by the initial intent scan, which runs before any checkpoint
+	// is published.
+	return rts.resolvedTS.Forward(newTS)
+}
+
+// unresolvedTxn is a transaction that has one or more unresolved intents on
+// the range.
+type unresolvedTxn struct {
+	txnID           uuid.UUID
+	txnKey          roachpb.Key
+	txnMinTimestamp hlc.Timestamp
+	// timestamp is the maximum timestamp of the transaction's intents, as
+	// last observed by the queue.
+	timestamp hlc.Timestamp
+	// keys is the set of keys that the transaction holds intents on.
+	keys map[string]struct{}
+
+	// The index of the item in the unresolvedTxnHeap, maintained by the
+	// heap.Interface methods.
+	index int
+}
+
+// asTxnMeta returns a TxnMeta representation of the unresolved transaction.
+func (t *unresolvedTxn) asTxnMeta() enginepb.TxnMeta {
+	return enginepb.TxnMeta{
+		ID:             t.txnID,
+		Key:            t.txnKey,
+		WriteTimestamp: t.timestamp,
+		MinTimestamp:   t.txnMinTimestamp,
+	}
+}
+
+// unresolvedTxnHeap implements heap.Interface and holds unresolvedTxns.
+// Transactions are prioritized based on their timestamp such that the
+// oldest unresolved transaction will rise to the top of the heap.
+type unresolvedTxnHeap []*unresolvedTxn
+
+func (h unresolvedTxnHeap) Len() int { return len(h) }
+
+func (h unresolvedTxnHeap) Less(i, j int) bool {
+	// Container/heap constructs a min-heap by default, so prioritize lower
+	// timestamps. Break ties on transaction IDs to keep the order stable.
+	if c := h[i].timestamp.Compare(h[j].timestamp); c != 0 {
+		return c < 0
+	}
+	return bytes.Compare(h[i].txnID.GetBytes(), h[j].txnID.GetBytes()) < 0
+}
+
+func (h unresolvedTxnHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *unresolvedTxnHeap) Push(x interface{}) {
+	txn := x.(*unresolvedTxn)
+	txn.index = len(*h)
+	*h = append(*h, txn)
+}
+
+func (h *unresolvedTxnHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	txn := old[n-1]
+	txn.index = -1
+	old[n-1] = nil
+	*h = old[0 : n-1]
+	return txn
+}
+
+// unresolvedIntentQueue tracks all unresolved intents that exist within the
+// range of a rangefeed, grouped by the transaction that wrote them. The queue
+// maintains the transactions in a min-heap ordered by their timestamp, which
+// allows the oldest unresolved transaction to be found in constant time.
+type unresolvedIntentQueue struct {
+	txns    map[uuid.UUID]*unresolvedTxn
+	minHeap unresolvedTxnHeap
+}
+
+func makeUnresolvedIntentQueue() unresolvedIntentQueue {
+	return unresolvedIntentQueue{
+		txns: make(map[uuid.UUID]*unresolvedTxn),
+	}
+}
+
+// Len returns the number of transactions being tracked.
+func (uiq *unresolvedIntentQueue) Len() int {
+	return uiq.minHeap.Len()
+}
+
+// Oldest returns the oldest transaction that is being tracked in the
+// unresolvedIntentQueue, or nil if the queue is empty.
+func (uiq *unresolvedIntentQueue) Oldest() *unresolvedTxn {
+	if uiq.Len() == 0 {
+		return nil
+	}
+	return uiq.minHeap[0]
+}
+
+// Before returns all transactions that have timestamps before the provided
+// timestamp, in no particular order.
+func (uiq *unresolvedIntentQueue) Before(ts hlc.Timestamp) []*unresolvedTxn {
+	var txns []*unresolvedTxn
+	for _, txn := range uiq.minHeap {
+		if txn.timestamp.Less(ts) {
+			txns = append(txns, txn)
+		}
+	}
+	return txns
+}
+
+// AddKey records an intent on the key written by the transaction at the
+// given timestamp. Returns whether the oldest transaction in the queue may
+// have changed.
+func (uiq *unresolvedIntentQueue) AddKey(
+	txnID uuid.UUID, txnKey roachpb.Key, txnMinTS hlc.Timestamp, key roachpb.Key, ts hlc.Timestamp,
+) bool {
+	txn, ok := uiq.txns[txnID]
+	if !ok {
+		txn = &unresolvedTxn{
+			txnID:           txnID,
+			txnKey:          txnKey,
+			txnMinTimestamp: txnMinTS,
+			timestamp:       ts,
+			keys:            make(map[string]struct{}),
+		}
+		uiq.txns[txnID] = txn
+		heap.Push(&uiq.minHeap, txn)
+	} else if txn.timestamp.Forward(ts) {
+		heap.Fix(&uiq.minHeap, txn.index)
+	}
+	txn.keys[string(key)] = struct{}{}
+	return true
+}
+
+// RemoveKey records that the transaction's intent on the key was resolved.
+// The transaction is removed from the queue once it has no intents left.
+// Returns whether the oldest transaction in the queue may have changed.
+func (uiq *unresolvedIntentQueue) RemoveKey(txnID uuid.UUID, key roachpb.Key) bool {
+	txn, ok := uiq.txns[txnID]
+	if !ok {
+		// Unknown transaction, e.g. one that was aborted by a push.
+		return false
+	}
+	delete(txn.keys, string(key))
+	if len(txn.keys) > 0 {
+		return false
+	}
+	uiq.remove(txn)
+	return true
+}
+
+// UpdateTS forwards the timestamp of the transaction, if it is being tracked.
+// Returns whether the oldest transaction in the queue may have changed.
+func (uiq *unresolvedIntentQueue) UpdateTS(txnID uuid.UUID, ts hlc.Timestamp) bool {
+	txn, ok := uiq.txns[txnID]
+	if !ok || !txn.timestamp.Forward(ts) {
+		return false
+	}
+	heap.Fix(&uiq.minHeap, txn.index)
+	return true
+}
+
+// Del removes the transaction from the queue, regardless of its remaining
+// intents. Returns whether the transaction was being tracked.
+func (uiq *unresolvedIntentQueue) Del(txnID uuid.UUID) bool {
+	txn, ok := uiq.txns[txnID]
+	if !ok {
+		return false
+	}
+	uiq.remove(txn)
+	return true
+}
+
+func (uiq *unresolvedIntentQueue) remove(txn *unresolvedTxn) {
+	delete(uiq.txns, txn.txnID)
+	heap.Remove(&uiq.minHeap, txn.index)
+}
@@ -0,0 +1,53 @@
+package rangefeed
+
+import (
+	"github.com/dborchard/tiny_crdb/pkg/h_storage/enginepb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/uuid"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestResolvedTimestamp(t *testing.T) {
+	ts := func(wall int64) hlc.Timestamp { return hlc.Timestamp{WallTime: wall} }
+	rts := makeResolvedTimestamp()
+
+	// The resolved timestamp follows the closed timestamp.
+	require.True(t, rts.ForwardClosedTS(ts(5)))
+	require.Equal(t, ts(5), rts.Get())
+
+	// Intents hold it back below the oldest unresolved transaction.
+	txn1, txn2 := uuid.MakeV4(), uuid.MakeV4()
+	require.False(t, rts.ConsumeLogicalOp(enginepb.MVCCLogicalOp{WriteIntent: &enginepb.MVCCWriteIntentOp{
+		TxnID: txn1, TxnKey: []byte("a"), Key: []byte("a"), Timestamp: ts(10),
+	}}))
+	require.False(t, rts.ConsumeLogicalOp(enginepb.MVCCLogicalOp{WriteIntent: &enginepb.MVCCWriteIntentOp{
+		TxnID: txn1, TxnKey: []byte("a"), Key: []byte("b"), Timestamp: ts(10),
+	}}))
+	require.False(t, rts.ConsumeLogicalOp(enginepb.MVCCLogicalOp{WriteIntent: &enginepb.MVCCWriteIntentOp{
+		TxnID: txn2, TxnKey: []byte("c"), Key: []byte("c"), Timestamp: ts(15),
+	}}))
+	require.True(t, rts.ForwardClosedTS(ts(20)))
+	require.Equal(t, ts(10).Prev(), rts.Get())
+
+	// Resolving one of the intents of the oldest transaction is not enough.
+	require.False(t, rts.ConsumeLogicalOp(enginepb.MVCCLogicalOp{CommitIntent: &enginepb.MVCCCommitIntentOp{
+		TxnID: txn1, Key: []byte("a"), Timestamp: ts(10),
+	}}))
+	require.Equal(t, ts(10).Prev(), rts.Get())
+	require.True(t, rts.ConsumeLogicalOp(enginepb.MVCCLogicalOp{AbortIntent: &enginepb.MVCCAbortIntentOp{
+		TxnID: txn1, Key: []byte("b"),
+	}}))
+	require.Equal(t, ts(15).Prev(), rts.Get())
+
+	// A pushed transaction moves up the resolved timestamp.
+	require.True(t, rts.ConsumeLogicalOp(enginepb.MVCCLogicalOp{UpdateIntent: &enginepb.MVCCUpdateIntentOp{
+		TxnID: txn2, Key: []byte("c"), Timestamp: ts(18),
+	}}))
+	require.Equal(t, ts(18).Prev(), rts.Get())
+
+	// An aborted transaction no longer holds it back.
+	require.True(t, rts.AbortTxn(txn2))
+	require.Equal(t, ts(20), rts.Get())
+	require.Equal(t, 0, rts.intentQ.Len())
+}
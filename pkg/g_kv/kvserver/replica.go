@@ -0,0 +1,371 @@
+package kvserver
+
+import (
+	"context"
+	"fmt"
+	keys "github.com/dborchard/tiny_crdb/pkg/g_keys"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/batcheval"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/closedts"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/concurrency"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/kvserverpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/rangefeed"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/stateloader"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/txnwait"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/dborchard/tiny_crdb/pkg/h_storage/enginepb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	raft "go.etcd.io/raft/v3"
+	"sync"
+)
+
+// A Replica is a contiguous keyspace with writes managed via an
+// instance of the Raft consensus algorithm. Many ranges may exist
+// in a store and they are unlikely to be contiguous. Ranges are
+// independent units and are responsible for maintaining their own
+// integrity by replacing failed replicas, splitting and merging
+// as appropriate.
+//
+// Requests to the replica are sequenced by its concurrency manager, which
+// isolates them from conflicting requests and transactions, then evaluated
+// against a batch of the store's engine by the leader of the range's Raft
+// group. The batches of writes are proposed to the group, and every replica
+// applies them once committed, atomically along with the updated MVCCStats
+// of the range.
+type Replica struct {
+	// RangeID is the ID of the range to which the replica belongs.
+	RangeID roachpb.RangeID
+
+	store *Store
+	// concMgr sequences incoming requests and provides isolation between
+	// requests that intend to perform conflicting operations.
+	concMgr concurrency.Manager
+	// txnWaitQueue holds the pushers of the transactions whose records are
+	// held by the range.
+	txnWaitQueue *txnwait.Queue
+	breaker      *replicaCircuitBreaker
+	// load tracks the rate of requests served by the replica, for load-based
+	// splitting.
+	load *replicaLoad
+	// cancel stops the background tasks of the replica.
+	cancel context.CancelFunc
+
+	// stateLoader loads and persists the state of the replica.
+	stateLoader stateloader.StateLoader
+	// raftReady is signaled when the replica's Raft group may have a Ready
+	// to process.
+	raftReady chan struct{}
+
+	// raftMu serializes the processing of the Readys of the replica's Raft
+	// group: the persistence of its log and the application of its
+	// committed entries.
+	raftMu sync.Mutex
+
+	// rangefeedMu protects the rangefeed processor of the replica, which is
+	// set while the replica serves rangefeeds. The processor is fed with the
+	// logical operations of the commands applied by the replica, with raftMu
+	// held.
+	rangefeedMu struct {
+		sync.RWMutex
+		proc *rangefeed.Processor
+	}
+
+	mu struct {
+		sync.RWMutex
+		// replicaID is the ID of the replica within its range, and of its
+		// member of the range's Raft group.
+		replicaID roachpb.ReplicaID
+		// desc is the descriptor of the range.
+		desc *roachpb.RangeDescriptor
+		// stats are the MVCCStats of the range, as persisted at
+		// keys.RangeStatsLegacyKey.
+		stats enginepb.MVCCStats
+		// state is the index and term of the last entry of the Raft log
+		// applied to the replica.
+		state enginepb.RangeAppliedState
+		// truncatedState and lastIndex are the bounds of the replica's
+		// persisted Raft log.
+		truncatedState kvserverpb.RaftTruncatedState
+		lastIndex      uint64
+		// internalRaftGroup is the replica's member of the range's Raft
+		// group.
+		internalRaftGroup *raft.RawNode
+		// proposals are the in-flight commands proposed by the replica, and
+		// proposalBuf those which are yet to be handed to its Raft group.
+		proposals   map[cmdIDKey]*proposal
+		proposalBuf []*proposal
+		// leaderReady is set while the replica is the leader of its range
+		// and has applied the entries of its predecessors. Only then does
+		// it propose commands, and acquire the range's lease.
+		leaderReady bool
+		// lease is the range's lease, as of the last command applied by the
+		// replica.
+		lease roachpb.Lease
+		// pendingLeaseRequest is the in-flight request for the lease by the
+		// replica, if any.
+		pendingLeaseRequest *pendingLeaseRequest
+		// leaseTransferInProgress is set while the replica transfers its
+		// lease, during which it closes no further timestamp.
+		leaseTransferInProgress bool
+		// closedTimestamp is the highest closed timestamp carried by the
+		// commands applied by the replica.
+		closedTimestamp hlc.Timestamp
+		// sideTransportClosed is the highest closed timestamp received
+		// through the side transport which holds at the replica's applied
+		// index, and sideTransportPending the latest one which doesn't hold
+		// yet.
+		sideTransportClosed  hlc.Timestamp
+		sideTransportPending sideTransportClosedTimestamp
+		// assignedClosedTimestamp is the highest timestamp closed by the
+		// replica as the leaseholder of its range, and writeTracker tracks
+		// the writes which it has in flight.
+		assignedClosedTimestamp hlc.Timestamp
+		writeTracker            *closedts.Tracker
+		// maxProposalIndex is the index of the last command proposed by the
+		// replica.
+		maxProposalIndex uint64
+		// destroyed is set once the range has been merged into its left
+		// neighbour, or once the replica has been removed from its range.
+		// Requests which reach a destroyed replica are rejected with a
+		// RangeNotFoundError.
+		destroyed bool
+	}
+}
+
+var _ batcheval.EvalContext = &Replica{}
+
+// newReplica instantiates the replica of the range with the provided
+// descriptor and loads its persisted state, from which its member of the
+// range's Raft group is created.
+func newReplica(ctx context.Context, store *Store, desc *roachpb.RangeDescriptor) (*Replica, error) {
+	replDesc, ok := desc.GetReplicaDescriptor(store.StoreID())
+	if !ok {
+		return nil, fmt.Errorf("s%d has no replica of range %s", store.StoreID(), desc)
+	}
+	r := &Replica{
+		RangeID:     desc.RangeID,
+		store:       store,
+		stateLoader: stateloader.Make(desc.RangeID),
+		raftReady:   make(chan struct{}, 1),
+		concMgr: concurrency.NewManager(concurrency.Config{
+			IntentResolver: store.intentResolver,
+		}),
+		txnWaitQueue: txnwait.NewQueue(txnwait.Config{
+			DB:    store.DB(),
+			Clock: store.Clock(),
+		}),
+	}
+	r.load = newReplicaLoad(store.Clock())
+	r.breaker = newReplicaCircuitBreaker(
+		store.Stopper(), store.Clock(), desc.RangeID, desc.RSpan().AsRawSpanWithNoLocals(),
+		store.cfg.SlowReplicationThreshold, r.sendProbe,
+	)
+	r.mu.replicaID = replDesc.ReplicaID
+	r.mu.desc = desc
+	r.mu.proposals = make(map[cmdIDKey]*proposal)
+	r.mu.writeTracker = closedts.NewTracker()
+
+	eng := store.Engine()
+	var err error
+	if r.mu.stats, err = r.stateLoader.LoadMVCCStats(ctx, eng); err != nil {
+		return nil, err
+	}
+	if r.mu.state, err = r.stateLoader.LoadRangeAppliedState(ctx, eng); err != nil {
+		return nil, err
+	}
+	if r.mu.truncatedState, err = r.stateLoader.LoadRaftTruncatedState(ctx, eng); err != nil {
+		return nil, err
+	}
+	if r.mu.lastIndex, err = r.stateLoader.LoadLastIndex(ctx, eng); err != nil {
+		return nil, err
+	}
+	if r.mu.lease, err = r.stateLoader.LoadLease(ctx, eng); err != nil {
+		return nil, err
+	}
+	if r.mu.lease.OwnedBy(store.StoreID()) {
+		// Pushers of the range's transactions queue on the leaseholder.
+		r.txnWaitQueue.Enable()
+	}
+	if err := r.initRaftGroupLocked(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// start launches the background tasks of the replica, including the loop
+// driving its Raft group. They run until the replica is destroyed or the
+// store is stopped. The sole voter of a range campaigns right away, rather
+// than after an election timeout.
+func (r *Replica) start(ctx context.Context) error {
+	if r.IsDestroyed() != nil {
+		// The range was merged away while the store was starting.
+		return nil
+	}
+	ctx, r.cancel = context.WithCancel(context.WithoutCancel(ctx))
+	if err := r.store.Stopper().RunAsyncTask(ctx, "replica: raft loop", r.raftLoop); err != nil {
+		return err
+	}
+	if r.isSoleVoter() {
+		r.campaign()
+	}
+	return r.breaker.start(ctx, defaultReplicaCircuitBreakerProbeInterval)
+}
+
+// destroy marks the replica as destroyed, once its range has been merged into
+// its left neighbour or it has been removed from its range, and stops its
+// background tasks. Pushers waiting in its txnWaitQueue are released, to
+// retry their push against the range's remaining replicas, and its rangefeeds
+// are disconnected.
+func (r *Replica) destroy() {
+	r.mu.Lock()
+	r.mu.destroyed = true
+	r.mu.leaderReady = false
+	r.mu.Unlock()
+	r.txnWaitQueue.Clear(true /* disable */)
+	r.disconnectRangefeedWithReason(kvpb.RangeFeedRetryError_REASON_REPLICA_REMOVED)
+	if r.cancel != nil {
+		r.cancel()
+	}
+}
+
+// setDesc sets the descriptor of the range, after a split, a merge or a
+// change of its replicas.
+func (r *Replica) setDesc(desc *roachpb.RangeDescriptor) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.mu.desc = desc
+}
+
+// Clock returns the hlc clock shared by this replica.
+func (r *Replica) Clock() *hlc.Clock {
+	return r.store.Clock()
+}
+
+// GetTxnWaitQueue returns the Replica's txnwait.Queue.
+func (r *Replica) GetTxnWaitQueue() *txnwait.Queue {
+	return r.txnWaitQueue
+}
+
+// Desc returns the authoritative range descriptor.
+func (r *Replica) Desc() *roachpb.RangeDescriptor {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.mu.desc
+}
+
+// ReplicaID returns the ID of the replica within its range.
+func (r *Replica) ReplicaID() roachpb.ReplicaID {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.mu.replicaID
+}
+
+// GetMVCCStats returns a copy of the MVCC stats object for this range.
+func (r *Replica) GetMVCCStats() enginepb.MVCCStats {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.mu.stats
+}
+
+// GetFirstIndex returns the index of the first entry in the replica's Raft
+// log.
+func (r *Replica) GetFirstIndex() uint64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.mu.truncatedState.Index + 1
+}
+
+// GetTerm returns the term of the entry of the replica's Raft log at the
+// index.
+func (r *Replica) GetTerm(i uint64) (uint64, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return (*replicaRaftStorage)(r).Term(i)
+}
+
+// IsDestroyed returns a RangeNotFoundError if the replica was destroyed,
+// because its range was merged into its left neighbour or because it was
+// removed from its range.
+func (r *Replica) IsDestroyed() error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.mu.destroyed {
+		return kvpb.NewRangeNotFoundError(r.RangeID, r.store.StoreID())
+	}
+	return nil
+}
+
+// Send executes a command on this range, dispatching it to the
+// read-only or read-write path, depending on whether the batch
+// modifies the range's state. Admin commands are dispatched to
+// executeAdminBatch. The batch's timestamp must be set.
+//
+// Only the holder of the range's lease serves requests. The other replicas
+// reject them with a NotLeaseHolderError, which points the sender to the
+// leaseholder if it is known. Requests which skip the lease check, such as
+// lease requests, are evaluated by the leader of the range. Non-locking reads
+// at or below the replica's closed timestamp are served by any replica, as
+// follower reads.
+func (r *Replica) Send(
+	ctx context.Context, ba *kvpb.BatchRequest,
+) (*kvpb.BatchResponse, *kvpb.Error) {
+	if err := r.IsDestroyed(); err != nil {
+		return nil, kvpb.NewError(err)
+	}
+	if ba.IsSingleSkipsLeaseCheckRequest() {
+		if err := r.redirectOnOrWaitForLeader(ctx); err != nil {
+			return nil, kvpb.NewError(err)
+		}
+	} else if r.canServeFollowerRead(ba) {
+		// The read is served without the lease.
+	} else if _, err := r.redirectOnOrAcquireLease(ctx, ba); err != nil {
+		return nil, kvpb.NewError(err)
+	}
+	if err := r.checkBatchRange(ba); err != nil {
+		return nil, kvpb.NewError(err)
+	}
+	if ba.IsAdmin() {
+		return r.executeAdminBatch(ctx, ba)
+	}
+	r.recordLoad(ba)
+	if ba.IsReadOnly() {
+		return r.executeBatchWithConcurrencyRetries(ctx, ba, (*Replica).executeReadOnlyBatch)
+	}
+	return r.executeBatchWithConcurrencyRetries(ctx, ba, (*Replica).executeWriteBatch)
+}
+
+// checkBatchRange verifies that the keys addressed by the batch are contained
+// in the range. If not, the sender's view of the range is stale and a
+// RangeKeyMismatchError is returned.
+func (r *Replica) checkBatchRange(ba *kvpb.BatchRequest) error {
+	rs, err := keys.Range(ba.Requests)
+	if err != nil {
+		return err
+	}
+	desc := r.Desc()
+	if !desc.ContainsKeyRange(rs.Key, rs.EndKey) {
+		return kvpb.NewRangeKeyMismatchError(rs.Key.AsRawKey(), rs.EndKey.AsRawKey(), desc)
+	}
+	return nil
+}
+
+// rangeDataSpans returns the spans of the replicated data of the range that
+// are accounted for in its MVCCStats: the range-local keys, such as
+// transaction records, which are addressed to the range's keys, and the
+// range's keys themselves.
+func rangeDataSpans(desc *roachpb.RangeDescriptor) []roachpb.Span {
+	userStart := desc.StartKey.AsRawKey()
+	if desc.StartKey.Equal(roachpb.RKeyMin) {
+		userStart = keys.LocalMax
+	}
+	return []roachpb.Span{
+		{
+			Key:    keys.MakeRangeKeyPrefix(desc.StartKey),
+			EndKey: keys.MakeRangeKeyPrefix(desc.EndKey),
+		},
+		{
+			Key:    userStart,
+			EndKey: desc.EndKey.AsRawKey(),
+		},
+	}
+}
@@ -0,0 +1,291 @@
+package kvserver
+
+import (
+	"context"
+	"fmt"
+	keys "github.com/dborchard/tiny_crdb/pkg/g_keys"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/kvserverpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/stateloader"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	storage "github.com/dborchard/tiny_crdb/pkg/h_storage"
+	"github.com/dborchard/tiny_crdb/pkg/h_storage/enginepb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/stop"
+	"go.etcd.io/raft/v3/raftpb"
+	"time"
+)
+
+// applyEntry applies a committed entry of the Raft log to the replica's
+// state machine, and finishes the replica's proposals which are decided by
+// the entry: the proposal of the entry's command, and the proposals whose
+// entries were replaced by it, which will never apply.
+//
+// Entries without data are appended by new leaders, and only advance the
+// applied index. Configuration changes are applied to the Raft group once
+// their command has applied.
+//
+// A command proposed under a lease other than the range's current one is
+// rejected: its evaluation may not account for the requests served by the
+// new leaseholder. It is applied as an empty command, and its proposal is
+// finished with a NotLeaseHolderError, or with a LeaseRejectedError for a
+// lease request.
+func (r *Replica) applyEntry(ctx context.Context, ent raftpb.Entry) error {
+	var idKey cmdIDKey
+	cmd := &kvserverpb.RaftCommand{}
+	var cc raftpb.ConfChangeV2
+	var err error
+	switch ent.Type {
+	case raftpb.EntryNormal:
+		if len(ent.Data) > 0 {
+			idKey, cmd, err = decodeRaftCommand(ent.Data)
+		}
+	case raftpb.EntryConfChangeV2:
+		if err = cc.Unmarshal(ent.Data); err == nil {
+			idKey, cmd, err = decodeRaftCommand(cc.Context)
+		}
+	default:
+		err = fmt.Errorf("unexpected raft entry type %d", ent.Type)
+	}
+	if err != nil {
+		return err
+	}
+
+	forcedErr := r.checkForcedErr(cmd)
+	if forcedErr != nil {
+		cmd = &kvserverpb.RaftCommand{}
+	}
+	if err := r.applyCommand(ctx, ent, cmd); err != nil {
+		return err
+	}
+	if ent.Type == raftpb.EntryConfChangeV2 && forcedErr == nil {
+		r.mu.Lock()
+		if !r.mu.destroyed {
+			r.mu.internalRaftGroup.ApplyConfChange(cc)
+		}
+		r.mu.Unlock()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for key, p := range r.mu.proposals {
+		switch {
+		case key == idKey:
+			p.finish(forcedErr)
+		case p.index <= ent.Index:
+			p.finish(r.newNotLeaderErrorRLocked())
+		default:
+			continue
+		}
+		delete(r.mu.proposals, key)
+	}
+	return nil
+}
+
+// checkForcedErr returns the error with which the command is rejected, if it
+// was proposed under a lease other than the range's current one. Empty
+// commands, which only advance the applied index, are never rejected.
+func (r *Replica) checkForcedErr(cmd *kvserverpb.RaftCommand) error {
+	res := &cmd.ReplicatedEvalResult
+	if res.IsZero() && len(cmd.WriteBatch) == 0 {
+		return nil
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	lease := r.mu.lease
+	if cmd.ProposerLeaseSequence == lease.Sequence {
+		return nil
+	}
+	if res.IsLeaseRequest {
+		var requested roachpb.Lease
+		if res.Lease != nil {
+			requested = *res.Lease
+		}
+		return kvpb.NewLeaseRejectedError("lease changed while the request was in flight", lease, requested)
+	}
+	return kvpb.NewNotLeaseHolderError(lease, r.store.StoreID(), r.mu.desc,
+		"command proposed under a previous lease")
+}
+
+// applyCommand applies the command of the entry to the replica's state
+// machine: its batch of writes is committed along with the range's updated
+// MVCCStats and applied state. The split, merge or replica change committed
+// by the command then takes effect on the store.
+//
+// The effects of the command are computed from the command and from the
+// state of the replica only, so that all the replicas of the range apply it
+// identically.
+func (r *Replica) applyCommand(
+	ctx context.Context, ent raftpb.Entry, cmd *kvserverpb.RaftCommand,
+) error {
+	res := &cmd.ReplicatedEvalResult
+	batch := r.store.Engine().NewBatch()
+	defer batch.Close()
+	if len(cmd.WriteBatch) > 0 {
+		if err := batch.ApplyBatchRepr(cmd.WriteBatch, false /* sync */); err != nil {
+			return err
+		}
+	}
+	if err := r.handleLogicalOpLogRaftMuLocked(ctx, cmd.LogicalOpLog, batch); err != nil {
+		return err
+	}
+
+	stats := r.GetMVCCStats()
+	stats.Add(res.Delta)
+	var rightRepl *Replica
+	switch {
+	case res.Split != nil:
+		rightStats, err := splitPreApply(ctx, batch, res.Split, r.GetLease(), res.Delta.LastUpdateNanos)
+		if err != nil {
+			return err
+		}
+		stats.Subtract(rightStats)
+	case res.Merge != nil:
+		// The subsumed range was frozen when the merge was evaluated. Its
+		// replica must have applied its log up to that point before it is
+		// destroyed and its stats are folded into those of the range.
+		var err error
+		if rightRepl, err = r.store.GetReplica(res.Merge.RightDesc.RangeID); err != nil {
+			return err
+		}
+		if err := rightRepl.waitForAppliedIndex(ctx, res.Merge.RightAppliedIndex); err != nil {
+			return err
+		}
+		rightRepl.raftMu.Lock()
+		defer rightRepl.raftMu.Unlock()
+		stats.Add(rightRepl.GetMVCCStats())
+		rightPrefix := keys.MakeRangeIDPrefix(rightRepl.RangeID)
+		if err := storage.ClearRange(ctx, batch, batch, rightPrefix, rightPrefix.PrefixEnd()); err != nil {
+			return err
+		}
+	}
+
+	truncated, err := r.truncateLogPreApply(ctx, batch, res.RaftTruncatedState)
+	if err != nil {
+		return err
+	}
+
+	as := enginepb.RangeAppliedState{
+		RaftAppliedIndex:     ent.Index,
+		RaftAppliedIndexTerm: ent.Term,
+	}
+	if err := r.stateLoader.SetMVCCStats(ctx, batch, &stats); err != nil {
+		return err
+	}
+	if err := r.stateLoader.SetRangeAppliedState(ctx, batch, as); err != nil {
+		return err
+	}
+
+	// The bounds of the Raft log are read by the Raft group with r.mu held:
+	// they change along with the log.
+	r.mu.Lock()
+	err = batch.Commit(false /* sync */)
+	if err == nil {
+		r.mu.stats = stats
+		r.mu.state = as
+		if truncated {
+			r.mu.truncatedState = *res.RaftTruncatedState
+		}
+		r.setAppliedClosedTimestampLocked(cmd.ClosedTimestamp)
+	}
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if res.Lease != nil {
+		r.leasePostApply(*res.Lease)
+	}
+	switch {
+	case res.Split != nil:
+		return r.store.splitPostApply(ctx, r, res.Split)
+	case res.Merge != nil:
+		r.store.mergePostApply(ctx, r, rightRepl, &res.Merge.MergeTrigger)
+	case res.ChangeReplicas != nil:
+		return r.store.changeReplicasPostApply(ctx, r, res.ChangeReplicas.Desc)
+	}
+	return nil
+}
+
+// truncateLogPreApply removes the entries of the replica's Raft log up to the
+// index of the truncated state, and persists the truncated state, in the
+// batch. It returns false if the log was already truncated up to that index,
+// such as by a snapshot.
+func (r *Replica) truncateLogPreApply(
+	ctx context.Context, batch storage.Batch, ts *kvserverpb.RaftTruncatedState,
+) (bool, error) {
+	if ts == nil {
+		return false, nil
+	}
+	r.mu.RLock()
+	oldIndex := r.mu.truncatedState.Index
+	r.mu.RUnlock()
+	if ts.Index <= oldIndex {
+		return false, nil
+	}
+	for i := oldIndex + 1; i <= ts.Index; i++ {
+		if err := r.stateLoader.ClearRaftLogEntry(batch, i); err != nil {
+			return false, err
+		}
+	}
+	if err := r.stateLoader.SetRaftTruncatedState(ctx, batch, ts); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// splitPreApply computes the MVCCStats of the right-hand side of the split
+// from its data, as of the evaluation time of the split, and writes them
+// along with the initial Raft state of the new range. The new range starts
+// out with the lease of the left-hand side. It returns the right-hand side's
+// stats, which the left-hand side no longer accounts for.
+func splitPreApply(
+	ctx context.Context,
+	batch storage.Batch,
+	split *roachpb.SplitTrigger,
+	leftLease roachpb.Lease,
+	nowNanos int64,
+) (enginepb.MVCCStats, error) {
+	rightDesc := &split.RightDesc
+	var rightStats enginepb.MVCCStats
+	for _, span := range rangeDataSpans(rightDesc) {
+		ms, err := storage.ComputeStats(ctx, batch, span.Key, span.EndKey, nowNanos)
+		if err != nil {
+			return enginepb.MVCCStats{}, err
+		}
+		rightStats.Add(ms)
+	}
+	rsl := stateloader.Make(rightDesc.RangeID)
+	if err := rsl.SetMVCCStats(ctx, batch, &rightStats); err != nil {
+		return enginepb.MVCCStats{}, err
+	}
+	if err := stateloader.WriteInitialRangeState(ctx, rsl, batch); err != nil {
+		return enginepb.MVCCStats{}, err
+	}
+	if err := rsl.SetLease(ctx, batch, leftLease); err != nil {
+		return enginepb.MVCCStats{}, err
+	}
+	return rightStats, nil
+}
+
+// waitForAppliedIndex waits for the replica to have applied its Raft log up
+// to the index.
+func (r *Replica) waitForAppliedIndex(ctx context.Context, index uint64) error {
+	for {
+		r.mu.RLock()
+		applied, destroyed := r.mu.state.RaftAppliedIndex, r.mu.destroyed
+		r.mu.RUnlock()
+		if applied >= index {
+			return nil
+		}
+		if destroyed {
+			return fmt.Errorf("r%d destroyed while waiting for applied index %d", r.RangeID, index)
+		}
+		select {
+		case <-time.After(time.Millisecond):
+		case <-r.store.Stopper().ShouldQuiesce():
+			return stop.ErrUnavailable
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package kvserver
+
+import (
+	"context"
+	"fmt"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/concurrency/poison"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/circuit"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/stop"
+	"sync"
+	"time"
+)
+
+// defaultReplicaCircuitBreakerSlowReplicationThreshold is the duration after
+// which a replication proposal is considered stuck, tripping the replica's
+// circuit breaker.
+const defaultReplicaCircuitBreakerSlowReplicationThreshold = time.Minute
+
+// defaultReplicaCircuitBreakerProbeInterval is the interval at which a
+// tripped replica circuit breaker probes the replica to determine whether it
+// has recovered.
+const defaultReplicaCircuitBreakerProbeInterval = time.Second
+
+// replicaCircuitBreaker is the circuit breaker of a Replica. It trips when a
+// replication proposal has been stuck for longer than the slow replication
+// threshold, which typically indicates that the range has lost quorum. Once
+// tripped, requests to the replica fail fast with a ReplicaUnavailableError
+// instead of hanging until the range recovers, and the latches of the
+// in-flight proposals are poisoned, so that requests waiting on them fail
+// fast as well.
+//
+// While tripped, the breaker probes the replica in the background by sending
+// a request through replication that bypasses the breaker. Once no proposal
+// is stuck and the probe succeeds, the breaker resets itself.
+type replicaCircuitBreaker struct {
+	stopper *stop.Stopper
+	clock   *hlc.Clock
+	rangeID roachpb.RangeID
+	span    roachpb.Span
+	// threshold is the slow replication threshold. A zero threshold disables
+	// the breaker's tripping.
+	threshold time.Duration
+	// probeInterval is the interval between probes of a tripped breaker.
+	probeInterval time.Duration
+	// sendProbe sends a request through replication without consulting the
+	// breaker, returning an error if the replica is unable to serve it.
+	sendProbe func(context.Context) error
+	wrapped   *circuit.Breaker
+
+	mu struct {
+		sync.Mutex
+		// proposals tracks the in-flight replication proposals.
+		proposals map[*trackedProposal]struct{}
+	}
+}
+
+// trackedProposal is an in-flight replication proposal tracked by the
+// replicaCircuitBreaker.
+type trackedProposal struct {
+	// start is the time at which the proposal was made.
+	start hlc.Timestamp
+	// poison poisons the latches held by the proposal's request.
+	poison func()
+}
+
+func newReplicaCircuitBreaker(
+	stopper *stop.Stopper,
+	clock *hlc.Clock,
+	rangeID roachpb.RangeID,
+	span roachpb.Span,
+	threshold time.Duration,
+	sendProbe func(context.Context) error,
+) *replicaCircuitBreaker {
+	br := &replicaCircuitBreaker{
+		stopper:       stopper,
+		clock:         clock,
+		rangeID:       rangeID,
+		span:          span,
+		threshold:     threshold,
+		probeInterval: defaultReplicaCircuitBreakerProbeInterval,
+		sendProbe:     sendProbe,
+	}
+	br.mu.proposals = make(map[*trackedProposal]struct{})
+	br.wrapped = circuit.NewBreaker(circuit.Options{
+		Name:       fmt.Sprintf("r%d", rangeID),
+		AsyncProbe: br.asyncProbe,
+	})
+	return br
+}
+
+// Signal returns the current state of the breaker.
+func (br *replicaCircuitBreaker) Signal() circuit.Signal {
+	return br.wrapped.Signal()
+}
+
+// execute runs fn on behalf of a request to the replica, unless the breaker
+// is tripped, in which case the request fails fast with a
+// ReplicaUnavailableError. If the breaker trips while fn is running, fn's
+// context is canceled and the request fails with a ReplicaUnavailableError,
+// as does a request that fails on a poisoned latch.
+func (br *replicaCircuitBreaker) execute(
+	ctx context.Context, fn func(context.Context) (*kvpb.BatchResponse, *kvpb.Error),
+) (*kvpb.BatchResponse, *kvpb.Error) {
+	sig := br.Signal()
+	if err := sig.Err(); err != nil {
+		return nil, kvpb.NewError(br.newUnavailableError(err))
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		br   *kvpb.BatchResponse
+		pErr *kvpb.Error
+	}
+	resC := make(chan result, 1)
+	go func() {
+		resp, pErr := fn(ctx)
+		resC <- result{br: resp, pErr: pErr}
+	}()
+
+	var res result
+	select {
+	case res = <-resC:
+	case <-sig.C():
+		cancel()
+		// Wait for fn to return, so that it does not outlive the request.
+		<-resC
+		return nil, kvpb.NewError(br.newUnavailableError(sig.Err()))
+	}
+	if res.pErr != nil && poison.IsPoisonedError(res.pErr.GoError()) {
+		return nil, kvpb.NewError(br.newUnavailableError(res.pErr.GoError()))
+	}
+	return res.br, res.pErr
+}
+
+// trackProposal registers an in-flight replication proposal with the
+// breaker. The provided function poisons the latches held by the proposal's
+// request, and is invoked if the breaker trips while the proposal is in
+// flight. The returned function must be called once the proposal has been
+// applied or abandoned.
+func (br *replicaCircuitBreaker) trackProposal(poison func()) (untrack func()) {
+	p := &trackedProposal{start: br.clock.Now(), poison: poison}
+	br.mu.Lock()
+	br.mu.proposals[p] = struct{}{}
+	br.mu.Unlock()
+	if br.Signal().Err() != nil {
+		// The breaker is already tripped, so requests waiting on this one
+		// should not expect it to complete any time soon.
+		poison()
+	}
+	return func() {
+		br.mu.Lock()
+		defer br.mu.Unlock()
+		delete(br.mu.proposals, p)
+	}
+}
+
+// stuckProposalDuration returns the duration for which the oldest in-flight
+// proposal has been in flight, or zero if there are none.
+func (br *replicaCircuitBreaker) stuckProposalDuration() time.Duration {
+	now := br.clock.Now()
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	var oldest time.Duration
+	for p := range br.mu.proposals {
+		if d := time.Duration(now.WallTime - p.start.WallTime); d > oldest {
+			oldest = d
+		}
+	}
+	return oldest
+}
+
+// checkStuckProposals trips the breaker if a proposal has been in flight for
+// longer than the slow replication threshold. When this happens, the latches
+// of all in-flight proposals are poisoned.
+func (br *replicaCircuitBreaker) checkStuckProposals() {
+	if br.threshold <= 0 {
+		return
+	}
+	d := br.stuckProposalDuration()
+	if d < br.threshold {
+		return
+	}
+	br.wrapped.Report(fmt.Errorf(
+		"proposal stuck for %s (slow replication threshold %s)", d, br.threshold))
+
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	for p := range br.mu.proposals {
+		p.poison()
+	}
+}
+
+// start launches a task that checks for stuck proposals at the specified
+// interval, until the stopper quiesces.
+func (br *replicaCircuitBreaker) start(ctx context.Context, interval time.Duration) error {
+	return br.stopper.RunAsyncTask(ctx, "replica circuit breaker: checking for stuck proposals",
+		func(ctx context.Context) {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					br.checkStuckProposals()
+				case <-br.stopper.ShouldQuiesce():
+					return
+				case <-ctx.Done():
+					return
+				}
+			}
+		})
+}
+
+// asyncProbe is the circuit.Options.AsyncProbe of the breaker. It probes the
+// replica at the probe interval until no proposal is stuck and a probe
+// request succeeds, at which point it resets the breaker.
+func (br *replicaCircuitBreaker) asyncProbe(report func(error), done func()) {
+	if err := br.stopper.RunAsyncTask(context.Background(), "replica circuit breaker: probing",
+		func(ctx context.Context) {
+			defer done()
+			for {
+				err := br.probe(ctx)
+				if err == nil {
+					br.wrapped.Reset()
+					return
+				}
+				report(err)
+				select {
+				case <-time.After(br.probeInterval):
+				case <-br.stopper.ShouldQuiesce():
+					return
+				}
+			}
+		}); err != nil {
+		done()
+	}
+}
+
+// probe returns an error if the replica is still unable to serve requests.
+func (br *replicaCircuitBreaker) probe(ctx context.Context) error {
+	if br.threshold > 0 {
+		if d := br.stuckProposalDuration(); d >= br.threshold {
+			return fmt.Errorf("proposal stuck for %s (slow replication threshold %s)", d, br.threshold)
+		}
+	}
+	if br.sendProbe == nil {
+		return nil
+	}
+	if br.threshold > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, br.threshold)
+		defer cancel()
+	}
+	if err := br.sendProbe(ctx); err != nil {
+		return fmt.Errorf("probe failed: %w", err)
+	}
+	return nil
+}
+
+// newUnavailableError returns a ReplicaUnavailableError carrying the
+// breaker's diagnostics.
+func (br *replicaCircuitBreaker) newUnavailableError(cause error) *kvpb.ReplicaUnavailableError {
+	return kvpb.NewReplicaUnavailableError(cause, br.rangeID, br.span)
+}
@@ -0,0 +1,109 @@
+package kvserver
+
+import (
+	"context"
+	"errors"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/concurrency/poison"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/circuit"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/stop"
+	"github.com/stretchr/testify/require"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestReplicaCircuitBreaker verifies that the breaker trips when a proposal
+// is stuck for longer than the slow replication threshold, that it then
+// fails requests fast, poisons the latches of in-flight proposals and
+// unblocks requests that are waiting, and that it resets itself once the
+// probe succeeds.
+func TestReplicaCircuitBreaker(t *testing.T) {
+	ctx := context.Background()
+	stopper := stop.NewStopper()
+	defer stopper.Stop(ctx)
+	var nowNanos atomic.Int64
+	nowNanos.Store(1)
+	clock := hlc.NewClock(nowNanos.Load, time.Nanosecond)
+
+	var quorumLost atomic.Bool
+	quorumLost.Store(true)
+	sendProbe := func(context.Context) error {
+		if quorumLost.Load() {
+			return errors.New("range has lost quorum")
+		}
+		return nil
+	}
+	span := roachpb.Span{Key: roachpb.Key("a"), EndKey: roachpb.Key("z")}
+	br := newReplicaCircuitBreaker(stopper, clock, 1, span, time.Second, sendProbe)
+	br.probeInterval = time.Millisecond
+
+	requireUnavailable := func(t *testing.T, pErr *kvpb.Error) {
+		t.Helper()
+		require.NotNil(t, pErr)
+		require.IsType(t, &kvpb.ReplicaUnavailableError{}, pErr.GetDetail())
+		rue := pErr.GetDetail().(*kvpb.ReplicaUnavailableError)
+		require.Equal(t, roachpb.RangeID(1), rue.RangeID)
+		require.Equal(t, span, rue.Span)
+	}
+
+	// Requests are let through while no proposal is stuck.
+	var poisoned atomic.Bool
+	untrack := br.trackProposal(func() { poisoned.Store(true) })
+	br.checkStuckProposals()
+	_, pErr := br.execute(ctx, func(context.Context) (*kvpb.BatchResponse, *kvpb.Error) {
+		return &kvpb.BatchResponse{}, nil
+	})
+	require.Nil(t, pErr)
+
+	// A request that hangs is unblocked when the proposal gets stuck and the
+	// breaker trips, and the proposal's latches are poisoned.
+	waiting := make(chan struct{})
+	errC := make(chan *kvpb.Error, 1)
+	go func() {
+		_, pErr := br.execute(ctx, func(ctx context.Context) (*kvpb.BatchResponse, *kvpb.Error) {
+			close(waiting)
+			<-ctx.Done()
+			return nil, kvpb.NewError(ctx.Err())
+		})
+		errC <- pErr
+	}()
+	<-waiting
+	nowNanos.Add(int64(2 * time.Second))
+	br.checkStuckProposals()
+	requireUnavailable(t, <-errC)
+	require.True(t, poisoned.Load())
+	require.ErrorIs(t, br.Signal().Err(), circuit.ErrBreakerOpen)
+
+	// New requests fail fast, without being evaluated.
+	_, pErr = br.execute(ctx, func(context.Context) (*kvpb.BatchResponse, *kvpb.Error) {
+		t.Fatal("request evaluated while breaker is tripped")
+		return nil, nil
+	})
+	requireUnavailable(t, pErr)
+
+	// Requests failing on a poisoned latch also return a
+	// ReplicaUnavailableError.
+	br.wrapped.Reset()
+	_, pErr = br.execute(ctx, func(context.Context) (*kvpb.BatchResponse, *kvpb.Error) {
+		return nil, kvpb.NewError(poison.NewPoisonedError(roachpb.Span{Key: roachpb.Key("b")}, hlc.Timestamp{}))
+	})
+	requireUnavailable(t, pErr)
+	br.checkStuckProposals()
+
+	// The probe keeps the breaker tripped while the proposal is stuck and the
+	// probe request fails, and resets it once both are resolved.
+	untrack()
+	time.Sleep(10 * time.Millisecond)
+	require.Error(t, br.Signal().Err())
+	quorumLost.Store(false)
+	require.Eventually(t, func() bool {
+		return br.Signal().Err() == nil
+	}, 10*time.Second, time.Millisecond)
+	_, pErr = br.execute(ctx, func(context.Context) (*kvpb.BatchResponse, *kvpb.Error) {
+		return &kvpb.BatchResponse{}, nil
+	})
+	require.Nil(t, pErr)
+}
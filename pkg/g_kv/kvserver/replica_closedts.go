@@ -0,0 +1,231 @@
+package kvserver
+
+import (
+	"context"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/closedts"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/closedts/sidetransport"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+)
+
+// This file contains replica methods related to closed timestamps.
+//
+// The leaseholder of a range closes the timestamps which trail the present
+// by StoreConfig.ClosedTimestampTargetDuration: it serves no write at or
+// below them from then on, by moving the writes which it evaluates above its
+// closed timestamp. The writes in flight are tracked, so that no timestamp
+// at or above any of them is closed. The closed timestamp is published to
+// the followers along with each command proposed by the leaseholder and, for
+// the ranges which see no writes, through the side transport, along with the
+// index up to which the followers must have applied the commands of the
+// range for it to hold on them.
+//
+// A replica serves the non-locking reads at or below its closed timestamp
+// without the lease: they are follower reads. The closed timestamps of a
+// leaseholder never reach the expiration of its lease, nor the start of the
+// lease to which it transfers the lease, so that the next leaseholder serves
+// no write below them either.
+
+// sideTransportClosedTimestamp is a closed timestamp received through the
+// side transport, which holds once the replica has applied its log up to
+// the index.
+type sideTransportClosedTimestamp struct {
+	closed hlc.Timestamp
+	index  uint64
+}
+
+// GetCurrentClosedTimestamp returns the closed timestamp of the replica, at
+// or below which it serves follower reads.
+func (r *Replica) GetCurrentClosedTimestamp() hlc.Timestamp {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.getCurrentClosedTimestampRLocked()
+}
+
+// getCurrentClosedTimestampRLocked returns the closed timestamp of the
+// replica: the highest of those carried by the commands it applied, and of
+// those received through the side transport which hold at its applied index.
+// The timestamps which it closed as a leaseholder are only included once
+// published: the commands proposed before they were closed may not have
+// applied yet.
+func (r *Replica) getCurrentClosedTimestampRLocked() hlc.Timestamp {
+	closed := r.mu.closedTimestamp
+	closed.Forward(r.mu.sideTransportClosed)
+	if p := r.mu.sideTransportPending; r.mu.state.RaftAppliedIndex >= p.index {
+		closed.Forward(p.closed)
+	}
+	return closed
+}
+
+// getClosedTimestampForWritesRLocked returns the timestamp above which the
+// writes served by the replica must be performed: its closed timestamp,
+// including the timestamps which it closed as a leaseholder.
+func (r *Replica) getClosedTimestampForWritesRLocked() hlc.Timestamp {
+	closed := r.getCurrentClosedTimestampRLocked()
+	closed.Forward(r.mu.assignedClosedTimestamp)
+	return closed
+}
+
+// canServeFollowerReadRLocked returns whether the batch can be served by the
+// replica without the lease: it is a read-only batch which acquires no lock,
+// of a transaction which wrote nothing, at or below the replica's closed
+// timestamp. A transaction which wrote must read its writes, which only the
+// leaseholder is sure to have applied.
+func (r *Replica) canServeFollowerReadRLocked(ba *kvpb.BatchRequest) bool {
+	if !ba.IsReadOnly() || ba.IsLocking() {
+		return false
+	}
+	if ba.Txn != nil && ba.Txn.IsLocking() {
+		return false
+	}
+	return ba.Timestamp.LessEq(r.getCurrentClosedTimestampRLocked())
+}
+
+// canServeFollowerRead is like canServeFollowerReadRLocked, but acquires the
+// replica's mutex.
+func (r *Replica) canServeFollowerRead(ba *kvpb.BatchRequest) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.canServeFollowerReadRLocked(ba)
+}
+
+// closeTimestampLocked forwards the timestamp closed by the replica up to the
+// target, if the replica holds a valid lease of its range at the clock
+// reading now. The closed timestamp stays below the writes in flight, and
+// below the expiration of the lease; it doesn't move while the lease is
+// being transferred. It returns false if the replica doesn't hold the lease.
+func (r *Replica) closeTimestampLocked(now hlc.ClockTimestamp, target hlc.Timestamp) bool {
+	if r.mu.destroyed {
+		return false
+	}
+	st := r.leaseStatusAtRLocked(now, now.ToTimestamp())
+	if !st.IsValid() || !st.OwnedBy(r.store.StoreID()) {
+		return false
+	}
+	if r.mu.leaseTransferInProgress {
+		return true
+	}
+	if lb := r.mu.writeTracker.LowerBound(); !lb.IsEmpty() && lb.LessEq(target) {
+		target = lb.Prev()
+	}
+	if exp := st.Expiration(); exp.LessEq(target) {
+		target = exp.Prev()
+	}
+	r.mu.assignedClosedTimestamp.Forward(target)
+	return true
+}
+
+// trackWriteAboveClosedTimestamp moves the write timestamp of the batch above
+// the closed timestamp of the replica, if necessary, and tracks it until the
+// returned function is first called, once the batch's command is proposed.
+// Like applyTimestampCache, it returns a copy of the batch if it was pushed.
+func (r *Replica) trackWriteAboveClosedTimestamp(ba *kvpb.BatchRequest) (*kvpb.BatchRequest, func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	nextTS := r.getClosedTimestampForWritesRLocked().Next()
+	var ts hlc.Timestamp
+	if ba.Txn != nil {
+		if ba.Txn.WriteTimestamp.Less(nextTS) {
+			ba = ba.ShallowCopy()
+			ba.Txn = ba.Txn.Clone()
+			ba.Txn.WriteTimestamp.Forward(nextTS)
+		}
+		ts = ba.Txn.WriteTimestamp
+	} else {
+		if ba.Timestamp.Less(nextTS) {
+			ba = ba.ShallowCopy()
+			ba.Timestamp.Forward(nextTS)
+		}
+		ts = ba.Timestamp
+	}
+	tok := r.mu.writeTracker.Track(ts)
+	return ba, func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.mu.writeTracker.Untrack(tok)
+	}
+}
+
+// BumpSideTransportClosed implements the sidetransport.Replica interface.
+//
+// Nothing is published while the replica has buffered proposals: their
+// commands, which may write below the timestamp, have no index yet for the
+// timestamp to hold at.
+func (r *Replica) BumpSideTransportClosed(
+	_ context.Context, now hlc.ClockTimestamp, target hlc.Timestamp,
+) sidetransport.BumpSideTransportClosedResult {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.mu.proposalBuf) > 0 || !r.closeTimestampLocked(now, target) {
+		return sidetransport.BumpSideTransportClosedResult{}
+	}
+	index := r.mu.maxProposalIndex
+	if index < r.mu.state.RaftAppliedIndex {
+		index = r.mu.state.RaftAppliedIndex
+	}
+	// The published timestamp holds on the leaseholder too once it applied
+	// the commands it proposed, like on its followers.
+	r.forwardSideTransportClosedTimestampLocked(r.mu.assignedClosedTimestamp, index)
+	return sidetransport.BumpSideTransportClosedResult{
+		OK:              true,
+		ClosedTimestamp: r.mu.assignedClosedTimestamp,
+		AppliedIndex:    index,
+		Desc:            r.mu.desc,
+	}
+}
+
+// forwardSideTransportClosedTimestamp records the closed timestamp received
+// through the side transport, which holds once the replica has applied its
+// log up to the index. Of the timestamps which don't hold yet, only the
+// latest is retained.
+func (r *Replica) forwardSideTransportClosedTimestamp(closed hlc.Timestamp, index uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.forwardSideTransportClosedTimestampLocked(closed, index)
+}
+
+// forwardSideTransportClosedTimestampLocked is like
+// forwardSideTransportClosedTimestamp, but requires r.mu to be held.
+func (r *Replica) forwardSideTransportClosedTimestampLocked(closed hlc.Timestamp, index uint64) {
+	if r.mu.state.RaftAppliedIndex >= index {
+		r.mu.sideTransportClosed.Forward(closed)
+		return
+	}
+	if r.mu.sideTransportPending.closed.Less(closed) {
+		r.mu.sideTransportPending = sideTransportClosedTimestamp{closed: closed, index: index}
+	}
+}
+
+// setAppliedClosedTimestampLocked records the closed timestamp carried by an
+// applied command, if any, and that received through the side transport
+// which now holds, if any.
+func (r *Replica) setAppliedClosedTimestampLocked(closed *hlc.Timestamp) {
+	if closed != nil {
+		r.mu.closedTimestamp.Forward(*closed)
+	}
+	if p := r.mu.sideTransportPending; p.index != 0 && r.mu.state.RaftAppliedIndex >= p.index {
+		r.mu.sideTransportClosed.Forward(p.closed)
+		r.mu.sideTransportPending = sideTransportClosedTimestamp{}
+	}
+}
+
+// inheritClosedTimestamps sets the closed timestamps of the right-hand side
+// of a split to those of the left-hand side, whose keyspace it takes over.
+// The writes to the right-hand side stay above the timestamps closed by the
+// left-hand side, and its followers serve the reads below them.
+func (r *Replica) inheritClosedTimestamps(leftRepl *Replica) {
+	leftRepl.mu.RLock()
+	closed := leftRepl.getCurrentClosedTimestampRLocked()
+	assigned := leftRepl.mu.assignedClosedTimestamp
+	leftRepl.mu.RUnlock()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.mu.closedTimestamp.Forward(closed)
+	r.mu.assignedClosedTimestamp.Forward(assigned)
+}
+
+// closedTimestampTarget returns the timestamp that the replica attempts to
+// close at the clock reading now.
+func (r *Replica) closedTimestampTarget(now hlc.ClockTimestamp) hlc.Timestamp {
+	return closedts.TargetForPolicy(now, r.store.cfg.ClosedTimestampTargetDuration)
+}
@@ -0,0 +1,587 @@
+package kvserver
+
+import (
+	"context"
+	"fmt"
+	keys "github.com/dborchard/tiny_crdb/pkg/g_keys"
+	kv "github.com/dborchard/tiny_crdb/pkg/g_kv"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/concurrency"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/concurrency/poison"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/kvserverpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/spanset"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	storage "github.com/dborchard/tiny_crdb/pkg/h_storage"
+	"go.etcd.io/raft/v3/raftpb"
+)
+
+// executeAdminBatch executes the admin command of the batch, which must be
+// alone in its batch. Admin commands are not evaluated against the range's
+// state: they run transactions which update the range descriptors and the
+// addressing records, and whose commit triggers take effect when they
+// commit.
+func (r *Replica) executeAdminBatch(
+	ctx context.Context, ba *kvpb.BatchRequest,
+) (*kvpb.BatchResponse, *kvpb.Error) {
+	if len(ba.Requests) != 1 {
+		return nil, kvpb.NewErrorf("only a single admin request is allowed per batch, got %d", len(ba.Requests))
+	}
+
+	var resp kvpb.Response
+	var pErr *kvpb.Error
+	switch args := ba.Requests[0].GetInner().(type) {
+	case *kvpb.AdminSplitRequest:
+		var reply kvpb.AdminSplitResponse
+		reply, pErr = r.AdminSplit(ctx, *args)
+		resp = &reply
+	case *kvpb.AdminMergeRequest:
+		var reply kvpb.AdminMergeResponse
+		reply, pErr = r.AdminMerge(ctx, *args)
+		resp = &reply
+	case *kvpb.AdminChangeReplicasRequest:
+		var reply kvpb.AdminChangeReplicasResponse
+		reply, pErr = r.AdminChangeReplicas(ctx, *args)
+		resp = &reply
+	case *kvpb.AdminTransferLeaseRequest:
+		var reply kvpb.AdminTransferLeaseResponse
+		reply, pErr = r.AdminTransferLease(ctx, *args)
+		resp = &reply
+	default:
+		return nil, kvpb.NewErrorf("unrecognized admin command: %s", args.Method())
+	}
+	if pErr != nil {
+		return nil, pErr
+	}
+
+	br := &kvpb.BatchResponse{}
+	br.Add(resp)
+	return br, nil
+}
+
+// AdminSplit divides the range into two ranges using args.SplitKey. If
+// no split key is provided, the key at the midpoint of the range's data is
+// used.
+//
+// The split is performed in a transaction which updates the descriptor of
+// the range and writes the descriptor of the new right-hand range, along with
+// the meta2 records addressing both. The transaction is anchored on the
+// range, and its EndTxn carries a SplitTrigger: when it commits, the new
+// right-hand range's stats are computed and a replica is created for it on
+// the store.
+func (r *Replica) AdminSplit(
+	ctx context.Context, args kvpb.AdminSplitRequest,
+) (kvpb.AdminSplitResponse, *kvpb.Error) {
+	var reply kvpb.AdminSplitResponse
+	desc := r.Desc()
+
+	splitKey := args.SplitKey
+	if len(splitKey) == 0 {
+		foundKey, err := r.findSplitKey(ctx)
+		if err != nil {
+			return reply, kvpb.NewError(fmt.Errorf("unable to determine split key: %w", err))
+		}
+		if foundKey == nil {
+			return reply, kvpb.NewErrorf("cannot find a split key for range %s", desc)
+		}
+		splitKey = foundKey
+	}
+	if !keys.IsValidSplitKey(splitKey) {
+		return reply, kvpb.NewErrorf("cannot split range at key %s", splitKey)
+	}
+	rSplitKey, err := keys.Addr(splitKey)
+	if err != nil {
+		return reply, kvpb.NewError(err)
+	}
+	if !desc.ContainsKey(rSplitKey) {
+		return reply, kvpb.NewError(
+			kvpb.NewRangeKeyMismatchError(splitKey, splitKey.Next(), desc))
+	}
+	if rSplitKey.Equal(desc.StartKey) {
+		return reply, kvpb.NewErrorf("range is already split at key %s", splitKey)
+	}
+
+	rangeID, err := allocateRangeID(ctx, r.store.DB())
+	if err != nil {
+		return reply, kvpb.NewError(err)
+	}
+	leftDesc := *desc
+	leftDesc.EndKey = rSplitKey
+	leftDesc.Generation++
+	rightDesc := roachpb.RangeDescriptor{
+		RangeID:          rangeID,
+		StartKey:         rSplitKey,
+		EndKey:           desc.EndKey,
+		InternalReplicas: append([]roachpb.ReplicaDescriptor(nil), desc.InternalReplicas...),
+		NextReplicaID:    desc.NextReplicaID,
+		Generation:       leftDesc.Generation,
+		StickyBit:        args.ExpirationTime,
+	}
+
+	if err := r.store.DB().Txn(ctx, func(ctx context.Context, txn *kv.Txn) error {
+		// The descriptor of the range is locked first, which anchors the
+		// transaction on the range. Its EndTxn, and therefore its commit
+		// trigger, is evaluated by the range.
+		if err := checkDescUnchanged(ctx, txn, desc); err != nil {
+			return err
+		}
+		b := txn.NewBatch()
+		b.Put(keys.RangeDescriptorKey(leftDesc.StartKey), &leftDesc)
+		b.Put(keys.RangeDescriptorKey(rightDesc.StartKey), &rightDesc)
+		// The left-hand side is now addressed by the meta2 record of the
+		// split key, and the right-hand side by that of the original range's
+		// end key.
+		b.Put(keys.RangeMetaKey(leftDesc.EndKey).AsRawKey(), &leftDesc)
+		b.Put(keys.RangeMetaKey(rightDesc.EndKey).AsRawKey(), &rightDesc)
+		if err := txn.Run(ctx, b); err != nil {
+			return err
+		}
+		return commitWithTrigger(ctx, txn, &roachpb.InternalCommitTrigger{
+			SplitTrigger: &roachpb.SplitTrigger{LeftDesc: leftDesc, RightDesc: rightDesc},
+		})
+	}); err != nil {
+		return reply, kvpb.NewError(fmt.Errorf("split at key %s failed: %w", splitKey, err))
+	}
+	return reply, nil
+}
+
+// findSplitKey returns the key at the midpoint of the range's data, or nil if
+// the range holds a single row.
+func (r *Replica) findSplitKey(ctx context.Context) (roachpb.Key, error) {
+	desc := r.Desc()
+	// The system data of the range, such as its descriptor, is not part of
+	// the data to be divided.
+	ms := r.GetMVCCStats()
+	targetSize := (ms.KeyBytes + ms.ValBytes) / 2
+	return storage.MVCCFindSplitKey(ctx, r.store.Engine(), desc.StartKey, desc.EndKey, targetSize)
+}
+
+// AdminMerge extends the range to subsume the range that comes next in the
+// key space. The subsumed range must have its replicas on the same stores,
+// and be led by the replica of the same store.
+//
+// The merge is performed in a transaction which extends the descriptor of
+// the range, deletes that of the subsumed range, and replaces the meta2
+// records of both ranges with the record of the merged range. Its EndTxn
+// carries a MergeTrigger: when it is evaluated, the subsumed range is frozen
+// until the commit has applied, at which point the subsumed replica is
+// destroyed and its stats are folded into those of the range.
+func (r *Replica) AdminMerge(
+	ctx context.Context, args kvpb.AdminMergeRequest,
+) (kvpb.AdminMergeResponse, *kvpb.Error) {
+	var reply kvpb.AdminMergeResponse
+	origLeftDesc := r.Desc()
+	if origLeftDesc.EndKey.Equal(roachpb.RKeyMax) {
+		return reply, kvpb.NewErrorf("cannot merge final range")
+	}
+	if origLeftDesc.StartKey.Less(roachpb.RKey(keys.MetaMax)) {
+		// The meta range is found without a meta lookup, through the meta1
+		// record and the FirstRangeProvider, and must stay a range of its
+		// own.
+		return reply, kvpb.NewErrorf("cannot merge the meta range %s", origLeftDesc)
+	}
+	rightRepl := r.store.LookupReplica(origLeftDesc.EndKey)
+	if rightRepl == nil {
+		return reply, kvpb.NewErrorf("cannot merge range %s: right-hand neighbour not found on s%d",
+			origLeftDesc, r.store.StoreID())
+	}
+	origRightDesc := rightRepl.Desc()
+	if !replicaSetsEqual(origLeftDesc, origRightDesc) {
+		return reply, kvpb.NewErrorf("cannot merge ranges %s and %s with different replica sets",
+			origLeftDesc, origRightDesc)
+	}
+	if !rightRepl.isLeaseholderReady() {
+		return reply, kvpb.NewErrorf("cannot merge range %s: s%d does not hold the lease of its right-hand neighbour",
+			origLeftDesc, r.store.StoreID())
+	}
+
+	mergedDesc := *origLeftDesc
+	mergedDesc.EndKey = origRightDesc.EndKey
+	mergedDesc.Generation = origLeftDesc.Generation
+	if origRightDesc.Generation > mergedDesc.Generation {
+		mergedDesc.Generation = origRightDesc.Generation
+	}
+	mergedDesc.Generation++
+
+	if err := r.store.DB().Txn(ctx, func(ctx context.Context, txn *kv.Txn) error {
+		// As for splits, the descriptor of the range is locked first, which
+		// anchors the transaction on it.
+		if err := checkDescUnchanged(ctx, txn, origLeftDesc); err != nil {
+			return err
+		}
+		if err := checkDescUnchanged(ctx, txn, origRightDesc); err != nil {
+			return err
+		}
+		b := txn.NewBatch()
+		b.Put(keys.RangeDescriptorKey(mergedDesc.StartKey), &mergedDesc)
+		b.Del(keys.RangeDescriptorKey(origRightDesc.StartKey))
+		b.Del(keys.RangeMetaKey(origLeftDesc.EndKey).AsRawKey())
+		b.Put(keys.RangeMetaKey(mergedDesc.EndKey).AsRawKey(), &mergedDesc)
+		if err := txn.Run(ctx, b); err != nil {
+			return err
+		}
+		return commitWithTrigger(ctx, txn, &roachpb.InternalCommitTrigger{
+			MergeTrigger: &roachpb.MergeTrigger{LeftDesc: mergedDesc, RightDesc: *origRightDesc},
+		})
+	}); err != nil {
+		return reply, kvpb.NewError(fmt.Errorf("merge of range into %d failed: %w",
+			origLeftDesc.RangeID, err))
+	}
+	return reply, nil
+}
+
+// AdminChangeReplicas adds or removes replicas of the range, through an
+// atomic replication change. The range's descriptor must match the expected
+// descriptor of the request.
+//
+// The change is performed by two transactions which update the descriptor
+// of the range and the meta records addressing it, and whose EndTxn carries
+// a ChangeReplicasTrigger: it is proposed to the range's Raft group as a
+// configuration change. The first transaction enters a joint configuration,
+// in which the added replicas are incoming voters and the removed ones are
+// outgoing voters; decisions then require a quorum of both the old and the
+// new set of voters. The second transaction leaves the joint configuration.
+// A range left in a joint configuration, by a change which failed midway,
+// leaves it before the change is made.
+//
+// Once the joint configuration is entered, each added replica is sent an
+// INITIAL snapshot of the range, from which it is created on its store.
+//
+// The replica evaluating the change leads the range, and cannot be removed.
+// Once a replica learns of its removal, it is destroyed and its data is
+// cleared from its store.
+func (r *Replica) AdminChangeReplicas(
+	ctx context.Context, args kvpb.AdminChangeReplicasRequest,
+) (kvpb.AdminChangeReplicasResponse, *kvpb.Error) {
+	var reply kvpb.AdminChangeReplicasResponse
+	desc := r.Desc()
+	if desc.RangeID != args.ExpDesc.RangeID || desc.Generation != args.ExpDesc.Generation {
+		return reply, kvpb.NewErrorf("descriptor changed: expected %s, found %s", args.ExpDesc, desc)
+	}
+	if desc.InAtomicReplicationChange() {
+		var err error
+		if desc, err = r.execChangeReplicasTxn(ctx, desc, leaveJointDesc(desc)); err != nil {
+			return reply, kvpb.NewError(fmt.Errorf("leaving joint configuration failed: %w", err))
+		}
+	}
+
+	jointDesc := *desc
+	jointDesc.InternalReplicas = append([]roachpb.ReplicaDescriptor(nil), desc.InternalReplicas...)
+	jointDesc.Generation++
+	for _, chg := range args.InternalChanges {
+		i := -1
+		for j, rd := range jointDesc.InternalReplicas {
+			if rd.StoreID == chg.Target.StoreID {
+				i = j
+			}
+		}
+		switch chg.ChangeType {
+		case roachpb.ADD_VOTER:
+			if i >= 0 {
+				return reply, kvpb.NewErrorf("unable to add replica on %s: range %s already has one",
+					chg.Target, desc)
+			}
+			jointDesc.InternalReplicas = append(jointDesc.InternalReplicas, roachpb.ReplicaDescriptor{
+				NodeID:    chg.Target.NodeID,
+				StoreID:   chg.Target.StoreID,
+				ReplicaID: jointDesc.NextReplicaID,
+				Type:      roachpb.VOTER_INCOMING,
+			})
+			jointDesc.NextReplicaID++
+		case roachpb.REMOVE_VOTER:
+			if i < 0 || jointDesc.InternalReplicas[i].Type != roachpb.VOTER_FULL {
+				return reply, kvpb.NewErrorf("unable to remove replica on %s: not a voter of range %s",
+					chg.Target, desc)
+			}
+			if chg.Target.StoreID == r.store.StoreID() {
+				return reply, kvpb.NewErrorf("unable to remove the leader of range %s", desc)
+			}
+			jointDesc.InternalReplicas[i].Type = roachpb.VOTER_OUTGOING
+		default:
+			return reply, kvpb.NewErrorf("unsupported replica change type %s", chg.ChangeType)
+		}
+	}
+	if !jointDesc.InAtomicReplicationChange() {
+		reply.Desc = *desc
+		return reply, nil
+	}
+
+	if _, err := r.execChangeReplicasTxn(ctx, desc, &jointDesc); err != nil {
+		return reply, kvpb.NewError(fmt.Errorf("entering joint configuration failed: %w", err))
+	}
+	for _, rd := range jointDesc.InternalReplicas {
+		if rd.Type != roachpb.VOTER_INCOMING {
+			continue
+		}
+		if err := r.sendSnapshot(ctx, rd, kvserverpb.SnapshotRequest_INITIAL); err != nil {
+			return reply, kvpb.NewError(fmt.Errorf("sending initial snapshot to %s failed: %w", rd, err))
+		}
+	}
+	finalDesc, err := r.execChangeReplicasTxn(ctx, &jointDesc, leaveJointDesc(&jointDesc))
+	if err != nil {
+		return reply, kvpb.NewError(fmt.Errorf("leaving joint configuration failed: %w", err))
+	}
+	reply.Desc = *finalDesc
+	return reply, nil
+}
+
+// sendSnapshot streams a snapshot of the replica, the leader of the range, to
+// the recipient, through the store's RaftTransport. The store sends up to
+// StoreConfig.SnapshotConcurrency snapshots at a time; the others wait for
+// their turn.
+func (r *Replica) sendSnapshot(
+	ctx context.Context, recipient roachpb.ReplicaDescriptor, snapType kvserverpb.SnapshotRequest_Type,
+) error {
+	transport := r.store.cfg.Transport
+	if transport == nil {
+		return fmt.Errorf("r%d: no raft transport to send snapshots", r.RangeID)
+	}
+	release, err := r.store.acquireSnapshotSem(ctx, r.store.snapshotSendSem)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	snap, err := r.getSnapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.Close()
+	if _, ok := snap.Desc.GetReplicaDescriptorByID(recipient.ReplicaID); !ok {
+		return fmt.Errorf("r%d: snapshot recipient %s is not part of range %s", r.RangeID, recipient, snap.Desc)
+	}
+
+	r.mu.RLock()
+	from := roachpb.ReplicaDescriptor{
+		NodeID:    r.store.NodeID(),
+		StoreID:   r.store.StoreID(),
+		ReplicaID: r.mu.replicaID,
+	}
+	term := r.mu.internalRaftGroup.Status().Term
+	r.mu.RUnlock()
+	header := &kvserverpb.SnapshotRequest_Header{
+		Desc: *snap.Desc,
+		RaftMessageRequest: kvserverpb.RaftMessageRequest{
+			RangeID:     r.RangeID,
+			FromReplica: from,
+			ToReplica:   recipient,
+			Message: raftpb.Message{
+				Type: raftpb.MsgSnap,
+				From: uint64(from.ReplicaID),
+				To:   uint64(recipient.ReplicaID),
+				Term: term,
+				Snapshot: &raftpb.Snapshot{
+					Metadata: raftpb.SnapshotMetadata{
+						ConfState: confStateFromDesc(snap.Desc),
+						Index:     snap.State.RaftAppliedIndex,
+						Term:      snap.State.RaftAppliedIndexTerm,
+					},
+				},
+			},
+		},
+		Type:      snapType,
+		RangeSize: snap.Stats.Total(),
+	}
+	stream, err := transport.SnapshotStream(ctx, recipient.StoreID)
+	if err != nil {
+		return err
+	}
+	if err := sendSnapshotStream(ctx, stream, header, snap); err != nil {
+		return fmt.Errorf("r%d: %s snapshot to %s: %w", r.RangeID, snapType, recipient, err)
+	}
+	return nil
+}
+
+// getSnapshot captures the state of the replica for a snapshot. The engine
+// snapshot is taken with r.raftMu held, so that it holds the state of the
+// range as of the applied index which it is taken with.
+func (r *Replica) getSnapshot() (*outgoingSnapshot, error) {
+	r.raftMu.Lock()
+	defer r.raftMu.Unlock()
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.mu.destroyed {
+		return nil, kvpb.NewRangeNotFoundError(r.RangeID, r.store.StoreID())
+	}
+	return &outgoingSnapshot{
+		EngineSnap: r.store.Engine().NewSnapshot(),
+		Desc:       r.mu.desc,
+		State:      r.mu.state,
+		Stats:      r.mu.stats,
+	}, nil
+}
+
+// leaveJointDesc returns the descriptor of the range once it leaves its
+// joint configuration: the incoming voters become full voters, and the
+// outgoing voters are removed.
+func leaveJointDesc(desc *roachpb.RangeDescriptor) *roachpb.RangeDescriptor {
+	newDesc := *desc
+	newDesc.InternalReplicas = nil
+	for _, rd := range desc.InternalReplicas {
+		switch rd.Type {
+		case roachpb.VOTER_OUTGOING:
+			continue
+		case roachpb.VOTER_INCOMING:
+			rd.Type = roachpb.VOTER_FULL
+		}
+		newDesc.InternalReplicas = append(newDesc.InternalReplicas, rd)
+	}
+	newDesc.Generation++
+	return &newDesc
+}
+
+// execChangeReplicasTxn replaces the descriptor of the range, and the meta
+// records addressing it, with the new descriptor in a transaction whose
+// commit carries a ChangeReplicasTrigger. It returns the new descriptor once
+// the change has applied on the replica.
+func (r *Replica) execChangeReplicasTxn(
+	ctx context.Context, oldDesc, newDesc *roachpb.RangeDescriptor,
+) (*roachpb.RangeDescriptor, error) {
+	if err := r.store.DB().Txn(ctx, func(ctx context.Context, txn *kv.Txn) error {
+		if err := checkDescUnchanged(ctx, txn, oldDesc); err != nil {
+			return err
+		}
+		b := txn.NewBatch()
+		b.Put(keys.RangeDescriptorKey(newDesc.StartKey), newDesc)
+		b.Put(keys.RangeMetaKey(newDesc.EndKey).AsRawKey(), newDesc)
+		if newDesc.StartKey.Equal(roachpb.RKeyMin) {
+			// The first range is also addressed by the meta1 record.
+			b.Put(keys.Meta1KeyMax, newDesc)
+		}
+		if err := txn.Run(ctx, b); err != nil {
+			return err
+		}
+		return commitWithTrigger(ctx, txn, &roachpb.InternalCommitTrigger{
+			ChangeReplicasTrigger: &roachpb.ChangeReplicasTrigger{Desc: newDesc},
+		})
+	}); err != nil {
+		return nil, err
+	}
+	return newDesc, nil
+}
+
+// replicaSetsEqual returns whether the ranges have full voters on the same
+// stores, and no other replicas.
+func replicaSetsEqual(a, b *roachpb.RangeDescriptor) bool {
+	if a.InAtomicReplicationChange() || b.InAtomicReplicationChange() ||
+		len(a.InternalReplicas) != len(b.InternalReplicas) {
+		return false
+	}
+	for _, rd := range a.InternalReplicas {
+		if _, ok := b.GetReplicaDescriptor(rd.StoreID); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// checkDescUnchanged locks the descriptor of the range in the transaction,
+// and verifies that it matches the expected descriptor. It fails if the range
+// was split or merged concurrently.
+func checkDescUnchanged(ctx context.Context, txn *kv.Txn, expDesc *roachpb.RangeDescriptor) error {
+	res, err := txn.GetForUpdate(ctx, keys.RangeDescriptorKey(expDesc.StartKey))
+	if err != nil {
+		return err
+	}
+	if res.Value == nil {
+		return fmt.Errorf("descriptor of r%d not found", expDesc.RangeID)
+	}
+	var desc roachpb.RangeDescriptor
+	if err := res.Value.GetProto(&desc); err != nil {
+		return err
+	}
+	if desc.RangeID != expDesc.RangeID || desc.Generation != expDesc.Generation ||
+		!desc.EndKey.Equal(expDesc.EndKey) {
+		return fmt.Errorf("descriptor changed: expected %s, found %s", expDesc, desc)
+	}
+	return nil
+}
+
+// commitWithTrigger commits the transaction with the internal commit trigger.
+func commitWithTrigger(
+	ctx context.Context, txn *kv.Txn, trigger *roachpb.InternalCommitTrigger,
+) error {
+	b := txn.NewBatch()
+	b.AddRawRequest(&kvpb.EndTxnRequest{
+		Commit:                true,
+		InternalCommitTrigger: trigger,
+	})
+	return txn.Run(ctx, b)
+}
+
+// allocateRangeID allocates a new range ID from the range ID generator.
+func allocateRangeID(ctx context.Context, db *kv.DB) (roachpb.RangeID, error) {
+	var id int64
+	if err := db.Txn(ctx, func(ctx context.Context, txn *kv.Txn) error {
+		res, err := txn.GetForUpdate(ctx, keys.RangeIDGenerator)
+		if err != nil {
+			return err
+		}
+		id = 0
+		if res.Value != nil {
+			if id, err = res.Value.GetInt(); err != nil {
+				return err
+			}
+		}
+		id++
+		return txn.Put(ctx, keys.RangeIDGenerator, id)
+	}); err != nil {
+		return 0, fmt.Errorf("unable to allocate range ID: %w", err)
+	}
+	return roachpb.RangeID(id), nil
+}
+
+// maybeFreezeRightHandSide freezes the range subsumed by the batch's merge
+// trigger, if any, before the merge is evaluated: write latches are acquired
+// over all of its data, which waits for its in-flight requests and blocks
+// new ones. The returned function releases the latches; the requests that
+// were blocked then find the replica destroyed, if the merge applied.
+//
+// The subsumed range's replica on the store must be the leader of the range.
+// Once frozen, all the replicas of the range are brought up to date with
+// its leader, whose applied index is returned: each replica of the merged
+// range applies the subsumed range's log up to that index before it applies
+// the merge, which it may do after the subsumed range's leader is gone.
+func (r *Replica) maybeFreezeRightHandSide(
+	ctx context.Context, ba *kvpb.BatchRequest,
+) (release func(), rightAppliedIndex uint64, _ error) {
+	arg, ok := ba.GetArg(kvpb.EndTxn)
+	if !ok {
+		return func() {}, 0, nil
+	}
+	et := arg.(*kvpb.EndTxnRequest)
+	mt := et.InternalCommitTrigger.GetMergeTrigger()
+	if mt == nil || !et.Commit {
+		return func() {}, 0, nil
+	}
+	rightRepl, err := r.store.GetReplica(mt.RightDesc.RangeID)
+	if err != nil {
+		return nil, 0, err
+	}
+	latchSpans := spanset.New()
+	for _, span := range rangeDataSpans(&mt.RightDesc) {
+		latchSpans.AddNonMVCC(spanset.SpanReadWrite, span)
+	}
+	g, pErr := rightRepl.concMgr.SequenceReq(ctx, nil, concurrency.Request{
+		PoisonPolicy: poison.Policy_Error,
+		LatchSpans:   latchSpans,
+	})
+	if pErr != nil {
+		return nil, 0, pErr.GoError()
+	}
+	release = func() { rightRepl.concMgr.FinishReq(g) }
+	if desc := rightRepl.Desc(); desc.Generation != mt.RightDesc.Generation {
+		release()
+		return nil, 0, fmt.Errorf("range %s changed during merge into r%d", desc, r.RangeID)
+	}
+	if !rightRepl.isLeaseholderReady() {
+		// The right-hand side's requests are served by another store.
+		release()
+		return nil, 0, fmt.Errorf("r%d lost its lease during merge into r%d", rightRepl.RangeID, r.RangeID)
+	}
+	if rightAppliedIndex, err = rightRepl.waitForReplicasToCatchUp(ctx); err != nil {
+		release()
+		return nil, 0, fmt.Errorf("replicas of r%d not caught up for merge into r%d: %w",
+			rightRepl.RangeID, r.RangeID, err)
+	}
+	return release, rightAppliedIndex, nil
+}
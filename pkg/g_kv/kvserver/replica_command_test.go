@@ -0,0 +1,138 @@
+package kvserver
+
+import (
+	"context"
+	"fmt"
+	keys "github.com/dborchard/tiny_crdb/pkg/g_keys"
+	kv "github.com/dborchard/tiny_crdb/pkg/g_kv"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	storage "github.com/dborchard/tiny_crdb/pkg/h_storage"
+	"github.com/dborchard/tiny_crdb/pkg/z_testutils/kvclientutils"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+// writeTestKeys writes the keys in a transaction, each with its own name as
+// value.
+func writeTestKeys(t *testing.T, db *kv.DB, keys ...string) {
+	require.NoError(t, db.Txn(context.Background(), func(ctx context.Context, txn *kv.Txn) error {
+		for _, key := range keys {
+			if err := txn.Put(ctx, key, key); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+}
+
+// requireMetaRecord verifies that the range is addressed by the meta2 record
+// of its end key.
+func requireMetaRecord(t *testing.T, db *kv.DB, desc *roachpb.RangeDescriptor) {
+	require.NoError(t, db.Txn(context.Background(), func(ctx context.Context, txn *kv.Txn) error {
+		res, err := txn.Get(ctx, keys.RangeMetaKey(desc.EndKey).AsRawKey())
+		require.NoError(t, err)
+		require.NotNil(t, res.Value)
+		var metaDesc roachpb.RangeDescriptor
+		require.NoError(t, res.Value.GetProto(&metaDesc))
+		require.Equal(t, desc.RangeID, metaDesc.RangeID)
+		require.Equal(t, desc.Generation, metaDesc.Generation)
+		return nil
+	}))
+}
+
+// TestStoreRangeSplitAndMerge verifies that a range is split and merged back
+// atomically: the descriptors, meta records and stats of the ranges are
+// updated, and requests are routed to the right ranges throughout.
+func TestStoreRangeSplitAndMerge(t *testing.T) {
+	ctx := context.Background()
+	store, db := createTestStore(t)
+	var ks []string
+	for c := 'a'; c <= 'j'; c++ {
+		ks = append(ks, string(c))
+	}
+	writeTestKeys(t, db, ks...)
+	origRepl := store.LookupReplica(roachpb.RKey("a"))
+	origDesc := *origRepl.Desc()
+
+	// Split the range at "e".
+	require.NoError(t, db.AdminSplit(ctx, "e", hlc.Timestamp{}))
+	require.Equal(t, 4, store.ReplicaCount())
+	lhs, rhs := store.LookupReplica(roachpb.RKey("a")), store.LookupReplica(roachpb.RKey("e"))
+	require.Equal(t, origRepl, lhs)
+	require.NotEqual(t, lhs.RangeID, rhs.RangeID)
+	require.Equal(t, roachpb.RKey("e"), lhs.Desc().EndKey)
+	require.Equal(t, origDesc.EndKey, rhs.Desc().EndKey)
+	require.Equal(t, origDesc.Generation+1, lhs.Desc().Generation)
+	requireMetaRecord(t, db, lhs.Desc())
+	requireMetaRecord(t, db, rhs.Desc())
+	requireStatsConsistent(t, lhs)
+	requireStatsConsistent(t, rhs)
+	require.Equal(t, int64(4), lhs.GetMVCCStats().LiveCount)
+	require.Equal(t, int64(6), rhs.GetMVCCStats().LiveCount)
+
+	// The ranges serve reads and transactions spanning both of them.
+	writeTestKeys(t, db, "b", "f")
+	require.NoError(t, db.Txn(ctx, func(ctx context.Context, txn *kv.Txn) error {
+		require.Equal(t, "b", kvclientutils.GetString(t, ctx, txn, "b"))
+		require.Equal(t, "f", kvclientutils.GetString(t, ctx, txn, "f"))
+		return nil
+	}))
+	requireStatsConsistent(t, lhs)
+	requireStatsConsistent(t, rhs)
+
+	// A range cannot be split at its start key, nor at a meta key.
+	require.ErrorContains(t, db.AdminSplit(ctx, "e", hlc.Timestamp{}), "already split")
+	require.Error(t, db.AdminSplit(ctx, keys.RangeMetaKey(roachpb.RKey("c")).AsRawKey(), hlc.Timestamp{}))
+
+	// Merge the ranges back.
+	require.NoError(t, db.AdminMerge(ctx, "a"))
+	require.Equal(t, 3, store.ReplicaCount())
+	require.Equal(t, lhs, store.LookupReplica(roachpb.RKey("e")))
+	require.Equal(t, origDesc.EndKey, lhs.Desc().EndKey)
+	requireMetaRecord(t, db, lhs.Desc())
+	requireStatsConsistent(t, lhs)
+	require.Equal(t, int64(10), lhs.GetMVCCStats().LiveCount)
+	var rhsErr *kvpb.RangeNotFoundError
+	require.ErrorAs(t, rhs.IsDestroyed(), &rhsErr)
+	ok, err := storage.MVCCGetProto(ctx, store.Engine(), keys.RangeStatsLegacyKey(rhs.RangeID),
+		hlc.Timestamp{}, &roachpb.RangeDescriptor{}, storage.MVCCGetOptions{})
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// The DistSender's cached descriptor of the subsumed range is stale, and
+	// is refreshed transparently.
+	require.NoError(t, db.Txn(ctx, func(ctx context.Context, txn *kv.Txn) error {
+		require.Equal(t, "f", kvclientutils.GetString(t, ctx, txn, "f"))
+		return txn.Put(ctx, "g", "g2")
+	}))
+	requireStatsConsistent(t, lhs)
+
+	// The system and meta ranges cannot be merged.
+	require.ErrorContains(t, db.AdminMerge(ctx, keys.RangeMetaKey(roachpb.RKey("a")).AsRawKey()),
+		"meta range")
+}
+
+// TestStoreRangeSplitAtRows verifies that a split without a split key splits
+// the range at the midpoint of its data.
+func TestStoreRangeSplitAtRows(t *testing.T) {
+	ctx := context.Background()
+	store, db := createTestStore(t)
+	var ks []string
+	for i := 0; i < 20; i++ {
+		ks = append(ks, fmt.Sprintf("k%02d", i))
+	}
+	writeTestKeys(t, db, ks...)
+
+	repl := store.LookupReplica(roachpb.RKey("k00"))
+	_, pErr := repl.AdminSplit(ctx, kvpb.AdminSplitRequest{
+		RequestHeader: kvpb.RequestHeader{Key: roachpb.Key("k00")},
+	})
+	require.NoError(t, pErr.GoError())
+	rhs := store.LookupReplica(roachpb.RKey("k19"))
+	require.NotEqual(t, repl, rhs)
+	require.Equal(t, roachpb.RKey("k10"), rhs.Desc().StartKey)
+	requireStatsConsistent(t, repl)
+	requireStatsConsistent(t, rhs)
+}
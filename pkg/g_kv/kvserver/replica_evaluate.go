@@ -0,0 +1,75 @@
+package kvserver
+
+import (
+	"context"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/batcheval"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/batcheval/result"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/concurrency"
+	storage "github.com/dborchard/tiny_crdb/pkg/h_storage"
+)
+
+// evaluateBatch evaluates a batch request by splitting it up into its
+// individual commands, passing them to the corresponding command
+// implementations and merging their results. The batch's timestamp must
+// already be set; for transactional batches, it is the transaction's read
+// timestamp.
+//
+// The transaction is updated with the outcome of each command before the
+// next one is evaluated, so that, for instance, an EndTxn observes the
+// timestamp to which the batch's writes were pushed. The updated transaction
+// is returned in the response.
+//
+// The concurrency guard of the batch, if any, is handed to the commands, for
+// the requests that skip locked keys to consult the lock table.
+func evaluateBatch(
+	ctx context.Context,
+	readWriter storage.ReadWriter,
+	evalCtx batcheval.EvalContext,
+	ba *kvpb.BatchRequest,
+	g *concurrency.Guard,
+) (*kvpb.BatchResponse, result.Result, *kvpb.Error) {
+	h := ba.Header
+	if h.Txn != nil {
+		// Clone the transaction, since it is updated in place.
+		h.Txn = h.Txn.Clone()
+	}
+
+	br := &kvpb.BatchResponse{}
+	var mergedResult result.Result
+	for i, ru := range ba.Requests {
+		args := ru.GetInner()
+		if h.Txn != nil {
+			h.Txn.Sequence = args.Header().Sequence
+		}
+		cmd, ok := batcheval.LookupCommand(args.Method())
+		if !ok {
+			pErr := kvpb.NewErrorf("unrecognized command %s", args.Method())
+			pErr.SetErrorIndex(int32(i))
+			return nil, result.Result{}, pErr
+		}
+		reply := kvpb.CreateReply(args)
+		cArgs := batcheval.CommandArgs{EvalCtx: evalCtx, Header: h, Args: args, Concurrency: g}
+		var res result.Result
+		var err error
+		if cmd.EvalRW != nil {
+			res, err = cmd.EvalRW(ctx, readWriter, cArgs, reply)
+		} else {
+			res, err = cmd.EvalRO(ctx, readWriter, cArgs, reply)
+		}
+		if err != nil {
+			pErr := kvpb.NewErrorWithTxn(err, h.Txn)
+			pErr.SetErrorIndex(int32(i))
+			return nil, result.Result{}, pErr
+		}
+		if err := mergedResult.MergeAndDestroy(res); err != nil {
+			return nil, result.Result{}, kvpb.NewError(err)
+		}
+		if h.Txn != nil {
+			h.Txn.Update(reply.Header().Txn)
+		}
+		br.Add(reply)
+	}
+	br.Txn = h.Txn
+	return br, mergedResult, nil
+}
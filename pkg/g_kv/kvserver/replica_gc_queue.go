@@ -0,0 +1,70 @@
+package kvserver
+
+import (
+	"context"
+	kv "github.com/dborchard/tiny_crdb/pkg/g_kv"
+	raft "go.etcd.io/raft/v3"
+)
+
+// replicaGCQueue manages a queue of replicas which may have been removed from
+// their range without applying their removal. Once the removal is committed,
+// the leader stops replicating the range's log to a removed replica, which may
+// therefore never learn of it: it then campaigns in vain, as the range's other
+// replicas ignore it while they hear from their leader. A replica which knows
+// no leader looks up the descriptor of its range in the meta records, and is
+// destroyed if the range no longer includes it.
+type replicaGCQueue struct {
+	*baseQueue
+}
+
+// newReplicaGCQueue returns a new instance of replicaGCQueue.
+func newReplicaGCQueue(store *Store) *replicaGCQueue {
+	rgcq := &replicaGCQueue{}
+	rgcq.baseQueue = newBaseQueue("replicaGC", rgcq, store, queueConfig{})
+	return rgcq
+}
+
+// shouldQueue determines whether a replica should be checked for removal from
+// its range, which is the case if its Raft group knows no leader.
+func (rgcq *replicaGCQueue) shouldQueue(ctx context.Context, repl *Replica) (bool, float64) {
+	status := repl.RaftStatus()
+	if status == nil || status.Lead != raft.None {
+		return false, 0
+	}
+	return true, 1
+}
+
+// process destroys the replica if the range no longer includes it. Ranges
+// which were merged away are left to the application of the merge by the
+// replica of their left neighbour.
+func (rgcq *replicaGCQueue) process(ctx context.Context, repl *Replica) (bool, error) {
+	desc := repl.Desc()
+	descs, err := kv.RangeLookup(ctx, rgcq.store.DB().NonTransactionalSender(),
+		desc.StartKey.AsRawKey(), 0 /* prefetchNum */)
+	if err != nil {
+		return false, err
+	}
+	replyDesc := descs[0]
+	if replyDesc.RangeID != desc.RangeID {
+		return false, nil
+	}
+	if _, ok := replyDesc.GetReplicaDescriptor(rgcq.store.StoreID()); ok {
+		return false, nil
+	}
+	if repl.ReplicaID() >= replyDesc.NextReplicaID {
+		// The replica was added by a change which the meta records don't
+		// reflect yet.
+		return false, nil
+	}
+
+	repl.raftMu.Lock()
+	defer repl.raftMu.Unlock()
+	if repl.IsDestroyed() != nil {
+		// The replica applied its removal in the meantime.
+		return false, nil
+	}
+	if err := rgcq.store.removeReplicaAndClearData(ctx, repl, repl.Desc()); err != nil {
+		return false, err
+	}
+	return true, nil
+}
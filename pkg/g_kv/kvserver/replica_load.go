@@ -0,0 +1,137 @@
+package kvserver
+
+import (
+	"bytes"
+	keys "github.com/dborchard/tiny_crdb/pkg/g_keys"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// loadWindow is the duration over which the request rate of a replica is
+	// measured. The rate measured over the last full window is retained for
+	// the next one, so that a range which was busy is not considered idle
+	// as soon as a new window starts.
+	loadWindow = 10 * time.Second
+	// loadSampleSize is the number of request keys sampled by a replica, from
+	// which its load-based split key is picked.
+	loadSampleSize = 20
+)
+
+// replicaLoad tracks the rate of the requests served by a replica, and keeps
+// a uniform sample of the keys they address, using reservoir sampling. The
+// median of the sampled keys divides the load of the range in two halves,
+// and is used as a split key when the range receives too many requests.
+type replicaLoad struct {
+	clock *hlc.Clock
+
+	mu struct {
+		sync.Mutex
+		// windowStart is the wall time at which the current window started,
+		// and count the number of requests recorded since then.
+		windowStart int64
+		count       int64
+		// lastQPS is the rate measured over the last full window.
+		lastQPS float64
+		// samples holds the sampled keys; seen is the number of keys offered
+		// to the reservoir in the current window.
+		samples []roachpb.RKey
+		seen    int
+		rand    *rand.Rand
+	}
+}
+
+func newReplicaLoad(clock *hlc.Clock) *replicaLoad {
+	l := &replicaLoad{clock: clock}
+	l.mu.windowStart = clock.Now().WallTime
+	l.mu.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	return l
+}
+
+// recordLoad records a request against the replica's load. The batch must
+// address a valid span of the range, as checked by checkBatchRange.
+func (r *Replica) recordLoad(ba *kvpb.BatchRequest) {
+	rs, err := keys.Range(ba.Requests)
+	if err != nil {
+		return
+	}
+	r.load.record(rs.Key)
+}
+
+// record records a request addressing the key.
+func (l *replicaLoad) record(key roachpb.RKey) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.maybeRollLocked(l.clock.Now().WallTime)
+	l.mu.count++
+	l.mu.seen++
+	if len(l.mu.samples) < loadSampleSize {
+		l.mu.samples = append(l.mu.samples, key)
+	} else if i := l.mu.rand.Intn(l.mu.seen); i < loadSampleSize {
+		l.mu.samples[i] = key
+	}
+}
+
+// maybeRollLocked starts a new window if the current one is over.
+func (l *replicaLoad) maybeRollLocked(now int64) {
+	elapsed := time.Duration(now - l.mu.windowStart)
+	if elapsed < loadWindow {
+		return
+	}
+	l.mu.lastQPS = float64(l.mu.count) / elapsed.Seconds()
+	l.mu.windowStart = now
+	l.mu.count = 0
+	l.mu.seen = 0
+	l.mu.samples = l.mu.samples[:0]
+}
+
+// QPS returns the request rate of the replica: the larger of the rate over
+// the last full window, and the rate over the current window, which is
+// measured over at least a second.
+func (l *replicaLoad) QPS() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.clock.Now().WallTime
+	l.maybeRollLocked(now)
+	elapsed := time.Duration(now - l.mu.windowStart)
+	if elapsed < time.Second {
+		elapsed = time.Second
+	}
+	qps := float64(l.mu.count) / elapsed.Seconds()
+	if l.mu.lastQPS > qps {
+		return l.mu.lastQPS
+	}
+	return qps
+}
+
+// splitKey returns the median of the sampled keys, or nil if too few keys
+// were sampled to pick a key which divides the load of the range.
+func (l *replicaLoad) splitKey() roachpb.RKey {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.mu.samples) < loadSampleSize {
+		return nil
+	}
+	samples := append([]roachpb.RKey(nil), l.mu.samples...)
+	sort.Slice(samples, func(i, j int) bool {
+		return bytes.Compare(samples[i], samples[j]) < 0
+	})
+	return samples[len(samples)/2]
+}
+
+// reset discards the recorded load, such as after the range was split or
+// merged and the recorded load no longer reflects that of the range.
+func (l *replicaLoad) reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.mu.windowStart = l.clock.Now().WallTime
+	l.mu.count = 0
+	l.mu.lastQPS = 0
+	l.mu.seen = 0
+	l.mu.samples = l.mu.samples[:0]
+}
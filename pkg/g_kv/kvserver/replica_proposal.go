@@ -0,0 +1,68 @@
+package kvserver
+
+import (
+	"fmt"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/kvserverpb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/protoutil"
+	"math/rand"
+)
+
+// raftCommandIDLen is the length of the ID which prefixes the encoded
+// commands in the Raft log.
+const raftCommandIDLen = 8
+
+// cmdIDKey identifies a command proposed to Raft, so that the proposer
+// recognizes it when it applies.
+type cmdIDKey string
+
+// makeIDKey returns a random cmdIDKey.
+func makeIDKey() cmdIDKey {
+	idKeyBuf := make([]byte, raftCommandIDLen)
+	_, _ = rand.Read(idKeyBuf)
+	return cmdIDKey(idKeyBuf)
+}
+
+// encodeRaftCommand encodes the command as the data of a Raft log entry,
+// prefixed by its ID.
+func encodeRaftCommand(idKey cmdIDKey, cmd *kvserverpb.RaftCommand) ([]byte, error) {
+	data, err := protoutil.Marshal(cmd)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(idKey), data...), nil
+}
+
+// decodeRaftCommand decodes the data of a Raft log entry, encoded by
+// encodeRaftCommand.
+func decodeRaftCommand(data []byte) (cmdIDKey, *kvserverpb.RaftCommand, error) {
+	if len(data) < raftCommandIDLen {
+		return "", nil, fmt.Errorf("invalid raft command of length %d", len(data))
+	}
+	cmd := &kvserverpb.RaftCommand{}
+	if err := protoutil.Unmarshal(data[raftCommandIDLen:], cmd); err != nil {
+		return "", nil, err
+	}
+	return cmdIDKey(data[:raftCommandIDLen]), cmd, nil
+}
+
+// proposal is a command proposed to Raft by the replica, whose proposer waits
+// for it to apply.
+type proposal struct {
+	idKey   cmdIDKey
+	command *kvserverpb.RaftCommand
+	// encodedCommand is the command encoded by encodeRaftCommand, as the
+	// data of its entry.
+	encodedCommand []byte
+	// index is the index of the command's entry in the Raft log, once the
+	// proposal has been handed to the Raft group.
+	index uint64
+	// doneCh receives the outcome of the proposal: nil once the command has
+	// applied, or an error if it will never apply.
+	doneCh chan error
+}
+
+// finish signals the outcome of the proposal to its proposer. It must be
+// called at most once.
+func (p *proposal) finish(err error) {
+	p.doneCh <- err
+}
@@ -0,0 +1,668 @@
+package kvserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/kvserverpb"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/stop"
+	raft "go.etcd.io/raft/v3"
+	"go.etcd.io/raft/v3/raftpb"
+	"io"
+	"log"
+	"time"
+)
+
+const (
+	// raftMaxSizePerMsg is the maximum size of the entries sent in a MsgApp.
+	raftMaxSizePerMsg = 32 << 10
+	// raftMaxInflightMsgs is the maximum number of MsgApps sent to a
+	// follower which it has yet to acknowledge.
+	raftMaxInflightMsgs = 128
+)
+
+// raftLogger discards the logs of the replicas' Raft groups. The groups
+// still panic when they reach a state they cannot recover from.
+var raftLogger = &raft.DefaultLogger{Logger: log.New(io.Discard, "", 0)}
+
+// initRaftGroupLocked creates the RawNode of the replica, from the Raft
+// state persisted on the store's engine. r.mu must be held.
+//
+// Only the leader of the range proposes commands: the proposals of a
+// follower are dropped, rather than forwarded to the leader, and the
+// proposer redirects its request to the leader instead.
+func (r *Replica) initRaftGroupLocked() error {
+	rn, err := raft.NewRawNode(&raft.Config{
+		ID:                        uint64(r.mu.replicaID),
+		ElectionTick:              r.store.cfg.RaftElectionTimeoutTicks,
+		HeartbeatTick:             r.store.cfg.RaftHeartbeatIntervalTicks,
+		Storage:                   (*replicaRaftStorage)(r),
+		Applied:                   r.mu.state.RaftAppliedIndex,
+		MaxSizePerMsg:             raftMaxSizePerMsg,
+		MaxInflightMsgs:           raftMaxInflightMsgs,
+		CheckQuorum:               true,
+		DisableProposalForwarding: true,
+		Logger:                    raftLogger,
+	})
+	if err != nil {
+		return err
+	}
+	r.mu.internalRaftGroup = rn
+	return nil
+}
+
+// raftLoop drives the replica's Raft group: it ticks the group at the
+// store's tick interval, and processes its Readys whenever the group was
+// stepped or a command was proposed. It runs until the replica is destroyed
+// or the stopper quiesces, at which point the in-flight proposals are
+// abandoned.
+func (r *Replica) raftLoop(ctx context.Context) {
+	ticker := time.NewTicker(r.store.cfg.RaftTickInterval)
+	defer ticker.Stop()
+	defer r.abandonProposals()
+	for {
+		select {
+		case <-ticker.C:
+			r.tick()
+		case <-r.raftReady:
+		case <-r.store.Stopper().ShouldQuiesce():
+			return
+		case <-ctx.Done():
+			return
+		}
+		if err := r.handleRaftReady(ctx); err != nil {
+			select {
+			case <-r.store.Stopper().ShouldQuiesce():
+				return
+			case <-ctx.Done():
+				return
+			default:
+			}
+			// The replica cannot make progress without diverging from the
+			// other replicas of the range.
+			panic(fmt.Sprintf("r%d: unable to handle raft ready: %v", r.RangeID, err))
+		}
+	}
+}
+
+// signalRaftReady wakes up the raft loop of the replica, to process the
+// Ready of its Raft group.
+func (r *Replica) signalRaftReady() {
+	select {
+	case r.raftReady <- struct{}{}:
+	default:
+	}
+}
+
+// tick ticks the replica's Raft group. A leader which does not hold the
+// range's lease transfers its leadership to the leaseholder.
+func (r *Replica) tick() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.mu.destroyed {
+		return
+	}
+	r.maybeTransferRaftLeadershipLocked()
+	r.mu.internalRaftGroup.Tick()
+}
+
+// campaign makes the replica campaign for the leadership of its range.
+func (r *Replica) campaign() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.mu.destroyed {
+		return
+	}
+	_ = r.mu.internalRaftGroup.Campaign()
+	r.signalRaftReady()
+}
+
+// isSoleVoter returns whether the replica is the only voter of its range.
+func (r *Replica) isSoleVoter() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	cs := confStateFromDesc(r.mu.desc)
+	return len(cs.Voters) == 1 && len(cs.VotersOutgoing) == 0 &&
+		cs.Voters[0] == uint64(r.mu.replicaID)
+}
+
+// isRaftLeader returns whether the replica is the leader of its range.
+func (r *Replica) isRaftLeader() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return !r.mu.destroyed && r.mu.internalRaftGroup.Status().RaftState == raft.StateLeader
+}
+
+// RaftStatus returns the current status of the replica's Raft group, or nil
+// if the replica was destroyed.
+func (r *Replica) RaftStatus() *raft.Status {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.mu.destroyed {
+		return nil
+	}
+	status := r.mu.internalRaftGroup.Status()
+	return &status
+}
+
+// isLeaderReady returns whether the replica is the leader of its range and
+// able to serve requests.
+func (r *Replica) isLeaderReady() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.mu.leaderReady
+}
+
+// isLeaseholderReady returns whether the replica holds the range's valid
+// lease and leads the range, which makes it able to serve all the requests
+// addressed to the range.
+func (r *Replica) isLeaseholderReady() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if !r.mu.leaderReady {
+		return false
+	}
+	st := r.leaseStatusAtRLocked(r.Clock().NowAsClockTimestamp(), hlc.Timestamp{})
+	return st.IsValid() && st.OwnedBy(r.store.StoreID())
+}
+
+// redirectOnOrWaitForLeader returns a NotLeaderError, carrying the leader of
+// the range if it is known, unless the replica is the leader of its range
+// and has applied the entries of its predecessors, which makes it able to
+// serve requests.
+//
+// While the replica is the leader but not yet ready, or while no leader is
+// known, it waits for up to an election timeout for the situation to
+// resolve: a range's replicas have no leader right after they start.
+func (r *Replica) redirectOnOrWaitForLeader(ctx context.Context) error {
+	electionTimeout := time.Duration(r.store.cfg.RaftElectionTimeoutTicks) * r.store.cfg.RaftTickInterval
+	deadline := time.Now().Add(electionTimeout)
+	for {
+		r.mu.RLock()
+		ready, destroyed := r.mu.leaderReady, r.mu.destroyed
+		lead := r.mu.internalRaftGroup.Status().Lead
+		var nle *kvpb.NotLeaderError
+		if !ready && !destroyed {
+			nle = r.newNotLeaderErrorRLocked()
+		}
+		r.mu.RUnlock()
+		switch {
+		case ready:
+			return nil
+		case destroyed:
+			return kvpb.NewRangeNotFoundError(r.RangeID, r.store.StoreID())
+		case nle.Leader != nil, lead != raft.None && lead != uint64(nle.Replica.ReplicaID):
+			// Another replica leads the range.
+			return nle
+		case time.Now().After(deadline):
+			return nle
+		}
+		select {
+		case <-time.After(time.Millisecond):
+		case <-r.store.Stopper().ShouldQuiesce():
+			return stop.ErrUnavailable
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// newNotLeaderErrorRLocked returns a NotLeaderError for the replica. r.mu
+// must be held, at least for reading.
+func (r *Replica) newNotLeaderErrorRLocked() *kvpb.NotLeaderError {
+	replica := roachpb.ReplicaDescriptor{
+		NodeID:    r.store.NodeID(),
+		StoreID:   r.store.StoreID(),
+		ReplicaID: r.mu.replicaID,
+	}
+	var leader *roachpb.ReplicaDescriptor
+	if lead := r.mu.internalRaftGroup.Status().Lead; lead != raft.None && lead != uint64(r.mu.replicaID) {
+		if rd, ok := r.mu.desc.GetReplicaDescriptorByID(roachpb.ReplicaID(lead)); ok {
+			leader = &rd
+		}
+	}
+	return kvpb.NewNotLeaderError(replica, leader, r.RangeID)
+}
+
+// propose proposes the command to the range's Raft group. The returned
+// proposal is finished once the command has applied on the replica, or once
+// it is known that it will never apply.
+//
+// The proposal is buffered until the replica processes the Ready of its Raft
+// group, which is when it is handed to the group: the index of its entry is
+// then known from the entries of the Ready. The buffered proposals are
+// handed to the group in order, so that the timestamps closed by their
+// commands increase along the log.
+//
+// A command proposed by the leaseholder of the range carries the timestamp
+// closed by the leaseholder, which it forwards first.
+func (r *Replica) propose(cmd *kvserverpb.RaftCommand) (*proposal, error) {
+	p := &proposal{
+		idKey:   makeIDKey(),
+		command: cmd,
+		doneCh:  make(chan error, 1),
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.mu.destroyed {
+		return nil, kvpb.NewRangeNotFoundError(r.RangeID, r.store.StoreID())
+	}
+	now := r.Clock().NowAsClockTimestamp()
+	if r.closeTimestampLocked(now, r.closedTimestampTarget(now)) {
+		closed := r.mu.assignedClosedTimestamp
+		cmd.ClosedTimestamp = &closed
+	}
+	var err error
+	if p.encodedCommand, err = encodeRaftCommand(p.idKey, cmd); err != nil {
+		return nil, err
+	}
+	r.mu.proposalBuf = append(r.mu.proposalBuf, p)
+	r.signalRaftReady()
+	return p, nil
+}
+
+// flushProposalsLocked hands the buffered proposals to the replica's Raft
+// group. A command carrying a ChangeReplicasTrigger is proposed as a
+// configuration change, towards the configuration of the trigger's
+// descriptor. The proposals dropped by the group, because the replica is not
+// the leader or is transferring its leadership, are finished with a
+// NotLeaderError.
+//
+// It returns the proposals accepted by the group, whose entries are among
+// those of its next Ready. r.mu must be held.
+func (r *Replica) flushProposalsLocked() []*proposal {
+	var flushed []*proposal
+	for _, p := range r.mu.proposalBuf {
+		var err error
+		if crt := p.command.ReplicatedEvalResult.ChangeReplicas; crt != nil {
+			cc := confChangeFromDesc(crt.Desc)
+			cc.Context = p.encodedCommand
+			err = r.mu.internalRaftGroup.ProposeConfChange(cc)
+		} else {
+			err = r.mu.internalRaftGroup.Propose(p.encodedCommand)
+		}
+		if errors.Is(err, raft.ErrProposalDropped) {
+			p.finish(r.newNotLeaderErrorRLocked())
+			continue
+		} else if err != nil {
+			p.finish(err)
+			continue
+		}
+		r.mu.proposals[p.idKey] = p
+		flushed = append(flushed, p)
+	}
+	r.mu.proposalBuf = nil
+	return flushed
+}
+
+// assignProposalIndexesLocked records the index of the entries of the
+// proposals just accepted by the replica's Raft group, from the entries of
+// its Ready. The leader turns a configuration change into an empty entry if
+// another one is in progress: the proposals without an entry are finished
+// with an error. r.mu must be held.
+func (r *Replica) assignProposalIndexesLocked(ents []raftpb.Entry, flushed []*proposal) {
+	if len(flushed) == 0 {
+		return
+	}
+	for _, ent := range ents {
+		data := ent.Data
+		if ent.Type == raftpb.EntryConfChangeV2 {
+			var cc raftpb.ConfChangeV2
+			if err := cc.Unmarshal(ent.Data); err != nil {
+				continue
+			}
+			data = cc.Context
+		}
+		if len(data) < raftCommandIDLen {
+			continue
+		}
+		if p, ok := r.mu.proposals[cmdIDKey(data[:raftCommandIDLen])]; ok && p.index == 0 {
+			p.index = ent.Index
+			if p.index > r.mu.maxProposalIndex {
+				r.mu.maxProposalIndex = p.index
+			}
+		}
+	}
+	for _, p := range flushed {
+		if p.index == 0 {
+			delete(r.mu.proposals, p.idKey)
+			p.finish(fmt.Errorf("r%d: %w: configuration change in progress",
+				r.RangeID, raft.ErrProposalDropped))
+		}
+	}
+}
+
+// waitForProposal waits for the outcome of the proposal. If the context is
+// canceled or the stopper quiesces first, the proposal is abandoned and an
+// AmbiguousResultError is returned: the command may still apply.
+func (r *Replica) waitForProposal(ctx context.Context, p *proposal) error {
+	var err error
+	select {
+	case err := <-p.doneCh:
+		return err
+	case <-r.store.Stopper().ShouldQuiesce():
+		err = stop.ErrUnavailable
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	r.mu.Lock()
+	delete(r.mu.proposals, p.idKey)
+	r.mu.Unlock()
+	return kvpb.NewAmbiguousResultError(err)
+}
+
+// sendProbe proposes an empty command through Raft and waits for it to
+// apply. It is the probe of the replica's circuit breaker: a replica which
+// is not the leader of its range has nothing to replicate and is deemed
+// available, as requests are redirected to the leader.
+func (r *Replica) sendProbe(ctx context.Context) error {
+	p, err := r.propose(&kvserverpb.RaftCommand{})
+	if err != nil {
+		return err
+	}
+	err = r.waitForProposal(ctx, p)
+	var nle *kvpb.NotLeaderError
+	if errors.As(err, &nle) {
+		return nil
+	}
+	return err
+}
+
+// waitForReplicasToCatchUp waits for all the voters of the range to hold the
+// entries which the replica, the leader of the range, has applied, and to
+// know them committed. They can then apply them without the help of the
+// leader. It returns the applied index of the leader.
+//
+// To that end, an empty command is proposed once the entries have applied:
+// the messages which replicate it to a voter carry a commit index at least
+// as high as the index of the entries.
+func (r *Replica) waitForReplicasToCatchUp(ctx context.Context) (uint64, error) {
+	r.mu.RLock()
+	applied := r.mu.state.RaftAppliedIndex
+	r.mu.RUnlock()
+	p, err := r.propose(&kvserverpb.RaftCommand{})
+	if err != nil {
+		return 0, err
+	}
+	if err := r.waitForProposal(ctx, p); err != nil {
+		return 0, err
+	}
+	for {
+		caughtUp, err := r.replicasCaughtUp(p.index)
+		if err != nil {
+			return 0, err
+		}
+		if caughtUp {
+			return applied, nil
+		}
+		select {
+		case <-time.After(time.Millisecond):
+		case <-r.store.Stopper().ShouldQuiesce():
+			return 0, stop.ErrUnavailable
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+}
+
+// replicasCaughtUp returns whether all the voters of the range hold the log
+// up to the index, as known by the replica, which must be the leader of the
+// range.
+func (r *Replica) replicasCaughtUp(index uint64) (bool, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.mu.destroyed {
+		return false, kvpb.NewRangeNotFoundError(r.RangeID, r.store.StoreID())
+	}
+	status := r.mu.internalRaftGroup.Status()
+	if status.RaftState != raft.StateLeader {
+		return false, r.newNotLeaderErrorRLocked()
+	}
+	for _, id := range confStateFromDesc(r.mu.desc).Voters {
+		if pr, ok := status.Progress[id]; !ok || pr.Match < index {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// abandonProposals finishes the in-flight proposals with an
+// AmbiguousResultError, once the replica stops processing its Raft group.
+// The buffered proposals are finished with an error: they will not apply.
+func (r *Replica) abandonProposals() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := fmt.Errorf("r%d: replica stopped processing raft commands", r.RangeID)
+	for idKey, p := range r.mu.proposals {
+		p.finish(kvpb.NewAmbiguousResultError(err))
+		delete(r.mu.proposals, idKey)
+	}
+	for _, p := range r.mu.proposalBuf {
+		p.finish(err)
+	}
+	r.mu.proposalBuf = nil
+}
+
+// stepRaftMessage steps the replica's Raft group with a message received
+// from another replica of the range.
+func (r *Replica) stepRaftMessage(req *kvserverpb.RaftMessageRequest) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.mu.destroyed {
+		return kvpb.NewRangeNotFoundError(r.RangeID, r.store.StoreID())
+	}
+	if req.ToReplica.ReplicaID != r.mu.replicaID {
+		return fmt.Errorf("r%d: message addressed to replica %d, found replica %d",
+			r.RangeID, req.ToReplica.ReplicaID, r.mu.replicaID)
+	}
+	err := r.mu.internalRaftGroup.Step(req.Message)
+	r.signalRaftReady()
+	return err
+}
+
+// sendRaftMessages sends the messages of the replica's Raft group to the
+// other replicas of the range, through the store's RaftTransport. Messages
+// to replicas which are not part of the range's descriptor are dropped. The
+// snapshots requested by the Raft group, through MsgSnaps, are streamed to
+// their recipient asynchronously.
+func (r *Replica) sendRaftMessages(msgs []raftpb.Message) {
+	transport := r.store.cfg.Transport
+	if transport == nil {
+		return
+	}
+	r.mu.RLock()
+	desc := r.mu.desc
+	from := roachpb.ReplicaDescriptor{
+		NodeID:    r.store.NodeID(),
+		StoreID:   r.store.StoreID(),
+		ReplicaID: r.mu.replicaID,
+	}
+	r.mu.RUnlock()
+	for _, m := range msgs {
+		to, ok := desc.GetReplicaDescriptorByID(roachpb.ReplicaID(m.To))
+		if !ok {
+			continue
+		}
+		if m.Type == raftpb.MsgSnap {
+			r.sendRaftSnapshot(to)
+			continue
+		}
+		transport.SendAsync(&kvserverpb.RaftMessageRequest{
+			RangeID:     r.RangeID,
+			FromReplica: from,
+			ToReplica:   to,
+			Message:     m,
+		})
+	}
+}
+
+// sendRaftSnapshot streams a snapshot of the replica to the recipient, which
+// needs entries truncated from the log of the replica, the leader of the
+// range. The outcome is reported to the Raft group, which doesn't send
+// entries to the recipient in the meantime.
+func (r *Replica) sendRaftSnapshot(to roachpb.ReplicaDescriptor) {
+	ctx := context.Background()
+	if err := r.store.Stopper().RunAsyncTask(ctx, "replica: sending raft snapshot", func(ctx context.Context) {
+		ctx, cancel := r.store.Stopper().WithCancelOnQuiesce(ctx)
+		defer cancel()
+		status := raft.SnapshotFinish
+		if err := r.sendSnapshot(ctx, to, kvserverpb.SnapshotRequest_RAFT); err != nil {
+			status = raft.SnapshotFailure
+		}
+		r.reportSnapshotStatus(to.ReplicaID, status)
+	}); err != nil {
+		r.reportSnapshotStatus(to.ReplicaID, raft.SnapshotFailure)
+	}
+}
+
+// reportSnapshotStatus reports the outcome of the snapshot sent to the
+// replica to the Raft group.
+func (r *Replica) reportSnapshotStatus(to roachpb.ReplicaID, status raft.SnapshotStatus) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.mu.destroyed {
+		return
+	}
+	r.mu.internalRaftGroup.ReportSnapshot(uint64(to), status)
+	r.signalRaftReady()
+}
+
+// stepSnapshot steps the replica's Raft group with the MsgSnap of the
+// snapshot received by the store, and applies the snapshot if the group
+// restores it: the snapshot is ignored if the replica's log already holds
+// its entries.
+func (r *Replica) stepSnapshot(
+	ctx context.Context, req *kvserverpb.RaftMessageRequest, inSnap incomingSnapshot,
+) error {
+	r.raftMu.Lock()
+	defer r.raftMu.Unlock()
+	if err := r.stepRaftMessage(req); err != nil {
+		return err
+	}
+	return r.handleRaftReadyRaftMuLocked(ctx, inSnap)
+}
+
+// handleRaftReady processes the Ready of the replica's Raft group, if any:
+// the new log entries and HardState are persisted, the messages are sent,
+// and the committed entries are applied to the state machine. The buffered
+// proposals are handed to the group first.
+func (r *Replica) handleRaftReady(ctx context.Context) error {
+	r.raftMu.Lock()
+	defer r.raftMu.Unlock()
+	return r.handleRaftReadyRaftMuLocked(ctx, incomingSnapshot{})
+}
+
+// handleRaftReadyRaftMuLocked is like handleRaftReady, with r.raftMu held. If
+// the Ready carries a snapshot, which the Raft group restores once it is
+// stepped with a MsgSnap, inSnap holds its data and the snapshot is applied
+// before the log entries are persisted.
+func (r *Replica) handleRaftReadyRaftMuLocked(ctx context.Context, inSnap incomingSnapshot) error {
+	r.mu.Lock()
+	if r.mu.destroyed {
+		r.mu.Unlock()
+		return nil
+	}
+	flushed := r.flushProposalsLocked()
+	if !r.mu.internalRaftGroup.HasReady() {
+		// The replica may still have stepped down.
+		r.maybeSetLeaderReadyLocked()
+		r.mu.Unlock()
+		return nil
+	}
+	rd := r.mu.internalRaftGroup.Ready()
+	r.assignProposalIndexesLocked(rd.Entries, flushed)
+	lastIndex := r.mu.lastIndex
+	r.mu.Unlock()
+
+	if rd.SoftState != nil && rd.SoftState.RaftState == raft.StateCandidate {
+		// The replica may have been removed from its range without learning
+		// of it, in which case it campaigns without end.
+		r.store.replicaGCQueue.maybeProcessAsync(ctx, r)
+	}
+	if !raft.IsEmptySnap(rd.Snapshot) {
+		if inSnap.Desc == nil {
+			return fmt.Errorf("r%d: raft snapshot at index %d received without its data",
+				r.RangeID, rd.Snapshot.Metadata.Index)
+		}
+		if err := r.applySnapshot(ctx, inSnap, rd.Snapshot); err != nil {
+			return err
+		}
+		lastIndex = rd.Snapshot.Metadata.Index
+	}
+	if len(rd.Entries) > 0 || !raft.IsEmptyHardState(rd.HardState) {
+		var err error
+		if lastIndex, err = r.persistRaftState(ctx, rd, lastIndex); err != nil {
+			return err
+		}
+		r.mu.Lock()
+		r.mu.lastIndex = lastIndex
+		r.mu.Unlock()
+	}
+	r.sendRaftMessages(rd.Messages)
+
+	for _, ent := range rd.CommittedEntries {
+		if err := r.applyEntry(ctx, ent); err != nil {
+			return err
+		}
+		if r.IsDestroyed() != nil {
+			// The replica was removed from its range.
+			return nil
+		}
+	}
+
+	r.mu.Lock()
+	r.mu.internalRaftGroup.Advance(rd)
+	r.maybeSetLeaderReadyLocked()
+	if r.mu.internalRaftGroup.HasReady() {
+		// The entries just persisted may have been committed once the
+		// replica acknowledged them to itself, on advancing.
+		r.signalRaftReady()
+	}
+	r.mu.Unlock()
+	return nil
+}
+
+// maybeSetLeaderReadyLocked updates whether the replica is a leader able to
+// propose commands, which requires it to have applied the entries of the
+// previous terms. r.mu must be held.
+func (r *Replica) maybeSetLeaderReadyLocked() {
+	status := r.mu.internalRaftGroup.Status()
+	r.mu.leaderReady = status.RaftState == raft.StateLeader && r.mu.state.RaftAppliedIndexTerm == status.Term
+}
+
+// persistRaftState persists the entries and the HardState of the Ready. The
+// entries which follow the new ones in the persisted log, and which they
+// therefore replace, are removed. It returns the new last index of the log.
+func (r *Replica) persistRaftState(
+	ctx context.Context, rd raft.Ready, lastIndex uint64,
+) (uint64, error) {
+	batch := r.store.Engine().NewBatch()
+	defer batch.Close()
+	if n := len(rd.Entries); n > 0 {
+		for _, ent := range rd.Entries {
+			if err := r.stateLoader.SetRaftLogEntry(ctx, batch, ent); err != nil {
+				return 0, err
+			}
+		}
+		newLastIndex := rd.Entries[n-1].Index
+		for i := newLastIndex + 1; i <= lastIndex; i++ {
+			if err := r.stateLoader.ClearRaftLogEntry(batch, i); err != nil {
+				return 0, err
+			}
+		}
+		lastIndex = newLastIndex
+	}
+	if !raft.IsEmptyHardState(rd.HardState) {
+		if err := r.stateLoader.SetHardState(ctx, batch, rd.HardState); err != nil {
+			return 0, err
+		}
+	}
+	if err := batch.Commit(true /* sync */); err != nil {
+		return 0, err
+	}
+	return lastIndex, nil
+}
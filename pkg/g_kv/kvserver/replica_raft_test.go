@@ -0,0 +1,124 @@
+package kvserver
+
+import (
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/kvserverpb"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/stretchr/testify/require"
+	raft "go.etcd.io/raft/v3"
+	"go.etcd.io/raft/v3/raftpb"
+	"testing"
+)
+
+// newTestRaftReplica returns a replica whose Raft group is the only voter of
+// its range, with its log in memory, along with a function which processes
+// the Readys of the group until it has none.
+func newTestRaftReplica(t *testing.T) (*Replica, func()) {
+	storage := raft.NewMemoryStorage()
+	require.NoError(t, storage.ApplySnapshot(raftpb.Snapshot{
+		Metadata: raftpb.SnapshotMetadata{
+			ConfState: raftpb.ConfState{Voters: []uint64{1}},
+			Index:     1,
+			Term:      1,
+		},
+	}))
+	rn, err := raft.NewRawNode(&raft.Config{
+		ID:                        1,
+		ElectionTick:              10,
+		HeartbeatTick:             1,
+		Storage:                   storage,
+		MaxSizePerMsg:             raftMaxSizePerMsg,
+		MaxInflightMsgs:           raftMaxInflightMsgs,
+		DisableProposalForwarding: true,
+		Logger:                    raftLogger,
+	})
+	require.NoError(t, err)
+
+	r := &Replica{RangeID: 1, store: &Store{nodeID: 1, storeID: 1}}
+	r.mu.desc = &roachpb.RangeDescriptor{
+		RangeID: 1,
+		InternalReplicas: []roachpb.ReplicaDescriptor{
+			{NodeID: 1, StoreID: 1, ReplicaID: 1, Type: roachpb.VOTER_FULL},
+		},
+	}
+	r.mu.replicaID = 1
+	r.mu.proposals = make(map[cmdIDKey]*proposal)
+	r.mu.internalRaftGroup = rn
+	drain := func() {
+		for rn.HasReady() {
+			rd := rn.Ready()
+			require.NoError(t, storage.Append(rd.Entries))
+			if !raft.IsEmptyHardState(rd.HardState) {
+				require.NoError(t, storage.SetHardState(rd.HardState))
+			}
+			rn.Advance(rd)
+		}
+	}
+	return r, drain
+}
+
+// newTestProposal returns a proposal of the command, as buffered by propose.
+func newTestProposal(t *testing.T, cmd *kvserverpb.RaftCommand) *proposal {
+	p := &proposal{idKey: makeIDKey(), command: cmd, doneCh: make(chan error, 1)}
+	var err error
+	p.encodedCommand, err = encodeRaftCommand(p.idKey, cmd)
+	require.NoError(t, err)
+	return p
+}
+
+// TestReplicaFlushProposals verifies that the buffered proposals handed to
+// the Raft group are assigned the index of their entries, that a
+// configuration change proposed while another one is in progress is refused,
+// and that the proposals of a replica which doesn't lead its range are
+// finished with a NotLeaderError.
+func TestReplicaFlushProposals(t *testing.T) {
+	r, drain := newTestRaftReplica(t)
+
+	// The replica is not the leader yet.
+	follower := newTestProposal(t, &kvserverpb.RaftCommand{})
+	r.mu.proposalBuf = []*proposal{follower}
+	require.Empty(t, r.flushProposalsLocked())
+	require.Empty(t, r.mu.proposalBuf)
+	require.IsType(t, &kvpb.NotLeaderError{}, <-follower.doneCh)
+
+	require.NoError(t, r.mu.internalRaftGroup.Campaign())
+	drain()
+	require.Equal(t, raft.StateLeader, r.mu.internalRaftGroup.Status().RaftState)
+
+	// The range adds a second voter, through a joint configuration.
+	desc := *r.mu.desc
+	desc.InternalReplicas = append(desc.InternalReplicas, roachpb.ReplicaDescriptor{
+		NodeID: 2, StoreID: 2, ReplicaID: 2, Type: roachpb.VOTER_INCOMING,
+	})
+	changeReplicas := &kvserverpb.RaftCommand{
+		ReplicatedEvalResult: kvserverpb.ReplicatedEvalResult{
+			ChangeReplicas: &roachpb.ChangeReplicasTrigger{Desc: &desc},
+		},
+	}
+	write := newTestProposal(t, &kvserverpb.RaftCommand{})
+	change := newTestProposal(t, changeReplicas)
+	otherChange := newTestProposal(t, changeReplicas)
+	r.mu.proposalBuf = []*proposal{write, change, otherChange}
+
+	flushed := r.flushProposalsLocked()
+	require.Equal(t, []*proposal{write, change, otherChange}, flushed)
+	rd := r.mu.internalRaftGroup.Ready()
+	r.assignProposalIndexesLocked(rd.Entries, flushed)
+
+	require.Len(t, rd.Entries, 3)
+	require.Equal(t, rd.Entries[0].Index, write.index)
+	require.Equal(t, rd.Entries[1].Index, change.index)
+	require.Equal(t, raftpb.EntryConfChangeV2, rd.Entries[1].Type)
+	var cc raftpb.ConfChangeV2
+	require.NoError(t, cc.Unmarshal(rd.Entries[1].Data))
+	require.Equal(t, raftpb.ConfChangeTransitionJointExplicit, cc.Transition)
+	require.Equal(t, change.encodedCommand, cc.Context)
+	// The leader turned the other change into an empty entry.
+	require.Equal(t, raftpb.EntryNormal, rd.Entries[2].Type)
+	require.Empty(t, rd.Entries[2].Data)
+	require.Zero(t, otherChange.index)
+	require.ErrorIs(t, <-otherChange.doneCh, raft.ErrProposalDropped)
+
+	require.Len(t, r.mu.proposals, 2)
+	require.Equal(t, change.index, r.mu.maxProposalIndex)
+}
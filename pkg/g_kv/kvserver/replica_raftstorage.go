@@ -0,0 +1,201 @@
+package kvserver
+
+import (
+	"context"
+	"fmt"
+	keys "github.com/dborchard/tiny_crdb/pkg/g_keys"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/kvserverpb"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	raft "go.etcd.io/raft/v3"
+	"go.etcd.io/raft/v3/raftpb"
+	"math"
+)
+
+// replicaRaftStorage implements the raft.Storage interface over the store's
+// engine. The methods are called by the replica's RawNode, with r.mu held:
+// they read the HardState and the log entries persisted by handleRaftReady,
+// and the bounds of the log cached in r.mu.
+type replicaRaftStorage Replica
+
+var _ raft.Storage = (*replicaRaftStorage)(nil)
+
+// InitialState implements the raft.Storage interface. The ConfState is
+// derived from the range descriptor.
+func (r *replicaRaftStorage) InitialState() (raftpb.HardState, raftpb.ConfState, error) {
+	hs, err := r.stateLoader.LoadHardState(context.Background(), r.store.Engine())
+	if err != nil {
+		return raftpb.HardState{}, raftpb.ConfState{}, err
+	}
+	return hs, confStateFromDesc(r.mu.desc), nil
+}
+
+// Entries implements the raft.Storage interface. The entries are limited to
+// maxSize bytes, but the first one is returned regardless of its size.
+func (r *replicaRaftStorage) Entries(lo, hi, maxSize uint64) ([]raftpb.Entry, error) {
+	if lo <= r.mu.truncatedState.Index {
+		return nil, raft.ErrCompacted
+	}
+	if hi > r.mu.lastIndex+1 {
+		return nil, raft.ErrUnavailable
+	}
+	ents := make([]raftpb.Entry, 0, hi-lo)
+	var size uint64
+	for i := lo; i < hi; i++ {
+		ent, ok, err := r.stateLoader.LoadRaftLogEntry(context.Background(), r.store.Engine(), i)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, fmt.Errorf("r%d: raft log entry %d not found", r.RangeID, i)
+		}
+		if size += uint64(ent.Size()); len(ents) > 0 && size > maxSize {
+			break
+		}
+		ents = append(ents, ent)
+	}
+	return ents, nil
+}
+
+// Term implements the raft.Storage interface.
+func (r *replicaRaftStorage) Term(i uint64) (uint64, error) {
+	switch {
+	case i == r.mu.truncatedState.Index:
+		return r.mu.truncatedState.Term, nil
+	case i < r.mu.truncatedState.Index:
+		return 0, raft.ErrCompacted
+	case i > r.mu.lastIndex:
+		return 0, raft.ErrUnavailable
+	}
+	ents, err := r.Entries(i, i+1, math.MaxUint64)
+	if err != nil {
+		return 0, err
+	}
+	return ents[0].Term, nil
+}
+
+// LastIndex implements the raft.Storage interface.
+func (r *replicaRaftStorage) LastIndex() (uint64, error) {
+	return r.mu.lastIndex, nil
+}
+
+// FirstIndex implements the raft.Storage interface.
+func (r *replicaRaftStorage) FirstIndex() (uint64, error) {
+	return r.mu.truncatedState.Index + 1, nil
+}
+
+// Snapshot implements the raft.Storage interface. Only the metadata of the
+// snapshot is returned: its data is streamed to the follower by
+// sendRaftSnapshot, from a snapshot of the engine taken at that point.
+func (r *replicaRaftStorage) Snapshot() (raftpb.Snapshot, error) {
+	return raftpb.Snapshot{
+		Metadata: raftpb.SnapshotMetadata{
+			ConfState: confStateFromDesc(r.mu.desc),
+			Index:     r.mu.state.RaftAppliedIndex,
+			Term:      r.mu.state.RaftAppliedIndexTerm,
+		},
+	}, nil
+}
+
+// applySnapshot applies the snapshot restored by the replica's Raft group,
+// whose data was received by the store: the replicated state and the data of
+// the range, as well as the replica's Raft log, are replaced by those of the
+// snapshot. r.raftMu must be held.
+func (r *Replica) applySnapshot(
+	ctx context.Context, inSnap incomingSnapshot, snap raftpb.Snapshot,
+) error {
+	if inSnap.Index != snap.Metadata.Index {
+		return fmt.Errorf("r%d: received snapshot at index %d, raft restored snapshot at index %d",
+			r.RangeID, inSnap.Index, snap.Metadata.Index)
+	}
+	logPrefix := keys.RaftLogPrefix(r.RangeID)
+	clearSpans := []roachpb.Span{
+		rangeIDReplicatedSpan(r.RangeID),
+		{Key: logPrefix, EndKey: logPrefix.PrefixEnd()},
+	}
+	// The range may have been split or merged since the replica last applied
+	// a command.
+	clearSpans = append(clearSpans, rangeDataSpans(r.Desc())...)
+	clearSpans = append(clearSpans, rangeDataSpans(inSnap.Desc)...)
+	// The rangefeeds of the replica can't follow the data of the range across
+	// the snapshot.
+	r.disconnectRangefeedWithReason(kvpb.RangeFeedRetryError_REASON_RAFT_SNAPSHOT)
+	if err := r.store.ingestSnapshot(ctx, inSnap, clearSpans, nil /* hs */); err != nil {
+		return err
+	}
+
+	eng := r.store.Engine()
+	state, err := r.stateLoader.LoadRangeAppliedState(ctx, eng)
+	if err != nil {
+		return err
+	}
+	if state.RaftAppliedIndex != inSnap.Index {
+		return fmt.Errorf("r%d: snapshot at index %d holds the state applied at index %d",
+			r.RangeID, inSnap.Index, state.RaftAppliedIndex)
+	}
+	stats, err := r.stateLoader.LoadMVCCStats(ctx, eng)
+	if err != nil {
+		return err
+	}
+	lease, err := r.stateLoader.LoadLease(ctx, eng)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.mu.state = state
+	r.mu.stats = stats
+	r.mu.lease = lease
+	r.mu.truncatedState = kvserverpb.RaftTruncatedState{Index: inSnap.Index, Term: inSnap.Term}
+	r.mu.lastIndex = inSnap.Index
+	r.mu.desc = inSnap.Desc
+	return nil
+}
+
+// confStateFromDesc returns the Raft configuration of the range described by
+// desc. The voters are identified by their replica IDs. If the range is in a
+// joint configuration, the voters of the outgoing configuration are returned
+// as well.
+func confStateFromDesc(desc *roachpb.RangeDescriptor) raftpb.ConfState {
+	var cs raftpb.ConfState
+	joint := desc.InAtomicReplicationChange()
+	for _, rd := range desc.Replicas() {
+		if rd.Type.IsVoterNewConfig() {
+			cs.Voters = append(cs.Voters, uint64(rd.ReplicaID))
+		}
+		if joint && rd.Type.IsVoterOldConfig() {
+			cs.VotersOutgoing = append(cs.VotersOutgoing, uint64(rd.ReplicaID))
+		}
+	}
+	return cs
+}
+
+// confChangeFromDesc returns the Raft configuration change which moves the
+// range to the configuration described by desc: if desc is in a joint
+// configuration, the change enters it by adding the incoming voters and
+// removing the outgoing ones; otherwise, the change leaves the joint
+// configuration that the range is in.
+//
+// The joint configuration is entered explicitly, even for a single change:
+// the range leaves it once the descriptor without incoming and outgoing
+// voters is committed, rather than when Raft sees fit.
+func confChangeFromDesc(desc *roachpb.RangeDescriptor) raftpb.ConfChangeV2 {
+	var cc raftpb.ConfChangeV2
+	if desc.InAtomicReplicationChange() {
+		cc.Transition = raftpb.ConfChangeTransitionJointExplicit
+	}
+	for _, rd := range desc.Replicas() {
+		switch rd.Type {
+		case roachpb.VOTER_INCOMING:
+			cc.Changes = append(cc.Changes, raftpb.ConfChangeSingle{
+				Type: raftpb.ConfChangeAddNode, NodeID: uint64(rd.ReplicaID),
+			})
+		case roachpb.VOTER_OUTGOING:
+			cc.Changes = append(cc.Changes, raftpb.ConfChangeSingle{
+				Type: raftpb.ConfChangeRemoveNode, NodeID: uint64(rd.ReplicaID),
+			})
+		}
+	}
+	return cc
+}
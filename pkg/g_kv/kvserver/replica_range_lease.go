@@ -0,0 +1,462 @@
+package kvserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	keys "github.com/dborchard/tiny_crdb/pkg/g_keys"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/kvserverpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/liveness"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/stop"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/uuid"
+	raft "go.etcd.io/raft/v3"
+	"time"
+)
+
+// This file contains replica methods related to range leases.
+//
+// Only the holder of a valid lease serves the requests addressed to the
+// range: the other replicas redirect them with a NotLeaseHolderError. The
+// leaseholder serves reads on its own, but only the leader of the range's
+// Raft group proposes commands. The leader therefore transfers its
+// leadership to the leaseholder, which then serves writes as well.
+//
+// A range without a valid lease has its lease acquired, on demand, by the
+// leader of its Raft group. Expiration-based leases are valid until their
+// expiration, and are extended by their holder. Epoch-based leases are tied
+// to the liveness record of their holder's node, and are revoked by
+// incrementing the epoch of the record once it has expired. The ranges which
+// hold the liveness records use expiration-based leases, so as not to depend
+// on themselves.
+
+// pendingLeaseRequest is an in-flight request for the lease of the range, on
+// which the requests which need the lease wait.
+type pendingLeaseRequest struct {
+	// done is closed once the request completes, at which point err holds
+	// its outcome.
+	done chan struct{}
+	err  error
+}
+
+// GetLease returns the lease of the range, as of the last command applied by
+// the replica.
+func (r *Replica) GetLease() roachpb.Lease {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.mu.lease
+}
+
+// GetMaxReadTimestamp returns the highest timestamp at which the range's data
+// was read, as recorded in the store's timestamp cache, or may have been read
+// by follower reads: the closed timestamp of the range.
+func (r *Replica) GetMaxReadTimestamp() hlc.Timestamp {
+	r.mu.RLock()
+	maxTS := r.getClosedTimestampForWritesRLocked()
+	r.mu.RUnlock()
+	for _, span := range rangeDataSpans(r.Desc()) {
+		ts, _ := r.store.tsCache.GetMax(span.Key, span.EndKey)
+		maxTS.Forward(ts)
+	}
+	return maxTS
+}
+
+// CurrentLeaseStatus returns the status of the current lease for the
+// current time.
+func (r *Replica) CurrentLeaseStatus() kvserverpb.LeaseStatus {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.leaseStatusAtRLocked(r.Clock().NowAsClockTimestamp(), hlc.Timestamp{})
+}
+
+// OwnsValidLease returns whether this replica is the current valid
+// leaseholder.
+func (r *Replica) OwnsValidLease() bool {
+	st := r.CurrentLeaseStatus()
+	return st.IsValid() && st.OwnedBy(r.store.StoreID())
+}
+
+// leaseStatusAtRLocked returns the status of the current lease at the clock
+// reading now, for a request at the timestamp reqTS, which may be empty. r.mu
+// must be held, at least for reading.
+func (r *Replica) leaseStatusAtRLocked(now hlc.ClockTimestamp, reqTS hlc.Timestamp) kvserverpb.LeaseStatus {
+	return r.leaseStatus(r.mu.lease, now, reqTS)
+}
+
+// leaseStatus returns the status of the lease at the clock reading now, for a
+// request at the timestamp reqTS. A lease is valid if neither the clock
+// reading nor the request timestamp has reached its expiration, which is the
+// expiration of the liveness record of its holder for epoch-based leases.
+// An epoch-based lease is expired once the epoch of the record has been
+// incremented, and its status is an error if the record is unknown.
+func (r *Replica) leaseStatus(
+	lease roachpb.Lease, now hlc.ClockTimestamp, reqTS hlc.Timestamp,
+) kvserverpb.LeaseStatus {
+	st := kvserverpb.LeaseStatus{Lease: lease, Now: now, RequestTime: reqTS}
+	var expiration hlc.Timestamp
+	switch lease.Type() {
+	case roachpb.LeaseNone:
+		st.State = kvserverpb.LeaseState_EXPIRED
+		return st
+	case roachpb.LeaseExpiration:
+		expiration = lease.GetExpiration()
+	case roachpb.LeaseEpoch:
+		nl := r.store.cfg.NodeLiveness
+		if nl == nil {
+			st.State = kvserverpb.LeaseState_ERROR
+			return st
+		}
+		l, ok := nl.GetLiveness(lease.Replica.NodeID)
+		if !ok || l.Epoch < lease.Epoch {
+			// The record is not known, or the cached one is stale.
+			st.State = kvserverpb.LeaseState_ERROR
+			return st
+		}
+		st.Liveness = l
+		if l.Epoch > lease.Epoch {
+			st.State = kvserverpb.LeaseState_EXPIRED
+			return st
+		}
+		expiration = l.Expiration
+	}
+	maxTS := now.ToTimestamp()
+	maxTS.Forward(reqTS)
+	if maxTS.Less(expiration) {
+		st.State = kvserverpb.LeaseState_VALID
+	} else {
+		st.State = kvserverpb.LeaseState_EXPIRED
+	}
+	return st
+}
+
+// requiresExpirationLeaseRLocked returns whether the range must use
+// expiration-based leases: it holds liveness records, or the store has no
+// NodeLiveness. r.mu must be held, at least for reading.
+func (r *Replica) requiresExpirationLeaseRLocked() bool {
+	return r.store.cfg.NodeLiveness == nil ||
+		r.mu.desc.StartKey.Less(roachpb.RKey(keys.NodeLivenessKeyMax))
+}
+
+// redirectOnOrAcquireLease checks whether this replica holds a valid lease
+// for the request, and returns its status if it does. Otherwise, the lease
+// is acquired if the replica leads the range's Raft group and the lease is
+// not held by another replica; the request waits for the lease request to
+// complete. If another replica holds the lease, or leads the range, a
+// NotLeaseHolderError pointing to it is returned.
+//
+// Requests which write, and must therefore be proposed by the leader, also
+// wait for the leaseholder to lead the range: the leader transfers its
+// leadership to the leaseholder. As in the absence of a known leader, the
+// wait is bounded by an election timeout.
+func (r *Replica) redirectOnOrAcquireLease(
+	ctx context.Context, ba *kvpb.BatchRequest,
+) (kvserverpb.LeaseStatus, error) {
+	electionTimeout := time.Duration(r.store.cfg.RaftElectionTimeoutTicks) * r.store.cfg.RaftTickInterval
+	deadline := time.Now().Add(electionTimeout)
+	needsLeader := !ba.IsReadOnly()
+	storeID := r.store.StoreID()
+	for {
+		now := r.Clock().NowAsClockTimestamp()
+		r.mu.Lock()
+		if r.mu.destroyed {
+			r.mu.Unlock()
+			return kvserverpb.LeaseStatus{}, kvpb.NewRangeNotFoundError(r.RangeID, storeID)
+		}
+		st := r.leaseStatusAtRLocked(now, ba.Timestamp)
+		pastDeadline := time.Now().After(deadline)
+		var pending *pendingLeaseRequest
+		var err error
+		switch {
+		case st.IsValid() && st.OwnedBy(storeID):
+			if r.mu.leaderReady && r.shouldExtendLeaseRLocked(st) {
+				// The lease is extended in the background.
+				r.requestLeaseLocked(st)
+			}
+			switch {
+			case !needsLeader || r.mu.leaderReady:
+				r.mu.Unlock()
+				return st, nil
+			case pastDeadline:
+				err = r.newNotLeaderErrorRLocked()
+			}
+		case st.State != kvserverpb.LeaseState_EXPIRED && !st.OwnedBy(storeID):
+			// Another replica holds the lease, or may hold it if the
+			// liveness record of its node is unknown.
+			err = kvpb.NewNotLeaseHolderError(st.Lease, storeID, r.mu.desc, "")
+		case r.mu.leaderReady:
+			pending = r.requestLeaseLocked(st)
+		default:
+			lead := r.mu.internalRaftGroup.Status().Lead
+			if lead != raft.None && lead != uint64(r.mu.replicaID) {
+				// The leader acquires the lease: point the request to it.
+				if leader, ok := r.mu.desc.GetReplicaDescriptorByID(roachpb.ReplicaID(lead)); ok {
+					err = kvpb.NewNotLeaseHolderError(roachpb.Lease{Replica: leader}, storeID, r.mu.desc,
+						"lease expired; the leader acquires it")
+				}
+			} else if pastDeadline {
+				err = kvpb.NewNotLeaseHolderError(roachpb.Lease{}, storeID, r.mu.desc,
+					"lease expired and no leader known")
+			}
+		}
+		r.mu.Unlock()
+		if err != nil {
+			return kvserverpb.LeaseStatus{}, err
+		}
+
+		var done <-chan struct{}
+		var retry <-chan time.Time
+		if pending != nil {
+			done = pending.done
+		} else {
+			retry = time.After(time.Millisecond)
+		}
+		select {
+		case <-done:
+		case <-retry:
+		case <-r.store.Stopper().ShouldQuiesce():
+			return kvserverpb.LeaseStatus{}, stop.ErrUnavailable
+		case <-ctx.Done():
+			return kvserverpb.LeaseStatus{}, ctx.Err()
+		}
+		if pending == nil || pending.err == nil {
+			continue
+		}
+		var lre *kvpb.LeaseRejectedError
+		switch {
+		case errors.As(pending.err, &lre):
+			// The lease changed while it was requested.
+		case errors.Is(pending.err, liveness.ErrRecordCacheMiss):
+			// Epoch-based leases are only acquired once the node has
+			// heartbeated its liveness record.
+			select {
+			case <-r.store.cfg.NodeLiveness.SelfHeartbeated():
+			case <-r.store.Stopper().ShouldQuiesce():
+				return kvserverpb.LeaseStatus{}, stop.ErrUnavailable
+			case <-ctx.Done():
+				return kvserverpb.LeaseStatus{}, ctx.Err()
+			}
+		default:
+			return kvserverpb.LeaseStatus{}, pending.err
+		}
+	}
+}
+
+// shouldExtendLeaseRLocked returns whether the valid lease, held by the
+// replica, is an expiration-based lease of which less than half the duration
+// remains. r.mu must be held, at least for reading.
+func (r *Replica) shouldExtendLeaseRLocked(st kvserverpb.LeaseStatus) bool {
+	if st.Lease.Type() != roachpb.LeaseExpiration {
+		return false
+	}
+	renewal := st.Now.ToTimestamp().Add(r.store.cfg.RangeLeaseDuration.Nanoseconds()/2, 0)
+	return st.Lease.GetExpiration().Less(renewal)
+}
+
+// requestLeaseLocked requests the lease of the range for the replica, in
+// place of the lease whose status is provided, unless a request is already
+// in flight. The request runs asynchronously, and the returned handle is
+// completed with its outcome. r.mu must be held.
+func (r *Replica) requestLeaseLocked(st kvserverpb.LeaseStatus) *pendingLeaseRequest {
+	if p := r.mu.pendingLeaseRequest; p != nil {
+		return p
+	}
+	p := &pendingLeaseRequest{done: make(chan struct{})}
+	replDesc, ok := r.mu.desc.GetReplicaDescriptorByID(r.mu.replicaID)
+	if !ok {
+		p.err = kvpb.NewRangeNotFoundError(r.RangeID, r.store.StoreID())
+		close(p.done)
+		return p
+	}
+	useExpiration := r.requiresExpirationLeaseRLocked()
+	r.mu.pendingLeaseRequest = p
+	if err := r.store.Stopper().RunAsyncTask(context.Background(), "replica: requesting lease",
+		func(ctx context.Context) {
+			ctx, cancel := r.store.Stopper().WithCancelOnQuiesce(ctx)
+			defer cancel()
+			err := r.requestLease(ctx, st, replDesc, useExpiration)
+			r.mu.Lock()
+			r.mu.pendingLeaseRequest = nil
+			r.mu.Unlock()
+			p.err = err
+			close(p.done)
+		}); err != nil {
+		r.mu.pendingLeaseRequest = nil
+		p.err = err
+		close(p.done)
+	}
+	return p
+}
+
+// requestLease proposes a RequestLease for the replica, in place of the lease
+// whose status is provided. An epoch-based lease held by another node, which
+// expired with the liveness record of the node, is first revoked by
+// incrementing the epoch of the record. If the record turns out to be live,
+// the lease is not requested, and a NotLeaseHolderError pointing to its holder
+// is returned.
+func (r *Replica) requestLease(
+	ctx context.Context, st kvserverpb.LeaseStatus, replDesc roachpb.ReplicaDescriptor, useExpiration bool,
+) error {
+	now := r.Clock().NowAsClockTimestamp()
+	lease := roachpb.Lease{
+		Start:      now,
+		Replica:    replDesc,
+		ProposedTS: now,
+	}
+	if useExpiration {
+		exp := now.ToTimestamp().Add(r.store.cfg.RangeLeaseDuration.Nanoseconds(), 0)
+		lease.Expiration = &exp
+	} else {
+		nl := r.store.cfg.NodeLiveness
+		self, ok := nl.Self()
+		if !ok {
+			return liveness.ErrRecordCacheMiss
+		}
+		lease.Epoch = self.Epoch
+		prev := st.Lease
+		if prev.Type() == roachpb.LeaseEpoch && prev.Replica.NodeID != r.store.NodeID() &&
+			st.Liveness.Epoch == prev.Epoch {
+			err := nl.IncrementEpoch(ctx, st.Liveness)
+			switch {
+			case err == nil, errors.Is(err, liveness.ErrEpochAlreadyIncremented):
+			case errors.Is(err, liveness.ErrLiveNode):
+				// The record was found expired in the stale cache of the
+				// node: the lease is still valid, and its holder serves the
+				// request. The cache now holds the live record.
+				return kvpb.NewNotLeaseHolderError(prev, r.store.StoreID(), r.Desc(),
+					"the leaseholder's node is live")
+			default:
+				return fmt.Errorf("unable to revoke lease %s: %w", prev, err)
+			}
+		}
+	}
+
+	ba := &kvpb.BatchRequest{}
+	ba.Timestamp = now.ToTimestamp()
+	ba.RangeID = r.RangeID
+	ba.Add(&kvpb.RequestLeaseRequest{
+		RequestHeader: kvpb.RequestHeader{Key: r.Desc().StartKey.AsRawKey()},
+		Lease:         lease,
+		PrevLease:     st.Lease,
+	})
+	_, pErr := r.Send(ctx, ba)
+	return pErr.GoError()
+}
+
+// AdminTransferLease transfers the lease of the range to the replica on the
+// target store. The replica must hold the lease: the transfer waits for the
+// requests in flight on the range and blocks new ones until it applies, at
+// which point they are redirected to the new leaseholder.
+func (r *Replica) AdminTransferLease(
+	ctx context.Context, args kvpb.AdminTransferLeaseRequest,
+) (kvpb.AdminTransferLeaseResponse, *kvpb.Error) {
+	var reply kvpb.AdminTransferLeaseResponse
+	target := args.Target
+	desc := r.Desc()
+	targetDesc, ok := desc.GetReplicaDescriptor(target)
+	if !ok {
+		return reply, kvpb.NewErrorf("unable to find store s%d in range %s", target, desc)
+	}
+	st := r.CurrentLeaseStatus()
+	if st.OwnedBy(target) {
+		// The target already holds the lease.
+		return reply, nil
+	}
+
+	now := r.Clock().NowAsClockTimestamp()
+	lease := roachpb.Lease{
+		Start:      now,
+		Replica:    targetDesc,
+		ProposedTS: now,
+	}
+	r.mu.RLock()
+	useExpiration := r.requiresExpirationLeaseRLocked()
+	r.mu.RUnlock()
+	if useExpiration {
+		exp := now.ToTimestamp().Add(r.store.cfg.RangeLeaseDuration.Nanoseconds(), 0)
+		lease.Expiration = &exp
+	} else {
+		l, ok := r.store.cfg.NodeLiveness.GetLiveness(targetDesc.NodeID)
+		if !ok || !l.IsLive(now.ToTimestamp()) {
+			return reply, kvpb.NewErrorf("cannot transfer lease to s%d: node n%d not live",
+				target, targetDesc.NodeID)
+		}
+		lease.Epoch = l.Epoch
+	}
+
+	// The replica closes no further timestamp during the transfer, as the
+	// new lease starts above the timestamps closed when it is evaluated.
+	r.mu.Lock()
+	r.mu.leaseTransferInProgress = true
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		r.mu.leaseTransferInProgress = false
+		r.mu.Unlock()
+	}()
+	ba := &kvpb.BatchRequest{}
+	ba.Timestamp = now.ToTimestamp()
+	ba.RangeID = r.RangeID
+	ba.Add(&kvpb.TransferLeaseRequest{
+		RequestHeader: kvpb.RequestHeader{Key: desc.StartKey.AsRawKey()},
+		Lease:         lease,
+		PrevLease:     st.Lease,
+	})
+	if _, pErr := r.Send(ctx, ba); pErr != nil {
+		return reply, pErr
+	}
+	return reply, nil
+}
+
+// leasePostApply updates the replica's lease once a command installing a new
+// lease has applied. A replica which takes the lease over from another store
+// bumps the timestamp cache over the range's data to the start of the lease,
+// so that it serves no writes below the reads served by its predecessor; the
+// low water mark of the cache covers the reads served by the store itself
+// before it restarted. The new leaseholder starts queuing the pushers of the
+// range's transactions, and a replica which loses the lease releases the
+// requests waiting in its queues.
+func (r *Replica) leasePostApply(newLease roachpb.Lease) {
+	r.mu.Lock()
+	prevLease := r.mu.lease
+	r.mu.lease = newLease
+	desc := r.mu.desc
+	replicaID := r.mu.replicaID
+	r.mu.Unlock()
+
+	storeID := r.store.StoreID()
+	iAmTheLeaseHolder := newLease.Replica.ReplicaID == replicaID && newLease.OwnedBy(storeID)
+	if iAmTheLeaseHolder && !prevLease.Empty() && !prevLease.OwnedBy(storeID) {
+		start := newLease.Start.ToTimestamp()
+		for _, span := range rangeDataSpans(desc) {
+			r.store.tsCache.Add(span.Key, span.EndKey, start, uuid.Nil)
+		}
+	}
+	if iAmTheLeaseHolder {
+		r.txnWaitQueue.Enable()
+	} else if prevLease.OwnedBy(storeID) {
+		r.txnWaitQueue.Clear(true /* disable */)
+		r.concMgr.OnRangeLeaseUpdated(false /* isLeaseholder */)
+	}
+}
+
+// maybeTransferRaftLeadershipLocked transfers the leadership of the range's
+// Raft group to the holder of the range's valid lease, if the replica leads
+// the group without holding the lease. Only the leader proposes commands,
+// so the leaseholder cannot serve writes until then. r.mu must be held.
+func (r *Replica) maybeTransferRaftLeadershipLocked() {
+	status := r.mu.internalRaftGroup.Status()
+	if status.RaftState != raft.StateLeader || status.LeadTransferee != raft.None {
+		return
+	}
+	st := r.leaseStatusAtRLocked(r.Clock().NowAsClockTimestamp(), hlc.Timestamp{})
+	if !st.IsValid() || st.Lease.Replica.ReplicaID == r.mu.replicaID {
+		return
+	}
+	rd, ok := r.mu.desc.GetReplicaDescriptorByID(st.Lease.Replica.ReplicaID)
+	if !ok || rd.Type != roachpb.VOTER_FULL {
+		return
+	}
+	r.mu.internalRaftGroup.TransferLeader(uint64(rd.ReplicaID))
+}
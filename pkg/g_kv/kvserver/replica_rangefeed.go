@@ -0,0 +1,209 @@
+package kvserver
+
+import (
+	"context"
+	"fmt"
+	keys "github.com/dborchard/tiny_crdb/pkg/g_keys"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/kvserverpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/rangefeed"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	storage "github.com/dborchard/tiny_crdb/pkg/h_storage"
+	"github.com/dborchard/tiny_crdb/pkg/h_storage/enginepb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+)
+
+// rangefeedTxnPusher is a shim around intentResolver that implements the
+// rangefeed.TxnPusher interface.
+type rangefeedTxnPusher struct {
+	r *Replica
+}
+
+var _ rangefeed.TxnPusher = &rangefeedTxnPusher{}
+
+// PushTxns is part of the rangefeed.TxnPusher interface. It performs a
+// high-priority push at the specified timestamp to each of the specified
+// transactions.
+func (tp *rangefeedTxnPusher) PushTxns(
+	ctx context.Context, txns []enginepb.TxnMeta, ts hlc.Timestamp,
+) ([]*roachpb.Transaction, error) {
+	h := kvpb.Header{
+		Timestamp:    ts,
+		UserPriority: roachpb.MaxUserPriority,
+	}
+	pushed := make([]*roachpb.Transaction, 0, len(txns))
+	for i := range txns {
+		txn, pErr := tp.r.store.intentResolver.PushTransaction(ctx, &txns[i], h, kvpb.PUSH_TIMESTAMP)
+		if pErr != nil {
+			return nil, pErr.GoError()
+		}
+		pushed = append(pushed, txn)
+	}
+	return pushed, nil
+}
+
+// ResolveIntents is part of the rangefeed.TxnPusher interface.
+func (tp *rangefeedTxnPusher) ResolveIntents(
+	ctx context.Context, intents []roachpb.LockUpdate,
+) error {
+	for _, intent := range intents {
+		if pErr := tp.r.store.intentResolver.ResolveIntent(ctx, intent); pErr != nil {
+			return pErr.GoError()
+		}
+	}
+	return nil
+}
+
+// RangeFeed registers a rangefeed over the specified span. It sends updates
+// to the provided stream and returns with a future error once the
+// registration is disconnected: when the stream fails, or when the range is
+// split, merged or removed from the store, in which case the client is
+// expected to re-establish its rangefeeds from the last checkpoint it
+// received.
+func (r *Replica) RangeFeed(args *kvpb.RangeFeedRequest, stream kvpb.RangeFeedEventSink) *kvpb.Error {
+	ctx := stream.Context()
+	rSpan, err := keys.SpanAddr(args.Span)
+	if err != nil {
+		return kvpb.NewError(err)
+	}
+
+	errC := make(chan *kvpb.Error, 1)
+	r.raftMu.Lock()
+	if err := r.IsDestroyed(); err != nil {
+		r.raftMu.Unlock()
+		return kvpb.NewError(err)
+	}
+	if desc := r.Desc(); !desc.ContainsKeyRange(rSpan.Key, rSpan.EndKey) {
+		r.raftMu.Unlock()
+		return kvpb.NewError(kvpb.NewRangeKeyMismatchError(args.Span.Key, args.Span.EndKey, desc))
+	}
+	// The catch-up snapshot is taken with raftMu held, so that it reflects
+	// exactly the commands applied before the registration starts receiving
+	// the events published by the processor.
+	snap := r.store.Engine().NewSnapshot()
+	err = r.registerWithRangefeedRaftMuLocked(ctx, rSpan, args.Timestamp, snap, args.WithDiff, stream, errC)
+	r.raftMu.Unlock()
+	if err != nil {
+		snap.Close()
+		return kvpb.NewError(err)
+	}
+	return <-errC
+}
+
+// registerWithRangefeedRaftMuLocked registers the stream with the rangefeed
+// processor of the replica, which is created if it doesn't exist yet. r.raftMu
+// must be held.
+func (r *Replica) registerWithRangefeedRaftMuLocked(
+	ctx context.Context,
+	span roachpb.RSpan,
+	startTS hlc.Timestamp,
+	catchUpSnap storage.Reader,
+	withDiff bool,
+	stream kvpb.RangeFeedEventSink,
+	errC chan<- *kvpb.Error,
+) error {
+	r.rangefeedMu.Lock()
+	defer r.rangefeedMu.Unlock()
+	if p := r.rangefeedMu.proc; p != nil {
+		if p.Register(span, startTS, catchUpSnap, withDiff, stream, errC) {
+			return nil
+		}
+		// The processor stopped itself after its last registration was
+		// removed. Replace it.
+		r.rangefeedMu.proc = nil
+	}
+
+	dataSpan := rangeDataSpans(r.Desc())[1]
+	var p *rangefeed.Processor
+	p = rangefeed.NewProcessor(rangefeed.Config{
+		Clock:           r.store.Clock(),
+		Stopper:         r.store.Stopper(),
+		Span:            roachpb.RSpan{Key: roachpb.RKey(dataSpan.Key), EndKey: roachpb.RKey(dataSpan.EndKey)},
+		ClosedTimestamp: r.GetCurrentClosedTimestamp,
+		TxnPusher:       &rangefeedTxnPusher{r: r},
+		OnEmpty:         func() { r.unsetRangefeedProcessor(p) },
+	})
+	if err := p.Start(ctx, catchUpSnap); err != nil {
+		return err
+	}
+	if !p.Register(span, startTS, catchUpSnap, withDiff, stream, errC) {
+		return fmt.Errorf("r%d: rangefeed processor stopped during registration", r.RangeID)
+	}
+	r.rangefeedMu.proc = p
+	return nil
+}
+
+// getRangefeedProcessor returns the rangefeed processor of the replica, or nil
+// if the replica has no active rangefeed.
+func (r *Replica) getRangefeedProcessor() *rangefeed.Processor {
+	r.rangefeedMu.RLock()
+	defer r.rangefeedMu.RUnlock()
+	return r.rangefeedMu.proc
+}
+
+// unsetRangefeedProcessor unsets the rangefeed processor of the replica, if
+// it is still the provided one.
+func (r *Replica) unsetRangefeedProcessor(p *rangefeed.Processor) {
+	r.rangefeedMu.Lock()
+	defer r.rangefeedMu.Unlock()
+	if r.rangefeedMu.proc == p {
+		r.rangefeedMu.proc = nil
+	}
+}
+
+// disconnectRangefeedWithReason stops the rangefeed processor of the replica,
+// if any, and disconnects its registrations with a RangeFeedRetryError
+// carrying the provided reason.
+func (r *Replica) disconnectRangefeedWithReason(reason kvpb.RangeFeedRetryError_Reason) {
+	r.rangefeedMu.Lock()
+	defer r.rangefeedMu.Unlock()
+	if p := r.rangefeedMu.proc; p != nil {
+		p.StopWithErr(kvpb.NewError(kvpb.NewRangeFeedRetryError(reason)))
+		r.rangefeedMu.proc = nil
+	}
+}
+
+// handleLogicalOpLogRaftMuLocked passes the logical operations of a command
+// to the rangefeed processor of the replica, if any. It is called while the
+// command applies, before its batch is committed: the values written by the
+// operations are read from the batch, and their previous values from the
+// engine. r.raftMu must be held.
+func (r *Replica) handleLogicalOpLogRaftMuLocked(
+	ctx context.Context, ops *kvserverpb.LogicalOpLog, batch storage.Reader,
+) error {
+	p := r.getRangefeedProcessor()
+	if p == nil || ops == nil || len(ops.Ops) == 0 {
+		return nil
+	}
+	eng := r.store.Engine()
+	for _, op := range ops.Ops {
+		var key roachpb.Key
+		var ts hlc.Timestamp
+		var valPtr, prevValPtr *[]byte
+		switch t := op.GetValue().(type) {
+		case *enginepb.MVCCWriteValueOp:
+			key, ts, valPtr, prevValPtr = t.Key, t.Timestamp, &t.Value, &t.PrevValue
+		case *enginepb.MVCCCommitIntentOp:
+			key, ts, valPtr, prevValPtr = t.Key, t.Timestamp, &t.Value, &t.PrevValue
+		default:
+			continue
+		}
+		val, ok, err := storage.MVCCGetVersion(ctx, batch, key, ts)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("r%d: value of logical op on %s at %s not found", r.RangeID, key, ts)
+		}
+		*valPtr = val
+		prev, err := storage.MVCCGet(ctx, eng, key, ts, storage.MVCCGetOptions{Inconsistent: true})
+		if err != nil {
+			return err
+		}
+		if prev.Value != nil {
+			*prevValPtr = prev.Value.RawBytes
+		}
+	}
+	p.ConsumeLogicalOps(ops.Ops...)
+	return nil
+}
@@ -0,0 +1,33 @@
+package kvserver
+
+import (
+	"context"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/concurrency"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/kvserverpb"
+)
+
+// executeReadOnlyBatch is the execution logic for client requests which do
+// not mutate the range's replicated state. The method uses a single RocksDB
+// iterator to evaluate all of the requests in the batch.
+//
+// Locking reads acquire unreplicated locks, which are recorded in the lock
+// table once the batch has been evaluated. The spans that were read are then
+// recorded in the timestamp cache, so that later writes to them are pushed
+// above the read.
+func (r *Replica) executeReadOnlyBatch(
+	ctx context.Context, ba *kvpb.BatchRequest, g *concurrency.Guard, _ kvserverpb.LeaseStatus,
+) (*kvpb.BatchResponse, *kvpb.Error) {
+	// Evaluate against a batch, which provides a consistent snapshot of the
+	// engine across the requests of the read-only batch. Nothing is written
+	// to it.
+	rw := r.store.Engine().NewBatch()
+	defer rw.Close()
+	br, res, pErr := evaluateBatch(ctx, rw, r, ba, g)
+	if pErr != nil {
+		return nil, pErr
+	}
+	r.handleLocalResult(ctx, res.Local)
+	r.updateTimestampCache(ctx, ba, br)
+	return br, nil
+}
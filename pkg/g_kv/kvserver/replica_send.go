@@ -0,0 +1,175 @@
+package kvserver
+
+import (
+	"context"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/batcheval"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/concurrency"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/concurrency/poison"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/kvserverpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/lockspanset"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/spanset"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/txnwait"
+)
+
+// batchExecutionFn is a method on Replica that executes a BatchRequest. It
+// is called with the batch, along with a guard for the latches and locks
+// protecting the request and the status of the lease under which the request
+// executes.
+type batchExecutionFn func(
+	*Replica, context.Context, *kvpb.BatchRequest, *concurrency.Guard, kvserverpb.LeaseStatus,
+) (*kvpb.BatchResponse, *kvpb.Error)
+
+var _ batchExecutionFn = (*Replica).executeWriteBatch
+var _ batchExecutionFn = (*Replica).executeReadOnlyBatch
+
+// executeBatchWithConcurrencyRetries is the entry point for client (non-admin)
+// requests that execute against the range's state. The method coordinates the
+// execution of requests that may require multiple retries due to interactions
+// with concurrency control.
+//
+// The method acquires latches for the request, which synchronizes it with
+// conflicting requests. This permits the execution function to run without
+// concern of coordinating with logically conflicting operations, although it
+// still needs to worry about coordinating with non-conflicting operations when
+// accessing shared data structures.
+//
+// If the execution function hits a concurrency error like a WriteIntentError
+// or a TransactionPushError it will propagate the error back to this method,
+// which handles the process of retrying batch execution after addressing the
+// error.
+func (r *Replica) executeBatchWithConcurrencyRetries(
+	ctx context.Context, ba *kvpb.BatchRequest, fn batchExecutionFn,
+) (*kvpb.BatchResponse, *kvpb.Error) {
+	latchSpans, lockSpans := r.collectSpans(ba)
+
+	var g *concurrency.Guard
+	defer func() {
+		// NB: wrapped to delay g evaluation to its value when returning.
+		if g != nil {
+			r.concMgr.FinishReq(g)
+		}
+	}()
+	pushWaited := false
+	// contentionEvents are the events of the guards released before the
+	// request is retried with a new one.
+	var contentionEvents []kvpb.ContentionEvent
+	for {
+		var pErr *kvpb.Error
+		g, pErr = r.concMgr.SequenceReq(ctx, g, concurrency.Request{
+			Txn:          ba.Txn,
+			Timestamp:    ba.Timestamp,
+			WaitPolicy:   ba.WaitPolicy,
+			PoisonPolicy: poison.Policy_Error,
+			Requests:     ba.Requests,
+			LatchSpans:   latchSpans,
+			LockSpans:    lockSpans,
+		})
+		if pErr != nil {
+			// The guard was released by the concurrency manager.
+			return nil, pErr
+		}
+		// The range may have been split or merged away while the request
+		// waited for its latches.
+		if err := r.IsDestroyed(); err != nil {
+			return nil, kvpb.NewError(err)
+		}
+		if err := r.checkBatchRange(ba); err != nil {
+			return nil, kvpb.NewError(err)
+		}
+		// The lease may also have changed hands.
+		st, err := r.checkLeaseForBatch(ba)
+		if err != nil {
+			return nil, kvpb.NewError(err)
+		}
+
+		br, pErr := fn(r, ctx, ba, g, st)
+		if pErr == nil {
+			// Report the time that the request spent waiting on locks.
+			br.ContentionEvents = append(br.ContentionEvents, contentionEvents...)
+			br.ContentionEvents = append(br.ContentionEvents, g.ContentionEvents()...)
+			return br, nil
+		}
+
+		switch t := pErr.GetDetail().(type) {
+		case *kvpb.WriteIntentError:
+			// Drop latches, but retain lock wait-queues, and wait on the
+			// discovered locks.
+			latchedG := g
+			if g, pErr = r.concMgr.HandleWriterIntentError(ctx, g, t); pErr != nil {
+				g = latchedG
+				return nil, pErr
+			}
+		case *kvpb.TransactionPushError:
+			// A PushTxn request that cannot push its pushee waits in the
+			// txnWaitQueue for the pushee to be finalized or pushed, or to
+			// expire. The wait is only attempted once: a push that still
+			// fails afterwards is returned to the pusher.
+			args, ok := ba.GetArg(kvpb.PushTxn)
+			if !ok || !ba.IsSinglePushTxnRequest() || pushWaited {
+				return nil, pErr
+			}
+			pushReq := args.(*kvpb.PushTxnRequest)
+			if txnwait.ShouldPushImmediately(pushReq) {
+				return nil, pErr
+			}
+			pushWaited = true
+			contentionEvents = append(contentionEvents, g.ContentionEvents()...)
+			r.concMgr.FinishReq(g)
+			g = nil
+			resp, waitErr := r.txnWaitQueue.MaybeWaitForPush(ctx, pushReq)
+			if waitErr != nil {
+				return nil, waitErr
+			}
+			if resp != nil {
+				br := &kvpb.BatchResponse{}
+				br.Add(resp)
+				return br, nil
+			}
+		case *kvpb.IndeterminateCommitError:
+			// The request ran into a transaction record in the STAGING
+			// state, abandoned by its coordinator. Recover the transaction
+			// before retrying.
+			contentionEvents = append(contentionEvents, g.ContentionEvents()...)
+			r.concMgr.FinishReq(g)
+			g = nil
+			if _, err := r.store.recoveryMgr.ResolveIndeterminateCommit(ctx, t); err != nil {
+				return nil, kvpb.NewError(err)
+			}
+		default:
+			return nil, pErr
+		}
+	}
+}
+
+// checkLeaseForBatch returns the status of the range's lease for the batch,
+// which the replica must hold, unless the batch skips the lease check or is
+// served as a follower read: a NotLeaseHolderError is returned otherwise.
+func (r *Replica) checkLeaseForBatch(ba *kvpb.BatchRequest) (kvserverpb.LeaseStatus, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	st := r.leaseStatusAtRLocked(r.Clock().NowAsClockTimestamp(), ba.Timestamp)
+	if ba.IsSingleSkipsLeaseCheckRequest() {
+		return st, nil
+	}
+	if !st.IsValid() || !st.OwnedBy(r.store.StoreID()) {
+		if r.canServeFollowerReadRLocked(ba) {
+			return kvserverpb.LeaseStatus{}, nil
+		}
+		return kvserverpb.LeaseStatus{}, kvpb.NewNotLeaseHolderError(st.Lease, r.store.StoreID(), r.mu.desc, "")
+	}
+	return st, nil
+}
+
+// collectSpans collects the latch and lock spans declared by the requests of
+// the batch.
+func (r *Replica) collectSpans(ba *kvpb.BatchRequest) (*spanset.SpanSet, *lockspanset.LockSpanSet) {
+	latchSpans, lockSpans := spanset.New(), lockspanset.New()
+	for _, union := range ba.Requests {
+		inner := union.GetInner()
+		if cmd, ok := batcheval.LookupCommand(inner.Method()); ok && cmd.DeclareKeys != nil {
+			cmd.DeclareKeys(&ba.Header, inner, latchSpans, lockSpans)
+		}
+	}
+	return latchSpans, lockSpans
+}
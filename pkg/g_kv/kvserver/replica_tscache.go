@@ -0,0 +1,88 @@
+package kvserver
+
+import (
+	"context"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/uuid"
+)
+
+// updateTimestampCache updates the timestamp cache in order to set a low
+// water mark for the timestamp at which mutations to keys overlapping the
+// provided request spans may be committed.
+func (r *Replica) updateTimestampCache(
+	ctx context.Context, ba *kvpb.BatchRequest, br *kvpb.BatchResponse,
+) {
+	tc := r.store.tsCache
+	var txnID uuid.UUID
+	if ba.Txn != nil {
+		txnID = ba.Txn.ID
+	}
+	for i, union := range ba.Requests {
+		args := union.GetInner()
+		if !kvpb.UpdatesTimestampCache(args) {
+			continue
+		}
+		header := args.Header()
+		switch t := args.(type) {
+		case *kvpb.QueryIntentRequest:
+			if br.Responses[i].GetInner().(*kvpb.QueryIntentResponse).FoundIntent {
+				continue
+			}
+			// The intent is missing. Bump the timestamp cache over the key
+			// up to the queried transaction's provisional commit timestamp,
+			// so that the intent can no longer be written at or below it.
+			// The entry belongs to no transaction, so that the queried
+			// transaction's own write is pushed as well.
+			tc.Add(header.Key, header.EndKey, t.Txn.WriteTimestamp, uuid.Nil)
+		default:
+			tc.Add(header.Key, header.EndKey, ba.Timestamp, txnID)
+		}
+	}
+}
+
+// applyTimestampCache moves the batch's write timestamp forward, if
+// necessary, to be above the timestamps at which the keys that it writes
+// were read by other transactions, as recorded in the timestamp cache.
+// Reads by the batch's own transaction do not push its writes.
+//
+// The returned batch is a copy of the provided one if its timestamp was
+// pushed. For a transactional batch, the transaction's write timestamp is
+// pushed, which prevents it from committing in one phase and, for
+// serializable transactions, requires a refresh of its reads to commit.
+func (r *Replica) applyTimestampCache(ctx context.Context, ba *kvpb.BatchRequest) *kvpb.BatchRequest {
+	tc := r.store.tsCache
+	copied := false
+	for _, union := range ba.Requests {
+		args := union.GetInner()
+		if !kvpb.AppliesTimestampCache(args) {
+			continue
+		}
+		header := args.Header()
+		rTS, rTxnID := tc.GetMax(header.Key, header.EndKey)
+		if ba.Txn != nil && rTxnID == ba.Txn.ID {
+			continue
+		}
+		nextTS := rTS.Next()
+		if ba.Txn != nil {
+			if !ba.Txn.WriteTimestamp.Less(nextTS) {
+				continue
+			}
+			if !copied {
+				ba = ba.ShallowCopy()
+				ba.Txn = ba.Txn.Clone()
+				copied = true
+			}
+			ba.Txn.WriteTimestamp.Forward(nextTS)
+		} else {
+			if !ba.Timestamp.Less(nextTS) {
+				continue
+			}
+			if !copied {
+				ba = ba.ShallowCopy()
+				copied = true
+			}
+			ba.Timestamp.Forward(nextTS)
+		}
+	}
+	return ba
+}
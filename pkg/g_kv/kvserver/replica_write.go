@@ -0,0 +1,299 @@
+package kvserver
+
+import (
+	"context"
+	keys "github.com/dborchard/tiny_crdb/pkg/g_keys"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/batcheval"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/batcheval/result"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/concurrency"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/kvserverpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/spanset"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	storage "github.com/dborchard/tiny_crdb/pkg/h_storage"
+	"github.com/dborchard/tiny_crdb/pkg/h_storage/enginepb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+)
+
+// executeWriteBatch is the execution logic for client requests which may
+// mutate the range's replicated state. Requests taking this path are
+// evaluated into a batch of writes, which is proposed to the range's Raft
+// group along with its effect on the range's MVCCStats, and with the sequence
+// of the lease under which it was evaluated. The request returns once the
+// command has applied on the replica.
+//
+// The batch's write timestamp is first moved above the timestamp cache, so
+// that it does not invalidate reads performed by other transactions, and
+// above the closed timestamp of the range, so that it does not invalidate
+// follower reads. It is tracked until proposed, so that the leaseholder does
+// not close a timestamp at or above it in the meantime. The
+// replication is tracked by the replica's circuit breaker: if it gets stuck,
+// the breaker trips and the latches of the request are poisoned.
+func (r *Replica) executeWriteBatch(
+	ctx context.Context, ba *kvpb.BatchRequest, g *concurrency.Guard, st kvserverpb.LeaseStatus,
+) (*kvpb.BatchResponse, *kvpb.Error) {
+	return r.breaker.execute(ctx, func(ctx context.Context) (*kvpb.BatchResponse, *kvpb.Error) {
+		untrack := r.breaker.trackProposal(func() { r.concMgr.PoisonReq(g) })
+		defer untrack()
+
+		ba := r.applyTimestampCache(ctx, ba)
+		ba, untrackWrite := r.trackWriteAboveClosedTimestamp(ba)
+		defer untrackWrite()
+		release, rightAppliedIndex, err := r.maybeFreezeRightHandSide(ctx, ba)
+		if err != nil {
+			return nil, kvpb.NewError(err)
+		}
+		defer release()
+		batch, br, res, pErr := evaluateWriteBatch(ctx, r.store.Engine(), r, ba, g)
+		if pErr != nil {
+			return nil, pErr
+		}
+		defer batch.Close()
+		if res.Replicated.Merge != nil {
+			res.Replicated.Merge.RightAppliedIndex = rightAppliedIndex
+		}
+		if res.Replicated.Delta, err = r.computeStatsDelta(ctx, batch, g, res); err != nil {
+			return nil, kvpb.NewError(err)
+		}
+		p, err := r.propose(&kvserverpb.RaftCommand{
+			ProposerLeaseSequence: st.Lease.Sequence,
+			ReplicatedEvalResult:  res.Replicated,
+			WriteBatch:            batch.Repr(),
+			LogicalOpLog:          res.LogicalOpLog,
+		})
+		// The closed timestamps carried by the command and by the later ones
+		// apply after the write.
+		untrackWrite()
+		if err != nil {
+			return nil, kvpb.NewError(err)
+		}
+		if err := r.waitForProposal(ctx, p); err != nil {
+			return nil, kvpb.NewError(err)
+		}
+		if ba.Txn == nil {
+			br.Timestamp = ba.Timestamp
+		}
+		r.handleLocalResult(ctx, res.Local)
+		r.updateTimestampCache(ctx, ba, br)
+		return br, nil
+	})
+}
+
+// computeStatsDelta computes the effect of the evaluated batch on the range's
+// MVCCStats, by comparing the engine with the batch over the spans that the
+// batch may have written within the range: the spans on which it holds write
+// latches, and the spans of the locks that it resolved. The stats of the
+// ranges involved in a split or a merge are split or combined when the
+// command applies.
+func (r *Replica) computeStatsDelta(
+	ctx context.Context, batch storage.Batch, g *concurrency.Guard, res result.Result,
+) (enginepb.MVCCStats, error) {
+	desc := r.Desc()
+	if res.Replicated.Merge != nil {
+		// The batch may write the data of the subsumed range.
+		desc = &res.Replicated.Merge.LeftDesc
+	}
+	var spans []roachpb.Span
+	for _, span := range g.Req.LatchSpans.GetSpans(spanset.SpanReadWrite) {
+		spans = append(spans, span.Span)
+	}
+	for _, up := range res.Local.ResolvedLocks {
+		spans = append(spans, up.Span)
+	}
+	nowNanos := r.Clock().Now().WallTime
+	var delta enginepb.MVCCStats
+	for _, span := range clipSpans(roachpb.MergeSpans(spans), rangeDataSpans(desc)) {
+		before, err := storage.ComputeStats(ctx, r.store.Engine(), span.Key, span.EndKey, nowNanos)
+		if err != nil {
+			return enginepb.MVCCStats{}, err
+		}
+		after, err := storage.ComputeStats(ctx, batch, span.Key, span.EndKey, nowNanos)
+		if err != nil {
+			return enginepb.MVCCStats{}, err
+		}
+		delta.Add(after)
+		delta.Subtract(before)
+	}
+	// The evaluation time is recorded even if the batch did not change the
+	// stats, as it is the time at which the stats of a split's right-hand
+	// side are computed.
+	delta.LastUpdateNanos = nowNanos
+	return delta, nil
+}
+
+// clipSpans returns the parts of the spans which fall within the bounds.
+// Point spans, without an end key, are treated as spans of a single key.
+func clipSpans(spans, bounds []roachpb.Span) []roachpb.Span {
+	var clipped []roachpb.Span
+	for _, span := range spans {
+		end := span.EndKey
+		if len(end) == 0 {
+			end = span.Key.Next()
+		}
+		for _, b := range bounds {
+			start := span.Key
+			if start.Compare(b.Key) < 0 {
+				start = b.Key
+			}
+			clippedEnd := end
+			if clippedEnd.Compare(b.EndKey) > 0 {
+				clippedEnd = b.EndKey
+			}
+			if start.Compare(clippedEnd) < 0 {
+				clipped = append(clipped, roachpb.Span{Key: start, EndKey: clippedEnd})
+			}
+		}
+	}
+	return clipped
+}
+
+// handleLocalResult informs the concurrency manager and the txnWaitQueue of
+// the locks acquired and resolved, and of the transaction records updated by
+// an evaluated batch. The locks of finalized transactions held on other
+// ranges are resolved asynchronously.
+func (r *Replica) handleLocalResult(ctx context.Context, lResult result.LocalResult) {
+	for i := range lResult.AcquiredLocks {
+		r.concMgr.OnLockAcquired(ctx, &lResult.AcquiredLocks[i])
+	}
+	for i := range lResult.ResolvedLocks {
+		r.concMgr.OnLockUpdated(ctx, &lResult.ResolvedLocks[i])
+	}
+	for _, txn := range lResult.UpdatedTxns {
+		r.txnWaitQueue.UpdateTxn(ctx, txn)
+	}
+	if len(lResult.ExternalLocks) > 0 {
+		r.store.intentResolver.ResolveIntentsAsync(ctx, lResult.ExternalLocks)
+	}
+}
+
+// evaluateWriteBatch evaluates the supplied batch into a new storage.Batch,
+// which the caller applies atomically. The logical MVCC operations performed
+// by the batch are logged in the result, to feed the rangefeeds of the range
+// once the batch applies. They are logged whether or not the range has
+// rangefeeds, so that a rangefeed started while the batch is in flight sees
+// them.
+//
+// If the batch is transactional and has all the hallmarks of a 1PC commit
+// (i.e. includes all intent writes & EndTxn, and there's nothing to suggest
+// that the transaction will require retry or restart), the batch's txn is
+// stripped and it's executed as an atomic batch write. If the writes cannot
+// all be completed at the intended timestamp, the batch's txn is restored
+// and it's re-executed in full. This allows it to lay down intents and return
+// an appropriate retryable error.
+func evaluateWriteBatch(
+	ctx context.Context,
+	eng storage.Engine,
+	evalCtx batcheval.EvalContext,
+	ba *kvpb.BatchRequest,
+	g *concurrency.Guard,
+) (storage.Batch, *kvpb.BatchResponse, result.Result, *kvpb.Error) {
+	if isOnePhaseCommit(ba) {
+		batch, br, res, ok := evaluate1PC(ctx, eng, evalCtx, ba, g)
+		if ok {
+			return batch, br, res, nil
+		}
+	}
+
+	batch := storage.NewOpLoggerBatch(eng.NewBatch())
+	br, res, pErr := evaluateBatch(ctx, batch, evalCtx, ba, g)
+	if pErr != nil {
+		batch.Close()
+		return nil, nil, result.Result{}, pErr
+	}
+	res.LogicalOpLog = &kvserverpb.LogicalOpLog{Ops: batch.LogicalOps()}
+	return batch, br, res, nil
+}
+
+// isOnePhaseCommit returns true iff the BatchRequest contains all writes in
+// the transaction and ends with an EndTxn. One phase commits are disallowed
+// if any of the following conditions are true:
+//   - the transaction has already been restarted, since it may have left
+//     intents at an earlier epoch which would not be resolved.
+//   - the transaction's commit would trigger a retry error, or the
+//     transaction's deadline has been exceeded.
+//   - the transaction's write timestamp has moved above its read timestamp:
+//     the writes would then be applied without checking for conflicting
+//     writes between the two timestamps.
+//   - the EndTxn carries a commit trigger, which runs as part of the
+//     regular evaluation of the EndTxn.
+func isOnePhaseCommit(ba *kvpb.BatchRequest) bool {
+	if ba.Txn == nil {
+		return false
+	}
+	if !ba.IsCompleteTransaction() {
+		return false
+	}
+	arg, _ := ba.GetArg(kvpb.EndTxn)
+	etArg := arg.(*kvpb.EndTxnRequest)
+	if etArg.InternalCommitTrigger != nil {
+		return false
+	}
+	if batcheval.IsEndTxnExceedingDeadline(ba.Txn.WriteTimestamp, etArg.Deadline) {
+		return false
+	}
+	if retry, _, _ := batcheval.IsEndTxnTriggeringRetryError(ba.Txn); retry {
+		return false
+	}
+	return ba.Txn.Epoch == 0 && ba.Txn.ReadTimestamp == ba.Txn.WriteTimestamp
+}
+
+// evaluate1PC attempts to evaluate the batch as a 1PC transaction - meaning
+// it attempts to evaluate the batch as a non-transactional request. This is
+// only possible if the batch contains all of the transaction's writes, which
+// the caller must ensure. If successful, evaluating the batch this way is
+// more efficient - we're avoiding writing the transaction record and writing
+// and then resolving intents.
+//
+// The returned boolean is false if the batch could not be evaluated in one
+// phase, in which case it needs to be evaluated as a regular transactional
+// batch.
+func evaluate1PC(
+	ctx context.Context,
+	eng storage.Engine,
+	evalCtx batcheval.EvalContext,
+	ba *kvpb.BatchRequest,
+	g *concurrency.Guard,
+) (storage.Batch, *kvpb.BatchResponse, result.Result, bool) {
+	// A transaction with a record may have been aborted by a pusher, or may
+	// be heartbeated concurrently. It must go through the regular path, which
+	// consults and updates its record.
+	var record roachpb.Transaction
+	txnKey := keys.TransactionKey(ba.Txn.Key, ba.Txn.ID)
+	if ok, err := storage.MVCCGetProto(
+		ctx, eng, txnKey, hlc.Timestamp{}, &record, storage.MVCCGetOptions{},
+	); err != nil || ok {
+		return nil, nil, result.Result{}, false
+	}
+
+	// Strip the EndTxn and evaluate the rest of the batch non-transactionally
+	// at the transaction's commit timestamp. The writes are performed without
+	// intents, so there is nothing to resolve.
+	strippedBa := ba.ShallowCopy()
+	strippedBa.Requests = ba.Requests[:len(ba.Requests)-1]
+	strippedBa.Txn = nil
+	strippedBa.Timestamp = ba.Txn.WriteTimestamp
+
+	batch := storage.NewOpLoggerBatch(eng.NewBatch())
+	br, res, pErr := evaluateBatch(ctx, batch, evalCtx, strippedBa, g)
+	if pErr != nil {
+		// The writes could not all be performed at the intended timestamp,
+		// for instance because of a conflicting intent or a newer committed
+		// value. Fall back to the transactional path, which returns an error
+		// that the transaction knows how to handle.
+		batch.Close()
+		return nil, nil, result.Result{}, false
+	}
+
+	// Add a placeholder response for the EndTxn, carrying the committed
+	// transaction.
+	clonedTxn := ba.Txn.Clone()
+	clonedTxn.Status = roachpb.COMMITTED
+	br.Add(&kvpb.EndTxnResponse{
+		ResponseHeader: kvpb.ResponseHeader{Txn: clonedTxn},
+		OnePhaseCommit: true,
+	})
+	br.Txn = clonedTxn
+	res.Local.UpdatedTxns = append(res.Local.UpdatedTxns, clonedTxn)
+	res.LogicalOpLog = &kvserverpb.LogicalOpLog{Ops: batch.LogicalOps()}
+	return batch, br, res, true
+}
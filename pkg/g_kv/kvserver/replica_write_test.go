@@ -0,0 +1,116 @@
+package kvserver
+
+import (
+	"context"
+	keys "github.com/dborchard/tiny_crdb/pkg/g_keys"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/batcheval"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/concurrency/isolation"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	storage "github.com/dborchard/tiny_crdb/pkg/h_storage"
+	"github.com/dborchard/tiny_crdb/pkg/h_storage/enginepb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+// makeTxnBatch returns a batch in which txn writes each of the keys and then
+// commits, with sequence numbers assigned as a transaction coordinator would.
+// If skipSeq is set, the sequence number of the first write is skipped, as if
+// the transaction had written in an earlier batch.
+func makeTxnBatch(txn *roachpb.Transaction, skipSeq bool, writes ...string) *kvpb.BatchRequest {
+	ba := &kvpb.BatchRequest{}
+	ba.Txn = txn
+	ba.Timestamp = txn.ReadTimestamp
+	seq := enginepb.TxnSeq(0)
+	if skipSeq {
+		seq++
+	}
+	var lockSpans []roachpb.Span
+	for _, k := range writes {
+		seq++
+		lockSpans = append(lockSpans, roachpb.Span{Key: roachpb.Key(k)})
+		ba.Add(&kvpb.PutRequest{
+			RequestHeader: kvpb.RequestHeader{Key: roachpb.Key(k), Sequence: seq},
+			Value:         roachpb.MakeValueFromString(k),
+		})
+	}
+	seq++
+	ba.Add(&kvpb.EndTxnRequest{
+		RequestHeader: kvpb.RequestHeader{Key: txn.Key, Sequence: seq},
+		Commit:        true,
+		LockSpans:     lockSpans,
+	})
+	return ba
+}
+
+// TestEvaluateWriteBatchOnePhaseCommit verifies that a batch containing all
+// of a transaction's writes is committed in one phase, without intents or a
+// transaction record, and that other batches, or batches whose writes
+// conflict, are evaluated transactionally.
+func TestEvaluateWriteBatchOnePhaseCommit(t *testing.T) {
+	ctx := context.Background()
+	clock := hlc.NewClock(hlc.UnixNano, time.Nanosecond)
+	evalCtx := (&batcheval.MockEvalCtx{Clock: clock}).EvalContext()
+
+	testCases := []struct {
+		name    string
+		skipSeq bool
+		// conflict, if set, writes a newer committed value to the first key
+		// before the batch is evaluated.
+		conflict  bool
+		expect1PC bool
+		expectErr bool
+	}{
+		{name: "complete transaction", expect1PC: true},
+		{name: "incomplete transaction", skipSeq: true},
+		{name: "conflict", conflict: true, expectErr: true},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			eng, err := storage.Open(ctx, storage.Location{})
+			require.NoError(t, err)
+			defer eng.Close()
+
+			txn := roachpb.MakeTransaction("test", roachpb.Key("a"), isolation.Serializable,
+				roachpb.NormalUserPriority, clock.Now())
+			if c.conflict {
+				require.NoError(t, storage.MVCCPut(ctx, eng, roachpb.Key("a"), clock.Now(),
+					roachpb.MakeValueFromString("other"), storage.MVCCWriteOptions{}))
+			}
+
+			ba := makeTxnBatch(&txn, c.skipSeq, "a", "b")
+			batch, br, _, pErr := evaluateWriteBatch(ctx, eng, evalCtx, ba, nil /* g */)
+			if c.expectErr {
+				require.NotNil(t, pErr)
+				require.IsType(t, &kvpb.WriteTooOldError{}, pErr.GetDetail())
+				return
+			}
+			require.Nil(t, pErr)
+			require.NoError(t, batch.Commit(false /* sync */))
+			batch.Close()
+
+			require.Equal(t, roachpb.COMMITTED, br.Txn.Status)
+			etResp := br.Responses[len(br.Responses)-1].GetInner().(*kvpb.EndTxnResponse)
+			require.Equal(t, c.expect1PC, etResp.OnePhaseCommit)
+
+			// The transaction record is only written by the transactional path.
+			var record roachpb.Transaction
+			ok, err := storage.MVCCGetProto(ctx, eng, keys.TransactionKey(txn.Key, txn.ID),
+				hlc.Timestamp{}, &record, storage.MVCCGetOptions{})
+			require.NoError(t, err)
+			require.Equal(t, !c.expect1PC, ok)
+
+			// Either way, the writes are committed and have no intents.
+			for _, k := range []string{"a", "b"} {
+				res, err := storage.MVCCGet(ctx, eng, roachpb.Key(k), clock.Now(), storage.MVCCGetOptions{})
+				require.NoError(t, err)
+				require.NotNil(t, res.Value)
+				meta, err := storage.MVCCGetIntentMeta(ctx, eng, roachpb.Key(k))
+				require.NoError(t, err)
+				require.Nil(t, meta)
+			}
+		})
+	}
+}
@@ -0,0 +1,263 @@
+// Package spanlatch provides a latch management structure for serializing
+// access to keys and key ranges. Latch acquisitions affecting keys or key
+// ranges must wait on already-acquired latches which overlap their key
+// ranges to be released.
+//
+// The evolution of complexity can best be understood as a series of
+// incremental changes, each in the name of increased lock granularity to
+// reduce contention and enable more concurrency between requests. The
+// structure can trace its lineage back to a simple sync.Mutex. From there,
+// the structure evolved through the following progression:
+//
+//   - The structure began by enforcing strict mutual exclusion for access to
+//     any keys. Conceptually, it was a sync.Mutex.
+//   - Concurrent read-only access to keys and key ranges was permitted. Read
+//     and writes were serialized with each other, writes were serialized
+//     with each other, but no ordering was enforced between reads.
+//     Conceptually, the structure became a sync.RWMutex.
+//   - The structure became key range-aware and concurrent access to
+//     non-overlapping key ranges was permitted. Conceptually, the structure
+//     became an interval tree of sync.RWMutexes.
+//   - The structure became timestamp-aware and concurrent access of
+//     non-causal read and write pairs was permitted. The effect of this was
+//     that reads no longer waited for writes at higher timestamps and writes
+//     no longer waited for reads at lower timestamps.
+//   - The latches of requests that are not expected to complete in a timely
+//     manner, such as those of requests stuck on an unavailable range, can
+//     be poisoned. Waiters then either fail fast or keep waiting, depending
+//     on their poison.Policy.
+package spanlatch
+
+import (
+	"context"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/concurrency/poison"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/spanset"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"sync"
+)
+
+// A Manager maintains a set of key and key range latches. Latch
+// acquisitions affecting keys or key ranges must wait on already-acquired
+// latches which overlap their key range to be released.
+//
+// Latch acquisition attempts invoke Manager.Acquire and provide details about
+// the spans that they plan to touch and the timestamps they plan to touch
+// them at. Acquire inserts the latch into the Manager's set of latches and
+// then waits on all prior latches that overlap with it and are incompatible
+// with it. Once it has done so, the latches are held and Acquire returns a
+// Guard that must be provided to Release.
+//
+// Because latches are inserted atomically and only wait on the latches that
+// were inserted before them, latch acquisition is fair: conflicting requests
+// are granted their latches in the order in which they called Acquire, and
+// the sequencing can never deadlock.
+//
+// The zero value of a Manager is ready for use.
+type Manager struct {
+	mu struct {
+		sync.Mutex
+		// latches contains the latches held or being acquired, in insertion
+		// order, indexed by access.
+		latches [spanset.NumSpanAccess][]*latch
+	}
+}
+
+// latch is a single latch on a span, held at a given timestamp.
+type latch struct {
+	span roachpb.Span
+	ts   hlc.Timestamp
+	// done is closed when the latch's Guard is released.
+	done chan struct{}
+	// poisoned is closed when the latch's Guard is poisoned.
+	poisoned chan struct{}
+}
+
+// Guard is a handle to a set of acquired latches. It is returned by
+// Manager.Acquire and accepted by Manager.Release.
+type Guard struct {
+	done     chan struct{}
+	poisoned chan struct{}
+	// poisonOnce ensures that poisoned is closed at most once.
+	poisonOnce sync.Once
+	// pp is the poison policy of the request that acquired the latches.
+	pp      poison.Policy
+	latches [spanset.NumSpanAccess][]*latch
+}
+
+// Make returns an initialized Manager.
+func Make() Manager {
+	return Manager{}
+}
+
+// Acquire acquires latches from the Manager for each of the provided spans,
+// at the specified timestamp. In doing so, it waits for latches over all
+// overlapping spans to be released before returning. If the provided context
+// is canceled before the method is done waiting for overlapping latches to be
+// released, it stops waiting, releases all latches that it has already
+// acquired, and returns the context's error.
+//
+// The poison policy determines how the acquisition reacts to a poisoned
+// latch among those it waits on: with poison.Policy_Error, it stops waiting,
+// releases its latches and returns a *poison.PoisonedError; with
+// poison.Policy_Wait, it keeps waiting but poisons its own latches, so that
+// the poisoning propagates to the requests waiting on it.
+//
+// It returns a Guard which must be provided to Release.
+func (m *Manager) Acquire(
+	ctx context.Context, spans *spanset.SpanSet, pp poison.Policy,
+) (*Guard, error) {
+	lg, prereqs := m.sequence(spans, pp)
+	if err := m.wait(ctx, lg, prereqs); err != nil {
+		m.Release(lg)
+		return nil, err
+	}
+	return lg, nil
+}
+
+// sequence inserts the latches of the provided SpanSet into the Manager and
+// returns the previously inserted latches that they conflict with and must
+// wait on.
+func (m *Manager) sequence(spans *spanset.SpanSet, pp poison.Policy) (*Guard, []*latch) {
+	lg := &Guard{done: make(chan struct{}), poisoned: make(chan struct{}), pp: pp}
+	for sa := spanset.SpanAccess(0); sa < spanset.NumSpanAccess; sa++ {
+		for _, s := range spans.GetSpans(sa) {
+			lg.latches[sa] = append(lg.latches[sa], &latch{
+				span: s.Span, ts: s.Timestamp, done: lg.done, poisoned: lg.poisoned,
+			})
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var prereqs []*latch
+	for sa := spanset.SpanAccess(0); sa < spanset.NumSpanAccess; sa++ {
+		for _, l := range lg.latches[sa] {
+			for sa2 := spanset.SpanAccess(0); sa2 < spanset.NumSpanAccess; sa2++ {
+				for _, other := range m.mu.latches[sa2] {
+					if conflicts(sa, l, sa2, other) {
+						prereqs = append(prereqs, other)
+					}
+				}
+			}
+		}
+	}
+	for sa := spanset.SpanAccess(0); sa < spanset.NumSpanAccess; sa++ {
+		m.mu.latches[sa] = append(m.mu.latches[sa], lg.latches[sa]...)
+	}
+	return lg, prereqs
+}
+
+// conflicts returns whether latch l, with access sa, must wait on the
+// previously inserted latch other, with access sa2.
+//
+// Reads do not conflict with reads. Writes conflict with writes on
+// overlapping spans regardless of their timestamps. A read and a write
+// conflict if the write is at or below the read's timestamp, as the read
+// must observe the write; a read at a lower timestamp than a write does not
+// need to wait for it, and vice versa. Non-MVCC latches (zero timestamp)
+// conflict with all latches of the other access on overlapping spans.
+func conflicts(sa spanset.SpanAccess, l *latch, sa2 spanset.SpanAccess, other *latch) bool {
+	if sa == spanset.SpanReadOnly && sa2 == spanset.SpanReadOnly {
+		return false
+	}
+	if !l.span.Overlaps(other.span) {
+		return false
+	}
+	if sa == spanset.SpanReadWrite && sa2 == spanset.SpanReadWrite {
+		return true
+	}
+	if l.ts.IsEmpty() || other.ts.IsEmpty() {
+		return true
+	}
+	read, write := l, other
+	if sa == spanset.SpanReadWrite {
+		read, write = other, l
+	}
+	return write.ts.LessEq(read.ts)
+}
+
+// wait waits for all prerequisite latches to be released, reacting to
+// poisoned latches according to the poison policy of the waiting Guard.
+func (m *Manager) wait(ctx context.Context, lg *Guard, prereqs []*latch) error {
+	for _, p := range prereqs {
+		if err := m.waitForLatch(ctx, lg, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// waitForLatch waits for a single prerequisite latch to be released.
+func (m *Manager) waitForLatch(ctx context.Context, lg *Guard, p *latch) error {
+	poisonCh := p.poisoned
+	for {
+		select {
+		case <-p.done:
+			return nil
+		case <-poisonCh:
+			// The latch may have been released after being poisoned, in which
+			// case there is nothing left to wait for.
+			select {
+			case <-p.done:
+				return nil
+			default:
+			}
+			switch lg.pp {
+			case poison.Policy_Error:
+				return poison.NewPoisonedError(p.span, p.ts)
+			case poison.Policy_Wait:
+				m.Poison(lg)
+				// Keep waiting for the latch to be released, without
+				// reacting to its poisoning again.
+				poisonCh = nil
+			default:
+				panic("unknown poison policy")
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Poison marks the Guard's latches as poisoned, indicating that the request
+// holding them is not expected to release them in a timely manner. Requests
+// waiting on, or later sequenced behind, these latches react according to
+// their poison.Policy. Poison is idempotent.
+func (m *Manager) Poison(lg *Guard) {
+	lg.poisonOnce.Do(func() {
+		close(lg.poisoned)
+	})
+}
+
+// Poisoned returns whether the Guard's latches have been poisoned.
+func (lg *Guard) Poisoned() bool {
+	select {
+	case <-lg.poisoned:
+		return true
+	default:
+		return false
+	}
+}
+
+// Release releases the latches held by the provided Guard. After being
+// called, dependent latch acquisition attempts can complete if not blocked
+// on any other owned latches.
+func (m *Manager) Release(lg *Guard) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for sa := spanset.SpanAccess(0); sa < spanset.NumSpanAccess; sa++ {
+		latches := m.mu.latches[sa][:0]
+		for _, l := range m.mu.latches[sa] {
+			if l.done != lg.done {
+				latches = append(latches, l)
+			}
+		}
+		// Clear the tail so released latches can be garbage collected.
+		for i := len(latches); i < len(m.mu.latches[sa]); i++ {
+			m.mu.latches[sa][i] = nil
+		}
+		m.mu.latches[sa] = latches
+	}
+	close(lg.done)
+}
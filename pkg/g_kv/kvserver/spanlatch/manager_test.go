@@ -0,0 +1,145 @@
+package spanlatch
+
+import (
+	"context"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/concurrency/poison"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/spanset"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func spans(access spanset.SpanAccess, key, endKey string, ts int64) *spanset.SpanSet {
+	s := spanset.New()
+	span := roachpb.Span{Key: roachpb.Key(key)}
+	if endKey != "" {
+		span.EndKey = roachpb.Key(endKey)
+	}
+	s.AddMVCC(access, span, hlc.Timestamp{WallTime: ts})
+	return s
+}
+
+// acquireAsync acquires latches in a goroutine and returns a channel that
+// receives the guard once they are acquired.
+func acquireAsync(m *Manager, s *spanset.SpanSet) <-chan *Guard {
+	ch := make(chan *Guard, 1)
+	go func() {
+		lg, err := m.Acquire(context.Background(), s, poison.Policy_Wait)
+		if err == nil {
+			ch <- lg
+		}
+	}()
+	return ch
+}
+
+// acquireAsyncWithPolicy is like acquireAsync, but acquires the latches with
+// the provided poison policy and returns the acquisition's error instead.
+func acquireAsyncWithPolicy(m *Manager, s *spanset.SpanSet, pp poison.Policy) <-chan error {
+	ch := make(chan error, 1)
+	go func() {
+		lg, err := m.Acquire(context.Background(), s, pp)
+		if err == nil {
+			m.Release(lg)
+		}
+		ch <- err
+	}()
+	return ch
+}
+
+func requireBlocked(t *testing.T, ch <-chan *Guard) {
+	select {
+	case <-ch:
+		t.Fatal("latch acquisition unexpectedly succeeded")
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func requireAcquired(t *testing.T, ch <-chan *Guard) *Guard {
+	select {
+	case lg := <-ch:
+		return lg
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for latches")
+		return nil
+	}
+}
+
+func TestLatchManagerConflicts(t *testing.T) {
+	ctx := context.Background()
+	var m Manager
+
+	// A write latch at ts 10 on [a, c).
+	wg, err := m.Acquire(ctx, spans(spanset.SpanReadWrite, "a", "c", 10), poison.Policy_Wait)
+	require.NoError(t, err)
+
+	// Reads below the write do not wait, nor do non-overlapping writes.
+	lg := requireAcquired(t, acquireAsync(&m, spans(spanset.SpanReadOnly, "b", "", 9)))
+	m.Release(lg)
+	lg = requireAcquired(t, acquireAsync(&m, spans(spanset.SpanReadWrite, "c", "", 5)))
+	m.Release(lg)
+
+	// Reads at or above the write and overlapping writes wait.
+	readCh := acquireAsync(&m, spans(spanset.SpanReadOnly, "b", "", 10))
+	writeCh := acquireAsync(&m, spans(spanset.SpanReadWrite, "a", "", 20))
+	requireBlocked(t, readCh)
+	requireBlocked(t, writeCh)
+
+	m.Release(wg)
+	m.Release(requireAcquired(t, readCh))
+	m.Release(requireAcquired(t, writeCh))
+}
+
+func TestLatchManagerContextCancellation(t *testing.T) {
+	var m Manager
+	wg, err := m.Acquire(context.Background(), spans(spanset.SpanReadWrite, "a", "", 10), poison.Policy_Wait)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = m.Acquire(ctx, spans(spanset.SpanReadWrite, "a", "", 10), poison.Policy_Wait)
+	require.ErrorIs(t, err, context.Canceled)
+
+	// The canceled acquisition released its latches, so a later acquisition
+	// only waits on the first guard.
+	ch := acquireAsync(&m, spans(spanset.SpanReadWrite, "a", "", 10))
+	requireBlocked(t, ch)
+	m.Release(wg)
+	m.Release(requireAcquired(t, ch))
+}
+
+func TestLatchManagerPoison(t *testing.T) {
+	var m Manager
+	lg1, err := m.Acquire(context.Background(), spans(spanset.SpanReadWrite, "a", "", 10), poison.Policy_Wait)
+	require.NoError(t, err)
+
+	// A waiter with Policy_Wait queues behind the first guard, and a waiter
+	// with Policy_Error queues behind both.
+	waitCh := acquireAsync(&m, spans(spanset.SpanReadWrite, "a", "", 10))
+	requireBlocked(t, waitCh)
+	errCh := acquireAsyncWithPolicy(&m, spans(spanset.SpanReadWrite, "a", "", 10), poison.Policy_Error)
+
+	// Poisoning the first guard poisons the waiter with Policy_Wait, which
+	// keeps waiting; the poisoning propagates to the waiter with
+	// Policy_Error, which fails fast.
+	m.Poison(lg1)
+	m.Poison(lg1)
+	select {
+	case err := <-errCh:
+		require.True(t, poison.IsPoisonedError(err), "%v", err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for poisoned error")
+	}
+	requireBlocked(t, waitCh)
+
+	// Once the first guard is released, the waiter with Policy_Wait acquires
+	// its latches, which remain poisoned.
+	m.Release(lg1)
+	lg2 := requireAcquired(t, waitCh)
+	require.True(t, lg2.Poisoned())
+	m.Release(lg2)
+
+	// New acquisitions are not affected by released poisoned latches.
+	require.NoError(t, <-acquireAsyncWithPolicy(&m, spans(spanset.SpanReadWrite, "a", "", 10), poison.Policy_Error))
+}
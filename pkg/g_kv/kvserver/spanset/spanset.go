@@ -0,0 +1,103 @@
+// Package spanset provides SpanSet, the set of key spans, along with the
+// type of access and the timestamp of that access, declared by a request
+// before it is evaluated. SpanSets are used to acquire latches in the
+// spanlatch.Manager and to scan the lock table of the concurrency manager.
+package spanset
+
+import (
+	"fmt"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"strings"
+)
+
+// SpanAccess records the intended mode of access in a SpanSet.
+type SpanAccess int
+
+// Constants for SpanAccess. Higher-valued accesses imply lower-level ones.
+const (
+	SpanReadOnly SpanAccess = iota
+	SpanReadWrite
+	NumSpanAccess
+)
+
+// String returns a string representation of the SpanAccess.
+func (a SpanAccess) String() string {
+	switch a {
+	case SpanReadOnly:
+		return "read"
+	case SpanReadWrite:
+		return "write"
+	default:
+		panic("unreachable")
+	}
+}
+
+// Span is used to represent a keyspan accessed by a request at a given
+// timestamp. A zero timestamp indicates it's a non-MVCC access.
+type Span struct {
+	roachpb.Span
+	Timestamp hlc.Timestamp
+}
+
+// SpanSet tracks the set of key spans touched by a command, broken into
+// read-only and read-write sub-sets. The SpanSet is not thread-safe.
+type SpanSet struct {
+	spans [NumSpanAccess][]Span
+}
+
+// New creates a new empty SpanSet.
+func New() *SpanSet {
+	return &SpanSet{}
+}
+
+// String prints a string representation of the SpanSet.
+func (s *SpanSet) String() string {
+	var buf strings.Builder
+	for sa := SpanAccess(0); sa < NumSpanAccess; sa++ {
+		for _, cur := range s.GetSpans(sa) {
+			fmt.Fprintf(&buf, "%s: %s at %v\n", sa, cur.Span, cur.Timestamp)
+		}
+	}
+	return buf.String()
+}
+
+// Len returns the total number of spans tracked across all accesses.
+func (s *SpanSet) Len() int {
+	var count int
+	for sa := SpanAccess(0); sa < NumSpanAccess; sa++ {
+		count += len(s.spans[sa])
+	}
+	return count
+}
+
+// Empty returns whether the set contains any spans across all accesses.
+func (s *SpanSet) Empty() bool {
+	return s.Len() == 0
+}
+
+// Copy copies the SpanSet.
+func (s *SpanSet) Copy() *SpanSet {
+	n := &SpanSet{}
+	for sa := SpanAccess(0); sa < NumSpanAccess; sa++ {
+		n.spans[sa] = append(n.spans[sa], s.spans[sa]...)
+	}
+	return n
+}
+
+// AddNonMVCC adds a non-MVCC span to the span set. This should typically
+// be used for local keys, such as transaction records.
+func (s *SpanSet) AddNonMVCC(access SpanAccess, span roachpb.Span) {
+	s.AddMVCC(access, span, hlc.Timestamp{})
+}
+
+// AddMVCC adds an MVCC span to the span set to be accessed at the given
+// timestamp. This should typically be used for MVCC keys, such as user keys.
+func (s *SpanSet) AddMVCC(access SpanAccess, span roachpb.Span, timestamp hlc.Timestamp) {
+	s.spans[access] = append(s.spans[access], Span{Span: span, Timestamp: timestamp})
+}
+
+// GetSpans returns a slice of spans with the given parameters.
+func (s *SpanSet) GetSpans(access SpanAccess) []Span {
+	return s.spans[access]
+}
@@ -0,0 +1,85 @@
+package kvserver
+
+import (
+	"context"
+	keys "github.com/dborchard/tiny_crdb/pkg/g_keys"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+)
+
+// splitQueue manages a queue of ranges slated to be split, either because
+// their size exceeds StoreConfig.RangeMaxBytes, or because the rate of
+// requests they serve exceeds StoreConfig.SplitQPSThreshold.
+type splitQueue struct {
+	*baseQueue
+}
+
+// newSplitQueue returns a new instance of splitQueue.
+func newSplitQueue(store *Store) *splitQueue {
+	sq := &splitQueue{}
+	sq.baseQueue = newBaseQueue("split", sq, store, queueConfig{needsLease: true})
+	return sq
+}
+
+// shouldQueue determines whether a range should be queued for splitting. The
+// priority is the factor by which the range exceeds the larger of its
+// thresholds.
+func (sq *splitQueue) shouldQueue(ctx context.Context, repl *Replica) (bool, float64) {
+	if !canSplit(repl.Desc()) {
+		return false, 0
+	}
+	sizeRatio := float64(repl.GetMVCCStats().Total()) / float64(sq.store.cfg.RangeMaxBytes)
+	qpsRatio := repl.load.QPS() / sq.store.cfg.SplitQPSThreshold
+	priority := sizeRatio
+	if qpsRatio > priority {
+		priority = qpsRatio
+	}
+	return priority > 1, priority
+}
+
+// process splits the range if it is too large, at the midpoint of its data,
+// or if it serves too many requests, at the median of the keys it serves.
+func (sq *splitQueue) process(ctx context.Context, repl *Replica) (bool, error) {
+	desc := repl.Desc()
+	var splitKey roachpb.Key
+	if repl.GetMVCCStats().Total() > sq.store.cfg.RangeMaxBytes {
+		var err error
+		if splitKey, err = repl.findSplitKey(ctx); err != nil {
+			return false, err
+		}
+		if splitKey == nil {
+			// The range holds a single, large row.
+			return false, nil
+		}
+	} else if repl.load.QPS() > sq.store.cfg.SplitQPSThreshold {
+		loadKey := repl.load.splitKey()
+		if loadKey == nil {
+			return false, nil
+		}
+		var err error
+		if splitKey, err = keys.EnsureSafeSplitKey(loadKey.AsRawKey()); err != nil {
+			return false, err
+		}
+		// The load may be concentrated on the first row of the range, which
+		// cannot be split off any further.
+		if !keys.IsValidSplitKey(splitKey) || !desc.StartKey.Less(roachpb.RKey(splitKey)) ||
+			!desc.ContainsKey(roachpb.RKey(splitKey)) {
+			return false, nil
+		}
+	} else {
+		return false, nil
+	}
+	if _, pErr := repl.AdminSplit(ctx, kvpb.AdminSplitRequest{
+		RequestHeader: kvpb.RequestHeader{Key: splitKey},
+		SplitKey:      splitKey,
+	}); pErr != nil {
+		return false, pErr.GoError()
+	}
+	return true, nil
+}
+
+// canSplit returns whether the range may be split. The meta range holds the
+// meta1 and meta2 records, which must stay in a single range.
+func canSplit(desc *roachpb.RangeDescriptor) bool {
+	return roachpb.RKey(keys.MetaMax).Less(desc.EndKey)
+}
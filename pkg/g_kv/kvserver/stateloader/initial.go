@@ -0,0 +1,43 @@
+package stateloader
+
+import (
+	"context"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/kvserverpb"
+	storage "github.com/dborchard/tiny_crdb/pkg/h_storage"
+	"github.com/dborchard/tiny_crdb/pkg/h_storage/enginepb"
+	"go.etcd.io/raft/v3/raftpb"
+)
+
+const (
+	// RaftInitialLogIndex is the starting point for the raft log. We bootstrap
+	// the raft membership by synthesizing a snapshot as if there were some
+	// discarded prefix to the log, so we must begin the log at an arbitrary
+	// index greater than 1.
+	RaftInitialLogIndex = 10
+	// RaftInitialLogTerm is the starting term for the raft log.
+	RaftInitialLogTerm = 5
+)
+
+// WriteInitialRangeState writes the initial Raft state of a new range,
+// created by the bootstrap of a cluster or by a split: its log is empty, as
+// if the entries up to RaftInitialLogIndex had been applied and truncated,
+// and all of its replicas agree on that state. The MVCCStats of the range are
+// written by the caller.
+func WriteInitialRangeState(ctx context.Context, rsl StateLoader, rw storage.ReadWriter) error {
+	if err := rsl.SetRangeAppliedState(ctx, rw, enginepb.RangeAppliedState{
+		RaftAppliedIndex:     RaftInitialLogIndex,
+		RaftAppliedIndexTerm: RaftInitialLogTerm,
+	}); err != nil {
+		return err
+	}
+	if err := rsl.SetRaftTruncatedState(ctx, rw, &kvserverpb.RaftTruncatedState{
+		Index: RaftInitialLogIndex,
+		Term:  RaftInitialLogTerm,
+	}); err != nil {
+		return err
+	}
+	return rsl.SetHardState(ctx, rw, raftpb.HardState{
+		Term:   RaftInitialLogTerm,
+		Commit: RaftInitialLogIndex,
+	})
+}
@@ -0,0 +1,183 @@
+// Package stateloader loads and persists the state of a replica: its
+// replicated range state, such as its MVCCStats and applied index, and its
+// unreplicated Raft state, such as its HardState and log.
+package stateloader
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	keys "github.com/dborchard/tiny_crdb/pkg/g_keys"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/kvserverpb"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	storage "github.com/dborchard/tiny_crdb/pkg/h_storage"
+	"github.com/dborchard/tiny_crdb/pkg/h_storage/enginepb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"go.etcd.io/raft/v3/raftpb"
+)
+
+// StateLoader gives access to the persisted state of the replica of a range.
+// All the state is stored at unversioned, range-ID local keys.
+type StateLoader struct {
+	rangeID roachpb.RangeID
+}
+
+// Make creates a StateLoader for the replica of the range.
+func Make(rangeID roachpb.RangeID) StateLoader {
+	return StateLoader{rangeID: rangeID}
+}
+
+// LoadRangeAppliedState loads the applied state of the range: the index and
+// term of the last Raft log entry applied to it.
+func (rsl StateLoader) LoadRangeAppliedState(
+	ctx context.Context, reader storage.Reader,
+) (enginepb.RangeAppliedState, error) {
+	var as enginepb.RangeAppliedState
+	_, err := storage.MVCCGetProto(ctx, reader, keys.RangeAppliedStateKey(rsl.rangeID),
+		hlc.Timestamp{}, &as, storage.MVCCGetOptions{})
+	return as, err
+}
+
+// SetRangeAppliedState persists the applied state of the range.
+func (rsl StateLoader) SetRangeAppliedState(
+	ctx context.Context, rw storage.ReadWriter, as enginepb.RangeAppliedState,
+) error {
+	return storage.MVCCPutProto(ctx, rw, keys.RangeAppliedStateKey(rsl.rangeID),
+		hlc.Timestamp{}, &as, storage.MVCCWriteOptions{})
+}
+
+// LoadMVCCStats loads the MVCCStats of the range.
+func (rsl StateLoader) LoadMVCCStats(
+	ctx context.Context, reader storage.Reader,
+) (enginepb.MVCCStats, error) {
+	var ms enginepb.MVCCStats
+	_, err := storage.MVCCGetProto(ctx, reader, keys.RangeStatsLegacyKey(rsl.rangeID),
+		hlc.Timestamp{}, &ms, storage.MVCCGetOptions{})
+	return ms, err
+}
+
+// SetMVCCStats persists the MVCCStats of the range.
+func (rsl StateLoader) SetMVCCStats(
+	ctx context.Context, rw storage.ReadWriter, ms *enginepb.MVCCStats,
+) error {
+	return storage.MVCCPutProto(ctx, rw, keys.RangeStatsLegacyKey(rsl.rangeID),
+		hlc.Timestamp{}, ms, storage.MVCCWriteOptions{})
+}
+
+// LoadLease loads the lease of the range. The empty lease is returned if
+// none was ever acquired.
+func (rsl StateLoader) LoadLease(ctx context.Context, reader storage.Reader) (roachpb.Lease, error) {
+	var lease roachpb.Lease
+	_, err := storage.MVCCGetProto(ctx, reader, keys.RangeLeaseKey(rsl.rangeID),
+		hlc.Timestamp{}, &lease, storage.MVCCGetOptions{})
+	return lease, err
+}
+
+// SetLease persists the lease of the range.
+func (rsl StateLoader) SetLease(ctx context.Context, rw storage.ReadWriter, lease roachpb.Lease) error {
+	return storage.MVCCPutProto(ctx, rw, keys.RangeLeaseKey(rsl.rangeID),
+		hlc.Timestamp{}, &lease, storage.MVCCWriteOptions{})
+}
+
+// LoadHardState loads the Raft HardState of the replica. The empty HardState
+// is returned if none was persisted.
+func (rsl StateLoader) LoadHardState(
+	ctx context.Context, reader storage.Reader,
+) (raftpb.HardState, error) {
+	var hs raftpb.HardState
+	_, err := storage.MVCCGetProto(ctx, reader, keys.RaftHardStateKey(rsl.rangeID),
+		hlc.Timestamp{}, &hs, storage.MVCCGetOptions{})
+	return hs, err
+}
+
+// SetHardState persists the Raft HardState of the replica.
+func (rsl StateLoader) SetHardState(
+	ctx context.Context, writer storage.Writer, hs raftpb.HardState,
+) error {
+	return storage.MVCCBlindPutProto(ctx, writer, keys.RaftHardStateKey(rsl.rangeID), &hs)
+}
+
+// LoadRaftTruncatedState loads the truncated state of the replica's Raft
+// log.
+func (rsl StateLoader) LoadRaftTruncatedState(
+	ctx context.Context, reader storage.Reader,
+) (kvserverpb.RaftTruncatedState, error) {
+	var ts kvserverpb.RaftTruncatedState
+	_, err := storage.MVCCGetProto(ctx, reader, keys.RaftTruncatedStateKey(rsl.rangeID),
+		hlc.Timestamp{}, &ts, storage.MVCCGetOptions{})
+	return ts, err
+}
+
+// SetRaftTruncatedState persists the truncated state of the replica's Raft
+// log.
+func (rsl StateLoader) SetRaftTruncatedState(
+	ctx context.Context, writer storage.Writer, ts *kvserverpb.RaftTruncatedState,
+) error {
+	return storage.MVCCBlindPutProto(ctx, writer, keys.RaftTruncatedStateKey(rsl.rangeID), ts)
+}
+
+// LoadRaftLogEntry loads the entry of the replica's Raft log at the index.
+// It returns false if there is no such entry.
+func (rsl StateLoader) LoadRaftLogEntry(
+	ctx context.Context, reader storage.Reader, index uint64,
+) (raftpb.Entry, bool, error) {
+	var ent raftpb.Entry
+	ok, err := storage.MVCCGetProto(ctx, reader, keys.RaftLogKey(rsl.rangeID, index),
+		hlc.Timestamp{}, &ent, storage.MVCCGetOptions{})
+	return ent, ok, err
+}
+
+// SetRaftLogEntry persists the entry in the replica's Raft log.
+func (rsl StateLoader) SetRaftLogEntry(
+	ctx context.Context, rw storage.ReadWriter, ent raftpb.Entry,
+) error {
+	return storage.MVCCPutProto(ctx, rw, keys.RaftLogKey(rsl.rangeID, ent.Index),
+		hlc.Timestamp{}, &ent, storage.MVCCWriteOptions{})
+}
+
+// ClearRaftLogEntry removes the entry at the index from the replica's Raft
+// log.
+func (rsl StateLoader) ClearRaftLogEntry(w storage.Writer, index uint64) error {
+	return w.ClearUnversioned(keys.RaftLogKey(rsl.rangeID, index))
+}
+
+// LoadLastIndex loads the index of the last entry of the replica's Raft log.
+// If the log is empty, this is the index of the last entry removed from it.
+func (rsl StateLoader) LoadLastIndex(ctx context.Context, reader storage.Reader) (uint64, error) {
+	prefix := keys.RaftLogPrefix(rsl.rangeID)
+	var lastIndex uint64
+	if err := reader.MVCCIterate(ctx, prefix, prefix.PrefixEnd(), storage.MVCCKeyIterKind,
+		storage.IterKeyTypePointsOnly, storage.UnknownReadCategory,
+		func(kv storage.MVCCKeyValue, _ storage.MVCCRangeKeyStack) error {
+			suffix := kv.Key.Key[len(prefix):]
+			if len(suffix) != 8 {
+				return fmt.Errorf("malformed raft log key %s", kv.Key.Key)
+			}
+			lastIndex = binary.BigEndian.Uint64(suffix)
+			return nil
+		}); err != nil {
+		return 0, err
+	}
+	if lastIndex == 0 {
+		ts, err := rsl.LoadRaftTruncatedState(ctx, reader)
+		if err != nil {
+			return 0, err
+		}
+		lastIndex = ts.Index
+	}
+	return lastIndex, nil
+}
+
+// ComputeRaftLogSize computes the size of the replica's Raft log, as the sum
+// of the sizes of the keys and values of its entries.
+func (rsl StateLoader) ComputeRaftLogSize(ctx context.Context, reader storage.Reader) (int64, error) {
+	prefix := keys.RaftLogPrefix(rsl.rangeID)
+	var size int64
+	err := reader.MVCCIterate(ctx, prefix, prefix.PrefixEnd(), storage.MVCCKeyIterKind,
+		storage.IterKeyTypePointsOnly, storage.ReplicationReadCategory,
+		func(kv storage.MVCCKeyValue, _ storage.MVCCRangeKeyStack) error {
+			size += int64(len(kv.Key.Key) + len(kv.Value))
+			return nil
+		})
+	return size, err
+}
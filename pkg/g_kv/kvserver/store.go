@@ -0,0 +1,636 @@
+package kvserver
+
+import (
+	"context"
+	"fmt"
+	keys "github.com/dborchard/tiny_crdb/pkg/g_keys"
+	kv "github.com/dborchard/tiny_crdb/pkg/g_kv"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/closedts"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/closedts/sidetransport"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/intentresolver"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/kvserverpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/kvstorage"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/liveness"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/tscache"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/txnrecovery"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	storage "github.com/dborchard/tiny_crdb/pkg/h_storage"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/stop"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/uuid"
+	"sort"
+	"sync"
+	"time"
+)
+
+// StoreConfig contains configuration parameters for a Store.
+type StoreConfig struct {
+	Clock   *hlc.Clock
+	DB      *kv.DB
+	Stopper *stop.Stopper
+
+	// SlowReplicationThreshold is the duration after which an in-flight
+	// write is considered stuck, tripping the replica's circuit breaker.
+	// Defaults to defaultReplicaCircuitBreakerSlowReplicationThreshold.
+	SlowReplicationThreshold time.Duration
+
+	// RangeMaxBytes is the size above which a range is split by the split
+	// queue. Defaults to defaultRangeMaxBytes.
+	RangeMaxBytes int64
+	// RangeMinBytes is the size below which a range is merged with its
+	// right-hand neighbour by the merge queue. Defaults to
+	// defaultRangeMinBytes.
+	RangeMinBytes int64
+	// SplitQPSThreshold is the request rate above which a range is split by
+	// the split queue, at a key which divides its load. Defaults to
+	// defaultSplitQPSThreshold.
+	SplitQPSThreshold float64
+	// ScanInterval is the interval at which the store's replicas are offered
+	// to its queues. Defaults to defaultScanInterval.
+	ScanInterval time.Duration
+	// RaftLogQueueStaleThreshold is the number of entries which may be
+	// truncated from the Raft log of a range before the Raft log queue
+	// truncates it. Defaults to defaultRaftLogQueueStaleThreshold.
+	RaftLogQueueStaleThreshold uint64
+	// RaftLogQueueStaleSize is the size of the Raft log of a range above
+	// which the Raft log queue truncates it, even if that requires its
+	// lagging followers to catch up through snapshots. Defaults to
+	// defaultRaftLogQueueStaleSize.
+	RaftLogQueueStaleSize int64
+	// SnapshotConcurrency is the number of snapshots which the store sends,
+	// and the number which it applies, concurrently. Defaults to
+	// defaultSnapshotConcurrency.
+	SnapshotConcurrency int
+
+	// RaftTickInterval is the interval at which the Raft groups of the
+	// store's replicas are ticked. Defaults to defaultRaftTickInterval.
+	RaftTickInterval time.Duration
+	// RaftElectionTimeoutTicks is the number of ticks after which a follower
+	// which hasn't heard from its leader campaigns. Defaults to
+	// defaultRaftElectionTimeoutTicks.
+	RaftElectionTimeoutTicks int
+	// RaftHeartbeatIntervalTicks is the number of ticks between the
+	// heartbeats of a leader to its followers. Defaults to
+	// defaultRaftHeartbeatIntervalTicks.
+	RaftHeartbeatIntervalTicks int
+	// Transport delivers the Raft messages of the store's replicas to the
+	// replicas of the other stores. Without a transport, the messages are
+	// dropped, which only suits ranges with a single replica.
+	Transport RaftTransport
+
+	// RangeLeaseDuration is the duration of the expiration-based leases of
+	// the store's replicas. They are renewed once less than half of it
+	// remains. Defaults to defaultRangeLeaseDuration.
+	RangeLeaseDuration time.Duration
+	// NodeLiveness maintains the liveness records of the nodes, to which
+	// epoch-based leases are tied. Without it, all the leases acquired by the
+	// store's replicas are expiration-based. The ranges holding the liveness
+	// records always use expiration-based leases.
+	NodeLiveness *liveness.NodeLiveness
+
+	// ClosedTimestampTargetDuration is the lag behind the present of the
+	// timestamps closed by the leaseholders of the store, at or below which
+	// the followers serve reads. Defaults to
+	// closedts.DefaultTargetDuration.
+	ClosedTimestampTargetDuration time.Duration
+	// ClosedTimestampSideTransportInterval is the interval at which the
+	// closed timestamps of the leaseholders of the store are published
+	// through the side transport. Defaults to
+	// closedts.DefaultSideTransportCloseInterval.
+	ClosedTimestampSideTransportInterval time.Duration
+	// ClosedTimestampTransport delivers the closed timestamps of the
+	// leaseholders of the store, for ranges which see no writes, to the
+	// stores of their followers. Without it, the followers only learn of
+	// closed timestamps along with the commands of their leaseholders.
+	ClosedTimestampTransport sidetransport.Transport
+}
+
+const (
+	defaultRangeMaxBytes              = 512 << 20 // 512 MiB
+	defaultRangeMinBytes              = 128 << 20 // 128 MiB
+	defaultSplitQPSThreshold          = 2500
+	defaultScanInterval               = time.Minute
+	defaultRaftLogQueueStaleThreshold = 100
+	defaultRaftLogQueueStaleSize      = 64 << 10 // 64 KiB
+	defaultSnapshotConcurrency        = 1
+	defaultRaftTickInterval           = 200 * time.Millisecond
+	defaultRaftElectionTimeoutTicks   = 15
+	defaultRaftHeartbeatIntervalTicks = 5
+	defaultRangeLeaseDuration         = 6 * time.Second
+)
+
+// SetDefaults initializes unset fields in StoreConfig to values
+// suitable for use on a local network.
+func (sc *StoreConfig) SetDefaults() {
+	if sc.SlowReplicationThreshold == 0 {
+		sc.SlowReplicationThreshold = defaultReplicaCircuitBreakerSlowReplicationThreshold
+	}
+	if sc.RangeMaxBytes == 0 {
+		sc.RangeMaxBytes = defaultRangeMaxBytes
+	}
+	if sc.RangeMinBytes == 0 {
+		sc.RangeMinBytes = defaultRangeMinBytes
+	}
+	if sc.SplitQPSThreshold == 0 {
+		sc.SplitQPSThreshold = defaultSplitQPSThreshold
+	}
+	if sc.ScanInterval == 0 {
+		sc.ScanInterval = defaultScanInterval
+	}
+	if sc.RaftLogQueueStaleThreshold == 0 {
+		sc.RaftLogQueueStaleThreshold = defaultRaftLogQueueStaleThreshold
+	}
+	if sc.RaftLogQueueStaleSize == 0 {
+		sc.RaftLogQueueStaleSize = defaultRaftLogQueueStaleSize
+	}
+	if sc.SnapshotConcurrency == 0 {
+		sc.SnapshotConcurrency = defaultSnapshotConcurrency
+	}
+	if sc.RaftTickInterval == 0 {
+		sc.RaftTickInterval = defaultRaftTickInterval
+	}
+	if sc.RaftElectionTimeoutTicks == 0 {
+		sc.RaftElectionTimeoutTicks = defaultRaftElectionTimeoutTicks
+	}
+	if sc.RaftHeartbeatIntervalTicks == 0 {
+		sc.RaftHeartbeatIntervalTicks = defaultRaftHeartbeatIntervalTicks
+	}
+	if sc.RangeLeaseDuration == 0 {
+		sc.RangeLeaseDuration = defaultRangeLeaseDuration
+	}
+	if sc.ClosedTimestampTargetDuration == 0 {
+		sc.ClosedTimestampTargetDuration = closedts.DefaultTargetDuration
+	}
+	if sc.ClosedTimestampSideTransportInterval == 0 {
+		sc.ClosedTimestampSideTransportInterval = closedts.DefaultSideTransportCloseInterval
+	}
+}
+
+// A Store maintains a map of ranges by start key. A Store corresponds
+// to one physical device.
+type Store struct {
+	cfg     StoreConfig
+	engine  storage.Engine
+	nodeID  roachpb.NodeID
+	storeID roachpb.StoreID
+
+	// tsCache is the timestamp cache shared by the replicas of the store.
+	tsCache        tscache.Cache
+	intentResolver *intentresolver.IntentResolver
+	recoveryMgr    txnrecovery.Manager
+	splitQueue     *splitQueue
+	mergeQueue     *mergeQueue
+	raftLogQueue   *raftLogQueue
+	replicaGCQueue *replicaGCQueue
+
+	// snapshotSendSem and snapshotApplySem throttle the snapshots sent and
+	// applied by the store, to StoreConfig.SnapshotConcurrency each.
+	snapshotSendSem  chan struct{}
+	snapshotApplySem chan struct{}
+
+	mu struct {
+		sync.RWMutex
+		// replicas is the set of replicas hosted by the store, by range ID.
+		replicas map[roachpb.RangeID]*Replica
+		// replicasByKey holds the replicas sorted by start key.
+		replicasByKey []*Replica
+		// placeholders reserve the keyspace of the replicas which are being
+		// created from snapshots, by range ID.
+		placeholders map[roachpb.RangeID]*roachpb.RangeDescriptor
+	}
+}
+
+var _ kv.Sender = &Store{}
+var _ RaftMessageHandler = &Store{}
+var _ sidetransport.Receiver = &Store{}
+
+// NewStore returns a new instance of a store.
+func NewStore(
+	ctx context.Context,
+	cfg StoreConfig,
+	eng storage.Engine,
+	nodeID roachpb.NodeID,
+	storeID roachpb.StoreID,
+) *Store {
+	cfg.SetDefaults()
+	s := &Store{
+		cfg:     cfg,
+		engine:  eng,
+		nodeID:  nodeID,
+		storeID: storeID,
+		tsCache: tscache.New(cfg.Clock),
+		intentResolver: intentresolver.New(intentresolver.Config{
+			Clock:   cfg.Clock,
+			DB:      cfg.DB,
+			Stopper: cfg.Stopper,
+		}),
+		recoveryMgr:      txnrecovery.NewManager(cfg.Clock, cfg.DB, cfg.Stopper),
+		snapshotSendSem:  make(chan struct{}, cfg.SnapshotConcurrency),
+		snapshotApplySem: make(chan struct{}, cfg.SnapshotConcurrency),
+	}
+	s.mu.replicas = make(map[roachpb.RangeID]*Replica)
+	s.mu.placeholders = make(map[roachpb.RangeID]*roachpb.RangeDescriptor)
+	s.splitQueue = newSplitQueue(s)
+	s.mergeQueue = newMergeQueue(s)
+	s.raftLogQueue = newRaftLogQueue(s)
+	s.replicaGCQueue = newReplicaGCQueue(s)
+	return s
+}
+
+// Start loads the replicas of the ranges whose descriptors are stored on the
+// store's engine, and starts them along with the store's replica scanner.
+// The store then receives the Raft messages addressed to its replicas.
+//
+// All the replicas are loaded before any is started: a replica may have to
+// apply the merge of a range whose replica it then finds on the store.
+//
+// A store may have stopped after the removal of one of its replicas was
+// applied, but before the replica's data was cleared: the descriptors which
+// don't include the store are skipped.
+func (s *Store) Start(ctx context.Context) error {
+	if err := kvstorage.IterateRangeDescriptorsFromDisk(ctx, s.engine,
+		func(desc roachpb.RangeDescriptor) error {
+			if _, ok := desc.GetReplicaDescriptor(s.storeID); !ok {
+				return nil
+			}
+			repl, err := newReplica(ctx, s, &desc)
+			if err != nil {
+				return err
+			}
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			return s.addReplicaLocked(repl)
+		}); err != nil {
+		return err
+	}
+	var err error
+	s.VisitReplicas(func(repl *Replica) bool {
+		err = repl.start(ctx)
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+	if s.cfg.Transport != nil {
+		if err := s.cfg.Transport.Listen(s.Stopper(), s.storeID, s); err != nil {
+			return err
+		}
+	}
+	if t := s.cfg.ClosedTimestampTransport; t != nil {
+		if err := t.Listen(s.Stopper(), s.storeID, s); err != nil {
+			return err
+		}
+		sender := sidetransport.NewSender(sidetransport.SenderConfig{
+			Clock:     s.cfg.Clock,
+			Stopper:   s.Stopper(),
+			Transport: t,
+			StoreID:   s.storeID,
+			VisitReplicas: func(fn func(sidetransport.Replica) bool) {
+				s.VisitReplicas(func(repl *Replica) bool { return fn(repl) })
+			},
+			TargetDuration: s.cfg.ClosedTimestampTargetDuration,
+			CloseInterval:  s.cfg.ClosedTimestampSideTransportInterval,
+		})
+		if err := sender.Run(ctx); err != nil {
+			return err
+		}
+	}
+	return s.startScanner(ctx)
+}
+
+// HandleSideTransportUpdate implements the sidetransport.Receiver interface.
+func (s *Store) HandleSideTransportUpdate(_ context.Context, update *sidetransport.Update) {
+	for _, u := range update.Ranges {
+		repl, err := s.GetReplica(u.RangeID)
+		if err != nil {
+			continue
+		}
+		repl.forwardSideTransportClosedTimestamp(u.ClosedTimestamp, u.AppliedIndex)
+	}
+}
+
+// HandleRaftRequest implements the RaftMessageHandler interface. Messages
+// addressed to replicas which the store doesn't hold are dropped.
+func (s *Store) HandleRaftRequest(ctx context.Context, req *kvserverpb.RaftMessageRequest) error {
+	repl, err := s.GetReplica(req.RangeID)
+	if err != nil {
+		return err
+	}
+	return repl.stepRaftMessage(req)
+}
+
+// startScanner periodically offers the store's replicas to the split, merge,
+// Raft log and replica GC queues. Processing failures are ignored: the replicas are offered
+// again at the next scan.
+func (s *Store) startScanner(ctx context.Context) error {
+	return s.Stopper().RunAsyncTask(ctx, "store: scanning replicas", func(ctx context.Context) {
+		ticker := time.NewTicker(s.cfg.ScanInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				_ = s.splitQueue.scanAndProcess(ctx)
+				_ = s.mergeQueue.scanAndProcess(ctx)
+				_ = s.raftLogQueue.scanAndProcess(ctx)
+				_ = s.replicaGCQueue.scanAndProcess(ctx)
+			case <-s.Stopper().ShouldQuiesce():
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	})
+}
+
+// addReplicaLocked adds the replica to the store's maps. s.mu must be held.
+func (s *Store) addReplicaLocked(repl *Replica) error {
+	if _, ok := s.mu.replicas[repl.RangeID]; ok {
+		return fmt.Errorf("r%d already exists on s%d", repl.RangeID, s.storeID)
+	}
+	s.mu.replicas[repl.RangeID] = repl
+	s.mu.replicasByKey = append(s.mu.replicasByKey, repl)
+	sort.Slice(s.mu.replicasByKey, func(i, j int) bool {
+		return s.mu.replicasByKey[i].Desc().StartKey.Less(s.mu.replicasByKey[j].Desc().StartKey)
+	})
+	return nil
+}
+
+// splitPostApply is called once a split of the left-hand replica has been
+// committed. It shrinks the left-hand replica, and creates and starts the
+// replica of the new right-hand range. The replica of the leader of the
+// left-hand range campaigns to lead the right-hand range, so that it doesn't
+// wait for an election timeout.
+func (s *Store) splitPostApply(
+	ctx context.Context, leftRepl *Replica, split *roachpb.SplitTrigger,
+) error {
+	leftDesc, rightDesc := split.LeftDesc, split.RightDesc
+	rightRepl, err := newReplica(ctx, s, &rightDesc)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	leftRepl.setDesc(&leftDesc)
+	err = s.addReplicaLocked(rightRepl)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	// The recorded load of the left-hand side includes that of the right-hand
+	// side, and pushers waiting on transactions whose records moved to the
+	// right-hand side retry their push there.
+	leftRepl.load.reset()
+	leftRepl.txnWaitQueue.Clear(false /* disable */)
+	leftRepl.disconnectRangefeedWithReason(kvpb.RangeFeedRetryError_REASON_RANGE_SPLIT)
+	rightRepl.inheritClosedTimestamps(leftRepl)
+	if err := rightRepl.start(ctx); err != nil {
+		return err
+	}
+	if leftRepl.isRaftLeader() {
+		rightRepl.campaign()
+	}
+	return nil
+}
+
+// mergePostApply is called once the merge of the right-hand replica into the
+// left-hand replica has been committed. It extends the left-hand replica and
+// destroys the right-hand replica.
+//
+// The timestamp cache is bumped over the keyspace of the right-hand side to
+// the timestamps it closed, so that the writes which the left-hand side
+// serves there stay above them.
+func (s *Store) mergePostApply(
+	ctx context.Context, leftRepl, rightRepl *Replica, merge *roachpb.MergeTrigger,
+) {
+	mergedDesc := merge.LeftDesc
+	rightRepl.mu.RLock()
+	rightClosed := rightRepl.getClosedTimestampForWritesRLocked()
+	rightRepl.mu.RUnlock()
+	for _, span := range rangeDataSpans(&merge.RightDesc) {
+		s.tsCache.Add(span.Key, span.EndKey, rightClosed, uuid.Nil)
+	}
+	leftRepl.disconnectRangefeedWithReason(kvpb.RangeFeedRetryError_REASON_RANGE_MERGED)
+	rightRepl.disconnectRangefeedWithReason(kvpb.RangeFeedRetryError_REASON_RANGE_MERGED)
+	rightRepl.destroy()
+	s.mu.Lock()
+	leftRepl.setDesc(&mergedDesc)
+	s.removeReplicaLocked(rightRepl)
+	s.mu.Unlock()
+	leftRepl.load.reset()
+}
+
+// changeReplicasPostApply is called once a change of the replicas of the
+// range has been committed. If the replica was removed from the range, it is
+// destroyed and its data is cleared from the store's engine.
+func (s *Store) changeReplicasPostApply(
+	ctx context.Context, repl *Replica, desc *roachpb.RangeDescriptor,
+) error {
+	repl.setDesc(desc)
+	if _, ok := desc.GetReplicaDescriptorByID(repl.ReplicaID()); ok {
+		return nil
+	}
+	return s.removeReplicaAndClearData(ctx, repl, desc)
+}
+
+// removeReplicaAndClearData destroys a replica which was removed from its
+// range, removes it from the store and clears its data, that of the range
+// described by desc, from the store's engine. repl.raftMu must be held.
+func (s *Store) removeReplicaAndClearData(
+	ctx context.Context, repl *Replica, desc *roachpb.RangeDescriptor,
+) error {
+	repl.destroy()
+	s.mu.Lock()
+	s.removeReplicaLocked(repl)
+	s.mu.Unlock()
+
+	batch := s.engine.NewBatch()
+	defer batch.Close()
+	for _, span := range rangeDataSpans(desc) {
+		if err := storage.ClearRange(ctx, batch, batch, span.Key, span.EndKey); err != nil {
+			return err
+		}
+	}
+	prefix := keys.MakeRangeIDPrefix(repl.RangeID)
+	if err := storage.ClearRange(ctx, batch, batch, prefix, prefix.PrefixEnd()); err != nil {
+		return err
+	}
+	return batch.Commit(true /* sync */)
+}
+
+// removeReplicaLocked removes the replica from the store's maps. s.mu must be
+// held.
+func (s *Store) removeReplicaLocked(repl *Replica) {
+	delete(s.mu.replicas, repl.RangeID)
+	for i, r := range s.mu.replicasByKey {
+		if r == repl {
+			s.mu.replicasByKey = append(s.mu.replicasByKey[:i], s.mu.replicasByKey[i+1:]...)
+			break
+		}
+	}
+}
+
+// Clock returns the clock used by the store.
+func (s *Store) Clock() *hlc.Clock { return s.cfg.Clock }
+
+// Engine accessor.
+func (s *Store) Engine() storage.Engine { return s.engine }
+
+// DB accessor.
+func (s *Store) DB() *kv.DB { return s.cfg.DB }
+
+// NodeID accessor.
+func (s *Store) NodeID() roachpb.NodeID { return s.nodeID }
+
+// StoreID accessor.
+func (s *Store) StoreID() roachpb.StoreID { return s.storeID }
+
+// Stopper accessor.
+func (s *Store) Stopper() *stop.Stopper { return s.cfg.Stopper }
+
+// GetReplica fetches a replica by Range ID. Returns an error if no replica is
+// found.
+func (s *Store) GetReplica(rangeID roachpb.RangeID) (*Replica, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if repl, ok := s.mu.replicas[rangeID]; ok {
+		return repl, nil
+	}
+	return nil, kvpb.NewRangeNotFoundError(rangeID, s.storeID)
+}
+
+// LookupReplica looks up the replica that contains the specified key. It
+// returns nil if no such replica exists.
+func (s *Store) LookupReplica(key roachpb.RKey) *Replica {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	i := sort.Search(len(s.mu.replicasByKey), func(i int) bool {
+		return key.Less(s.mu.replicasByKey[i].Desc().EndKey)
+	})
+	if i == len(s.mu.replicasByKey) || !s.mu.replicasByKey[i].Desc().ContainsKey(key) {
+		return nil
+	}
+	return s.mu.replicasByKey[i]
+}
+
+// ReplicaCount returns the number of replicas contained by this store.
+func (s *Store) ReplicaCount() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.mu.replicas)
+}
+
+// VisitReplicas invokes the visitor on the store's replicas, in key order,
+// until the visitor returns false.
+func (s *Store) VisitReplicas(visitor func(*Replica) bool) {
+	s.mu.RLock()
+	repls := append([]*Replica(nil), s.mu.replicasByKey...)
+	s.mu.RUnlock()
+	for _, repl := range repls {
+		if !visitor(repl) {
+			return
+		}
+	}
+}
+
+// Capacity returns the capacity of the underlying storage engine, along with
+// the number of replicas held by the store and their logical size.
+func (s *Store) Capacity(ctx context.Context) (roachpb.StoreCapacity, error) {
+	capacity, err := s.engine.Capacity()
+	if err != nil {
+		return roachpb.StoreCapacity{}, err
+	}
+	s.VisitReplicas(func(repl *Replica) bool {
+		capacity.RangeCount++
+		ms := repl.GetMVCCStats()
+		capacity.LogicalBytes += ms.Total()
+		return true
+	})
+	return capacity, nil
+}
+
+// Descriptor returns a StoreDescriptor including current store capacity
+// information.
+func (s *Store) Descriptor(ctx context.Context) (*roachpb.StoreDescriptor, error) {
+	capacity, err := s.Capacity(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &roachpb.StoreDescriptor{
+		StoreID:  s.storeID,
+		Attrs:    s.engine.Attrs(),
+		Node:     roachpb.NodeDescriptor{NodeID: s.nodeID},
+		Capacity: capacity,
+	}, nil
+}
+
+// Send fetches a range based on the header's replica, assembles method, args &
+// reply into a Raft Cmd struct and executes the command using the fetched
+// range.
+//
+// The batch's timestamp is set on the server: for transactional batches, it
+// is the transaction's read timestamp, and a reading of the node's clock is
+// recorded in the transaction as its observed timestamp for the node, which
+// is returned to the coordinator with the response. Non-transactional batches
+// without a timestamp are evaluated at the current time.
+//
+// The node's clock is updated with the clock reading of the batch's sender,
+// and the batch is rejected if the reading is further ahead of the node's
+// physical clock than the maximum clock offset. The response, or the error,
+// carries the clock reading of the node in turn.
+func (s *Store) Send(
+	ctx context.Context, ba *kvpb.BatchRequest,
+) (br *kvpb.BatchResponse, pErr *kvpb.Error) {
+	if !ba.Now.IsEmpty() {
+		if err := s.cfg.Clock.UpdateAndCheckMaxOffset(ctx, ba.Now); err != nil {
+			return nil, kvpb.NewError(err)
+		}
+	}
+	defer func() {
+		now := s.cfg.Clock.NowAsClockTimestamp()
+		if pErr != nil {
+			pErr.Now = now
+		} else if br != nil {
+			br.Now = now
+		}
+	}()
+
+	ba = ba.ShallowCopy()
+	if ba.Txn != nil {
+		ba.Txn = ba.Txn.Clone()
+		ba.Timestamp = ba.Txn.ReadTimestamp
+		ba.Txn.UpdateObservedTimestamp(s.nodeID, s.cfg.Clock.NowAsClockTimestamp())
+	} else if ba.Timestamp.IsEmpty() {
+		ba.Timestamp = s.cfg.Clock.Now()
+	}
+
+	var repl *Replica
+	if ba.RangeID != 0 {
+		var err error
+		if repl, err = s.GetReplica(ba.RangeID); err != nil {
+			return nil, kvpb.NewError(err)
+		}
+	} else {
+		// The batch was not routed by a DistSender; find the replica
+		// containing its keys.
+		rs, err := keys.Range(ba.Requests)
+		if err != nil {
+			return nil, kvpb.NewError(err)
+		}
+		if repl = s.LookupReplica(rs.Key); repl == nil {
+			return nil, kvpb.NewErrorf("no replica of s%d contains key %s", s.storeID, rs.Key)
+		}
+		ba.RangeID = repl.RangeID
+	}
+	return repl.Send(ctx, ba)
+}
+
+// RangeFeed registers a rangefeed over the specified span of the range
+// addressed by the request. It sends updates to the provided stream and
+// returns with an error once the registration is disconnected.
+func (s *Store) RangeFeed(args *kvpb.RangeFeedRequest, stream kvpb.RangeFeedEventSink) *kvpb.Error {
+	repl, err := s.GetReplica(args.RangeID)
+	if err != nil {
+		return kvpb.NewError(err)
+	}
+	return repl.RangeFeed(args, stream)
+}
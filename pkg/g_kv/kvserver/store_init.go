@@ -0,0 +1,114 @@
+package kvserver
+
+import (
+	"context"
+	keys "github.com/dborchard/tiny_crdb/pkg/g_keys"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/stateloader"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	storage "github.com/dborchard/tiny_crdb/pkg/h_storage"
+	"github.com/dborchard/tiny_crdb/pkg/h_storage/enginepb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+)
+
+// initialSplitKeys are the keys at which the keyspace is split into the
+// initial ranges of a new cluster: the meta ranges, the system ranges and the
+// remainder of the keyspace.
+var initialSplitKeys = []roachpb.RKey{
+	roachpb.RKey(keys.SystemPrefix),
+	roachpb.RKey(keys.SystemMax),
+}
+
+// WriteInitialClusterData writes initialization data to an engine. It creates
+// system ranges, filling in meta1 and meta2 and the ID generators.
+//
+// The keyspace is split at initialSplitKeys, and each of the resulting ranges
+// gets a replica on each of the provided stores, which are numbered in
+// order. Their descriptors are written along with the meta1 and meta2
+// records addressing them, their initial MVCCStats and their initial Raft
+// state. The node and store ID generators are initialized to the highest
+// IDs of the provided replicas, which are the first ones allocated in the
+// cluster, and the range ID generator to the ID of the last initial range.
+//
+// A cluster whose ranges have several replicas is bootstrapped by writing
+// the same data to the engine of each of their stores.
+func WriteInitialClusterData(
+	ctx context.Context, eng storage.Engine, replicas []roachpb.ReplicaDescriptor, nowNanos int64,
+) error {
+	replicas = append([]roachpb.ReplicaDescriptor(nil), replicas...)
+	var maxNodeID roachpb.NodeID
+	var maxStoreID roachpb.StoreID
+	for i := range replicas {
+		replicas[i].ReplicaID = roachpb.ReplicaID(i + 1)
+		if replicas[i].NodeID > maxNodeID {
+			maxNodeID = replicas[i].NodeID
+		}
+		if replicas[i].StoreID > maxStoreID {
+			maxStoreID = replicas[i].StoreID
+		}
+	}
+	now := hlc.Timestamp{WallTime: nowNanos}
+
+	var descs []*roachpb.RangeDescriptor
+	startKey := roachpb.RKeyMin
+	for i, endKey := range append(initialSplitKeys, roachpb.RKeyMax) {
+		descs = append(descs, &roachpb.RangeDescriptor{
+			RangeID:          roachpb.RangeID(i + 1),
+			StartKey:         startKey,
+			EndKey:           endKey,
+			InternalReplicas: replicas,
+			NextReplicaID:    roachpb.ReplicaID(len(replicas) + 1),
+		})
+		startKey = endKey
+	}
+
+	batch := eng.NewBatch()
+	defer batch.Close()
+	for _, desc := range descs {
+		if err := storage.MVCCPutProto(ctx, batch, keys.RangeDescriptorKey(desc.StartKey),
+			now, desc, storage.MVCCWriteOptions{}); err != nil {
+			return err
+		}
+		// Each range is addressed by the meta2 record of its end key.
+		if err := storage.MVCCPutProto(ctx, batch, keys.RangeMetaKey(desc.EndKey).AsRawKey(),
+			now, desc, storage.MVCCWriteOptions{}); err != nil {
+			return err
+		}
+	}
+	// The first range contains the meta2 records, which are addressed by the
+	// meta1 record at Meta1KeyMax.
+	if err := storage.MVCCPutProto(ctx, batch, keys.Meta1KeyMax,
+		now, descs[0], storage.MVCCWriteOptions{}); err != nil {
+		return err
+	}
+	for key, id := range map[string]int64{
+		string(keys.NodeIDGenerator):  int64(maxNodeID),
+		string(keys.StoreIDGenerator): int64(maxStoreID),
+		string(keys.RangeIDGenerator): int64(len(descs)),
+	} {
+		var v roachpb.Value
+		v.SetInt(id)
+		if err := storage.MVCCPut(ctx, batch, roachpb.Key(key), now, v,
+			storage.MVCCWriteOptions{}); err != nil {
+			return err
+		}
+	}
+
+	for _, desc := range descs {
+		var ms enginepb.MVCCStats
+		for _, span := range rangeDataSpans(desc) {
+			spanMS, err := storage.ComputeStats(ctx, batch, span.Key, span.EndKey, nowNanos)
+			if err != nil {
+				return err
+			}
+			ms.Add(spanMS)
+		}
+		rsl := stateloader.Make(desc.RangeID)
+		if err := rsl.SetMVCCStats(ctx, batch, &ms); err != nil {
+			return err
+		}
+		if err := stateloader.WriteInitialRangeState(ctx, rsl, batch); err != nil {
+			return err
+		}
+	}
+	return batch.Commit(true /* sync */)
+}
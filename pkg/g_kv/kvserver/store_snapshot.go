@@ -0,0 +1,324 @@
+package kvserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	keys "github.com/dborchard/tiny_crdb/pkg/g_keys"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/kvserverpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/stateloader"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	storage "github.com/dborchard/tiny_crdb/pkg/h_storage"
+	"github.com/dborchard/tiny_crdb/pkg/h_storage/enginepb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/stop"
+	"go.etcd.io/raft/v3/raftpb"
+)
+
+// snapshotSSTChunkSize is the size above which the data of a snapshot is cut
+// into another SSTable.
+const snapshotSSTChunkSize = 512 << 10 // 512 KiB
+
+// outgoingSnapshot is the state of a replica captured for a snapshot: a
+// snapshot of the store's engine, along with the descriptor and applied state
+// of the range as of that engine snapshot.
+type outgoingSnapshot struct {
+	EngineSnap storage.Reader
+	Desc       *roachpb.RangeDescriptor
+	State      enginepb.RangeAppliedState
+	Stats      enginepb.MVCCStats
+}
+
+// Close releases the engine snapshot.
+func (s *outgoingSnapshot) Close() {
+	s.EngineSnap.Close()
+}
+
+// incomingSnapshot is a snapshot received by a store: the SSTables of the
+// range's data, along with the descriptor of the range and the index and
+// term of the last entry applied to its state.
+type incomingSnapshot struct {
+	Desc  *roachpb.RangeDescriptor
+	SSTs  [][]byte
+	Index uint64
+	Term  uint64
+	Type  kvserverpb.SnapshotRequest_Type
+}
+
+// snapshotSpans returns the spans of the keys of the range which are sent in
+// its snapshots: its replicated range-ID local keys, such as its applied
+// state and MVCCStats, along with its data.
+func snapshotSpans(desc *roachpb.RangeDescriptor) []roachpb.Span {
+	return append([]roachpb.Span{rangeIDReplicatedSpan(desc.RangeID)}, rangeDataSpans(desc)...)
+}
+
+// rangeIDReplicatedSpan returns the span of the replicated range-ID local
+// keys of the range.
+func rangeIDReplicatedSpan(rangeID roachpb.RangeID) roachpb.Span {
+	return roachpb.Span{
+		Key:    keys.MakeRangeIDPrefix(rangeID),
+		EndKey: keys.MakeRangeIDUnreplicatedPrefix(rangeID),
+	}
+}
+
+// acquireSnapshotSem reserves a slot of the semaphore, waiting for one to be
+// released if needed. The returned function releases the slot.
+func (s *Store) acquireSnapshotSem(ctx context.Context, sem chan struct{}) (func(), error) {
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }, nil
+	case <-s.Stopper().ShouldQuiesce():
+		return nil, stop.ErrUnavailable
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// sendSnapshotStream streams the snapshot through the stream: the header is
+// sent first, and once the recipient accepts it, the data of the range
+// follows as SSTables of about snapshotSSTChunkSize. The data is read from
+// the engine snapshot, in key order.
+func sendSnapshotStream(
+	ctx context.Context,
+	stream OutgoingSnapshotStream,
+	header *kvserverpb.SnapshotRequest_Header,
+	snap *outgoingSnapshot,
+) error {
+	if err := stream.Send(&kvserverpb.SnapshotRequest{Header: header}); err != nil {
+		return err
+	}
+	if err := expectSnapshotStatus(stream, kvserverpb.SnapshotResponse_ACCEPTED); err != nil {
+		return err
+	}
+
+	sst := storage.MakeIngestionSSTWriter()
+	sendChunk := func(final bool) error {
+		data, err := sst.Finish()
+		if err != nil {
+			return err
+		}
+		sst = storage.MakeIngestionSSTWriter()
+		return stream.Send(&kvserverpb.SnapshotRequest{SSTChunk: data, Final: final})
+	}
+	for _, span := range snapshotSpans(snap.Desc) {
+		if err := snap.EngineSnap.MVCCIterate(ctx, span.Key, span.EndKey,
+			storage.MVCCKeyAndIntentsIterKind, storage.IterKeyTypePointsOnly,
+			storage.RangeSnapshotReadCategory,
+			func(kv storage.MVCCKeyValue, _ storage.MVCCRangeKeyStack) error {
+				if err := sst.PutRawMVCC(kv.Key, kv.Value); err != nil {
+					return err
+				}
+				if sst.DataSize < snapshotSSTChunkSize {
+					return nil
+				}
+				return sendChunk(false /* final */)
+			}); err != nil {
+			return err
+		}
+	}
+	if err := sendChunk(true /* final */); err != nil {
+		return err
+	}
+	return expectSnapshotStatus(stream, kvserverpb.SnapshotResponse_APPLIED)
+}
+
+// expectSnapshotStatus receives the next response of the stream, and returns
+// an error unless it has the expected status.
+func expectSnapshotStatus(
+	stream OutgoingSnapshotStream, expected kvserverpb.SnapshotResponse_Status,
+) error {
+	resp, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	switch resp.Status {
+	case expected:
+		return nil
+	case kvserverpb.SnapshotResponse_ERROR:
+		return fmt.Errorf("snapshot failed: %s", resp.Message)
+	default:
+		return fmt.Errorf("snapshot: unexpected response status %s, expected %s", resp.Status, expected)
+	}
+}
+
+// HandleSnapshot implements the RaftMessageHandler interface. It receives the
+// snapshot streamed to a replica of the store, and applies it: the replica is
+// created if the store doesn't hold it yet. The store applies up to
+// StoreConfig.SnapshotConcurrency snapshots at a time; the others wait before
+// they are accepted.
+func (s *Store) HandleSnapshot(ctx context.Context, stream IncomingSnapshotStream) error {
+	req, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	if req.Header == nil {
+		return sendSnapshotError(stream, errors.New("client error: no header in first snapshot request message"))
+	}
+	release, err := s.acquireSnapshotSem(ctx, s.snapshotApplySem)
+	if err != nil {
+		return sendSnapshotError(stream, err)
+	}
+	defer release()
+	if err := s.receiveSnapshot(ctx, req.Header, stream); err != nil {
+		return sendSnapshotError(stream, err)
+	}
+	return stream.Send(&kvserverpb.SnapshotResponse{Status: kvserverpb.SnapshotResponse_APPLIED})
+}
+
+// sendSnapshotError sends the error to the sender of the snapshot.
+func sendSnapshotError(stream IncomingSnapshotStream, err error) error {
+	return stream.Send(&kvserverpb.SnapshotResponse{
+		Status:  kvserverpb.SnapshotResponse_ERROR,
+		Message: err.Error(),
+	})
+}
+
+// receiveSnapshot accepts the snapshot described by the header if the store
+// can apply it, and then receives and applies it.
+func (s *Store) receiveSnapshot(
+	ctx context.Context, header *kvserverpb.SnapshotRequest_Header, stream IncomingSnapshotStream,
+) error {
+	req := &header.RaftMessageRequest
+	msg := &req.Message
+	if req.ToReplica.StoreID != s.storeID {
+		return fmt.Errorf("snapshot for s%d received by s%d", req.ToReplica.StoreID, s.storeID)
+	}
+	if msg.Type != raftpb.MsgSnap || msg.Snapshot == nil {
+		return fmt.Errorf("r%d: snapshot without raft snapshot message", req.RangeID)
+	}
+	repl, releasePlaceholder, err := s.prepareSnapshotTarget(&header.Desc, req.ToReplica.ReplicaID)
+	if err != nil {
+		return err
+	}
+	if releasePlaceholder != nil {
+		defer releasePlaceholder()
+	}
+	if err := stream.Send(&kvserverpb.SnapshotResponse{Status: kvserverpb.SnapshotResponse_ACCEPTED}); err != nil {
+		return err
+	}
+
+	inSnap := incomingSnapshot{
+		Desc:  &header.Desc,
+		Index: msg.Snapshot.Metadata.Index,
+		Term:  msg.Snapshot.Metadata.Term,
+		Type:  header.Type,
+	}
+	for {
+		req, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		if req.Header != nil {
+			return errors.New("client error: provided a header mid-stream")
+		}
+		if len(req.SSTChunk) > 0 {
+			inSnap.SSTs = append(inSnap.SSTs, req.SSTChunk)
+		}
+		if req.Final {
+			break
+		}
+	}
+
+	if repl != nil {
+		return repl.stepSnapshot(ctx, req, inSnap)
+	}
+	return s.createReplicaFromSnapshot(ctx, inSnap)
+}
+
+// prepareSnapshotTarget returns the replica of the store to which the
+// snapshot of the range is addressed, if the store holds it. Otherwise, the
+// keyspace of the range is reserved by a placeholder, which the returned
+// function releases, until the replica is created from the snapshot. The
+// range must not overlap the other replicas of the store.
+func (s *Store) prepareSnapshotTarget(
+	desc *roachpb.RangeDescriptor, replicaID roachpb.ReplicaID,
+) (*Replica, func(), error) {
+	if rd, ok := desc.GetReplicaDescriptor(s.storeID); !ok || rd.ReplicaID != replicaID {
+		return nil, nil, fmt.Errorf("snapshot of range %s addressed to replica %d of s%d, which is not part of it",
+			desc, replicaID, s.storeID)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if repl, ok := s.mu.replicas[desc.RangeID]; ok {
+		if id := repl.ReplicaID(); id != replicaID {
+			return nil, nil, fmt.Errorf("r%d: snapshot addressed to replica %d, found replica %d",
+				desc.RangeID, replicaID, id)
+		}
+		return repl, nil, nil
+	}
+	if _, ok := s.mu.placeholders[desc.RangeID]; ok {
+		return nil, nil, fmt.Errorf("r%d: a snapshot of the range is already being applied", desc.RangeID)
+	}
+	for _, repl := range s.mu.replicasByKey {
+		if other := repl.Desc(); other.StartKey.Less(desc.EndKey) && desc.StartKey.Less(other.EndKey) {
+			return nil, nil, fmt.Errorf("snapshot of range %s overlaps existing range %s", desc, other)
+		}
+	}
+	for _, other := range s.mu.placeholders {
+		if other.StartKey.Less(desc.EndKey) && desc.StartKey.Less(other.EndKey) {
+			return nil, nil, fmt.Errorf("snapshot of range %s overlaps the snapshot of range %s", desc, other)
+		}
+	}
+	s.mu.placeholders[desc.RangeID] = desc
+	return nil, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.mu.placeholders, desc.RangeID)
+	}, nil
+}
+
+// createReplicaFromSnapshot creates the replica of the range from the
+// snapshot, along with its initial Raft state: its log is empty, as if the
+// entries up to the snapshot's index had been applied and truncated.
+func (s *Store) createReplicaFromSnapshot(ctx context.Context, inSnap incomingSnapshot) error {
+	desc := inSnap.Desc
+	prefix := keys.MakeRangeIDPrefix(desc.RangeID)
+	clearSpans := append([]roachpb.Span{{Key: prefix, EndKey: prefix.PrefixEnd()}}, rangeDataSpans(desc)...)
+	hs := raftpb.HardState{Term: inSnap.Term, Commit: inSnap.Index}
+	if err := s.ingestSnapshot(ctx, inSnap, clearSpans, &hs); err != nil {
+		return err
+	}
+	repl, err := newReplica(ctx, s, desc)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	err = s.addReplicaLocked(repl)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return repl.start(ctx)
+}
+
+// ingestSnapshot ingests the SSTables of the snapshot into the store's
+// engine, along with an SSTable which first clears the spans, and then
+// writes the truncated state of the replica's Raft log, which starts after
+// the snapshot's index, and the HardState, if provided.
+func (s *Store) ingestSnapshot(
+	ctx context.Context, inSnap incomingSnapshot, clearSpans []roachpb.Span, hs *raftpb.HardState,
+) error {
+	rsl := stateloader.Make(inSnap.Desc.RangeID)
+	sst := storage.MakeIngestionSSTWriter()
+	for _, span := range clearSpans {
+		if err := sst.ClearRawRange(span.Key, span.EndKey); err != nil {
+			return err
+		}
+	}
+	if hs != nil {
+		if err := rsl.SetHardState(ctx, &sst, *hs); err != nil {
+			return err
+		}
+	}
+	if err := rsl.SetRaftTruncatedState(ctx, &sst, &kvserverpb.RaftTruncatedState{
+		Index: inSnap.Index,
+		Term:  inSnap.Term,
+	}); err != nil {
+		return err
+	}
+	data, err := sst.Finish()
+	if err != nil {
+		return err
+	}
+	return s.engine.IngestSSTs(ctx, append([][]byte{data}, inSnap.SSTs...))
+}
@@ -0,0 +1,236 @@
+package kvserver
+
+import (
+	"context"
+	keys "github.com/dborchard/tiny_crdb/pkg/g_keys"
+	kv "github.com/dborchard/tiny_crdb/pkg/g_kv"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvclient/kvcoord"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/concurrency/isolation"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	storage "github.com/dborchard/tiny_crdb/pkg/h_storage"
+	"github.com/dborchard/tiny_crdb/pkg/h_storage/enginepb"
+	"github.com/dborchard/tiny_crdb/pkg/z_testutils/kvclientutils"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/stop"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+// testStoreSender routes the DistSender's requests to the test store, which
+// also holds the first range.
+type testStoreSender struct {
+	store *Store
+}
+
+func (s *testStoreSender) Send(
+	ctx context.Context, ba *kvpb.BatchRequest,
+) (*kvpb.BatchResponse, *kvpb.Error) {
+	return s.store.Send(ctx, ba)
+}
+
+func (s *testStoreSender) RangeFeed(
+	args *kvpb.RangeFeedRequest, stream kvpb.RangeFeedEventSink,
+) *kvpb.Error {
+	return s.store.RangeFeed(args, stream)
+}
+
+func (s *testStoreSender) GetFirstRangeDescriptor() (*roachpb.RangeDescriptor, error) {
+	return s.store.LookupReplica(roachpb.RKeyMin).Desc(), nil
+}
+
+// createTestStore bootstraps a store on an in-memory engine and returns it,
+// along with a DB that sends its requests to the store through a DistSender.
+func createTestStore(t *testing.T) (*Store, *kv.DB) {
+	return createTestStoreWithConfig(t, StoreConfig{})
+}
+
+// createTestStoreWithConfig is like createTestStore, but starts the store
+// with the provided config, whose clock, DB and stopper are filled in.
+func createTestStoreWithConfig(t *testing.T, cfg StoreConfig) (*Store, *kv.DB) {
+	ctx := context.Background()
+	eng, err := storage.Open(ctx, storage.Location{})
+	require.NoError(t, err)
+	t.Cleanup(eng.Close)
+	stopper := stop.NewStopper()
+	t.Cleanup(func() { stopper.Stop(ctx) })
+	clock := hlc.NewClock(hlc.UnixNano, time.Nanosecond)
+
+	sender := &testStoreSender{}
+	ds := kvcoord.NewDistSender(kvcoord.DistSenderConfig{
+		Clock:              clock,
+		Stopper:            stopper,
+		FirstRangeProvider: sender,
+		TransportFactory:   kvcoord.SenderTransportFactory(sender),
+	})
+	factory := kvcoord.NewTxnCoordSenderFactory(kvcoord.TxnCoordSenderFactoryConfig{
+		Clock:   clock,
+		Stopper: stopper,
+	}, ds)
+	db := kv.NewDB(ctx, factory, clock, stopper)
+
+	require.NoError(t, WriteInitialClusterData(ctx, eng,
+		[]roachpb.ReplicaDescriptor{{NodeID: 1, StoreID: 1}}, clock.Now().WallTime))
+	cfg.Clock, cfg.DB, cfg.Stopper = clock, db, stopper
+	store := NewStore(ctx, cfg, eng, 1, 1)
+	require.NoError(t, store.Start(ctx))
+	// The replicas serve requests once they have been elected. Transactions
+	// which start earlier have their writes pushed above the election.
+	store.VisitReplicas(func(repl *Replica) bool {
+		require.NoError(t, repl.redirectOnOrWaitForLeader(ctx))
+		return true
+	})
+	sender.store = store
+	return store, db
+}
+
+// requireStatsConsistent verifies that the range's stats reflect the data
+// that it holds.
+func requireStatsConsistent(t *testing.T, repl *Replica) {
+	var expected enginepb.MVCCStats
+	for _, span := range rangeDataSpans(repl.Desc()) {
+		ms, err := storage.ComputeStats(context.Background(), repl.store.Engine(), span.Key, span.EndKey, 0)
+		require.NoError(t, err)
+		expected.Add(ms)
+	}
+	actual := repl.GetMVCCStats()
+	actual.LastUpdateNanos = 0
+	require.Equal(t, expected, actual)
+
+	var persisted enginepb.MVCCStats
+	_, err := storage.MVCCGetProto(context.Background(), repl.store.Engine(),
+		keys.RangeStatsLegacyKey(repl.RangeID), hlc.Timestamp{}, &persisted, storage.MVCCGetOptions{})
+	require.NoError(t, err)
+	require.Equal(t, repl.GetMVCCStats(), persisted)
+}
+
+// TestStoreSend verifies that transactions are served by the store, that the
+// range's stats are kept up to date, and that requests addressed to an
+// unknown range are rejected.
+func TestStoreSend(t *testing.T) {
+	ctx := context.Background()
+	store, db := createTestStore(t)
+	repl := store.LookupReplica(roachpb.RKey("a"))
+	require.NotNil(t, repl)
+	requireStatsConsistent(t, repl)
+
+	// A transaction which writes in several batches lays down intents and a
+	// transaction record.
+	require.NoError(t, db.Txn(ctx, func(ctx context.Context, txn *kv.Txn) error {
+		if err := txn.Put(ctx, "a", "1"); err != nil {
+			return err
+		}
+		return txn.Put(ctx, "b", "2")
+	}))
+	require.NoError(t, db.Txn(ctx, func(ctx context.Context, txn *kv.Txn) error {
+		require.Equal(t, "1", kvclientutils.GetString(t, ctx, txn, "a"))
+		require.Equal(t, "2", kvclientutils.GetString(t, ctx, txn, "b"))
+		return txn.Put(ctx, "a", "3")
+	}))
+	require.NoError(t, db.Txn(ctx, func(ctx context.Context, txn *kv.Txn) error {
+		require.Equal(t, "3", kvclientutils.GetString(t, ctx, txn, "a"))
+		return nil
+	}))
+	requireStatsConsistent(t, repl)
+	// The two keys are live; the meta records and the ID generators live in
+	// the meta and system ranges.
+	require.Equal(t, int64(2), repl.GetMVCCStats().LiveCount)
+
+	ba := &kvpb.BatchRequest{}
+	ba.RangeID = 99
+	ba.Add(&kvpb.GetRequest{RequestHeader: kvpb.RequestHeader{Key: roachpb.Key("a")}})
+	_, pErr := store.Send(ctx, ba)
+	require.IsType(t, &kvpb.RangeNotFoundError{}, pErr.GetDetail())
+}
+
+// TestStoreSendUpdatesClock verifies that the store updates its clock with
+// the clock readings of the batches it serves, and rejects those further
+// ahead of its physical clock than the maximum clock offset.
+func TestStoreSendUpdatesClock(t *testing.T) {
+	ctx := context.Background()
+	store, _ := createTestStore(t)
+	clock := store.Clock()
+
+	get := func(now hlc.ClockTimestamp) (*kvpb.BatchResponse, *kvpb.Error) {
+		ba := &kvpb.BatchRequest{}
+		ba.Now = now
+		ba.Add(&kvpb.GetRequest{RequestHeader: kvpb.RequestHeader{Key: roachpb.Key("a")}})
+		return store.Send(ctx, ba)
+	}
+
+	// A remote clock reading further ahead than the max offset is rejected.
+	ahead := hlc.ClockTimestamp{WallTime: clock.PhysicalNow() + time.Hour.Nanoseconds()}
+	_, pErr := get(ahead)
+	require.IsType(t, &hlc.UntrustworthyRemoteWallTimeError{}, pErr.GoError())
+	require.True(t, clock.Now().Less(ahead.ToTimestamp()))
+
+	// A remote clock reading within the max offset moves the clock forward,
+	// and the response carries the clock reading of the store.
+	ahead = clock.NowAsClockTimestamp()
+	ahead.Logical += 7
+	br, pErr := get(ahead)
+	require.Nil(t, pErr)
+	require.True(t, ahead.Less(br.Now))
+	require.True(t, ahead.ToTimestamp().Less(clock.Now()))
+}
+
+// TestStoreConflictingTxnWaits verifies that a transaction which runs into
+// the intent of a concurrent transaction waits for it to finish before
+// writing.
+func TestStoreConflictingTxnWaits(t *testing.T) {
+	ctx := context.Background()
+	_, db := createTestStore(t)
+
+	txn1 := kv.NewTxn(ctx, db)
+	require.NoError(t, txn1.Put(ctx, "a", "1"))
+
+	errC := make(chan error, 1)
+	go func() {
+		errC <- db.Txn(ctx, func(ctx context.Context, txn *kv.Txn) error {
+			return txn.Put(ctx, "a", "2")
+		})
+	}()
+	select {
+	case err := <-errC:
+		t.Fatalf("conflicting transaction did not wait: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	require.NoError(t, txn1.Commit(ctx))
+	require.NoError(t, <-errC)
+	require.NoError(t, db.Txn(ctx, func(ctx context.Context, txn *kv.Txn) error {
+		require.Equal(t, "2", kvclientutils.GetString(t, ctx, txn, "a"))
+		return nil
+	}))
+}
+
+// TestStoreQueryIntentBumpsTimestampCache verifies that querying a missing
+// intent prevents the transaction from writing it at or below the queried
+// timestamp.
+func TestStoreQueryIntentBumpsTimestampCache(t *testing.T) {
+	ctx := context.Background()
+	store, _ := createTestStore(t)
+	clock := store.Clock()
+	txn := roachpb.MakeTransaction("test", roachpb.Key("a"), isolation.Serializable,
+		roachpb.NormalUserPriority, clock.Now())
+
+	ba := &kvpb.BatchRequest{}
+	ba.Add(&kvpb.QueryIntentRequest{
+		RequestHeader: kvpb.RequestHeader{Key: roachpb.Key("a")},
+		Txn:           txn.TxnMeta,
+	})
+	br, pErr := store.Send(ctx, ba)
+	require.Nil(t, pErr)
+	require.False(t, br.Responses[0].GetInner().(*kvpb.QueryIntentResponse).FoundIntent)
+
+	ba = &kvpb.BatchRequest{}
+	ba.Txn = &txn
+	ba.Add(&kvpb.PutRequest{
+		RequestHeader: kvpb.RequestHeader{Key: roachpb.Key("a"), Sequence: 1},
+		Value:         roachpb.MakeValueFromString("1"),
+	})
+	br, pErr = store.Send(ctx, ba)
+	require.Nil(t, pErr)
+	require.True(t, txn.WriteTimestamp.Less(br.Txn.WriteTimestamp))
+}
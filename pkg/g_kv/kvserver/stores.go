@@ -0,0 +1,187 @@
+package kvserver
+
+import (
+	"context"
+	"fmt"
+	kv "github.com/dborchard/tiny_crdb/pkg/g_kv"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"sort"
+	"sync"
+)
+
+// Stores provides methods to access a collection of stores. There's
+// a visitor pattern and also an implementation of the client.Sender
+// interface which directs a call to the appropriate store based on
+// the replica that the call is addressed to.
+type Stores struct {
+	mu struct {
+		sync.RWMutex
+		storeMap map[roachpb.StoreID]*Store
+	}
+}
+
+var _ kv.Sender = &Stores{}
+
+// NewStores returns a local-only sender which directly calls api
+// methods on stores.
+func NewStores() *Stores {
+	ls := &Stores{}
+	ls.mu.storeMap = make(map[roachpb.StoreID]*Store)
+	return ls
+}
+
+// GetStoreCount returns the number of stores this node is exporting.
+func (ls *Stores) GetStoreCount() int {
+	ls.mu.RLock()
+	defer ls.mu.RUnlock()
+	return len(ls.mu.storeMap)
+}
+
+// HasStore returns true if the specified store is owned by this Stores.
+func (ls *Stores) HasStore(storeID roachpb.StoreID) bool {
+	ls.mu.RLock()
+	defer ls.mu.RUnlock()
+	_, ok := ls.mu.storeMap[storeID]
+	return ok
+}
+
+// GetStore looks up the store by store ID. Returns an error
+// if not found.
+func (ls *Stores) GetStore(storeID roachpb.StoreID) (*Store, error) {
+	ls.mu.RLock()
+	defer ls.mu.RUnlock()
+	if store, ok := ls.mu.storeMap[storeID]; ok {
+		return store, nil
+	}
+	return nil, fmt.Errorf("store %d not found", storeID)
+}
+
+// AddStore adds the specified store to the store map.
+func (ls *Stores) AddStore(s *Store) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if _, ok := ls.mu.storeMap[s.StoreID()]; ok {
+		panic(fmt.Sprintf("cannot add store twice: %d", s.StoreID()))
+	}
+	ls.mu.storeMap[s.StoreID()] = s
+}
+
+// RemoveStore removes the specified store from the store map.
+func (ls *Stores) RemoveStore(s *Store) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	delete(ls.mu.storeMap, s.StoreID())
+}
+
+// VisitStores implements a visitor pattern over stores in the
+// storeMap. The specified function is invoked with each store in
+// turn, in the order of their store IDs. Care is taken to invoke the
+// visitor func without the lock held to avoid inconsistent lock
+// orderings, as some visitor functions may call back into the Stores
+// object.
+func (ls *Stores) VisitStores(visitor func(s *Store) error) error {
+	ls.mu.RLock()
+	stores := make([]*Store, 0, len(ls.mu.storeMap))
+	for _, s := range ls.mu.storeMap {
+		stores = append(stores, s)
+	}
+	ls.mu.RUnlock()
+	sort.Slice(stores, func(i, j int) bool { return stores[i].StoreID() < stores[j].StoreID() })
+
+	for _, s := range stores {
+		if err := visitor(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Send implements the client.Sender interface. The store is looked up from
+// the store map using the ID specified in the request.
+func (ls *Stores) Send(
+	ctx context.Context, ba *kvpb.BatchRequest,
+) (*kvpb.BatchResponse, *kvpb.Error) {
+	storeID := ba.Replica.StoreID
+	if storeID == 0 {
+		// The batch was not addressed to a replica; send it to the store
+		// holding the range, or to the first store if it is not known.
+		var err error
+		if storeID, err = ls.lookupStoreID(ba.RangeID); err != nil {
+			return nil, kvpb.NewError(err)
+		}
+	}
+	store, err := ls.GetStore(storeID)
+	if err != nil {
+		return nil, kvpb.NewError(err)
+	}
+	return store.Send(ctx, ba)
+}
+
+// RangeFeed registers a rangefeed over the specified span. The store is
+// looked up like that of a batch, by Send.
+func (ls *Stores) RangeFeed(
+	args *kvpb.RangeFeedRequest, stream kvpb.RangeFeedEventSink,
+) *kvpb.Error {
+	storeID := args.Replica.StoreID
+	if storeID == 0 {
+		var err error
+		if storeID, err = ls.lookupStoreID(args.RangeID); err != nil {
+			return kvpb.NewError(err)
+		}
+	}
+	store, err := ls.GetStore(storeID)
+	if err != nil {
+		return kvpb.NewError(err)
+	}
+	return store.RangeFeed(args, stream)
+}
+
+// lookupStoreID returns the ID of a store holding a replica of the range, or
+// of the first store if the range is unspecified.
+func (ls *Stores) lookupStoreID(rangeID roachpb.RangeID) (roachpb.StoreID, error) {
+	var storeID roachpb.StoreID
+	err := ls.VisitStores(func(s *Store) error {
+		if storeID != 0 {
+			return nil
+		}
+		if rangeID == 0 {
+			storeID = s.StoreID()
+		} else if _, err := s.GetReplica(rangeID); err == nil {
+			storeID = s.StoreID()
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if storeID == 0 {
+		return 0, kvpb.NewRangeNotFoundError(rangeID, 0)
+	}
+	return storeID, nil
+}
+
+// GetReplicaForRangeID returns the replica and store which contains the
+// specified range. It returns a RangeNotFoundError if the range is not
+// hosted on any of the stores.
+func (ls *Stores) GetReplicaForRangeID(
+	ctx context.Context, rangeID roachpb.RangeID,
+) (*Replica, *Store, error) {
+	var replica *Replica
+	var store *Store
+	if err := ls.VisitStores(func(s *Store) error {
+		if replica != nil {
+			return nil
+		}
+		if r, err := s.GetReplica(rangeID); err == nil {
+			replica, store = r, s
+		}
+		return nil
+	}); err != nil {
+		return nil, nil, err
+	}
+	if replica == nil {
+		return nil, nil, kvpb.NewRangeNotFoundError(rangeID, 0)
+	}
+	return replica, store, nil
+}
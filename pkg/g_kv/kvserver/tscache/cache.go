@@ -0,0 +1,162 @@
+// Package tscache provides a timestamp cache structure that records the
+// maximum timestamp that key ranges were read from and written to.
+package tscache
+
+import (
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/uuid"
+	"sync"
+)
+
+// defaultMaxEntries is the number of entries that the cache holds before it
+// evicts them all, raising its low water mark in the process.
+const defaultMaxEntries = 1 << 16
+
+// Cache is a bounded in-memory cache that records the maximum timestamp that
+// key ranges were read from and written to. The structure serves to protect
+// against violations of Snapshot Isolation, which requires that the outcome
+// of reading a value at a specified timestamp does not change after the read
+// has been performed. A write which would otherwise be performed below the
+// timestamp of a read is pushed above it, so that the read's outcome remains
+// valid.
+//
+// The cache is bounded: it remembers the latest timestamps of its entries
+// until it fills up, at which point it forgets them and instead raises its
+// "low water mark", which is the timestamp returned for keys that it holds
+// no entry for. This loses precision but never correctness: writes may be
+// pushed more than necessary, but never less.
+type Cache interface {
+	// Add adds the specified timestamp to the cache covering the range of
+	// keys from start to end. If end is nil, the range covers the start key
+	// only. txnID is nil for no transaction.
+	Add(start, end roachpb.Key, ts hlc.Timestamp, txnID uuid.UUID)
+	// GetMax returns the maximum timestamp which overlaps the interval
+	// spanning from start to end. If that maximum timestamp belongs to a
+	// single transaction, that transaction's ID is also returned. If no part
+	// of the specified range is overlapped by an entry in the cache, the low
+	// water mark is returned.
+	GetMax(start, end roachpb.Key) (hlc.Timestamp, uuid.UUID)
+}
+
+// New returns a new timestamp cache. Its low water mark is initialized to the
+// current time of the clock: the cache has no knowledge of the reads that
+// were served before it was created, for instance by a previous incarnation
+// of the node, so it assumes that they happened no later than now.
+func New(clock *hlc.Clock) Cache {
+	c := &cacheImpl{maxEntries: defaultMaxEntries}
+	c.mu.lowWater = clock.Now()
+	return c
+}
+
+// entry is a span of keys and the maximum timestamp at which it was
+// accessed.
+type entry struct {
+	span  roachpb.Span
+	ts    hlc.Timestamp
+	txnID uuid.UUID
+}
+
+// cacheImpl implements Cache. Point entries are indexed by key, while ranged
+// entries are kept in a slice and scanned on lookup.
+type cacheImpl struct {
+	maxEntries int
+
+	mu struct {
+		sync.Mutex
+		lowWater hlc.Timestamp
+		points   map[string]entry
+		ranges   []entry
+	}
+}
+
+var _ Cache = &cacheImpl{}
+
+// Add implements the Cache interface.
+func (c *cacheImpl) Add(start, end roachpb.Key, ts hlc.Timestamp, txnID uuid.UUID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Nothing to remember below the low water mark.
+	if ts.LessEq(c.mu.lowWater) {
+		return
+	}
+	if len(c.mu.points)+len(c.mu.ranges) >= c.maxEntries {
+		c.evictLocked()
+	}
+
+	if len(end) == 0 {
+		if c.mu.points == nil {
+			c.mu.points = make(map[string]entry)
+		}
+		k := string(start)
+		if cur, ok := c.mu.points[k]; ok {
+			ts, txnID = ratchet(cur.ts, cur.txnID, ts, txnID)
+		}
+		c.mu.points[k] = entry{span: roachpb.Span{Key: start}, ts: ts, txnID: txnID}
+		return
+	}
+	c.mu.ranges = append(c.mu.ranges, entry{
+		span:  roachpb.Span{Key: start, EndKey: end},
+		ts:    ts,
+		txnID: txnID,
+	})
+}
+
+// GetMax implements the Cache interface.
+func (c *cacheImpl) GetMax(start, end roachpb.Key) (hlc.Timestamp, uuid.UUID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	span := roachpb.Span{Key: start, EndKey: end}
+	ts, txnID := c.mu.lowWater, uuid.Nil
+	if len(end) == 0 {
+		if e, ok := c.mu.points[string(start)]; ok {
+			ts, txnID = ratchet(ts, txnID, e.ts, e.txnID)
+		}
+	} else {
+		for _, e := range c.mu.points {
+			if span.ContainsKey(e.span.Key) {
+				ts, txnID = ratchet(ts, txnID, e.ts, e.txnID)
+			}
+		}
+	}
+	for _, e := range c.mu.ranges {
+		if e.span.Overlaps(span) {
+			ts, txnID = ratchet(ts, txnID, e.ts, e.txnID)
+		}
+	}
+	return ts, txnID
+}
+
+// evictLocked forgets all entries, raising the low water mark to the maximum
+// timestamp that they held.
+func (c *cacheImpl) evictLocked() {
+	for _, e := range c.mu.points {
+		c.mu.lowWater.Forward(e.ts)
+	}
+	for _, e := range c.mu.ranges {
+		c.mu.lowWater.Forward(e.ts)
+	}
+	c.mu.points = nil
+	c.mu.ranges = nil
+}
+
+// ratchet returns the larger of the two timestamps, along with the ID of the
+// transaction that it belongs to. If the timestamps are equal but belong to
+// different transactions, neither transaction can claim ownership of the
+// timestamp and a nil ID is returned.
+func ratchet(
+	ts hlc.Timestamp, txnID uuid.UUID, otherTS hlc.Timestamp, otherTxnID uuid.UUID,
+) (hlc.Timestamp, uuid.UUID) {
+	switch {
+	case ts.Less(otherTS):
+		return otherTS, otherTxnID
+	case otherTS.Less(ts):
+		return ts, txnID
+	case txnID != otherTxnID:
+		return ts, uuid.Nil
+	default:
+		return ts, txnID
+	}
+}
@@ -0,0 +1,53 @@
+package tscache
+
+import (
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/uuid"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+// TestCache verifies that the cache returns the maximum timestamp overlapping
+// a span along with its transaction, and that eviction preserves the
+// timestamps by raising the low water mark.
+func TestCache(t *testing.T) {
+	clock := hlc.NewClock(hlc.UnixNano, time.Nanosecond)
+	c := New(clock).(*cacheImpl)
+	c.maxEntries = 3
+	lowWater := c.mu.lowWater
+
+	txn1, txn2 := uuid.MakeV4(), uuid.MakeV4()
+	ts1 := clock.Now()
+	ts2 := clock.Now()
+	c.Add(roachpb.Key("a"), nil, ts1, txn1)
+	c.Add(roachpb.Key("c"), roachpb.Key("e"), ts2, txn2)
+
+	ts, txnID := c.GetMax(roachpb.Key("a"), nil)
+	require.Equal(t, ts1, ts)
+	require.Equal(t, txn1, txnID)
+	ts, txnID = c.GetMax(roachpb.Key("d"), nil)
+	require.Equal(t, ts2, ts)
+	require.Equal(t, txn2, txnID)
+	ts, txnID = c.GetMax(roachpb.Key("a"), roachpb.Key("z"))
+	require.Equal(t, ts2, ts)
+	require.Equal(t, txn2, txnID)
+	ts, txnID = c.GetMax(roachpb.Key("b"), nil)
+	require.Equal(t, lowWater, ts)
+	require.Equal(t, uuid.Nil, txnID)
+
+	// Equal timestamps from different transactions belong to neither.
+	c.Add(roachpb.Key("a"), nil, ts1, txn2)
+	ts, txnID = c.GetMax(roachpb.Key("a"), nil)
+	require.Equal(t, ts1, ts)
+	require.Equal(t, uuid.Nil, txnID)
+
+	// Overflowing the cache evicts its entries and raises the low water mark.
+	ts3 := clock.Now()
+	c.Add(roachpb.Key("x"), nil, ts3, txn1)
+	c.Add(roachpb.Key("y"), nil, ts3, txn1)
+	ts, txnID = c.GetMax(roachpb.Key("b"), nil)
+	require.Equal(t, ts3, ts)
+	require.Equal(t, uuid.Nil, txnID)
+}
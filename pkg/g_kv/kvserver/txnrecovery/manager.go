@@ -0,0 +1,263 @@
+// Package txnrecovery implements the recovery of transactions that were
+// abandoned by their coordinator in the STAGING state of a parallel commit.
+package txnrecovery
+
+import (
+	"context"
+	"fmt"
+	kv "github.com/dborchard/tiny_crdb/pkg/g_kv"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/stop"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/uuid"
+	"sync"
+	"sync/atomic"
+)
+
+// defaultBatchSize is the maximum number of QueryIntent requests that are
+// sent in a single batch while querying a transaction's in-flight writes.
+const defaultBatchSize = 128
+
+// Manager organizes the recovery of transactions whose states require global
+// (as opposed to local) coordination to transition away from.
+type Manager interface {
+	// ResolveIndeterminateCommit attempts to resolve the status of
+	// transactions that have been abandoned while in the STAGING state,
+	// attempting to commit. Unlike most transitions in the transaction state
+	// machine, moving from STAGING to any other state requires global
+	// coordination instead of localized coordination. This method performs
+	// this coordination with the goal of finalizing the transaction as either
+	// COMMITTED or ABORTED.
+	//
+	// The method may also return a transaction in any other state if it is
+	// discovered to still be live and undergoing state transitions.
+	ResolveIndeterminateCommit(
+		context.Context, *kvpb.IndeterminateCommitError,
+	) (*roachpb.Transaction, error)
+
+	// Metrics returns the Manager's metrics struct.
+	Metrics() *Metrics
+}
+
+// Metrics holds the counters maintained by a Manager.
+type Metrics struct {
+	// AttemptsPending is the number of recovery attempts currently in
+	// progress.
+	AttemptsPending atomic.Int64
+	// Attempts is the number of recovery attempts started.
+	Attempts atomic.Int64
+	// SuccessesAsCommitted is the number of recoveries that found the
+	// transaction implicitly committed and committed it.
+	SuccessesAsCommitted atomic.Int64
+	// SuccessesAsAborted is the number of recoveries that found one of the
+	// transaction's in-flight writes missing and aborted it.
+	SuccessesAsAborted atomic.Int64
+	// SuccessesAsPending is the number of recoveries that found the
+	// transaction still in progress.
+	SuccessesAsPending atomic.Int64
+	// Failures is the number of recoveries that failed with an error.
+	Failures atomic.Int64
+}
+
+// recoveryCall is an in-flight recovery of a single transaction. Concurrent
+// callers attempting to recover the same transaction wait on the same call.
+type recoveryCall struct {
+	done chan struct{}
+	txn  *roachpb.Transaction
+	err  error
+}
+
+// manager implements the Manager interface.
+type manager struct {
+	clock   *hlc.Clock
+	db      *kv.DB
+	stopper *stop.Stopper
+	metrics Metrics
+
+	mu struct {
+		sync.Mutex
+		// inflight contains the recoveries in progress, keyed by the ID of
+		// the transaction being recovered.
+		inflight map[uuid.UUID]*recoveryCall
+	}
+}
+
+// NewManager returns an implementation of a transaction recovery Manager.
+func NewManager(clock *hlc.Clock, db *kv.DB, stopper *stop.Stopper) Manager {
+	m := &manager{
+		clock:   clock,
+		db:      db,
+		stopper: stopper,
+	}
+	m.mu.inflight = make(map[uuid.UUID]*recoveryCall)
+	return m
+}
+
+// ResolveIndeterminateCommit implements the Manager interface.
+func (m *manager) ResolveIndeterminateCommit(
+	ctx context.Context, ice *kvpb.IndeterminateCommitError,
+) (*roachpb.Transaction, error) {
+	txn := &ice.StagingTxn
+	if txn.Status != roachpb.STAGING {
+		return nil, fmt.Errorf("IndeterminateCommitError with non-STAGING transaction: %s", txn.Short())
+	}
+
+	// Join an in-flight recovery of the same transaction, if there is one.
+	// Otherwise, launch one. The recovery runs in an async task so that it is
+	// not canceled when the context of the caller that launched it is, which
+	// would fail every caller waiting on it.
+	m.mu.Lock()
+	c, ok := m.mu.inflight[txn.ID]
+	if !ok {
+		c = &recoveryCall{done: make(chan struct{})}
+		m.mu.inflight[txn.ID] = c
+		m.mu.Unlock()
+		if err := m.stopper.RunAsyncTask(context.Background(), "recover-txn", func(ctx context.Context) {
+			m.runRecovery(ctx, txn, c)
+		}); err != nil {
+			m.finishCall(txn.ID, c, nil, err)
+		}
+	} else {
+		m.mu.Unlock()
+	}
+
+	select {
+	case <-c.done:
+		return c.txn, c.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// runRecovery runs the recovery of the transaction and publishes its result
+// to the recovery call.
+func (m *manager) runRecovery(ctx context.Context, txn *roachpb.Transaction, c *recoveryCall) {
+	m.metrics.AttemptsPending.Add(1)
+	m.metrics.Attempts.Add(1)
+	defer m.metrics.AttemptsPending.Add(-1)
+
+	res, err := m.resolveIndeterminateCommitForTxn(ctx, txn)
+	m.updateMetrics(res, err)
+	m.finishCall(txn.ID, c, res, err)
+}
+
+// finishCall removes the recovery call from the in-flight set and releases
+// the callers waiting on it.
+func (m *manager) finishCall(
+	txnID uuid.UUID, c *recoveryCall, txn *roachpb.Transaction, err error,
+) {
+	m.mu.Lock()
+	delete(m.mu.inflight, txnID)
+	m.mu.Unlock()
+	c.txn, c.err = txn, err
+	close(c.done)
+}
+
+// resolveIndeterminateCommitForTxn attempts to resolve the status of a
+// transaction in the STAGING state. It queries each of the transaction's
+// in-flight writes. If all of them are found, the transaction is implicitly
+// committed and is moved to COMMITTED. If any of them is missing, the
+// transaction can not have been implicitly committed, and it is moved to
+// ABORTED. The querying of a missing write prevents it from succeeding in
+// the future, so that the abort is safe even if the coordinator is still
+// alive.
+//
+// Between each batch of queries, the transaction record is consulted, so
+// that the recovery terminates early if the transaction is finalized or
+// moves on to a new epoch or timestamp while it is being recovered.
+func (m *manager) resolveIndeterminateCommitForTxn(
+	ctx context.Context, txn *roachpb.Transaction,
+) (*roachpb.Transaction, error) {
+	var preventedIntent bool
+	writes := txn.InFlightWrites
+	for len(writes) > 0 {
+		batchSize := len(writes)
+		if batchSize > defaultBatchSize {
+			batchSize = defaultBatchSize
+		}
+		b := &kv.Batch{}
+		b.AddRawRequest(&kvpb.QueryTxnRequest{
+			RequestHeader: kvpb.RequestHeader{Key: txn.Key},
+			Txn:           txn.TxnMeta,
+		})
+		for _, w := range writes[:batchSize] {
+			meta := txn.TxnMeta
+			meta.Sequence = w.Sequence
+			b.AddRawRequest(&kvpb.QueryIntentRequest{
+				RequestHeader: kvpb.RequestHeader{Key: w.Key},
+				Txn:           meta,
+			})
+		}
+		writes = writes[batchSize:]
+		if err := m.db.Run(ctx, b); err != nil {
+			return nil, err
+		}
+
+		resps := b.RawResponse().Responses
+		queriedTxn := &resps[0].GetInner().(*kvpb.QueryTxnResponse).QueriedTxn
+		if changed, ok := m.checkTxnChanged(txn, queriedTxn); ok {
+			return changed, nil
+		}
+		for _, ru := range resps[1:] {
+			if !ru.GetInner().(*kvpb.QueryIntentResponse).FoundIntent {
+				preventedIntent = true
+				break
+			}
+		}
+		if preventedIntent {
+			break
+		}
+	}
+
+	b := &kv.Batch{}
+	b.AddRawRequest(&kvpb.RecoverTxnRequest{
+		RequestHeader:       kvpb.RequestHeader{Key: txn.Key},
+		Txn:                 txn.TxnMeta,
+		ImplicitlyCommitted: !preventedIntent,
+	})
+	if err := m.db.Run(ctx, b); err != nil {
+		return nil, err
+	}
+	resp := b.RawResponse().Responses[0].GetInner().(*kvpb.RecoverTxnResponse)
+	return &resp.RecoveredTxn, nil
+}
+
+// checkTxnChanged determines whether the queried transaction record has
+// changed from the STAGING state that is being recovered in a way that makes
+// the recovery unnecessary. If so, the queried transaction is returned with
+// ok set to true.
+func (m *manager) checkTxnChanged(
+	staging, queried *roachpb.Transaction,
+) (*roachpb.Transaction, bool) {
+	if queried.Status.IsFinalized() ||
+		staging.Epoch < queried.Epoch ||
+		staging.WriteTimestamp.Less(queried.WriteTimestamp) {
+		return queried, true
+	}
+	return nil, false
+}
+
+// updateMetrics updates the Manager's metrics to account for a new
+// transaction recovery attempt.
+func (m *manager) updateMetrics(txn *roachpb.Transaction, err error) {
+	if err != nil {
+		m.metrics.Failures.Add(1)
+		return
+	}
+	switch txn.Status {
+	case roachpb.COMMITTED:
+		m.metrics.SuccessesAsCommitted.Add(1)
+	case roachpb.ABORTED:
+		m.metrics.SuccessesAsAborted.Add(1)
+	case roachpb.PENDING, roachpb.STAGING:
+		m.metrics.SuccessesAsPending.Add(1)
+	default:
+		panic(fmt.Sprintf("unexpected txn status %s", txn.Status))
+	}
+}
+
+// Metrics implements the Manager interface.
+func (m *manager) Metrics() *Metrics {
+	return &m.metrics
+}
@@ -0,0 +1,255 @@
+package txnrecovery_test
+
+import (
+	"context"
+	keys "github.com/dborchard/tiny_crdb/pkg/g_keys"
+	kv "github.com/dborchard/tiny_crdb/pkg/g_kv"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvclient/kvcoord"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/batcheval"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/concurrency/isolation"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/txnrecovery"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	storage "github.com/dborchard/tiny_crdb/pkg/h_storage"
+	"github.com/dborchard/tiny_crdb/pkg/h_storage/enginepb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/stop"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testContext evaluates batches against an in-memory engine, standing in for
+// the replicas holding the recovered transaction's record and intents.
+type testContext struct {
+	clock   *hlc.Clock
+	eng     storage.Engine
+	db      *kv.DB
+	stopper *stop.Stopper
+
+	mu sync.Mutex
+	// block, if set, is waited on before evaluating a RecoverTxn request.
+	block chan struct{}
+	// recoverCalls counts the RecoverTxn requests evaluated.
+	recoverCalls int
+}
+
+func newTestContext(t *testing.T) *testContext {
+	ctx := context.Background()
+	eng, err := storage.Open(ctx, storage.Location{})
+	require.NoError(t, err)
+	t.Cleanup(eng.Close)
+
+	tc := &testContext{
+		clock:   hlc.NewClock(hlc.UnixNano, time.Nanosecond),
+		eng:     eng,
+		stopper: stop.NewStopper(),
+	}
+	t.Cleanup(func() { tc.stopper.Stop(ctx) })
+	factory := kvcoord.NewTxnCoordSenderFactory(
+		kvcoord.TxnCoordSenderFactoryConfig{Clock: tc.clock}, kv.SenderFunc(tc.send))
+	tc.db = kv.NewDB(ctx, factory, tc.clock, tc.stopper)
+	return tc
+}
+
+func (tc *testContext) send(
+	ctx context.Context, ba *kvpb.BatchRequest,
+) (*kvpb.BatchResponse, *kvpb.Error) {
+	if _, ok := ba.GetArg(kvpb.RecoverTxn); ok {
+		tc.mu.Lock()
+		tc.recoverCalls++
+		block := tc.block
+		tc.mu.Unlock()
+		if block != nil {
+			<-block
+		}
+	}
+
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	h := ba.Header
+	if h.Timestamp.IsEmpty() {
+		h.Timestamp = tc.clock.Now()
+	}
+	if h.Txn != nil {
+		h.Timestamp = h.Txn.ReadTimestamp
+	}
+	evalCtx := (&batcheval.MockEvalCtx{Clock: tc.clock}).EvalContext()
+
+	batch := tc.eng.NewBatch()
+	defer batch.Close()
+	br := &kvpb.BatchResponse{}
+	for _, ru := range ba.Requests {
+		args := ru.GetInner()
+		cmd, ok := batcheval.LookupCommand(args.Method())
+		if !ok {
+			return nil, kvpb.NewErrorf("unknown command %s", args.Method())
+		}
+		reply := kvpb.CreateReply(args)
+		cArgs := batcheval.CommandArgs{EvalCtx: evalCtx, Header: h, Args: args}
+		var err error
+		if cmd.EvalRW != nil {
+			_, err = cmd.EvalRW(ctx, batch, cArgs, reply)
+		} else {
+			_, err = cmd.EvalRO(ctx, batch, cArgs, reply)
+		}
+		if err != nil {
+			return nil, kvpb.NewErrorWithTxn(err, ba.Txn)
+		}
+		br.Add(reply)
+	}
+	if err := batch.Commit(false /* sync */); err != nil {
+		return nil, kvpb.NewError(err)
+	}
+	br.Txn = h.Txn
+	return br, nil
+}
+
+// makeStagingTxn creates a transaction which writes intents to the provided
+// keys, one per sequence number, and then declares writes to each of the
+// keys in inFlight as in-flight in its STAGING record. Only the keys in
+// written receive intents; those that are not in-flight are recorded in the
+// record's lock spans.
+func (tc *testContext) makeStagingTxn(
+	t *testing.T, written []string, inFlight []string,
+) *roachpb.Transaction {
+	ctx := context.Background()
+	txn := roachpb.MakeTransaction("staging", roachpb.Key("a"), isolation.Serializable,
+		roachpb.NormalUserPriority, tc.clock.Now())
+	seqs := make(map[string]enginepb.TxnSeq)
+	for i, k := range append(append([]string(nil), written...), inFlight...) {
+		if _, ok := seqs[k]; !ok {
+			seqs[k] = enginepb.TxnSeq(i + 1)
+		}
+	}
+	for _, k := range written {
+		txn.Sequence = seqs[k]
+		ba := &kvpb.BatchRequest{}
+		ba.Txn = &txn
+		ba.Add(&kvpb.PutRequest{
+			RequestHeader: kvpb.RequestHeader{Key: roachpb.Key(k)},
+			Value:         roachpb.MakeValueFromString("v"),
+		})
+		_, pErr := tc.send(ctx, ba)
+		require.Nil(t, pErr)
+	}
+	txn.Status = roachpb.STAGING
+	txn.LastHeartbeat = tc.clock.Now()
+	isInFlight := make(map[string]bool)
+	for _, k := range inFlight {
+		isInFlight[k] = true
+		txn.InFlightWrites = append(txn.InFlightWrites,
+			roachpb.SequencedWrite{Key: roachpb.Key(k), Sequence: seqs[k]})
+	}
+	for _, k := range written {
+		if !isInFlight[k] {
+			txn.LockSpans = append(txn.LockSpans, roachpb.Span{Key: roachpb.Key(k)})
+		}
+	}
+	require.NoError(t, storage.MVCCPutProto(ctx, tc.eng, keys.TransactionKey(txn.Key, txn.ID),
+		hlc.Timestamp{}, &txn, storage.MVCCWriteOptions{}))
+	return &txn
+}
+
+// readKey reads key non-transactionally, returning whether a value was found.
+// It fails if the key still has an intent.
+func (tc *testContext) readKey(t *testing.T, key string) bool {
+	res, err := storage.MVCCGet(context.Background(), tc.eng, roachpb.Key(key),
+		tc.clock.Now(), storage.MVCCGetOptions{})
+	require.NoError(t, err)
+	return res.Value != nil
+}
+
+// TestResolveIndeterminateCommit verifies that a STAGING transaction is
+// committed if all of its in-flight writes are found, and aborted if any of
+// them is missing. In both cases, its intents are resolved.
+func TestResolveIndeterminateCommit(t *testing.T) {
+	ctx := context.Background()
+	testCases := []struct {
+		name     string
+		written  []string
+		inFlight []string
+		expected roachpb.TransactionStatus
+	}{
+		{"all writes found", []string{"a", "b", "c"}, []string{"b", "c"}, roachpb.COMMITTED},
+		{"write missing", []string{"a", "b"}, []string{"b", "c"}, roachpb.ABORTED},
+		{"no in-flight writes", []string{"a"}, nil, roachpb.COMMITTED},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			tc := newTestContext(t)
+			m := txnrecovery.NewManager(tc.clock, tc.db, tc.stopper)
+			txn := tc.makeStagingTxn(t, c.written, c.inFlight)
+
+			recovered, err := m.ResolveIndeterminateCommit(ctx, kvpb.NewIndeterminateCommitError(*txn))
+			require.NoError(t, err)
+			require.Equal(t, c.expected, recovered.Status)
+			for _, k := range c.written {
+				require.Equal(t, c.expected == roachpb.COMMITTED, tc.readKey(t, k), "key %s", k)
+			}
+
+			// Recovering a finalized transaction is a no-op.
+			recovered, err = m.ResolveIndeterminateCommit(ctx, kvpb.NewIndeterminateCommitError(*txn))
+			require.NoError(t, err)
+			require.Equal(t, c.expected, recovered.Status)
+
+			metrics := m.Metrics()
+			require.Equal(t, int64(2), metrics.Attempts.Load())
+			require.Equal(t, int64(0), metrics.AttemptsPending.Load())
+			require.Equal(t, int64(0), metrics.Failures.Load())
+			if c.expected == roachpb.COMMITTED {
+				require.Equal(t, int64(2), metrics.SuccessesAsCommitted.Load())
+			} else {
+				require.Equal(t, int64(2), metrics.SuccessesAsAborted.Load())
+			}
+		})
+	}
+}
+
+// TestResolveIndeterminateCommitDeduplicates verifies that concurrent
+// recovery attempts of the same transaction share a single recovery.
+func TestResolveIndeterminateCommitDeduplicates(t *testing.T) {
+	ctx := context.Background()
+	tc := newTestContext(t)
+	m := txnrecovery.NewManager(tc.clock, tc.db, tc.stopper)
+	txn := tc.makeStagingTxn(t, []string{"a", "b"}, []string{"b"})
+	block := make(chan struct{})
+	tc.mu.Lock()
+	tc.block = block
+	tc.mu.Unlock()
+
+	const n = 5
+	var started, wg sync.WaitGroup
+	results := make([]*roachpb.Transaction, n)
+	errs := make([]error, n)
+	for i := 0; i < n; i++ {
+		started.Add(1)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			started.Done()
+			results[i], errs[i] = m.ResolveIndeterminateCommit(ctx, kvpb.NewIndeterminateCommitError(*txn))
+		}(i)
+	}
+	// Wait for the recovery to reach RecoverTxn and for every caller to join
+	// it before releasing it.
+	started.Wait()
+	require.Eventually(t, func() bool {
+		tc.mu.Lock()
+		defer tc.mu.Unlock()
+		return tc.recoverCalls == 1
+	}, 10*time.Second, 5*time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	close(block)
+	wg.Wait()
+
+	for i := 0; i < n; i++ {
+		require.NoError(t, errs[i])
+		require.Equal(t, roachpb.COMMITTED, results[i].Status)
+	}
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	require.Equal(t, 1, tc.recoverCalls)
+	require.Equal(t, int64(1), m.Metrics().Attempts.Load())
+}
@@ -0,0 +1,513 @@
+// Package txnwait implements the queue in which transactions wait on the
+// transactions whose locks they conflict with, and in which deadlocks between
+// waiting transactions are detected and broken.
+package txnwait
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	kv "github.com/dborchard/tiny_crdb/pkg/g_kv"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/dborchard/tiny_crdb/pkg/h_storage/enginepb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/uuid"
+	"sync"
+	"time"
+)
+
+// TxnLivenessHeartbeatMultiplier specifies what multiple the transaction
+// liveness threshold should be of the transaction heartbeat interval.
+const TxnLivenessHeartbeatMultiplier = 5
+
+// TxnLivenessThreshold is the maximum duration between transaction heartbeats
+// before the transaction is considered expired by Queue. Transaction
+// coordinators heartbeat their transaction records once a second, so a
+// record goes TxnLivenessHeartbeatMultiplier heartbeats without being
+// updated before it expires. It is exposed and mutable to allow tests to
+// override it.
+var TxnLivenessThreshold = TxnLivenessHeartbeatMultiplier * time.Second
+
+// defaultQueryInterval is the interval at which waiting pushers query the
+// status of the pushee and of the pusher transactions.
+const defaultQueryInterval = 50 * time.Millisecond
+
+// TxnExpiration computes the timestamp after which the transaction will be
+// considered expired.
+func TxnExpiration(txn *roachpb.Transaction) hlc.Timestamp {
+	return txn.LastActive().Add(TxnLivenessThreshold.Nanoseconds(), 0)
+}
+
+// IsExpired is true if the given transaction is expired.
+func IsExpired(now hlc.Timestamp, txn *roachpb.Transaction) bool {
+	return TxnExpiration(txn).LessEq(now)
+}
+
+// CanPushWithPriority returns true if the given pusher can push the pushee
+// based on its priority. Transactions at the maximum priority can push all
+// other transactions, and transactions at the minimum priority can be pushed
+// by all other transactions. Between these bounds, priorities do not allow a
+// pusher to push: the pusher waits for the pushee to finish or to expire.
+func CanPushWithPriority(pusher, pushee enginepb.TxnPriority) bool {
+	return (pusher > enginepb.MinTxnPriority && pushee == enginepb.MinTxnPriority) ||
+		(pusher == enginepb.MaxTxnPriority && pushee < pusher)
+}
+
+// ShouldPushImmediately returns whether the PushTxn request should proceed
+// without queueing. This is true for pushes which are neither ABORT nor
+// TIMESTAMP, but also for ABORT and TIMESTAMP pushes which are forced or
+// where the pusher's priority allows it to push the pushee.
+func ShouldPushImmediately(req *kvpb.PushTxnRequest) bool {
+	if req.Force {
+		return true
+	}
+	if !(req.PushType == kvpb.PUSH_ABORT || req.PushType == kvpb.PUSH_TIMESTAMP) {
+		return true
+	}
+	return CanPushWithPriority(req.PusherTxn.Priority, req.PusheeTxn.Priority)
+}
+
+// isPushed returns whether the PushTxn request has already been
+// fulfilled by the current transaction state. This may be true
+// for transactions with pushed timestamps.
+func isPushed(req *kvpb.PushTxnRequest, txn *roachpb.Transaction) bool {
+	return txn.Status.IsFinalized() ||
+		(req.PushType == kvpb.PUSH_TIMESTAMP && req.PushTo.LessEq(txn.WriteTimestamp))
+}
+
+// createPushTxnResponse returns a PushTxnResponse struct with a
+// copy of the supplied transaction. It is necessary to fully copy
+// each field in the transaction to avoid race conditions.
+func createPushTxnResponse(txn *roachpb.Transaction) *kvpb.PushTxnResponse {
+	return &kvpb.PushTxnResponse{PusheeTxn: *txn.Clone()}
+}
+
+// A waitingPush represents a PushTxn command that is waiting on the
+// pushee transaction to commit or abort. It maintains a transitive
+// set of all txns which are waiting on this txn in order to detect
+// dependency cycles.
+type waitingPush struct {
+	req *kvpb.PushTxnRequest
+	// pending channel receives updated, pushed txn or nil if queue is cleared.
+	pending chan *roachpb.Transaction
+	mu      struct {
+		sync.Mutex
+		dependents map[uuid.UUID]enginepb.TxnMeta // transitive set of txns waiting on this txn
+	}
+}
+
+// updateDependents replaces the set of transactions known to be waiting,
+// directly or transitively, on the pusher.
+func (push *waitingPush) updateDependents(waitingTxns []enginepb.TxnMeta) {
+	push.mu.Lock()
+	defer push.mu.Unlock()
+	push.mu.dependents = make(map[uuid.UUID]enginepb.TxnMeta, len(waitingTxns))
+	for _, meta := range waitingTxns {
+		push.mu.dependents[meta.ID] = meta
+	}
+}
+
+// hasDependent returns whether the given transaction is known to be waiting,
+// directly or transitively, on the pusher.
+func (push *waitingPush) hasDependent(txnID uuid.UUID) bool {
+	push.mu.Lock()
+	defer push.mu.Unlock()
+	_, ok := push.mu.dependents[txnID]
+	return ok
+}
+
+// A pendingTxn represents a transaction waiting to be pushed by one
+// or more PushTxn requests.
+type pendingTxn struct {
+	// txn is the latest known state of the pushee's transaction record. It
+	// is nil until the record is updated while pushers are waiting.
+	txn *roachpb.Transaction
+	// waitingPushes are the pushes waiting on the transaction.
+	waitingPushes []*waitingPush
+}
+
+// getDependentsSet returns the set of transactions waiting, directly or
+// transitively, on the pending transaction. The caller must hold the Queue's
+// mutex.
+func (pt *pendingTxn) getDependentsSet() map[uuid.UUID]enginepb.TxnMeta {
+	set := map[uuid.UUID]enginepb.TxnMeta{}
+	for _, push := range pt.waitingPushes {
+		if id := push.req.PusherTxn.ID; id != (uuid.UUID{}) {
+			set[id] = push.req.PusherTxn.TxnMeta
+			push.mu.Lock()
+			for txnID, meta := range push.mu.dependents {
+				set[txnID] = meta
+			}
+			push.mu.Unlock()
+		}
+	}
+	return set
+}
+
+// TestingKnobs represents testing knobs for a Queue.
+type TestingKnobs struct {
+	// QueryInterval overrides the interval at which waiting pushers query the
+	// status of the pushee and pusher transactions.
+	QueryInterval time.Duration
+}
+
+// Config contains the dependencies to construct a Queue.
+type Config struct {
+	// DB is used to query the records of the pushee and pusher transactions,
+	// and to force the abort of the victim of a deadlock.
+	DB    *kv.DB
+	Clock *hlc.Clock
+	Knobs TestingKnobs
+}
+
+// Queue enqueues PushTxn requests which are waiting on extant txns
+// with conflicting intents to abort or commit.
+//
+// Internally, it maintains a map from extant txn IDs to queues of pending
+// PushTxn requests.
+//
+// When a write intent is encountered, the command which encountered it (called
+// the "pusher") issues a PushTxn command to the transaction which owns the
+// intent (the "pushee"). A PushTxn that cannot succeed immediately, because
+// the pushee is alive and the pusher's priority does not allow it to push the
+// pushee, waits in the Queue of the range holding the pushee's transaction
+// record until one of the following happens:
+//
+//   - the pushee's record is updated in a way that fulfills the push: the
+//     pushee committed or aborted, or its timestamp was pushed past the
+//     requested timestamp. The updated record is returned to the pusher.
+//   - the pushee's record expires because its coordinator stopped
+//     heartbeating it. The pusher then goes on to push the pushee, which
+//     aborts it.
+//   - the pusher itself is aborted, in which case the push fails with a
+//     TransactionAbortedError.
+//   - the pusher detects a dependency cycle, i.e. a deadlock.
+//
+// Deadlocks are detected by propagating dependency chains between waiting
+// pushers. Each waiting pusher periodically queries its own transaction
+// record, and learns from the response the set of transactions waiting on it,
+// directly or transitively. If the pushee is part of that set, the
+// transactions form a cycle. The transactions of the cycle are those of the
+// set which the pusher waits on in turn, and the victim is the one with the
+// lowest priority or, at equal priorities, the smallest transaction ID. Every
+// pusher in the cycle picks the same victim, so exactly one of them breaks
+// the deadlock: the pusher of the victim, which force-aborts it.
+//
+// Queue is thread safe.
+type Queue struct {
+	cfg Config
+	mu  struct {
+		sync.Mutex
+		txns map[uuid.UUID]*pendingTxn
+	}
+}
+
+// NewQueue instantiates a new Queue.
+func NewQueue(cfg Config) *Queue {
+	return &Queue{cfg: cfg}
+}
+
+// Enable allows transactions to be enqueued and waiting pushers
+// added. This method must be idempotent as it can be invoked multiple
+// times as range leases are updated for the same replica.
+func (q *Queue) Enable() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.mu.txns == nil {
+		q.mu.txns = map[uuid.UUID]*pendingTxn{}
+	}
+}
+
+// Clear empties the queue and returns all waiters. This method should
+// be invoked when the replica loses or transfers its lease. If
+// `disable` is true, future transactions may not be enqueued or
+// waiting pushers added. Call Enable() once the lease is again
+// acquired by the replica.
+func (q *Queue) Clear(disable bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, pending := range q.mu.txns {
+		for _, push := range pending.waitingPushes {
+			select {
+			case push.pending <- nil:
+			default:
+			}
+		}
+	}
+	if disable {
+		q.mu.txns = nil
+	} else {
+		q.mu.txns = map[uuid.UUID]*pendingTxn{}
+	}
+}
+
+// IsEnabled is true if the queue is enabled.
+func (q *Queue) IsEnabled() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.mu.txns != nil
+}
+
+// UpdateTxn is invoked to update a transaction's status after a successful
+// PushTxn, HeartbeatTxn or EndTxn command. It unblocks all pushers waiting on
+// the transaction, which decide whether their push is now fulfilled.
+func (q *Queue) UpdateTxn(ctx context.Context, txn *roachpb.Transaction) {
+	txn = txn.Clone()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	pending, ok := q.mu.txns[txn.ID]
+	if !ok {
+		return
+	}
+	pending.txn = txn
+	for _, push := range pending.waitingPushes {
+		// Replace any update not yet consumed by the pusher with the latest.
+		select {
+		case <-push.pending:
+		default:
+		}
+		push.pending <- txn
+	}
+}
+
+// GetDependents returns a slice of transactions waiting on the specified
+// txn either directly or indirectly.
+func (q *Queue) GetDependents(txnID uuid.UUID) []enginepb.TxnMeta {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.mu.txns == nil {
+		return nil
+	}
+	pending, ok := q.mu.txns[txnID]
+	if !ok {
+		return nil
+	}
+	set := pending.getDependentsSet()
+	dependents := make([]enginepb.TxnMeta, 0, len(set))
+	for _, meta := range set {
+		dependents = append(dependents, meta)
+	}
+	return dependents
+}
+
+// MaybeWaitForPush checks whether there is a queue already
+// established for pushing the transaction. If not, or if the PushTxn
+// request isn't queueable, return immediately. If there is a queue,
+// enqueue this request as a waiter and enter a select loop waiting
+// for resolution.
+//
+// If the transaction is successfully pushed while this method is waiting,
+// the first return value is a non-nil PushTxnResponse object.
+//
+// If the pushee's record expires, or the pusher breaks a deadlock, while this
+// method is waiting, both return values are nil and the caller should proceed
+// with evaluating the PushTxn request, which then succeeds.
+func (q *Queue) MaybeWaitForPush(
+	ctx context.Context, req *kvpb.PushTxnRequest,
+) (*kvpb.PushTxnResponse, *kvpb.Error) {
+	if ShouldPushImmediately(req) {
+		return nil, nil
+	}
+
+	q.mu.Lock()
+	// If the txn wait queue is not enabled, don't queue the push.
+	if q.mu.txns == nil {
+		q.mu.Unlock()
+		return nil, nil
+	}
+	pending, ok := q.mu.txns[req.PusheeTxn.ID]
+	if !ok {
+		pending = &pendingTxn{}
+		q.mu.txns[req.PusheeTxn.ID] = pending
+	}
+	// If the pushee's record is already known to fulfill the push, return
+	// it right away.
+	if txn := pending.txn; txn != nil && isPushed(req, txn) {
+		q.mu.Unlock()
+		return createPushTxnResponse(txn), nil
+	}
+
+	push := &waitingPush{
+		req:     req,
+		pending: make(chan *roachpb.Transaction, 1),
+	}
+	pending.waitingPushes = append(pending.waitingPushes, push)
+	q.mu.Unlock()
+
+	defer q.dequeuePush(req.PusheeTxn.ID, push)
+	return q.waitForPush(ctx, req, push)
+}
+
+// dequeuePush removes the waiting push from the queue of the pushee, and the
+// pushee's entry if no other push is waiting on it.
+func (q *Queue) dequeuePush(pusheeID uuid.UUID, push *waitingPush) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	pending, ok := q.mu.txns[pusheeID]
+	if !ok {
+		return
+	}
+	for i, p := range pending.waitingPushes {
+		if p == push {
+			pending.waitingPushes = append(pending.waitingPushes[:i], pending.waitingPushes[i+1:]...)
+			break
+		}
+	}
+	if len(pending.waitingPushes) == 0 {
+		delete(q.mu.txns, pusheeID)
+	}
+}
+
+// waitForPush waits until the push is fulfilled, the pushee expires, the
+// pusher is aborted or a deadlock is detected. See MaybeWaitForPush.
+func (q *Queue) waitForPush(
+	ctx context.Context, req *kvpb.PushTxnRequest, push *waitingPush,
+) (*kvpb.PushTxnResponse, *kvpb.Error) {
+	interval := q.cfg.Knobs.QueryInterval
+	if interval == 0 {
+		interval = defaultQueryInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			// Caller has given up.
+			return nil, kvpb.NewError(ctx.Err())
+
+		case txn := <-push.pending:
+			if txn == nil {
+				// The queue was cleared. Let the caller evaluate the push,
+				// which will either succeed or send it back to a queue.
+				return nil, nil
+			}
+			if isPushed(req, txn) {
+				return createPushTxnResponse(txn), nil
+			}
+
+		case <-ticker.C:
+			// Check whether the pushee has been updated, possibly without
+			// this queue hearing about it, or has expired.
+			pushee, _, pErr := q.queryTxnStatus(ctx, req.PusheeTxn)
+			if pErr != nil {
+				return nil, pErr
+			}
+			if isPushed(req, pushee) {
+				return createPushTxnResponse(pushee), nil
+			}
+			if IsExpired(q.cfg.Clock.Now(), pushee) {
+				// The pushee has been abandoned by its coordinator. Let the
+				// caller evaluate the push, which will abort it.
+				return nil, nil
+			}
+
+			// Non-transactional pushers cannot be part of a deadlock and
+			// cannot be aborted.
+			if req.PusherTxn.ID == (uuid.UUID{}) {
+				continue
+			}
+			pusher, waitingTxns, pErr := q.queryTxnStatus(ctx, req.PusherTxn.TxnMeta)
+			if pErr != nil {
+				return nil, pErr
+			}
+			if pusher.Status == roachpb.ABORTED {
+				// The pusher was aborted, for example by a higher priority
+				// transaction or as the victim of a deadlock. There is no
+				// point in waiting any longer.
+				return nil, kvpb.NewErrorWithTxn(
+					kvpb.NewTransactionAbortedError(kvpb.ABORT_REASON_PUSHER_ABORTED), pusher)
+			}
+
+			// Check for dependency cycle to find and break deadlocks.
+			push.updateDependents(waitingTxns)
+			if push.hasDependent(req.PusheeTxn.ID) {
+				victim, pErr := q.deadlockVictim(ctx, pusher, waitingTxns)
+				if pErr != nil {
+					return nil, pErr
+				}
+				if victim == req.PusheeTxn.ID {
+					return q.forcePushAbort(ctx, req)
+				}
+			}
+		}
+	}
+}
+
+// deadlockVictim returns the ID of the transaction to abort to break the
+// dependency cycle in which the pusher, waiting on a pushee which is one of
+// its dependents, finds itself. The transactions of the cycle are the pusher
+// and those of its dependents which have the pusher as a dependent in turn;
+// the others merely wait on the cycle. The victim is the transaction of the
+// cycle with the lowest priority or, at equal priorities, the smallest ID, as
+// found in their records.
+func (q *Queue) deadlockVictim(
+	ctx context.Context, pusher *roachpb.Transaction, dependents []enginepb.TxnMeta,
+) (uuid.UUID, *kvpb.Error) {
+	victim := pusher.TxnMeta
+	for _, meta := range dependents {
+		txn, waitingTxns, pErr := q.queryTxnStatus(ctx, meta)
+		if pErr != nil {
+			return uuid.UUID{}, pErr
+		}
+		for _, w := range waitingTxns {
+			if w.ID == pusher.ID {
+				if txnLess(txn.TxnMeta, victim) {
+					victim = txn.TxnMeta
+				}
+				break
+			}
+		}
+	}
+	return victim.ID, nil
+}
+
+// txnLess orders transactions by priority and then by ID.
+func txnLess(a, b enginepb.TxnMeta) bool {
+	return a.Priority < b.Priority ||
+		(a.Priority == b.Priority && bytes.Compare(a.ID.GetBytes(), b.ID.GetBytes()) < 0)
+}
+
+// queryTxnStatus does a "query" push on the specified transaction
+// to glean possible changes, such as a higher timestamp and/or
+// priority. It turns out this is necessary while a request is waiting
+// to push another transaction, as the pushee's record may be updated
+// on a different node, and as the pusher's own record may be aborted
+// by another pusher.
+//
+// It returns the current state of the transaction's record, and the
+// transactions waiting on it.
+func (q *Queue) queryTxnStatus(
+	ctx context.Context, txnMeta enginepb.TxnMeta,
+) (*roachpb.Transaction, []enginepb.TxnMeta, *kvpb.Error) {
+	b := &kv.Batch{}
+	b.AddRawRequest(&kvpb.QueryTxnRequest{
+		RequestHeader: kvpb.RequestHeader{Key: txnMeta.Key},
+		Txn:           txnMeta,
+	})
+	if err := q.cfg.DB.Run(ctx, b); err != nil {
+		return nil, nil, kvpb.NewError(err)
+	}
+	br := b.RawResponse()
+	resp := br.Responses[0].GetInner().(*kvpb.QueryTxnResponse)
+	return &resp.QueriedTxn, resp.WaitingTxns, nil
+}
+
+// forcePushAbort upgrades the PushTxn request to a "forced" push abort,
+// which overrides the normal expiration and priority checks to ensure
+// that the transaction is aborted. This is used to break deadlocks.
+func (q *Queue) forcePushAbort(
+	ctx context.Context, req *kvpb.PushTxnRequest,
+) (*kvpb.PushTxnResponse, *kvpb.Error) {
+	forceReq := req.ShallowCopy().(*kvpb.PushTxnRequest)
+	forceReq.Force = true
+	forceReq.PushType = kvpb.PUSH_ABORT
+	b := &kv.Batch{}
+	b.AddRawRequest(forceReq)
+	if err := q.cfg.DB.Run(ctx, b); err != nil {
+		return nil, kvpb.NewError(fmt.Errorf("failed to break deadlock by aborting %s: %w",
+			req.PusheeTxn.Short(), err))
+	}
+	return b.RawResponse().Responses[0].GetInner().(*kvpb.PushTxnResponse), nil
+}
@@ -0,0 +1,333 @@
+package txnwait_test
+
+import (
+	"context"
+	kv "github.com/dborchard/tiny_crdb/pkg/g_kv"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvclient/kvcoord"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/batcheval"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/batcheval/result"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/concurrency/isolation"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/txnwait"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	storage "github.com/dborchard/tiny_crdb/pkg/h_storage"
+	"github.com/dborchard/tiny_crdb/pkg/h_storage/enginepb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/stop"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testContext stands in for the replica holding the transaction records: it
+// evaluates batches against an in-memory engine and routes PushTxn requests
+// through the txnwait.Queue before evaluating them.
+type testContext struct {
+	clock  *hlc.Clock
+	eng    storage.Engine
+	db     *kv.DB
+	queue  *txnwait.Queue
+	sender kv.Sender
+
+	evalMu sync.Mutex
+}
+
+func newTestContext(t *testing.T) *testContext {
+	ctx := context.Background()
+	eng, err := storage.Open(ctx, storage.Location{})
+	require.NoError(t, err)
+	t.Cleanup(eng.Close)
+
+	tc := &testContext{
+		clock: hlc.NewClock(hlc.UnixNano, time.Nanosecond),
+		eng:   eng,
+	}
+	tc.sender = kv.SenderFunc(tc.send)
+	factory := kvcoord.NewTxnCoordSenderFactory(
+		kvcoord.TxnCoordSenderFactoryConfig{Clock: tc.clock}, tc.sender)
+	tc.db = kv.NewDB(ctx, factory, tc.clock, stop.NewStopper())
+	tc.queue = txnwait.NewQueue(txnwait.Config{
+		DB:    tc.db,
+		Clock: tc.clock,
+		Knobs: txnwait.TestingKnobs{QueryInterval: 5 * time.Millisecond},
+	})
+	tc.queue.Enable()
+	return tc
+}
+
+func (tc *testContext) send(
+	ctx context.Context, ba *kvpb.BatchRequest,
+) (*kvpb.BatchResponse, *kvpb.Error) {
+	if ba.IsSinglePushTxnRequest() {
+		push := ba.Requests[0].GetInner().(*kvpb.PushTxnRequest)
+		resp, pErr := tc.queue.MaybeWaitForPush(ctx, push)
+		if pErr != nil {
+			return nil, pErr
+		} else if resp != nil {
+			br := &kvpb.BatchResponse{}
+			br.Add(resp)
+			return br, nil
+		}
+	}
+
+	tc.evalMu.Lock()
+	defer tc.evalMu.Unlock()
+	h := ba.Header
+	if h.Timestamp.IsEmpty() {
+		h.Timestamp = tc.clock.Now()
+	}
+	if h.Txn != nil {
+		h.Timestamp = h.Txn.ReadTimestamp
+	}
+	evalCtx := (&batcheval.MockEvalCtx{Clock: tc.clock, TxnWaitQueue: tc.queue}).EvalContext()
+
+	batch := tc.eng.NewBatch()
+	defer batch.Close()
+	br := &kvpb.BatchResponse{}
+	var updatedTxns []*roachpb.Transaction
+	for _, ru := range ba.Requests {
+		args := ru.GetInner()
+		cmd, ok := batcheval.LookupCommand(args.Method())
+		if !ok {
+			return nil, kvpb.NewErrorf("unknown command %s", args.Method())
+		}
+		reply := kvpb.CreateReply(args)
+		cArgs := batcheval.CommandArgs{EvalCtx: evalCtx, Header: h, Args: args}
+		var res result.Result
+		var err error
+		if cmd.EvalRW != nil {
+			res, err = cmd.EvalRW(ctx, batch, cArgs, reply)
+		} else {
+			res, err = cmd.EvalRO(ctx, batch, cArgs, reply)
+		}
+		if err != nil {
+			return nil, kvpb.NewErrorWithTxn(err, ba.Txn)
+		}
+		updatedTxns = append(updatedTxns, res.Local.UpdatedTxns...)
+		br.Add(reply)
+	}
+	if err := batch.Commit(false /* sync */); err != nil {
+		return nil, kvpb.NewError(err)
+	}
+	for _, txn := range updatedTxns {
+		tc.queue.UpdateTxn(ctx, txn)
+	}
+	br.Txn = h.Txn
+	return br, nil
+}
+
+// makeTxn creates a transaction anchored at key and writes its record.
+func (tc *testContext) makeTxn(
+	t *testing.T, name string, key string, pri roachpb.UserPriority,
+) *roachpb.Transaction {
+	txn := roachpb.MakeTransaction(name, roachpb.Key(key), isolation.Serializable, pri, tc.clock.Now())
+	tc.writeTxnRecord(t, &txn)
+	return &txn
+}
+
+// makeTxnWithPriority is like makeTxn, but gives the transaction the provided
+// priority instead of one derived from a user priority.
+func (tc *testContext) makeTxnWithPriority(
+	t *testing.T, name string, key string, pri enginepb.TxnPriority,
+) *roachpb.Transaction {
+	txn := roachpb.MakeTransaction(
+		name, roachpb.Key(key), isolation.Serializable, roachpb.NormalUserPriority, tc.clock.Now())
+	txn.Priority = pri
+	tc.writeTxnRecord(t, &txn)
+	return &txn
+}
+
+// writeTxnRecord writes the record of the transaction with a heartbeat.
+func (tc *testContext) writeTxnRecord(t *testing.T, txn *roachpb.Transaction) {
+	ba := &kvpb.BatchRequest{}
+	ba.Txn = txn
+	ba.Add(&kvpb.HeartbeatTxnRequest{
+		RequestHeader: kvpb.RequestHeader{Key: txn.Key},
+		Now:           tc.clock.Now(),
+	})
+	_, pErr := tc.sender.Send(context.Background(), ba)
+	require.Nil(t, pErr)
+}
+
+func (tc *testContext) endTxn(t *testing.T, txn *roachpb.Transaction, commit bool) {
+	ba := &kvpb.BatchRequest{}
+	ba.Txn = txn
+	ba.Add(&kvpb.EndTxnRequest{
+		RequestHeader: kvpb.RequestHeader{Key: txn.Key},
+		Commit:        commit,
+	})
+	_, pErr := tc.sender.Send(context.Background(), ba)
+	require.Nil(t, pErr)
+}
+
+type pushResult struct {
+	resp *kvpb.PushTxnResponse
+	pErr *kvpb.Error
+}
+
+// pushAsync sends a PUSH_ABORT from pusher to pushee in a goroutine.
+func (tc *testContext) pushAsync(pusher, pushee *roachpb.Transaction) <-chan pushResult {
+	ch := make(chan pushResult, 1)
+	go func() {
+		ba := &kvpb.BatchRequest{}
+		ba.Timestamp = tc.clock.Now()
+		ba.Add(&kvpb.PushTxnRequest{
+			RequestHeader: kvpb.RequestHeader{Key: pushee.Key},
+			PusherTxn:     *pusher,
+			PusheeTxn:     pushee.TxnMeta,
+			PushType:      kvpb.PUSH_ABORT,
+		})
+		br, pErr := tc.sender.Send(context.Background(), ba)
+		if pErr != nil {
+			ch <- pushResult{pErr: pErr}
+			return
+		}
+		ch <- pushResult{resp: br.Responses[0].GetInner().(*kvpb.PushTxnResponse)}
+	}()
+	return ch
+}
+
+func waitForResult(t *testing.T, ch <-chan pushResult) pushResult {
+	select {
+	case res := <-ch:
+		return res
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for push")
+		return pushResult{}
+	}
+}
+
+// TestQueuePusherWaitsForCommit verifies that a pusher that cannot push its
+// pushee waits in the queue until the pushee commits.
+func TestQueuePusherWaitsForCommit(t *testing.T) {
+	tc := newTestContext(t)
+	pushee := tc.makeTxn(t, "pushee", "a", roachpb.MinUserPriority)
+	pusher := tc.makeTxn(t, "pusher", "b", roachpb.MinUserPriority)
+
+	ch := tc.pushAsync(pusher, pushee)
+	select {
+	case res := <-ch:
+		t.Fatalf("push unexpectedly completed: %+v", res)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	tc.endTxn(t, pushee, true /* commit */)
+	res := waitForResult(t, ch)
+	require.Nil(t, res.pErr)
+	require.Equal(t, roachpb.COMMITTED, res.resp.PusheeTxn.Status)
+}
+
+// TestQueueHighPriorityPusherPushesImmediately verifies that a pusher with
+// the maximum priority aborts its pushee without waiting.
+func TestQueueHighPriorityPusherPushesImmediately(t *testing.T) {
+	tc := newTestContext(t)
+	pushee := tc.makeTxn(t, "pushee", "a", roachpb.NormalUserPriority)
+	pusher := tc.makeTxn(t, "pusher", "b", roachpb.MaxUserPriority)
+
+	res := waitForResult(t, tc.pushAsync(pusher, pushee))
+	require.Nil(t, res.pErr)
+	require.Equal(t, roachpb.ABORTED, res.resp.PusheeTxn.Status)
+}
+
+// TestQueueExpiredPusheeIsAborted verifies that a waiting pusher aborts a
+// pushee whose record is no longer heartbeated.
+func TestQueueExpiredPusheeIsAborted(t *testing.T) {
+	defer func(prev time.Duration) { txnwait.TxnLivenessThreshold = prev }(txnwait.TxnLivenessThreshold)
+	txnwait.TxnLivenessThreshold = 100 * time.Millisecond
+
+	tc := newTestContext(t)
+	pushee := tc.makeTxn(t, "pushee", "a", roachpb.MinUserPriority)
+	pusher := tc.makeTxn(t, "pusher", "b", roachpb.MinUserPriority)
+
+	res := waitForResult(t, tc.pushAsync(pusher, pushee))
+	require.Nil(t, res.pErr)
+	require.Equal(t, roachpb.ABORTED, res.resp.PusheeTxn.Status)
+}
+
+// TestQueueDeadlockDetection verifies that two transactions pushing each
+// other detect the dependency cycle and that exactly one of them is aborted
+// to break it.
+func TestQueueDeadlockDetection(t *testing.T) {
+	tc := newTestContext(t)
+	txn1 := tc.makeTxn(t, "txn1", "a", roachpb.MinUserPriority)
+	txn2 := tc.makeTxn(t, "txn2", "b", roachpb.MinUserPriority)
+
+	ch1 := tc.pushAsync(txn1, txn2)
+	ch2 := tc.pushAsync(txn2, txn1)
+	res1 := waitForResult(t, ch1)
+	res2 := waitForResult(t, ch2)
+
+	// One push succeeds by aborting its pushee; the other fails because its
+	// pusher is the victim of the deadlock.
+	var aborted int
+	for _, res := range []pushResult{res1, res2} {
+		if res.pErr != nil {
+			_, ok := res.pErr.GetDetail().(*kvpb.TransactionAbortedError)
+			require.True(t, ok, "unexpected error: %s", res.pErr)
+			continue
+		}
+		require.Equal(t, roachpb.ABORTED, res.resp.PusheeTxn.Status)
+		aborted++
+	}
+	require.Equal(t, 1, aborted)
+}
+
+// TestQueueDeadlockDetectionCycleOfThree verifies that in a dependency cycle
+// of three transactions with different priorities, the pushers agree on a
+// single victim, the transaction with the lowest priority: only it is aborted
+// to break the deadlock.
+func TestQueueDeadlockDetectionCycleOfThree(t *testing.T) {
+	tc := newTestContext(t)
+	txns := []*roachpb.Transaction{
+		tc.makeTxnWithPriority(t, "txn1", "a", 300),
+		tc.makeTxnWithPriority(t, "txn2", "b", 100),
+		tc.makeTxnWithPriority(t, "txn3", "c", 200),
+	}
+
+	// Each transaction pushes the next one.
+	type indexedResult struct {
+		idx int
+		pushResult
+	}
+	resCh := make(chan indexedResult, len(txns))
+	for i := range txns {
+		i := i
+		ch := tc.pushAsync(txns[i], txns[(i+1)%len(txns)])
+		go func() { resCh <- indexedResult{idx: i, pushResult: <-ch} }()
+	}
+	recv := func() indexedResult {
+		select {
+		case res := <-resCh:
+			return res
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for push")
+			return indexedResult{}
+		}
+	}
+
+	// The pusher of the victim aborts it, and the push of the victim fails.
+	victim, pusherOfVictim := -1, -1
+	for i := 0; i < 2; i++ {
+		res := recv()
+		if res.pErr != nil {
+			_, ok := res.pErr.GetDetail().(*kvpb.TransactionAbortedError)
+			require.True(t, ok, "unexpected error: %s", res.pErr)
+			require.Equal(t, -1, victim)
+			victim = res.idx
+			continue
+		}
+		require.Equal(t, roachpb.ABORTED, res.resp.PusheeTxn.Status)
+		require.Equal(t, -1, pusherOfVictim)
+		pusherOfVictim = res.idx
+	}
+	require.Equal(t, 1, victim)
+	require.Equal(t, 0, pusherOfVictim)
+
+	// The remaining pusher waits on the pusher of the victim, which is not
+	// aborted.
+	tc.endTxn(t, txns[pusherOfVictim], true /* commit */)
+	res := recv()
+	require.Nil(t, res.pErr)
+	require.Equal(t, roachpb.COMMITTED, res.resp.PusheeTxn.Status)
+}
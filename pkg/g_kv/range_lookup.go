@@ -0,0 +1,74 @@
+package kv
+
+import (
+	"context"
+	"fmt"
+	keys "github.com/dborchard/tiny_crdb/pkg/g_keys"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+)
+
+// RangeLookup is used to look up RangeDescriptors - a RangeDescriptor is a
+// metadata structure which describes the key range and replica locations of
+// a distinct range in the cluster. They map the logical keyspace in cockroach
+// to its physical replicas, allowing a node to send requests for a certain
+// key to the replicas that contain that key.
+//
+// RangeDescriptors are stored as values in the cockroach cluster's key-value
+// store. However, they are always stored using special "Range Metadata keys",
+// which are "ordinary" keys with a special prefix prepended. The Range
+// Metadata Key for an ordinary key can be generated with the
+// `keys.RangeMetaKey(key)` function. The RangeDescriptor for the range which
+// contains a given key can be retrieved by generating its Range Metadata Key
+// and scanning from the key forwards until the first RangeDescriptor is
+// found. This is what this function does with the provided key.
+//
+// Note that the Range Metadata Key sent as the StartKey of the lookup scan is
+// NOT the key at which the desired RangeDescriptor is stored. Instead, this
+// method returns the RangeDescriptor stored at the _lowest_ existing key
+// which is _greater_ than the given key. The returned RangeDescriptor will
+// thus contain the ordinary key which was provided to this function.
+//
+// The "Range Metadata Key" for a range is built by appending the end key of
+// the range to the respective meta prefix.
+//
+// In addition to the descriptor of the range containing the key, up to
+// prefetchNum descriptors of the ranges that follow it are returned, in key
+// order. They can be used to pre-populate a range cache.
+func RangeLookup(
+	ctx context.Context, sender Sender, key roachpb.Key, prefetchNum int64,
+) ([]roachpb.RangeDescriptor, error) {
+	rkey, err := keys.Addr(key)
+	if err != nil {
+		return nil, err
+	}
+	metaKey := keys.RangeMetaKey(rkey)
+	bounds, err := keys.MetaScanBounds(metaKey)
+	if err != nil {
+		return nil, fmt.Errorf("could not create scan bounds for range lookup: %w", err)
+	}
+
+	ba := &kvpb.BatchRequest{}
+	ba.MaxSpanRequestKeys = prefetchNum + 1
+	ba.Add(&kvpb.ScanRequest{
+		RequestHeader: kvpb.RequestHeaderFromSpan(bounds.AsRawSpanWithNoLocals()),
+	})
+	br, pErr := sender.Send(ctx, ba)
+	if pErr != nil {
+		return nil, pErr.GoError()
+	}
+	rows := br.Responses[0].GetInner().(*kvpb.ScanResponse).Rows
+
+	descs := make([]roachpb.RangeDescriptor, 0, len(rows))
+	for _, kv := range rows {
+		var desc roachpb.RangeDescriptor
+		if err := kv.Value.GetProto(&desc); err != nil {
+			return nil, err
+		}
+		descs = append(descs, desc)
+	}
+	if len(descs) == 0 || !descs[0].ContainsKey(rkey) {
+		return nil, fmt.Errorf("range lookup of key %s found only non-matching ranges %v", key, descs)
+	}
+	return descs, nil
+}
@@ -119,6 +119,12 @@ type TxnSender interface {
 	// timestamp. Use CommitTimestamp() when needed.
 	ReadTimestamp() hlc.Timestamp
 
+	// ProvisionalCommitTimestamp returns the transaction's provisional
+	// commit timestamp. This can move forward throughout the txn's
+	// lifetime. See the explanatory comments for the WriteTimestamp
+	// field on TxnMeta.
+	ProvisionalCommitTimestamp() hlc.Timestamp
+
 	// ReadTimestampFixed returns true if the read timestamp has been fixed
 	// and cannot be pushed forward.
 	ReadTimestampFixed() bool
@@ -142,8 +148,140 @@ type TxnSender interface {
 	// the method returns an error. Fixing the commit timestamp early is not
 	// supported for transactions running under weak isolation levels.
 	CommitTimestamp() (hlc.Timestamp, error)
+
+	// CreateSavepoint establishes a savepoint.
+	// This method is only valid when called on RootTxns.
+	//
+	// Committing (or aborting) the transaction causes every open
+	// savepoint to be released (or, respectively, rolled back)
+	// implicitly.
+	CreateSavepoint(context.Context) (SavepointToken, error)
+
+	// RollbackToSavepoint rolls back to the given savepoint.
+	// All savepoints "under" the savepoint being rolled back
+	// are also rolled back and their token must not be used any more.
+	// The token of the savepoint being rolled back remains valid
+	// and can be reused later (e.g. to release or roll back again).
+	// Aborting a txn implicitly rolls back all savepoints.
+	//
+	// The writes performed after the savepoint was created are not
+	// removed right away; their sequence numbers are added to the txn's
+	// list of ignored seqnum ranges, which makes them invisible to the
+	// txn's subsequent reads and causes them to be discarded when the
+	// txn's intents are resolved.
+	//
+	// This method is only valid when called on RootTxns.
+	RollbackToSavepoint(context.Context, SavepointToken) error
+
+	// ReleaseSavepoint releases the given savepoint. The savepoint
+	// must not have been rolled back or released already.
+	// All savepoints "under" the savepoint being released
+	// are also released and their token must not be used any more.
+	// Committing a txn implicitly releases all savepoints.
+	//
+	// This method is only valid when called on RootTxns.
+	ReleaseSavepoint(context.Context, SavepointToken) error
+
+	// Step creates a sequencing point in the current transaction. A
+	// sequencing point establishes a snapshot baseline for subsequent
+	// read-only operations: until the next sequencing point, read-only
+	// operations observe the data at the time the snapshot was established
+	// and ignore writes performed since.
+	//
+	// If allowReadTimestampStep is set and the transaction's isolation level
+	// establishes a new read snapshot for each statement (Read Committed),
+	// the transaction's read timestamp is also advanced to the current time,
+	// so that subsequent reads observe all writes committed before the call.
+	//
+	// Before the first step is taken, the transaction operates as if there
+	// was a step after every write: each read to a key is able to see the
+	// latest write before it. This makes the step behavior opt-in and
+	// backward-compatible with existing code which does not need it.
+	Step(ctx context.Context, allowReadTimestampStep bool) error
+
+	// ConfigureStepping sets the sequencing point behavior.
+	//
+	// Note that a Sender is initially in the non-stepping mode,
+	// i.e. uses reads-own-writes by default. This makes the step
+	// behavior opt-in and backward-compatible with existing code
+	// which does not need it.
+	//
+	// Calling ConfigureStepping(SteppingEnabled) when the stepping mode
+	// is currently disabled implies calling Step(), for convenience.
+	ConfigureStepping(ctx context.Context, mode SteppingMode) (prevMode SteppingMode)
+
+	// GetSteppingMode accompanies ConfigureStepping. It is provided
+	// for use in SQL checks and internal tests.
+	GetSteppingMode(ctx context.Context) (curMode SteppingMode)
+
+	// GetRetryableErr returns an error if the TxnSender had a retryable error,
+	// otherwise nil. In this state Send() always fails with the same retryable
+	// error. ClearRetryableErr can be called to clear this error and make
+	// TxnSender usable again.
+	GetRetryableErr(ctx context.Context) *kvpb.TransactionRetryWithProtoRefreshError
+
+	// ClearRetryableErr clears the retryable error and moves the transaction
+	// to the state prepared for its next attempt, if any.
+	ClearRetryableErr(ctx context.Context) error
+
+	// GetLeafTxnInputState retrieves the input state necessary and
+	// sufficient to initialize a LeafTxn from the current RootTxn.
+	//
+	// This method is only valid when called on RootTxns; the txn must be
+	// pending.
+	GetLeafTxnInputState(context.Context) (*roachpb.LeafTxnInputState, error)
+
+	// GetLeafTxnFinalState retrieves the final state of a LeafTxn
+	// necessary and sufficient to update a RootTxn with progress made
+	// on its behalf by the LeafTxn.
+	//
+	// This method is only valid when called on LeafTxns.
+	GetLeafTxnFinalState(context.Context) (*roachpb.LeafTxnFinalState, error)
+
+	// UpdateRootWithLeafFinalState updates a RootTxn using the final
+	// state of a LeafTxn: the refresh spans collected by the leaf's reads
+	// and the observed timestamps it has accumulated. Final states from a
+	// previous attempt of the transaction are ignored.
+	//
+	// This method is only valid when called on RootTxns.
+	UpdateRootWithLeafFinalState(context.Context, *roachpb.LeafTxnFinalState) error
+
+	// TestingCloneTxn returns a clone of the transaction's current
+	// proto. This is for use by tests only.
+	TestingCloneTxn() *roachpb.Transaction
+}
+
+// SteppingMode is the argument type to ConfigureStepping.
+type SteppingMode bool
+
+const (
+	// SteppingDisabled is the default mode, where each read can
+	// observe the latest write.
+	SteppingDisabled SteppingMode = false
+
+	// SteppingEnabled can be set to indicate that read operations
+	// operate on a snapshot taken at the latest Step() invocation.
+	SteppingEnabled SteppingMode = true
+)
+
+// SavepointToken represents a savepoint.
+type SavepointToken interface {
+	// Initial returns true if this savepoint has been created before performing
+	// any KV operations. If so, it is possible to rollback to it after a
+	// retriable error. If not, then rolling back to it after a retriable error
+	// will return the retriable error again because reads might have been
+	// evaluated before the savepoint and such reads cannot have their timestamp
+	// forwarded without a refresh.
+	Initial() bool
 }
 
 // SenderFunc is an adapter to allow the use of ordinary functions as
 // Senders.
 type SenderFunc func(context.Context, *kvpb.BatchRequest) (*kvpb.BatchResponse, *kvpb.Error)
+
+// Send calls f(ctx, c).
+func (f SenderFunc) Send(
+	ctx context.Context, ba *kvpb.BatchRequest,
+) (*kvpb.BatchResponse, *kvpb.Error) {
+	return f(ctx, ba)
+}
@@ -3,10 +3,13 @@ package kv
 import (
 	"context"
 	"errors"
+	"fmt"
 	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
 	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/concurrency/isolation"
 	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
 	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/uuid"
+	"sync"
 )
 
 // Txn is an in-progress distributed database transaction. A Txn is safe for
@@ -15,6 +18,10 @@ type Txn struct {
 	db  *DB
 	typ TxnType
 	mu  struct {
+		sync.Mutex
+		// ID is the ID of the transaction. It changes when the transaction is
+		// aborted, and retried as a new transaction.
+		ID           uuid.UUID
 		debugName    string
 		userPriority roachpb.UserPriority
 		sender       TxnSender
@@ -76,11 +83,30 @@ func NewTxnFromProto(
 	proto *roachpb.Transaction,
 ) *Txn {
 	txn := &Txn{db: db, typ: typ}
+	txn.mu.ID = proto.ID
 	txn.mu.userPriority = roachpb.NormalUserPriority
 	txn.mu.sender = db.factory.RootTransactionalSender(proto, txn.mu.userPriority)
 	return txn
 }
 
+// NewLeafTxn instantiates a new leaf transaction, which runs on behalf of the
+// root transaction whose state is captured by tis. Leaf transactions can only
+// perform reads; their progress is brought back to the root through
+// GetLeafTxnFinalState and UpdateRootWithLeafFinalState.
+func NewLeafTxn(ctx context.Context, db *DB, tis *roachpb.LeafTxnInputState) *Txn {
+	if db == nil {
+		panic("attempting to create leaf txn with nil db")
+	}
+	if tis == nil {
+		panic("attempting to create leaf txn with nil input state")
+	}
+	txn := &Txn{db: db, typ: LeafTxn}
+	txn.mu.ID = tis.Txn.ID
+	txn.mu.userPriority = roachpb.NormalUserPriority
+	txn.mu.sender = db.factory.LeafTransactionalSender(tis)
+	return txn
+}
+
 // runTxn runs the given retryable transaction function using the given *Txn.
 func runTxn(ctx context.Context, txn *Txn, retryable func(context.Context, *Txn) error) error {
 	err := txn.exec(ctx, retryable)
@@ -107,16 +133,82 @@ func (txn *Txn) exec(ctx context.Context, fn func(context.Context, *Txn) error)
 		if err = ctx.Err(); err != nil {
 			return err
 		}
+		// Establish a savepoint at the start of every attempt. Retryable errors
+		// that do not require the transaction to restart from the beginning
+		// (see TxnMustRestartFromBeginning) are handled by rolling back to it,
+		// which discards the writes performed by the failed attempt.
+		var sp SavepointToken
+		sp, err = txn.CreateSavepoint(ctx)
+		if err != nil {
+			return err
+		}
 		err = fn(ctx, txn)
+		if err == nil && !txn.IsCommitted() {
+			// The closure may have committed the transaction itself, through
+			// CommitInBatch.
+			err = txn.Commit(ctx)
+		}
+		if err == nil {
+			return nil
+		}
 
-		if err != nil {
+		var retryErr *kvpb.TransactionRetryWithProtoRefreshError
+		if !errors.As(err, &retryErr) {
 			return err
 		}
-		err = txn.Commit(ctx)
-		break
+		if retryErr.TxnMustRestartFromBeginning() {
+			if err := txn.PrepareForRetry(ctx); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := txn.RollbackToSavepoint(ctx, sp); err != nil {
+			return err
+		}
+		// Establish a new read snapshot for the next attempt, so that it
+		// observes the write that caused the retry.
+		if err := txn.Step(ctx, true /* allowReadTimestampStep */); err != nil {
+			return err
+		}
+	}
+}
+
+// PrepareForRetry needs to be called before a retry to perform some
+// book-keeping and clear errors when possible. If the transaction was aborted,
+// a new transaction with a new ID is created (along with a new TxnSender) to
+// be used by the next attempt. Otherwise, the transaction moves to the state
+// prepared by the retryable error, usually a new epoch at a higher timestamp.
+//
+// It is a no-op if the transaction is not in a retryable error state.
+func (txn *Txn) PrepareForRetry(ctx context.Context) error {
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+
+	retryErr := txn.mu.sender.GetRetryableErr(ctx)
+	if retryErr == nil {
+		return nil
+	}
+	// The deadline must be re-established by the client for the next
+	// attempt. The next attempt runs at a higher timestamp, so a deadline
+	// that was exceeded would otherwise keep failing every attempt.
+	txn.resetDeadlineLocked()
+	if retryErr.PrevTxnAborted() {
+		txn.handleTransactionAbortedErrorLocked(ctx, retryErr)
+		return nil
 	}
+	return txn.mu.sender.ClearRetryableErr(ctx)
+}
 
-	return nil
+// handleTransactionAbortedErrorLocked replaces the transaction's TxnSender
+// with a new one for the transaction prepared by the retryable error. The
+// stepping mode of the aborted transaction carries over to the new one.
+func (txn *Txn) handleTransactionAbortedErrorLocked(
+	ctx context.Context, retryErr *kvpb.TransactionRetryWithProtoRefreshError,
+) {
+	prevSteppingMode := txn.mu.sender.GetSteppingMode(ctx)
+	txn.mu.ID = retryErr.NextTransaction.ID
+	txn.mu.sender = txn.db.factory.RootTransactionalSender(&retryErr.NextTransaction, txn.mu.userPriority)
+	txn.mu.sender.ConfigureStepping(ctx, prevSteppingMode)
 }
 
 // Commit sends an EndTxnRequest with Commit=true.
@@ -129,9 +221,48 @@ func (txn *Txn) Commit(ctx context.Context) error {
 }
 
 func (txn *Txn) commit(ctx context.Context) error {
+	txn.mu.Lock()
+	deadline := txn.mu.deadline
+	txn.mu.Unlock()
+
 	ba := &kvpb.BatchRequest{}
+	ba.Add(endTxnReq(true /* commit */, deadline))
 	_, pErr := txn.Send(ctx, ba)
-	return pErr.Error
+	return pErr.GoError()
+}
+
+// CommitInBatch executes the operations queued up within a batch and
+// commits the transaction. Explicitly committing a transaction is optional,
+// but more efficient than relying on the implicit commit performed when the
+// transaction function returns without error: the commit runs in parallel
+// with the batch's writes, and a batch that contains all of the
+// transaction's writes can be committed by the server in one phase.
+// The batch must be created by this transaction.
+// If the command completes successfully, the txn is considered finalized. On
+// error, no attempt is made to clean up the (possibly still pending)
+// transaction.
+func (txn *Txn) CommitInBatch(ctx context.Context, b *Batch) error {
+	if txn.typ != RootTxn {
+		return errors.New("CommitInBatch() called on leaf txn")
+	}
+	if txn != b.txn {
+		return errors.New("a batch b can only be committed by b.txn")
+	}
+
+	txn.mu.Lock()
+	deadline := txn.mu.deadline
+	txn.mu.Unlock()
+
+	b.appendReqs(endTxnReq(true /* commit */, deadline))
+	b.initResult(1 /* calls */, nil)
+	return txn.Run(ctx, b)
+}
+
+// IsCommitted returns true iff the transaction has the committed status.
+func (txn *Txn) IsCommitted() bool {
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	return txn.mu.sender.TxnStatus() == roachpb.COMMITTED
 }
 
 // Send runs the specified calls synchronously in a single batch and
@@ -143,21 +274,182 @@ func (txn *Txn) commit(ctx context.Context) error {
 func (txn *Txn) Send(
 	ctx context.Context, ba *kvpb.BatchRequest,
 ) (*kvpb.BatchResponse, *kvpb.Error) {
+	if len(ba.Requests) == 0 {
+		return nil, nil
+	}
 	return txn.mu.sender.Send(ctx, ba)
 }
 
 // Rollback sends an EndTxnRequest with Commit=false.
 // txn is considered finalized and cannot be used to send any more commands.
 func (txn *Txn) Rollback(ctx context.Context) error {
-	return txn.rollback(ctx).Error
+	if txn.typ != RootTxn {
+		return errors.New("rollback() called on leaf txn")
+	}
+
+	return txn.rollback(ctx).GoError()
 }
 
 func (txn *Txn) rollback(ctx context.Context) *kvpb.Error {
 	ba := &kvpb.BatchRequest{}
+	ba.Add(endTxnReq(false /* commit */, hlc.Timestamp{} /* deadline */))
 	_, pErr := txn.Send(ctx, ba)
 	return pErr
 }
 
+// endTxnReq creates an EndTxnRequest that commits or rolls back the
+// transaction. The deadline, if set, bounds the commit timestamp.
+func endTxnReq(commit bool, deadline hlc.Timestamp) kvpb.Request {
+	return &kvpb.EndTxnRequest{Commit: commit, Deadline: deadline}
+}
+
+// UpdateDeadline sets the transaction's deadline to the passed deadline, if
+// the transaction has no deadline yet or if the passed deadline is lower than
+// the existing one; a deadline can only ever be lowered. The transaction will
+// fail to commit, with a retryable error, if its commit timestamp reaches the
+// deadline.
+//
+// It returns an error if the deadline is below the transaction's read
+// timestamp, since the transaction would have no chance to commit.
+func (txn *Txn) UpdateDeadline(ctx context.Context, deadline hlc.Timestamp) error {
+	if txn.typ != RootTxn {
+		return errors.New("UpdateDeadline() called on leaf txn")
+	}
+
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+
+	readTimestamp := txn.mu.sender.ReadTimestamp()
+	if deadline.Less(readTimestamp) {
+		return fmt.Errorf("deadline below read timestamp is nonsensical; "+
+			"txn would have no chance to commit. Deadline: %v. Read timestamp: %v. Previous deadline: %v",
+			deadline, readTimestamp, txn.mu.deadline)
+	}
+	if txn.mu.deadline.IsEmpty() || deadline.Less(txn.mu.deadline) {
+		txn.mu.deadline = deadline
+	}
+	return nil
+}
+
+// DeadlineLikelySufficient returns true if there currently is a deadline and
+// that deadline is later than both the transaction's provisional commit
+// timestamp and the current reading of the node's HLC clock. A transaction
+// whose deadline is likely sufficient does not need its deadline extended
+// (for example by renewing the descriptor leases that determine it) before
+// committing. The answer is only a hint: the transaction can still be pushed
+// past its deadline.
+func (txn *Txn) DeadlineLikelySufficient() bool {
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+
+	if txn.mu.deadline.IsEmpty() {
+		return false
+	}
+	return txn.mu.sender.ProvisionalCommitTimestamp().Less(txn.mu.deadline) &&
+		txn.db.clock.Now().Less(txn.mu.deadline)
+}
+
+// resetDeadlineLocked resets the deadline.
+func (txn *Txn) resetDeadlineLocked() {
+	txn.mu.deadline = hlc.Timestamp{}
+}
+
+// Get retrieves the value for a key, returning the retrieved key/value or an
+// error. It is not considered an error for the key to not exist.
+//
+//	r, err := txn.Get("a")
+//	// string(r.Key) == "a"
+//
+// key can be either a byte slice or a string.
+func (txn *Txn) Get(ctx context.Context, key interface{}) (KeyValue, error) {
+	b := txn.NewBatch()
+	b.Get(key)
+	return getOneRow(txn.Run(ctx, b), b)
+}
+
+// GetForUpdate retrieves the value for a key, returning the retrieved
+// key/value or an error. An Exclusive lock with unreplicated durability is
+// acquired on the key, if it exists. It is not considered an error for the
+// key to not exist.
+//
+// key can be either a byte slice or a string.
+func (txn *Txn) GetForUpdate(ctx context.Context, key interface{}) (KeyValue, error) {
+	b := txn.NewBatch()
+	b.GetForUpdate(key)
+	return getOneRow(txn.Run(ctx, b), b)
+}
+
+// Del deletes one or more keys.
+//
+// key can be either a byte slice or a string.
+//
+// Returns the keys that were deleted.
+func (txn *Txn) Del(ctx context.Context, keys ...interface{}) ([]roachpb.Key, error) {
+	b := txn.NewBatch()
+	b.Del(keys...)
+	if err := txn.Run(ctx, b); err != nil {
+		return nil, err
+	}
+	return b.Results[0].Keys, nil
+}
+
+// Scan retrieves the rows between begin (inclusive) and end (exclusive) in
+// ascending order.
+//
+// The returned []KeyValue will contain up to maxRows elements (or all results
+// when zero is supplied).
+//
+// key can be either a byte slice or a string.
+func (txn *Txn) Scan(ctx context.Context, begin, end interface{}, maxRows int64) ([]KeyValue, error) {
+	b := txn.NewBatch()
+	b.Header.MaxSpanRequestKeys = maxRows
+	b.Scan(begin, end)
+	if err := txn.Run(ctx, b); err != nil {
+		return nil, err
+	}
+	return b.Results[0].Rows, nil
+}
+
+// ScanForUpdate retrieves the rows between begin (inclusive) and end
+// (exclusive) in ascending order. Exclusive locks with unreplicated
+// durability are acquired on each of the returned keys.
+//
+// The returned []KeyValue will contain up to maxRows elements (or all results
+// when zero is supplied).
+//
+// key can be either a byte slice or a string.
+func (txn *Txn) ScanForUpdate(
+	ctx context.Context, begin, end interface{}, maxRows int64,
+) ([]KeyValue, error) {
+	b := txn.NewBatch()
+	b.Header.MaxSpanRequestKeys = maxRows
+	b.ScanForUpdate(begin, end)
+	if err := txn.Run(ctx, b); err != nil {
+		return nil, err
+	}
+	return b.Results[0].Rows, nil
+}
+
+// ScanForShare retrieves the rows between begin (inclusive) and end
+// (exclusive) in ascending order. Shared locks with unreplicated durability
+// are acquired on each of the returned keys.
+//
+// The returned []KeyValue will contain up to maxRows elements (or all results
+// when zero is supplied).
+//
+// key can be either a byte slice or a string.
+func (txn *Txn) ScanForShare(
+	ctx context.Context, begin, end interface{}, maxRows int64,
+) ([]KeyValue, error) {
+	b := txn.NewBatch()
+	b.Header.MaxSpanRequestKeys = maxRows
+	b.ScanForShare(begin, end)
+	if err := txn.Run(ctx, b); err != nil {
+		return nil, err
+	}
+	return b.Results[0].Rows, nil
+}
+
 // Put sets the value for a key
 //
 // key can be either a byte slice or a string. value can be any key type, a
@@ -188,6 +480,110 @@ func (txn *Txn) Run(ctx context.Context, b *Batch) error {
 	return sendAndFill(ctx, txn.Send, b)
 }
 
+// GetLeafTxnInputState returns the LeafTxnInputState information for this
+// transaction for use with NewLeafTxn(), when distributing the state of the
+// current transaction to multiple distributed transaction coordinators.
+func (txn *Txn) GetLeafTxnInputState(ctx context.Context) (*roachpb.LeafTxnInputState, error) {
+	if txn.typ != RootTxn {
+		return nil, errors.New("GetLeafTxnInputState() called on leaf txn")
+	}
+
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	return txn.mu.sender.GetLeafTxnInputState(ctx)
+}
+
+// GetLeafTxnFinalState returns the LeafTxnFinalState information for this
+// transaction for use with UpdateRootWithLeafFinalState(), when combining the
+// impact of multiple distributed transaction coordinators that are all
+// operating on the same transaction.
+func (txn *Txn) GetLeafTxnFinalState(ctx context.Context) (*roachpb.LeafTxnFinalState, error) {
+	if txn.typ != LeafTxn {
+		return nil, errors.New("GetLeafTxnFinalState() called on root txn")
+	}
+
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	return txn.mu.sender.GetLeafTxnFinalState(ctx)
+}
+
+// UpdateRootWithLeafFinalState augments the txn with information from a
+// LeafTxnFinalState.
+func (txn *Txn) UpdateRootWithLeafFinalState(
+	ctx context.Context, tfs *roachpb.LeafTxnFinalState,
+) error {
+	if txn.typ != RootTxn {
+		return errors.New("UpdateRootWithLeafFinalState() called on leaf txn")
+	}
+
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	return txn.mu.sender.UpdateRootWithLeafFinalState(ctx, tfs)
+}
+
+// ID returns the current ID of the transaction.
+func (txn *Txn) ID() uuid.UUID {
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	return txn.mu.ID
+}
+
+// TestingCloneTxn returns a clone of the current txn.
+// This is for use by tests only.
+func (txn *Txn) TestingCloneTxn() *roachpb.Transaction {
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	return txn.mu.sender.TestingCloneTxn()
+}
+
+// SetIsoLevel sets the transaction's isolation level. Transactions default to
+// Serializable isolation. The isolation must be set before any operations are
+// performed on the transaction.
+func (txn *Txn) SetIsoLevel(isoLevel isolation.Level) error {
+	if txn.typ != RootTxn {
+		return errors.New("SetIsoLevel() called on leaf txn")
+	}
+
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	return txn.mu.sender.SetIsoLevel(isoLevel)
+}
+
+// IsoLevel returns the transaction's isolation level.
+func (txn *Txn) IsoLevel() isolation.Level {
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	return txn.mu.sender.IsoLevel()
+}
+
+// Step performs a sequencing step. Step-wise execution must be
+// already enabled.
+//
+// In step-wise execution, reads operate at a snapshot established at
+// the last step, instead of the latest write if not yet enabled.
+//
+// If allowReadTimestampStep is set and the transaction runs under an
+// isolation level that establishes a new read snapshot for each statement,
+// the step also advances the transaction's read timestamp to the current
+// time.
+func (txn *Txn) Step(ctx context.Context, allowReadTimestampStep bool) error {
+	if txn.typ != RootTxn {
+		return errors.New("txn.Step() only allowed in RootTxn")
+	}
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	return txn.mu.sender.Step(ctx, allowReadTimestampStep)
+}
+
+// ConfigureStepping configures step-wise execution in the
+// transaction.
+func (txn *Txn) ConfigureStepping(ctx context.Context, mode SteppingMode) (prevMode SteppingMode) {
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	return txn.mu.sender.ConfigureStepping(ctx, mode)
+}
+
+// Sender returns the transaction's TxnSender.
 func (txn *Txn) Sender() TxnSender {
 	return txn.mu.sender
 }
@@ -201,8 +597,64 @@ func sendAndFill(ctx context.Context, send SenderFunc, b *Batch) error {
 	// fails. But send() also returns its own errors, so there's some dancing
 	// here to do because we want to run fillResults() so that the individual
 	// result gets initialized with an error from the corresponding call.
+	if err := b.prepare(); err != nil {
+		return err
+	}
 	ba := &kvpb.BatchRequest{}
 	ba.Requests = b.reqs
+	ba.Header = b.Header
 	b.response, b.pErr = send(ctx, ba)
-	return b.pErr.Error
+	b.fillResults(ctx)
+	return b.pErr.GoError()
+}
+
+// CreateSavepoint establishes a savepoint.
+// This method is only valid when called on RootTxns.
+//
+// Committing (or aborting) the transaction causes every open
+// savepoint to be released (or, respectively, rolled back)
+// implicitly.
+func (txn *Txn) CreateSavepoint(ctx context.Context) (SavepointToken, error) {
+	if txn.typ != RootTxn {
+		return nil, errors.New("cannot get savepoint in non-root txn")
+	}
+
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	return txn.mu.sender.CreateSavepoint(ctx)
+}
+
+// RollbackToSavepoint rolls back to the given savepoint. The writes performed
+// by the transaction since the savepoint was created become invisible to the
+// transaction and are discarded when the transaction finishes. All savepoints
+// "under" the savepoint being rolled back are also rolled back and their
+// token must not be used any more. The token of the savepoint being rolled
+// back remains valid and can be reused later (e.g. to release or roll back
+// again).
+//
+// This method is only valid when called on RootTxns.
+func (txn *Txn) RollbackToSavepoint(ctx context.Context, s SavepointToken) error {
+	if txn.typ != RootTxn {
+		return errors.New("cannot rollback savepoint in non-root txn")
+	}
+
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	return txn.mu.sender.RollbackToSavepoint(ctx, s)
+}
+
+// ReleaseSavepoint releases the given savepoint. The savepoint must not have
+// been rolled back or released already. All savepoints "under" the savepoint
+// being released are also released and their token must not be used any
+// more.
+//
+// This method is only valid when called on RootTxns.
+func (txn *Txn) ReleaseSavepoint(ctx context.Context, s SavepointToken) error {
+	if txn.typ != RootTxn {
+		return errors.New("cannot release savepoint in non-root txn")
+	}
+
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	return txn.mu.sender.ReleaseSavepoint(ctx, s)
 }
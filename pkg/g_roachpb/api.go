@@ -1,6 +1,75 @@
 package roachpb
 
+import (
+	"github.com/dborchard/tiny_crdb/pkg/h_storage/enginepb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"strings"
+)
+
+// A Transaction is a unit of work performed on the database.
+// Cockroach transactions always operate at the serializable isolation
+// level. Each Cockroach transaction is assigned a random priority. This
+// priority will be used to decide whether a transaction will be
+// aborted during contention.
+//
+// If you add fields to Transaction you'll need to update
+// Transaction.Clone. Failure to do this will result in test failures
+// in this package.
 type Transaction struct {
+	// The transaction metadata. This field includes the subset of information
+	// that is persisted with every write intent.
+	enginepb.TxnMeta
+	// A free-text identifier for debug purposes.
+	Name string
+	// The status of the transaction.
+	Status TransactionStatus
+	// The last time that the transaction's record was sent a heartbeat by its
+	// coordinator to indicate client activity. Concurrent transactions will
+	// avoid aborting a transaction if it observes recent-enough activity.
+	LastHeartbeat hlc.Timestamp
+	// This flag is set if the transaction's timestamp was "leaked" beyond the
+	// transaction (e.g. via cluster_logical_timestamp()). If true, this prevents
+	// the transaction's timestamp from being pushed, which means that the txn
+	// can't commit at a higher timestamp without resorting to a client-side
+	// retry.
+	ReadTimestampFixed bool
+	// The transaction's read timestamp. All reads are performed at this
+	// timestamp, ensuring that the transaction runs on top of a consistent
+	// snapshot of the database.
+	// Writes are performed at the transaction's write timestamp (meta.timestamp).
+	// The write timestamp can diverge from the read timestamp when a write is
+	// "pushed": for example in case a write runs into the timestamp cache, we're
+	// forced to write at a higher timestamp. Being serializable, the transaction
+	// can't commit if the write timestamp diverged from the read timestamp.
+	ReadTimestamp hlc.Timestamp
+	// A list of <start, end> key pairs. Only set if the transaction has
+	// acquired locks. These lock spans must be resolved (lock resolution) when
+	// the transaction is finalized.
+	LockSpans []Span
+	// A list of in-flight writes (point keys and sequence numbers). Only set
+	// if the transaction record is in the STAGING state: these are the writes
+	// that were sent in parallel with the EndTxn request that staged the
+	// record, and whose success determines whether the transaction is
+	// implicitly committed.
+	InFlightWrites []SequencedWrite
+	// A list of ignored seqnum ranges.
+	//
+	// The user code (SQL) expects this to be sorted and non-overlapping.
+	IgnoredSeqNums []enginepb.IgnoredSeqNumRange
+	// A list of observed timestamps, one per node, sorted by node ID. An
+	// observed timestamp is the reading of a node's clock the first time the
+	// transaction performed an operation on that node. Readings are never
+	// updated once recorded.
+	//
+	// The slice is treated as immutable; updates replace it with a copy. Use
+	// UpdateObservedTimestamp to add a reading.
+	ObservedTimestamps []ObservedTimestamp
+}
+
+// ObservedTimestamp is the reading of a node's clock by a transaction.
+type ObservedTimestamp struct {
+	NodeID    NodeID
+	Timestamp hlc.ClockTimestamp
 }
 
 type UserPriority int32
@@ -11,10 +80,124 @@ const (
 	MaxUserPriority    UserPriority = 100
 )
 
+// LeafTxnInputState is the state from a transaction coordinator
+// necessary and sufficient to set up a leaf transaction coordinator on
+// another node, or on another goroutine of the same node.
 type LeafTxnInputState struct {
+	// Txn is a copy of the transaction record. Its sequence number is the
+	// sequence number of the root's most recent write, at which the leaf's
+	// reads are performed when stepping is disabled.
+	Txn Transaction
+	// SteppingModeEnabled indicates whether the root transaction has
+	// enabled stepping mode; see kv.TxnSender.ConfigureStepping.
+	SteppingModeEnabled bool
+	// ReadSeqNum is the sequence number of the root transaction's read
+	// snapshot. It is only meaningful if stepping mode is enabled.
+	ReadSeqNum enginepb.TxnSeq
+}
+
+// LeafTxnFinalState is the state from a leaf transaction coordinator
+// necessary and sufficient to update a root transaction coordinator with
+// the work performed by the leaf.
+type LeafTxnFinalState struct {
+	// Txn is a copy of the transaction record. It carries the observed
+	// timestamps collected by the leaf.
+	Txn Transaction
+	// RefreshSpans contains the key spans read by the leaf. The root
+	// transaction must add them to its own refresh spans, as the leaf's reads
+	// need to be refreshed, just like the root's, if the transaction's read
+	// timestamp moves.
+	RefreshSpans []Span
 }
 
+// TransactionStatus specifies possible states for a transaction.
 type TransactionStatus int32
 
+const (
+	// PENDING is the default state for a new transaction. Transactions
+	// move from PENDING to one of COMMITTED or ABORTED. Mutations made
+	// as part of a PENDING transactions are recorded as "intents" in
+	// the underlying MVCC model.
+	PENDING TransactionStatus = 0
+	// STAGING is the state for a transaction which has issued all of
+	// its writes and is in the process of committing.
+	STAGING TransactionStatus = 3
+	// COMMITTED is the state for a transaction which has committed.
+	// Mutations made as part of a transaction which is moved into
+	// COMMITTED state become durable and visible to other transactions,
+	// moving from "intents" to permanent versioned values.
+	COMMITTED TransactionStatus = 1
+	// ABORTED is the state for a transaction which has been aborted.
+	// Mutations made as part of a transaction which is moved into
+	// ABORTED state are deleted and are never made visible to other
+	// transactions.
+	ABORTED TransactionStatus = 2
+)
+
+// Locality is an ordered set of key value Tiers that describe a node's
+// location. The tier keys should be the same across all nodes.
 type Locality struct {
+	Tiers []Tier
+}
+
+// Tier represents one level of the locality hierarchy.
+type Tier struct {
+	// Key is the name of tier and should match all other nodes.
+	Key string
+	// Value is node specific value corresponding to the key.
+	Value string
+}
+
+// String returns a string representation of the Tier.
+func (t Tier) String() string {
+	return t.Key + "=" + t.Value
+}
+
+// String returns a string representation of all the Tiers. This is part
+// of the Stringer interface.
+func (l Locality) String() string {
+	tiers := make([]string, len(l.Tiers))
+	for i, tier := range l.Tiers {
+		tiers[i] = tier.String()
+	}
+	return strings.Join(tiers, ",")
+}
+
+// Empty returns true if the tiers are empty.
+func (l Locality) Empty() bool {
+	return len(l.Tiers) == 0
+}
+
+// SharedPrefix returns the number of this locality's tiers which match those
+// of the passed locality.
+func (l Locality) SharedPrefix(other Locality) int {
+	for i := range l.Tiers {
+		if i >= len(other.Tiers) || l.Tiers[i] != other.Tiers[i] {
+			return i
+		}
+	}
+	return len(l.Tiers)
+}
+
+// Matches checks if this locality has a tier with a matching value for each
+// tier of the passed filter, returning true if so or false if not along with
+// the first tier of the filters that did not matched.
+func (l Locality) Matches(filter Locality) (bool, Tier) {
+	for _, t := range filter.Tiers {
+		if v, ok := l.Find(t.Key); !ok || v != t.Value {
+			return false, t
+		}
+	}
+	return true, Tier{}
+}
+
+// Find searches the locality's tiers for the input key, returning its value
+// if present.
+func (l Locality) Find(key string) (value string, ok bool) {
+	for i := range l.Tiers {
+		if l.Tiers[i].Key == key {
+			return l.Tiers[i].Value, true
+		}
+	}
+	return "", false
 }
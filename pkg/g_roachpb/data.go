@@ -1,20 +1,412 @@
 package roachpb
 
 import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
 	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/concurrency/isolation"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/concurrency/lock"
+	"github.com/dborchard/tiny_crdb/pkg/h_storage/enginepb"
 	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/protoutil"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/uuid"
+	"math/rand"
+	"sort"
 )
 
 // Key is a custom type for a byte string in proto
 // messages which refer to Cockroach keys.
 type Key []byte
 
+// KeyMin is a minimum key value which sorts before all other keys.
+var KeyMin = Key{}
+
+// KeyMax is a maximum key value which sorts after all other keys.
+var KeyMax = Key{0xff, 0xff}
+
+// Next returns the next key in lexicographic sort order. The method may only
+// take a shallow copy of the Key, so both the receiver and the return
+// value should be treated as immutable after.
+func (k Key) Next() Key {
+	return append(append(make(Key, 0, len(k)+1), k...), 0)
+}
+
+// PrefixEnd determines the end key given key as a prefix, that is the
+// key that sorts precisely behind all keys starting with prefix: "1"
+// is added to the final byte and the carry propagated. The special
+// cases of nil and KeyMin always returns KeyMax.
+func (k Key) PrefixEnd() Key {
+	if len(k) == 0 {
+		return KeyMax
+	}
+	end := append(Key(nil), k...)
+	for i := len(end) - 1; i >= 0; i-- {
+		end[i] = end[i] + 1
+		if end[i] != 0 {
+			return end[:i+1]
+		}
+	}
+	// This statement will only be reached if the key is already a maximal byte
+	// string (i.e. already \xff...).
+	return k
+}
+
+// Equal returns whether two keys are identical.
+func (k Key) Equal(l Key) bool {
+	return bytes.Equal(k, l)
+}
+
+// Compare compares the two Keys.
+func (k Key) Compare(b Key) int {
+	return bytes.Compare(k, b)
+}
+
+// String returns a string-formatted version of the key.
+func (k Key) String() string {
+	return fmt.Sprintf("%q", []byte(k))
+}
+
+// RKey denotes a Key whose local addressing has been accounted for. A key can
+// be transformed to an RKey by keys.Addr().
+//
+// RKey stands for "resolved key," as in a key whose address has been
+// resolved.
+type RKey Key
+
+// RKeyMin is a minimum key value which sorts before all other keys.
+var RKeyMin = RKey("")
+
+// RKeyMax is a maximum key value which sorts after all other keys.
+var RKeyMax = RKey(KeyMax)
+
+// AsRawKey returns the RKey as a Key. This is to be used only in select
+// situations in which an RKey is known to not contain a wrapped locally-
+// addressed Key. That is, it must only be used when the original Key was not
+// a local key. Whenever the Key which created the RKey is still available, it
+// should be used instead.
+func (rk RKey) AsRawKey() Key {
+	return Key(rk)
+}
+
+// Less returns true if receiver < otherRK.
+func (rk RKey) Less(otherRK RKey) bool {
+	return bytes.Compare(rk, otherRK) < 0
+}
+
+// Compare compares the two RKeys.
+func (rk RKey) Compare(other RKey) int {
+	return bytes.Compare(rk, other)
+}
+
+// Equal checks for byte-wise equality.
+func (rk RKey) Equal(other []byte) bool {
+	return bytes.Equal(rk, other)
+}
+
+// Next returns the RKey that sorts immediately after the given one.
+// The method may only take a shallow copy of the RKey, so both the
+// receiver and the return value should be treated as immutable after.
+func (rk RKey) Next() RKey {
+	return RKey(Key(rk).Next())
+}
+
+// PrefixEnd determines the end key given key as a prefix, that is the
+// key that sorts precisely behind all keys starting with prefix: "1"
+// is added to the final byte and the carry propagated. The special
+// cases of nil and KeyMin always returns KeyMax.
+func (rk RKey) PrefixEnd() RKey {
+	return RKey(Key(rk).PrefixEnd())
+}
+
+func (rk RKey) String() string {
+	return Key(rk).String()
+}
+
+// ValueType defines a set of type constants placed in the "tag" field of Value
+// messages. These are defined as a protocol buffer enumeration so that they
+// can be used portably between our Go and C code. The tags are used by the
+// RocksDB Merge Operator to perform specialized merges.
+type ValueType int32
+
+const (
+	// This is a subset of the SQL column type values, representing the
+	// underlying storage for various types. The DELIMITED_foo entries
+	// are used to encode values in the aggregation.
+	ValueType_UNKNOWN ValueType = 0
+	ValueType_INT     ValueType = 1
+	ValueType_BYTES   ValueType = 3
+	// TUPLE represents a DTuple, encoded as repeated pairs of varint field
+	// number followed by a value encoded Datum.
+	ValueType_TUPLE ValueType = 10
+)
+
+// headerSize is the size of the Value header: a single tag byte.
+const headerSize = 1
+
 type Value struct {
-	RawBytes  []byte
+	// raw_bytes contains the encoded value and tag. A nil or empty RawBytes
+	// is a deletion tombstone.
+	RawBytes []byte
+	// Timestamp of value.
 	Timestamp hlc.Timestamp
 }
 
+// MakeValueFromString returns a value with bytes and tag set.
+func MakeValueFromString(s string) Value {
+	v := Value{}
+	v.SetString(s)
+	return v
+}
+
+// MakeValueFromBytes returns a value with bytes and tag set.
+func MakeValueFromBytes(bs []byte) Value {
+	v := Value{}
+	v.SetBytes(bs)
+	return v
+}
+
+// IsPresent returns true if the value is present (existent and not a tombstone).
+func (v *Value) IsPresent() bool {
+	return v != nil && len(v.RawBytes) != 0
+}
+
+// GetTag retrieves the value type.
+func (v Value) GetTag() ValueType {
+	if len(v.RawBytes) < headerSize {
+		return ValueType_UNKNOWN
+	}
+	return ValueType(v.RawBytes[0])
+}
+
+func (v Value) dataBytes() []byte {
+	return v.RawBytes[headerSize:]
+}
+
+func (v *Value) ensureRawBytes(size int) {
+	if cap(v.RawBytes) < headerSize+size {
+		v.RawBytes = make([]byte, headerSize+size)
+		return
+	}
+	v.RawBytes = v.RawBytes[:headerSize+size]
+}
+
+func (v *Value) setTag(t ValueType) {
+	v.RawBytes[0] = byte(t)
+}
+
+// SetBytes sets the bytes and tag field of the receiver and clears the checksum.
+func (v *Value) SetBytes(b []byte) {
+	v.ensureRawBytes(len(b))
+	copy(v.dataBytes(), b)
+	v.setTag(ValueType_BYTES)
+}
+
+// SetTagAndData actually copies the input data to the RawBytes of the value,
+// placing the tag before it.
+func (v *Value) SetTagAndData(tag ValueType, data []byte) {
+	v.ensureRawBytes(len(data))
+	copy(v.dataBytes(), data)
+	v.setTag(tag)
+}
+
+// SetString sets the bytes and tag field of the receiver and clears the
+// checksum. This is identical to SetBytes, but specialized for a string
+// argument.
+func (v *Value) SetString(s string) {
+	v.ensureRawBytes(len(s))
+	copy(v.dataBytes(), s)
+	v.setTag(ValueType_BYTES)
+}
+
+// SetInt encodes the specified int64 value into the bytes field of the
+// receiver, sets the tag and clears the checksum.
+func (v *Value) SetInt(i int64) {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(buf[:], i)
+	v.ensureRawBytes(n)
+	copy(v.dataBytes(), buf[:n])
+	v.setTag(ValueType_INT)
+}
+
+// GetBytes returns the bytes field of the receiver. If the tag is not
+// BYTES an error will be returned.
+func (v Value) GetBytes() ([]byte, error) {
+	if tag := v.GetTag(); tag != ValueType_BYTES {
+		return nil, fmt.Errorf("value type is not %s: %d", "BYTES", tag)
+	}
+	return v.dataBytes(), nil
+}
+
+// GetInt decodes an int64 value from the bytes field of the receiver. If the
+// tag is not INT or the value cannot be decoded an error will be returned.
+func (v Value) GetInt() (int64, error) {
+	if tag := v.GetTag(); tag != ValueType_INT {
+		return 0, fmt.Errorf("value type is not %s: %d", "INT", tag)
+	}
+	i, n := binary.Varint(v.dataBytes())
+	if n <= 0 {
+		return 0, fmt.Errorf("int64 varint decoding failed: %d", n)
+	}
+	return i, nil
+}
+
+// Span is a key range with an inclusive start Key and an exclusive end Key.
 type Span struct {
+	// The start key of the key range.
+	Key Key
+	// The end key of the key range. The value is empty if the key range
+	// contains only a single key. Otherwise, it must order strictly after Key.
+	// In such a case, the Span encompasses the key range from Key to EndKey,
+	// including Key and excluding EndKey.
+	EndKey Key
+}
+
+// Valid returns whether or not the span is a "valid span".
+// A valid span cannot have an empty start and end key and must satisfy either:
+// 1. The end key is empty.
+// 2. The start key is lexicographically-ordered before the end key.
+func (s Span) Valid() bool {
+	if len(s.Key) == 0 && len(s.EndKey) == 0 {
+		return false
+	}
+	if len(s.EndKey) == 0 {
+		return true
+	}
+	return bytes.Compare(s.Key, s.EndKey) < 0
+}
+
+// Overlaps returns true WLOG for span A and B iff:
+//  1. Both spans contain one key (just the start key) and they are equal; or
+//  2. The span with only one key is contained inside the other span; or
+//  3. The end key of span A is strictly greater than the start key of span B
+//     and the end key of span B is strictly greater than the start key of span
+//     A.
+func (s Span) Overlaps(o Span) bool {
+	if !s.Valid() || !o.Valid() {
+		return false
+	}
+	if len(s.EndKey) == 0 && len(o.EndKey) == 0 {
+		return s.Key.Equal(o.Key)
+	} else if len(s.EndKey) == 0 {
+		return bytes.Compare(s.Key, o.Key) >= 0 && bytes.Compare(s.Key, o.EndKey) < 0
+	} else if len(o.EndKey) == 0 {
+		return bytes.Compare(o.Key, s.Key) >= 0 && bytes.Compare(o.Key, s.EndKey) < 0
+	}
+	return bytes.Compare(s.EndKey, o.Key) > 0 && bytes.Compare(s.Key, o.EndKey) < 0
+}
+
+// ContainsKey returns whether the span contains the given key.
+func (s Span) ContainsKey(key Key) bool {
+	if len(s.EndKey) == 0 {
+		return s.Key.Equal(key)
+	}
+	return bytes.Compare(key, s.Key) >= 0 && bytes.Compare(key, s.EndKey) < 0
+}
+
+// String formats the span.
+func (s Span) String() string {
+	if len(s.EndKey) == 0 {
+		return s.Key.String()
+	}
+	return fmt.Sprintf("{%s-%s}", s.Key, s.EndKey)
+}
+
+// MergeSpans sorts the given spans and merges ones with overlapping
+// spans. The input spans are not safe for re-use. Point spans are treated
+// as covering [Key, Key.Next()), so that adjacent spans are merged as well.
+//
+// The returned spans are sorted and non-overlapping; spans that cover a
+// single key are returned as point spans.
+func MergeSpans(spans []Span) []Span {
+	if len(spans) == 0 {
+		return spans
+	}
+	endKey := func(s Span) Key {
+		if len(s.EndKey) == 0 {
+			return s.Key.Next()
+		}
+		return s.EndKey
+	}
+	sort.Slice(spans, func(i, j int) bool {
+		return bytes.Compare(spans[i].Key, spans[j].Key) < 0
+	})
+	r := spans[:1]
+	r[0].EndKey = endKey(r[0])
+	for _, cur := range spans[1:] {
+		prev := &r[len(r)-1]
+		if bytes.Compare(cur.Key, prev.EndKey) <= 0 {
+			// The spans overlap or are adjacent.
+			if end := endKey(cur); bytes.Compare(end, prev.EndKey) > 0 {
+				prev.EndKey = end
+			}
+			continue
+		}
+		cur.EndKey = endKey(cur)
+		r = append(r, cur)
+	}
+	for i := range r {
+		if r[i].EndKey.Equal(r[i].Key.Next()) {
+			r[i].EndKey = nil
+		}
+	}
+	return r
+}
+
+// RSpan is a key range with an inclusive start RKey and an exclusive end
+// RKey.
+type RSpan struct {
+	Key, EndKey RKey
+}
+
+// Equal compares for equality.
+func (rs RSpan) Equal(o RSpan) bool {
+	return rs.Key.Equal(o.Key) && rs.EndKey.Equal(o.EndKey)
+}
+
+// ContainsKey returns whether this span contains the specified key.
+func (rs RSpan) ContainsKey(key RKey) bool {
+	return bytes.Compare(key, rs.Key) >= 0 && bytes.Compare(key, rs.EndKey) < 0
+}
+
+// ContainsKeyRange returns whether this span contains the specified key
+// range from start (inclusive) to end (exclusive). If end is empty or
+// start is equal to end, returns ContainsKey(start).
+func (rs RSpan) ContainsKeyRange(start, end RKey) bool {
+	if len(end) == 0 {
+		return rs.ContainsKey(start)
+	}
+	if comp := bytes.Compare(end, start); comp < 0 {
+		return false
+	} else if comp == 0 {
+		return rs.ContainsKey(start)
+	}
+	return bytes.Compare(start, rs.Key) >= 0 && bytes.Compare(rs.EndKey, end) >= 0
+}
+
+// Intersect returns the intersection of the current span and the given
+// span, or false if the spans do not intersect.
+func (rs RSpan) Intersect(o RSpan) (RSpan, bool) {
+	if !rs.EndKey.Less(o.EndKey) {
+		rs.EndKey = o.EndKey
+	}
+	if rs.Key.Less(o.Key) {
+		rs.Key = o.Key
+	}
+	if !rs.Key.Less(rs.EndKey) {
+		return RSpan{}, false
+	}
+	return rs, true
+}
+
+// AsRawSpanWithNoLocals returns the RSpan as a Span. This is to be used only
+// in select situations in which an RSpan is known to not contain a wrapped
+// locally-addressed Key.
+func (rs RSpan) AsRawSpanWithNoLocals() Span {
+	return Span{Key: Key(rs.Key), EndKey: Key(rs.EndKey)}
+}
+
+func (rs RSpan) String() string {
+	return fmt.Sprintf("{%s-%s}", rs.Key, rs.EndKey)
 }
 
 type KeyValue struct {
@@ -22,6 +414,22 @@ type KeyValue struct {
 	Value Value
 }
 
+// MakePriority generates a random priority value, biased by the specified
+// userPriority. If userPriority=MaxUserPriority, the random priority
+// returned will be MaxTxnPriority. If userPriority=MinUserPriority, the
+// random priority returned will be MinTxnPriority.
+func MakePriority(userPriority UserPriority) enginepb.TxnPriority {
+	switch userPriority {
+	case MinUserPriority:
+		return enginepb.MinTxnPriority
+	case MaxUserPriority:
+		return enginepb.MaxTxnPriority
+	}
+	// Priorities strictly between the min and the max are randomized so that
+	// conflicting transactions at the same user priority break ties fairly.
+	return enginepb.TxnPriority(rand.Int31n(int32(enginepb.MaxTxnPriority-1))) + 1
+}
+
 // MakeTransaction creates a new transaction. The transaction key is
 // composed using the specified baseKey (for locality with data
 // affected by the transaction) and a random ID to guarantee
@@ -48,5 +456,541 @@ func MakeTransaction(
 	userPriority UserPriority,
 	now hlc.Timestamp,
 ) Transaction {
-	return Transaction{}
+	return Transaction{
+		TxnMeta: enginepb.TxnMeta{
+			Key:            baseKey,
+			ID:             uuid.MakeV4(),
+			IsoLevel:       isoLevel,
+			WriteTimestamp: now,
+			MinTimestamp:   now,
+			Priority:       MakePriority(userPriority),
+			Sequence:       0, // 1-indexed, incremented before each Request
+		},
+		Name:          name,
+		LastHeartbeat: now,
+		ReadTimestamp: now,
+	}
+}
+
+// Clone creates a copy of the given transaction. The copy is shallow because
+// none of the references held by a transaction allow interior mutability.
+func (t *Transaction) Clone() *Transaction {
+	if t == nil {
+		return nil
+	}
+	c := *t
+	return &c
+}
+
+// IsLocking returns whether the transaction has begun acquiring locks.
+func (t *Transaction) IsLocking() bool {
+	return t.Key != nil
+}
+
+// LastActive returns the last timestamp at which client activity definitely
+// occurred, i.e. the maximum of ReadTimestamp and LastHeartbeat.
+func (t *Transaction) LastActive() hlc.Timestamp {
+	ts := t.LastHeartbeat
+	ts.Forward(t.ReadTimestamp)
+	return ts
+}
+
+// Update ratchets priority, timestamp and original timestamp values (among
+// others) for the transaction. If t.ID is empty, then the transaction is
+// copied from o.
+func (t *Transaction) Update(o *Transaction) {
+	if o == nil {
+		return
+	}
+	if t.ID == (uuid.UUID{}) {
+		*t = *o
+		return
+	} else if t.ID != o.ID {
+		panic(fmt.Sprintf("updating txn %s with different txn %s", t.ID.Short(), o.ID.Short()))
+	}
+	if len(t.Key) == 0 {
+		t.Key = o.Key
+	}
+
+	// Update epoch-scoped state, depending on the two transactions' epochs.
+	if t.Epoch < o.Epoch {
+		// Replace all epoch-scoped state.
+		t.Epoch = o.Epoch
+		t.Status = o.Status
+		t.WriteTimestamp = o.WriteTimestamp
+		t.ReadTimestamp = o.ReadTimestamp
+		t.ReadTimestampFixed = o.ReadTimestampFixed
+		t.Sequence = o.Sequence
+		t.LockSpans = o.LockSpans
+		t.InFlightWrites = o.InFlightWrites
+		t.IgnoredSeqNums = o.IgnoredSeqNums
+	} else if t.Epoch == o.Epoch {
+		// Forward all epoch-scoped state.
+		switch t.Status {
+		case PENDING:
+			t.Status = o.Status
+		case STAGING:
+			if o.Status != PENDING {
+				t.Status = o.Status
+			}
+		case ABORTED:
+			// Nothing to do.
+		case COMMITTED:
+			// Nothing to do.
+		}
+
+		if t.ReadTimestamp == o.ReadTimestamp {
+			// If neither of the transactions has a bumped ReadTimestamp, then the
+			// ReadTimestampFixed flag is cumulative.
+			t.ReadTimestampFixed = t.ReadTimestampFixed || o.ReadTimestampFixed
+		} else if t.ReadTimestamp.Less(o.ReadTimestamp) {
+			// If the other transaction has a higher ReadTimestamp, then it wins.
+			t.ReadTimestampFixed = o.ReadTimestampFixed
+		}
+		t.WriteTimestamp.Forward(o.WriteTimestamp)
+		t.ReadTimestamp.Forward(o.ReadTimestamp)
+		if t.Sequence < o.Sequence {
+			t.Sequence = o.Sequence
+		}
+		if len(o.LockSpans) > 0 {
+			t.LockSpans = o.LockSpans
+		}
+		if len(o.InFlightWrites) > 0 {
+			t.InFlightWrites = o.InFlightWrites
+		}
+		if len(o.IgnoredSeqNums) > 0 {
+			t.IgnoredSeqNums = o.IgnoredSeqNums
+		}
+	} else /* t.Epoch > o.Epoch */ {
+		// Ignore epoch-specific state from previous epoch. However, if the other
+		// transaction was aborted, the whole transaction is aborted.
+		if o.Status == ABORTED {
+			t.Status = ABORTED
+		}
+	}
+
+	// Update non-epoch-scoped state.
+	t.LastHeartbeat.Forward(o.LastHeartbeat)
+	for _, v := range o.ObservedTimestamps {
+		t.UpdateObservedTimestamp(v.NodeID, v.Timestamp)
+	}
+	if t.Priority < o.Priority {
+		t.Priority = o.Priority
+	}
+}
+
+// Restart reconfigures a transaction for restart. The epoch is incremented
+// for an in-place restart. The timestamp of the transaction on restart is
+// set to the maximum of the transaction's timestamp and the specified
+// timestamp.
+func (t *Transaction) Restart(timestamp hlc.Timestamp) {
+	t.BumpEpoch()
+	t.WriteTimestamp.Forward(timestamp)
+	t.ReadTimestamp = t.WriteTimestamp
+	t.ReadTimestampFixed = false
+	// Clear the sequence number and the ignored seqnum ranges: they only
+	// apply to the previous epoch.
+	t.Sequence = 0
+	t.IgnoredSeqNums = nil
+}
+
+// BumpEpoch increments the transaction's epoch.
+func (t *Transaction) BumpEpoch() {
+	t.Epoch++
+}
+
+// BumpReadTimestamp forwards the transaction's read timestamp to the provided
+// timestamp. The write timestamp is forwarded as well, as a transaction never
+// writes below the timestamp at which it reads.
+//
+// Unlike Restart, the epoch is not incremented: the writes that the
+// transaction has performed so far remain valid. This is used by isolation
+// levels that establish a new read snapshot for each statement.
+func (t *Transaction) BumpReadTimestamp(timestamp hlc.Timestamp) {
+	t.ReadTimestamp.Forward(timestamp)
+	t.WriteTimestamp.Forward(t.ReadTimestamp)
+}
+
+// UpdateObservedTimestamp stores a timestamp off a node's clock for future
+// operations in the transaction. When multiple calls are made for a single
+// nodeID, the lowest timestamp prevails.
+func (t *Transaction) UpdateObservedTimestamp(nodeID NodeID, timestamp hlc.ClockTimestamp) {
+	// Fast path for a transaction without observed timestamps.
+	if len(t.ObservedTimestamps) == 0 {
+		t.ObservedTimestamps = []ObservedTimestamp{{NodeID: nodeID, Timestamp: timestamp}}
+		return
+	}
+	i := sort.Search(len(t.ObservedTimestamps), func(i int) bool {
+		return t.ObservedTimestamps[i].NodeID >= nodeID
+	})
+	if i < len(t.ObservedTimestamps) && t.ObservedTimestamps[i].NodeID == nodeID {
+		if !timestamp.Less(t.ObservedTimestamps[i].Timestamp) {
+			return
+		}
+	}
+	// Copy the slice so that the update is not visible through clones of
+	// this transaction.
+	cpy := make([]ObservedTimestamp, 0, len(t.ObservedTimestamps)+1)
+	cpy = append(cpy, t.ObservedTimestamps[:i]...)
+	cpy = append(cpy, ObservedTimestamp{NodeID: nodeID, Timestamp: timestamp})
+	if i < len(t.ObservedTimestamps) && t.ObservedTimestamps[i].NodeID == nodeID {
+		i++
+	}
+	cpy = append(cpy, t.ObservedTimestamps[i:]...)
+	t.ObservedTimestamps = cpy
+}
+
+// AddIgnoredSeqNumRange adds the given range to the given list of
+// ignored seqnum ranges.
+//
+// The following invariants are assumed to hold and are preserved:
+// - the list contains no overlapping ranges
+// - the list contains no contiguous ranges
+// - the list is sorted, with larger seqnums at the end
+//
+// Additionally, the caller must ensure:
+//
+//  1. if the new range overlaps with some range in the list, then it
+//     also overlaps with every subsequent range in the list.
+//
+//  2. the new range's "end" seqnum is larger or equal to the "end"
+//     seqnum of the last element in the list.
+//
+// For example:
+//
+//	current list [3 5] [10 20] [22 24]
+//	new item:    [8 26]
+//	final list:  [3 5] [8 26]
+//
+//	current list [3 5] [10 20] [22 24]
+//	new item:    [28 32]
+//	final list:  [3 5] [10 20] [22 24] [28 32]
+//
+// This corresponds to savepoints semantics:
+//
+//   - Property 1 says that a rollback to an earlier savepoint
+//     rolls back over all writes following that savepoint.
+//   - Property 2 comes from that the new range's 'end' seqnum is the
+//     current write seqnum and thus larger than or equal to every
+//     previously seen value.
+func (t *Transaction) AddIgnoredSeqNumRange(newRange enginepb.IgnoredSeqNumRange) {
+	// Truncate the list at the last element not included in the new range.
+	list := t.IgnoredSeqNums
+	i := sort.Search(len(list), func(i int) bool {
+		return list[i].End >= newRange.Start
+	})
+
+	// Copy the list to avoid mutating a slice that might be shared with a
+	// clone of this transaction.
+	cpy := make([]enginepb.IgnoredSeqNumRange, i+1)
+	copy(cpy[:i], list[:i])
+	cpy[i] = newRange
+	t.IgnoredSeqNums = cpy
+}
+
+// String formats transaction into human readable string.
+func (t Transaction) String() string {
+	return fmt.Sprintf("%q meta={id=%s key=%s iso=%d pri=%d epo=%d ts=%v min=%v seq=%d} lock=%t stat=%s rts=%v",
+		t.Name, t.Short(), Key(t.Key), t.IsoLevel, t.Priority, t.Epoch, t.WriteTimestamp,
+		t.MinTimestamp, t.Sequence, t.IsLocking(), t.Status, t.ReadTimestamp)
+}
+
+// IsFinalized determines whether the transaction is in a final state. A final
+// state is one from which the transaction cannot transition.
+func (s TransactionStatus) IsFinalized() bool {
+	return s == COMMITTED || s == ABORTED
+}
+
+// String implements the fmt.Stringer interface.
+func (s TransactionStatus) String() string {
+	switch s {
+	case PENDING:
+		return "PENDING"
+	case STAGING:
+		return "STAGING"
+	case COMMITTED:
+		return "COMMITTED"
+	case ABORTED:
+		return "ABORTED"
+	default:
+		return fmt.Sprintf("TransactionStatus(%d)", int32(s))
+	}
+}
+
+// LockUpdate is a set of lock updates to be applied to the locks in the
+// span. The intent may be resolved (committed or aborted) or may be moved
+// to a higher timestamp.
+type LockUpdate struct {
+	Span
+	Txn            enginepb.TxnMeta
+	Status         TransactionStatus
+	IgnoredSeqNums []enginepb.IgnoredSeqNumRange
+}
+
+// MakeLockUpdate makes a lock update from the given span and txn.
+func MakeLockUpdate(txn *Transaction, span Span) LockUpdate {
+	u := LockUpdate{Span: span}
+	u.SetTxn(txn)
+	return u
+}
+
+// SetTxn updates the transaction details in the lock update.
+func (u *LockUpdate) SetTxn(txn *Transaction) {
+	u.Txn = txn.TxnMeta
+	u.Status = txn.Status
+	u.IgnoredSeqNums = txn.IgnoredSeqNums
+}
+
+// SequencedWrite is a point write to a key with a certain sequence number.
+type SequencedWrite struct {
+	// The key that the write was made at.
+	Key Key
+	// The sequence number of the request that created the write.
+	Sequence enginepb.TxnSeq
+}
+
+// LockAcquisition represents the acquisition of a lock on a single key by a
+// transaction, with the specified strength.
+type LockAcquisition struct {
+	Span
+	Txn        enginepb.TxnMeta
+	Durability lock.Durability
+	Strength   lock.Strength
+}
+
+// MakeLockAcquisition makes a lock acquisition message from the given txn,
+// key, durability, and strength.
+func MakeLockAcquisition(
+	txn *enginepb.TxnMeta, key Key, dur lock.Durability, str lock.Strength,
+) LockAcquisition {
+	return LockAcquisition{Span: Span{Key: key}, Txn: *txn, Durability: dur, Strength: str}
+}
+
+// Intent is an intent on a single key, together with the metadata of the
+// transaction that wrote it.
+type Intent struct {
+	Key Key
+	Txn enginepb.TxnMeta
+}
+
+// MakeIntent makes an intent with the given txn and key.
+func MakeIntent(txn *enginepb.TxnMeta, key Key) Intent {
+	return Intent{Key: key, Txn: *txn}
+}
+
+// AsLockUpdate creates a lock update message corresponding to the given
+// intent and transaction.
+func (i *Intent) AsLockUpdate(txn *Transaction) LockUpdate {
+	return MakeLockUpdate(txn, Span{Key: i.Key})
+}
+
+// SetProto encodes the specified proto message into the bytes field of the
+// receiver and clears the checksum. If the proto message is an
+// InternalTimeSeriesData, the tag will be set to TIMESERIES rather than BYTES.
+func (v *Value) SetProto(msg protoutil.Message) error {
+	data, err := protoutil.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	v.SetBytes(data)
+	return nil
+}
+
+// GetProto unmarshals the bytes field of the receiver into msg. If
+// unmarshalling fails or the tag is not BYTES, an error will be
+// returned.
+func (v Value) GetProto(msg protoutil.Message) error {
+	data, err := v.GetBytes()
+	if err != nil {
+		return err
+	}
+	return protoutil.Unmarshal(data, msg)
+}
+
+// A SplitTrigger is run after a successful commit of an AdminSplit
+// command. It provides the updated left hand side of the split's
+// range descriptor (left_desc) and the new range descriptor covering
+// the right hand side of the split (right_desc). This information
+// allows the final bookkeeping for the split to be completed and the
+// new range put into operation.
+type SplitTrigger struct {
+	LeftDesc  RangeDescriptor
+	RightDesc RangeDescriptor
+}
+
+// A MergeTrigger is run after a successful commit of an AdminMerge
+// command. It provides the updated left hand side of the split's
+// range descriptor (left_desc), which now encompasses what was
+// originally both ranges, and the soon-to-be-invalid range descriptor
+// that used to cover the subsumed, right-hand range (right_desc). This
+// information allows the final bookkeeping for the merge to be completed
+// and put into operation.
+type MergeTrigger struct {
+	LeftDesc  RangeDescriptor
+	RightDesc RangeDescriptor
+}
+
+// A ChangeReplicasTrigger is run after a successful commit of an
+// AdminChangeReplicas command. It provides the updated range descriptor
+// (desc), whose replica set is applied to the range's Raft group as a
+// configuration change when the commit applies.
+type ChangeReplicasTrigger struct {
+	Desc *RangeDescriptor
+}
+
+// InternalCommitTrigger encapsulates all of the internal-only commit triggers.
+// Only one may be set.
+type InternalCommitTrigger struct {
+	SplitTrigger          *SplitTrigger
+	MergeTrigger          *MergeTrigger
+	ChangeReplicasTrigger *ChangeReplicasTrigger
+}
+
+// GetSplitTrigger returns the split trigger, if any.
+func (t *InternalCommitTrigger) GetSplitTrigger() *SplitTrigger {
+	if t == nil {
+		return nil
+	}
+	return t.SplitTrigger
+}
+
+// GetMergeTrigger returns the merge trigger, if any.
+func (t *InternalCommitTrigger) GetMergeTrigger() *MergeTrigger {
+	if t == nil {
+		return nil
+	}
+	return t.MergeTrigger
+}
+
+// GetChangeReplicasTrigger returns the change replicas trigger, if any.
+func (t *InternalCommitTrigger) GetChangeReplicasTrigger() *ChangeReplicasTrigger {
+	if t == nil {
+		return nil
+	}
+	return t.ChangeReplicasTrigger
+}
+
+// LeaseSequence is a custom type for a lease sequence number.
+type LeaseSequence int64
+
+// LeaseType describes the type of a range lease.
+type LeaseType int
+
+const (
+	// LeaseNone specifies no lease, to be used as a default value.
+	LeaseNone LeaseType = iota
+	// LeaseExpiration allows range operations while the wall clock is
+	// within the expiration timestamp.
+	LeaseExpiration
+	// LeaseEpoch allows range operations while the node liveness epoch
+	// is equal to the lease epoch.
+	LeaseEpoch
+)
+
+func (t LeaseType) String() string {
+	switch t {
+	case LeaseNone:
+		return "none"
+	case LeaseExpiration:
+		return "expiration"
+	case LeaseEpoch:
+		return "epoch"
+	default:
+		return fmt.Sprintf("LeaseType(%d)", int(t))
+	}
+}
+
+// Lease contains information about range leases including the
+// expiration and lease holder. Only the holder of a valid lease serves the
+// requests addressed to the range.
+//
+// An expiration-based lease is valid until its Expiration, and is extended
+// by its holder before it expires. An epoch-based lease is valid for as
+// long as the liveness record of the holder's node carries the lease's
+// Epoch, and does not need to be extended: it ends when the epoch of the
+// node is incremented, once the node failed to heartbeat its liveness.
+type Lease struct {
+	// Start is the timestamp from which the lease is valid. The new
+	// leaseholder serves no writes below it.
+	Start hlc.ClockTimestamp
+	// Expiration is the timestamp until which an expiration-based lease is
+	// valid. It is nil for epoch-based leases.
+	Expiration *hlc.Timestamp
+	// Replica is the replica holding the lease.
+	Replica ReplicaDescriptor
+	// ProposedTS is the timestamp at which the lease was proposed.
+	ProposedTS hlc.ClockTimestamp
+	// Epoch is the node liveness epoch of the holder's node for which an
+	// epoch-based lease is valid.
+	Epoch int64
+	// Sequence is a number which identifies the lease among the
+	// successive leases of the range. It is incremented whenever the lease
+	// changes hands or type, but not when a lease is extended. Commands are
+	// proposed under the sequence of the proposer's lease, and are rejected
+	// when they apply under another lease.
+	Sequence LeaseSequence
+}
+
+// Type returns the lease type.
+func (l Lease) Type() LeaseType {
+	switch {
+	case l.Epoch != 0:
+		return LeaseEpoch
+	case l.Expiration != nil:
+		return LeaseExpiration
+	default:
+		return LeaseNone
+	}
+}
+
+// Empty returns true for the Lease zero-value.
+func (l *Lease) Empty() bool {
+	return l == nil || *l == (Lease{})
+}
+
+// OwnedBy returns whether the given store is the lease owner.
+func (l Lease) OwnedBy(storeID StoreID) bool {
+	return l.Replica.StoreID == storeID
+}
+
+// GetExpiration returns the lease expiration or the zero timestamp if the
+// receiver is not an expiration-based lease.
+func (l Lease) GetExpiration() hlc.Timestamp {
+	if l.Expiration == nil {
+		return hlc.Timestamp{}
+	}
+	return *l.Expiration
+}
+
+// Equivalent determines whether the new lease is equivalent to the old
+// lease, l, for the purposes of lease sequencing: the new lease is then an
+// extension of the old one, and keeps its sequence. An expiration-based
+// lease is equivalent to a new lease of the same holder, start and type,
+// which expires no earlier. An epoch-based lease is equivalent to a new
+// lease of the same holder, start and epoch.
+func (l Lease) Equivalent(newL Lease) bool {
+	if l.Replica != newL.Replica || l.Start != newL.Start || l.Type() != newL.Type() {
+		return false
+	}
+	switch l.Type() {
+	case LeaseEpoch:
+		return l.Epoch == newL.Epoch
+	case LeaseExpiration:
+		return l.GetExpiration().LessEq(newL.GetExpiration())
+	default:
+		return true
+	}
+}
+
+func (l Lease) String() string {
+	if l.Empty() {
+		return "<empty>"
+	}
+	if l.Type() == LeaseEpoch {
+		return fmt.Sprintf("repl=%s seq=%d start=%d,%d epo=%d",
+			l.Replica, l.Sequence, l.Start.WallTime, l.Start.Logical, l.Epoch)
+	}
+	exp := l.GetExpiration()
+	return fmt.Sprintf("repl=%s seq=%d start=%d,%d exp=%d,%d",
+		l.Replica, l.Sequence, l.Start.WallTime, l.Start.Logical, exp.WallTime, exp.Logical)
 }
@@ -1,5 +1,11 @@
 package roachpb
 
+import (
+	"fmt"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"strings"
+)
+
 // NodeID is a custom type for a cockroach node ID. (not a raft node ID)
 // 0 is not a valid NodeID.
 type NodeID int32
@@ -7,8 +13,201 @@ type NodeID int32
 // StoreID is a custom type for a cockroach store ID.
 type StoreID int32
 
+// RangeID is a custom type for a cockroach range ID.
+type RangeID int64
+
+// ReplicaID is a custom type for a range replica ID.
+type ReplicaID int32
+
+// ReplicaDescriptor describes a replica location by node ID
+// (corresponds to a host:port via lookup on gossip network) and store
+// ID (identifies the device).
+type ReplicaDescriptor struct {
+	NodeID  NodeID
+	StoreID StoreID
+	// ReplicaID uniquely identifies a replica instance. If a range is
+	// removed from a store and then re-added to the same store, the new
+	// instance will have a higher replica_id.
+	ReplicaID ReplicaID
+	// Type indicates which Raft activities the replica participates in. The
+	// incoming and outgoing voter types are only used while the range is in
+	// a joint configuration.
+	Type ReplicaType
+}
+
+func (r ReplicaDescriptor) String() string {
+	s := fmt.Sprintf("(n%d,s%d):%d", r.NodeID, r.StoreID, r.ReplicaID)
+	if r.Type != VOTER_FULL {
+		s += r.Type.String()
+	}
+	return s
+}
+
+// RangeDescriptor is the value stored in a range metadata key. A range is
+// described using an inclusive start key, a non-inclusive end key, and a
+// list of replicas where the range is stored.
+//
+// Range descriptors are stored at two places: the range-local
+// keys.RangeDescriptorKey of their start key, which is the authoritative
+// copy, and a meta addressing record at keys.RangeMetaKey of their end key,
+// which is how the descriptor of the range containing a key is found (see
+// kv.RangeLookup).
+type RangeDescriptor struct {
+	RangeID RangeID
+	// StartKey is the first key which may be contained by this range.
+	StartKey RKey
+	// EndKey marks the end of the range's possible keys. EndKey itself is
+	// not contained in this range - it will be contained in the immediately
+	// subsequent range.
+	EndKey RKey
+	// InternalReplicas is the set of nodes/stores on which replicas of this
+	// range are stored.
+	InternalReplicas []ReplicaDescriptor
+	// NextReplicaID is a counter used to generate replica IDs.
+	NextReplicaID ReplicaID
+	// Generation is incremented on every split, merge, and every replica
+	// change, i.e., whenever the span of the range or replica set changes. It
+	// is initialized to zero when the range is first created. Two
+	// descriptors of the same range are ordered by their generation; the
+	// range cache uses this to tell stale descriptors from fresh ones.
+	Generation int64
+	// StickyBit, if set, is the timestamp until which the range must not be
+	// merged with its left neighbour. It is set by manual splits, so that
+	// the merge queue does not undo them.
+	StickyBit hlc.Timestamp
+}
+
+// RSpan returns the RangeDescriptor's resolved span.
+func (r *RangeDescriptor) RSpan() RSpan {
+	return RSpan{Key: r.StartKey, EndKey: r.EndKey}
+}
+
+// ContainsKey returns whether this RangeDescriptor contains the specified
+// key.
+func (r *RangeDescriptor) ContainsKey(key RKey) bool {
+	return r.RSpan().ContainsKey(key)
+}
+
+// ContainsKeyRange returns whether this RangeDescriptor contains the
+// specified key range from start (inclusive) to end (exclusive). If end is
+// empty, returns ContainsKey(start).
+func (r *RangeDescriptor) ContainsKeyRange(start, end RKey) bool {
+	return r.RSpan().ContainsKeyRange(start, end)
+}
+
+// Replicas returns the set of nodes/stores on which replicas of this range
+// are stored.
+func (r *RangeDescriptor) Replicas() []ReplicaDescriptor {
+	return r.InternalReplicas
+}
+
+// GetReplicaDescriptor returns the replica which matches the specified
+// store ID.
+func (r *RangeDescriptor) GetReplicaDescriptor(storeID StoreID) (ReplicaDescriptor, bool) {
+	for _, repDesc := range r.InternalReplicas {
+		if repDesc.StoreID == storeID {
+			return repDesc, true
+		}
+	}
+	return ReplicaDescriptor{}, false
+}
+
+// GetReplicaDescriptorByID returns the replica which matches the specified
+// replica ID.
+func (r *RangeDescriptor) GetReplicaDescriptorByID(replicaID ReplicaID) (ReplicaDescriptor, bool) {
+	for _, repDesc := range r.InternalReplicas {
+		if repDesc.ReplicaID == replicaID {
+			return repDesc, true
+		}
+	}
+	return ReplicaDescriptor{}, false
+}
+
+// InAtomicReplicationChange returns whether the range is in a joint
+// configuration, in which some of its voters are incoming or outgoing.
+func (r *RangeDescriptor) InAtomicReplicationChange() bool {
+	for _, repDesc := range r.InternalReplicas {
+		if repDesc.Type == VOTER_INCOMING || repDesc.Type == VOTER_OUTGOING {
+			return true
+		}
+	}
+	return false
+}
+
+func (r RangeDescriptor) String() string {
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "r%d:%s [", r.RangeID, r.RSpan())
+	for i, repDesc := range r.InternalReplicas {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		buf.WriteString(repDesc.String())
+	}
+	fmt.Fprintf(&buf, ", next=%d, gen=%d", r.NextReplicaID, r.Generation)
+	if !r.StickyBit.IsEmpty() {
+		fmt.Fprintf(&buf, ", sticky=%v", r.StickyBit)
+	}
+	buf.WriteString("]")
+	return buf.String()
+}
+
+// RangeInfo contains information about a range, returned to the client so
+// that it can update its range cache.
+type RangeInfo struct {
+	Desc RangeDescriptor
+}
+
+// Attributes specifies a list of arbitrary strings describing node
+// topology, store type, and machine capabilities.
+type Attributes struct {
+	Attrs []string
+}
+
+// String implements the fmt.Stringer interface.
+func (a Attributes) String() string {
+	return strings.Join(a.Attrs, ",")
+}
+
+// NodeDescriptor holds details on node physical/network topology.
 type NodeDescriptor struct {
+	NodeID   NodeID
+	Locality Locality
+}
+
+// StoreCapacity contains capacity information for a storage device.
+type StoreCapacity struct {
+	// Capacity is the total number of bytes of the store.
+	Capacity int64
+	// Available is the number of bytes remaining free on the store.
+	Available int64
+	// Used is the number of bytes used by the store's data.
+	Used int64
+	// LogicalBytes is the sum of the live and historical data of the
+	// store's ranges, as tracked by their MVCCStats.
+	LogicalBytes int64
+	// RangeCount is the number of replicas held by the store.
+	RangeCount int32
+}
+
+// FractionUsed computes the fraction of storage capacity that is in use.
+func (sc StoreCapacity) FractionUsed() float64 {
+	if sc.Capacity == 0 {
+		return 0
+	}
+	return float64(sc.Used) / float64(sc.Used+sc.Available)
+}
+
+// String implements the fmt.Stringer interface.
+func (sc StoreCapacity) String() string {
+	return fmt.Sprintf("disk (capacity=%d, available=%d, used=%d, logicalBytes=%d), ranges=%d",
+		sc.Capacity, sc.Available, sc.Used, sc.LogicalBytes, sc.RangeCount)
 }
 
+// StoreDescriptor holds store information including store attributes, node
+// descriptor and store capacity.
 type StoreDescriptor struct {
+	StoreID  StoreID
+	Attrs    Attributes
+	Node     NodeDescriptor
+	Capacity StoreCapacity
 }
@@ -0,0 +1,76 @@
+package roachpb
+
+import "fmt"
+
+// ReplicaType identifies which Raft activities a replica participates in.
+type ReplicaType int32
+
+const (
+	// VOTER_FULL indicates a replica that is a voter in the current
+	// configuration.
+	VOTER_FULL ReplicaType = 0
+	// VOTER_INCOMING indicates a voting replica that is being added to the
+	// range: it is a voter of the incoming configuration of a joint
+	// configuration, but not of the outgoing one.
+	VOTER_INCOMING ReplicaType = 2
+	// VOTER_OUTGOING indicates a voting replica that is being removed from
+	// the range: it is a voter of the outgoing configuration of a joint
+	// configuration, but not of the incoming one.
+	VOTER_OUTGOING ReplicaType = 3
+)
+
+func (t ReplicaType) String() string {
+	switch t {
+	case VOTER_FULL:
+		return "VOTER_FULL"
+	case VOTER_INCOMING:
+		return "VOTER_INCOMING"
+	case VOTER_OUTGOING:
+		return "VOTER_OUTGOING"
+	default:
+		return fmt.Sprintf("ReplicaType(%d)", int32(t))
+	}
+}
+
+// IsVoterOldConfig returns whether a replica of this type is a voter in the
+// outgoing configuration of a joint configuration, or in the configuration
+// if the range is not in a joint configuration.
+func (t ReplicaType) IsVoterOldConfig() bool {
+	return t == VOTER_FULL || t == VOTER_OUTGOING
+}
+
+// IsVoterNewConfig returns whether a replica of this type is a voter in the
+// incoming configuration of a joint configuration, or in the configuration
+// if the range is not in a joint configuration.
+func (t ReplicaType) IsVoterNewConfig() bool {
+	return t == VOTER_FULL || t == VOTER_INCOMING
+}
+
+// ReplicaChangeType is a parameter of ChangeReplicasTrigger.
+type ReplicaChangeType int32
+
+const (
+	ADD_VOTER    ReplicaChangeType = 0
+	REMOVE_VOTER ReplicaChangeType = 1
+)
+
+func (t ReplicaChangeType) String() string {
+	switch t {
+	case ADD_VOTER:
+		return "ADD_VOTER"
+	case REMOVE_VOTER:
+		return "REMOVE_VOTER"
+	default:
+		return fmt.Sprintf("ReplicaChangeType(%d)", int32(t))
+	}
+}
+
+// ReplicationTarget identifies a node/store pair.
+type ReplicationTarget struct {
+	NodeID  NodeID
+	StoreID StoreID
+}
+
+func (t ReplicationTarget) String() string {
+	return fmt.Sprintf("n%d,s%d", t.NodeID, t.StoreID)
+}
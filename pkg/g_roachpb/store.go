@@ -1,4 +1,12 @@
 package roachpb
 
+import "github.com/dborchard/tiny_crdb/pkg/z_util/uuid"
+
+// StoreIdent uniquely identifies a store in the cluster. The StoreIdent is
+// written to the underlying storage engine at a store-reserved system key
+// (keys.StoreIdentKey).
 type StoreIdent struct {
+	ClusterID uuid.UUID
+	NodeID    NodeID
+	StoreID   StoreID
 }
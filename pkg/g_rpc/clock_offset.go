@@ -0,0 +1,137 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"sync"
+	"time"
+)
+
+// RemoteOffset is the offset of the clock of a remote node from the clock
+// of the local node, as measured by a heartbeat.
+type RemoteOffset struct {
+	// Offset is the estimated offset of the remote clock, in nanoseconds. It
+	// is positive if the remote clock is ahead of the local clock.
+	Offset int64
+	// Uncertainty is the maximum error of the estimated offset, in
+	// nanoseconds: the actual offset lies within Offset ± Uncertainty.
+	Uncertainty int64
+	// MeasuredAt is the physical time of the local clock, in nanoseconds, at
+	// which the offset was measured.
+	MeasuredAt int64
+}
+
+func (r RemoteOffset) String() string {
+	return fmt.Sprintf("off=%s, err=%s, at=%s",
+		time.Duration(r.Offset), time.Duration(r.Uncertainty), time.Unix(0, r.MeasuredAt))
+}
+
+// isHealthy returns whether the remote clock is within the tolerated offset
+// of the local clock. A clock whose offset may or may not exceed the
+// tolerated offset, given the uncertainty of the measurement, is healthy.
+func (r RemoteOffset) isHealthy(toleratedOffset time.Duration) bool {
+	absOffset := r.Offset
+	if absOffset < 0 {
+		absOffset = -absOffset
+	}
+	return time.Duration(absOffset-r.Uncertainty) <= toleratedOffset
+}
+
+// isStale returns whether the measurement is too old to be trusted.
+func (r RemoteOffset) isStale(ttl time.Duration, now int64) bool {
+	return r.MeasuredAt+ttl.Nanoseconds() < now
+}
+
+// RemoteClockMonitor keeps track of the most recent measurements of the
+// offsets of the clocks of the remote nodes, and verifies that the local
+// clock is in sync with the clocks of the cluster.
+type RemoteClockMonitor struct {
+	clock     *hlc.Clock
+	offsetTTL time.Duration
+
+	mu struct {
+		sync.Mutex
+		// offsets maps the address of each remote node to the offset of its
+		// clock.
+		offsets map[string]RemoteOffset
+	}
+}
+
+// newRemoteClockMonitor returns a monitor for the given clock. The
+// measurements older than offsetTTL are discarded.
+func newRemoteClockMonitor(clock *hlc.Clock, offsetTTL time.Duration) *RemoteClockMonitor {
+	r := &RemoteClockMonitor{clock: clock, offsetTTL: offsetTTL}
+	r.mu.offsets = make(map[string]RemoteOffset)
+	return r
+}
+
+// AllOffsets returns a copy of the offsets of the remote clocks, keyed by
+// the address of their node.
+func (r *RemoteClockMonitor) AllOffsets() map[string]RemoteOffset {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	offsets := make(map[string]RemoteOffset, len(r.mu.offsets))
+	for addr, offset := range r.mu.offsets {
+		offsets[addr] = offset
+	}
+	return offsets
+}
+
+// UpdateOffset records the offset of the clock of the node at addr. The
+// measurement replaces the previous one if that one is stale or less precise.
+// An empty measurement, which the heartbeats send when no offset could be
+// measured, discards a stale previous one.
+func (r *RemoteClockMonitor) UpdateOffset(ctx context.Context, addr string, offset RemoteOffset) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	oldOffset, ok := r.mu.offsets[addr]
+	switch {
+	case !ok || oldOffset.isStale(r.offsetTTL, r.clock.PhysicalNow()):
+		if offset != (RemoteOffset{}) {
+			r.mu.offsets[addr] = offset
+		} else {
+			delete(r.mu.offsets, addr)
+		}
+	case offset != (RemoteOffset{}) && offset.Uncertainty <= oldOffset.Uncertainty:
+		r.mu.offsets[addr] = offset
+	}
+}
+
+// VerifyClockOffset returns an error if the local clock is out of sync with
+// the clocks of the cluster, that is if it is further than 80% of the
+// maximum clock offset from the median of the cluster's clocks. The median
+// is within the tolerated offset if a majority of the clocks of the cluster,
+// the local one included, are.
+//
+// Stale measurements are discarded. The check is disabled if the clock
+// doesn't enforce a maximum offset.
+func (r *RemoteClockMonitor) VerifyClockOffset(ctx context.Context) error {
+	maxOffset := r.clock.MaxOffset()
+	if maxOffset == 0 {
+		return nil
+	}
+	toleratedOffset := maxOffset * 4 / 5
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.clock.PhysicalNow()
+	healthyOffsetCount := 0
+	for addr, offset := range r.mu.offsets {
+		if offset.isStale(r.offsetTTL, now) {
+			delete(r.mu.offsets, addr)
+			continue
+		}
+		if offset.isHealthy(toleratedOffset) {
+			healthyOffsetCount++
+		}
+	}
+	// The local clock is in sync with itself.
+	numClocks := len(r.mu.offsets) + 1
+	if 2*(healthyOffsetCount+1) <= numClocks {
+		return fmt.Errorf("clock synchronization error: this node is more than %s away "+
+			"from the median of the cluster's clocks (%d of %d known nodes are within the offset)",
+			toleratedOffset, healthyOffsetCount, len(r.mu.offsets))
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package rpc
+
+import (
+	"context"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+// TestVerifyClockOffset verifies that the local clock is found out of sync
+// once the median of the cluster's clocks is further than the tolerated
+// offset.
+func TestVerifyClockOffset(t *testing.T) {
+	ctx := context.Background()
+	m := hlc.NewManualClock(1000)
+	// The tolerated offset is 80ns.
+	clock := hlc.NewClock(m.UnixNano, 100*time.Nanosecond)
+
+	for _, tc := range []struct {
+		name    string
+		offsets map[string]RemoteOffset
+		inSync  bool
+	}{
+		{"no remote clocks", nil, true},
+		{"close clock", map[string]RemoteOffset{"a": {Offset: 10}}, true},
+		{"far clock", map[string]RemoteOffset{"a": {Offset: 90}}, false},
+		{"far clock behind", map[string]RemoteOffset{"a": {Offset: -90}}, false},
+		{"uncertain clock", map[string]RemoteOffset{"a": {Offset: 90, Uncertainty: 20}}, true},
+		{"majority close", map[string]RemoteOffset{"a": {Offset: 90}, "b": {Offset: 10}}, true},
+		{"majority far", map[string]RemoteOffset{"a": {Offset: 90}, "b": {Offset: -90}}, false},
+		{"half far", map[string]RemoteOffset{
+			"a": {Offset: 90}, "b": {Offset: 90}, "c": {Offset: 10},
+		}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := newRemoteClockMonitor(clock, time.Hour)
+			for addr, offset := range tc.offsets {
+				offset.MeasuredAt = m.UnixNano()
+				r.UpdateOffset(ctx, addr, offset)
+			}
+			err := r.VerifyClockOffset(ctx)
+			if tc.inSync {
+				require.NoError(t, err)
+			} else {
+				require.ErrorContains(t, err, "clock synchronization error")
+			}
+		})
+	}
+
+	// Stale measurements are discarded.
+	r := newRemoteClockMonitor(clock, 50*time.Nanosecond)
+	r.UpdateOffset(ctx, "a", RemoteOffset{Offset: 90, MeasuredAt: m.UnixNano()})
+	require.Error(t, r.VerifyClockOffset(ctx))
+	m.Increment(100)
+	require.NoError(t, r.VerifyClockOffset(ctx))
+	require.Empty(t, r.AllOffsets())
+
+	// A less precise measurement doesn't replace a fresh one.
+	r.UpdateOffset(ctx, "a", RemoteOffset{Offset: 10, Uncertainty: 5, MeasuredAt: m.UnixNano()})
+	r.UpdateOffset(ctx, "a", RemoteOffset{Offset: 90, Uncertainty: 10, MeasuredAt: m.UnixNano()})
+	require.Equal(t, int64(10), r.AllOffsets()["a"].Offset)
+}
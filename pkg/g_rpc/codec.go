@@ -0,0 +1,27 @@
+package rpc
+
+import (
+	"github.com/dborchard/tiny_crdb/pkg/z_util/protoutil"
+	"google.golang.org/grpc/encoding"
+)
+
+// codec is the gRPC codec of the RPCs between nodes. It encodes the messages
+// with protoutil, whose messages aren't protobufs.
+type codec struct{}
+
+var _ encoding.Codec = codec{}
+
+// Marshal implements encoding.Codec.
+func (codec) Marshal(v interface{}) ([]byte, error) {
+	return protoutil.Marshal(v)
+}
+
+// Unmarshal implements encoding.Codec.
+func (codec) Unmarshal(data []byte, v interface{}) error {
+	return protoutil.Unmarshal(data, v)
+}
+
+// Name implements encoding.Codec.
+func (codec) Name() string {
+	return "json"
+}
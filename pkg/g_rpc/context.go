@@ -0,0 +1,406 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/stop"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultHeartbeatInterval is the default interval between the
+	// heartbeats of a connection.
+	defaultHeartbeatInterval = 3 * time.Second
+	// maximumPingDurationMult is the multiple of the tolerated clock offset
+	// above which the duration of a heartbeat makes it too imprecise to
+	// measure the offset of the remote clock.
+	maximumPingDurationMult = 2
+)
+
+// ErrNotHeartbeated is returned by Connection.Health until the first
+// heartbeat of the connection returns.
+var ErrNotHeartbeated = errors.New("not yet heartbeated")
+
+// ContextOptions are the options of a Context.
+type ContextOptions struct {
+	Clock   *hlc.Clock
+	Stopper *stop.Stopper
+	// AdvertiseAddr is the address at which the node serves RPCs. It is sent
+	// to the nodes that the node heartbeats, and the calls to it are served
+	// by the local Internal server, if one is set.
+	AdvertiseAddr string
+	// HeartbeatInterval is the interval between the heartbeats of each
+	// connection. Defaults to defaultHeartbeatInterval.
+	HeartbeatInterval time.Duration
+	// HeartbeatTimeout bounds the duration of each heartbeat. Defaults to
+	// twice the heartbeat interval.
+	HeartbeatTimeout time.Duration
+	// OnClockOffsetViolation, if set, is called after a heartbeat when the
+	// clock of the node is out of sync with the clocks of the cluster. The
+	// servers shut the node down.
+	OnClockOffsetViolation func(context.Context, error)
+}
+
+// Context is the RPC context of a node. It dials the connections to the
+// other nodes, which it heartbeats to check their health and to measure the
+// offsets of the remote clocks.
+type Context struct {
+	ContextOptions
+
+	// RemoteClocks holds the offsets of the remote clocks measured by the
+	// heartbeats, in both directions.
+	RemoteClocks *RemoteClockMonitor
+
+	// localInternalClient, if set, serves the calls to the node itself.
+	localInternalClient kvpb.InternalClient
+
+	mu struct {
+		sync.Mutex
+		// conns maps the target of each connection to the connection.
+		conns map[string]*Connection
+	}
+}
+
+// NewContext creates an RPC context with the given options.
+func NewContext(opts ContextOptions) *Context {
+	if opts.HeartbeatInterval == 0 {
+		opts.HeartbeatInterval = defaultHeartbeatInterval
+	}
+	if opts.HeartbeatTimeout == 0 {
+		opts.HeartbeatTimeout = 2 * opts.HeartbeatInterval
+	}
+	rpcCtx := &Context{
+		ContextOptions: opts,
+		// A measurement is kept for a few heartbeats, so that a connection
+		// which is briefly unhealthy doesn't forget its offset.
+		RemoteClocks: newRemoteClockMonitor(opts.Clock, 5*opts.HeartbeatInterval),
+	}
+	rpcCtx.mu.conns = make(map[string]*Connection)
+	return rpcCtx
+}
+
+// NewServer creates a gRPC server which serves the Heartbeat service of the
+// context. The caller registers the node's other services with it.
+func NewServer(rpcCtx *Context) *grpc.Server {
+	s := grpc.NewServer(grpc.ForceServerCodec(codec{}))
+	RegisterHeartbeatServer(s, &HeartbeatService{
+		clock:              rpcCtx.Clock,
+		remoteClockMonitor: rpcCtx.RemoteClocks,
+	})
+	return s
+}
+
+// SetLocalInternalServer sets the Internal server of the node, which serves
+// the calls that the node makes to itself. It must be called before the
+// context is used.
+func (rpcCtx *Context) SetLocalInternalServer(srv kvpb.InternalServer) {
+	rpcCtx.localInternalClient = internalClientAdapter{server: srv}
+}
+
+// GetLocalInternalClientForAddr returns the client of the local Internal
+// server if target is the address of the node, or nil otherwise. The client
+// calls the server directly, without marshalling the messages.
+func (rpcCtx *Context) GetLocalInternalClientForAddr(target string) kvpb.InternalClient {
+	if target == rpcCtx.AdvertiseAddr {
+		return rpcCtx.localInternalClient
+	}
+	return nil
+}
+
+// internalClientAdapter is an InternalClient which calls an InternalServer
+// of the same process. The server shares the request with the caller, which
+// must not modify it until the call returns.
+type internalClientAdapter struct {
+	server kvpb.InternalServer
+}
+
+// Batch implements the kvpb.InternalClient interface.
+func (a internalClientAdapter) Batch(
+	ctx context.Context, ba *kvpb.BatchRequest, _ ...grpc.CallOption,
+) (*kvpb.BatchResponse, error) {
+	return a.server.Batch(ctx, ba)
+}
+
+// RangeFeed implements the kvpb.InternalClient interface. The rangefeed is
+// served on a goroutine, which hands its events over to the client stream.
+func (a internalClientAdapter) RangeFeed(
+	ctx context.Context, args *kvpb.RangeFeedRequest, _ ...grpc.CallOption,
+) (kvpb.Internal_RangeFeedClient, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	pipe := &rangeFeedPipe{
+		ctx:    ctx,
+		cancel: cancel,
+		eventC: make(chan *kvpb.RangeFeedEvent),
+		errC:   make(chan error, 1),
+	}
+	go func() {
+		pipe.errC <- a.server.RangeFeed(args, rangeFeedServerAdapter{pipe})
+	}()
+	return rangeFeedClientAdapter{pipe}, nil
+}
+
+// rangeFeedPipe connects the client and server streams of a rangefeed served
+// in the process. The events are handed over without buffering, so that the
+// client receives all of them before the error returned by the server.
+type rangeFeedPipe struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	eventC chan *kvpb.RangeFeedEvent
+	errC   chan error
+}
+
+// rangeFeedClientAdapter is the client stream of a rangefeed served in the
+// process. Only the methods used by rangefeed clients are implemented.
+type rangeFeedClientAdapter struct {
+	*rangeFeedPipe
+}
+
+var _ kvpb.Internal_RangeFeedClient = rangeFeedClientAdapter{}
+
+// Recv implements the kvpb.Internal_RangeFeedClient interface. It returns
+// io.EOF once the server returned without error.
+func (a rangeFeedClientAdapter) Recv() (*kvpb.RangeFeedEvent, error) {
+	select {
+	case e := <-a.eventC:
+		return e, nil
+	case err := <-a.errC:
+		a.cancel()
+		if err == nil {
+			err = io.EOF
+		}
+		return nil, err
+	case <-a.ctx.Done():
+		return nil, a.ctx.Err()
+	}
+}
+
+// Context implements the grpc.ClientStream interface.
+func (a rangeFeedClientAdapter) Context() context.Context { return a.ctx }
+
+// Header implements the grpc.ClientStream interface.
+func (a rangeFeedClientAdapter) Header() (metadata.MD, error) { return nil, nil }
+
+// Trailer implements the grpc.ClientStream interface.
+func (a rangeFeedClientAdapter) Trailer() metadata.MD { return nil }
+
+// CloseSend implements the grpc.ClientStream interface.
+func (a rangeFeedClientAdapter) CloseSend() error { return nil }
+
+// SendMsg implements the grpc.ClientStream interface.
+func (a rangeFeedClientAdapter) SendMsg(interface{}) error {
+	return errors.New("unsupported SendMsg on a rangefeed client stream")
+}
+
+// RecvMsg implements the grpc.ClientStream interface.
+func (a rangeFeedClientAdapter) RecvMsg(m interface{}) error {
+	e, err := a.Recv()
+	if err != nil {
+		return err
+	}
+	*m.(*kvpb.RangeFeedEvent) = *e
+	return nil
+}
+
+// rangeFeedServerAdapter is the server stream of a rangefeed served in the
+// process.
+type rangeFeedServerAdapter struct {
+	*rangeFeedPipe
+}
+
+var _ kvpb.Internal_RangeFeedServer = rangeFeedServerAdapter{}
+
+// Send implements the kvpb.Internal_RangeFeedServer interface.
+func (a rangeFeedServerAdapter) Send(e *kvpb.RangeFeedEvent) error {
+	select {
+	case a.eventC <- e:
+		return nil
+	case <-a.ctx.Done():
+		return a.ctx.Err()
+	}
+}
+
+// Context implements the grpc.ServerStream interface.
+func (a rangeFeedServerAdapter) Context() context.Context { return a.ctx }
+
+// SetHeader implements the grpc.ServerStream interface.
+func (a rangeFeedServerAdapter) SetHeader(metadata.MD) error { return nil }
+
+// SendHeader implements the grpc.ServerStream interface.
+func (a rangeFeedServerAdapter) SendHeader(metadata.MD) error { return nil }
+
+// SetTrailer implements the grpc.ServerStream interface.
+func (a rangeFeedServerAdapter) SetTrailer(metadata.MD) {}
+
+// SendMsg implements the grpc.ServerStream interface.
+func (a rangeFeedServerAdapter) SendMsg(m interface{}) error {
+	return a.Send(m.(*kvpb.RangeFeedEvent))
+}
+
+// RecvMsg implements the grpc.ServerStream interface.
+func (a rangeFeedServerAdapter) RecvMsg(interface{}) error {
+	return errors.New("unsupported RecvMsg on a rangefeed server stream")
+}
+
+// Connection is a heartbeated connection to a node.
+type Connection struct {
+	target   string
+	grpcConn *grpc.ClientConn
+	// initialHeartbeatDone is closed once the first heartbeat of the
+	// connection has returned.
+	initialHeartbeatDone chan struct{}
+
+	mu struct {
+		sync.Mutex
+		// heartbeatErr is the error of the last heartbeat, or
+		// ErrNotHeartbeated before the first one returns.
+		heartbeatErr error
+	}
+}
+
+func newConnection(target string) *Connection {
+	c := &Connection{target: target, initialHeartbeatDone: make(chan struct{})}
+	c.mu.heartbeatErr = ErrNotHeartbeated
+	return c
+}
+
+// Connect waits for the first heartbeat of the connection and returns the
+// gRPC connection if the connection is healthy.
+func (c *Connection) Connect(ctx context.Context) (*grpc.ClientConn, error) {
+	select {
+	case <-c.initialHeartbeatDone:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if err := c.Health(); err != nil {
+		return nil, err
+	}
+	return c.grpcConn, nil
+}
+
+// Health returns nil if the last heartbeat of the connection succeeded, and
+// its error otherwise.
+func (c *Connection) Health() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.mu.heartbeatErr
+}
+
+func (c *Connection) setHeartbeatErr(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.mu.heartbeatErr = err
+}
+
+// GRPCDialNode returns the connection to the node at target, dialing it if
+// there is none. A new connection is heartbeated until the context is
+// stopped or a heartbeat fails, in which case it is closed and the next
+// call dials a new one.
+func (rpcCtx *Context) GRPCDialNode(target string) *Connection {
+	rpcCtx.mu.Lock()
+	defer rpcCtx.mu.Unlock()
+	if conn, ok := rpcCtx.mu.conns[target]; ok {
+		return conn
+	}
+	conn := newConnection(target)
+	grpcConn, err := grpc.Dial(target,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(codec{})),
+	)
+	if err != nil {
+		conn.setHeartbeatErr(err)
+		close(conn.initialHeartbeatDone)
+		return conn
+	}
+	conn.grpcConn = grpcConn
+	ctx, cancel := rpcCtx.Stopper.WithCancelOnQuiesce(context.Background())
+	if err := rpcCtx.Stopper.RunAsyncTask(ctx, "rpc heartbeat", func(ctx context.Context) {
+		defer cancel()
+		rpcCtx.runHeartbeat(ctx, conn)
+	}); err != nil {
+		cancel()
+		_ = grpcConn.Close()
+		conn.setHeartbeatErr(err)
+		close(conn.initialHeartbeatDone)
+		return conn
+	}
+	rpcCtx.mu.conns[target] = conn
+	return conn
+}
+
+// runHeartbeat heartbeats the connection until ctx is canceled or a
+// heartbeat fails. Each heartbeat measures the offset of the remote clock,
+// after which the local clock is verified to be in sync with the cluster.
+func (rpcCtx *Context) runHeartbeat(ctx context.Context, conn *Connection) {
+	initialHeartbeatDone := false
+	setInitialHeartbeatDone := func() {
+		if !initialHeartbeatDone {
+			close(conn.initialHeartbeatDone)
+			initialHeartbeatDone = true
+		}
+	}
+	defer func() {
+		rpcCtx.mu.Lock()
+		if rpcCtx.mu.conns[conn.target] == conn {
+			delete(rpcCtx.mu.conns, conn.target)
+		}
+		rpcCtx.mu.Unlock()
+		_ = conn.grpcConn.Close()
+		setInitialHeartbeatDone()
+	}()
+
+	client := NewHeartbeatClient(conn.grpcConn)
+	maxOffset := rpcCtx.Clock.MaxOffset()
+	var offset RemoteOffset
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			conn.setHeartbeatErr(stop.ErrUnavailable)
+			return
+		}
+		timer.Reset(rpcCtx.HeartbeatInterval)
+
+		request := &PingRequest{
+			Offset:         offset,
+			OriginAddr:     rpcCtx.AdvertiseAddr,
+			MaxOffsetNanos: maxOffset.Nanoseconds(),
+		}
+		sendTime := rpcCtx.Clock.PhysicalNow()
+		pingCtx, cancel := context.WithTimeout(ctx, rpcCtx.HeartbeatTimeout)
+		response, err := client.Ping(pingCtx, request)
+		cancel()
+		if err != nil {
+			conn.setHeartbeatErr(err)
+			return
+		}
+		receiveTime := rpcCtx.Clock.PhysicalNow()
+
+		// The remote clock read its time about halfway through the
+		// heartbeat, which bounds the uncertainty of the measurement.
+		pingDuration := receiveTime - sendTime
+		if maxOffset != 0 && time.Duration(pingDuration) > maximumPingDurationMult*maxOffset {
+			offset = RemoteOffset{}
+		} else {
+			offset = RemoteOffset{
+				Offset:      response.ServerTime + pingDuration/2 - receiveTime,
+				Uncertainty: pingDuration / 2,
+				MeasuredAt:  receiveTime,
+			}
+		}
+		rpcCtx.RemoteClocks.UpdateOffset(ctx, conn.target, offset)
+		if err := rpcCtx.RemoteClocks.VerifyClockOffset(ctx); err != nil && rpcCtx.OnClockOffsetViolation != nil {
+			rpcCtx.OnClockOffsetViolation(ctx, err)
+		}
+		conn.setHeartbeatErr(nil)
+		setInitialHeartbeatDone()
+	}
+}
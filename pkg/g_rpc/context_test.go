@@ -0,0 +1,237 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/stop"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestContext creates an RPC context with a fast heartbeat, whose stopper
+// is stopped when the test ends.
+func newTestContext(t *testing.T, clock *hlc.Clock, addr string) *Context {
+	stopper := stop.NewStopper()
+	t.Cleanup(func() { stopper.Stop(context.Background()) })
+	return NewContext(ContextOptions{
+		Clock:             clock,
+		Stopper:           stopper,
+		AdvertiseAddr:     addr,
+		HeartbeatInterval: 10 * time.Millisecond,
+	})
+}
+
+// startTestServer serves the RPCs of the context on an unused port, which
+// becomes the context's address, along with the Internal service of srv if
+// it is set.
+func startTestServer(t *testing.T, rpcCtx *Context, srv kvpb.InternalServer) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := NewServer(rpcCtx)
+	if srv != nil {
+		kvpb.RegisterInternalServer(s, srv)
+	}
+	go func() { _ = s.Serve(ln) }()
+	t.Cleanup(s.Stop)
+	rpcCtx.AdvertiseAddr = ln.Addr().String()
+	return rpcCtx.AdvertiseAddr
+}
+
+// TestHeartbeatClockOffset verifies that the heartbeats measure the offset
+// of the remote clock, on both ends of the connection, and that the node is
+// notified once its clock is out of sync with the cluster.
+func TestHeartbeatClockOffset(t *testing.T) {
+	ctx := context.Background()
+	const maxOffset = 500 * time.Millisecond
+	localClock := hlc.NewManualClock(time.Hour.Nanoseconds())
+	remoteClock := hlc.NewManualClock((time.Hour + 100*time.Millisecond).Nanoseconds())
+
+	local := newTestContext(t, hlc.NewClock(localClock.UnixNano, maxOffset), "local")
+	violations := make(chan error, 1)
+	local.OnClockOffsetViolation = func(_ context.Context, err error) {
+		select {
+		case violations <- err:
+		default:
+		}
+	}
+	remote := newTestContext(t, hlc.NewClock(remoteClock.UnixNano, maxOffset), "")
+	remoteAddr := startTestServer(t, remote, nil)
+
+	conn := local.GRPCDialNode(remoteAddr)
+	_, err := conn.Connect(ctx)
+	require.NoError(t, err)
+	require.NoError(t, conn.Health())
+	require.Same(t, conn, local.GRPCDialNode(remoteAddr))
+	// The physical clocks stand still during the heartbeat, so the offset is
+	// measured exactly.
+	require.Equal(t, RemoteOffset{Offset: (100 * time.Millisecond).Nanoseconds(), MeasuredAt: localClock.UnixNano()},
+		local.RemoteClocks.AllOffsets()[remoteAddr])
+	// The remote node learns of the offset from the next heartbeat.
+	require.Eventually(t, func() bool {
+		return remote.RemoteClocks.AllOffsets()["local"].Offset == (-100 * time.Millisecond).Nanoseconds()
+	}, 10*time.Second, time.Millisecond)
+	select {
+	case err := <-violations:
+		t.Fatalf("unexpected clock offset violation: %v", err)
+	default:
+	}
+
+	// Once the remote clock jumps ahead, the local clock is out of sync with
+	// the cluster, made of the two clocks.
+	remoteClock.Increment(time.Second.Nanoseconds())
+	select {
+	case err := <-violations:
+		require.ErrorContains(t, err, "clock synchronization error")
+	case <-time.After(10 * time.Second):
+		t.Fatal("clock offset violation not detected")
+	}
+}
+
+// TestHeartbeatMaxOffsetMismatch verifies that nodes with different maximum
+// clock offsets can't connect to each other.
+func TestHeartbeatMaxOffsetMismatch(t *testing.T) {
+	ctx := context.Background()
+	local := newTestContext(t, hlc.NewClock(hlc.UnixNano, 500*time.Millisecond), "local")
+	remote := newTestContext(t, hlc.NewClock(hlc.UnixNano, 250*time.Millisecond), "")
+	remoteAddr := startTestServer(t, remote, nil)
+
+	_, err := local.GRPCDialNode(remoteAddr).Connect(ctx)
+	require.ErrorContains(t, err, "all nodes must use the same max offset")
+}
+
+// testInternalServer serves Gets of any key with the value "v", and fails
+// the batches addressed to other ranges than r1.
+type testInternalServer struct {
+	lastBatch atomic.Pointer[kvpb.BatchRequest]
+}
+
+func (s *testInternalServer) Batch(
+	ctx context.Context, ba *kvpb.BatchRequest,
+) (*kvpb.BatchResponse, error) {
+	s.lastBatch.Store(ba)
+	br := &kvpb.BatchResponse{}
+	if ba.RangeID != 1 {
+		br.Error = kvpb.NewError(kvpb.NewRangeNotFoundError(ba.RangeID, 1))
+		return br, nil
+	}
+	value := roachpb.MakeValueFromString("v")
+	br.Add(&kvpb.GetResponse{Value: &value})
+	return br, nil
+}
+
+// RangeFeed sends a single checkpoint of the requested span at the start
+// timestamp of the rangefeed, followed by the error of ranges other than r1.
+func (s *testInternalServer) RangeFeed(
+	args *kvpb.RangeFeedRequest, stream kvpb.Internal_RangeFeedServer,
+) error {
+	if err := stream.Send(&kvpb.RangeFeedEvent{Checkpoint: &kvpb.RangeFeedCheckpoint{
+		Span: args.Span, ResolvedTS: args.Timestamp,
+	}}); err != nil {
+		return err
+	}
+	if args.RangeID != 1 {
+		return stream.Send(&kvpb.RangeFeedEvent{Error: &kvpb.RangeFeedError{
+			Error: *kvpb.NewError(kvpb.NewRangeNotFoundError(args.RangeID, 1)),
+		}})
+	}
+	return nil
+}
+
+// TestInternalBatch verifies that batches are sent to the Internal service
+// of remote nodes through gRPC, and to the one of the local node directly.
+func TestInternalBatch(t *testing.T) {
+	ctx := context.Background()
+	clock := hlc.NewClock(hlc.UnixNano, 500*time.Millisecond)
+	local := newTestContext(t, clock, "")
+	localSrv := &testInternalServer{}
+	localAddr := startTestServer(t, local, localSrv)
+	local.SetLocalInternalServer(localSrv)
+	remote := newTestContext(t, clock, "")
+	remoteSrv := &testInternalServer{}
+	remoteAddr := startTestServer(t, remote, remoteSrv)
+	require.Nil(t, local.GetLocalInternalClientForAddr(remoteAddr))
+
+	newBatch := func(rangeID roachpb.RangeID) *kvpb.BatchRequest {
+		ba := &kvpb.BatchRequest{}
+		ba.RangeID = rangeID
+		ba.Add(&kvpb.GetRequest{RequestHeader: kvpb.RequestHeader{Key: roachpb.Key("a")}})
+		return ba
+	}
+	conn, err := local.GRPCDialNode(remoteAddr).Connect(ctx)
+	require.NoError(t, err)
+	for _, tc := range []struct {
+		client kvpb.InternalClient
+		srv    *testInternalServer
+		// local is set if the server is handed the batch itself, rather
+		// than a copy of it.
+		local bool
+	}{
+		{kvpb.NewInternalClient(conn), remoteSrv, false},
+		{local.GetLocalInternalClientForAddr(localAddr), localSrv, true},
+	} {
+		ba := newBatch(1)
+		br, err := tc.client.Batch(ctx, ba)
+		require.NoError(t, err)
+		require.Nil(t, br.Error)
+		b, err := br.Responses[0].GetInner().(*kvpb.GetResponse).Value.GetBytes()
+		require.NoError(t, err)
+		require.Equal(t, "v", string(b))
+		require.Equal(t, ba, tc.srv.lastBatch.Load())
+		require.Equal(t, tc.local, ba == tc.srv.lastBatch.Load())
+
+		br, err = tc.client.Batch(ctx, newBatch(2))
+		require.NoError(t, err)
+		var rnf *kvpb.RangeNotFoundError
+		require.True(t, errors.As(br.Error.GoError(), &rnf))
+		require.Equal(t, kvpb.NewRangeNotFoundError(2, 1), rnf)
+	}
+}
+
+// TestInternalRangeFeed verifies that the events of rangefeeds are streamed
+// from the Internal service of remote nodes through gRPC, and from the one of
+// the local node directly.
+func TestInternalRangeFeed(t *testing.T) {
+	ctx := context.Background()
+	clock := hlc.NewClock(hlc.UnixNano, 500*time.Millisecond)
+	local := newTestContext(t, clock, "")
+	localSrv := &testInternalServer{}
+	localAddr := startTestServer(t, local, localSrv)
+	local.SetLocalInternalServer(localSrv)
+	remote := newTestContext(t, clock, "")
+	remoteAddr := startTestServer(t, remote, &testInternalServer{})
+
+	conn, err := local.GRPCDialNode(remoteAddr).Connect(ctx)
+	require.NoError(t, err)
+	span := roachpb.Span{Key: roachpb.Key("a"), EndKey: roachpb.Key("b")}
+	ts := hlc.Timestamp{WallTime: 10}
+	for _, client := range []kvpb.InternalClient{
+		kvpb.NewInternalClient(conn),
+		local.GetLocalInternalClientForAddr(localAddr),
+	} {
+		for _, rangeID := range []roachpb.RangeID{1, 2} {
+			args := &kvpb.RangeFeedRequest{Span: span}
+			args.RangeID = rangeID
+			args.Timestamp = ts
+			stream, err := client.RangeFeed(ctx, args)
+			require.NoError(t, err)
+			event, err := stream.Recv()
+			require.NoError(t, err)
+			require.Equal(t, &kvpb.RangeFeedCheckpoint{Span: span, ResolvedTS: ts}, event.Checkpoint)
+			if rangeID != 1 {
+				event, err = stream.Recv()
+				require.NoError(t, err)
+				var rnf *kvpb.RangeNotFoundError
+				require.True(t, errors.As(event.Error.Error.GoError(), &rnf))
+			}
+			_, err = stream.Recv()
+			require.Equal(t, io.EOF, err)
+		}
+	}
+}
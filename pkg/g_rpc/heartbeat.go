@@ -0,0 +1,127 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"google.golang.org/grpc"
+	"time"
+)
+
+// PingRequest is the request of a heartbeat.
+type PingRequest struct {
+	// Ping is echoed in the response.
+	Ping string
+	// Offset is the offset of the clock of the pinged node, as measured by
+	// the previous heartbeat of the pinger.
+	Offset RemoteOffset
+	// OriginAddr is the address of the pinger.
+	OriginAddr string
+	// MaxOffsetNanos is the maximum clock offset of the pinger, which must
+	// be the same on all the nodes of the cluster.
+	MaxOffsetNanos int64
+}
+
+// PingResponse is the response to a heartbeat.
+type PingResponse struct {
+	// Pong is the Ping of the request.
+	Pong string
+	// ServerTime is the physical time of the pinged node when it served the
+	// heartbeat, from which the pinger measures the offset of its clock.
+	ServerTime int64
+}
+
+// HeartbeatClient is the client API of the Heartbeat service.
+type HeartbeatClient interface {
+	Ping(ctx context.Context, in *PingRequest, opts ...grpc.CallOption) (*PingResponse, error)
+}
+
+// HeartbeatServer is the server API of the Heartbeat service.
+type HeartbeatServer interface {
+	Ping(context.Context, *PingRequest) (*PingResponse, error)
+}
+
+// HeartbeatService is the Heartbeat service of a node, which the remote
+// nodes ping to check the health of their connections and to measure the
+// offset of their clocks.
+type HeartbeatService struct {
+	clock              *hlc.Clock
+	remoteClockMonitor *RemoteClockMonitor
+}
+
+var _ HeartbeatServer = (*HeartbeatService)(nil)
+
+// Ping echoes the request along with the physical time of the node. The
+// pinger's measurement of the offset of the node's clock is recorded as the
+// opposite offset of the pinger's clock. Pingers whose maximum clock offset
+// differs from the node's are rejected.
+func (hs *HeartbeatService) Ping(ctx context.Context, args *PingRequest) (*PingResponse, error) {
+	if mo, amo := hs.clock.MaxOffset(), time.Duration(args.MaxOffsetNanos); mo != 0 && amo != 0 && mo != amo {
+		return nil, fmt.Errorf("remote node %s has max offset %s, local node has %s; "+
+			"all nodes must use the same max offset", args.OriginAddr, amo, mo)
+	}
+	if args.OriginAddr != "" && args.Offset != (RemoteOffset{}) {
+		offset := args.Offset
+		offset.Offset = -offset.Offset
+		hs.remoteClockMonitor.UpdateOffset(ctx, args.OriginAddr, offset)
+	}
+	return &PingResponse{Pong: args.Ping, ServerTime: hs.clock.PhysicalNow()}, nil
+}
+
+// The remainder of this file holds the gRPC bindings of the Heartbeat
+// service, which would be generated from its protobuf definition.
+
+// heartbeatPingMethod is the full name of the Heartbeat.Ping method.
+const heartbeatPingMethod = "/cockroach.rpc.Heartbeat/Ping"
+
+type heartbeatClient struct {
+	cc grpc.ClientConnInterface
+}
+
+// NewHeartbeatClient returns a HeartbeatClient which sends its calls over cc.
+func NewHeartbeatClient(cc grpc.ClientConnInterface) HeartbeatClient {
+	return &heartbeatClient{cc: cc}
+}
+
+// Ping implements the HeartbeatClient interface.
+func (c *heartbeatClient) Ping(
+	ctx context.Context, in *PingRequest, opts ...grpc.CallOption,
+) (*PingResponse, error) {
+	out := new(PingResponse)
+	if err := c.cc.Invoke(ctx, heartbeatPingMethod, in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// RegisterHeartbeatServer registers the Heartbeat service of srv with s.
+func RegisterHeartbeatServer(s grpc.ServiceRegistrar, srv HeartbeatServer) {
+	s.RegisterService(&heartbeatServiceDesc, srv)
+}
+
+func heartbeatPingHandler(
+	srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor,
+) (interface{}, error) {
+	in := new(PingRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(HeartbeatServer).Ping(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: heartbeatPingMethod}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(HeartbeatServer).Ping(ctx, req.(*PingRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var heartbeatServiceDesc = grpc.ServiceDesc{
+	ServiceName: "cockroach.rpc.Heartbeat",
+	HandlerType: (*HeartbeatServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "Ping", Handler: heartbeatPingHandler},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "rpc/heartbeat.proto",
+}
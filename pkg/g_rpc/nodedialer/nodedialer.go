@@ -0,0 +1,66 @@
+package nodedialer
+
+import (
+	"context"
+	"fmt"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	rpc "github.com/dborchard/tiny_crdb/pkg/g_rpc"
+	"google.golang.org/grpc"
+)
+
+// An AddressResolver translates NodeIDs into addresses.
+type AddressResolver func(roachpb.NodeID) (string, error)
+
+// A Dialer wraps an *rpc.Context for dialing based on node IDs. For each
+// node, it maps a nodeID to an address and uses the rpc.Context to dial
+// that address.
+type Dialer struct {
+	rpcContext *rpc.Context
+	resolver   AddressResolver
+}
+
+// New initializes a Dialer.
+func New(rpcContext *rpc.Context, resolver AddressResolver) *Dialer {
+	return &Dialer{rpcContext: rpcContext, resolver: resolver}
+}
+
+// Dial returns a gRPC connection to the given node. It waits for the first
+// heartbeat of the connection.
+func (n *Dialer) Dial(ctx context.Context, nodeID roachpb.NodeID) (*grpc.ClientConn, error) {
+	addr, err := n.resolve(nodeID)
+	if err != nil {
+		return nil, err
+	}
+	return n.rpcContext.GRPCDialNode(addr).Connect(ctx)
+}
+
+// DialInternalClient returns a kvpb.InternalClient for the given node. The
+// calls to the local node are served in-process, without gRPC.
+func (n *Dialer) DialInternalClient(
+	ctx context.Context, nodeID roachpb.NodeID,
+) (kvpb.InternalClient, error) {
+	addr, err := n.resolve(nodeID)
+	if err != nil {
+		return nil, err
+	}
+	if localClient := n.rpcContext.GetLocalInternalClientForAddr(addr); localClient != nil {
+		return localClient, nil
+	}
+	conn, err := n.rpcContext.GRPCDialNode(addr).Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return kvpb.NewInternalClient(conn), nil
+}
+
+func (n *Dialer) resolve(nodeID roachpb.NodeID) (string, error) {
+	if nodeID == 0 {
+		return "", fmt.Errorf("invalid node ID %d", nodeID)
+	}
+	addr, err := n.resolver(nodeID)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve n%d: %w", nodeID, err)
+	}
+	return addr, nil
+}
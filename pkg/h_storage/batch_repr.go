@@ -0,0 +1,139 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+)
+
+// batchReprVersion is the first byte of a batch representation.
+const batchReprVersion byte = 1
+
+// The kinds of the entries of batch representations and SSTables.
+const (
+	reprKindSet byte = iota
+	reprKindDelete
+	// reprKindRangeDelete deletes the keys from the entry's key to its value,
+	// exclusive. It only appears in SSTables.
+	reprKindRangeDelete
+)
+
+// Repr implements the WriteBatch interface. The representation is a version
+// byte followed by the operations of the batch, in the order in which they
+// were written. Each operation is encoded as its kind, its key and
+// timestamp, and its value.
+func (b *pebbleBatch) Repr() []byte {
+	repr := []byte{batchReprVersion}
+	for _, op := range b.ops {
+		kind := reprKindSet
+		if op.delete {
+			kind = reprKindDelete
+		}
+		repr = appendReprEntry(repr, kind, op.key, op.value)
+	}
+	return repr
+}
+
+// ApplyBatchRepr implements the Batch interface.
+func (b *pebbleBatch) ApplyBatchRepr(repr []byte, sync bool) error {
+	if b.closed {
+		return errors.New("attempted to apply to a closed batch")
+	}
+	ops, err := decodeBatchRepr(repr)
+	if err != nil {
+		return err
+	}
+	for _, op := range ops {
+		b.add(op)
+	}
+	return nil
+}
+
+// ApplyBatchRepr implements the Engine interface.
+func (p *Pebble) ApplyBatchRepr(repr []byte, sync bool) error {
+	ops, err := decodeBatchRepr(repr)
+	if err != nil {
+		return err
+	}
+	return p.apply(ops)
+}
+
+// decodeBatchRepr decodes the operations of a batch representation.
+func decodeBatchRepr(repr []byte) ([]batchOp, error) {
+	if len(repr) == 0 || repr[0] != batchReprVersion {
+		return nil, errors.New("invalid batch representation")
+	}
+	repr = repr[1:]
+	var ops []batchOp
+	for len(repr) > 0 {
+		kind, key, value, rest, err := decodeReprEntry(repr)
+		if err != nil {
+			return nil, err
+		}
+		op := batchOp{key: key}
+		switch kind {
+		case reprKindSet:
+			op.value = value
+		case reprKindDelete:
+			op.delete = true
+		default:
+			return nil, fmt.Errorf("unexpected entry kind %d in batch representation", kind)
+		}
+		ops = append(ops, op)
+		repr = rest
+	}
+	return ops, nil
+}
+
+// appendReprEntry appends an entry of the kind, encoded as its kind, its key
+// and timestamp, and its value, to the representation.
+func appendReprEntry(repr []byte, kind byte, key MVCCKey, value []byte) []byte {
+	repr = append(repr, kind)
+	repr = binary.AppendUvarint(repr, uint64(len(key.Key)))
+	repr = append(repr, key.Key...)
+	repr = binary.AppendVarint(repr, key.Timestamp.WallTime)
+	repr = binary.AppendVarint(repr, int64(key.Timestamp.Logical))
+	repr = binary.AppendUvarint(repr, uint64(len(value)))
+	return append(repr, value...)
+}
+
+// decodeReprEntry decodes the entry at the start of the representation,
+// returning its kind, key and value, and the remainder of the
+// representation.
+func decodeReprEntry(repr []byte) (kind byte, key MVCCKey, value, rest []byte, err error) {
+	kind = repr[0]
+	rawKey, rest, err := decodeReprBytes(repr[1:])
+	if err != nil {
+		return 0, MVCCKey{}, nil, nil, err
+	}
+	wallTime, n := binary.Varint(rest)
+	if n <= 0 {
+		return 0, MVCCKey{}, nil, nil, errors.New("invalid timestamp in representation")
+	}
+	rest = rest[n:]
+	logical, n := binary.Varint(rest)
+	if n <= 0 {
+		return 0, MVCCKey{}, nil, nil, errors.New("invalid timestamp in representation")
+	}
+	rest = rest[n:]
+	if value, rest, err = decodeReprBytes(rest); err != nil {
+		return 0, MVCCKey{}, nil, nil, err
+	}
+	key = MVCCKey{
+		Key:       roachpb.Key(rawKey),
+		Timestamp: hlc.Timestamp{WallTime: wallTime, Logical: int32(logical)},
+	}
+	return kind, key, value, rest, nil
+}
+
+// decodeReprBytes decodes a length-prefixed byte slice, returning a copy of
+// it and the remainder of the representation.
+func decodeReprBytes(repr []byte) ([]byte, []byte, error) {
+	l, n := binary.Uvarint(repr)
+	if n <= 0 || uint64(len(repr)-n) < l {
+		return nil, nil, errors.New("truncated representation")
+	}
+	return append([]byte(nil), repr[n:n+int(l)]...), repr[n+int(l):], nil
+}
@@ -2,7 +2,10 @@ package storage
 
 import (
 	"context"
+	"fmt"
 	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/dborchard/tiny_crdb/pkg/h_storage/enginepb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
 )
 
 // Engine is the interface that wraps the core operations of a key/value store.
@@ -19,6 +22,25 @@ type Engine interface {
 	// this engine. Batched engines accumulate all mutations and apply
 	// them atomically on a call to Commit().
 	NewBatch() Batch
+	// ApplyBatchRepr atomically applies a set of batched updates, as
+	// returned by WriteBatch.Repr, to the engine. If sync is true, the
+	// updates are synchronously flushed to disk.
+	ApplyBatchRepr(repr []byte, sync bool) error
+	// NewSnapshot returns a new instance of a read-only snapshot engine.
+	// Snapshots are instantaneous and, as long as they're released relatively
+	// quickly, inexpensive. Snapshots are released by invoking Close(). Note
+	// that snapshots must not be used after the original engine has been
+	// stopped.
+	NewSnapshot() Reader
+	// IngestSSTs atomically ingests the SSTables written by SSTWriters into
+	// the engine. The SSTables are applied in order: the range deletions of
+	// an SSTable delete the keys of the engine and of the SSTables preceding
+	// it, after which the keys of the SSTable are added.
+	IngestSSTs(ctx context.Context, ssts [][]byte) error
+	// Attrs returns the engine/store attributes.
+	Attrs() roachpb.Attributes
+	// Capacity returns capacity details for the engine's available storage.
+	Capacity() (roachpb.StoreCapacity, error)
 }
 
 // Reader is the read interface to an engine's data. Certain implementations
@@ -91,11 +113,37 @@ type Writer interface {
 	//
 	// It is safe to modify the contents of the arguments after PutMVCC returns.
 	PutMVCC(key MVCCKey, value MVCCValue) error
+	// PutUnversioned sets the given key to the value provided. It is for use
+	// with inline metadata (not intents) and other unversioned keys (like
+	// Range-ID local keys). It does not affect the lock table.
+	//
+	// Intents are interleaved with the versions of their key in this engine:
+	// the MVCCMetadata of an intent is written with PutUnversioned at the
+	// key's meta (zero timestamp) position.
+	//
+	// It is safe to modify the contents of the arguments after Put returns.
+	PutUnversioned(key roachpb.Key, value []byte) error
+	// ClearMVCC removes the point key with the given MVCCKey from the db. It
+	// does not affect range keys. It requires that the timestamp is non-empty
+	// (see ClearUnversioned or ClearIntent if the timestamp is empty).
+	//
+	// It is safe to modify the contents of the arguments after it returns.
+	ClearMVCC(key MVCCKey) error
+	// ClearUnversioned removes an unversioned item from the db. It is for use
+	// with inline metadata (not intents) and other unversioned keys (like
+	// Range-ID local keys).
+	//
+	// It is safe to modify the contents of the arguments after it returns.
+	ClearUnversioned(key roachpb.Key) error
 	// BufferedSize returns the size of the underlying buffered writes if the
 	// Writer implementation is buffered, and 0 if the Writer implementation is
 	// not buffered. Buffered writers are expected to always give a monotonically
 	// increasing size.
 	BufferedSize() int
+	// LogLogicalOp logs the specified logical mvcc operation with the provided
+	// details to the writer, if it has logical op logging enabled. For most
+	// Writer implementations, this is a no-op.
+	LogLogicalOp(op MVCCLogicalOpType, details MVCCLogicalOpDetails)
 }
 
 // MVCCIterKind is used to inform Reader about the kind of iteration desired
@@ -189,6 +237,9 @@ const (
 type Batch interface {
 	Reader
 	WriteBatch
+	// ApplyBatchRepr applies the updates of the batch representation to this
+	// batch. Reads through the batch observe them.
+	ApplyBatchRepr(repr []byte, sync bool) error
 	// NewBatchOnlyMVCCIterator returns a new instance of MVCCIterator that only
 	// sees the mutations in the batch (not the engine). It does not interleave
 	// intents, i.e., it is of kind MVCCKeyIterKind.
@@ -221,9 +272,115 @@ type WriteBatch interface {
 	Empty() bool
 	// Count returns the number of memtable-modifying operations in the batch.
 	Count() uint32
+	// Repr returns the underlying representation of the batch, which can be
+	// applied to another engine or batch with ApplyBatchRepr. This is how the
+	// writes of a command are replicated through Raft.
+	Repr() []byte
 	// Len returns the size of the underlying representation of the batch.
 	// Because of the batch header, the size of the batch is never 0 and should
 	// not be used interchangeably with Empty. The method avoids the memory copy
 	// that Repr imposes, but it still may require flushing the batch's mutations.
 	Len() int
 }
+
+// MVCCLogicalOpType is an enum with values corresponding to each of the
+// enginepb.MVCCLogicalOp types.
+//
+// LogLogicalOp is called with an MVCCLogicalOpType and a corresponding
+// MVCCLogicalOpDetails instead of an enginepb.MVCCLogicalOp variant for two
+// reasons. First, it serves as a form of abstraction so that callers of the
+// method don't need to construct protos themselves. More importantly, it
+// also avoids allocations in the common case where Writer.LogLogicalOp is a
+// no-op. This makes LogLogicalOp essentially free for cases where logical op
+// logging is disabled.
+type MVCCLogicalOpType int
+
+const (
+	// MVCCWriteValueOpType corresponds to the MVCCWriteValueOp variant.
+	MVCCWriteValueOpType MVCCLogicalOpType = iota
+	// MVCCWriteIntentOpType corresponds to the MVCCWriteIntentOp variant.
+	MVCCWriteIntentOpType
+	// MVCCUpdateIntentOpType corresponds to the MVCCUpdateIntentOp variant.
+	MVCCUpdateIntentOpType
+	// MVCCCommitIntentOpType corresponds to the MVCCCommitIntentOp variant.
+	MVCCCommitIntentOpType
+	// MVCCAbortIntentOpType corresponds to the MVCCAbortIntentOp variant.
+	MVCCAbortIntentOpType
+)
+
+// MVCCLogicalOpDetails contains details about the occurrence of an MVCC
+// logical operation.
+type MVCCLogicalOpDetails struct {
+	Txn       enginepb.TxnMeta
+	Key       roachpb.Key
+	Timestamp hlc.Timestamp
+}
+
+// OpLoggerBatch records a log of logical MVCC operations.
+type OpLoggerBatch struct {
+	Batch
+	ops []enginepb.MVCCLogicalOp
+}
+
+// NewOpLoggerBatch creates a new batch that logs logical mvcc operations and
+// wraps the provided batch.
+func NewOpLoggerBatch(b Batch) *OpLoggerBatch {
+	return &OpLoggerBatch{Batch: b}
+}
+
+var _ Batch = &OpLoggerBatch{}
+
+// LogLogicalOp implements the Writer interface.
+func (ol *OpLoggerBatch) LogLogicalOp(op MVCCLogicalOpType, details MVCCLogicalOpDetails) {
+	ol.logLogicalOp(op, details)
+	ol.Batch.LogLogicalOp(op, details)
+}
+
+func (ol *OpLoggerBatch) logLogicalOp(op MVCCLogicalOpType, details MVCCLogicalOpDetails) {
+	key := append([]byte(nil), details.Key...)
+	var logOp enginepb.MVCCLogicalOp
+	switch op {
+	case MVCCWriteValueOpType:
+		logOp.MustSetValue(&enginepb.MVCCWriteValueOp{
+			Key:       key,
+			Timestamp: details.Timestamp,
+		})
+	case MVCCWriteIntentOpType:
+		logOp.MustSetValue(&enginepb.MVCCWriteIntentOp{
+			TxnID:           details.Txn.ID,
+			TxnKey:          append([]byte(nil), details.Txn.Key...),
+			TxnMinTimestamp: details.Txn.MinTimestamp,
+			Key:             key,
+			Timestamp:       details.Timestamp,
+		})
+	case MVCCUpdateIntentOpType:
+		logOp.MustSetValue(&enginepb.MVCCUpdateIntentOp{
+			TxnID:     details.Txn.ID,
+			Key:       key,
+			Timestamp: details.Timestamp,
+		})
+	case MVCCCommitIntentOpType:
+		logOp.MustSetValue(&enginepb.MVCCCommitIntentOp{
+			TxnID:     details.Txn.ID,
+			Key:       key,
+			Timestamp: details.Timestamp,
+		})
+	case MVCCAbortIntentOpType:
+		logOp.MustSetValue(&enginepb.MVCCAbortIntentOp{
+			TxnID: details.Txn.ID,
+			Key:   key,
+		})
+	default:
+		panic(fmt.Sprintf("unexpected op type %d", op))
+	}
+	ol.ops = append(ol.ops, logOp)
+}
+
+// LogicalOps returns the list of all logical MVCC operations that have been
+// recorded by the logger.
+func (ol *OpLoggerBatch) LogicalOps() []enginepb.MVCCLogicalOp {
+	if ol == nil {
+		return nil
+	}
+	return ol.ops
+}
@@ -0,0 +1,162 @@
+package enginepb
+
+import "github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+
+// MVCCMetadata holds MVCC metadata for a key. Used by storage/mvcc.go.
+// An MVCCMetadata is stored for a versioned key while there is an intent on
+// that key.
+type MVCCMetadata struct {
+	Txn *TxnMeta
+	// The timestamp of the most recent versioned value if this is a
+	// value that may have multiple versions. For values which may have
+	// only one version, the data is stored inline (via raw_bytes), and
+	// timestamp is set to zero.
+	Timestamp hlc.Timestamp
+	// Is the most recent value a deletion tombstone?
+	Deleted bool
+	// The size in bytes of the most recent encoded key.
+	KeyBytes int64
+	// The size in bytes of the most recent versioned value.
+	ValBytes int64
+	// Inline value, used for non-versioned values with zero
+	// timestamp. This provides an efficient short circuit of the normal
+	// MVCC metadata sentinel and subsequent version rows. If timestamp
+	// == (0, 0), then there is only a single MVCC metadata row with
+	// value inlined, and with empty timestamp, key_bytes, and
+	// val_bytes.
+	RawBytes []byte
+	// IntentHistory of the transaction stores the older values the txn wrote
+	// for the key along with each values corresponding Sequence. It doesn't
+	// contain the latest intent value but rather stores all the values that
+	// have been overwritten by the transaction.
+	IntentHistory []MVCCMetadata_SequencedIntent
+}
+
+// MVCCMetadata_SequencedIntent stores a value at a given key and the sequence
+// number it was written at - to be stored in an IntentHistory of a key during
+// a transaction.
+type MVCCMetadata_SequencedIntent struct {
+	// Sequence is a one-indexed number which is increased on each request
+	// set as part of a transaction. It uniquely identifies a value from
+	// the IntentHistory.
+	Sequence TxnSeq
+	// Value is the value written to the key as part of the transaction at
+	// the above Sequence. Value uses the roachpb.Value encoding.
+	Value []byte
+}
+
+// IsInline returns true if the value is inlined in the metadata.
+func (meta MVCCMetadata) IsInline() bool {
+	return meta.RawBytes != nil
+}
+
+// AddToIntentHistory adds the sequence and value to the intent history.
+func (meta *MVCCMetadata) AddToIntentHistory(seq TxnSeq, val []byte) {
+	meta.IntentHistory = append(meta.IntentHistory,
+		MVCCMetadata_SequencedIntent{Sequence: seq, Value: val})
+}
+
+// GetPrevIntentSeq goes through the intent history and finds the previous
+// intent's sequence number given the current sequence. The ignored seqnum
+// ranges are skipped over.
+func (meta *MVCCMetadata) GetPrevIntentSeq(
+	seq TxnSeq, ignored []IgnoredSeqNumRange,
+) (MVCCMetadata_SequencedIntent, bool) {
+	for i := len(meta.IntentHistory) - 1; i >= 0; i-- {
+		e := meta.IntentHistory[i]
+		if e.Sequence < seq && !TxnSeqIsIgnored(e.Sequence, ignored) {
+			return e, true
+		}
+	}
+	return MVCCMetadata_SequencedIntent{}, false
+}
+
+// GetIntentValue goes through the intent history and finds the value
+// written at the sequence number.
+func (meta *MVCCMetadata) GetIntentValue(seq TxnSeq) ([]byte, bool) {
+	for _, e := range meta.IntentHistory {
+		if e.Sequence == seq {
+			return e.Value, true
+		}
+	}
+	return nil, false
+}
+
+// MVCCStats tracks byte and instance counts for various groups of keys,
+// values, or key-value pairs; see the field comments for details.
+//
+// It also tracks the time at which the stats were last updated, which
+// allows replicas that apply the same commands to agree on them.
+type MVCCStats struct {
+	// LastUpdateNanos is a timestamp at which the stats were last updated.
+	LastUpdateNanos int64
+	// LiveBytes is the number of bytes stored in keys and values which can in
+	// principle be read by means of a Scan or Get in the future, including
+	// intents but not deletion tombstones (or their intents). Note that the
+	// size of the meta kv pair (which could be explicit or implicit) is
+	// included in this.
+	LiveBytes int64
+	// KeyBytes is the number of bytes stored in all non-system keys,
+	// including live, meta, old, and deleted keys. Only meta keys really
+	// account for the "full" key; value keys only for the timestamp suffix.
+	KeyBytes int64
+	// ValBytes is the number of bytes in all non-system version values,
+	// including meta values.
+	ValBytes int64
+	// IntentBytes is the number of bytes in intent key-value pairs (without
+	// their meta keys).
+	IntentBytes int64
+	// LiveCount is the number of meta keys tracked under LiveBytes.
+	LiveCount int64
+	// KeyCount is the number of meta keys tracked under KeyBytes.
+	KeyCount int64
+	// ValCount is the number of meta values tracked under ValBytes.
+	ValCount int64
+	// IntentCount is the number of keys tracked under IntentBytes.
+	IntentCount int64
+	// SysBytes is the number of bytes stored in system-local kv-pairs. This
+	// tracks the same quantity as (KeyBytes + ValBytes), but for system-local
+	// keys (which aren't counted in either KeyBytes or ValBytes).
+	SysBytes int64
+	// SysCount is the number of system-local kv-pairs.
+	SysCount int64
+}
+
+// Add adds values from oms to ms. LastUpdateNanos is moved forward to the
+// later of the two.
+func (ms *MVCCStats) Add(oms MVCCStats) {
+	if oms.LastUpdateNanos > ms.LastUpdateNanos {
+		ms.LastUpdateNanos = oms.LastUpdateNanos
+	}
+	ms.LiveBytes += oms.LiveBytes
+	ms.KeyBytes += oms.KeyBytes
+	ms.ValBytes += oms.ValBytes
+	ms.IntentBytes += oms.IntentBytes
+	ms.LiveCount += oms.LiveCount
+	ms.KeyCount += oms.KeyCount
+	ms.ValCount += oms.ValCount
+	ms.IntentCount += oms.IntentCount
+	ms.SysBytes += oms.SysBytes
+	ms.SysCount += oms.SysCount
+}
+
+// Subtract removes oms from ms. The LastUpdateNanos of ms is retained.
+func (ms *MVCCStats) Subtract(oms MVCCStats) {
+	ms.LiveBytes -= oms.LiveBytes
+	ms.KeyBytes -= oms.KeyBytes
+	ms.ValBytes -= oms.ValBytes
+	ms.IntentBytes -= oms.IntentBytes
+	ms.LiveCount -= oms.LiveCount
+	ms.KeyCount -= oms.KeyCount
+	ms.ValCount -= oms.ValCount
+	ms.IntentCount -= oms.IntentCount
+	ms.SysBytes -= oms.SysBytes
+	ms.SysCount -= oms.SysCount
+}
+
+// Total returns the range size as the sum of the key and value
+// bytes. This includes all non-live keys and all versioned values,
+// as well as the system-local keys.
+func (ms MVCCStats) Total() int64 {
+	return ms.KeyBytes + ms.ValBytes + ms.SysBytes
+}
@@ -0,0 +1,209 @@
+package enginepb
+
+import (
+	"fmt"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/concurrency/isolation"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/uuid"
+)
+
+// TxnEpoch is a zero-indexed epoch for a transaction. When a transaction
+// retries, it increments its epoch, invalidating all of its previous writes.
+type TxnEpoch int32
+
+// TxnSeq is a zero-indexed sequence number assigned to a request performed by a
+// transaction. Writes within a transaction have unique sequences and start at
+// sequence number 1. Reads within a transaction have non-unique sequences and
+// start at sequence number 0.
+//
+// Writes within a transaction logically take place in sequence number order.
+// Reads within a transaction observe only writes performed by the transaction
+// at equal or lower sequence numbers.
+type TxnSeq int32
+
+// TxnPriority defines the priority that a transaction operates at. Transactions
+// with high priorities are preferred over those with lower priorities when
+// resolving conflicts between themselves.
+type TxnPriority int32
+
+const (
+	// MinTxnPriority is the minimum allowed txn priority.
+	MinTxnPriority TxnPriority = 0
+	// MaxTxnPriority is the maximum allowed txn priority.
+	MaxTxnPriority TxnPriority = 1<<31 - 1
+)
+
+// TxnMeta is the metadata of a Transaction record.
+type TxnMeta struct {
+	// id is a unique UUID value which identifies the transaction.
+	ID uuid.UUID
+	// key is the key which anchors the transaction. This is typically
+	// the first key read or written during the transaction and
+	// determines which range in the cluster will hold the transaction
+	// record.
+	Key []byte
+	// IsoLevel is the isolation level of the transaction.
+	IsoLevel isolation.Level
+	// Incremented on txn retry.
+	Epoch TxnEpoch
+	// The proposed timestamp for the transaction. This starts as the current
+	// wall time on the txn coordinator, and is forwarded by the timestamp cache
+	// if the txn attempts to write "beneath" another txn's writes.
+	//
+	// Writes within the txn are performed using the most up-to-date value of
+	// this timestamp that is available. For example, suppose a txn starts at
+	// some timestamp, writes a key/value, and has its timestamp forwarded while
+	// doing so because a later version already exists at that key. As soon as
+	// the txn coordinator learns of the updated timestamp, it will begin
+	// performing writes at the updated timestamp.
+	WriteTimestamp hlc.Timestamp
+	// The timestamp that the transaction was assigned by its gateway when it
+	// began its first epoch. This is the earliest timestamp that the
+	// transaction could have written any of its intents at.
+	MinTimestamp hlc.Timestamp
+	// The transaction's priority, ratcheted on transaction pushes.
+	Priority TxnPriority
+	// A zero-indexed sequence number which is increased on each request
+	// sent as part of the transaction. When set in the header of a batch of
+	// requests, the value will correspond to the sequence number of the
+	// last request. Used to provide idempotency and to protect against
+	// out-of-order application (by means of a transaction retry).
+	Sequence TxnSeq
+}
+
+// IgnoredSeqNumRange describes a range of ignored seqnums.
+// The range is inclusive on both ends.
+type IgnoredSeqNumRange struct {
+	Start TxnSeq
+	End   TxnSeq
+}
+
+// TxnSeqIsIgnored returns true iff the sequence number overlaps with
+// any range in the ignored array. The caller should ensure that the
+// ignored array is non-overlapping, non-contiguous, and sorted in
+// (increasing) seqnum order.
+func TxnSeqIsIgnored(seq TxnSeq, ignored []IgnoredSeqNumRange) bool {
+	for _, r := range ignored {
+		if seq < r.Start {
+			// The ranges are sorted, so the remaining ranges cannot contain
+			// the sequence number either.
+			return false
+		}
+		if seq <= r.End {
+			return true
+		}
+	}
+	return false
+}
+
+// Short returns a prefix of the transaction's ID.
+func (t TxnMeta) Short() string {
+	return t.ID.Short()
+}
+
+// RangeAppliedState combines the Raft applied index and term of a range,
+// which identify the last log entry applied to its replicated state. It is
+// written atomically with the effects of every applied entry.
+type RangeAppliedState struct {
+	// RaftAppliedIndex is the index of the last applied entry.
+	RaftAppliedIndex uint64
+	// RaftAppliedIndexTerm is the term of the last applied entry.
+	RaftAppliedIndexTerm uint64
+}
+
+// MVCCWriteValueOp corresponds to a value being written outside of a
+// transaction.
+type MVCCWriteValueOp struct {
+	Key       []byte
+	Timestamp hlc.Timestamp
+	// Value is the value written to the key, and PrevValue the value that it
+	// replaced. Neither is replicated: they are read from the engine when
+	// the command applies, if a rangefeed needs them.
+	Value     []byte
+	PrevValue []byte
+}
+
+// MVCCWriteIntentOp corresponds to an intent being written for a given
+// transaction.
+type MVCCWriteIntentOp struct {
+	TxnID           uuid.UUID
+	TxnKey          []byte
+	TxnMinTimestamp hlc.Timestamp
+	Key             []byte
+	Timestamp       hlc.Timestamp
+}
+
+// MVCCUpdateIntentOp corresponds to an intent being updated at a larger
+// timestamp for a given transaction.
+type MVCCUpdateIntentOp struct {
+	TxnID     uuid.UUID
+	Key       []byte
+	Timestamp hlc.Timestamp
+}
+
+// MVCCCommitIntentOp corresponds to an intent being committed for a given
+// transaction.
+type MVCCCommitIntentOp struct {
+	TxnID     uuid.UUID
+	Key       []byte
+	Timestamp hlc.Timestamp
+	// Value and PrevValue are populated like those of MVCCWriteValueOp.
+	Value     []byte
+	PrevValue []byte
+}
+
+// MVCCAbortIntentOp corresponds to an intent being aborted for a given
+// transaction, or removed because every write of the transaction to its key
+// was rolled back.
+type MVCCAbortIntentOp struct {
+	TxnID uuid.UUID
+	Key   []byte
+}
+
+// MVCCLogicalOp is a union of all logical MVCC operation types. Exactly one
+// of its fields is set.
+type MVCCLogicalOp struct {
+	WriteValue   *MVCCWriteValueOp
+	WriteIntent  *MVCCWriteIntentOp
+	UpdateIntent *MVCCUpdateIntentOp
+	CommitIntent *MVCCCommitIntentOp
+	AbortIntent  *MVCCAbortIntentOp
+}
+
+// GetValue returns the operation held by the union.
+func (op *MVCCLogicalOp) GetValue() interface{} {
+	switch {
+	case op.WriteValue != nil:
+		return op.WriteValue
+	case op.WriteIntent != nil:
+		return op.WriteIntent
+	case op.UpdateIntent != nil:
+		return op.UpdateIntent
+	case op.CommitIntent != nil:
+		return op.CommitIntent
+	case op.AbortIntent != nil:
+		return op.AbortIntent
+	default:
+		return nil
+	}
+}
+
+// MustSetValue sets the operation held by the union. It panics if the
+// operation is not one of the logical MVCC operation types.
+func (op *MVCCLogicalOp) MustSetValue(value interface{}) {
+	*op = MVCCLogicalOp{}
+	switch v := value.(type) {
+	case *MVCCWriteValueOp:
+		op.WriteValue = v
+	case *MVCCWriteIntentOp:
+		op.WriteIntent = v
+	case *MVCCUpdateIntentOp:
+		op.UpdateIntent = v
+	case *MVCCCommitIntentOp:
+		op.CommitIntent = v
+	case *MVCCAbortIntentOp:
+		op.AbortIntent = v
+	default:
+		panic(fmt.Sprintf("%T excludes an MVCCLogicalOp", value))
+	}
+}
@@ -1,11 +1,23 @@
 package storage
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
+	keys "github.com/dborchard/tiny_crdb/pkg/g_keys"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/concurrency/lock"
 	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/dborchard/tiny_crdb/pkg/h_storage/enginepb"
 	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/protoutil"
 )
 
+// MVCCVersionTimestampSize is the size of the timestamp portion of MVCC
+// version keys (used to update stats).
+const MVCCVersionTimestampSize int64 = 12
+
 // MVCCKeyValue contains the raw bytes of the value for a key.
 type MVCCKeyValue struct {
 	Key MVCCKey
@@ -20,6 +32,67 @@ type ReadWriter interface {
 	Writer
 }
 
+var emptyKeyError = errors.New("attempted access to empty key")
+
+// MVCCWriteOptions bundles options for the MVCCPut and MVCCDelete families of
+// functions.
+type MVCCWriteOptions struct {
+	// Txn is the transaction performing the write. If nil, the write is
+	// non-transactional and is performed at the provided timestamp. Otherwise,
+	// the write is performed at the transaction's write timestamp and leaves
+	// an intent behind.
+	Txn *roachpb.Transaction
+}
+
+// MVCCGetOptions bundles options for the MVCCGet family of functions.
+type MVCCGetOptions struct {
+	// Inconsistent, if set, causes intents of other transactions to be
+	// returned alongside the read instead of producing a WriteIntentError.
+	// The committed value beneath such an intent is returned instead.
+	Inconsistent bool
+	// Txn is the transaction performing the read, if any. A transaction
+	// observes its own provisional writes at or below its current sequence
+	// number, except for those in its ignored seqnum ranges.
+	Txn *roachpb.Transaction
+	// KeyLockingStrength is the strength with which the read locks the key.
+	// A locking read conflicts with the intents of other transactions
+	// regardless of their timestamp, and fails with a WriteTooOldError if it
+	// finds a committed value above its timestamp. The lock itself is
+	// acquired by the caller, through the concurrency manager.
+	KeyLockingStrength lock.Strength
+	// SkipLocked, if set, causes the read to skip over keys that are locked
+	// by other transactions in a mode that conflicts with the read, instead
+	// of returning a WriteIntentError. Locks are found both in storage, as
+	// intents, and in the LockTable, which must be provided.
+	SkipLocked bool
+	// LockTable is a view into the in-memory lock table of the range, used
+	// by SkipLocked reads to find unreplicated locks.
+	LockTable LockTableView
+}
+
+// LockTableView is a transaction-bound view into an in-memory collection of
+// key-level locks. The set of keys locked-by-others in the view is
+// guaranteed to be a superset of the keys on which a read in the view would
+// block.
+type LockTableView interface {
+	// IsKeyLockedByConflictingTxn returns whether the specified key is locked
+	// by a conflicting transaction in the lockTableGuard's snapshot of the
+	// lock table, given the caller's own desired locking strength. If so, the
+	// lock holder is also returned. A transaction's own lock does not appear
+	// to be locked to itself.
+	IsKeyLockedByConflictingTxn(roachpb.Key, lock.Strength) (bool, *enginepb.TxnMeta)
+}
+
+// MVCCGetResult bundles return values for the MVCCGet family of functions.
+type MVCCGetResult struct {
+	// The most recent value for the specified key whose timestamp is less than
+	// or equal to the supplied timestamp. If no such value exists, nil is
+	// returned instead.
+	Value *roachpb.Value
+	// In inconsistent mode, the intent if an intent is encountered.
+	Intent *roachpb.Intent
+}
+
 // MVCCPutProto sets the given key to the protobuf-serialized byte
 // string of msg and the provided timestamp.
 func MVCCPutProto(
@@ -27,10 +100,58 @@ func MVCCPutProto(
 	rw ReadWriter,
 	key roachpb.Key,
 	timestamp hlc.Timestamp,
+	msg protoutil.Message,
+	opts MVCCWriteOptions,
 ) error {
 	value := roachpb.Value{}
-	err := MVCCPut(ctx, rw, key, timestamp, value)
-	return err
+	if err := value.SetProto(msg); err != nil {
+		return err
+	}
+	return MVCCPut(ctx, rw, key, timestamp, value, opts)
+}
+
+// MVCCBlindPutProto sets the given key to the protobuf-serialized byte
+// string of msg as an inline value, without reading the existing value of
+// the key. It suits Writers which cannot be read from, such as SSTWriters,
+// and keys which are known not to hold versioned values.
+func MVCCBlindPutProto(
+	ctx context.Context, writer Writer, key roachpb.Key, msg protoutil.Message,
+) error {
+	if len(key) == 0 {
+		return emptyKeyError
+	}
+	value := roachpb.Value{}
+	if err := value.SetProto(msg); err != nil {
+		return err
+	}
+	data, err := protoutil.Marshal(&enginepb.MVCCMetadata{RawBytes: value.RawBytes})
+	if err != nil {
+		return err
+	}
+	return writer.PutUnversioned(key, data)
+}
+
+// MVCCGetProto fetches the value at the specified key and unmarshals it into
+// msg if msg is non-nil. Returns true on success or false if the key was not
+// found.
+func MVCCGetProto(
+	ctx context.Context,
+	reader Reader,
+	key roachpb.Key,
+	timestamp hlc.Timestamp,
+	msg protoutil.Message,
+	opts MVCCGetOptions,
+) (bool, error) {
+	valueRes, err := MVCCGet(ctx, reader, key, timestamp, opts)
+	if err != nil || valueRes.Value == nil {
+		return false, err
+	}
+	if msg != nil {
+		if err := valueRes.Value.GetProto(msg); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
 }
 
 // MVCCPut sets the value for a specified key. It will save the value
@@ -55,6 +176,798 @@ func MVCCPut(
 	key roachpb.Key,
 	timestamp hlc.Timestamp,
 	value roachpb.Value,
+	opts MVCCWriteOptions,
+) error {
+	if len(value.RawBytes) == 0 {
+		return errors.New("MVCCPut: empty value; use MVCCDelete to delete a key")
+	}
+	return mvccPutInternal(ctx, rw, key, timestamp, value.RawBytes, opts)
+}
+
+// MVCCDelete marks the key deleted so that it will not be returned in
+// future get responses.
+//
+// foundKey indicates whether the key that was passed in had a value already in
+// the database.
+func MVCCDelete(
+	ctx context.Context,
+	rw ReadWriter,
+	key roachpb.Key,
+	timestamp hlc.Timestamp,
+	opts MVCCWriteOptions,
+) (foundKey bool, err error) {
+	res, err := MVCCGet(ctx, rw, key, readTimestampForWrite(timestamp, opts), MVCCGetOptions{Txn: opts.Txn})
+	if err != nil {
+		return false, err
+	}
+	foundKey = res.Value != nil
+	return foundKey, mvccPutInternal(ctx, rw, key, timestamp, nil /* tombstone */, opts)
+}
+
+func readTimestampForWrite(timestamp hlc.Timestamp, opts MVCCWriteOptions) hlc.Timestamp {
+	if opts.Txn != nil {
+		return opts.Txn.ReadTimestamp
+	}
+	if timestamp.IsEmpty() {
+		return hlc.MaxTimestamp
+	}
+	return timestamp
+}
+
+// mvccGetMetadata returns the metadata of the given key. For keys with an
+// intent or an inline value this is the stored MVCCMetadata; otherwise a
+// metadata record is synthesized from the most recent version of the key.
+// Returns ok=false if the key has no metadata and no versions.
+func mvccGetMetadata(
+	ctx context.Context, reader Reader, key roachpb.Key,
+) (meta enginepb.MVCCMetadata, ok bool, err error) {
+	iter, err := reader.NewMVCCIterator(ctx, MVCCKeyAndIntentsIterKind, IterOptions{Prefix: true})
+	if err != nil {
+		return meta, false, err
+	}
+	defer iter.Close()
+	iter.SeekGE(MakeMVCCMetadataKey(key))
+	if valid, err := iter.Valid(); err != nil || !valid {
+		return meta, false, err
+	}
+	unsafeKey := iter.UnsafeKey()
+	if !unsafeKey.IsValue() {
+		v, err := iter.UnsafeValue()
+		if err != nil {
+			return meta, false, err
+		}
+		if err := protoutil.Unmarshal(v, &meta); err != nil {
+			return meta, false, err
+		}
+		return meta, true, nil
+	}
+	valLen, isTombstone, err := iter.MVCCValueLenAndIsTombstone()
+	if err != nil {
+		return meta, false, err
+	}
+	meta.Timestamp = unsafeKey.Timestamp
+	meta.Deleted = isTombstone
+	meta.KeyBytes = int64(len(unsafeKey.Key)) + 12
+	meta.ValBytes = int64(valLen)
+	return meta, true, nil
+}
+
+// MVCCGetIntentMeta returns the metadata of the intent at the given key, or
+// nil if the key has no intent.
+func MVCCGetIntentMeta(
+	ctx context.Context, reader Reader, key roachpb.Key,
+) (*enginepb.MVCCMetadata, error) {
+	meta, ok, err := mvccGetMetadata(ctx, reader, key)
+	if err != nil || !ok || meta.Txn == nil {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+// MVCCGetVersion returns the raw value of the version of key at exactly the
+// given timestamp, and whether such a version exists. Unlike MVCCGet, it
+// ignores intents and returns deletion tombstones as empty values.
+func MVCCGetVersion(
+	ctx context.Context, reader Reader, key roachpb.Key, ts hlc.Timestamp,
+) ([]byte, bool, error) {
+	return mvccGetVersion(ctx, reader, key, ts)
+}
+
+// mvccGetVersion returns the raw value of the version of key at exactly the
+// given timestamp.
+func mvccGetVersion(
+	ctx context.Context, reader Reader, key roachpb.Key, ts hlc.Timestamp,
+) ([]byte, bool, error) {
+	iter, err := reader.NewMVCCIterator(ctx, MVCCKeyIterKind, IterOptions{Prefix: true})
+	if err != nil {
+		return nil, false, err
+	}
+	defer iter.Close()
+	iter.SeekGE(MVCCKey{Key: key, Timestamp: ts})
+	if valid, err := iter.Valid(); err != nil || !valid {
+		return nil, false, err
+	}
+	if iter.UnsafeKey().Timestamp != ts {
+		return nil, false, nil
+	}
+	v, err := iter.UnsafeValue()
+	if err != nil {
+		return nil, false, err
+	}
+	return append([]byte(nil), v...), true, nil
+}
+
+func putMetadata(rw ReadWriter, key roachpb.Key, meta *enginepb.MVCCMetadata) error {
+	data, err := protoutil.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return rw.PutUnversioned(key, data)
+}
+
+// mvccPutInternal adds a new timestamped value to the specified key.
+// If value is nil, creates a deletion tombstone value.
+//
+// When writing transactionally, the timestamp parameter must either be empty
+// or match the transaction's read timestamp. The write is performed at the
+// transaction's write timestamp, which may be above its read timestamp. A
+// write must not overwrite a committed value that the transaction could not
+// have observed, i.e. one newer than its read timestamp; such a write fails
+// with a WriteTooOldError. A transactional write leaves an intent: an
+// MVCCMetadata record at the key's meta position that points at the
+// provisional version and remembers the transaction's earlier values of the
+// key, by sequence number, in its intent history.
+func mvccPutInternal(
+	ctx context.Context,
+	rw ReadWriter,
+	key roachpb.Key,
+	timestamp hlc.Timestamp,
+	value []byte,
+	opts MVCCWriteOptions,
 ) error {
+	if len(key) == 0 {
+		return emptyKeyError
+	}
+	meta, ok, err := mvccGetMetadata(ctx, rw, key)
+	if err != nil {
+		return err
+	}
+
+	// Handle inline put. No IntentHistory is required for inline writes as
+	// they aren't allowed within transactions.
+	if timestamp.IsEmpty() && opts.Txn == nil {
+		if ok && !meta.IsInline() {
+			return fmt.Errorf("%q: put is inline=true, but existing value is inline=false", key)
+		}
+		if value == nil {
+			return rw.ClearUnversioned(key)
+		}
+		return putMetadata(rw, key, &enginepb.MVCCMetadata{RawBytes: value})
+	}
+	if ok && meta.IsInline() {
+		return fmt.Errorf("%q: put is inline=false, but existing value is inline=true", key)
+	}
+
+	readTimestamp := timestamp
+	writeTimestamp := timestamp
+	txn := opts.Txn
+	if txn != nil {
+		if !timestamp.IsEmpty() && timestamp != txn.ReadTimestamp {
+			return fmt.Errorf("mvccPutInternal: txn's read timestamp %v does not match timestamp %v",
+				txn.ReadTimestamp, timestamp)
+		}
+		readTimestamp = txn.ReadTimestamp
+		writeTimestamp = txn.WriteTimestamp
+	}
+
+	var intentHistory []enginepb.MVCCMetadata_SequencedIntent
+	if ok && meta.Txn != nil {
+		// There is an intent on the key.
+		if txn == nil || meta.Txn.ID != txn.ID {
+			// The current Put operation does not come from the same
+			// transaction.
+			return &kvpb.WriteIntentError{Intents: []roachpb.Intent{roachpb.MakeIntent(meta.Txn, key)}}
+		}
+		if txn.Epoch < meta.Txn.Epoch {
+			return fmt.Errorf("put with epoch %d came after put with epoch %d in txn %s",
+				txn.Epoch, meta.Txn.Epoch, txn.ID)
+		}
+		if txn.Epoch == meta.Txn.Epoch {
+			if txn.Sequence <= meta.Txn.Sequence {
+				// This is a replay of an earlier write of the transaction. The
+				// write at this sequence number has already been performed (or
+				// superseded), so it is a no-op.
+				if txn.Sequence == meta.Txn.Sequence {
+					return nil
+				}
+				if _, found := meta.GetIntentValue(txn.Sequence); found {
+					return nil
+				}
+				return fmt.Errorf("transaction %s with sequence %d missing an intent with lower sequence %d",
+					txn.ID, meta.Txn.Sequence, txn.Sequence)
+			}
+			// We're overwriting the intent that was present at this key, before
+			// we do that though - we must record the older value in the
+			// IntentHistory. Values written in a sequence range that has since
+			// been rolled back are not worth remembering.
+			intentHistory = append(intentHistory, meta.IntentHistory...)
+			if !enginepb.TxnSeqIsIgnored(meta.Txn.Sequence, txn.IgnoredSeqNums) {
+				prevVal, _, err := mvccGetVersion(ctx, rw, key, meta.Timestamp)
+				if err != nil {
+					return err
+				}
+				intentHistory = append(intentHistory, enginepb.MVCCMetadata_SequencedIntent{
+					Sequence: meta.Txn.Sequence, Value: prevVal,
+				})
+			}
+		}
+		// The provisional value moves to the new write timestamp.
+		if meta.Timestamp != writeTimestamp {
+			if err := rw.ClearMVCC(MVCCKey{Key: key, Timestamp: meta.Timestamp}); err != nil {
+				return err
+			}
+		}
+	} else if ok && readTimestamp.LessEq(meta.Timestamp) {
+		// There is a committed value at or above the read timestamp. History
+		// cannot be rewritten, and the value was not visible to the writer,
+		// so the write must move above the existing value.
+		return kvpb.NewWriteTooOldError(readTimestamp, meta.Timestamp.Next())
+	}
+
+	if txn != nil {
+		txnMeta := txn.TxnMeta
+		txnMeta.WriteTimestamp = writeTimestamp
+		newMeta := enginepb.MVCCMetadata{
+			Txn:           &txnMeta,
+			Timestamp:     writeTimestamp,
+			Deleted:       value == nil,
+			KeyBytes:      int64(len(key)) + 12,
+			ValBytes:      int64(len(value)),
+			IntentHistory: intentHistory,
+		}
+		if err := putMetadata(rw, key, &newMeta); err != nil {
+			return err
+		}
+	}
+	if err := rw.PutMVCC(MVCCKey{Key: key, Timestamp: writeTimestamp}, MVCCValue{Value: roachpb.Value{RawBytes: value}}); err != nil {
+		return err
+	}
+
+	// Log the logical MVCC operation. A transaction which rewrites its own
+	// intent updates it rather than writing a new one.
+	logicalOp := MVCCWriteValueOpType
+	var details MVCCLogicalOpDetails
+	if txn != nil {
+		logicalOp = MVCCWriteIntentOpType
+		if ok && meta.Txn != nil {
+			logicalOp = MVCCUpdateIntentOpType
+		}
+		details.Txn = txn.TxnMeta
+	}
+	details.Key, details.Timestamp = key, writeTimestamp
+	rw.LogLogicalOp(logicalOp, details)
 	return nil
 }
+
+// MVCCGet returns the most recent value for the specified key whose timestamp
+// is less than or equal to the supplied timestamp. If no such value exists, nil
+// is returned instead.
+//
+// In tombstones mode, if the most recent value is a deletion tombstone, the
+// result will be a non-nil roachpb.Value whose RawBytes field is nil.
+// Otherwise, a deletion tombstone results in a nil roachpb.Value.
+//
+// In inconsistent mode, if an intent is encountered, it will be placed in the
+// intent field. By contrast, in consistent mode, an intent will generate a
+// WriteIntentError with the intent embedded within, and the intent result
+// parameter will be nil.
+//
+// Note that transactional gets must be consistent. Put another way, only
+// non-transactional gets may be inconsistent.
+func MVCCGet(
+	ctx context.Context, reader Reader, key roachpb.Key, timestamp hlc.Timestamp, opts MVCCGetOptions,
+) (MVCCGetResult, error) {
+	if len(key) == 0 {
+		return MVCCGetResult{}, emptyKeyError
+	}
+	if opts.Inconsistent && opts.Txn != nil {
+		return MVCCGetResult{}, errors.New("cannot allow inconsistent reads within a transaction")
+	}
+	if opts.Inconsistent && opts.SkipLocked {
+		return MVCCGetResult{}, errors.New("cannot allow inconsistent reads with skip locked wait policy")
+	}
+	iter, err := reader.NewMVCCIterator(ctx, MVCCKeyAndIntentsIterKind, IterOptions{Prefix: true})
+	if err != nil {
+		return MVCCGetResult{}, err
+	}
+	defer iter.Close()
+	s := newPebbleMVCCScanner(iter, key, key.Next(), timestamp, opts.Txn, opts.Inconsistent)
+	s.setLocking(opts.KeyLockingStrength, opts.SkipLocked, opts.LockTable)
+	if err := s.scan(); err != nil {
+		return MVCCGetResult{}, err
+	}
+	var res MVCCGetResult
+	if len(s.results) > 0 {
+		v := s.results[0].Value
+		res.Value = &v
+	}
+	if len(s.intents) > 0 {
+		res.Intent = &s.intents[0]
+	}
+	return res, nil
+}
+
+// MVCCScanOptions bundles options for the MVCCScan family of functions.
+type MVCCScanOptions struct {
+	// See the documentation for MVCCScan for information on these parameters.
+	Inconsistent bool
+	Txn          *roachpb.Transaction
+	// MaxKeys is the maximum number of kv pairs returned from this operation.
+	// The zero value represents an unbounded scan. If the limit stops the scan,
+	// a corresponding ResumeSpan is returned.
+	MaxKeys int64
+	// See the documentation on MVCCGetOptions for information on these
+	// parameters.
+	KeyLockingStrength lock.Strength
+	SkipLocked         bool
+	LockTable          LockTableView
+}
+
+// MVCCScanResult groups the values returned from an MVCCScan operation.
+type MVCCScanResult struct {
+	KVs        []roachpb.KeyValue
+	NumKeys    int64
+	ResumeSpan *roachpb.Span
+	Intents    []roachpb.Intent
+}
+
+// MVCCScan scans the key range [key, endKey) in the provided reader up to some
+// maximum number of results in ascending order. Specify max=0 for unbounded
+// scans.
+//
+// In inconsistent mode, the committed values beneath the intents of other
+// transactions are returned along with the intents themselves. In consistent
+// mode, intents of other transactions at or below the read timestamp produce a
+// WriteIntentError.
+func MVCCScan(
+	ctx context.Context,
+	reader Reader,
+	key, endKey roachpb.Key,
+	timestamp hlc.Timestamp,
+	opts MVCCScanOptions,
+) (MVCCScanResult, error) {
+	if len(endKey) == 0 {
+		return MVCCScanResult{}, emptyKeyError
+	}
+	if opts.Inconsistent && opts.Txn != nil {
+		return MVCCScanResult{}, errors.New("cannot allow inconsistent reads within a transaction")
+	}
+	if opts.Inconsistent && opts.SkipLocked {
+		return MVCCScanResult{}, errors.New("cannot allow inconsistent reads with skip locked wait policy")
+	}
+	iter, err := reader.NewMVCCIterator(ctx, MVCCKeyAndIntentsIterKind, IterOptions{
+		LowerBound: key,
+		UpperBound: endKey,
+	})
+	if err != nil {
+		return MVCCScanResult{}, err
+	}
+	defer iter.Close()
+	s := newPebbleMVCCScanner(iter, key, endKey, timestamp, opts.Txn, opts.Inconsistent)
+	s.maxKeys = opts.MaxKeys
+	s.setLocking(opts.KeyLockingStrength, opts.SkipLocked, opts.LockTable)
+	if err := s.scan(); err != nil {
+		return MVCCScanResult{}, err
+	}
+	return MVCCScanResult{
+		KVs:        s.results,
+		NumKeys:    int64(len(s.results)),
+		ResumeSpan: s.resumeSpan,
+		Intents:    s.intents,
+	}, nil
+}
+
+// MVCCResolveWriteIntent either commits, aborts (rolls back), or moves forward
+// in time an extant write intent for a given txn according to commit
+// parameter. ResolveWriteIntent will skip write intents of other txns.
+//
+// Before resolving the intent, the values written at sequence numbers in the
+// update's ignored seqnum ranges are discarded: the intent's provisional value
+// is rolled back to the most recent value in its intent history that was not
+// ignored. If every value the transaction wrote to the key was rolled back,
+// the intent is removed, even when the transaction commits.
+//
+// Returns whether or not an intent was found to resolve.
+func MVCCResolveWriteIntent(
+	ctx context.Context, rw ReadWriter, intent roachpb.LockUpdate,
+) (ok bool, err error) {
+	if len(intent.Key) == 0 {
+		return false, emptyKeyError
+	}
+	if len(intent.EndKey) > 0 {
+		return false, errors.New("end key must not be provided")
+	}
+	meta, found, err := mvccGetMetadata(ctx, rw, intent.Key)
+	if err != nil || !found || meta.Txn == nil || meta.Txn.ID != intent.Txn.ID {
+		return false, err
+	}
+	return mvccResolveWriteIntent(ctx, rw, intent.Key, &meta, intent)
+}
+
+// MVCCResolveWriteIntentRange commits, aborts (rolls back), or moves forward
+// in time the extant write intents of the update's transaction in its key
+// range, like MVCCResolveWriteIntent does for a single key. The write intents
+// of other txns are skipped.
+//
+// Returns the number of intents that were resolved.
+func MVCCResolveWriteIntentRange(
+	ctx context.Context, rw ReadWriter, intent roachpb.LockUpdate,
+) (int64, error) {
+	if len(intent.EndKey) == 0 {
+		return 0, emptyKeyError
+	}
+	// The keys with metadata are collected before any of them is resolved, so
+	// that the iterator doesn't observe the writes of the resolution.
+	iter, err := rw.NewMVCCIterator(ctx, MVCCKeyAndIntentsIterKind, IterOptions{
+		LowerBound: intent.Key,
+		UpperBound: intent.EndKey,
+	})
+	if err != nil {
+		return 0, err
+	}
+	var metaKeys []roachpb.Key
+	for iter.SeekGE(MakeMVCCMetadataKey(intent.Key)); ; iter.Next() {
+		valid, err := iter.Valid()
+		if err != nil {
+			iter.Close()
+			return 0, err
+		}
+		if !valid {
+			break
+		}
+		if unsafeKey := iter.UnsafeKey(); !unsafeKey.IsValue() {
+			metaKeys = append(metaKeys, append(roachpb.Key(nil), unsafeKey.Key...))
+		}
+	}
+	iter.Close()
+
+	var numKeys int64
+	for _, key := range metaKeys {
+		update := intent
+		update.Span = roachpb.Span{Key: key}
+		ok, err := MVCCResolveWriteIntent(ctx, rw, update)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			numKeys++
+		}
+	}
+	return numKeys, nil
+}
+
+func mvccResolveWriteIntent(
+	ctx context.Context,
+	rw ReadWriter,
+	key roachpb.Key,
+	meta *enginepb.MVCCMetadata,
+	intent roachpb.LockUpdate,
+) (bool, error) {
+	epochsMatch := meta.Txn.Epoch == intent.Txn.Epoch
+	inProgress := intent.Status == roachpb.PENDING || intent.Status == roachpb.STAGING
+	commit := intent.Status == roachpb.COMMITTED && epochsMatch
+	pushed := inProgress && meta.Txn.WriteTimestamp.Less(intent.Txn.WriteTimestamp)
+
+	if inProgress && !epochsMatch {
+		// An update from a different epoch of a transaction that is still in
+		// progress says nothing about this intent.
+		return false, nil
+	}
+
+	provisionalKey := MVCCKey{Key: key, Timestamp: meta.Timestamp}
+	value, _, err := mvccGetVersion(ctx, rw, key, meta.Timestamp)
+	if err != nil {
+		return false, err
+	}
+
+	// Roll back the writes performed in ignored sequence number ranges.
+	rolledBack := false
+	if epochsMatch && intent.Status != roachpb.ABORTED {
+		var removeIntent bool
+		rolledBack, removeIntent, value = mvccMaybeRewriteIntentHistory(meta, intent.IgnoredSeqNums, value)
+		if removeIntent {
+			// Every write of the transaction to this key was rolled back, so
+			// the key reverts to its committed state regardless of the outcome
+			// of the transaction.
+			if err := rw.ClearMVCC(provisionalKey); err != nil {
+				return false, err
+			}
+			rw.LogLogicalOp(MVCCAbortIntentOpType, MVCCLogicalOpDetails{Txn: *meta.Txn, Key: key})
+			return true, rw.ClearUnversioned(key)
+		}
+	}
+
+	if commit || pushed || rolledBack {
+		newTimestamp := meta.Timestamp
+		if commit || pushed {
+			newTimestamp.Forward(intent.Txn.WriteTimestamp)
+		}
+		if newTimestamp != meta.Timestamp {
+			if err := rw.ClearMVCC(provisionalKey); err != nil {
+				return false, err
+			}
+		}
+		if err := rw.PutMVCC(MVCCKey{Key: key, Timestamp: newTimestamp}, MVCCValue{Value: roachpb.Value{RawBytes: value}}); err != nil {
+			return false, err
+		}
+		if commit {
+			// The intent is committed: the provisional value becomes a regular
+			// committed version and the metadata is removed.
+			rw.LogLogicalOp(MVCCCommitIntentOpType, MVCCLogicalOpDetails{
+				Txn: *meta.Txn, Key: key, Timestamp: newTimestamp,
+			})
+			return true, rw.ClearUnversioned(key)
+		}
+		rw.LogLogicalOp(MVCCUpdateIntentOpType, MVCCLogicalOpDetails{
+			Txn: *meta.Txn, Key: key, Timestamp: newTimestamp,
+		})
+		meta.Timestamp = newTimestamp
+		meta.Txn.WriteTimestamp = newTimestamp
+		meta.Deleted = len(value) == 0
+		meta.ValBytes = int64(len(value))
+		return true, putMetadata(rw, key, meta)
+	}
+
+	if inProgress {
+		// Nothing to do: the intent is neither committed, pushed, nor rolled
+		// back.
+		return false, nil
+	}
+
+	// The transaction was aborted, or it committed in a later epoch than the
+	// one that wrote this intent. Either way the intent is removed.
+	if err := rw.ClearMVCC(provisionalKey); err != nil {
+		return false, err
+	}
+	rw.LogLogicalOp(MVCCAbortIntentOpType, MVCCLogicalOpDetails{Txn: *meta.Txn, Key: key})
+	return true, rw.ClearUnversioned(key)
+}
+
+// mvccMaybeRewriteIntentHistory rewrites the intent to reveal the latest
+// stored value, ignoring all values from the history that have an
+// ignored seqnum.
+// The remove return value, when true, indicates that
+// all the writes in the intent are ignored and the intent should
+// be marked for removal as it does not exist any more.
+// The updated return value, when true, indicates that the intent was
+// updated and should be overwritten in engine.
+func mvccMaybeRewriteIntentHistory(
+	meta *enginepb.MVCCMetadata, ignoredSeqNums []enginepb.IgnoredSeqNumRange, value []byte,
+) (updated, remove bool, newValue []byte) {
+	if len(ignoredSeqNums) == 0 {
+		return false, false, value
+	}
+	// Remove all the historical values that were written at ignored
+	// sequence numbers.
+	var history []enginepb.MVCCMetadata_SequencedIntent
+	for _, e := range meta.IntentHistory {
+		if enginepb.TxnSeqIsIgnored(e.Sequence, ignoredSeqNums) {
+			updated = true
+			continue
+		}
+		history = append(history, e)
+	}
+	meta.IntentHistory = history
+
+	if !enginepb.TxnSeqIsIgnored(meta.Txn.Sequence, ignoredSeqNums) {
+		// The latest write is not ignored; the provisional value stands.
+		return updated, false, value
+	}
+	// The latest write is ignored; reveal the most recent value from the
+	// history that survives.
+	if len(history) == 0 {
+		return true, true, nil
+	}
+	last := history[len(history)-1]
+	meta.IntentHistory = history[:len(history)-1]
+	meta.Txn.Sequence = last.Sequence
+	return true, false, last.Value
+}
+
+// ComputeStats scans the given key span and computes MVCC stats. nowNanos
+// specifies the wall time in nanoseconds since the epoch and is used as the
+// stats' LastUpdateNanos.
+//
+// Range-local keys, such as transaction records, are accounted for in
+// SysBytes and SysCount; all other keys in the remaining fields.
+func ComputeStats(
+	ctx context.Context, r Reader, start, end roachpb.Key, nowNanos int64,
+) (enginepb.MVCCStats, error) {
+	iter, err := r.NewMVCCIterator(ctx, MVCCKeyAndIntentsIterKind, IterOptions{
+		LowerBound: start,
+		UpperBound: end,
+	})
+	if err != nil {
+		return enginepb.MVCCStats{}, err
+	}
+	defer iter.Close()
+
+	ms := enginepb.MVCCStats{LastUpdateNanos: nowNanos}
+	var meta enginepb.MVCCMetadata
+	var prevKey []byte
+	first := false
+	for iter.SeekGE(MakeMVCCMetadataKey(start)); ; iter.Next() {
+		if valid, err := iter.Valid(); err != nil {
+			return enginepb.MVCCStats{}, err
+		} else if !valid {
+			break
+		}
+		unsafeKey := iter.UnsafeKey()
+		unsafeValue, err := iter.UnsafeValue()
+		if err != nil {
+			return enginepb.MVCCStats{}, err
+		}
+		isValue := unsafeKey.IsValue()
+		implicitMeta := isValue && !bytes.Equal(unsafeKey.Key, prevKey)
+		prevKey = append(prevKey[:0], unsafeKey.Key...)
+
+		if keys.IsLocal(unsafeKey.Key) {
+			totalBytes := int64(len(unsafeKey.Key)) + 1 + int64(len(unsafeValue))
+			if isValue {
+				totalBytes += MVCCVersionTimestampSize
+			}
+			ms.SysBytes += totalBytes
+			ms.SysCount++
+			continue
+		}
+
+		if !isValue || implicitMeta {
+			metaKeySize := int64(len(unsafeKey.Key)) + 1
+			var metaValSize int64
+			if implicitMeta {
+				// The key has no explicit meta record; synthesize one from
+				// its most recent version.
+				valLen, isTombstone, err := iter.MVCCValueLenAndIsTombstone()
+				if err != nil {
+					return enginepb.MVCCStats{}, err
+				}
+				meta = enginepb.MVCCMetadata{
+					Timestamp: unsafeKey.Timestamp,
+					Deleted:   isTombstone,
+					KeyBytes:  MVCCVersionTimestampSize,
+					ValBytes:  int64(valLen),
+				}
+			} else {
+				meta = enginepb.MVCCMetadata{}
+				if err := protoutil.Unmarshal(unsafeValue, &meta); err != nil {
+					return enginepb.MVCCStats{}, fmt.Errorf("unable to decode MVCCMetadata: %w", err)
+				}
+				metaValSize = int64(len(unsafeValue))
+			}
+			first = true
+
+			ms.KeyBytes += metaKeySize
+			ms.ValBytes += metaValSize
+			ms.KeyCount++
+			if meta.IsInline() {
+				ms.ValCount++
+			}
+			if !meta.Deleted {
+				ms.LiveBytes += metaKeySize + metaValSize
+				ms.LiveCount++
+			}
+			if meta.Txn != nil {
+				ms.IntentBytes += meta.KeyBytes + meta.ValBytes
+				ms.IntentCount++
+			}
+			if !implicitMeta {
+				continue
+			}
+		}
+
+		// A versioned value. The most recent version of a key is live
+		// unless it is a deletion tombstone.
+		totalBytes := int64(len(unsafeValue)) + MVCCVersionTimestampSize
+		if first {
+			first = false
+			if !meta.Deleted {
+				ms.LiveBytes += totalBytes
+			}
+		}
+		ms.KeyBytes += MVCCVersionTimestampSize
+		ms.ValBytes += int64(len(unsafeValue))
+		ms.ValCount++
+	}
+	return ms, nil
+}
+
+// MVCCFindSplitKey finds a key from the given span such that the left side of
+// the split is roughly targetSize bytes. The size of a key is that of all of
+// its versions and of its intent, if any. The returned key is always a valid
+// split key: it is never a meta key (see keys.IsValidSplitKey), and never
+// falls in the middle of a SQL row (see keys.EnsureSafeSplitKey). A nil key
+// is returned if no such key exists, for instance because the span holds a
+// single row.
+func MVCCFindSplitKey(
+	ctx context.Context, reader Reader, key, endKey roachpb.RKey, targetSize int64,
+) (roachpb.Key, error) {
+	if key.Less(roachpb.RKey(keys.MetaMax)) {
+		// Neither the local keys nor the meta keys are valid split keys.
+		key = roachpb.RKey(keys.MetaMax)
+	}
+	if !key.Less(endKey) {
+		return nil, nil
+	}
+	iter, err := reader.NewMVCCIterator(ctx, MVCCKeyAndIntentsIterKind, IterOptions{
+		LowerBound: key.AsRawKey(),
+		UpperBound: endKey.AsRawKey(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	// The split key is the first row whose preceding rows make up at least
+	// targetSize bytes. The first row of the span can't be split at, since
+	// that would leave the left side empty.
+	var sizeSoFar int64
+	var prevKey, prevRow roachpb.Key
+	for iter.SeekGE(MakeMVCCMetadataKey(key.AsRawKey())); ; iter.Next() {
+		if valid, err := iter.Valid(); err != nil {
+			return nil, err
+		} else if !valid {
+			return nil, nil
+		}
+		unsafeKey := iter.UnsafeKey()
+		if !bytes.Equal(unsafeKey.Key, prevKey) {
+			prevKey = append(prevKey[:0], unsafeKey.Key...)
+			row, err := keys.EnsureSafeSplitKey(unsafeKey.Key)
+			if err != nil {
+				return nil, err
+			}
+			if !row.Equal(prevRow) {
+				if prevRow != nil && sizeSoFar >= targetSize {
+					return append(roachpb.Key(nil), row...), nil
+				}
+				prevRow = append(prevRow[:0], row...)
+			}
+		}
+		unsafeValue, err := iter.UnsafeValue()
+		if err != nil {
+			return nil, err
+		}
+		sizeSoFar += int64(len(unsafeKey.Key)) + 1 + int64(len(unsafeValue))
+		if unsafeKey.IsValue() {
+			sizeSoFar += MVCCVersionTimestampSize
+		}
+	}
+}
+
+// ClearRange removes all the keys in [start, end) read from r, including
+// all their versions, by writing point deletions to w.
+func ClearRange(ctx context.Context, r Reader, w Writer, start, end roachpb.Key) error {
+	iter, err := r.NewMVCCIterator(ctx, MVCCKeyIterKind, IterOptions{
+		LowerBound: start,
+		UpperBound: end,
+	})
+	if err != nil {
+		return err
+	}
+	defer iter.Close()
+	for iter.SeekGE(MakeMVCCMetadataKey(start)); ; iter.Next() {
+		if valid, err := iter.Valid(); err != nil {
+			return err
+		} else if !valid {
+			return nil
+		}
+		key := iter.UnsafeKey().Clone()
+		if key.IsValue() {
+			err = w.ClearMVCC(key)
+		} else {
+			err = w.ClearUnversioned(key.Key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"fmt"
 	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
 	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
 )
@@ -35,3 +36,57 @@ type MVCCRangeKeyVersion struct {
 	Timestamp hlc.Timestamp
 	Value     []byte
 }
+
+// MakeMVCCMetadataKey creates an MVCCKey from a roachpb.Key.
+func MakeMVCCMetadataKey(key roachpb.Key) MVCCKey {
+	return MVCCKey{Key: key}
+}
+
+// IsValue returns true iff the timestamp is non-zero.
+func (k MVCCKey) IsValue() bool {
+	return !k.Timestamp.IsEmpty()
+}
+
+// Less compares two keys.
+func (k MVCCKey) Less(l MVCCKey) bool {
+	return k.Compare(l) < 0
+}
+
+// Compare returns -1 if this key is less than the given key, 0 if they're
+// equal, or 1 if this is greater. Comparison is by key,timestamp, where larger
+// timestamps sort before smaller ones except empty ones which sort first (like
+// elsewhere in MVCC).
+func (k MVCCKey) Compare(o MVCCKey) int {
+	if c := k.Key.Compare(o.Key); c != 0 {
+		return c
+	}
+	if k.Timestamp == o.Timestamp {
+		return 0
+	} else if k.Timestamp.IsEmpty() {
+		return -1
+	} else if o.Timestamp.IsEmpty() {
+		return 1
+	} else if o.Timestamp.Less(k.Timestamp) {
+		return -1
+	}
+	return 1
+}
+
+// Equal returns whether two keys are identical.
+func (k MVCCKey) Equal(l MVCCKey) bool {
+	return k.Key.Equal(l.Key) && k.Timestamp == l.Timestamp
+}
+
+// String returns a string-formatted version of the key.
+func (k MVCCKey) String() string {
+	if !k.IsValue() {
+		return k.Key.String()
+	}
+	return fmt.Sprintf("%s/%v", k.Key, k.Timestamp)
+}
+
+// Clone returns a copy of the key.
+func (k MVCCKey) Clone() MVCCKey {
+	k.Key = append(roachpb.Key(nil), k.Key...)
+	return k
+}
@@ -0,0 +1,266 @@
+package storage
+
+import (
+	"context"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/concurrency/isolation"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/concurrency/lock"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/dborchard/tiny_crdb/pkg/h_storage/enginepb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+// TestMVCCIgnoredSeqNums verifies that the writes of a transaction performed
+// at ignored sequence numbers are neither visible to the transaction's own
+// reads nor committed when its intents are resolved.
+func TestMVCCIgnoredSeqNums(t *testing.T) {
+	ctx := context.Background()
+	eng, err := NewPebble(ctx, engineConfig{})
+	require.NoError(t, err)
+	defer eng.Close()
+
+	keyA, keyB := roachpb.Key("a"), roachpb.Key("b")
+	ts1 := hlc.Timestamp{WallTime: 1}
+	require.NoError(t, MVCCPut(ctx, eng, keyA, ts1, roachpb.MakeValueFromString("a1"), MVCCWriteOptions{}))
+
+	txn := roachpb.MakeTransaction("test", keyA, isolation.Serializable, roachpb.NormalUserPriority, hlc.Timestamp{WallTime: 2})
+	put := func(key roachpb.Key, seq enginepb.TxnSeq, val string) {
+		txn.Sequence = seq
+		require.NoError(t, MVCCPut(ctx, eng, key, hlc.Timestamp{}, roachpb.MakeValueFromString(val), MVCCWriteOptions{Txn: &txn}))
+	}
+	read := func(key roachpb.Key, txn *roachpb.Transaction) string {
+		res, err := MVCCGet(ctx, eng, key, hlc.Timestamp{WallTime: 3}, MVCCGetOptions{Txn: txn})
+		require.NoError(t, err)
+		if res.Value == nil {
+			return ""
+		}
+		b, err := res.Value.GetBytes()
+		require.NoError(t, err)
+		return string(b)
+	}
+
+	put(keyA, 1, "a2")
+	put(keyA, 2, "a3")
+	put(keyA, 3, "a4")
+	put(keyB, 3, "b1")
+	require.Equal(t, "a4", read(keyA, &txn))
+
+	// Reads at an earlier sequence number observe the intent history.
+	txn.Sequence = 1
+	require.Equal(t, "a2", read(keyA, &txn))
+	require.Equal(t, "", read(keyB, &txn))
+
+	// Roll back the writes at sequence numbers 2 and 3.
+	txn.Sequence = 3
+	txn.AddIgnoredSeqNumRange(enginepb.IgnoredSeqNumRange{Start: 2, End: 3})
+	require.Equal(t, "a2", read(keyA, &txn))
+	require.Equal(t, "", read(keyB, &txn))
+
+	// Other readers conflict with the intent.
+	_, err = MVCCGet(ctx, eng, keyA, hlc.Timestamp{WallTime: 3}, MVCCGetOptions{})
+	require.IsType(t, &kvpb.WriteIntentError{}, err)
+
+	// Commit. The rolled back writes are discarded.
+	txn.Status = roachpb.COMMITTED
+	for _, key := range []roachpb.Key{keyA, keyB} {
+		ok, err := MVCCResolveWriteIntent(ctx, eng, roachpb.MakeLockUpdate(&txn, roachpb.Span{Key: key}))
+		require.NoError(t, err)
+		require.True(t, ok)
+	}
+	require.Equal(t, "a2", read(keyA, nil))
+	require.Equal(t, "", read(keyB, nil))
+
+	res, err := MVCCScan(ctx, eng, roachpb.KeyMin, roachpb.KeyMax, hlc.Timestamp{WallTime: 3}, MVCCScanOptions{})
+	require.NoError(t, err)
+	require.Len(t, res.KVs, 1)
+	require.Equal(t, hlc.Timestamp{WallTime: 2}, res.KVs[0].Value.Timestamp)
+}
+
+type testLockTableView map[string]enginepb.TxnMeta
+
+func (v testLockTableView) IsKeyLockedByConflictingTxn(
+	key roachpb.Key, str lock.Strength,
+) (bool, *enginepb.TxnMeta) {
+	if txn, ok := v[string(key)]; ok {
+		return true, &txn
+	}
+	return false, nil
+}
+
+// TestMVCCScanSkipLocked verifies that a skip-locked scan skips over the keys
+// with intents of other transactions, and the keys locked in the lock table,
+// instead of returning a WriteIntentError.
+func TestMVCCScanSkipLocked(t *testing.T) {
+	ctx := context.Background()
+	eng, err := NewPebble(ctx, engineConfig{})
+	require.NoError(t, err)
+	defer eng.Close()
+
+	ts1 := hlc.Timestamp{WallTime: 1}
+	for _, k := range []string{"a", "b", "c", "d"} {
+		require.NoError(t, MVCCPut(ctx, eng, roachpb.Key(k), ts1, roachpb.MakeValueFromString(k), MVCCWriteOptions{}))
+	}
+	// Txn1 writes an intent on "b" at ts 2 and an intent on "d" at ts 5.
+	txn1 := roachpb.MakeTransaction("txn1", roachpb.Key("b"), isolation.Serializable, roachpb.NormalUserPriority, hlc.Timestamp{WallTime: 2})
+	require.NoError(t, MVCCPut(ctx, eng, roachpb.Key("b"), hlc.Timestamp{}, roachpb.MakeValueFromString("b2"), MVCCWriteOptions{Txn: &txn1}))
+	txn1.WriteTimestamp = hlc.Timestamp{WallTime: 5}
+	require.NoError(t, MVCCPut(ctx, eng, roachpb.Key("d"), hlc.Timestamp{}, roachpb.MakeValueFromString("d2"), MVCCWriteOptions{Txn: &txn1}))
+	// Txn2 holds an unreplicated lock on "c".
+	txn2 := roachpb.MakeTransaction("txn2", roachpb.Key("c"), isolation.Serializable, roachpb.NormalUserPriority, ts1)
+	lockTable := testLockTableView{"c": txn2.TxnMeta}
+
+	txn3 := roachpb.MakeTransaction("txn3", roachpb.Key("a"), isolation.Serializable, roachpb.NormalUserPriority, hlc.Timestamp{WallTime: 3})
+	scan := func(str lock.Strength, skipLocked bool) ([]string, error) {
+		res, err := MVCCScan(ctx, eng, roachpb.Key("a"), roachpb.Key("z"), hlc.Timestamp{WallTime: 3}, MVCCScanOptions{
+			Txn:                &txn3,
+			KeyLockingStrength: str,
+			SkipLocked:         skipLocked,
+			LockTable:          lockTable,
+		})
+		var keys []string
+		for _, kv := range res.KVs {
+			keys = append(keys, string(kv.Key))
+		}
+		return keys, err
+	}
+
+	// Without skip-locked, the intent on "b" is a conflict.
+	_, err = scan(lock.None, false)
+	require.IsType(t, &kvpb.WriteIntentError{}, err)
+
+	// A non-locking skip-locked scan skips "b" and "c", but reads below the
+	// intent on "d", which is above its timestamp.
+	keys, err := scan(lock.None, true)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "d"}, keys)
+
+	// A locking skip-locked scan also skips "d".
+	keys, err = scan(lock.Exclusive, true)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a"}, keys)
+}
+
+// TestMVCCScanLockingWriteTooOld verifies that a locking scan which finds a
+// committed value above its timestamp fails with a WriteTooOldError, while a
+// non-locking scan reads below the value.
+func TestMVCCScanLockingWriteTooOld(t *testing.T) {
+	ctx := context.Background()
+	eng, err := NewPebble(ctx, engineConfig{})
+	require.NoError(t, err)
+	defer eng.Close()
+
+	for k, ts := range map[string]int64{"a": 1, "b": 5, "c": 7} {
+		require.NoError(t, MVCCPut(ctx, eng, roachpb.Key(k), hlc.Timestamp{WallTime: 1}, roachpb.MakeValueFromString(k), MVCCWriteOptions{}))
+		if ts > 1 {
+			require.NoError(t, MVCCPut(ctx, eng, roachpb.Key(k), hlc.Timestamp{WallTime: ts}, roachpb.MakeValueFromString(k+"2"), MVCCWriteOptions{}))
+		}
+	}
+	scan := func(str lock.Strength, ts int64) (MVCCScanResult, error) {
+		return MVCCScan(ctx, eng, roachpb.Key("a"), roachpb.Key("z"), hlc.Timestamp{WallTime: ts}, MVCCScanOptions{
+			KeyLockingStrength: str,
+		})
+	}
+
+	res, err := scan(lock.None, 3)
+	require.NoError(t, err)
+	require.Len(t, res.KVs, 3)
+
+	// The error carries the timestamp above the most recent value.
+	_, err = scan(lock.Exclusive, 3)
+	var wtoErr *kvpb.WriteTooOldError
+	require.ErrorAs(t, err, &wtoErr)
+	require.Equal(t, hlc.Timestamp{WallTime: 7, Logical: 1}, wtoErr.ActualTimestamp)
+
+	_, err = scan(lock.Shared, 6)
+	require.ErrorAs(t, err, &wtoErr)
+	require.Equal(t, hlc.Timestamp{WallTime: 7, Logical: 1}, wtoErr.ActualTimestamp)
+
+	res, err = scan(lock.Exclusive, 7)
+	require.NoError(t, err)
+	require.Len(t, res.KVs, 3)
+}
+
+// TestMVCCFindSplitKey verifies that the split key is found at the midpoint
+// of the data of a span, and that it never splits the column families of a
+// SQL row.
+func TestMVCCFindSplitKey(t *testing.T) {
+	ctx := context.Background()
+	eng, err := NewPebble(ctx, engineConfig{})
+	require.NoError(t, err)
+	defer eng.Close()
+
+	// Table keys are made of a row prefix, here the table and index IDs and a
+	// primary key, a column family ID, and the length of the family ID.
+	rowKey := func(pk byte) roachpb.Key {
+		return roachpb.Key{0x89, 0x89, 0x88 + pk}
+	}
+	familyKey := func(pk, family byte) roachpb.Key {
+		return append(rowKey(pk), 0x88+family, 0x89)
+	}
+	ts := hlc.Timestamp{WallTime: 1}
+	value := roachpb.MakeValueFromString(string(make([]byte, 100)))
+	const numRows = 10
+	for pk := byte(0); pk < numRows; pk++ {
+		for family := byte(0); family < 3; family++ {
+			require.NoError(t, MVCCPut(ctx, eng, familyKey(pk, family), ts, value, MVCCWriteOptions{}))
+		}
+	}
+
+	start, end := roachpb.RKey(rowKey(0)), roachpb.RKey(rowKey(numRows))
+	ms, err := ComputeStats(ctx, eng, start.AsRawKey(), end.AsRawKey(), 0)
+	require.NoError(t, err)
+	splitKey, err := MVCCFindSplitKey(ctx, eng, start, end, ms.Total()/2)
+	require.NoError(t, err)
+	require.Equal(t, rowKey(numRows/2), splitKey)
+
+	// The first row is never split off on its own, even with a tiny target,
+	// and a span holding a single row cannot be split.
+	splitKey, err = MVCCFindSplitKey(ctx, eng, start, end, 1)
+	require.NoError(t, err)
+	require.Equal(t, rowKey(1), splitKey)
+	splitKey, err = MVCCFindSplitKey(ctx, eng, start, roachpb.RKey(rowKey(1)), 1)
+	require.NoError(t, err)
+	require.Nil(t, splitKey)
+
+	// The meta keys are never split at.
+	splitKey, err = MVCCFindSplitKey(ctx, eng, roachpb.RKeyMin, roachpb.RKey{0x04}, 1)
+	require.NoError(t, err)
+	require.Nil(t, splitKey)
+}
+
+// TestMVCCResolveWriteIntentRange verifies that resolving a key range only
+// resolves the intents of the update's transaction in the range.
+func TestMVCCResolveWriteIntentRange(t *testing.T) {
+	ctx := context.Background()
+	eng, err := NewPebble(ctx, engineConfig{})
+	require.NoError(t, err)
+	defer eng.Close()
+
+	txn1 := roachpb.MakeTransaction("txn1", roachpb.Key("a"), isolation.Serializable, roachpb.NormalUserPriority, hlc.Timestamp{WallTime: 1})
+	txn2 := roachpb.MakeTransaction("txn2", roachpb.Key("b"), isolation.Serializable, roachpb.NormalUserPriority, hlc.Timestamp{WallTime: 1})
+	for _, w := range []struct {
+		key string
+		txn *roachpb.Transaction
+	}{{"a", &txn1}, {"b", &txn2}, {"c", &txn1}, {"d", &txn1}} {
+		require.NoError(t, MVCCPut(ctx, eng, roachpb.Key(w.key), hlc.Timestamp{}, roachpb.MakeValueFromString(w.key), MVCCWriteOptions{Txn: w.txn}))
+	}
+
+	txn1.Status = roachpb.COMMITTED
+	update := roachpb.MakeLockUpdate(&txn1, roachpb.Span{Key: roachpb.Key("a"), EndKey: roachpb.Key("d")})
+	n, err := MVCCResolveWriteIntentRange(ctx, eng, update)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), n)
+
+	// The intent of txn2 on "b" and the intent of txn1 on "d", outside of the
+	// range, are left in place.
+	for key, intent := range map[string]bool{"a": false, "b": true, "c": false, "d": true} {
+		_, err := MVCCGet(ctx, eng, roachpb.Key(key), hlc.Timestamp{WallTime: 2}, MVCCGetOptions{})
+		if intent {
+			require.IsType(t, &kvpb.WriteIntentError{}, err, key)
+		} else {
+			require.NoError(t, err, key)
+		}
+	}
+}
@@ -52,3 +52,13 @@ type MVCCValue struct {
 func (v MVCCValue) IsTombstone() bool {
 	return len(v.Value.RawBytes) == 0
 }
+
+// EncodeMVCCValue encodes an MVCCValue into its byte representation.
+func EncodeMVCCValue(v MVCCValue) ([]byte, error) {
+	return v.Value.RawBytes, nil
+}
+
+// DecodeMVCCValue decodes an MVCCKey from its byte representation.
+func DecodeMVCCValue(buf []byte) (MVCCValue, error) {
+	return MVCCValue{Value: roachpb.Value{RawBytes: buf}}, nil
+}
@@ -2,7 +2,10 @@ package storage
 
 import (
 	"context"
+	"errors"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
 	"github.com/dborchard/tiny_crdb/pkg/h_storage/vfs"
+	"os"
 )
 
 // A Location describes where the storage engine's data will be written. A
@@ -12,17 +15,76 @@ type Location struct {
 	fs  vfs.FS
 }
 
+// Filesystem constructs a Location that instructs the storage engine to read
+// and store data in the filesystem directory dir.
+func Filesystem(dir string) Location {
+	return Location{
+		dir: dir,
+		fs:  vfs.Default,
+	}
+}
+
+// InMemory constructs a Location that instructs the storage engine to store
+// data in-memory.
+func InMemory() Location {
+	return Location{}
+}
+
+// IsInMemory returns true if the Location is in-memory.
+func (l Location) IsInMemory() bool {
+	return l.fs == nil
+}
+
 type engineConfig struct {
 	Dir string
 	FS  vfs.FS
+	// MaxSize is the maximum size of the engine, in bytes. Zero means that
+	// the engine is bounded by the capacity of its filesystem only.
+	MaxSize int64
+	// Attrs is the set of attributes of the store backed by the engine.
+	Attrs roachpb.Attributes
+}
+
+// ConfigOption is an option for configuring an engine opened by Open.
+type ConfigOption func(cfg *engineConfig) error
+
+// MaxSize sets the intended maximum size of the store, in bytes. It is
+// reported as the capacity of the engine, and is required for in-memory
+// engines.
+func MaxSize(size int64) ConfigOption {
+	return func(cfg *engineConfig) error {
+		cfg.MaxSize = size
+		return nil
+	}
+}
+
+// Attributes configures the engine's attributes.
+func Attributes(attrs roachpb.Attributes) ConfigOption {
+	return func(cfg *engineConfig) error {
+		cfg.Attrs = attrs
+		return nil
+	}
 }
 
 // Open opens a new Pebble storage engine, reading and writing data to the
 // provided Location, configured with the provided options.
-func Open(ctx context.Context, loc Location) (*Pebble, error) {
+func Open(ctx context.Context, loc Location, opts ...ConfigOption) (*Pebble, error) {
 	var cfg engineConfig
 	cfg.Dir = loc.dir
 	cfg.FS = loc.fs
+	for _, opt := range opts {
+		if err := opt(&cfg); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.MaxSize < 0 {
+		return nil, errors.New("engine size must not be negative")
+	}
+	if !loc.IsInMemory() {
+		if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+			return nil, err
+		}
+	}
 	p, err := NewPebble(ctx, cfg)
 	if err != nil {
 		return nil, err
@@ -2,59 +2,378 @@ package storage
 
 import (
 	"context"
+	"errors"
 	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/dborchard/tiny_crdb/pkg/h_storage/vfs"
+	"sort"
+	"sync"
 )
 
 var _ Engine = &Pebble{}
 
-// Pebble is a wrapper around a Pebble database instance.
+// Pebble is the storage engine used by a store. It keeps its data as an
+// immutable, sorted run of MVCC key/value pairs that is replaced wholesale
+// (copy-on-write) on every write. Readers and iterators capture the run that
+// was current when they were created, which gives them the consistent view
+// described on Reader without any further locking.
 type Pebble struct {
+	cfg engineConfig
+
+	mu struct {
+		sync.RWMutex
+		data   []memKV
+		closed bool
+	}
+}
+
+// memKV is a single point key in the engine.
+type memKV struct {
+	key   MVCCKey
+	value []byte
 }
 
+// errClosed is returned when the engine is used after Close.
+var errClosed = errors.New("pebble: closed")
+
 func NewPebble(ctx context.Context, cfg engineConfig) (p *Pebble, err error) {
-	return &Pebble{}, nil
+	return &Pebble{cfg: cfg}, nil
 }
 
+// Close implements the Engine interface.
 func (p *Pebble) Close() {
-	//TODO implement me
-	panic("implement me")
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.mu.closed = true
 }
 
+// Closed implements the Engine interface.
 func (p *Pebble) Closed() bool {
-	//TODO implement me
-	panic("implement me")
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.mu.closed
+}
+
+// snapshot returns the current immutable run of the engine's data.
+func (p *Pebble) snapshot() []memKV {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.mu.data
 }
 
-func (p *Pebble) MVCCIterate(ctx context.Context, start, end roachpb.Key, iterKind MVCCIterKind, keyTypes IterKeyType, readCategory ReadCategory, f func(MVCCKeyValue, MVCCRangeKeyStack) error) error {
-	//TODO implement me
-	panic("implement me")
+// MVCCIterate implements the Engine interface.
+func (p *Pebble) MVCCIterate(
+	ctx context.Context,
+	start, end roachpb.Key,
+	iterKind MVCCIterKind,
+	keyTypes IterKeyType,
+	readCategory ReadCategory,
+	f func(MVCCKeyValue, MVCCRangeKeyStack) error,
+) error {
+	return iterateOnReader(ctx, p, start, end, iterKind, keyTypes, readCategory, f)
 }
+
+// NewBatch implements the Engine interface.
 func (p *Pebble) NewBatch() Batch {
-	//TODO implement me
-	panic("implement me")
+	return newPebbleBatch(p)
+}
+
+// NewMVCCIterator implements the Engine interface.
+func (p *Pebble) NewMVCCIterator(
+	ctx context.Context, iterKind MVCCIterKind, opts IterOptions,
+) (MVCCIterator, error) {
+	if p.Closed() {
+		return nil, errClosed
+	}
+	return newPebbleIterator(p.snapshot(), nil, opts), nil
 }
 
-func (p *Pebble) NewMVCCIterator(ctx context.Context, iterKind MVCCIterKind, opts IterOptions) (MVCCIterator, error) {
-	//TODO implement me
-	panic("implement me")
+// NewSnapshot implements the Engine interface. The snapshot captures the
+// current run of the engine's data.
+func (p *Pebble) NewSnapshot() Reader {
+	return &pebbleSnapshot{data: p.snapshot()}
+}
+
+// IngestSSTs implements the Engine interface.
+func (p *Pebble) IngestSSTs(ctx context.Context, ssts [][]byte) error {
+	type decodedSST struct {
+		rangeDels []roachpb.Span
+		ops       []batchOp
+	}
+	decoded := make([]decodedSST, 0, len(ssts))
+	for _, sst := range ssts {
+		rangeDels, ops, err := decodeSST(sst)
+		if err != nil {
+			return err
+		}
+		decoded = append(decoded, decodedSST{rangeDels: rangeDels, ops: ops})
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.mu.closed {
+		return errClosed
+	}
+	data := p.mu.data
+	for _, sst := range decoded {
+		if len(sst.rangeDels) > 0 {
+			kept := make([]memKV, 0, len(data))
+			for _, kv := range data {
+				if !spansContain(sst.rangeDels, kv.key.Key) {
+					kept = append(kept, kv)
+				}
+			}
+			data = kept
+		}
+		data = mergeOps(data, sst.ops)
+	}
+	p.mu.data = data
+	return nil
 }
 
+// spansContain returns whether one of the spans contains the key.
+func spansContain(spans []roachpb.Span, key roachpb.Key) bool {
+	for _, span := range spans {
+		if key.Compare(span.Key) >= 0 && key.Compare(span.EndKey) < 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// PutMVCC implements the Engine interface.
 func (p *Pebble) PutMVCC(key MVCCKey, value MVCCValue) error {
-	//TODO implement me
-	panic("implement me")
+	if key.Timestamp.IsEmpty() {
+		return errors.New("PutMVCC timestamp is empty")
+	}
+	encValue, err := EncodeMVCCValue(value)
+	if err != nil {
+		return err
+	}
+	return p.apply([]batchOp{{key: key.Clone(), value: append([]byte(nil), encValue...)}})
+}
+
+// PutUnversioned implements the Engine interface.
+func (p *Pebble) PutUnversioned(key roachpb.Key, value []byte) error {
+	return p.apply([]batchOp{{key: MakeMVCCMetadataKey(key).Clone(), value: append([]byte(nil), value...)}})
+}
+
+// ClearMVCC implements the Engine interface.
+func (p *Pebble) ClearMVCC(key MVCCKey) error {
+	if key.Timestamp.IsEmpty() {
+		return errors.New("ClearMVCC timestamp is empty")
+	}
+	return p.apply([]batchOp{{key: key.Clone(), delete: true}})
 }
 
+// ClearUnversioned implements the Engine interface.
+func (p *Pebble) ClearUnversioned(key roachpb.Key) error {
+	return p.apply([]batchOp{{key: MakeMVCCMetadataKey(key).Clone(), delete: true}})
+}
+
+// BufferedSize implements the Engine interface.
 func (p *Pebble) BufferedSize() int {
-	//TODO implement me
-	panic("implement me")
+	return 0
 }
 
+// LogLogicalOp implements the Engine interface.
+func (p *Pebble) LogLogicalOp(op MVCCLogicalOpType, details MVCCLogicalOpDetails) {
+	// No-op.
+}
+
+// Compact implements the Engine interface.
 func (p *Pebble) Compact() error {
-	//TODO implement me
-	panic("implement me")
+	return nil
 }
 
+// Attrs implements the Engine interface.
+func (p *Pebble) Attrs() roachpb.Attributes {
+	return p.cfg.Attrs
+}
+
+// Capacity implements the Engine interface. The engine's data is accounted
+// for by its logical size. An in-memory engine's capacity is its configured
+// maximum size; the capacity of an engine on the filesystem is that of the
+// filesystem, limited by the maximum size if one is configured.
+func (p *Pebble) Capacity() (roachpb.StoreCapacity, error) {
+	var used int64
+	for _, kv := range p.snapshot() {
+		used += int64(len(kv.key.Key) + len(kv.value))
+		if kv.key.IsValue() {
+			used += MVCCVersionTimestampSize
+		}
+	}
+
+	capacity := p.cfg.MaxSize
+	available := capacity - used
+	if p.cfg.FS != nil {
+		du, err := vfs.GetDiskUsage(p.cfg.Dir)
+		if err != nil {
+			return roachpb.StoreCapacity{}, err
+		}
+		fsCapacity := int64(du.TotalBytes)
+		fsAvailable := int64(du.AvailBytes)
+		if capacity == 0 || capacity > fsCapacity {
+			capacity = fsCapacity
+			available = fsAvailable
+		} else if available > fsAvailable {
+			available = fsAvailable
+		}
+	}
+	if available < 0 {
+		available = 0
+	}
+	return roachpb.StoreCapacity{
+		Capacity:  capacity,
+		Available: available,
+		Used:      used,
+	}, nil
+}
+
+// Flush implements the Engine interface.
 func (p *Pebble) Flush() error {
-	//TODO implement me
-	panic("implement me")
+	return nil
+}
+
+// apply atomically applies the given operations, in order, to the engine.
+func (p *Pebble) apply(ops []batchOp) error {
+	if len(ops) == 0 {
+		return nil
+	}
+	// Later operations on the same key supersede earlier ones, so a stable
+	// sort followed by keeping the last entry of each run yields the net
+	// effect of the batch.
+	sorted := make([]batchOp, len(ops))
+	copy(sorted, ops)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].key.Less(sorted[j].key)
+	})
+	deduped := sorted[:0]
+	for i := range sorted {
+		if n := len(deduped); n > 0 && deduped[n-1].key.Equal(sorted[i].key) {
+			deduped[n-1] = sorted[i]
+			continue
+		}
+		deduped = append(deduped, sorted[i])
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.mu.closed {
+		return errClosed
+	}
+	p.mu.data = mergeOps(p.mu.data, deduped)
+	return nil
+}
+
+// mergeOps returns a new sorted run containing data with the sorted,
+// de-duplicated ops applied. Neither input is modified.
+func mergeOps(data []memKV, ops []batchOp) []memKV {
+	merged := make([]memKV, 0, len(data)+len(ops))
+	i, j := 0, 0
+	for i < len(data) || j < len(ops) {
+		switch {
+		case j == len(ops):
+			merged = append(merged, data[i])
+			i++
+		case i == len(data) || ops[j].key.Less(data[i].key):
+			if !ops[j].delete {
+				merged = append(merged, memKV{key: ops[j].key, value: ops[j].value})
+			}
+			j++
+		case data[i].key.Less(ops[j].key):
+			merged = append(merged, data[i])
+			i++
+		default:
+			// Same key: the operation replaces or deletes the existing entry.
+			if !ops[j].delete {
+				merged = append(merged, memKV{key: ops[j].key, value: ops[j].value})
+			}
+			i++
+			j++
+		}
+	}
+	return merged
+}
+
+// pebbleSnapshot is a read-only view of the engine's data as of the time of
+// its creation. It is unaffected by the subsequent writes to the engine.
+type pebbleSnapshot struct {
+	data   []memKV
+	closed bool
+}
+
+var _ Reader = &pebbleSnapshot{}
+
+// Close implements the Reader interface.
+func (s *pebbleSnapshot) Close() {
+	s.closed = true
+	s.data = nil
+}
+
+// Closed implements the Reader interface.
+func (s *pebbleSnapshot) Closed() bool {
+	return s.closed
+}
+
+// MVCCIterate implements the Reader interface.
+func (s *pebbleSnapshot) MVCCIterate(
+	ctx context.Context,
+	start, end roachpb.Key,
+	iterKind MVCCIterKind,
+	keyTypes IterKeyType,
+	readCategory ReadCategory,
+	f func(MVCCKeyValue, MVCCRangeKeyStack) error,
+) error {
+	return iterateOnReader(ctx, s, start, end, iterKind, keyTypes, readCategory, f)
+}
+
+// NewMVCCIterator implements the Reader interface.
+func (s *pebbleSnapshot) NewMVCCIterator(
+	ctx context.Context, iterKind MVCCIterKind, opts IterOptions,
+) (MVCCIterator, error) {
+	if s.closed {
+		return nil, errors.New("attempted to iterate over a closed snapshot")
+	}
+	return newPebbleIterator(s.data, nil, opts), nil
+}
+
+// iterateOnReader implements MVCCIterate on top of a Reader's iterator.
+func iterateOnReader(
+	ctx context.Context,
+	reader Reader,
+	start, end roachpb.Key,
+	iterKind MVCCIterKind,
+	keyTypes IterKeyType,
+	readCategory ReadCategory,
+	f func(MVCCKeyValue, MVCCRangeKeyStack) error,
+) error {
+	if reader.Closed() {
+		return errClosed
+	}
+	it, err := reader.NewMVCCIterator(ctx, iterKind, IterOptions{
+		LowerBound:   start,
+		UpperBound:   end,
+		KeyTypes:     keyTypes,
+		ReadCategory: readCategory,
+	})
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+	for it.SeekGE(MakeMVCCMetadataKey(start)); ; it.Next() {
+		if ok, err := it.Valid(); err != nil {
+			return err
+		} else if !ok {
+			break
+		}
+		v, err := it.UnsafeValue()
+		if err != nil {
+			return err
+		}
+		kv := MVCCKeyValue{Key: it.UnsafeKey().Clone(), Value: append([]byte(nil), v...)}
+		if err := f(kv, MVCCRangeKeyStack{}); err != nil {
+			return err
+		}
+	}
+	return nil
 }
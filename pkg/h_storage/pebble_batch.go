@@ -0,0 +1,175 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"sort"
+)
+
+// batchOp is a single mutation buffered in a pebbleBatch.
+type batchOp struct {
+	key    MVCCKey
+	value  []byte
+	delete bool
+}
+
+// Wrapper struct around a pebble.Batch.
+//
+// The batch is indexed: reads through the batch observe the batch's own
+// writes layered over the engine state captured when the batch was created.
+type pebbleBatch struct {
+	parent *Pebble
+	// base is the engine state the batch reads through to.
+	base []memKV
+	// ops are the mutations in the order they were written; they are applied
+	// to the engine in this order on Commit.
+	ops []batchOp
+	// index is the sorted, de-duplicated view of ops used by iterators.
+	index  []batchOp
+	size   int
+	closed bool
+}
+
+var _ Batch = &pebbleBatch{}
+
+func newPebbleBatch(parent *Pebble) *pebbleBatch {
+	return &pebbleBatch{parent: parent, base: parent.snapshot()}
+}
+
+// Close implements the Batch interface.
+func (b *pebbleBatch) Close() {
+	b.closed = true
+}
+
+// Closed implements the Batch interface.
+func (b *pebbleBatch) Closed() bool {
+	return b.closed
+}
+
+// MVCCIterate implements the Batch interface.
+func (b *pebbleBatch) MVCCIterate(
+	ctx context.Context,
+	start, end roachpb.Key,
+	iterKind MVCCIterKind,
+	keyTypes IterKeyType,
+	readCategory ReadCategory,
+	f func(MVCCKeyValue, MVCCRangeKeyStack) error,
+) error {
+	return iterateOnReader(ctx, b, start, end, iterKind, keyTypes, readCategory, f)
+}
+
+// NewMVCCIterator implements the Batch interface.
+func (b *pebbleBatch) NewMVCCIterator(
+	ctx context.Context, iterKind MVCCIterKind, opts IterOptions,
+) (MVCCIterator, error) {
+	if b.closed {
+		return nil, errors.New("attempted to iterate over a closed batch")
+	}
+	return newPebbleIterator(b.base, b.index, opts), nil
+}
+
+// NewBatchOnlyMVCCIterator implements the Batch interface.
+func (b *pebbleBatch) NewBatchOnlyMVCCIterator(
+	ctx context.Context, opts IterOptions,
+) (MVCCIterator, error) {
+	if b.closed {
+		return nil, errors.New("attempted to iterate over a closed batch")
+	}
+	return newPebbleIterator(nil, b.index, opts), nil
+}
+
+// PutMVCC implements the Batch interface.
+func (b *pebbleBatch) PutMVCC(key MVCCKey, value MVCCValue) error {
+	if key.Timestamp.IsEmpty() {
+		return errors.New("PutMVCC timestamp is empty")
+	}
+	encValue, err := EncodeMVCCValue(value)
+	if err != nil {
+		return err
+	}
+	b.add(batchOp{key: key.Clone(), value: append([]byte(nil), encValue...)})
+	return nil
+}
+
+// PutUnversioned implements the Batch interface.
+func (b *pebbleBatch) PutUnversioned(key roachpb.Key, value []byte) error {
+	b.add(batchOp{key: MakeMVCCMetadataKey(key).Clone(), value: append([]byte(nil), value...)})
+	return nil
+}
+
+// ClearMVCC implements the Batch interface.
+func (b *pebbleBatch) ClearMVCC(key MVCCKey) error {
+	if key.Timestamp.IsEmpty() {
+		return errors.New("ClearMVCC timestamp is empty")
+	}
+	b.add(batchOp{key: key.Clone(), delete: true})
+	return nil
+}
+
+// ClearUnversioned implements the Batch interface.
+func (b *pebbleBatch) ClearUnversioned(key roachpb.Key) error {
+	b.add(batchOp{key: MakeMVCCMetadataKey(key).Clone(), delete: true})
+	return nil
+}
+
+func (b *pebbleBatch) add(op batchOp) {
+	b.ops = append(b.ops, op)
+	b.size += len(op.key.Key) + len(op.value)
+	i := sort.Search(len(b.index), func(i int) bool {
+		return !b.index[i].key.Less(op.key)
+	})
+	if i < len(b.index) && b.index[i].key.Equal(op.key) {
+		b.index[i] = op
+		return
+	}
+	// Copy-on-write so that open iterators keep their view of the batch.
+	index := make([]batchOp, 0, len(b.index)+1)
+	index = append(index, b.index[:i]...)
+	index = append(index, op)
+	index = append(index, b.index[i:]...)
+	b.index = index
+}
+
+// BufferedSize implements the Batch interface.
+func (b *pebbleBatch) BufferedSize() int {
+	return b.size
+}
+
+// LogLogicalOp implements the Batch interface.
+func (b *pebbleBatch) LogLogicalOp(op MVCCLogicalOpType, details MVCCLogicalOpDetails) {
+	// No-op.
+}
+
+// Commit implements the Batch interface.
+func (b *pebbleBatch) Commit(sync bool) error {
+	if b.closed {
+		return errors.New("attempted to commit a closed batch")
+	}
+	return b.parent.apply(b.ops)
+}
+
+// CommitNoSyncWait implements the Batch interface.
+func (b *pebbleBatch) CommitNoSyncWait() error {
+	return b.Commit(false)
+}
+
+// SyncWait implements the Batch interface.
+func (b *pebbleBatch) SyncWait() error {
+	return nil
+}
+
+// Empty implements the Batch interface.
+func (b *pebbleBatch) Empty() bool {
+	return len(b.ops) == 0
+}
+
+// Count implements the Batch interface.
+func (b *pebbleBatch) Count() uint32 {
+	return uint32(len(b.ops))
+}
+
+// Len implements the Batch interface.
+func (b *pebbleBatch) Len() int {
+	return b.size
+}
@@ -0,0 +1,192 @@
+package storage
+
+import (
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"sort"
+)
+
+// pebbleIterator is a wrapper around a pebble.Iterator, which implements the
+// MVCCIterator interface.
+//
+// It merges the engine state it was created over with the (optional) indexed
+// writes of a batch; the batch writes shadow the engine state and deletions
+// in the batch hide the corresponding engine keys.
+type pebbleIterator struct {
+	base    []memKV
+	overlay []batchOp
+	opts    IterOptions
+
+	// Positions in base and overlay.
+	bi, oi int
+	// The currently exposed entry.
+	cur   memKV
+	valid bool
+	// prefix is the roachpb.Key that iteration is restricted to, when
+	// opts.Prefix is set.
+	prefix roachpb.Key
+}
+
+var _ MVCCIterator = &pebbleIterator{}
+
+func newPebbleIterator(base []memKV, overlay []batchOp, opts IterOptions) *pebbleIterator {
+	return &pebbleIterator{base: base, overlay: overlay, opts: opts}
+}
+
+// Close implements the MVCCIterator interface.
+func (p *pebbleIterator) Close() {
+	p.base, p.overlay = nil, nil
+	p.valid = false
+}
+
+// SeekGE implements the MVCCIterator interface.
+func (p *pebbleIterator) SeekGE(key MVCCKey) {
+	if len(p.opts.LowerBound) > 0 && key.Key.Compare(p.opts.LowerBound) < 0 {
+		key = MakeMVCCMetadataKey(p.opts.LowerBound)
+	}
+	if p.opts.Prefix {
+		p.prefix = key.Key
+	}
+	p.bi = sort.Search(len(p.base), func(i int) bool {
+		return !p.base[i].key.Less(key)
+	})
+	p.oi = sort.Search(len(p.overlay), func(i int) bool {
+		return !p.overlay[i].key.Less(key)
+	})
+	p.settle()
+}
+
+// settle positions the iterator on the next visible entry at or after the
+// current base and overlay positions.
+func (p *pebbleIterator) settle() {
+	for {
+		p.valid = false
+		var next memKV
+		switch {
+		case p.bi >= len(p.base) && p.oi >= len(p.overlay):
+			return
+		case p.oi >= len(p.overlay):
+			next = p.base[p.bi]
+			p.bi++
+		case p.bi >= len(p.base) || p.overlay[p.oi].key.Less(p.base[p.bi].key):
+			op := p.overlay[p.oi]
+			p.oi++
+			if op.delete {
+				continue
+			}
+			next = memKV{key: op.key, value: op.value}
+		default:
+			op := p.overlay[p.oi]
+			if op.key.Equal(p.base[p.bi].key) {
+				// The batch write shadows the engine's version of the key.
+				p.bi++
+				p.oi++
+				if op.delete {
+					continue
+				}
+				next = memKV{key: op.key, value: op.value}
+			} else {
+				next = p.base[p.bi]
+				p.bi++
+			}
+		}
+		if !p.withinBounds(next.key) {
+			return
+		}
+		if !p.withinTimeBounds(next.key) {
+			continue
+		}
+		p.cur = next
+		p.valid = true
+		return
+	}
+}
+
+func (p *pebbleIterator) withinBounds(key MVCCKey) bool {
+	if p.opts.Prefix && !key.Key.Equal(p.prefix) {
+		return false
+	}
+	if len(p.opts.UpperBound) > 0 && key.Key.Compare(p.opts.UpperBound) >= 0 {
+		return false
+	}
+	return true
+}
+
+// withinTimeBounds implements the time-bound iteration described on
+// IterOptions.MinTimestamp: intents and versions outside of the time range
+// are not surfaced.
+func (p *pebbleIterator) withinTimeBounds(key MVCCKey) bool {
+	if p.opts.MinTimestamp.IsEmpty() && p.opts.MaxTimestamp.IsEmpty() {
+		return true
+	}
+	if !key.IsValue() {
+		return false
+	}
+	if key.Timestamp.Less(p.opts.MinTimestamp) {
+		return false
+	}
+	return p.opts.MaxTimestamp.IsEmpty() || key.Timestamp.LessEq(p.opts.MaxTimestamp)
+}
+
+// Valid implements the MVCCIterator interface.
+func (p *pebbleIterator) Valid() (bool, error) {
+	return p.valid, nil
+}
+
+// Next implements the MVCCIterator interface.
+func (p *pebbleIterator) Next() {
+	if !p.valid {
+		return
+	}
+	p.settle()
+}
+
+// NextKey implements the MVCCIterator interface.
+func (p *pebbleIterator) NextKey() {
+	if !p.valid {
+		return
+	}
+	cur := p.cur.key.Key
+	for p.Next(); p.valid && p.cur.key.Key.Equal(cur); p.Next() {
+	}
+}
+
+// UnsafeKey implements the MVCCIterator interface.
+func (p *pebbleIterator) UnsafeKey() MVCCKey {
+	return p.cur.key
+}
+
+// UnsafeValue implements the MVCCIterator interface.
+func (p *pebbleIterator) UnsafeValue() ([]byte, error) {
+	return p.cur.value, nil
+}
+
+// MVCCValueLenAndIsTombstone implements the MVCCIterator interface.
+func (p *pebbleIterator) MVCCValueLenAndIsTombstone() (int, bool, error) {
+	return len(p.cur.value), len(p.cur.value) == 0, nil
+}
+
+// ValueLen implements the MVCCIterator interface.
+func (p *pebbleIterator) ValueLen() int {
+	return len(p.cur.value)
+}
+
+// HasPointAndRange implements the MVCCIterator interface. Range keys are not
+// supported by this engine, so the iterator only ever exposes point keys.
+func (p *pebbleIterator) HasPointAndRange() (bool, bool) {
+	return true, false
+}
+
+// RangeBounds implements the MVCCIterator interface.
+func (p *pebbleIterator) RangeBounds() roachpb.Span {
+	return roachpb.Span{}
+}
+
+// RangeKeys implements the MVCCIterator interface.
+func (p *pebbleIterator) RangeKeys() MVCCRangeKeyStack {
+	return MVCCRangeKeyStack{}
+}
+
+// RangeKeyChanged implements the MVCCIterator interface.
+func (p *pebbleIterator) RangeKeyChanged() bool {
+	return false
+}
@@ -1 +1,245 @@
 package storage
+
+import (
+	"fmt"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvpb"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/concurrency/lock"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/dborchard/tiny_crdb/pkg/h_storage/enginepb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/protoutil"
+)
+
+// pebbleMVCCScanner handles MVCCScan / MVCCGet using a Pebble iterator.
+//
+// For every user key in [start, end) the scanner decides which version of the
+// key is visible at the read timestamp:
+//
+//   - an inline value is always visible.
+//   - the reading transaction's own intent is visible if it was written at or
+//     below the transaction's current sequence number and that sequence number
+//     has not been rolled back. Otherwise the most recent value in the intent
+//     history that satisfies the same conditions is visible. If none does, the
+//     committed value beneath the intent is read.
+//   - another transaction's intent at or below the read timestamp is a
+//     conflict, as is any intent of another transaction if the scan locks the
+//     keys it reads. In consistent mode the conflicting intents are returned
+//     as a WriteIntentError; in inconsistent mode they are returned alongside
+//     the committed values beneath them. In skip-locked mode, the keys with
+//     conflicting intents, or with conflicting locks in the lock table, are
+//     skipped.
+//   - otherwise, the most recent committed version at or below the read
+//     timestamp is visible. Deletion tombstones are not returned. If the scan
+//     locks the keys it reads and a key has a committed version above the
+//     read timestamp, the scan fails with a WriteTooOldError: the lock could
+//     not protect the value that was read.
+type pebbleMVCCScanner struct {
+	parent MVCCIterator
+	// start and end are the bounds of the scan.
+	start, end roachpb.Key
+	// ts is the read timestamp.
+	ts hlc.Timestamp
+	// txn is the reading transaction, if any.
+	txn          *roachpb.Transaction
+	inconsistent bool
+	// maxKeys is the maximum number of results; zero means unbounded.
+	maxKeys int64
+	// str is the strength with which the scan locks the keys that it reads.
+	str lock.Strength
+	// skipLocked is set if the scan skips the keys that are locked by other
+	// transactions, in which case lockTable is consulted for the locks that
+	// are not found in storage.
+	skipLocked bool
+	lockTable  LockTableView
+
+	results []roachpb.KeyValue
+	// intents are the intents encountered in inconsistent mode.
+	intents []roachpb.Intent
+	// conflicts are the conflicting intents encountered in consistent mode.
+	conflicts []roachpb.Intent
+	// mostRecentTS is the timestamp of the most recent committed version
+	// above the read timestamp encountered by a locking scan, if any.
+	mostRecentTS hlc.Timestamp
+	resumeSpan   *roachpb.Span
+}
+
+func newPebbleMVCCScanner(
+	iter MVCCIterator,
+	start, end roachpb.Key,
+	ts hlc.Timestamp,
+	txn *roachpb.Transaction,
+	inconsistent bool,
+) *pebbleMVCCScanner {
+	return &pebbleMVCCScanner{
+		parent:       iter,
+		start:        start,
+		end:          end,
+		ts:           ts,
+		txn:          txn,
+		inconsistent: inconsistent,
+	}
+}
+
+// setLocking configures the locking strength and skip-locked behavior of the
+// scan.
+func (p *pebbleMVCCScanner) setLocking(str lock.Strength, skipLocked bool, lockTable LockTableView) {
+	p.str = str
+	p.skipLocked = skipLocked
+	p.lockTable = lockTable
+}
+
+// scan iterates until the end of the span or until maxKeys results have been
+// collected.
+func (p *pebbleMVCCScanner) scan() error {
+	p.parent.SeekGE(MakeMVCCMetadataKey(p.start))
+	for {
+		if ok, err := p.parent.Valid(); err != nil {
+			return err
+		} else if !ok {
+			break
+		}
+		key := p.parent.UnsafeKey().Key
+		if key.Compare(p.end) >= 0 {
+			break
+		}
+		if p.maxKeys > 0 && int64(len(p.results)) >= p.maxKeys {
+			p.resumeSpan = &roachpb.Span{Key: append(roachpb.Key(nil), key...), EndKey: p.end}
+			break
+		}
+		if err := p.getOne(); err != nil {
+			return err
+		}
+	}
+	if len(p.conflicts) > 0 {
+		return &kvpb.WriteIntentError{Intents: p.conflicts}
+	}
+	if !p.mostRecentTS.IsEmpty() {
+		return kvpb.NewWriteTooOldError(p.ts, p.mostRecentTS.Next())
+	}
+	return nil
+}
+
+// getOne processes the key the iterator is positioned on, adding its visible
+// value (if any) to the results, and leaves the iterator positioned on the
+// next key.
+func (p *pebbleMVCCScanner) getOne() error {
+	unsafeKey := p.parent.UnsafeKey()
+	key := append(roachpb.Key(nil), unsafeKey.Key...)
+	if p.skipLocked && p.lockTable != nil {
+		if locked, _ := p.lockTable.IsKeyLockedByConflictingTxn(key, p.str); locked {
+			// The key is locked by another transaction in the lock table.
+			p.parent.NextKey()
+			return nil
+		}
+	}
+	if unsafeKey.IsValue() {
+		// There is no intent on the key.
+		if p.str != lock.None && p.ts.Less(unsafeKey.Timestamp) {
+			// A locking read cannot lock a value that was overwritten after
+			// its timestamp.
+			p.mostRecentTS.Forward(unsafeKey.Timestamp)
+		}
+		return p.seekVersion(key, p.ts, hlc.Timestamp{})
+	}
+
+	raw, err := p.parent.UnsafeValue()
+	if err != nil {
+		return err
+	}
+	var meta enginepb.MVCCMetadata
+	if err := protoutil.Unmarshal(raw, &meta); err != nil {
+		return err
+	}
+	if meta.IsInline() {
+		if len(meta.RawBytes) > 0 {
+			p.addResult(key, roachpb.Value{RawBytes: append([]byte(nil), meta.RawBytes...)})
+		}
+		p.parent.NextKey()
+		return nil
+	}
+	if meta.Txn == nil {
+		return fmt.Errorf("intent on key %s without transaction", key)
+	}
+
+	if p.txn != nil && meta.Txn.ID == p.txn.ID {
+		// The intent is our own.
+		if meta.Txn.Epoch > p.txn.Epoch {
+			return fmt.Errorf("failed to read with epoch %d due to a write intent with epoch %d",
+				p.txn.Epoch, meta.Txn.Epoch)
+		}
+		if meta.Txn.Epoch == p.txn.Epoch {
+			if p.txn.Sequence >= meta.Txn.Sequence &&
+				!enginepb.TxnSeqIsIgnored(meta.Txn.Sequence, p.txn.IgnoredSeqNums) {
+				// Our most recent write is visible, regardless of the read
+				// timestamp.
+				return p.seekVersion(key, meta.Timestamp, hlc.Timestamp{})
+			}
+			// Our most recent write is either from a later sequence number or
+			// was rolled back. Look for an earlier visible write in the intent
+			// history.
+			if e, ok := meta.GetPrevIntentSeq(p.txn.Sequence+1, p.txn.IgnoredSeqNums); ok {
+				if len(e.Value) > 0 {
+					p.addResult(key, roachpb.Value{RawBytes: append([]byte(nil), e.Value...), Timestamp: meta.Timestamp})
+				}
+				p.parent.NextKey()
+				return nil
+			}
+		}
+		// None of our writes to this key are visible; read the committed value
+		// beneath the intent.
+		return p.seekVersion(key, p.ts, meta.Timestamp)
+	}
+
+	if p.str != lock.None || meta.Timestamp.LessEq(p.ts) {
+		// The intent of another transaction is in the way.
+		intent := roachpb.MakeIntent(meta.Txn, key)
+		if p.skipLocked {
+			p.parent.NextKey()
+			return nil
+		}
+		if !p.inconsistent {
+			p.conflicts = append(p.conflicts, intent)
+			p.parent.NextKey()
+			return nil
+		}
+		p.intents = append(p.intents, intent)
+	}
+	return p.seekVersion(key, p.ts, meta.Timestamp)
+}
+
+// seekVersion positions the iterator on the most recent version of key at or
+// below ts, skipping the provisional version at skipTS if non-empty. The
+// version is added to the results unless it is a deletion tombstone, and the
+// iterator is advanced to the next key.
+func (p *pebbleMVCCScanner) seekVersion(key roachpb.Key, ts, skipTS hlc.Timestamp) error {
+	if ts.IsEmpty() {
+		p.parent.NextKey()
+		return nil
+	}
+	for p.parent.SeekGE(MVCCKey{Key: key, Timestamp: ts}); ; p.parent.Next() {
+		if ok, err := p.parent.Valid(); err != nil || !ok {
+			return err
+		}
+		unsafeKey := p.parent.UnsafeKey()
+		if !unsafeKey.Key.Equal(key) {
+			// No visible version; the iterator is on the next key.
+			return nil
+		}
+		if !unsafeKey.IsValue() || (!skipTS.IsEmpty() && unsafeKey.Timestamp == skipTS) {
+			continue
+		}
+		v, err := p.parent.UnsafeValue()
+		if err != nil {
+			return err
+		}
+		if len(v) > 0 {
+			p.addResult(key, roachpb.Value{RawBytes: append([]byte(nil), v...), Timestamp: unsafeKey.Timestamp})
+		}
+		p.parent.NextKey()
+		return nil
+	}
+}
+
+func (p *pebbleMVCCScanner) addResult(key roachpb.Key, value roachpb.Value) {
+	p.results = append(p.results, roachpb.KeyValue{Key: key, Value: value})
+}
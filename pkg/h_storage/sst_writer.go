@@ -0,0 +1,144 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+)
+
+// sstVersion is the first byte of an SSTable written by an SSTWriter.
+const sstVersion byte = 1
+
+// SSTWriter writes SSTables: sorted runs of keys, along with range deletions,
+// which an engine ingests atomically through IngestSSTs. The encoding of the
+// entries is that of batch representations.
+//
+// SSTWriter implements the Writer interface, but keys must be written in
+// strictly increasing order.
+type SSTWriter struct {
+	data    []byte
+	lastKey MVCCKey
+	hasKey  bool
+	// DataSize tracks the total key and value bytes added so far.
+	DataSize int64
+}
+
+// MakeIngestionSSTWriter creates a new SSTWriter tailored for ingestion SSTs.
+func MakeIngestionSSTWriter() SSTWriter {
+	return SSTWriter{data: []byte{sstVersion}}
+}
+
+var _ Writer = &SSTWriter{}
+
+// PutRawMVCC sets the key to the encoded value.
+func (fw *SSTWriter) PutRawMVCC(key MVCCKey, value []byte) error {
+	return fw.addEntry(reprKindSet, key, value)
+}
+
+// PutMVCC implements the Writer interface.
+func (fw *SSTWriter) PutMVCC(key MVCCKey, value MVCCValue) error {
+	if key.Timestamp.IsEmpty() {
+		return errors.New("PutMVCC timestamp is empty")
+	}
+	encValue, err := EncodeMVCCValue(value)
+	if err != nil {
+		return err
+	}
+	return fw.addEntry(reprKindSet, key, encValue)
+}
+
+// PutUnversioned implements the Writer interface.
+func (fw *SSTWriter) PutUnversioned(key roachpb.Key, value []byte) error {
+	return fw.addEntry(reprKindSet, MakeMVCCMetadataKey(key), value)
+}
+
+// ClearMVCC implements the Writer interface.
+func (fw *SSTWriter) ClearMVCC(key MVCCKey) error {
+	if key.Timestamp.IsEmpty() {
+		return errors.New("ClearMVCC timestamp is empty")
+	}
+	return fw.addEntry(reprKindDelete, key, nil)
+}
+
+// ClearUnversioned implements the Writer interface.
+func (fw *SSTWriter) ClearUnversioned(key roachpb.Key) error {
+	return fw.addEntry(reprKindDelete, MakeMVCCMetadataKey(key), nil)
+}
+
+// BufferedSize implements the Writer interface.
+func (fw *SSTWriter) BufferedSize() int {
+	return 0
+}
+
+// LogLogicalOp implements the Writer interface.
+func (fw *SSTWriter) LogLogicalOp(op MVCCLogicalOpType, details MVCCLogicalOpDetails) {
+	// No-op.
+}
+
+// addEntry adds the point entry of the kind to the SSTable. Keys must be
+// added in strictly increasing order.
+func (fw *SSTWriter) addEntry(kind byte, key MVCCKey, value []byte) error {
+	if fw.data == nil {
+		return errors.New("cannot write to a finished or uninitialized SSTWriter")
+	}
+	if fw.hasKey && !fw.lastKey.Less(key) {
+		return fmt.Errorf("keys must be added in strictly increasing order: %s <= %s", key, fw.lastKey)
+	}
+	fw.lastKey = key.Clone()
+	fw.hasKey = true
+	fw.DataSize += int64(len(key.Key) + len(value))
+	fw.data = appendReprEntry(fw.data, kind, key, value)
+	return nil
+}
+
+// ClearRawRange deletes all the keys in [start, end), at all timestamps,
+// from the engine ingesting the SSTable. The keys of the SSTable itself are
+// not deleted.
+func (fw *SSTWriter) ClearRawRange(start, end roachpb.Key) error {
+	if fw.data == nil {
+		return errors.New("cannot write to a finished or uninitialized SSTWriter")
+	}
+	if end.Compare(start) <= 0 {
+		return fmt.Errorf("invalid range deletion [%s, %s)", start, end)
+	}
+	fw.DataSize += int64(len(start) + len(end))
+	fw.data = appendReprEntry(fw.data, reprKindRangeDelete, MakeMVCCMetadataKey(start), end)
+	return nil
+}
+
+// Finish finalizes the SSTable and returns its contents. The writer must not
+// be used afterwards.
+func (fw *SSTWriter) Finish() ([]byte, error) {
+	if fw.data == nil {
+		return nil, errors.New("cannot call Finish on a finished or uninitialized SSTWriter")
+	}
+	data := fw.data
+	fw.data = nil
+	return data, nil
+}
+
+// decodeSST decodes the range deletions and the keys of an SSTable.
+func decodeSST(sst []byte) (rangeDels []roachpb.Span, ops []batchOp, err error) {
+	if len(sst) == 0 || sst[0] != sstVersion {
+		return nil, nil, errors.New("invalid sstable")
+	}
+	sst = sst[1:]
+	for len(sst) > 0 {
+		kind, key, value, rest, err := decodeReprEntry(sst)
+		if err != nil {
+			return nil, nil, err
+		}
+		switch kind {
+		case reprKindSet:
+			ops = append(ops, batchOp{key: key, value: value})
+		case reprKindDelete:
+			ops = append(ops, batchOp{key: key, delete: true})
+		case reprKindRangeDelete:
+			rangeDels = append(rangeDels, roachpb.Span{Key: key.Key, EndKey: roachpb.Key(value)})
+		default:
+			return nil, nil, fmt.Errorf("unexpected entry kind %d in sstable", kind)
+		}
+		sst = rest
+	}
+	return rangeDels, ops, nil
+}
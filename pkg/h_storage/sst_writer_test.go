@@ -0,0 +1,52 @@
+package storage
+
+import (
+	"context"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+// TestIngestSSTs verifies that the range deletions of an ingested SSTable
+// clear the existing data of the engine but not the keys of the SSTable, and
+// that snapshots taken before the ingestion don't observe it.
+func TestIngestSSTs(t *testing.T) {
+	ctx := context.Background()
+	eng, err := NewPebble(ctx, engineConfig{})
+	require.NoError(t, err)
+	defer eng.Close()
+
+	ts := hlc.Timestamp{WallTime: 1}
+	for _, k := range []string{"a", "b", "d"} {
+		require.NoError(t, MVCCPut(ctx, eng, roachpb.Key(k), ts, roachpb.MakeValueFromString("old"), MVCCWriteOptions{}))
+	}
+	snap := eng.NewSnapshot()
+	defer snap.Close()
+
+	value, err := EncodeMVCCValue(MVCCValue{Value: roachpb.MakeValueFromString("new")})
+	require.NoError(t, err)
+	w := MakeIngestionSSTWriter()
+	require.NoError(t, w.ClearRawRange(roachpb.Key("a"), roachpb.Key("c")))
+	require.NoError(t, w.PutRawMVCC(MVCCKey{Key: roachpb.Key("b"), Timestamp: ts}, value))
+	require.Error(t, w.PutRawMVCC(MVCCKey{Key: roachpb.Key("a"), Timestamp: ts}, value))
+	sst, err := w.Finish()
+	require.NoError(t, err)
+	require.NoError(t, eng.IngestSSTs(ctx, [][]byte{sst}))
+
+	read := func(r Reader, key string) string {
+		res, err := MVCCGet(ctx, r, roachpb.Key(key), ts, MVCCGetOptions{})
+		require.NoError(t, err)
+		if res.Value == nil {
+			return ""
+		}
+		b, err := res.Value.GetBytes()
+		require.NoError(t, err)
+		return string(b)
+	}
+	require.Equal(t, "", read(eng, "a"))
+	require.Equal(t, "new", read(eng, "b"))
+	require.Equal(t, "old", read(eng, "d"))
+	require.Equal(t, "old", read(snap, "a"))
+	require.Equal(t, "old", read(snap, "b"))
+}
@@ -0,0 +1,22 @@
+//go:build !windows
+
+package vfs
+
+import "golang.org/x/sys/unix"
+
+// GetDiskUsage returns disk space statistics for the filesystem that
+// contains the given path.
+func GetDiskUsage(path string) (DiskUsage, error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(path, &stat); err != nil {
+		return DiskUsage{}, err
+	}
+	freeBytes := uint64(stat.Bsize) * uint64(stat.Bfree)
+	availBytes := uint64(stat.Bsize) * uint64(stat.Bavail)
+	totalBytes := uint64(stat.Bsize) * uint64(stat.Blocks)
+	return DiskUsage{
+		AvailBytes: availBytes,
+		TotalBytes: totalBytes,
+		UsedBytes:  totalBytes - freeBytes,
+	}, nil
+}
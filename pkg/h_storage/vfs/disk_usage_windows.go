@@ -0,0 +1,11 @@
+//go:build windows
+
+package vfs
+
+import "errors"
+
+// GetDiskUsage returns disk space statistics for the filesystem that
+// contains the given path. It is not supported on Windows.
+func GetDiskUsage(path string) (DiskUsage, error) {
+	return DiskUsage{}, errors.New("disk usage is not supported on windows")
+}
@@ -2,3 +2,21 @@ package vfs
 
 type FS interface {
 }
+
+// defaultFS is the FS of the operating system.
+type defaultFS struct{}
+
+// Default is the FS implementation backed by the underlying operating
+// system's file system.
+var Default FS = defaultFS{}
+
+// DiskUsage summarizes disk space usage on a filesystem.
+type DiskUsage struct {
+	// AvailBytes is the total number of free bytes available to an
+	// unprivileged user.
+	AvailBytes uint64
+	// TotalBytes is the total number of bytes on the filesystem.
+	TotalBytes uint64
+	// UsedBytes is the total number of bytes used on the filesystem.
+	UsedBytes uint64
+}
@@ -0,0 +1,24 @@
+// Package kvclientutils holds helpers for tests which read and write keys
+// through the KV client.
+package kvclientutils
+
+import (
+	"context"
+	kv "github.com/dborchard/tiny_crdb/pkg/g_kv"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+// GetString reads the string value of the key in the transaction. It returns
+// the empty string if the key has no value.
+func GetString(t testing.TB, ctx context.Context, txn *kv.Txn, key string) string {
+	t.Helper()
+	res, err := txn.Get(ctx, key)
+	require.NoError(t, err)
+	if res.Value == nil {
+		return ""
+	}
+	b, err := res.Value.GetBytes()
+	require.NoError(t, err)
+	return string(b)
+}
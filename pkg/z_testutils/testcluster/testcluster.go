@@ -0,0 +1,415 @@
+// Package testcluster runs clusters of several nodes in a single process, for
+// tests of the replication of ranges. The nodes exchange Raft messages through
+// a loopback transport and send KV requests to each other directly, and can be
+// stopped and restarted on their engines.
+package testcluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	kv "github.com/dborchard/tiny_crdb/pkg/g_kv"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvclient/kvcoord"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/closedts"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/closedts/sidetransport"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/kvstorage"
+	"github.com/dborchard/tiny_crdb/pkg/g_kv/kvserver/liveness"
+	roachpb "github.com/dborchard/tiny_crdb/pkg/g_roachpb"
+	storage "github.com/dborchard/tiny_crdb/pkg/h_storage"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/hlc"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/stop"
+	"github.com/dborchard/tiny_crdb/pkg/z_util/uuid"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	// testRaftTickInterval and the election and heartbeat ticks make the
+	// ranges of test clusters elect their leaders quickly.
+	testRaftTickInterval           = 10 * time.Millisecond
+	testRaftElectionTimeoutTicks   = 10
+	testRaftHeartbeatIntervalTicks = 2
+	// testRangeLeaseDuration and the liveness durations make the leases of
+	// stopped nodes expire quickly.
+	testRangeLeaseDuration        = time.Second
+	testLivenessThreshold         = time.Second
+	testLivenessHeartbeatInterval = 200 * time.Millisecond
+	// testClosedTimestampTargetDuration and testSideTransportInterval make
+	// the followers of the ranges serve recent reads.
+	testClosedTimestampTargetDuration = 200 * time.Millisecond
+	testSideTransportInterval         = 20 * time.Millisecond
+	// testMaxClockOffset is the maximum offset between the clocks of the
+	// nodes, which all read the same physical clock.
+	testMaxClockOffset = 500 * time.Millisecond
+)
+
+// TestCluster is a cluster of nodes running in the process. Each node has a
+// single store, and every initial range of the cluster has a replica on each
+// store.
+type TestCluster struct {
+	transport         kvserver.RaftTransport
+	closedTSTransport sidetransport.Transport
+	engines           []storage.Engine
+
+	mu struct {
+		sync.RWMutex
+		// servers are the running nodes, by index. The entries of stopped
+		// nodes are nil.
+		servers []*TestServer
+	}
+}
+
+// TestServer is a node of a TestCluster.
+type TestServer struct {
+	nodeID       roachpb.NodeID
+	stopper      *stop.Stopper
+	clock        *hlc.Clock
+	store        *kvserver.Store
+	stores       *kvserver.Stores
+	distSender   *kvcoord.DistSender
+	db           *kv.DB
+	nodeLiveness *liveness.NodeLiveness
+}
+
+// NodeID returns the ID of the node.
+func (ts *TestServer) NodeID() roachpb.NodeID { return ts.nodeID }
+
+// Stopper returns the stopper of the node.
+func (ts *TestServer) Stopper() *stop.Stopper { return ts.stopper }
+
+// Clock returns the clock of the node.
+func (ts *TestServer) Clock() *hlc.Clock { return ts.clock }
+
+// Store returns the store of the node.
+func (ts *TestServer) Store() *kvserver.Store { return ts.store }
+
+// DistSender returns the DistSender of the node.
+func (ts *TestServer) DistSender() *kvcoord.DistSender { return ts.distSender }
+
+// DB returns a DB which sends its requests to the cluster from the node.
+func (ts *TestServer) DB() *kv.DB { return ts.db }
+
+// NodeLiveness returns the liveness of the nodes, as known by the node.
+func (ts *TestServer) NodeLiveness() *liveness.NodeLiveness { return ts.nodeLiveness }
+
+// StartTestCluster bootstraps a cluster of numNodes nodes and starts them.
+// The cluster is stopped when the test completes.
+func StartTestCluster(t testing.TB, numNodes int) *TestCluster {
+	ctx := context.Background()
+	tc := &TestCluster{
+		transport:         kvserver.NewLoopbackRaftTransport(),
+		closedTSTransport: sidetransport.NewLoopbackTransport(),
+	}
+	tc.mu.servers = make([]*TestServer, numNodes)
+
+	// Every store is bootstrapped with the same initial data, which gives
+	// each initial range a replica on every store.
+	clusterID := uuid.MakeV4()
+	replicas := make([]roachpb.ReplicaDescriptor, numNodes)
+	for i := range replicas {
+		replicas[i] = roachpb.ReplicaDescriptor{
+			NodeID:  roachpb.NodeID(i + 1),
+			StoreID: roachpb.StoreID(i + 1),
+		}
+	}
+	nowNanos := hlc.UnixNano()
+	for i := 0; i < numNodes; i++ {
+		eng, err := storage.Open(ctx, storage.Location{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(eng.Close)
+		ident := roachpb.StoreIdent{
+			ClusterID: clusterID,
+			NodeID:    replicas[i].NodeID,
+			StoreID:   replicas[i].StoreID,
+		}
+		if err := kvstorage.InitEngine(ctx, eng, ident); err != nil {
+			t.Fatal(err)
+		}
+		if err := kvserver.WriteInitialClusterData(ctx, eng, replicas, nowNanos); err != nil {
+			t.Fatal(err)
+		}
+		tc.engines = append(tc.engines, eng)
+	}
+
+	t.Cleanup(tc.Stop)
+	for i := 0; i < numNodes; i++ {
+		if err := tc.startServer(ctx, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tc.WaitForNodeLiveness(); err != nil {
+		t.Fatal(err)
+	}
+	return tc
+}
+
+// startServer starts the node with the index on its engine.
+func (tc *TestCluster) startServer(ctx context.Context, idx int) error {
+	ts := &TestServer{
+		nodeID:  roachpb.NodeID(idx + 1),
+		stopper: stop.NewStopper(),
+		clock:   hlc.NewClock(hlc.UnixNano, testMaxClockOffset),
+		stores:  kvserver.NewStores(),
+	}
+	ds := kvcoord.NewDistSender(kvcoord.DistSenderConfig{
+		Clock:              ts.clock,
+		Stopper:            ts.stopper,
+		FirstRangeProvider: tc,
+		TransportFactory:   kvcoord.LoopbackTransportFactory(tc.dial),
+		NodeIDGetter:       ts.NodeID,
+		FollowerReadLag: closedts.FollowerReadLag(
+			testClosedTimestampTargetDuration, testSideTransportInterval),
+	})
+	ts.distSender = ds
+	factory := kvcoord.NewTxnCoordSenderFactory(kvcoord.TxnCoordSenderFactoryConfig{
+		Clock:   ts.clock,
+		Stopper: ts.stopper,
+	}, ds)
+	ts.db = kv.NewDB(ctx, factory, ts.clock, ts.stopper)
+	ts.nodeLiveness = liveness.NewNodeLiveness(liveness.NodeLivenessOptions{
+		DB:                ts.db,
+		Clock:             ts.clock,
+		Stopper:           ts.stopper,
+		LivenessThreshold: testLivenessThreshold,
+		HeartbeatInterval: testLivenessHeartbeatInterval,
+	})
+
+	ts.store = kvserver.NewStore(ctx, kvserver.StoreConfig{
+		Clock:                      ts.clock,
+		DB:                         ts.db,
+		Stopper:                    ts.stopper,
+		RaftTickInterval:           testRaftTickInterval,
+		RaftElectionTimeoutTicks:   testRaftElectionTimeoutTicks,
+		RaftHeartbeatIntervalTicks: testRaftHeartbeatIntervalTicks,
+		RangeLeaseDuration:         testRangeLeaseDuration,
+		NodeLiveness:               ts.nodeLiveness,
+		Transport:                  tc.transport,
+
+		ClosedTimestampTargetDuration:        testClosedTimestampTargetDuration,
+		ClosedTimestampSideTransportInterval: testSideTransportInterval,
+		ClosedTimestampTransport:             tc.closedTSTransport,
+	}, tc.engines[idx], ts.nodeID, roachpb.StoreID(idx+1))
+	if err := ts.store.Start(ctx); err != nil {
+		ts.stopper.Stop(ctx)
+		return err
+	}
+	ts.stores.AddStore(ts.store)
+	if err := ts.nodeLiveness.Start(ctx, ts.nodeID); err != nil {
+		ts.stopper.Stop(ctx)
+		return err
+	}
+
+	tc.mu.Lock()
+	tc.mu.servers[idx] = ts
+	tc.mu.Unlock()
+	return nil
+}
+
+// NumServers returns the number of nodes of the cluster, running or not.
+func (tc *TestCluster) NumServers() int {
+	return len(tc.engines)
+}
+
+// Server returns the node with the index, or nil if it is stopped.
+func (tc *TestCluster) Server(idx int) *TestServer {
+	tc.mu.RLock()
+	defer tc.mu.RUnlock()
+	return tc.mu.servers[idx]
+}
+
+// Engine returns the engine of the node with the index, which survives the
+// restarts of the node.
+func (tc *TestCluster) Engine(idx int) storage.Engine {
+	return tc.engines[idx]
+}
+
+// StopServer stops the node with the index. The other nodes can no longer
+// reach it, and its engine is retained for a restart.
+func (tc *TestCluster) StopServer(idx int) {
+	tc.mu.Lock()
+	ts := tc.mu.servers[idx]
+	tc.mu.servers[idx] = nil
+	tc.mu.Unlock()
+	if ts != nil {
+		ts.stopper.Stop(context.Background())
+	}
+}
+
+// RestartServer restarts the stopped node with the index on its engine.
+func (tc *TestCluster) RestartServer(idx int) error {
+	if tc.Server(idx) != nil {
+		return fmt.Errorf("n%d is running", idx+1)
+	}
+	if err := tc.startServer(context.Background(), idx); err != nil {
+		return err
+	}
+	return tc.WaitForNodeLiveness()
+}
+
+// Stop stops all the running nodes of the cluster.
+func (tc *TestCluster) Stop() {
+	for i := range tc.engines {
+		tc.StopServer(i)
+	}
+}
+
+// WaitForNodeLiveness waits until every running node has cached the liveness
+// records of all the running nodes, its own included. Until then, the node
+// can't acquire epoch-based leases, nor tell whether the others hold theirs.
+func (tc *TestCluster) WaitForNodeLiveness() error {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		var missing error
+		for i := range tc.engines {
+			ts := tc.Server(i)
+			if ts == nil {
+				continue
+			}
+			for j := range tc.engines {
+				if tc.Server(j) == nil {
+					continue
+				}
+				if _, ok := ts.nodeLiveness.GetLiveness(roachpb.NodeID(j + 1)); !ok {
+					missing = fmt.Errorf("n%d: liveness record of n%d: %w", i+1, j+1,
+						liveness.ErrRecordCacheMiss)
+				}
+			}
+		}
+		if missing == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return missing
+		}
+		time.Sleep(testLivenessHeartbeatInterval / 10)
+	}
+}
+
+// LeaderStore returns the store of the leader of the range containing the
+// key, once all the running nodes agree on it.
+func (tc *TestCluster) LeaderStore(key roachpb.Key) (*kvserver.Store, error) {
+	rKey := roachpb.RKey(key)
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		var leader *kvserver.Store
+		var lead uint64
+		agreed := true
+		for i := range tc.engines {
+			ts := tc.Server(i)
+			if ts == nil {
+				continue
+			}
+			repl := ts.store.LookupReplica(rKey)
+			if repl == nil {
+				continue
+			}
+			status := repl.RaftStatus()
+			if status == nil || status.Lead == 0 || (lead != 0 && status.Lead != lead) {
+				agreed = false
+				break
+			}
+			lead = status.Lead
+			if status.ID == status.Lead {
+				leader = ts.store
+			}
+		}
+		if agreed && leader != nil {
+			return leader, nil
+		}
+		time.Sleep(testRaftTickInterval)
+	}
+	return nil, fmt.Errorf("no leader elected for the range containing %s", key)
+}
+
+// LeaseHolderStore returns the store of the holder of the valid lease of the
+// range containing the key, once the running nodes agree on it, acquiring
+// the lease if needed.
+func (tc *TestCluster) LeaseHolderStore(key roachpb.Key) (*kvserver.Store, error) {
+	rKey := roachpb.RKey(key)
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		var holder *kvserver.Store
+		var lease roachpb.Lease
+		agreed := true
+		for i := range tc.engines {
+			ts := tc.Server(i)
+			if ts == nil {
+				continue
+			}
+			repl := ts.store.LookupReplica(rKey)
+			if repl == nil {
+				continue
+			}
+			l := repl.GetLease()
+			if lease.Empty() {
+				lease = l
+			} else if l.Sequence != lease.Sequence {
+				agreed = false
+			}
+			if repl.OwnsValidLease() {
+				holder = ts.store
+			}
+		}
+		if agreed && holder != nil {
+			return holder, nil
+		}
+		if ts := tc.anyServer(); ts != nil {
+			// A read acquires the lease, if it is not held.
+			_ = ts.db.Txn(context.Background(), func(ctx context.Context, txn *kv.Txn) error {
+				_, err := txn.Get(ctx, key)
+				return err
+			})
+		}
+		time.Sleep(testRaftTickInterval)
+	}
+	return nil, fmt.Errorf("no leaseholder for the range containing %s", key)
+}
+
+// anyServer returns a running node, if any.
+func (tc *TestCluster) anyServer() *TestServer {
+	for i := range tc.engines {
+		if ts := tc.Server(i); ts != nil {
+			return ts
+		}
+	}
+	return nil
+}
+
+// GetFirstRangeDescriptor implements the kvcoord.FirstRangeProvider
+// interface. The descriptor is that of the replica of the first range on a
+// running node, which is the most recent one.
+func (tc *TestCluster) GetFirstRangeDescriptor() (*roachpb.RangeDescriptor, error) {
+	var desc *roachpb.RangeDescriptor
+	for i := range tc.engines {
+		ts := tc.Server(i)
+		if ts == nil {
+			continue
+		}
+		if repl := ts.store.LookupReplica(roachpb.RKeyMin); repl != nil {
+			if d := repl.Desc(); desc == nil || d.Generation > desc.Generation {
+				desc = d
+			}
+		}
+	}
+	if desc == nil {
+		return nil, errors.New("first range not found on the running nodes")
+	}
+	return desc, nil
+}
+
+// dial returns the sender of the stores of the node, if it is running.
+func (tc *TestCluster) dial(nodeID roachpb.NodeID) (kv.Sender, error) {
+	idx := int(nodeID) - 1
+	if idx < 0 || idx >= len(tc.engines) {
+		return nil, fmt.Errorf("n%d not found", nodeID)
+	}
+	ts := tc.Server(idx)
+	if ts == nil {
+		return nil, fmt.Errorf("n%d is stopped", nodeID)
+	}
+	return ts.stores, nil
+}
@@ -0,0 +1,183 @@
+// Package circuit provides a circuit breaker. A circuit breaker trips when
+// an error is reported to it, and from then on fails fast every caller that
+// checks it, until a background probe determines that the protected resource
+// is healthy again and resets it.
+package circuit
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrBreakerOpen is a reference error that matches the errors returned from
+// Signal.Err while the breaker is tripped; it can be checked with
+// errors.Is.
+var ErrBreakerOpen = errors.New("breaker open")
+
+// Options are the arguments to NewBreaker.
+type Options struct {
+	// Name is the name of the breaker, used in the errors it returns.
+	Name string
+
+	// AsyncProbe is invoked when the breaker trips, and again whenever the
+	// breaker is found to be tripped while no probe is running. It must
+	// launch a probe asynchronously and return: the probe determines whether
+	// the protected resource has recovered and, if so, calls Reset on the
+	// breaker. It may call report to update the breaker's error, and it must
+	// call done when it exits.
+	AsyncProbe func(report func(error), done func())
+}
+
+// Signal is the interface returned by Breaker.Signal. It is a snapshot of the
+// breaker at the time Signal was called.
+type Signal interface {
+	// Err returns a non-nil error if the breaker is tripped. The error
+	// wraps ErrBreakerOpen as well as the error most recently reported to
+	// the breaker.
+	Err() error
+	// C returns a channel that is closed once the breaker trips. The channel
+	// of a Signal obtained while the breaker was tripped is already closed.
+	C() <-chan struct{}
+}
+
+// Breaker is a circuit breaker. Before accessing the protected resource,
+// callers check Signal().Err() and fail fast if it is non-nil; callers that
+// may block on the resource can additionally select on Signal().C() to be
+// notified when the breaker trips. Errors that indicate the resource is
+// unhealthy are reported through Report, which trips the breaker.
+type Breaker struct {
+	opts Options
+
+	mu struct {
+		sync.Mutex
+		// errAndCh is the signal handed out by Signal. It is replaced when
+		// the breaker trips, when a new error is reported while it is
+		// tripped, and when it is reset.
+		errAndCh *errAndCh
+		// probing is set while an AsyncProbe is running.
+		probing bool
+	}
+}
+
+// NewBreaker instantiates a new circuit breaker.
+func NewBreaker(opts Options) *Breaker {
+	b := &Breaker{opts: opts}
+	b.mu.errAndCh = b.newErrAndCh()
+	return b
+}
+
+// Signal returns a Signal for the breaker's current state. If the breaker is
+// tripped and no probe is running, a probe is launched.
+func (b *Breaker) Signal() Signal {
+	b.mu.Lock()
+	sig := b.mu.errAndCh
+	probe := sig.err != nil && b.shouldTriggerProbeLocked()
+	b.mu.Unlock()
+	if probe {
+		b.triggerProbe()
+	}
+	return sig
+}
+
+// Report trips the breaker with the provided error, and launches a probe if
+// none is running. If the breaker is already tripped, its error is replaced.
+func (b *Breaker) Report(err error) {
+	if err == nil {
+		panic("circuit: cannot report nil error")
+	}
+	b.mu.Lock()
+	berr := &breakerError{name: b.opts.Name, cause: err}
+	cur := b.mu.errAndCh
+	if cur.err == nil {
+		// Trip the breaker, notifying everyone holding the current signal.
+		cur.err = berr
+		close(cur.ch)
+	} else {
+		// The breaker is already tripped. Hand out a new, already tripped,
+		// signal carrying the new error, leaving the old one untouched.
+		next := b.newErrAndCh()
+		next.err = berr
+		close(next.ch)
+		b.mu.errAndCh = next
+	}
+	probe := b.shouldTriggerProbeLocked()
+	b.mu.Unlock()
+	if probe {
+		b.triggerProbe()
+	}
+}
+
+// Reset resets the breaker, so that Signal().Err() returns nil until the
+// next call to Report.
+func (b *Breaker) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.mu.errAndCh.err != nil {
+		b.mu.errAndCh = b.newErrAndCh()
+	}
+}
+
+// shouldTriggerProbeLocked returns whether a probe should be launched, in
+// which case it marks the probe as running. The caller must then launch it
+// with triggerProbe, after releasing the lock.
+func (b *Breaker) shouldTriggerProbeLocked() bool {
+	if b.mu.probing || b.opts.AsyncProbe == nil {
+		return false
+	}
+	b.mu.probing = true
+	return true
+}
+
+// triggerProbe launches the breaker's AsyncProbe.
+func (b *Breaker) triggerProbe() {
+	b.opts.AsyncProbe(b.Report, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.mu.probing = false
+	})
+}
+
+func (b *Breaker) newErrAndCh() *errAndCh {
+	return &errAndCh{b: b, ch: make(chan struct{})}
+}
+
+// errAndCh implements Signal.
+type errAndCh struct {
+	b  *Breaker
+	ch chan struct{}
+	// err is protected by b.mu. It is set when ch is closed.
+	err error
+}
+
+// Err implements the Signal interface.
+func (s *errAndCh) Err() error {
+	s.b.mu.Lock()
+	defer s.b.mu.Unlock()
+	return s.err
+}
+
+// C implements the Signal interface.
+func (s *errAndCh) C() <-chan struct{} {
+	return s.ch
+}
+
+// breakerError is the error returned by a tripped breaker.
+type breakerError struct {
+	name  string
+	cause error
+}
+
+func (e *breakerError) Error() string {
+	return fmt.Sprintf("%s: %v: %v", ErrBreakerOpen, e.name, e.cause)
+}
+
+// Is makes breakerError match ErrBreakerOpen.
+func (e *breakerError) Is(target error) bool {
+	return target == ErrBreakerOpen
+}
+
+// Unwrap returns the error reported to the breaker.
+func (e *breakerError) Unwrap() error {
+	return e.cause
+}
@@ -0,0 +1,56 @@
+package circuit
+
+import (
+	"errors"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestBreaker(t *testing.T) {
+	var probes int
+	var probeDone func()
+	b := NewBreaker(Options{
+		Name: "test",
+		AsyncProbe: func(_ func(error), done func()) {
+			probes++
+			probeDone = done
+		},
+	})
+
+	// A healthy breaker lets callers through.
+	sig := b.Signal()
+	require.NoError(t, sig.Err())
+	select {
+	case <-sig.C():
+		t.Fatal("signal of healthy breaker is closed")
+	default:
+	}
+
+	// Reporting an error trips the breaker, notifies holders of the signal
+	// and launches a probe.
+	cause := errors.New("boom")
+	b.Report(cause)
+	<-sig.C()
+	require.ErrorIs(t, sig.Err(), ErrBreakerOpen)
+	require.ErrorIs(t, sig.Err(), cause)
+	require.Equal(t, 1, probes)
+
+	// While the probe runs, no other probe is launched, and new errors
+	// replace the old one.
+	other := errors.New("other")
+	b.Report(other)
+	require.ErrorIs(t, b.Signal().Err(), other)
+	require.Equal(t, 1, probes)
+
+	// Once the probe exits without resetting the breaker, checking the
+	// breaker launches a new probe.
+	probeDone()
+	require.Error(t, b.Signal().Err())
+	require.Equal(t, 2, probes)
+
+	// Resetting the breaker lets callers through again.
+	b.Reset()
+	probeDone()
+	require.NoError(t, b.Signal().Err())
+	require.Equal(t, 2, probes)
+}
@@ -0,0 +1,188 @@
+// Package encoding implements the order-preserving encodings of the values
+// that make up the keys of SQL rows: the encoded values of a type sort like
+// the values themselves, and each encoding is self-delimiting, so that the
+// values of several columns can be concatenated into a key and decoded back.
+package encoding
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+const (
+	encodedNull = 0x00
+	// bytesMarker is the marker of the encoding of a byte slice or a string.
+	bytesMarker byte = 0x12
+
+	escape      byte = 0x00
+	escapedTerm byte = 0x01
+	escaped00   byte = 0xff
+
+	// intMin is the smallest marker of the encoding of an integer. The
+	// markers of negative integers sort before those of positive ones, and
+	// the markers of longer encodings sort further from intZero.
+	intMin      = 0x80
+	intMaxWidth = 8
+	// intZero is the marker of the single-byte encoding of zero. Values up
+	// to intSmall are encoded in a single byte, as intZero plus the value.
+	intZero  = intMin + intMaxWidth
+	intSmall = intMax - intZero - intMaxWidth
+	// intMax is the largest marker of the encoding of an integer.
+	intMax = 0xfd
+)
+
+// EncodeUvarintAscending encodes the uint64 value using a variable length
+// (length-prefixed) representation. The length is encoded as a single byte
+// indicating the number of encoded bytes following; values up to intSmall
+// are encoded in a single byte. The encoded bytes are appended to the
+// supplied buffer and the final buffer is returned.
+func EncodeUvarintAscending(b []byte, v uint64) []byte {
+	if v <= intSmall {
+		return append(b, intZero+byte(v))
+	}
+	n := 8
+	for n > 1 && v>>uint(8*(n-1)) == 0 {
+		n--
+	}
+	b = append(b, byte(intMax-intMaxWidth+n))
+	for i := n - 1; i >= 0; i-- {
+		b = append(b, byte(v>>uint(8*i)))
+	}
+	return b
+}
+
+// DecodeUvarintAscending decodes a uint64 encoded with
+// EncodeUvarintAscending, and returns the remaining bytes.
+func DecodeUvarintAscending(b []byte) ([]byte, uint64, error) {
+	if len(b) == 0 {
+		return nil, 0, errors.New("insufficient bytes to decode uvarint value")
+	}
+	length := int(b[0]) - intZero
+	b = b[1:]
+	if length <= intSmall {
+		if length < 0 {
+			return nil, 0, fmt.Errorf("invalid uvarint marker %#x", length+intZero)
+		}
+		return b, uint64(length), nil
+	}
+	length -= intSmall
+	if length > intMaxWidth || len(b) < length {
+		return nil, 0, fmt.Errorf("insufficient bytes to decode uvarint value: %q", b)
+	}
+	var v uint64
+	for _, t := range b[:length] {
+		v = (v << 8) | uint64(t)
+	}
+	return b[length:], v, nil
+}
+
+// EncodeVarintAscending encodes the int64 value using a variable length
+// (length-prefixed) representation. Positive values are encoded like by
+// EncodeUvarintAscending; negative values are encoded with the length
+// complemented, so that they sort before the positive ones.
+func EncodeVarintAscending(b []byte, v int64) []byte {
+	if v >= 0 {
+		return EncodeUvarintAscending(b, uint64(v))
+	}
+	n := 8
+	for n > 1 && v>>uint(8*(n-1)) == -1 {
+		n--
+	}
+	b = append(b, byte(intMin+intMaxWidth-n))
+	for i := n - 1; i >= 0; i-- {
+		b = append(b, byte(v>>uint(8*i)))
+	}
+	return b
+}
+
+// DecodeVarintAscending decodes an int64 encoded with EncodeVarintAscending,
+// and returns the remaining bytes.
+func DecodeVarintAscending(b []byte) ([]byte, int64, error) {
+	if len(b) == 0 {
+		return nil, 0, errors.New("insufficient bytes to decode varint value")
+	}
+	length := int(b[0]) - intZero
+	if length >= 0 {
+		rem, v, err := DecodeUvarintAscending(b)
+		return rem, int64(v), err
+	}
+	length = -length
+	b = b[1:]
+	if length > intMaxWidth || len(b) < length {
+		return nil, 0, fmt.Errorf("insufficient bytes to decode varint value: %q", b)
+	}
+	v := int64(-1)
+	for _, t := range b[:length] {
+		v = (v << 8) | int64(t)
+	}
+	return b[length:], v, nil
+}
+
+// EncodeBytesAscending encodes the []byte value using an escape-based
+// encoding. The encoded value is terminated with the sequence "\x00\x01"
+// which is guaranteed to not occur elsewhere in the encoded value. The
+// encoded bytes are appended to the supplied buffer and the resulting buffer
+// is returned.
+func EncodeBytesAscending(b []byte, data []byte) []byte {
+	b = append(b, bytesMarker)
+	for {
+		i := bytes.IndexByte(data, escape)
+		if i == -1 {
+			break
+		}
+		b = append(b, data[:i]...)
+		b = append(b, escape, escaped00)
+		data = data[i+1:]
+	}
+	b = append(b, data...)
+	return append(b, escape, escapedTerm)
+}
+
+// EncodeStringAscending encodes the string value like EncodeBytesAscending.
+func EncodeStringAscending(b []byte, s string) []byte {
+	return EncodeBytesAscending(b, []byte(s))
+}
+
+// DecodeBytesAscending decodes a []byte value encoded with
+// EncodeBytesAscending, and returns the remaining bytes.
+func DecodeBytesAscending(b []byte) ([]byte, []byte, error) {
+	if len(b) == 0 || b[0] != bytesMarker {
+		return nil, nil, fmt.Errorf("did not find marker %#x in buffer %q", bytesMarker, b)
+	}
+	b = b[1:]
+	var r []byte
+	for {
+		i := bytes.IndexByte(b, escape)
+		if i == -1 || i+1 >= len(b) {
+			return nil, nil, fmt.Errorf("did not find terminator %#x in buffer %q", escapedTerm, b)
+		}
+		switch b[i+1] {
+		case escapedTerm:
+			return b[i+2:], append(r, b[:i]...), nil
+		case escaped00:
+			r = append(r, b[:i]...)
+			r = append(r, escape)
+			b = b[i+2:]
+		default:
+			return nil, nil, fmt.Errorf("unknown escape sequence: %#x %#x", escape, b[i+1])
+		}
+	}
+}
+
+// EncodeNullAscending encodes a NULL value. The encoded bytes are appended to
+// the buffer. NULLs sort before all the other values.
+func EncodeNullAscending(b []byte) []byte {
+	return append(b, encodedNull)
+}
+
+// DecodeIfNull decodes a NULL value from the input buffer. If the input
+// buffer contains a null at the start of the buffer then it is removed from
+// the buffer and true is returned for the second result. Otherwise, the
+// buffer is returned unchanged and false is returned for the second result.
+func DecodeIfNull(b []byte) ([]byte, bool) {
+	if len(b) > 0 && b[0] == encodedNull {
+		return b[1:], true
+	}
+	return b, false
+}
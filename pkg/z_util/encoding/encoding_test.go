@@ -0,0 +1,43 @@
+package encoding
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/require"
+	"math"
+	"sort"
+	"testing"
+)
+
+func TestEncodeDecodeVarintAscending(t *testing.T) {
+	vals := []int64{
+		math.MinInt64, -1 << 40, -65536, -257, -256, -1, 0, 1, 109, 110, 255, 256, 1 << 40, math.MaxInt64,
+	}
+	var encs [][]byte
+	for _, v := range vals {
+		enc := EncodeVarintAscending(nil, v)
+		rem, dec, err := DecodeVarintAscending(append(enc, 'x'))
+		require.NoError(t, err)
+		require.Equal(t, v, dec)
+		require.Equal(t, []byte("x"), rem)
+		encs = append(encs, enc)
+	}
+	require.True(t, sort.SliceIsSorted(encs, func(i, j int) bool {
+		return bytes.Compare(encs[i], encs[j]) < 0
+	}))
+}
+
+func TestEncodeDecodeBytesAscending(t *testing.T) {
+	vals := [][]byte{{}, {0}, {0, 0}, {0, 1}, []byte("a"), []byte("a\x00b"), []byte("ab"), {0xff}}
+	var encs [][]byte
+	for _, v := range vals {
+		enc := EncodeBytesAscending(nil, v)
+		rem, dec, err := DecodeBytesAscending(append(enc, 'x'))
+		require.NoError(t, err)
+		require.Equal(t, string(v), string(dec))
+		require.Equal(t, []byte("x"), rem)
+		encs = append(encs, enc)
+	}
+	require.True(t, sort.SliceIsSorted(encs, func(i, j int) bool {
+		return bytes.Compare(encs[i], encs[j]) < 0
+	}))
+}
@@ -1,21 +1,131 @@
 package fsm
 
+import (
+	"context"
+	"fmt"
+)
+
 // Event is something that happens to a Machine which may or may not trigger a
 // state transition.
 type Event interface {
 	Event()
 }
 
+// EventPayload is extra payload on an Event that does not help decide which
+// transition to take, but which is passed to the transition's Action.
 type EventPayload interface{}
 
+// State is a node in a Machine's transition graph.
 type State interface {
 	State()
 }
 
+// ExtendedState is extra state in a Machine that does not contribute to state
+// transition decisions, but that can be affected by a state transition.
+type ExtendedState interface{}
+
+// Args is a structure containing the arguments passed to Transition.Action.
+type Args struct {
+	Ctx context.Context
+
+	Prev     State
+	Extended ExtendedState
+
+	Event   Event
+	Payload EventPayload
+}
+
+// Transition is a Machine's response to an Event applied to a State. It may
+// transition the machine to a new State and it may also perform an action on
+// the Machine's ExtendedState.
+type Transition struct {
+	Next   State
+	Action func(Args) error
+}
+
+// Pattern is a mapping from State to a mapping from Event to Transition. The
+// States and Events are matched by equality, so their Bool fields must be
+// spelled out for each of their values.
+type Pattern map[State]map[Event]Transition
+
+// Transitions is a set of expanded state transitions generated from a Pattern,
+// forming a State graph with Events acting as the directed edges between
+// different States.
+type Transitions struct {
+	expanded Pattern
+}
+
+// Compile creates a set of state Transitions from a Pattern.
+func Compile(p Pattern) Transitions {
+	return Transitions{expanded: p}
+}
+
+// TransitionNotFoundError is returned from Machine.Apply when the Event cannot
+// be applied to the current State.
+type TransitionNotFoundError struct {
+	state State
+	event Event
+}
+
+func (e TransitionNotFoundError) Error() string {
+	return fmt.Sprintf("event %T inappropriate in current state %T", e.event, e.state)
+}
+
+func (t Transitions) apply(a Args) (State, error) {
+	sm, ok := t.expanded[a.Prev]
+	if !ok {
+		return a.Prev, TransitionNotFoundError{state: a.Prev, event: a.Event}
+	}
+	tr, ok := sm[a.Event]
+	if !ok {
+		return a.Prev, TransitionNotFoundError{state: a.Prev, event: a.Event}
+	}
+	if tr.Action != nil {
+		if err := tr.Action(a); err != nil {
+			return a.Prev, err
+		}
+	}
+	return tr.Next, nil
+}
+
+// Machine encapsulates a State with a set of State transitions. It reacts to
+// Events, adjusting its internal State according to its Transition graph and
+// performing actions on its ExtendedState accordingly.
 type Machine struct {
+	t   Transitions
 	cur State
+	es  ExtendedState
+}
+
+// MakeMachine returns a new Machine with the specified Transitions and
+// starting State, and with the ExtendedState passed to the transitions'
+// actions.
+func MakeMachine(t Transitions, start State, es ExtendedState) Machine {
+	return Machine{t: t, cur: start, es: es}
 }
 
+// Apply applies the Event to the state Machine. If the Event cannot be
+// applied to the current State, a TransitionNotFoundError is returned. If
+// the Transition's Action returns an error, the State is left unchanged and
+// the error is returned.
+func (m *Machine) Apply(ctx context.Context, e Event) error {
+	return m.ApplyWithPayload(ctx, e, nil)
+}
+
+// ApplyWithPayload is like Apply, but also passes the payload to the
+// Transition's Action.
+func (m *Machine) ApplyWithPayload(ctx context.Context, e Event, b EventPayload) (err error) {
+	m.cur, err = m.t.apply(Args{
+		Ctx:      ctx,
+		Prev:     m.cur,
+		Extended: m.es,
+		Event:    e,
+		Payload:  b,
+	})
+	return err
+}
+
+// CurState returns the current State.
 func (m *Machine) CurState() State {
 	return m.cur
 }
@@ -29,14 +139,10 @@ type Bool interface {
 
 type b bool
 
-func (b b) bool() {
-	//TODO implement me
-	panic("implement me")
-}
+func (b b) bool() {}
 
 func (b b) Get() bool {
-	//TODO implement me
-	panic("implement me")
+	return bool(b)
 }
 
 var (
@@ -45,3 +151,8 @@ var (
 	// False is a pattern that matches false booleans.
 	False Bool = b(false)
 )
+
+// FromBool creates a Bool from a Go bool.
+func FromBool(val bool) Bool {
+	return b(val)
+}
@@ -1,4 +1,168 @@
 package hlc
 
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Clock is a hybrid logical clock. Objects of this type model causality while
+// maintaining a relation to physical time. Roughly speaking, timestamps
+// consist of the largest wall clock time among all events, and a logical
+// clock that ticks whenever an event happens in the future of the local
+// physical clock.
+//
+// The timestamps handed out by a Clock are strictly increasing, even if the
+// physical clock jumps backwards. A zero Clock is ready to use, reads the
+// local machine's physical clock and enforces no maximum offset.
 type Clock struct {
+	physicalClock func() int64
+
+	// maxOffset specifies how far ahead of the local physical clock the wall
+	// time of a remote clock reading may be before the reading is deemed
+	// untrustworthy. A value of zero disables the check.
+	maxOffset time.Duration
+
+	mu struct {
+		sync.Mutex
+		// timestamp is the current HLC time.
+		timestamp ClockTimestamp
+	}
+}
+
+// UnixNano returns the local machine's physical nanosecond unix epoch
+// timestamp as a convenience to create a HLC via
+// c := hlc.NewClock(hlc.UnixNano, maxOffset).
+func UnixNano() int64 {
+	return time.Now().UnixNano()
+}
+
+// NewClock creates a new hybrid logical clock associated with the given
+// physical clock, initializing both wall time and logical time with zero.
+//
+// The maxOffset is the maximum offset between the clocks of the cluster's
+// nodes, beyond which the remote clock readings are deemed untrustworthy. A
+// value of zero disables the check.
+func NewClock(physicalClock func() int64, maxOffset time.Duration) *Clock {
+	return &Clock{physicalClock: physicalClock, maxOffset: maxOffset}
+}
+
+// MaxOffset returns the maximal clock offset to any node in the cluster.
+//
+// A value of 0 means offset checking is disabled.
+func (c *Clock) MaxOffset() time.Duration {
+	return c.maxOffset
+}
+
+// getPhysicalClockLocked returns the current physical clock.
+func (c *Clock) getPhysicalClockLocked() int64 {
+	if c.physicalClock == nil {
+		return UnixNano()
+	}
+	return c.physicalClock()
+}
+
+// Now returns a timestamp associated with an event from the local
+// machine that may be sent to other members of the distributed network.
+// This is the counterpart of Update, which is passed a timestamp
+// received from another member of the distributed network.
+func (c *Clock) Now() Timestamp {
+	return c.NowAsClockTimestamp().ToTimestamp()
+}
+
+// NowAsClockTimestamp is like Now, but returns a ClockTimestamp instead
+// of a raw Timestamp.
+//
+// This is the counterpart of Update, which is passed a ClockTimestamp
+// received from another member of the distributed network. As such,
+// callers that intend to use the returned timestamp to update a peer's
+// HLC clock should use this method.
+func (c *Clock) NowAsClockTimestamp() ClockTimestamp {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	physicalClock := c.getPhysicalClockLocked()
+	if c.mu.timestamp.WallTime >= physicalClock {
+		// The physical clock has not advanced past the last timestamp handed
+		// out; tick the logical clock instead.
+		c.mu.timestamp.Logical++
+	} else {
+		c.mu.timestamp.WallTime = physicalClock
+		c.mu.timestamp.Logical = 0
+	}
+	return c.mu.timestamp
+}
+
+// PhysicalNow returns the local wall time.
+//
+// Note that, contrary to Now(), PhysicalNow does not take into consideration
+// higher clock signals received through Update(). If you want to take them
+// into consideration, use c.Now().GoTime().
+func (c *Clock) PhysicalNow() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.getPhysicalClockLocked()
+}
+
+// PhysicalTime returns a time.Time struct using the local wall time.
+func (c *Clock) PhysicalTime() time.Time {
+	return time.Unix(0, c.PhysicalNow())
+}
+
+// Update takes a hybrid timestamp, usually originating from an event
+// received from another member of a distributed system. The clock is
+// updated to reflect the later of the two: the timestamps subsequently
+// handed out by Now are above the remote timestamp.
+//
+// The remote timestamp is not checked against the maximum offset; see
+// UpdateAndCheckMaxOffset.
+func (c *Clock) Update(rt ClockTimestamp) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.updateLocked(rt)
+}
+
+// updateLocked updates the clock to the later of its current timestamp and
+// the remote timestamp. c.mu must be held.
+func (c *Clock) updateLocked(rt ClockTimestamp) {
+	if c.mu.timestamp.Less(rt) {
+		c.mu.timestamp = rt
+	}
+}
+
+// UntrustworthyRemoteWallTimeError is returned by UpdateAndCheckMaxOffset
+// for a remote timestamp whose wall time is further ahead of the local
+// physical clock than the maximum clock offset.
+type UntrustworthyRemoteWallTimeError struct {
+	// WallTimeDelta is how far the remote wall time is ahead of the local
+	// physical clock.
+	WallTimeDelta time.Duration
+	// MaxOffset is the maximum clock offset which was exceeded.
+	MaxOffset time.Duration
+}
+
+func (e *UntrustworthyRemoteWallTimeError) Error() string {
+	return fmt.Sprintf("remote wall time is too far ahead (%s) to be trustworthy (max offset %s)",
+		e.WallTimeDelta, e.MaxOffset)
+}
+
+// UpdateAndCheckMaxOffset is like Update, but also takes the wall time into
+// account and returns an error in the event that the supplied remote
+// timestamp exceeds the wall clock time by more than the maximum clock
+// offset. In that case, the clock is left untouched.
+//
+// If an error is returned, it will be an *UntrustworthyRemoteWallTimeError.
+func (c *Clock) UpdateAndCheckMaxOffset(ctx context.Context, rt ClockTimestamp) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// The physical clock is read under the same lock as the update, so that
+	// the check holds for the reading that the clock is updated with.
+	if c.maxOffset > 0 {
+		physicalClock := c.getPhysicalClockLocked()
+		if delta := time.Duration(rt.WallTime - physicalClock); delta > c.maxOffset {
+			return &UntrustworthyRemoteWallTimeError{WallTimeDelta: delta, MaxOffset: c.maxOffset}
+		}
+	}
+	c.updateLocked(rt)
+	return nil
 }
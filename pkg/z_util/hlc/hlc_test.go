@@ -0,0 +1,76 @@
+package hlc
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestClockMonotonic(t *testing.T) {
+	m := NewManualClock(10)
+	c := NewClock(m.UnixNano, 0)
+
+	require.Equal(t, Timestamp{WallTime: 10}, c.Now())
+	// The logical clock ticks while the physical clock stands still.
+	require.Equal(t, Timestamp{WallTime: 10, Logical: 1}, c.Now())
+	// It also ticks if the physical clock jumps backwards.
+	m.Set(5)
+	require.Equal(t, Timestamp{WallTime: 10, Logical: 2}, c.Now())
+	require.Equal(t, int64(5), c.PhysicalNow())
+	m.Set(20)
+	require.Equal(t, Timestamp{WallTime: 20}, c.Now())
+}
+
+func TestClockUpdate(t *testing.T) {
+	ctx := context.Background()
+	m := NewManualClock(100)
+	c := NewClock(m.UnixNano, 50)
+	require.Equal(t, 50*time.Nanosecond, c.MaxOffset())
+
+	// A remote timestamp behind the clock doesn't move it.
+	c.Update(ClockTimestamp{WallTime: 90, Logical: 5})
+	require.Equal(t, Timestamp{WallTime: 100}, c.Now())
+
+	// A remote timestamp ahead of the clock moves it forward.
+	require.NoError(t, c.UpdateAndCheckMaxOffset(ctx, ClockTimestamp{WallTime: 140, Logical: 3}))
+	require.Equal(t, Timestamp{WallTime: 140, Logical: 4}, c.Now())
+
+	// A remote timestamp further ahead than the max offset is rejected, and
+	// the clock is left untouched.
+	err := c.UpdateAndCheckMaxOffset(ctx, ClockTimestamp{WallTime: 151})
+	var offsetErr *UntrustworthyRemoteWallTimeError
+	require.True(t, errors.As(err, &offsetErr))
+	require.Equal(t, 51*time.Nanosecond, offsetErr.WallTimeDelta)
+	require.Equal(t, Timestamp{WallTime: 140, Logical: 5}, c.Now())
+
+	// Update doesn't check the max offset.
+	c.Update(ClockTimestamp{WallTime: 151})
+	require.Equal(t, Timestamp{WallTime: 151, Logical: 1}, c.Now())
+}
+
+func TestTimestamp(t *testing.T) {
+	a := Timestamp{WallTime: 1, Logical: 2}
+	b := Timestamp{WallTime: 2}
+	require.Equal(t, -1, a.Compare(b))
+	require.Equal(t, 1, b.Compare(a))
+	require.Equal(t, 0, a.Compare(a))
+
+	require.Equal(t, Timestamp{WallTime: 1, Logical: 3}, a.Next())
+	require.Equal(t, Timestamp{WallTime: 1, Logical: 1}, a.Prev())
+	require.Equal(t, Timestamp{WallTime: 1, Logical: 1<<31 - 1}, b.Prev())
+	require.Equal(t, b, b.Prev().Next())
+
+	ts := a
+	require.True(t, ts.Forward(b))
+	require.Equal(t, b, ts)
+	require.False(t, ts.Forward(a))
+	require.True(t, ts.Backward(a))
+	require.Equal(t, a, ts)
+	require.False(t, ts.Backward(b))
+
+	require.Equal(t, "0.000000001,2", a.String())
+	require.Equal(t, "1.000000002,3", Timestamp{WallTime: 1e9 + 2, Logical: 3}.String())
+	require.Equal(t, "-1.000000000,0", Timestamp{WallTime: -1e9}.String())
+}
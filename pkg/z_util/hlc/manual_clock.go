@@ -0,0 +1,25 @@
+package hlc
+
+import "sync/atomic"
+
+// ManualClock is a physical clock which only moves when set, for tests. Its
+// UnixNano method can be passed to NewClock.
+type ManualClock struct {
+	nanos atomic.Int64
+}
+
+// NewManualClock returns a manual clock set to the given nanos.
+func NewManualClock(nanos int64) *ManualClock {
+	m := &ManualClock{}
+	m.nanos.Store(nanos)
+	return m
+}
+
+// UnixNano returns the nanos of the clock.
+func (m *ManualClock) UnixNano() int64 { return m.nanos.Load() }
+
+// Set sets the nanos of the clock.
+func (m *ManualClock) Set(nanos int64) { m.nanos.Store(nanos) }
+
+// Increment moves the clock forward by the given nanos.
+func (m *ManualClock) Increment(nanos int64) { m.nanos.Add(nanos) }
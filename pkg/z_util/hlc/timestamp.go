@@ -1,6 +1,124 @@
 package hlc
 
+import (
+	"fmt"
+	"time"
+)
+
+// Timestamp represents a state of the hybrid logical clock.
 type Timestamp struct {
+	// Holds a wall time, typically a unix epoch time expressed in
+	// nanoseconds.
+	WallTime int64
+	// The logical component captures causality for events whose wall times
+	// are equal. It is effectively bounded by (maximum clock skew)/(minimal
+	// ns between events) and nearly impossible to overflow.
+	Logical int32
+}
+
+// MaxTimestamp is the max value allowed for Timestamp.
+var MaxTimestamp = Timestamp{WallTime: 1<<63 - 1, Logical: 1<<31 - 1}
+
+// MinTimestamp is the min value allowed for Timestamp.
+var MinTimestamp = Timestamp{WallTime: 0, Logical: 1}
+
+// IsEmpty returns true if t is an empty Timestamp.
+func (t Timestamp) IsEmpty() bool {
+	return t == Timestamp{}
+}
+
+// Compare returns -1 if this timestamp is lesser than the given timestamp, 1 if
+// it is greater, and 0 if they are equal.
+func (t Timestamp) Compare(s Timestamp) int {
+	if t.WallTime > s.WallTime {
+		return 1
+	} else if t.WallTime < s.WallTime {
+		return -1
+	} else if t.Logical > s.Logical {
+		return 1
+	} else if t.Logical < s.Logical {
+		return -1
+	}
+	return 0
+}
+
+// Less returns whether the receiver is less than the parameter.
+func (t Timestamp) Less(s Timestamp) bool {
+	return t.WallTime < s.WallTime || (t.WallTime == s.WallTime && t.Logical < s.Logical)
+}
+
+// LessEq returns whether the receiver is less than or equal to the parameter.
+func (t Timestamp) LessEq(s Timestamp) bool {
+	return t.WallTime < s.WallTime || (t.WallTime == s.WallTime && t.Logical <= s.Logical)
+}
+
+// Add returns a timestamp with the WallTime and Logical components increased.
+// wallTime is expressed in nanos.
+func (t Timestamp) Add(wallTime int64, logical int32) Timestamp {
+	return Timestamp{
+		WallTime: t.WallTime + wallTime,
+		Logical:  t.Logical + logical,
+	}
+}
+
+// Forward replaces the receiver with the argument, if that moves it forwards in
+// time. Returns true if the timestamp was adjusted to a larger time and false
+// otherwise.
+func (t *Timestamp) Forward(s Timestamp) bool {
+	if t.Less(s) {
+		*t = s
+		return true
+	}
+	return false
+}
+
+// Backward replaces the receiver with the argument, if that moves it backwards
+// in time. Returns true if the timestamp was adjusted to a smaller time and
+// false otherwise.
+func (t *Timestamp) Backward(s Timestamp) bool {
+	if s.Less(*t) {
+		*t = s
+		return true
+	}
+	return false
+}
+
+// Next returns the timestamp with the next later timestamp.
+func (t Timestamp) Next() Timestamp {
+	if t.Logical == 1<<31-1 {
+		if t.WallTime == 1<<63-1 {
+			panic("cannot take the next value to a max timestamp")
+		}
+		return Timestamp{WallTime: t.WallTime + 1}
+	}
+	return Timestamp{WallTime: t.WallTime, Logical: t.Logical + 1}
+}
+
+// Prev returns the next earliest timestamp.
+func (t Timestamp) Prev() Timestamp {
+	if t.Logical > 0 {
+		return Timestamp{WallTime: t.WallTime, Logical: t.Logical - 1}
+	} else if t.WallTime > 0 {
+		return Timestamp{WallTime: t.WallTime - 1, Logical: 1<<31 - 1}
+	}
+	panic("cannot take the previous value to a zero timestamp")
+}
+
+// GoTime converts the timestamp to a time.Time.
+func (t Timestamp) GoTime() time.Time {
+	return time.Unix(0, t.WallTime)
+}
+
+// String implements the fmt.Stringer interface. The timestamp is formatted as
+// its wall time in seconds, with nanosecond precision, followed by its
+// logical component, e.g. "1.000000002,3".
+func (t Timestamp) String() string {
+	sign := ""
+	wallTime := t.WallTime
+	if wallTime < 0 {
+		sign, wallTime = "-", -wallTime
+	}
+	return fmt.Sprintf("%s%d.%09d,%d", sign, wallTime/1e9, wallTime%1e9, t.Logical)
 }
 
 // ClockTimestamp is a Timestamp with the added capability of being able to
@@ -10,17 +128,22 @@ type Timestamp struct {
 // system has a clock with a reading equal to or above its value.
 type ClockTimestamp Timestamp
 
+// ToTimestamp upcasts a ClockTimestamp into a Timestamp.
 func (t ClockTimestamp) ToTimestamp() Timestamp {
-	return Timestamp{}
+	return Timestamp(t)
 }
 
-// NowAsClockTimestamp is like Now, but returns a ClockTimestamp instead
-// of a raw Timestamp.
-//
-// This is the counterpart of Update, which is passed a ClockTimestamp
-// received from another member of the distributed network. As such,
-// callers that intend to use the returned timestamp to update a peer's
-// HLC clock should use this method.
-func (c *Clock) NowAsClockTimestamp() ClockTimestamp {
-	return ClockTimestamp{}
-}
+// IsEmpty returns true if t is an empty ClockTimestamp.
+func (t ClockTimestamp) IsEmpty() bool { return Timestamp(t).IsEmpty() }
+
+// Less returns whether the receiver is less than the parameter.
+func (t ClockTimestamp) Less(s ClockTimestamp) bool { return Timestamp(t).Less(Timestamp(s)) }
+
+// LessEq returns whether the receiver is less than or equal to the parameter.
+func (t ClockTimestamp) LessEq(s ClockTimestamp) bool { return Timestamp(t).LessEq(Timestamp(s)) }
+
+// Forward is like Timestamp.Forward.
+func (t *ClockTimestamp) Forward(s ClockTimestamp) bool { return (*Timestamp)(t).Forward(Timestamp(s)) }
+
+// String implements the fmt.Stringer interface.
+func (t ClockTimestamp) String() string { return Timestamp(t).String() }
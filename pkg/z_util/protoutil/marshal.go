@@ -0,0 +1,21 @@
+package protoutil
+
+import "encoding/json"
+
+// Message is the interface implemented by the structs that are persisted in
+// the engine or sent between nodes. The messages in this tree are plain Go
+// structs rather than generated protobufs, so any value that the encoding
+// below accepts is a Message.
+type Message interface{}
+
+// Marshal encodes pb into the wire format. The encoding is JSON, which keeps
+// the persisted messages self-describing; callers must not rely on the
+// encoding beyond round-tripping it through Unmarshal.
+func Marshal(pb Message) ([]byte, error) {
+	return json.Marshal(pb)
+}
+
+// Unmarshal decodes data, previously produced by Marshal, into pb.
+func Unmarshal(data []byte, pb Message) error {
+	return json.Unmarshal(data, pb)
+}
@@ -1,6 +1,14 @@
 package stop
 
-import "context"
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrUnavailable indicates that the Stopper is quiescing or stopped and
+// refuses to run new tasks.
+var ErrUnavailable = errors.New("node unavailable; try another peer")
 
 // A Stopper provides control over the lifecycle of goroutines started
 // through it via its RunTask, RunAsyncTask, and other similar methods.
@@ -51,6 +59,16 @@ import "context"
 type Stopper struct {
 	quiescer chan struct{} // Closed when quiescing
 	stopped  chan struct{} // Closed when stopped completely
+
+	// tasks tracks the async tasks started through the Stopper.
+	tasks sync.WaitGroup
+	mu    struct {
+		sync.Mutex
+		// quiescing is set once Stop is invoked; new tasks are refused.
+		quiescing bool
+		// stopping is set by the first caller of Stop.
+		stopping bool
+	}
 }
 
 // ShouldQuiesce returns a channel which will be closed when Stop() has been
@@ -63,7 +81,54 @@ func (s *Stopper) ShouldQuiesce() <-chan struct{} {
 	return s.quiescer
 }
 
+// IsStopped returns a channel which will be closed after Stop() has been
+// invoked to full completion, meaning all tasks have completed.
+func (s *Stopper) IsStopped() <-chan struct{} {
+	if s == nil {
+		return nil
+	}
+	return s.stopped
+}
+
+// WithCancelOnQuiesce returns a child context which is canceled when the
+// returned cancel function is called or when the Stopper begins to quiesce,
+// whichever happens first.
+func (s *Stopper) WithCancelOnQuiesce(ctx context.Context) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-s.ShouldQuiesce():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// RunAsyncTask is like RunAsyncTaskEx, but takes a task name that is
+// used for debugging purposes.
+func (s *Stopper) RunAsyncTask(
+	ctx context.Context, taskName string, f func(ctx context.Context),
+) error {
+	return s.RunAsyncTaskEx(ctx, f)
+}
+
+// RunAsyncTaskEx runs the function f in a goroutine. It returns
+// ErrUnavailable if the Stopper is quiescing, in which case f is never
+// invoked. Stop waits for all tasks started through it to complete.
 func (s *Stopper) RunAsyncTaskEx(ctx context.Context, f func(ctx context.Context)) error {
+	s.mu.Lock()
+	if s.mu.quiescing {
+		s.mu.Unlock()
+		return ErrUnavailable
+	}
+	s.tasks.Add(1)
+	s.mu.Unlock()
+
+	go func() {
+		defer s.tasks.Done()
+		f(ctx)
+	}()
 	return nil
 }
 
@@ -85,5 +150,17 @@ func register(s *Stopper) {
 //
 // Stop is idempotent; concurrent calls will block on each other.
 func (s *Stopper) Stop(ctx context.Context) {
+	s.mu.Lock()
+	if s.mu.stopping {
+		s.mu.Unlock()
+		<-s.stopped
+		return
+	}
+	s.mu.stopping = true
+	s.mu.quiescing = true
+	close(s.quiescer)
+	s.mu.Unlock()
 
+	s.tasks.Wait()
+	close(s.stopped)
 }
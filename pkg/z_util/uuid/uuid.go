@@ -0,0 +1,80 @@
+package uuid
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+)
+
+// Size of a UUID in bytes.
+const Size = 16
+
+// UUID is an array type to represent the value of a UUID, as defined in RFC
+// 4122.
+type UUID [Size]byte
+
+// Nil is the nil UUID, as specified in RFC-4122, that has all 128 bits set to
+// zero.
+var Nil = UUID{}
+
+// MakeV4 calls Must(NewV4)
+func MakeV4() UUID {
+	u, err := NewV4()
+	if err != nil {
+		panic(err)
+	}
+	return u
+}
+
+// NewV4 returns a randomly generated UUID.
+func NewV4() (UUID, error) {
+	var u UUID
+	if _, err := rand.Read(u[:]); err != nil {
+		return Nil, err
+	}
+	u[6] = (u[6] & 0x0f) | 0x40 // version 4
+	u[8] = (u[8] & 0x3f) | 0x80 // RFC 4122 variant
+	return u, nil
+}
+
+// FromBytes returns a UUID generated from the raw byte slice input.
+// It will return an error if the slice isn't 16 bytes long.
+func FromBytes(input []byte) (UUID, error) {
+	var u UUID
+	if len(input) != Size {
+		return Nil, fmt.Errorf("uuid: UUID must be exactly 16 bytes long, got %d bytes", len(input))
+	}
+	copy(u[:], input)
+	return u, nil
+}
+
+// GetBytes returns the UUID as a byte slice.
+func (u UUID) GetBytes() []byte {
+	return u[:]
+}
+
+// Equal returns true iff the receiver equals the argument.
+func (u UUID) Equal(t UUID) bool {
+	return u == t
+}
+
+// String returns a canonical RFC-4122 string representation of the UUID:
+// xxxxxxxx-xxxx-xxxx-xxxx-xxxxxxxxxxxx.
+func (u UUID) String() string {
+	buf := make([]byte, 36)
+	hex.Encode(buf[0:8], u[0:4])
+	buf[8] = '-'
+	hex.Encode(buf[9:13], u[4:6])
+	buf[13] = '-'
+	hex.Encode(buf[14:18], u[6:8])
+	buf[18] = '-'
+	hex.Encode(buf[19:23], u[8:10])
+	buf[23] = '-'
+	hex.Encode(buf[24:], u[10:])
+	return string(buf)
+}
+
+// Short returns the first eight characters of the output of String().
+func (u UUID) Short() string {
+	return u.String()[:8]
+}